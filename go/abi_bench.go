@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const abiBenchDefaultIterations = 1000
+
+type (
+	// abiBenchFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	abiBenchFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// abiBenchFilterConfig is the JSON configuration of the ABI benchmark filter.
+	abiBenchFilterConfig struct {
+		// Iterations is the number of calls timed per operation and request. Defaults to 1000.
+		Iterations int `json:"iterations"`
+	}
+	// abiBenchFilterFactory implements [shared.HttpFilterFactory].
+	abiBenchFilterFactory struct {
+		iterations int
+		calls      shared.MetricID
+		hasMetric  bool
+	}
+	// abiBenchFilter implements [shared.HttpFilter].
+	//
+	// This filter measures the cost of the calls crossing the cgo boundary into Envoy. Each
+	// operation is called in a loop on every request, and the mean time per call is recorded in
+	// the abi_bench_call_nanoseconds histogram and returned in the x-abi-bench-<operation>-ns
+	// response headers, so that the SDK changes can be compared with numbers. It is meant for a
+	// benchmark listener, not for production traffic.
+	abiBenchFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *abiBenchFilterFactory
+		// results are the mean nanoseconds per call of the operations measured so far.
+		results [][2]string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *abiBenchFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config abiBenchFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse ABI bench config: %w", err)
+		}
+	}
+	if config.Iterations <= 0 {
+		config.Iterations = abiBenchDefaultIterations
+	}
+	f := &abiBenchFilterFactory{iterations: config.Iterations}
+	id, res := handle.DefineHistogram("abi_bench_call_nanoseconds", "operation")
+	if res == shared.MetricsSuccess {
+		f.calls, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the ABI bench histogram: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *abiBenchFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &abiBenchFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *abiBenchFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.measure("header_get", func() { headers.GetOne("user-agent") })
+	p.measure("header_get_all", func() { headers.GetAll() })
+	p.measure("header_set", func() { headers.Set("x-abi-bench", "value") })
+	headers.Remove("x-abi-bench")
+	p.measure("attribute", func() { p.handle.GetAttributeString(shared.AttributeIDSourceAddress) })
+
+	// The scheduler is measured from the goroutine scheduling the callbacks until the last one
+	// runs on the worker thread, which includes the wakeup of the event loop.
+	iterations := p.factory.iterations
+	scheduler := p.handle.GetScheduler()
+	go func() {
+		start := time.Now()
+		for i := range iterations {
+			last := i == iterations-1
+			scheduler.Schedule(func() {
+				if last {
+					p.record("scheduler", time.Since(start))
+					p.handle.ContinueRequest()
+				}
+			})
+		}
+	}()
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *abiBenchFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if endOfStream {
+		p.measure("body_get_chunks", func() { body.GetChunks() })
+		p.measure("body_get_size", func() { body.GetSize() })
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *abiBenchFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	for _, result := range p.results {
+		headers.Set("x-abi-bench-"+result[0]+"-ns", result[1])
+	}
+	return shared.HeadersStatusContinue
+}
+
+// measure calls fn the configured number of times, and records the mean time per call.
+func (p *abiBenchFilter) measure(operation string, fn func()) {
+	start := time.Now()
+	for range p.factory.iterations {
+		fn()
+	}
+	p.record(operation, time.Since(start))
+}
+
+func (p *abiBenchFilter) record(operation string, elapsed time.Duration) {
+	perCall := float64(elapsed.Nanoseconds()) / float64(p.factory.iterations)
+	p.results = append(p.results, [2]string{operation, strconv.FormatFloat(perCall, 'f', 1, 64)})
+	if p.factory.hasMetric {
+		p.handle.RecordHistogramValue(p.factory.calls, uint64(perCall), operation)
+	}
+}
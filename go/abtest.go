@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	abTestDefaultHeader       = "x-experiment"
+	abTestDefaultCookieMaxAge = 30 * 24 * 60 * 60
+)
+
+type (
+	// abTestFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	abTestFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// abTestFilterConfig is the JSON configuration of the A/B test filter.
+	abTestFilterConfig struct {
+		// Experiment is the name of the experiment. It is mixed into the hash so that the
+		// experiments split the users independently.
+		Experiment string `json:"experiment" example:"checkout"`
+		// Variants are the buckets the traffic is split into, proportionally to their weights.
+		Variants []abTestVariant `json:"variants" example:"[{name: control, weight: 50}, {name: treatment, weight: 50}]"`
+		// KeyHeader is the request header identifying the user, e.g. "x-user-id". The users without
+		// it are assigned randomly.
+		KeyHeader string `json:"key_header"`
+		// Header is the request header set to the variant name. Defaults to "x-experiment".
+		Header string `json:"header"`
+		// Cookie is the name of the sticky cookie. Defaults to "ab_" followed by the experiment.
+		Cookie string `json:"cookie"`
+		// CookieMaxAgeSeconds defaults to 30 days.
+		CookieMaxAgeSeconds int `json:"cookie_max_age_seconds"`
+	}
+	abTestVariant struct {
+		Name   string `json:"name"`
+		Weight uint64 `json:"weight"`
+	}
+	// abTestFilterFactory implements [shared.HttpFilterFactory].
+	abTestFilterFactory struct {
+		config      abTestFilterConfig
+		totalWeight uint64
+		requests    shared.MetricID
+		hasMetric   bool
+	}
+	// abTestFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to change the route selection from a filter: it sets a header
+	// that the routes match on, and clears the route cache so that Envoy selects the route again.
+	abTestFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *abTestFilterFactory
+		// setCookie is set if the sticky cookie needs to be set on the response.
+		setCookie string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *abTestFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config abTestFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse A/B test config: %w", err)
+	}
+	if config.Experiment == "" {
+		return nil, fmt.Errorf("experiment must be set")
+	}
+	f := &abTestFilterFactory{config: config}
+	for _, v := range config.Variants {
+		if v.Name == "" {
+			return nil, fmt.Errorf("variant name must be set")
+		}
+		f.totalWeight += v.Weight
+	}
+	if f.totalWeight == 0 {
+		return nil, fmt.Errorf("variants must have a positive total weight")
+	}
+	if f.config.Header == "" {
+		f.config.Header = abTestDefaultHeader
+	}
+	if f.config.Cookie == "" {
+		f.config.Cookie = "ab_" + config.Experiment
+	}
+	if f.config.CookieMaxAgeSeconds <= 0 {
+		f.config.CookieMaxAgeSeconds = abTestDefaultCookieMaxAge
+	}
+	id, res := handle.DefineCounter("ab_test_requests_total", "experiment", "variant")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the A/B test counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *abTestFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &abTestFilter{handle: handle, factory: p}
+}
+
+// variant returns the variant for the point in [0, totalWeight).
+func (p *abTestFilterFactory) variant(point uint64) string {
+	for _, v := range p.config.Variants {
+		if point < v.Weight {
+			return v.Name
+		}
+		point -= v.Weight
+	}
+	return p.config.Variants[len(p.config.Variants)-1].Name
+}
+
+// isVariant reports whether name is one of the variants with a positive weight.
+func (p *abTestFilterFactory) isVariant(name string) bool {
+	for _, v := range p.config.Variants {
+		if v.Name == name && v.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// assign returns the variant of the request and whether the sticky cookie needs to be set.
+func (p *abTestFilterFactory) assign(headers shared.HeaderMap) (string, bool) {
+	if v, ok := requestCookie(headers, p.config.Cookie); ok && p.isVariant(v) {
+		return v, false
+	}
+	if p.config.KeyHeader != "" {
+		if key := headers.GetOne(p.config.KeyHeader); key != "" {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(p.config.Experiment))
+			_, _ = h.Write([]byte{0})
+			_, _ = h.Write([]byte(key))
+			return p.variant(h.Sum64() % p.totalWeight), true
+		}
+	}
+	return p.variant(rand.Uint64() % p.totalWeight), true
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *abTestFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	variant, setCookie := p.factory.assign(headers)
+	headers.Set(p.factory.config.Header, variant)
+	// The route was selected before this filter, so clear it to make the routes matching on the
+	// variant header take effect.
+	p.handle.ClearRouteCache()
+	if setCookie {
+		p.setCookie = (&http.Cookie{
+			Name:     p.factory.config.Cookie,
+			Value:    variant,
+			Path:     "/",
+			MaxAge:   p.factory.config.CookieMaxAgeSeconds,
+			HttpOnly: true,
+		}).String()
+	}
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, p.factory.config.Experiment, variant)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *abTestFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.setCookie != "" {
+		headers.Add("set-cookie", p.setCookie)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// requestCookie returns the value of the named cookie in the request.
+func requestCookie(headers shared.HeaderMap, name string) (string, bool) {
+	for _, line := range headers.Get("cookie") {
+		for _, part := range strings.Split(line, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if ok && k == name {
+				if unquoted, err := strconv.Unquote(v); err == nil {
+					v = unquoted
+				}
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
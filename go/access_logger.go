@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	accessLogFormatJSON     = "json"
+	accessLogFormatCommon   = "common"
+	accessLogFormatCombined = "combined"
+
+	accessLogDefaultMaxFileBytes = 100 << 20
+	accessLogDefaultMaxBackups   = 3
+	accessLogDefaultQueueSize    = 1024
+	accessLogWriteBufferBytes    = 64 << 10
+)
+
+// accessLogFormats are the named text formats. The time layout is Go's, not strftime.
+var accessLogFormats = map[string]string{
+	accessLogFormatCommon: `%CLIENT_IP% - - [%START_TIME(02/Jan/2006:15:04:05 -0700)%] "%METHOD% %PATH% %PROTOCOL%" ` +
+		`%RESPONSE_CODE% %BYTES_SENT%`,
+	accessLogFormatCombined: `%CLIENT_IP% - - [%START_TIME(02/Jan/2006:15:04:05 -0700)%] "%METHOD% %PATH% %PROTOCOL%" ` +
+		`%RESPONSE_CODE% %BYTES_SENT% "%REQ(referer)%" "%REQ(user-agent)%"`,
+}
+
+// accessLogDefaultJSONFields are the fields of the JSON format when json_fields is not set.
+var accessLogDefaultJSONFields = map[string]string{
+	"start_time":     "%START_TIME%",
+	"method":         "%METHOD%",
+	"path":           "%PATH%",
+	"protocol":       "%PROTOCOL%",
+	"authority":      "%AUTHORITY%",
+	"client_ip":      "%CLIENT_IP%",
+	"route":          "%ROUTE_NAME%",
+	"response_code":  "%RESPONSE_CODE%",
+	"bytes_received": "%BYTES_RECEIVED%",
+	"bytes_sent":     "%BYTES_SENT%",
+	"duration_ms":    "%DURATION%",
+	"user_agent":     "%REQ(user-agent)%",
+	"request_id":     "%REQ(x-request-id)%",
+}
+
+// accessLogWriters are the writers by the path. A writer and its goroutine outlive the filter
+// configs since there is no hook to stop them, so the configs logging to the same file share one
+// rather than leaking one on every config update.
+var accessLogWriters sync.Map // map[string]*accessLogWriter
+
+type (
+	// accessLoggerFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	accessLoggerFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// accessLoggerFilterConfig is the JSON configuration of the access logger filter.
+	accessLoggerFilterConfig struct {
+		// Path is the file the access logs are appended to.
+		Path string `json:"path" example:"/dev/stdout"`
+		// Format is "json", "common", "combined", or a format string of the placeholders such as
+		// "%METHOD% %PATH% %RESPONSE_CODE%". Defaults to "json". The placeholders are %START_TIME%,
+		// optionally with a Go time layout as in %START_TIME(15:04:05)%, %METHOD%, %PATH%,
+		// %PROTOCOL%, %AUTHORITY%, %CLIENT_IP%, %ROUTE_NAME%, %RESPONSE_CODE%, %BYTES_RECEIVED%,
+		// %BYTES_SENT%, %DURATION% in milliseconds, %REQ(header)%, and %RESP(header)%.
+		Format string `json:"format"`
+		// JSONFields are the fields of the JSON format by their format strings. Defaults to the
+		// common request and response properties.
+		JSONFields map[string]string `json:"json_fields"`
+		// MaxFileBytes is the size the file is rotated at. Defaults to 100 MiB.
+		MaxFileBytes int64 `json:"max_file_bytes"`
+		// MaxBackups is the number of the rotated files kept as Path.1, Path.2, and so on.
+		// Defaults to 3.
+		MaxBackups int `json:"max_backups"`
+		// QueueSize is the number of the lines queued for the writer. The lines are dropped when it
+		// is full rather than blocking the worker thread. Defaults to 1024.
+		QueueSize int `json:"queue_size"`
+	}
+	// accessLoggerFilterFactory implements [shared.HttpFilterFactory].
+	accessLoggerFilterFactory struct {
+		format *accessLogFormat
+		writer *accessLogWriter
+		// requestHeaders and responseHeaders are the headers the format refers to.
+		requestHeaders  []string
+		responseHeaders []string
+		records         shared.MetricID
+		hasMetric       bool
+	}
+	// accessLoggerFilter implements [shared.HttpFilter].
+	//
+	// The line is formatted when the stream completes, and handed to the writer goroutine so
+	// that the worker thread never waits on the disk.
+	accessLoggerFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *accessLoggerFilterFactory
+		entry   accessLogEntry
+		shared.EmptyHttpFilter
+	}
+	// accessLogEntry is what is known about a request when its stream completes.
+	accessLogEntry struct {
+		start           time.Time
+		duration        time.Duration
+		method          string
+		path            string
+		protocol        string
+		authority       string
+		clientIP        string
+		route           string
+		status          int
+		bytesReceived   uint64
+		bytesSent       uint64
+		requestHeaders  map[string]string
+		responseHeaders map[string]string
+	}
+	// accessLogFormat formats the entries either as text or as JSON objects.
+	accessLogFormat struct {
+		text       accessLogTemplate
+		jsonFields []accessLogJSONField
+	}
+	accessLogJSONField struct {
+		name     string
+		template accessLogTemplate
+	}
+	// accessLogTemplate is a parsed format string.
+	accessLogTemplate []accessLogSegment
+	// accessLogSegment is either a literal or a field.
+	accessLogSegment struct {
+		literal string
+		field   func(e *accessLogEntry) string
+		// numeric is set for the fields that are numbers in JSON.
+		numeric bool
+	}
+	// accessLogWriter appends the lines to the file from its own goroutine, rotating the file
+	// when it grows too large.
+	accessLogWriter struct {
+		path         string
+		maxFileBytes int64
+		maxBackups   int
+		lines        chan []byte
+		file         *os.File
+		buf          *bufio.Writer
+		size         int64
+		// logf is the log of the config that started the writer.
+		logf logFunc
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *accessLoggerFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config accessLoggerFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse access logger config: %w", err)
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("path must be set")
+	}
+	if config.MaxFileBytes <= 0 {
+		config.MaxFileBytes = accessLogDefaultMaxFileBytes
+	}
+	if config.MaxBackups <= 0 {
+		config.MaxBackups = accessLogDefaultMaxBackups
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = accessLogDefaultQueueSize
+	}
+	f := &accessLoggerFilterFactory{format: &accessLogFormat{}}
+	var err error
+	switch config.Format {
+	case "", accessLogFormatJSON:
+		fields := config.JSONFields
+		if len(fields) == 0 {
+			fields = accessLogDefaultJSONFields
+		}
+		for name, format := range fields {
+			field := accessLogJSONField{name: name}
+			if field.template, err = f.parseTemplate(format); err != nil {
+				return nil, fmt.Errorf("invalid json_fields %q: %w", name, err)
+			}
+			f.format.jsonFields = append(f.format.jsonFields, field)
+		}
+		// The map order is random, and the lines are easier to read with the same order.
+		slices.SortFunc(f.format.jsonFields, func(a, b accessLogJSONField) int { return strings.Compare(a.name, b.name) })
+	default:
+		format := config.Format
+		if named, ok := accessLogFormats[format]; ok {
+			format = named
+		}
+		if f.format.text, err = f.parseTemplate(format); err != nil {
+			return nil, fmt.Errorf("invalid format: %w", err)
+		}
+	}
+	if f.writer, err = openAccessLogWriter(config.Path, config.MaxFileBytes, config.MaxBackups, config.QueueSize, handle.Log); err != nil {
+		return nil, err
+	}
+	id, res := handle.DefineCounter("access_log_records_total", "result")
+	if res == shared.MetricsSuccess {
+		f.records, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the access log counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *accessLoggerFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &accessLoggerFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *accessLoggerFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	e := &p.entry
+	e.start = time.Now()
+	e.method = strings.Clone(headers.GetOne(":method"))
+	e.path = strings.Clone(headers.GetOne(":path"))
+	e.authority = strings.Clone(headers.GetOne(":authority"))
+	e.requestHeaders = captureAccessLogHeaders(headers, p.factory.requestHeaders)
+	if protocol, ok := p.handle.GetAttributeString(shared.AttributeIDRequestProtocol); ok {
+		e.protocol = strings.Clone(protocol)
+	}
+	if source, ok := p.handle.GetAttributeString(shared.AttributeIDSourceAddress); ok {
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			source = host
+		}
+		e.clientIP = strings.Clone(source)
+	}
+	if route, ok := p.handle.GetAttributeString(shared.AttributeIDXdsRouteName); ok {
+		e.route = strings.Clone(route)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *accessLoggerFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.entry.status, _ = strconv.Atoi(headers.GetOne(":status"))
+	p.entry.responseHeaders = captureAccessLogHeaders(headers, p.factory.responseHeaders)
+	return shared.HeadersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *accessLoggerFilter) OnStreamComplete() {
+	e := &p.entry
+	if e.start.IsZero() {
+		return
+	}
+	e.duration = time.Since(e.start)
+	if size, ok := p.handle.GetAttributeNumber(shared.AttributeIDRequestSize); ok {
+		e.bytesReceived = uint64(size)
+	}
+	if size, ok := p.handle.GetAttributeNumber(shared.AttributeIDResponseSize); ok {
+		e.bytesSent = uint64(size)
+	}
+	result := "queued"
+	select {
+	case p.factory.writer.lines <- p.factory.format.format(e):
+	default:
+		result = "dropped"
+	}
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.records, 1, result)
+	}
+}
+
+// parseTemplate parses the format string, and collects the headers it refers to.
+func (p *accessLoggerFilterFactory) parseTemplate(format string) (accessLogTemplate, error) {
+	var t accessLogTemplate
+	for format != "" {
+		start := strings.IndexByte(format, '%')
+		if start < 0 {
+			t = append(t, accessLogSegment{literal: format})
+			break
+		}
+		end := strings.IndexByte(format[start+1:], '%')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder %q", format[start:])
+		}
+		end += start + 1
+		if start > 0 {
+			t = append(t, accessLogSegment{literal: format[:start]})
+		}
+		segment, err := p.parsePlaceholder(format[start+1 : end])
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, segment)
+		format = format[end+1:]
+	}
+	return t, nil
+}
+
+func (p *accessLoggerFilterFactory) parsePlaceholder(name string) (accessLogSegment, error) {
+	arg := ""
+	if open := strings.IndexByte(name, '('); open >= 0 && strings.HasSuffix(name, ")") {
+		name, arg = name[:open], name[open+1:len(name)-1]
+	}
+	switch name {
+	case "START_TIME":
+		layout := cmp.Or(arg, time.RFC3339Nano)
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.start.Format(layout) }}, nil
+	case "METHOD":
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.method }}, nil
+	case "PATH":
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.path }}, nil
+	case "PROTOCOL":
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.protocol }}, nil
+	case "AUTHORITY":
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.authority }}, nil
+	case "CLIENT_IP":
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.clientIP }}, nil
+	case "ROUTE_NAME":
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.route }}, nil
+	case "RESPONSE_CODE":
+		return accessLogSegment{numeric: true, field: func(e *accessLogEntry) string {
+			if e.status == 0 {
+				return ""
+			}
+			return strconv.Itoa(e.status)
+		}}, nil
+	case "BYTES_RECEIVED":
+		return accessLogSegment{numeric: true, field: func(e *accessLogEntry) string { return strconv.FormatUint(e.bytesReceived, 10) }}, nil
+	case "BYTES_SENT":
+		return accessLogSegment{numeric: true, field: func(e *accessLogEntry) string { return strconv.FormatUint(e.bytesSent, 10) }}, nil
+	case "DURATION":
+		return accessLogSegment{numeric: true, field: func(e *accessLogEntry) string { return strconv.FormatInt(e.duration.Milliseconds(), 10) }}, nil
+	case "REQ", "RESP":
+		if arg == "" {
+			return accessLogSegment{}, fmt.Errorf("%%%s%% needs a header name", name)
+		}
+		header := strings.ToLower(arg)
+		if name == "REQ" {
+			p.requestHeaders = append(p.requestHeaders, header)
+			return accessLogSegment{field: func(e *accessLogEntry) string { return e.requestHeaders[header] }}, nil
+		}
+		p.responseHeaders = append(p.responseHeaders, header)
+		return accessLogSegment{field: func(e *accessLogEntry) string { return e.responseHeaders[header] }}, nil
+	}
+	return accessLogSegment{}, fmt.Errorf("unknown placeholder %%%s%%", name)
+}
+
+// format returns the line of the entry including the trailing newline.
+func (f *accessLogFormat) format(e *accessLogEntry) []byte {
+	if f.jsonFields == nil {
+		return append(f.text.render(e, "-", true), '\n')
+	}
+	line := []byte{'{'}
+	for i, field := range f.jsonFields {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = strconv.AppendQuote(line, field.name)
+		line = append(line, ':')
+		value := field.template.render(e, "", false)
+		switch {
+		case len(value) == 0:
+			line = append(line, "null"...)
+		case len(field.template) == 1 && field.template[0].numeric:
+			line = append(line, value...)
+		default:
+			encoded, _ := json.Marshal(string(value))
+			line = append(line, encoded...)
+		}
+	}
+	return append(line, '}', '\n')
+}
+
+// render renders the template, with the missing values as missing.
+func (t accessLogTemplate) render(e *accessLogEntry, missing string, escape bool) []byte {
+	var out []byte
+	for _, s := range t {
+		if s.field == nil {
+			out = append(out, s.literal...)
+			continue
+		}
+		v := s.field(e)
+		switch {
+		case v == "":
+			out = append(out, missing...)
+		case escape:
+			out = appendAccessLogEscaped(out, v)
+		default:
+			out = append(out, v...)
+		}
+	}
+	return out
+}
+
+// appendAccessLogEscaped escapes the quotes, the backslashes, and the non-printable bytes as
+// Apache does, so that a client can't break the fields or forge the lines of the text formats.
+func appendAccessLogEscaped(out []byte, v string) []byte {
+	const hexDigits = "0123456789abcdef"
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"' || c == '\\':
+			out = append(out, '\\', c)
+		case c < ' ' || c > '~':
+			out = append(out, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func captureAccessLogHeaders(headers shared.HeaderMap, names []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	captured := make(map[string]string, len(names))
+	for _, name := range names {
+		if v := headers.GetOne(name); v != "" {
+			captured[name] = strings.Clone(v)
+		}
+	}
+	return captured
+}
+
+// openAccessLogWriter returns the writer of the path, starting it if it is not running yet. It
+// fails if the writer that is already running rotates the file differently, such as when the path
+// of an access log is also the path of the audit log, which is never rotated.
+func openAccessLogWriter(path string, maxFileBytes int64, maxBackups, queueSize int, logf logFunc) (*accessLogWriter, error) {
+	if w, ok := accessLogWriters.Load(path); ok {
+		return w.(*accessLogWriter).check(maxFileBytes, maxBackups)
+	}
+	w := &accessLogWriter{path: path, maxFileBytes: maxFileBytes, maxBackups: maxBackups, lines: make(chan []byte, queueSize), logf: logf}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	if actual, loaded := accessLogWriters.LoadOrStore(path, w); loaded {
+		_ = w.file.Close()
+		return actual.(*accessLogWriter).check(maxFileBytes, maxBackups)
+	}
+	go w.run()
+	return w, nil
+}
+
+// check returns the writer if it rotates the file with the settings.
+func (w *accessLogWriter) check(maxFileBytes int64, maxBackups int) (*accessLogWriter, error) {
+	if w.maxFileBytes != maxFileBytes || w.maxBackups != maxBackups {
+		return nil, fmt.Errorf("%s is already written with other rotation settings", w.path)
+	}
+	return w, nil
+}
+
+func (w *accessLogWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the access log: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat the access log: %w", err)
+	}
+	w.file, w.size = file, stat.Size()
+	if w.buf == nil {
+		w.buf = bufio.NewWriterSize(file, accessLogWriteBufferBytes)
+	} else {
+		w.buf.Reset(file)
+	}
+	return nil
+}
+
+// run writes the lines as they come, and flushes whenever the queue is drained so that the lines
+// reach the file soon after the streams complete without a write per line under load.
+func (w *accessLogWriter) run() {
+	for line := range w.lines {
+		if w.file == nil || w.size+int64(len(line)) > w.maxFileBytes {
+			w.rotate()
+		}
+		if w.file == nil {
+			continue
+		}
+		n, _ := w.buf.Write(line)
+		w.size += int64(n)
+		if len(w.lines) == 0 {
+			if err := w.buf.Flush(); err != nil {
+				w.logf(shared.LogLevelError, "failed to write the access log %s: %v", w.path, err)
+			}
+		}
+	}
+}
+
+// rotate shifts the backups, moves the current file to Path.1, and opens a new one. If the file
+// can't be reopened, the lines are dropped until it can.
+func (w *accessLogWriter) rotate() {
+	if w.file != nil {
+		_ = w.buf.Flush()
+		_ = w.file.Close()
+		w.file = nil
+		for i := w.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(w.path+"."+strconv.Itoa(i), w.path+"."+strconv.Itoa(i+1))
+		}
+		_ = os.Rename(w.path, w.path+".1")
+	}
+	if err := w.open(); err != nil {
+		w.logf(shared.LogLevelError, "failed to rotate the access log %s: %v", w.path, err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	adaptiveConcurrencyDefaultInitialLimit = 20
+	adaptiveConcurrencyDefaultMinLimit     = 1
+	adaptiveConcurrencyDefaultMaxLimit     = 1000
+	adaptiveConcurrencyDefaultWindow       = 100 * time.Millisecond
+	adaptiveConcurrencyDefaultMinSamples   = 10
+	adaptiveConcurrencyDefaultLongWindow   = 60
+	adaptiveConcurrencyDefaultSmoothing    = 0.2
+	adaptiveConcurrencyDefaultRetryAfter   = 1
+)
+
+type (
+	// adaptiveConcurrencyFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	adaptiveConcurrencyFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// adaptiveConcurrencyFilterConfig is the JSON configuration of the adaptive concurrency filter.
+	adaptiveConcurrencyFilterConfig struct {
+		// InitialLimit is the concurrency limit of a route before any latency is measured.
+		// Defaults to 20.
+		InitialLimit int `json:"initial_limit"`
+		// MinLimit and MaxLimit bound the concurrency limit. Default to 1 and 1000.
+		MinLimit int `json:"min_limit"`
+		MaxLimit int `json:"max_limit"`
+		// SampleWindowMs is how often the limit is recalculated from the latencies measured in the
+		// window. Defaults to 100ms.
+		SampleWindowMs int `json:"sample_window_ms"`
+		// MinSamples is the number of the latencies a window needs for the limit to be recalculated.
+		// Defaults to 10.
+		MinSamples int `json:"min_samples"`
+		// LongWindow is the number of the sample windows the baseline latency is averaged over.
+		// Defaults to 60.
+		LongWindow int `json:"long_window"`
+		// Smoothing is the weight of the new limit over the current one, from 0 to 1. Defaults to 0.2.
+		Smoothing float64 `json:"smoothing"`
+		// RetryAfterSeconds is sent in the Retry-After header of the 503 responses. Defaults to 1.
+		RetryAfterSeconds int `json:"retry_after_seconds"`
+	}
+	// adaptiveConcurrencyFilterFactory implements [shared.HttpFilterFactory].
+	adaptiveConcurrencyFilterFactory struct {
+		config     adaptiveConcurrencyFilterConfig
+		window     time.Duration
+		retryAfter string
+		// limiters holds the *concurrencyLimiter of each route. They are shared across all the
+		// worker threads since the requests in flight must be counted across all of them.
+		limiters  sync.Map
+		limit     shared.MetricID
+		inFlight  shared.MetricID
+		requests  shared.MetricID
+		hasLimit  bool
+		hasFlight bool
+		hasReqs   bool
+	}
+	// concurrencyLimiter caps the requests in flight of a route with a gradient limiter: the limit
+	// shrinks as the recent latency grows over the long-term baseline, and grows by the square
+	// root of the limit otherwise so that the queue the upstream builds up stays small.
+	concurrencyLimiter struct {
+		// inFlight and limit are read and updated on the request path without the lock.
+		inFlight atomic.Int64
+		limit    atomic.Int64
+
+		// The rest is guarded by mux and only updated as the requests complete.
+		mux         sync.Mutex
+		windowStart time.Time
+		sampleSum   time.Duration
+		samples     int
+		maxInFlight int64
+		// longRTT is the exponential moving average of the window latencies in nanoseconds.
+		longRTT float64
+		// estimate is the unrounded limit.
+		estimate float64
+	}
+	// adaptiveConcurrencyFilter implements [shared.HttpFilter].
+	adaptiveConcurrencyFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *adaptiveConcurrencyFilterFactory
+		// limiter is set while the request holds a slot of the route.
+		limiter *concurrencyLimiter
+		route   string
+		start   time.Time
+		latency time.Duration
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *adaptiveConcurrencyFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config adaptiveConcurrencyFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse adaptive concurrency config: %w", err)
+		}
+	}
+	if config.MinLimit <= 0 {
+		config.MinLimit = adaptiveConcurrencyDefaultMinLimit
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = adaptiveConcurrencyDefaultMaxLimit
+	}
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = adaptiveConcurrencyDefaultInitialLimit
+	}
+	if config.MinLimit > config.MaxLimit {
+		return nil, fmt.Errorf("min_limit %d is greater than max_limit %d", config.MinLimit, config.MaxLimit)
+	}
+	config.InitialLimit = min(max(config.InitialLimit, config.MinLimit), config.MaxLimit)
+	if config.MinSamples <= 0 {
+		config.MinSamples = adaptiveConcurrencyDefaultMinSamples
+	}
+	if config.LongWindow <= 0 {
+		config.LongWindow = adaptiveConcurrencyDefaultLongWindow
+	}
+	if config.Smoothing <= 0 || config.Smoothing > 1 {
+		config.Smoothing = adaptiveConcurrencyDefaultSmoothing
+	}
+	if config.RetryAfterSeconds <= 0 {
+		config.RetryAfterSeconds = adaptiveConcurrencyDefaultRetryAfter
+	}
+	f := &adaptiveConcurrencyFilterFactory{
+		config:     config,
+		window:     time.Duration(config.SampleWindowMs) * time.Millisecond,
+		retryAfter: strconv.Itoa(config.RetryAfterSeconds),
+	}
+	if f.window <= 0 {
+		f.window = adaptiveConcurrencyDefaultWindow
+	}
+	if id, res := handle.DefineGauge("adaptive_concurrency_limit", "route"); res == shared.MetricsSuccess {
+		f.limit, f.hasLimit = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the adaptive concurrency limit gauge: %v", res)
+	}
+	if id, res := handle.DefineGauge("adaptive_concurrency_in_flight", "route"); res == shared.MetricsSuccess {
+		f.inFlight, f.hasFlight = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the adaptive concurrency in flight gauge: %v", res)
+	}
+	if id, res := handle.DefineCounter("adaptive_concurrency_requests_total", "route", "result"); res == shared.MetricsSuccess {
+		f.requests, f.hasReqs = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the adaptive concurrency counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *adaptiveConcurrencyFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &adaptiveConcurrencyFilter{handle: handle, factory: p}
+}
+
+func (p *adaptiveConcurrencyFilterFactory) limiter(route string) *concurrencyLimiter {
+	if l, ok := p.limiters.Load(route); ok {
+		return l.(*concurrencyLimiter)
+	}
+	l := &concurrencyLimiter{estimate: float64(p.config.InitialLimit)}
+	l.limit.Store(int64(p.config.InitialLimit))
+	actual, _ := p.limiters.LoadOrStore(route, l)
+	return actual.(*concurrencyLimiter)
+}
+
+// acquire takes a slot, and reports false if the limit has been reached.
+func (l *concurrencyLimiter) acquire() bool {
+	if l.inFlight.Add(1) > l.limit.Load() {
+		l.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release returns the slot taken by acquire, and recalculates the limit at the end of the sample
+// window. The latency is zero if the request got no response, in which case it is not sampled.
+func (l *concurrencyLimiter) release(config *adaptiveConcurrencyFilterConfig, window, latency time.Duration, now time.Time) {
+	inFlight := l.inFlight.Add(-1) + 1
+	if latency <= 0 {
+		return
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.sampleSum += latency
+	l.samples++
+	l.maxInFlight = max(l.maxInFlight, inFlight)
+	if now.Sub(l.windowStart) < window || l.samples < config.MinSamples {
+		return
+	}
+
+	shortRTT := float64(l.sampleSum) / float64(l.samples)
+	if l.longRTT == 0 {
+		l.longRTT = shortRTT
+	} else {
+		l.longRTT += (shortRTT - l.longRTT) / float64(config.LongWindow)
+	}
+	// The requests in flight staying well below the limit means the traffic, not the upstream,
+	// is what's limiting, so growing the limit further would only make it meaningless.
+	appLimited := l.maxInFlight*2 < int64(l.estimate)
+	l.windowStart, l.sampleSum, l.samples, l.maxInFlight = now, 0, 0, 0
+
+	gradient := max(0.5, min(1, l.longRTT/shortRTT))
+	next := l.estimate*gradient + math.Sqrt(l.estimate)
+	if appLimited && next > l.estimate {
+		return
+	}
+	l.estimate = l.estimate*(1-config.Smoothing) + next*config.Smoothing
+	l.estimate = max(float64(config.MinLimit), min(float64(config.MaxLimit), l.estimate))
+	l.limit.Store(int64(l.estimate))
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *adaptiveConcurrencyFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	// The requests on the routes without a name share a limiter.
+	route, _ := p.handle.GetAttributeString(shared.AttributeIDXdsRouteName)
+	route = strings.Clone(route)
+	limiter := p.factory.limiter(route)
+	if !limiter.acquire() {
+		p.count(route, "rejected")
+		p.handle.SendLocalResponse(http.StatusServiceUnavailable,
+			[][2]string{{"Content-Type", "text/plain"}, {"Retry-After", p.factory.retryAfter}},
+			[]byte("Service Unavailable\n"), "adaptive_concurrency_limited")
+		return shared.HeadersStatusStop
+	}
+	p.count(route, "accepted")
+	if p.factory.hasFlight {
+		p.handle.IncrementGaugeValue(p.factory.inFlight, 1, route)
+	}
+	p.limiter, p.route, p.start = limiter, route, time.Now()
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *adaptiveConcurrencyFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.limiter != nil {
+		p.latency = time.Since(p.start)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *adaptiveConcurrencyFilter) OnStreamComplete() {
+	if p.limiter == nil {
+		return
+	}
+	latency := p.latency
+	// Envoy's own measurement of the upstream latency excludes the time spent in the filters, so
+	// it is preferred when available. It is reported in milliseconds, which is too coarse for
+	// the fast upstreams.
+	if ms, ok := p.handle.GetAttributeNumber(shared.AttributeIDResponseBackendLatency); ok && ms >= 1 && latency > 0 {
+		latency = time.Duration(ms * float64(time.Millisecond))
+	}
+	p.limiter.release(&p.factory.config, p.factory.window, latency, time.Now())
+	if p.factory.hasFlight {
+		p.handle.DecrementGaugeValue(p.factory.inFlight, 1, p.route)
+	}
+	if p.factory.hasLimit {
+		p.handle.SetGaugeValue(p.factory.limit, uint64(p.limiter.limit.Load()), p.route)
+	}
+	p.limiter = nil
+}
+
+func (p *adaptiveConcurrencyFilter) count(route, result string) {
+	if p.factory.hasReqs {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, route, result)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	apiKeyDefaultHeader               = "x-api-key"
+	apiKeyDefaultMetadataHeaderPrefix = "x-api-key-"
+	apiKeyDefaultReloadInterval       = 5 * time.Second
+)
+
+type (
+	// apiKeyFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	apiKeyFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// apiKeyFilterConfig is the JSON configuration of the API key filter.
+	apiKeyFilterConfig struct {
+		// Header is the request header carrying the key. Defaults to "x-api-key".
+		Header string `json:"header"`
+		// QueryParam is the query parameter carrying the key. It is only consulted when the header
+		// is absent.
+		QueryParam string `json:"query_param"`
+		// Keys are the inline keys.
+		Keys []apiKey `json:"keys" example:"[{key: example-key}]"`
+		// KeysFile is the path to a JSON file containing a list of keys in the same format as Keys.
+		// It is reloaded when it changes.
+		KeysFile string `json:"keys_file"`
+		// ReloadIntervalMs is how often KeysFile is checked for changes. Defaults to 5 seconds.
+		ReloadIntervalMs int `json:"reload_interval_ms"`
+		// MetadataHeaderPrefix is prepended to the metadata names to make the request headers.
+		// Defaults to "x-api-key-".
+		MetadataHeaderPrefix string `json:"metadata_header_prefix"`
+	}
+	// apiKey is a key and the metadata, such as the tenant and the plan, associated with it.
+	apiKey struct {
+		Key      string            `json:"key"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	// apiKeyStore maps the SHA-256 of the keys to the metadata so that the lookup doesn't depend
+	// on the key bytes.
+	apiKeyStore map[[sha256.Size]byte]map[string]string
+	// apiKeyFilterFactory implements [shared.HttpFilterFactory].
+	apiKeyFilterFactory struct {
+		header               string
+		queryParam           string
+		metadataHeaderPrefix string
+		inline               apiKeyStore
+		// file is nil if keys_file is not set.
+		file *reloadableFile[apiKeyStore]
+	}
+	// apiKeyFilter implements [shared.HttpFilter].
+	apiKeyFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *apiKeyFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *apiKeyFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config apiKeyFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse API key config: %w", err)
+	}
+	if len(config.Keys) == 0 && config.KeysFile == "" {
+		return nil, fmt.Errorf("keys or keys_file must be set")
+	}
+	inline, err := newAPIKeyStore(config.Keys)
+	if err != nil {
+		return nil, err
+	}
+	f := &apiKeyFilterFactory{
+		header:               strings.ToLower(config.Header),
+		queryParam:           config.QueryParam,
+		metadataHeaderPrefix: strings.ToLower(config.MetadataHeaderPrefix),
+		inline:               inline,
+	}
+	if f.header == "" {
+		f.header = apiKeyDefaultHeader
+	}
+	if f.metadataHeaderPrefix == "" {
+		f.metadataHeaderPrefix = apiKeyDefaultMetadataHeaderPrefix
+	}
+	if config.KeysFile != "" {
+		reloadInterval := time.Duration(config.ReloadIntervalMs) * time.Millisecond
+		if reloadInterval <= 0 {
+			reloadInterval = apiKeyDefaultReloadInterval
+		}
+		f.file, err = newReloadableFile(config.KeysFile, reloadInterval, parseAPIKeyFile, handle.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *apiKeyFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &apiKeyFilter{handle: handle, factory: p}
+}
+
+func newAPIKeyStore(keys []apiKey) (apiKeyStore, error) {
+	store := make(apiKeyStore, len(keys))
+	for i, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("keys[%d]: key must be set", i)
+		}
+		store[sha256.Sum256([]byte(k.Key))] = k.Metadata
+	}
+	return store, nil
+}
+
+func parseAPIKeyFile(data []byte, _ logFunc) (apiKeyStore, error) {
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return newAPIKeyStore(keys)
+}
+
+// lookup returns the metadata of the key, or false if the key is unknown.
+func (p *apiKeyFilterFactory) lookup(key string, logf logFunc) (map[string]string, bool) {
+	digest := sha256.Sum256([]byte(key))
+	if metadata, ok := p.inline[digest]; ok {
+		return metadata, true
+	}
+	if p.file == nil {
+		return nil, false
+	}
+	metadata, ok := p.file.Load(logf)[digest]
+	return metadata, ok
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *apiKeyFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	// Remove the metadata headers sent by the client so that they cannot be spoofed.
+	// The names are copied since they point to the header map being modified.
+	var spoofed []string
+	for _, h := range headers.GetAll() {
+		if strings.HasPrefix(strings.ToLower(h[0]), p.factory.metadataHeaderPrefix) {
+			spoofed = append(spoofed, strings.Clone(h[0]))
+		}
+	}
+	for _, name := range spoofed {
+		headers.Remove(name)
+	}
+
+	key := headers.GetOne(p.factory.header)
+	if key == "" && p.factory.queryParam != "" {
+		if _, rawQuery, ok := strings.Cut(headers.GetOne(":path"), "?"); ok {
+			if query, err := url.ParseQuery(rawQuery); err == nil {
+				key = query.Get(p.factory.queryParam)
+			}
+		}
+	}
+	if key == "" {
+		p.sendUnauthorized("Missing API key\n", "api_key_missing")
+		return shared.HeadersStatusStop
+	}
+	metadata, ok := p.factory.lookup(key, p.handle.Log)
+	if !ok {
+		p.sendUnauthorized("Invalid API key\n", "api_key_invalid")
+		return shared.HeadersStatusStop
+	}
+	for name, value := range metadata {
+		headers.Set(p.factory.metadataHeaderPrefix+name, value)
+	}
+	return shared.HeadersStatusContinue
+}
+
+func (p *apiKeyFilter) sendUnauthorized(body, detail string) {
+	p.handle.SendLocalResponse(http.StatusUnauthorized, [][2]string{{"Content-Type", "text/plain"}}, []byte(body), detail)
+}
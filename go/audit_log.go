@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/syslog"
+	"math"
+	"mime"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	auditLogDefaultBodyBytes  = 1024
+	auditLogMaxBodyBytes      = 16 << 10
+	auditLogDefaultQueueSize  = 1024
+	auditLogDefaultSyslogTag  = "envoy-audit"
+	auditLogDefaultRecordSize = 64 << 10
+)
+
+// auditLogSyslogWriters are the syslog writers by their settings, shared like the access log
+// writers.
+var auditLogSyslogWriters sync.Map // map[string]*auditLogSyslogWriter
+
+type (
+	// auditLogFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	auditLogFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// auditLogFilterConfig is the JSON configuration of the audit log filter.
+	auditLogFilterConfig struct {
+		// Path is the file the records are appended to. The filter never rotates or truncates it.
+		// A file can't be both an audit log and a rotated access log.
+		Path string `json:"path" example:"/dev/stderr"`
+		// Syslog sends the records to syslog instead of a file.
+		Syslog *auditLogSyslogConfig `json:"syslog"`
+		// Routes are the names of the routes audited. Defaults to all the routes.
+		Routes []string `json:"routes"`
+		// Methods are the methods audited, e.g. ["POST", "PUT", "DELETE"]. Defaults to all.
+		Methods []string `json:"methods"`
+		// RequestHeaders and ResponseHeaders are the headers recorded.
+		RequestHeaders  []string `json:"request_headers"`
+		ResponseHeaders []string `json:"response_headers"`
+		// SensitiveHeaders and SensitiveQueryParams are recorded as their hashes, so that the
+		// records can tell the values apart without revealing them.
+		SensitiveHeaders     []string `json:"sensitive_headers"`
+		SensitiveQueryParams []string `json:"sensitive_query_params"`
+		// SensitiveBodyFields are the JSON object keys and the form fields whose values are
+		// recorded as their hashes in the body excerpts, at any depth. When it is set, the
+		// excerpts of the other media types are left out, as they can't be redacted.
+		SensitiveBodyFields []string `json:"sensitive_body_fields"`
+		// HashKey makes the hashes HMAC-SHA256 rather than SHA-256, so that the low-entropy values
+		// can't be recovered by hashing the candidates. Strongly recommended.
+		HashKey string `json:"hash_key"`
+		// RequestBodyBytes and ResponseBodyBytes are the sizes of the body excerpts recorded, at
+		// most 16 KiB. Defaults to 1024. Negative disables the excerpt.
+		RequestBodyBytes  int `json:"request_body_bytes"`
+		ResponseBodyBytes int `json:"response_body_bytes"`
+		// MaxRecordBytes is the maximum size of a record. The larger records are recorded without
+		// the headers and the body excerpts. Defaults to 64 KiB.
+		MaxRecordBytes int `json:"max_record_bytes"`
+		// QueueSize is the number of the records waiting to be written. The records are dropped
+		// when it is full, rather than holding up the requests. Defaults to 1024.
+		QueueSize int `json:"queue_size"`
+	}
+	auditLogSyslogConfig struct {
+		// Network and Address are the syslog server, e.g. "udp" and "127.0.0.1:514". The local
+		// syslog is used if Network is empty.
+		Network string `json:"network"`
+		Address string `json:"address"`
+		// Tag defaults to "envoy-audit".
+		Tag string `json:"tag"`
+	}
+	// auditLogFilterFactory implements [shared.HttpFilterFactory].
+	auditLogFilterFactory struct {
+		config           auditLogFilterConfig
+		routes           map[string]bool
+		methods          map[string]bool
+		sensitiveHeaders map[string]bool
+		sensitiveParams  map[string]bool
+		sensitiveFields  map[string]bool
+		lines            chan []byte
+		records          shared.MetricID
+		hasMetric        bool
+	}
+	// auditLogFilter implements [shared.HttpFilter].
+	//
+	// The bodies are not buffered: the excerpts are copied from the chunks as they pass, so the
+	// auditing adds no latency beyond the copy.
+	auditLogFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *auditLogFilterFactory
+		record  *auditLogRecord
+		shared.EmptyHttpFilter
+	}
+	// auditLogRecord is a line of the audit log.
+	auditLogRecord struct {
+		Time                  string            `json:"time"`
+		Route                 string            `json:"route,omitempty"`
+		Method                string            `json:"method"`
+		Path                  string            `json:"path"`
+		ClientIP              string            `json:"client_ip,omitempty"`
+		Status                int               `json:"status,omitempty"`
+		DurationMs            int64             `json:"duration_ms"`
+		RequestHeaders        map[string]string `json:"request_headers,omitempty"`
+		ResponseHeaders       map[string]string `json:"response_headers,omitempty"`
+		RequestBody           string            `json:"request_body,omitempty"`
+		RequestBodyTruncated  bool              `json:"request_body_truncated,omitempty"`
+		ResponseBody          string            `json:"response_body,omitempty"`
+		ResponseBodyTruncated bool              `json:"response_body_truncated,omitempty"`
+		// Truncated is set if the headers and the bodies were left out to fit MaxRecordBytes.
+		Truncated bool `json:"truncated,omitempty"`
+
+		start                               time.Time
+		requestBody, responseBody           []byte
+		requestMediaType, responseMediaType string
+	}
+	// auditLogSyslogWriter writes the lines to syslog from its own goroutine.
+	auditLogSyslogWriter struct {
+		writer *syslog.Writer
+		lines  chan []byte
+		logf   logFunc
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *auditLogFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config auditLogFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse audit log config: %w", err)
+	}
+	if (config.Path == "") == (config.Syslog == nil) {
+		return nil, fmt.Errorf("exactly one of path and syslog must be set")
+	}
+	for _, n := range []*int{&config.RequestBodyBytes, &config.ResponseBodyBytes} {
+		switch {
+		case *n == 0:
+			*n = auditLogDefaultBodyBytes
+		case *n < 0:
+			*n = 0
+		case *n > auditLogMaxBodyBytes:
+			return nil, fmt.Errorf("body excerpts must be at most %d bytes", auditLogMaxBodyBytes)
+		}
+	}
+	if config.MaxRecordBytes <= 0 {
+		config.MaxRecordBytes = auditLogDefaultRecordSize
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = auditLogDefaultQueueSize
+	}
+	f := &auditLogFilterFactory{
+		config:           config,
+		routes:           auditLogSet(config.Routes, false),
+		methods:          auditLogSet(config.Methods, false),
+		sensitiveHeaders: auditLogSet(config.SensitiveHeaders, true),
+		sensitiveParams:  auditLogSet(config.SensitiveQueryParams, false),
+		sensitiveFields:  auditLogSet(config.SensitiveBodyFields, false),
+	}
+	if config.Syslog != nil {
+		w, err := openAuditLogSyslogWriter(config.Syslog, config.QueueSize, handle.Log)
+		if err != nil {
+			return nil, err
+		}
+		f.lines = w.lines
+	} else {
+		// The audit log is append-only, so the file is never rotated. This fails if the file is
+		// already an access log, which is rotated.
+		w, err := openAccessLogWriter(config.Path, math.MaxInt64, 0, config.QueueSize, handle.Log)
+		if err != nil {
+			return nil, err
+		}
+		f.lines = w.lines
+	}
+	id, res := handle.DefineCounter("audit_log_records_total", "result")
+	if res == shared.MetricsSuccess {
+		f.records, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the audit log counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *auditLogFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &auditLogFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *auditLogFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	f := p.factory
+	route, _ := p.handle.GetAttributeString(shared.AttributeIDXdsRouteName)
+	method := headers.GetOne(":method")
+	if (len(f.routes) > 0 && !f.routes[route]) || (len(f.methods) > 0 && !f.methods[method]) {
+		return shared.HeadersStatusContinue
+	}
+	now := time.Now()
+	r := &auditLogRecord{
+		Time:           now.UTC().Format(time.RFC3339Nano),
+		Route:          strings.Clone(route),
+		Method:         strings.Clone(method),
+		Path:           f.redactPath(headers.GetOne(":path")),
+		RequestHeaders: f.capture(headers, f.config.RequestHeaders),
+		start:          now,
+	}
+	r.requestMediaType = auditLogMediaType(headers)
+	if source, ok := p.handle.GetAttributeString(shared.AttributeIDSourceAddress); ok {
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			source = host
+		}
+		r.ClientIP = strings.Clone(source)
+	}
+	p.record = r
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *auditLogFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.record != nil {
+		p.record.requestBody, p.record.RequestBodyTruncated = appendExcerpt(p.record.requestBody,
+			p.record.RequestBodyTruncated, body, p.factory.config.RequestBodyBytes)
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *auditLogFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.record != nil {
+		p.record.Status, _ = strconv.Atoi(headers.GetOne(":status"))
+		p.record.ResponseHeaders = p.factory.capture(headers, p.factory.config.ResponseHeaders)
+		p.record.responseMediaType = auditLogMediaType(headers)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *auditLogFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.record != nil {
+		p.record.responseBody, p.record.ResponseBodyTruncated = appendExcerpt(p.record.responseBody,
+			p.record.ResponseBodyTruncated, body, p.factory.config.ResponseBodyBytes)
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *auditLogFilter) OnStreamComplete() {
+	r := p.record
+	if r == nil {
+		return
+	}
+	p.record = nil
+	r.DurationMs = time.Since(r.start).Milliseconds()
+	r.RequestBody = p.factory.redactBody(r.requestMediaType, r.requestBody)
+	r.ResponseBody = p.factory.redactBody(r.responseMediaType, r.responseBody)
+	line, _ := json.Marshal(r)
+	if len(line) >= p.factory.config.MaxRecordBytes {
+		r.RequestHeaders, r.ResponseHeaders, r.RequestBody, r.ResponseBody = nil, nil, "", ""
+		r.RequestBodyTruncated, r.ResponseBodyTruncated, r.Truncated = false, false, true
+		line, _ = json.Marshal(r)
+	}
+	result := "queued"
+	select {
+	case p.factory.lines <- append(line, '\n'):
+	default:
+		result = "dropped"
+	}
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.records, 1, result)
+	}
+}
+
+// capture returns the values of the headers, with the sensitive ones hashed.
+func (p *auditLogFilterFactory) capture(headers shared.HeaderMap, names []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	captured := make(map[string]string, len(names))
+	for _, name := range names {
+		values := headers.Get(name)
+		if len(values) == 0 {
+			continue
+		}
+		v := strings.Join(values, ",")
+		if p.sensitiveHeaders[strings.ToLower(name)] {
+			v = p.hash(v)
+		} else {
+			v = strings.Clone(v)
+		}
+		captured[name] = v
+	}
+	return captured
+}
+
+// redactPath returns the path with the values of the sensitive query parameters hashed.
+func (p *auditLogFilterFactory) redactPath(path string) string {
+	base, query, ok := strings.Cut(path, "?")
+	if !ok || len(p.sensitiveParams) == 0 {
+		return strings.Clone(path)
+	}
+	return base + "?" + p.redactForm(query, p.sensitiveParams)
+}
+
+// redactForm returns the URL encoded form with the values of the sensitive names hashed.
+func (p *auditLogFilterFactory) redactForm(form string, sensitive map[string]bool) string {
+	params := strings.Split(form, "&")
+	for i, param := range params {
+		k, v, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(strings.ReplaceAll(k, "+", " ")); err == nil && sensitive[name] {
+			if unescaped, err := url.QueryUnescape(v); err == nil {
+				v = unescaped
+			}
+			params[i] = k + "=" + p.hash(v)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// redactBody returns the body excerpt with the values of the sensitive fields hashed.
+func (p *auditLogFilterFactory) redactBody(mediaType string, excerpt []byte) string {
+	if len(p.sensitiveFields) == 0 || len(excerpt) == 0 {
+		return string(excerpt)
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return string(p.redactJSON(excerpt))
+	case mediaType == "application/x-www-form-urlencoded":
+		return p.redactForm(string(excerpt), p.sensitiveFields)
+	default:
+		return ""
+	}
+}
+
+// redactJSON returns the JSON excerpt with the values of the sensitive keys replaced by their
+// hashes as strings. The excerpt may be cut anywhere, so a value cut short is hashed up to the
+// end. An excerpt that isn't JSON is left out.
+func (p *auditLogFilterFactory) redactJSON(excerpt []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(excerpt))
+	var (
+		out    []byte
+		copied int
+		// containers has an entry per open container: 'k' for the objects whose next token is a
+		// key, 'v' for the objects whose next token is a value, and 'a' for the arrays.
+		containers []byte
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The end of the excerpt, which is at most a part of a token that isn't a value of a
+			// sensitive key.
+			return append(out, excerpt[copied:]...)
+		}
+		if err != nil {
+			return nil
+		}
+		var state byte
+		if len(containers) > 0 {
+			state = containers[len(containers)-1]
+			// In an object, a key is followed by a value and a value by a key.
+			switch state {
+			case 'k':
+				containers[len(containers)-1] = 'v'
+			case 'v':
+				containers[len(containers)-1] = 'k'
+			}
+		}
+		switch tok {
+		case json.Delim('{'):
+			containers = append(containers, 'k')
+			continue
+		case json.Delim('['):
+			containers = append(containers, 'a')
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			containers = containers[:len(containers)-1]
+			continue
+		}
+		if key, ok := tok.(string); !ok || state != 'k' || !p.sensitiveFields[key] {
+			continue
+		}
+		start := int(dec.InputOffset())
+		for start < len(excerpt) && strings.IndexByte(" \t\r\n:", excerpt[start]) >= 0 {
+			start++
+		}
+		value, end := auditLogSkipJSONValue(dec, excerpt, start)
+		out = append(append(out, excerpt[copied:start]...), strconv.Quote(p.hash(value))...)
+		copied = end
+		containers[len(containers)-1] = 'k'
+	}
+}
+
+// auditLogSkipJSONValue reads the next value, which starts at the offset, from the decoder, and
+// returns it, decoded if it is a string, and the offset of its end. A value cut short by the end
+// of the excerpt is returned as is up to the end.
+func auditLogSkipJSONValue(dec *json.Decoder, excerpt []byte, start int) (string, int) {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return string(excerpt[start:]), len(excerpt)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth > 0 {
+			continue
+		}
+		if s, ok := tok.(string); ok {
+			return s, int(dec.InputOffset())
+		}
+		return string(excerpt[start:dec.InputOffset()]), int(dec.InputOffset())
+	}
+}
+
+// auditLogMediaType returns the media type of the body, which decides how it is redacted.
+func auditLogMediaType(headers shared.HeaderMap) string {
+	mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	return mediaType
+}
+
+// hash returns the hash of the value prefixed by its algorithm.
+func (p *auditLogFilterFactory) hash(v string) string {
+	var h hash.Hash
+	prefix := "sha256:"
+	if p.config.HashKey != "" {
+		h, prefix = hmac.New(sha256.New, []byte(p.config.HashKey)), "hmac-sha256:"
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(v))
+	return prefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// appendExcerpt copies the chunks of the body into the excerpt up to the limit, and reports
+// whether the body is longer than the excerpt.
+func appendExcerpt(excerpt []byte, truncated bool, body shared.BodyBuffer, limit int) ([]byte, bool) {
+	if limit == 0 || truncated {
+		return excerpt, truncated
+	}
+	for _, chunk := range body.GetChunks() {
+		room := limit - len(excerpt)
+		if len(chunk) > room {
+			return append(excerpt, chunk[:room]...), true
+		}
+		excerpt = append(excerpt, chunk...)
+	}
+	return excerpt, truncated
+}
+
+func auditLogSet(values []string, lower bool) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		if lower {
+			v = strings.ToLower(v)
+		}
+		set[v] = true
+	}
+	return set
+}
+
+// openAuditLogSyslogWriter returns the syslog writer of the settings, starting it if it is not
+// running yet.
+func openAuditLogSyslogWriter(config *auditLogSyslogConfig, queueSize int, logf logFunc) (*auditLogSyslogWriter, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = auditLogDefaultSyslogTag
+	}
+	key := strings.Join([]string{config.Network, config.Address, tag}, "\x00")
+	if w, ok := auditLogSyslogWriters.Load(key); ok {
+		return w.(*auditLogSyslogWriter), nil
+	}
+	writer, err := syslog.Dial(config.Network, config.Address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	w := &auditLogSyslogWriter{writer: writer, lines: make(chan []byte, queueSize), logf: logf}
+	if actual, loaded := auditLogSyslogWriters.LoadOrStore(key, w); loaded {
+		_ = writer.Close()
+		return actual.(*auditLogSyslogWriter), nil
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *auditLogSyslogWriter) run() {
+	for line := range w.lines {
+		// The writer reconnects on its own if the connection is lost.
+		if err := w.writer.Info(string(line[:len(line)-1])); err != nil {
+			w.logf(shared.LogLevelError, "failed to write the audit log to syslog: %v", err)
+		}
+	}
+}
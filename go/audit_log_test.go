@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+)
+
+func TestAuditLogRedactBody(t *testing.T) {
+	factory, err := (&auditLogFilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(`{
+		"path": "`+filepath.Join(t.TempDir(), "audit.log")+`",
+		"sensitive_body_fields": ["password", "card"]
+	}`))
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	f := factory.(*auditLogFilterFactory)
+	hash := func(v string) string { return strconv.Quote(f.hash(v)) }
+
+	for _, tc := range []struct {
+		name, mediaType, excerpt, want string
+	}{
+		{
+			name: "JSON", mediaType: "application/json",
+			excerpt: `{"user": "alice", "password": "hunter2", "n": [{"password": 42}]}`,
+			want:    `{"user": "alice", "password": ` + hash("hunter2") + `, "n": [{"password": ` + hash("42") + `}]}`,
+		},
+		{
+			name: "JSON key as a value", mediaType: "application/problem+json",
+			excerpt: `{"user": "password", "list": ["password", "x"]}`,
+			want:    `{"user": "password", "list": ["password", "x"]}`,
+		},
+		{
+			name: "JSON object value", mediaType: "application/json",
+			excerpt: `{"card": {"number": "4111"}, "ok": true}`,
+			want:    `{"card": ` + hash(`{"number": "4111"}`) + `, "ok": true}`,
+		},
+		{
+			name: "truncated JSON", mediaType: "application/json",
+			excerpt: `{"user": "alice", "password": "hunt`,
+			want:    `{"user": "alice", "password": ` + hash(`"hunt`),
+		},
+		{
+			name: "truncated JSON key", mediaType: "application/json",
+			excerpt: `{"user": "alice", "passw`,
+			want:    `{"user": "alice", "passw`,
+		},
+		{
+			name: "malformed JSON", mediaType: "application/json",
+			excerpt: `{"password" "hunter2"}`,
+		},
+		{
+			name: "form", mediaType: "application/x-www-form-urlencoded",
+			excerpt: `user=alice&password=hunter%32&card`,
+			want:    `user=alice&password=` + f.hash("hunter2") + `&card=` + f.hash(""),
+		},
+		{
+			name: "truncated form", mediaType: "application/x-www-form-urlencoded",
+			excerpt: `user=alice&password=hun`,
+			want:    `user=alice&password=` + f.hash("hun"),
+		},
+		{
+			name: "other", mediaType: "text/plain",
+			excerpt: `password=hunter2`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := f.redactBody(tc.mediaType, []byte(tc.excerpt)); got != tc.want {
+				t.Fatalf("redactBody() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuditLogSharedPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if _, err := (&accessLoggerFilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(`{"path": "`+path+`"}`)); err != nil {
+		t.Fatalf("access logger Create() = %v", err)
+	}
+	if _, err := (&auditLogFilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(`{"path": "`+path+`"}`)); err == nil {
+		t.Fatal("the audit log was written to a rotated access log")
+	}
+}
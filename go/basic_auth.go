@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	basicAuthDefaultRealm          = "Restricted"
+	basicAuthDefaultReloadInterval = 5 * time.Second
+	// basicAuthMaxCacheSize bounds the number of the verified credentials kept per htpasswd file.
+	basicAuthMaxCacheSize = 1024
+)
+
+type (
+	// basicAuthFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	basicAuthFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// basicAuthFilterConfig is the JSON configuration of the basic auth filter.
+	basicAuthFilterConfig struct {
+		// HtpasswdFile is the path to the htpasswd file. Only bcrypt and apr1 hashes are supported.
+		HtpasswdFile string `json:"htpasswd_file" example:"./testdata/htpasswd"`
+		// Realm is sent in the WWW-Authenticate header of the 401 responses.
+		Realm string `json:"realm"`
+		// ReloadIntervalMs is how often the file is checked for changes. Defaults to 5 seconds.
+		ReloadIntervalMs int `json:"reload_interval_ms"`
+	}
+	// basicAuthFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// The htpasswd file is reloaded when it changes so that the users can be updated without
+	// pushing a new filter config to Envoy.
+	basicAuthFilterFactory struct {
+		wwwAuthenticate string
+		users           *reloadableFile[*htpasswd]
+	}
+	// htpasswd is the parsed htpasswd file.
+	htpasswd struct {
+		hashes map[string]string
+		// verified caches the SHA-256 of the Authorization header values that have been verified
+		// against this file since bcrypt is intentionally slow.
+		mux      sync.Mutex
+		verified map[[sha256.Size]byte]struct{}
+	}
+	// basicAuthFilter implements [shared.HttpFilter].
+	//
+	// The password verification runs in a goroutine so that the slow hashes don't block the worker
+	// thread, and the request is continued via the scheduler as in the delay filter.
+	basicAuthFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *basicAuthFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *basicAuthFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config basicAuthFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse basic auth config: %w", err)
+	}
+	if config.HtpasswdFile == "" {
+		return nil, fmt.Errorf("htpasswd_file must be set")
+	}
+	if config.Realm == "" {
+		config.Realm = basicAuthDefaultRealm
+	}
+	reloadInterval := time.Duration(config.ReloadIntervalMs) * time.Millisecond
+	if reloadInterval <= 0 {
+		reloadInterval = basicAuthDefaultReloadInterval
+	}
+	users, err := newReloadableFile(config.HtpasswdFile, reloadInterval, parseHtpasswd, handle.Log)
+	if err != nil {
+		return nil, err
+	}
+	return &basicAuthFilterFactory{
+		wwwAuthenticate: fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, config.Realm),
+		users:           users,
+	}, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *basicAuthFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &basicAuthFilter{handle: handle, factory: p}
+}
+
+// parseHtpasswd parses the htpasswd file. Lines with unsupported hashes are skipped.
+func parseHtpasswd(data []byte, logf logFunc) (*htpasswd, error) {
+	h := &htpasswd{
+		hashes:   make(map[string]string),
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing ':'", lineNum)
+		}
+		if !isBcryptHash(hash) && !strings.HasPrefix(hash, apr1Magic) {
+			logf(shared.LogLevelWarn, "htpasswd line %d: skipping user %s with unsupported hash", lineNum, user)
+			continue
+		}
+		h.hashes[user] = hash
+	}
+	return h, scanner.Err()
+}
+
+func (h *htpasswd) isVerified(key [sha256.Size]byte) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	_, ok := h.verified[key]
+	return ok
+}
+
+func (h *htpasswd) setVerified(key [sha256.Size]byte) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if len(h.verified) >= basicAuthMaxCacheSize {
+		clear(h.verified)
+	}
+	h.verified[key] = struct{}{}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *basicAuthFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	authorization := headers.GetOne("authorization")
+	user, password, ok := parseBasicAuth(authorization)
+	if !ok {
+		p.sendUnauthorized()
+		return shared.HeadersStatusStop
+	}
+	users := p.factory.users.Load(p.handle.Log)
+	hash, ok := users.hashes[user]
+	if !ok {
+		p.sendUnauthorized()
+		return shared.HeadersStatusStop
+	}
+	key := sha256.Sum256([]byte(authorization))
+	if users.isVerified(key) {
+		return shared.HeadersStatusContinue
+	}
+
+	// The header values are only valid during this callback, so copy them before the goroutine.
+	password = strings.Clone(password)
+	scheduler := p.handle.GetScheduler()
+	go func() {
+		ok := verifyHtpasswdHash(hash, password)
+		scheduler.Schedule(func() {
+			if !ok {
+				p.sendUnauthorized()
+				return
+			}
+			users.setVerified(key)
+			p.handle.ContinueRequest()
+		})
+	}()
+	return shared.HeadersStatusStop
+}
+
+func (p *basicAuthFilter) sendUnauthorized() {
+	p.handle.SendLocalResponse(http.StatusUnauthorized,
+		[][2]string{{"Content-Type", "text/plain"}, {"WWW-Authenticate", p.factory.wwwAuthenticate}},
+		[]byte("Unauthorized\n"), "basic_auth_unauthorized")
+}
+
+// parseBasicAuth parses the Authorization header value of the Basic scheme.
+func parseBasicAuth(authorization string) (user, password string, ok bool) {
+	const prefix = "basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(authorization[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	user, password, ok = strings.Cut(string(decoded), ":")
+	return user, password, ok
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$")
+}
+
+// verifyHtpasswdHash reports whether password matches the bcrypt or apr1 hash.
+func verifyHtpasswdHash(hash, password string) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	salt, _, ok := strings.Cut(strings.TrimPrefix(hash, apr1Magic), "$")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(apr1Crypt(password, salt)), []byte(hash)) == 1
+}
+
+const (
+	apr1Magic  = "$apr1$"
+	apr1Itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// apr1Crypt computes the Apache variant of the MD5-based crypt as produced by `htpasswd -m`.
+func apr1Crypt(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Magic))
+	h.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= md5.Size {
+		h.Write(altSum[:min(md5.Size, i)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := range 1000 {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(sum[:0])
+	}
+
+	var out bytes.Buffer
+	out.WriteString(apr1Magic)
+	out.WriteString(salt)
+	out.WriteByte('$')
+	encode := func(v uint, n int) {
+		for range n {
+			out.WriteByte(apr1Itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return out.String()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+type (
+	// bodyLimitFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	bodyLimitFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// bodyLimitFilterConfig is the JSON configuration of the body limit filter. The same format
+	// is used for the per-route configuration, which overrides the filter configuration.
+	bodyLimitFilterConfig struct {
+		// MaxRequestBytes is the maximum size of the request body. Zero means no limit.
+		MaxRequestBytes uint64 `json:"max_request_bytes"`
+	}
+	// bodyLimitFilterFactory implements [shared.HttpFilterFactory].
+	bodyLimitFilterFactory struct {
+		config    bodyLimitFilterConfig
+		rejected  shared.MetricID
+		hasMetric bool
+	}
+	// bodyLimitFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to account for a body as it streams: the chunks are passed
+	// through as they arrive, and the request is rejected as soon as the limit is exceeded rather
+	// than after buffering the whole body.
+	bodyLimitFilter struct {
+		handle   shared.HttpFilterHandle
+		factory  *bodyLimitFilterFactory
+		limit    uint64
+		received uint64
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *bodyLimitFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	config, err := parseBodyLimitConfig(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	f := &bodyLimitFilterFactory{config: *config}
+	id, res := handle.DefineCounter("body_limit_rejected_total", "reason")
+	if res == shared.MetricsSuccess {
+		f.rejected, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the body limit counter: %v", res)
+	}
+	return f, nil
+}
+
+// CreatePerRoute implements [shared.HttpFilterConfigFactory].
+func (p *bodyLimitFilterConfigFactory) CreatePerRoute(unparsedConfig []byte) (any, error) {
+	return parseBodyLimitConfig(unparsedConfig)
+}
+
+func parseBodyLimitConfig(unparsedConfig []byte) (*bodyLimitFilterConfig, error) {
+	var config bodyLimitFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse body limit config: %w", err)
+		}
+	}
+	return &config, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *bodyLimitFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &bodyLimitFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *bodyLimitFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.limit = p.factory.config.MaxRequestBytes
+	if routeConfig, ok := p.handle.GetMostSpecificConfig().(*bodyLimitFilterConfig); ok {
+		p.limit = routeConfig.MaxRequestBytes
+	}
+	if p.limit == 0 || endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	// Reject early if the client announces a body that is too large.
+	if cl, err := strconv.ParseUint(headers.GetOne("content-length"), 10, 64); err == nil && cl > p.limit {
+		p.reject("content_length")
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *bodyLimitFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.limit == 0 {
+		return shared.BodyStatusContinue
+	}
+	p.received += body.GetSize()
+	if p.received > p.limit {
+		p.reject("streamed")
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+func (p *bodyLimitFilter) reject(reason string) {
+	// Don't account for the rest of the body.
+	p.limit = 0
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.rejected, 1, reason)
+	}
+	p.handle.SendLocalResponse(http.StatusRequestEntityTooLarge, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte("Payload Too Large\n"), "body_limit_exceeded")
+}
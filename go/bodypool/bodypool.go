@@ -0,0 +1,79 @@
+// Package bodypool provides a pool of the scratch buffers the filters copy the buffered bodies
+// into.
+//
+// The filters inspecting every body would otherwise grow a new slice on each request, which is
+// most of their allocations at high request rates. A filter gets a buffer when the body starts,
+// appends the chunks to it with [Append] or [ReadAllInto], and puts it back with [Put] when the
+// body is done, for example:
+//
+//	p.body = bodypool.Append(p.body, body)
+//	if !endOfStream {
+//		return shared.BodyStatusStopAndBuffer
+//	}
+//	err := json.Unmarshal(p.body, &v)
+//	bodypool.Put(p.body)
+//	p.body = nil
+package bodypool
+
+import (
+	"io"
+	"sync"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// MaxBytes is the capacity over which the buffers are dropped instead of pooled, so that an
+// occasional large body doesn't stay in memory for good.
+const MaxBytes = 1 << 20
+
+// minRead is the free space [ReadAllInto] makes before each read, as [bytes.Buffer] does.
+const minRead = 512
+
+var pool = sync.Pool{New: func() any { return new([]byte) }}
+
+// Get returns an empty buffer from the pool.
+func Get() []byte {
+	return (*pool.Get().(*[]byte))[:0]
+}
+
+// Put returns the buffer to the pool. Nothing must reference the buffer afterwards, so the values
+// parsed from it must have been copied, as the JSON and form decoders do.
+func Put(b []byte) {
+	if cap(b) == 0 || cap(b) > MaxBytes {
+		return
+	}
+	pool.Put(&b)
+}
+
+// Append appends the chunks of the body to dst, getting dst from the pool if it is nil.
+func Append(dst []byte, body shared.BodyBuffer) []byte {
+	if dst == nil {
+		dst = Get()
+	}
+	for _, chunk := range body.GetChunks() {
+		dst = append(dst, chunk...)
+	}
+	return dst
+}
+
+// ReadAllInto reads r until EOF and appends the data to dst, getting dst from the pool if it is
+// nil. It is [io.ReadAll] reusing the buffer, for the bodies read through an [io.Reader]. The data
+// read before an error is returned along with it, and the buffer must be put back in either case.
+func ReadAllInto(dst []byte, r io.Reader) ([]byte, error) {
+	if dst == nil {
+		dst = Get()
+	}
+	for {
+		if cap(dst)-len(dst) < minRead {
+			dst = append(dst, make([]byte, minRead)...)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
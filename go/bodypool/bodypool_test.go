@@ -0,0 +1,84 @@
+package bodypool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+)
+
+// fuzzChunks splits data into the chunks of the lengths in layout, the last one taking the rest.
+// The zero lengths make empty chunks, which Envoy may hand over as well.
+func fuzzChunks(data, layout []byte) [][]byte {
+	var chunks [][]byte
+	for _, n := range layout {
+		n := min(int(n)%32, len(data))
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return append(chunks, data)
+}
+
+func FuzzAppend(f *testing.F) {
+	f.Add([]byte("hello, world"), []byte{0, 3, 0, 1})
+	f.Add([]byte{}, []byte{0, 0})
+	f.Fuzz(func(t *testing.T, data, layout []byte) {
+		body := filtertest.NewBodyBuffer(fuzzChunks(data, layout)...)
+		got := Append(nil, body)
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Append = %q, want %q", got, data)
+		}
+		Put(got)
+	})
+}
+
+func TestReadAllInto(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, tc := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{name: "reader", r: bytes.NewReader(data)},
+		{name: "one byte reads", r: iotest.OneByteReader(bytes.NewReader(data))},
+		{name: "data with EOF", r: iotest.DataErrReader(bytes.NewReader(data))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ReadAllInto(nil, tc.r)
+			if err != nil {
+				t.Fatalf("ReadAllInto() = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("ReadAllInto() read %d bytes, want %d", len(got), len(data))
+			}
+			Put(got)
+		})
+	}
+
+	t.Run("append", func(t *testing.T) {
+		got, err := ReadAllInto([]byte("head:"), bytes.NewReader([]byte("tail")))
+		if err != nil || string(got) != "head:tail" {
+			t.Fatalf("ReadAllInto() = %q, %v, want %q", got, err, "head:tail")
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		errRead := errors.New("read failed")
+		got, err := ReadAllInto(nil, io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errRead)))
+		if !errors.Is(err, errRead) || string(got) != "partial" {
+			t.Fatalf("ReadAllInto() = %q, %v, want %q, %v", got, err, "partial", errRead)
+		}
+		Put(got)
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		// A buffer with the room for the body is reused as is.
+		buf := make([]byte, 0, len(data)+minRead)
+		got, err := ReadAllInto(buf, bytes.NewReader(data))
+		if err != nil || &got[0] != &buf[:1][0] {
+			t.Fatalf("ReadAllInto() = %v, reallocated the buffer with the room for the body", err)
+		}
+	})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	cacheDefaultMaxEntries   = 1000
+	cacheDefaultMaxBodyBytes = 1 << 20
+)
+
+// cacheSkippedResponseHeaders are not stored since they are either hop-by-hop or set by Envoy
+// when the cached response is sent as a local reply.
+var cacheSkippedResponseHeaders = map[string]struct{}{
+	":status": {}, "connection": {}, "content-length": {}, "date": {}, "keep-alive": {},
+	"proxy-connection": {}, "set-cookie": {}, "transfer-encoding": {}, "upgrade": {},
+}
+
+type (
+	// cacheFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	cacheFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// cacheFilterConfig is the JSON configuration of the cache filter.
+	cacheFilterConfig struct {
+		cachePolicyConfig
+		// MaxEntries is the maximum number of the cached responses. The least recently used one is
+		// evicted when the cache is full.
+		MaxEntries int `json:"max_entries"`
+	}
+	// cachePolicyConfig is the configuration shared by the cache filters.
+	cachePolicyConfig struct {
+		// MaxBodyBytes is the maximum size of a cached response body.
+		MaxBodyBytes int `json:"max_body_bytes"`
+		// AllowedVaryHeaders are the request headers that responses can vary on. The values of these
+		// headers are part of the cache key, and responses that vary on other headers are not cached.
+		AllowedVaryHeaders []string `json:"allowed_vary_headers"`
+	}
+	// cachePolicy decides what can be cached and under which key.
+	cachePolicy struct {
+		maxBodyBytes       int
+		allowedVaryHeaders []string
+	}
+	// cacheFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// The factory is shared by all the filter instances across the worker threads, so the cache
+	// lives here and is guarded by the mutex.
+	cacheFilterFactory struct {
+		policy    *cachePolicy
+		cache     *lruCache
+		lookups   shared.MetricID
+		hasMetric bool
+	}
+	// cachedResponse is a response stored in the cache.
+	cachedResponse struct {
+		status   uint32
+		headers  [][2]string
+		body     []byte
+		storedAt time.Time
+		expires  time.Time
+		// fingerprint identifies the request the response is for, for the filters that replay
+		// the response only to the same request.
+		fingerprint string
+	}
+	// lruCache is a fixed size cache evicting the least recently used entry.
+	lruCache struct {
+		mux        sync.Mutex
+		maxEntries int
+		entries    map[string]*list.Element
+		// order has the most recently used entry at the front.
+		order *list.List
+	}
+	lruEntry struct {
+		key      string
+		response *cachedResponse
+	}
+	// cacheRecorder captures a cacheable response as it streams through.
+	cacheRecorder struct {
+		policy *cachePolicy
+		// pending is non-nil while the response is being recorded.
+		pending *cachedResponse
+	}
+	// cacheFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to combine the request and the response phases: the cache is
+	// looked up at the request headers, and the response is stored as it streams through.
+	cacheFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *cacheFilterFactory
+		// key is set if the response can be stored.
+		key      string
+		recorder cacheRecorder
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *cacheFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config cacheFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse cache config: %w", err)
+		}
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = cacheDefaultMaxEntries
+	}
+	f := &cacheFilterFactory{
+		policy: newCachePolicy(&config.cachePolicyConfig),
+		cache:  newLRUCache(config.MaxEntries),
+	}
+	id, res := handle.DefineCounter("cache_lookups_total", "result")
+	if res == shared.MetricsSuccess {
+		f.lookups, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the cache counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *cacheFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &cacheFilter{handle: handle, factory: p, recorder: cacheRecorder{policy: p.policy}}
+}
+
+func newCachePolicy(config *cachePolicyConfig) *cachePolicy {
+	p := &cachePolicy{maxBodyBytes: config.MaxBodyBytes}
+	if p.maxBodyBytes <= 0 {
+		p.maxBodyBytes = cacheDefaultMaxBodyBytes
+	}
+	for _, h := range config.AllowedVaryHeaders {
+		p.allowedVaryHeaders = append(p.allowedVaryHeaders, strings.ToLower(h))
+	}
+	slices.Sort(p.allowedVaryHeaders)
+	return p
+}
+
+func newLRUCache(maxEntries int) *lruCache {
+	return &lruCache{maxEntries: maxEntries, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the response cached under key, or nil if there is none or it has expired.
+func (c *lruCache) get(key string, now time.Time) *cachedResponse {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*lruEntry)
+	if !now.Before(entry.response.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return entry.response
+}
+
+// put stores the response under key, evicting the least recently used entry if the cache is full.
+func (c *lruCache) put(key string, response *cachedResponse) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).response = response
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, response: response})
+}
+
+// cacheKey returns the cache key of the request, or false if the request must bypass the cache.
+func (p *cachePolicy) cacheKey(headers shared.HeaderMap) (string, bool) {
+	if headers.GetOne(":method") != "GET" || headers.GetOne("authorization") != "" {
+		return "", false
+	}
+	if directives := parseCacheControl(headers.GetOne("cache-control")); directives.has("no-cache") || directives.has("no-store") {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString("GET\x00")
+	b.WriteString(headers.GetOne(":authority"))
+	b.WriteByte(0)
+	b.WriteString(headers.GetOne(":path"))
+	for _, name := range p.allowedVaryHeaders {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(headers.Get(name), ","))
+	}
+	return b.String(), true
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *cacheFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	key, ok := p.factory.policy.cacheKey(headers)
+	if !ok {
+		return shared.HeadersStatusContinue
+	}
+	now := time.Now()
+	if cached := p.factory.cache.get(key, now); cached != nil {
+		p.record("hit")
+		sendCachedResponse(p.handle, cached, now)
+		return shared.HeadersStatusStop
+	}
+	p.record("miss")
+	p.key = key
+	return shared.HeadersStatusContinue
+}
+
+// sendCachedResponse sends the cached response as a local reply.
+func sendCachedResponse(handle shared.HttpFilterHandle, cached *cachedResponse, now time.Time) {
+	headers := append(slices.Clone(cached.headers),
+		[2]string{"age", strconv.Itoa(int(now.Sub(cached.storedAt).Seconds()))},
+		[2]string{"x-cache", "HIT"})
+	handle.SendLocalResponse(cached.status, headers, cached.body, "cache_hit")
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *cacheFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.key == "" {
+		return shared.HeadersStatusContinue
+	}
+	headers.Set("x-cache", "MISS")
+	if response := p.recorder.onResponseHeaders(headers, endOfStream); response != nil {
+		p.factory.cache.put(p.key, response)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *cacheFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if response := p.recorder.onResponseBody(body, endOfStream); response != nil {
+		p.factory.cache.put(p.key, response)
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *cacheFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	p.recorder.onResponseTrailers()
+	return shared.TrailersStatusContinue
+}
+
+func (p *cacheFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.lookups, 1, result)
+	}
+}
+
+// onResponseHeaders starts recording the response if it is cacheable. Returns the response if it
+// is complete.
+func (r *cacheRecorder) onResponseHeaders(headers shared.HeaderMap, endOfStream bool) *cachedResponse {
+	ttl, ok := r.policy.cacheableTTL(headers)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	r.pending = &cachedResponse{status: 200, storedAt: now, expires: now.Add(ttl)}
+	for _, h := range headers.GetAll() {
+		name := strings.ToLower(h[0])
+		if _, skip := cacheSkippedResponseHeaders[name]; skip || name == "x-cache" {
+			continue
+		}
+		// The header values are only valid during this callback.
+		r.pending.headers = append(r.pending.headers, [2]string{strings.Clone(name), strings.Clone(h[1])})
+	}
+	if endOfStream {
+		return r.finish()
+	}
+	return nil
+}
+
+// onResponseBody records the body chunk. Returns the response if it is complete.
+func (r *cacheRecorder) onResponseBody(body shared.BodyBuffer, endOfStream bool) *cachedResponse {
+	if r.pending == nil {
+		return nil
+	}
+	if len(r.pending.body)+int(body.GetSize()) > r.policy.maxBodyBytes {
+		r.pending = nil
+		return nil
+	}
+	for _, chunk := range body.GetChunks() {
+		r.pending.body = append(r.pending.body, chunk...)
+	}
+	if endOfStream {
+		return r.finish()
+	}
+	return nil
+}
+
+// onResponseTrailers stops recording since local replies cannot carry trailers.
+func (r *cacheRecorder) onResponseTrailers() {
+	r.pending = nil
+}
+
+func (r *cacheRecorder) finish() *cachedResponse {
+	response := r.pending
+	r.pending = nil
+	return response
+}
+
+// cacheableTTL returns how long the response can be cached, or false if it cannot.
+func (p *cachePolicy) cacheableTTL(headers shared.HeaderMap) (time.Duration, bool) {
+	if headers.GetOne(":status") != "200" {
+		return 0, false
+	}
+	for _, vary := range headers.Get("vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := slices.BinarySearch(p.allowedVaryHeaders, name); !ok && name != "" {
+				return 0, false
+			}
+		}
+	}
+	directives := parseCacheControl(strings.Join(headers.Get("cache-control"), ","))
+	if directives.has("no-store") || directives.has("no-cache") || directives.has("private") {
+		return 0, false
+	}
+	maxAge, ok := directives["s-maxage"]
+	if !ok {
+		maxAge, ok = directives["max-age"]
+	}
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheControl maps the Cache-Control directives to their values.
+type cacheControl map[string]string
+
+func parseCacheControl(value string) cacheControl {
+	directives := cacheControl{}
+	for _, d := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+func (c cacheControl) has(directive string) bool {
+	_, ok := c[directive]
+	return ok
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	canaryDefaultCookie       = "canary"
+	canaryDefaultForceHeader  = "x-canary"
+	canaryDefaultCookieMaxAge = 24 * 60 * 60
+)
+
+type (
+	// canaryFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	canaryFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// canaryFilterConfig is the JSON configuration of the canary filter.
+	canaryFilterConfig struct {
+		// Percentage is the percentage of the new users assigned to the canary.
+		Percentage float64 `json:"percentage"`
+		// PrimaryCluster and CanaryCluster are the clusters the traffic is routed to.
+		PrimaryCluster string `json:"primary_cluster" example:"httpbin"`
+		CanaryCluster  string `json:"canary_cluster" example:"httpbin"`
+		// ClusterHeader is the request header set to the selected cluster. The route must use it as
+		// the cluster_header.
+		ClusterHeader string `json:"cluster_header" example:"x-canary-cluster"`
+		// Cookie is the name of the cookie persisting the assignment. Defaults to "canary".
+		Cookie string `json:"cookie"`
+		// CookieMaxAgeSeconds defaults to 1 day.
+		CookieMaxAgeSeconds int `json:"cookie_max_age_seconds"`
+		// ForceHeader is the escape hatch: "true" forces the canary and "false" forces the primary
+		// regardless of the cookie. Defaults to "x-canary".
+		ForceHeader string `json:"force_header"`
+	}
+	// canaryFilterFactory implements [shared.HttpFilterFactory].
+	canaryFilterFactory struct {
+		config    canaryFilterConfig
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// canaryFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to override the cluster selected by the route: the route reads
+	// the cluster from a request header, which this filter sets before clearing the route cache.
+	canaryFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *canaryFilterFactory
+		// setCookie is set if the cookie needs to be set on the response.
+		setCookie string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *canaryFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config canaryFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse canary config: %w", err)
+	}
+	if config.PrimaryCluster == "" || config.CanaryCluster == "" || config.ClusterHeader == "" {
+		return nil, fmt.Errorf("primary_cluster, canary_cluster, and cluster_header must be set")
+	}
+	if config.Percentage < 0 || config.Percentage > 100 {
+		return nil, fmt.Errorf("percentage must be between 0 and 100")
+	}
+	if config.Cookie == "" {
+		config.Cookie = canaryDefaultCookie
+	}
+	if config.CookieMaxAgeSeconds <= 0 {
+		config.CookieMaxAgeSeconds = canaryDefaultCookieMaxAge
+	}
+	if config.ForceHeader == "" {
+		config.ForceHeader = canaryDefaultForceHeader
+	}
+	f := &canaryFilterFactory{config: config}
+	id, res := handle.DefineCounter("canary_requests_total", "cluster")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the canary counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *canaryFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &canaryFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *canaryFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	var canary bool
+	switch force := headers.GetOne(config.ForceHeader); force {
+	case "true":
+		canary = true
+	case "false":
+		canary = false
+	default:
+		switch cookie, _ := requestCookie(headers, config.Cookie); cookie {
+		case "1":
+			canary = true
+		case "0":
+			canary = false
+		default:
+			canary = rand.Float64()*100 < config.Percentage
+			value := "0"
+			if canary {
+				value = "1"
+			}
+			p.setCookie = (&http.Cookie{
+				Name:     config.Cookie,
+				Value:    value,
+				Path:     "/",
+				MaxAge:   config.CookieMaxAgeSeconds,
+				HttpOnly: true,
+			}).String()
+		}
+	}
+
+	cluster := config.PrimaryCluster
+	if canary {
+		cluster = config.CanaryCluster
+	}
+	headers.Set(config.ClusterHeader, cluster)
+	p.handle.ClearRouteCache()
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, cluster)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *canaryFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.setCookie != "" {
+		headers.Add("set-cookie", p.setCookie)
+	}
+	return shared.HeadersStatusContinue
+}
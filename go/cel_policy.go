@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"github.com/google/cel-go/cel"
+)
+
+const celPolicyDefaultRouteHeader = "x-route"
+
+var (
+	// celPolicyEnv declares the variables of the expressions: request with method, path, url_path,
+	// query, host, scheme and headers, where the header names are lowercase and the repeated
+	// values are joined by ",", and source with address. The optional types allow the headers
+	// that may be missing to be read as request.headers[?"x-env"].orValue("").
+	celPolicyEnv = sync.OnceValues(func() (*cel.Env, error) {
+		return cel.NewEnv(
+			cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+			cel.Variable("source", cel.MapType(cel.StringType, cel.DynType)),
+			cel.OptionalTypes(),
+		)
+	})
+	// celPolicyPrograms caches the compiled programs by expression, so that the same expressions
+	// in the per-route configs and across the config updates are compiled once.
+	celPolicyPrograms   = map[string]cel.Program{}
+	celPolicyProgramsMu sync.Mutex
+)
+
+type (
+	// celPolicyFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	celPolicyFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// celPolicyFilterConfig is the JSON configuration of the CEL policy filter. It is also the
+	// per-route configuration, which replaces the policies of the filter.
+	celPolicyFilterConfig struct {
+		Policies []celPolicyConfig `json:"policies"`
+	}
+	// celPolicyConfig is a CEL expression and the action taken when it evaluates to true. The
+	// policies are evaluated in order, and a deny stops the evaluation.
+	celPolicyConfig struct {
+		// Name names the policy in the metrics. Defaults to the index of the policy.
+		Name string `json:"name"`
+		// Expression is the CEL expression, such as
+		// `request.method == "DELETE" && !("x-admin" in request.headers)`. It must evaluate to a
+		// bool. The expressions that fail to evaluate, such as when a missing header is indexed,
+		// count as false.
+		Expression string `json:"expression"`
+		// Action is "set_header", "remove_header", "deny" or "route".
+		Action string `json:"action"`
+		// Header is the request header of "set_header" and "remove_header", and the routing
+		// header of "route", defaulting to "x-route".
+		Header string `json:"header"`
+		// Value is the header value of "set_header" and "route".
+		Value string `json:"value"`
+		// Status is the status of "deny". Defaults to 403.
+		Status int `json:"status"`
+		// Body is the response body of "deny".
+		Body string `json:"body"`
+	}
+	// celPolicy is a compiled [celPolicyConfig].
+	celPolicy struct {
+		celPolicyConfig
+		program cel.Program
+	}
+	// celPolicyFilterFactory implements [shared.HttpFilterFactory].
+	celPolicyFilterFactory struct {
+		policies  []celPolicy
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// celPolicyFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates declarative policies. The expressions are compiled once when the
+	// config is loaded, and only evaluated on the request path, which is much lighter than running
+	// a script per request.
+	celPolicyFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *celPolicyFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *celPolicyFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	policies, err := parseCELPolicyConfig(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	f := &celPolicyFilterFactory{policies: policies}
+	id, res := handle.DefineCounter("cel_policy_evaluations_total", "policy", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the CEL policy counter: %v", res)
+	}
+	return f, nil
+}
+
+// CreatePerRoute implements [shared.HttpFilterConfigFactory].
+func (p *celPolicyFilterConfigFactory) CreatePerRoute(unparsedConfig []byte) (any, error) {
+	policies, err := parseCELPolicyConfig(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &policies, nil
+}
+
+func parseCELPolicyConfig(unparsedConfig []byte) ([]celPolicy, error) {
+	var config celPolicyFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse CEL policy config: %w", err)
+	}
+	policies := make([]celPolicy, 0, len(config.Policies))
+	for i, policy := range config.Policies {
+		if policy.Name == "" {
+			policy.Name = fmt.Sprint(i)
+		}
+		policy.Header = strings.ToLower(policy.Header)
+		switch policy.Action {
+		case "set_header", "remove_header":
+			if policy.Header == "" || strings.HasPrefix(policy.Header, ":") {
+				return nil, fmt.Errorf("policies[%d]: header must be set and not a pseudo-header", i)
+			}
+		case "deny":
+			if policy.Status == 0 {
+				policy.Status = http.StatusForbidden
+			} else if policy.Status < 200 || policy.Status > 599 {
+				return nil, fmt.Errorf("policies[%d]: invalid status %d", i, policy.Status)
+			}
+		case "route":
+			if policy.Header == "" {
+				policy.Header = celPolicyDefaultRouteHeader
+			}
+		default:
+			return nil, fmt.Errorf("policies[%d]: unknown action %q", i, policy.Action)
+		}
+		if strings.ContainsAny(policy.Value, "\r\n") {
+			return nil, fmt.Errorf("policies[%d]: value must not contain CR or LF", i)
+		}
+		program, err := compileCELPolicy(policy.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("policies[%d]: %w", i, err)
+		}
+		policies = append(policies, celPolicy{celPolicyConfig: policy, program: program})
+	}
+	return policies, nil
+}
+
+// compileCELPolicy returns the program of the expression, compiling it if it isn't cached.
+func compileCELPolicy(expression string) (cel.Program, error) {
+	celPolicyProgramsMu.Lock()
+	defer celPolicyProgramsMu.Unlock()
+	if program, ok := celPolicyPrograms[expression]; ok {
+		return program, nil
+	}
+	env, err := celPolicyEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the CEL environment: %w", err)
+	}
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile %q: %w", expression, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("%q must evaluate to a bool, not %v", expression, ast.OutputType())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the program of %q: %w", expression, err)
+	}
+	celPolicyPrograms[expression] = program
+	return program, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *celPolicyFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &celPolicyFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *celPolicyFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	policies := p.factory.policies
+	if routePolicies, ok := p.handle.GetMostSpecificConfig().(*[]celPolicy); ok {
+		policies = *routePolicies
+	}
+	if len(policies) == 0 {
+		return shared.HeadersStatusContinue
+	}
+	activation := p.activation(headers)
+	rerouted := false
+	for i := range policies {
+		policy := &policies[i]
+		out, _, err := policy.program.Eval(activation)
+		if err != nil {
+			p.handle.Log(shared.LogLevelDebug, "failed to evaluate the CEL policy %s: %v", policy.Name, err)
+			p.record(policy.Name, "error")
+			continue
+		}
+		if matched, _ := out.Value().(bool); !matched {
+			continue
+		}
+		p.record(policy.Name, policy.Action)
+		switch policy.Action {
+		case "set_header":
+			headers.Set(policy.Header, policy.Value)
+		case "remove_header":
+			headers.Remove(policy.Header)
+		case "route":
+			headers.Set(policy.Header, policy.Value)
+			rerouted = true
+		case "deny":
+			p.handle.SendLocalResponse(uint32(policy.Status), [][2]string{{"content-type", "text/plain"}},
+				[]byte(policy.Body), "cel_policy_denied")
+			return shared.HeadersStatusStop
+		}
+		// The later policies see the headers set by the earlier ones.
+		activation = p.activation(headers)
+	}
+	if rerouted {
+		p.handle.ClearRouteCache()
+	}
+	return shared.HeadersStatusContinue
+}
+
+// activation returns the variables of the expressions for the request.
+func (p *celPolicyFilter) activation(headers shared.HeaderMap) map[string]any {
+	// The values are only used during this callback, so they are not copied.
+	requestHeaders := map[string]string{}
+	for _, h := range headers.GetAll() {
+		name := strings.ToLower(h[0])
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		if v, ok := requestHeaders[name]; ok {
+			requestHeaders[name] = v + "," + h[1]
+		} else {
+			requestHeaders[name] = h[1]
+		}
+	}
+	path := headers.GetOne(":path")
+	urlPath, query, _ := strings.Cut(path, "?")
+	request := map[string]any{
+		"method":   headers.GetOne(":method"),
+		"path":     path,
+		"url_path": urlPath,
+		"query":    query,
+		"host":     headers.GetOne(":authority"),
+		"scheme":   headers.GetOne(":scheme"),
+		"headers":  requestHeaders,
+	}
+	source := map[string]any{}
+	if address, ok := p.handle.GetAttributeString(shared.AttributeIDSourceAddress); ok {
+		source["address"] = address
+	}
+	return map[string]any{"request": request, "source": source}
+}
+
+func (p *celPolicyFilter) record(policy, result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, policy, result)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	circuitBreakerKeyRoute   = "route"
+	circuitBreakerKeyCluster = "cluster"
+
+	circuitBreakerDefaultWindow         = 10 * time.Second
+	circuitBreakerDefaultMinRequests    = 20
+	circuitBreakerDefaultErrorRate      = 0.5
+	circuitBreakerDefaultCooldown       = 30 * time.Second
+	circuitBreakerDefaultHalfOpenProbes = 1
+	// circuitBreakerBuckets is the number of the buckets of the rolling window.
+	circuitBreakerBuckets = 10
+)
+
+// circuitState is the state of a circuit. The values are reported by the gauge.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type (
+	// circuitBreakerFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	circuitBreakerFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// circuitBreakerFilterConfig is the JSON configuration of the circuit breaker filter.
+	circuitBreakerFilterConfig struct {
+		// Key is what the circuits are tracked by: "route" or "cluster". Defaults to "route".
+		Key string `json:"key"`
+		// WindowMs is the length of the rolling window of the error rate. Defaults to 10 seconds.
+		WindowMs int `json:"window_ms"`
+		// MinRequests is the number of the requests in the window below which the circuit doesn't
+		// trip regardless of the error rate. Defaults to 20.
+		MinRequests int `json:"min_requests"`
+		// ErrorRate is the ratio of the 5xx responses and the resets, including the timeouts, at
+		// which the circuit trips. Defaults to 0.5.
+		ErrorRate float64 `json:"error_rate"`
+		// CooldownMs is how long the circuit stays open before probing. Defaults to 30 seconds.
+		CooldownMs int `json:"cooldown_ms"`
+		// HalfOpenProbes is the number of the requests let through while half-open. The circuit
+		// closes if they all succeed, and opens again on the first failure. Defaults to 1.
+		HalfOpenProbes int `json:"half_open_probes"`
+		// FallbackStatus, FallbackBody and FallbackContentType are the local reply served while
+		// open. Defaults to a 503 with a plain text body.
+		FallbackStatus      int    `json:"fallback_status"`
+		FallbackBody        string `json:"fallback_body"`
+		FallbackContentType string `json:"fallback_content_type"`
+	}
+	// circuitBreakerFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// The circuits are shared across all the worker threads since the error rate must be
+	// measured over all the requests.
+	circuitBreakerFilterFactory struct {
+		config        circuitBreakerFilterConfig
+		window        time.Duration
+		cooldown      time.Duration
+		mux           sync.Mutex
+		circuits      map[string]*circuit
+		stateGauge    shared.MetricID
+		requests      shared.MetricID
+		hasStateGauge bool
+		hasRequests   bool
+	}
+	// circuit is the state of the circuit of a key. It is guarded by the factory mutex.
+	circuit struct {
+		state circuitState
+		// buckets is the ring of the rolling window, where bucket i covers the requests completed
+		// in the i-th slot of the window.
+		buckets [circuitBreakerBuckets]circuitBucket
+		// openedAt is when the circuit last opened.
+		openedAt time.Time
+		// probes is the number of the probes in flight while half-open, and probeSuccesses is the
+		// number of the successful ones.
+		probes, probeSuccesses int
+	}
+	circuitBucket struct {
+		// slot is the index of the window slot this bucket currently holds.
+		slot             int64
+		requests, errors int
+	}
+	// circuitBreakerFilter implements [shared.HttpFilter].
+	circuitBreakerFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *circuitBreakerFilterFactory
+		// key is set if the request is let through and its outcome needs to be recorded.
+		key   string
+		probe bool
+		// status is the response status, or zero if no response was received.
+		status int
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *circuitBreakerFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config circuitBreakerFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse circuit breaker config: %w", err)
+		}
+	}
+	switch config.Key {
+	case "":
+		config.Key = circuitBreakerKeyRoute
+	case circuitBreakerKeyRoute, circuitBreakerKeyCluster:
+	default:
+		return nil, fmt.Errorf("unknown key %q", config.Key)
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = circuitBreakerDefaultMinRequests
+	}
+	if config.ErrorRate <= 0 {
+		config.ErrorRate = circuitBreakerDefaultErrorRate
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = circuitBreakerDefaultHalfOpenProbes
+	}
+	if config.FallbackStatus == 0 {
+		config.FallbackStatus = http.StatusServiceUnavailable
+	}
+	if config.FallbackBody == "" {
+		config.FallbackBody = "Service Unavailable\n"
+	}
+	if config.FallbackContentType == "" {
+		config.FallbackContentType = "text/plain"
+	}
+	f := &circuitBreakerFilterFactory{
+		config:   config,
+		window:   time.Duration(config.WindowMs) * time.Millisecond,
+		cooldown: time.Duration(config.CooldownMs) * time.Millisecond,
+		circuits: make(map[string]*circuit),
+	}
+	if f.window <= 0 {
+		f.window = circuitBreakerDefaultWindow
+	}
+	if f.cooldown <= 0 {
+		f.cooldown = circuitBreakerDefaultCooldown
+	}
+	if id, res := handle.DefineGauge("circuit_breaker_state", "key"); res == shared.MetricsSuccess {
+		f.stateGauge, f.hasStateGauge = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the circuit breaker gauge: %v", res)
+	}
+	if id, res := handle.DefineCounter("circuit_breaker_requests_total", "key", "result"); res == shared.MetricsSuccess {
+		f.requests, f.hasRequests = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the circuit breaker counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *circuitBreakerFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &circuitBreakerFilter{handle: handle, factory: p}
+}
+
+// allow reports whether the request to the key is let through, and whether it is a probe.
+func (p *circuitBreakerFilterFactory) allow(key string, now time.Time) (allowed, probe bool, state circuitState) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	c := p.circuit(key)
+	if c.state == circuitOpen && now.Sub(c.openedAt) >= p.cooldown {
+		c.state, c.probes, c.probeSuccesses = circuitHalfOpen, 0, 0
+	}
+	switch c.state {
+	case circuitOpen:
+		return false, false, c.state
+	case circuitHalfOpen:
+		if c.probes+c.probeSuccesses >= p.config.HalfOpenProbes {
+			return false, false, c.state
+		}
+		c.probes++
+		return true, true, c.state
+	}
+	return true, false, c.state
+}
+
+// record records the outcome of the request let through, and returns the new state.
+func (p *circuitBreakerFilterFactory) record(key string, probe, failed bool, now time.Time) circuitState {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	c := p.circuit(key)
+	if probe {
+		if c.state != circuitHalfOpen {
+			return c.state
+		}
+		c.probes--
+		switch {
+		case failed:
+			c.state, c.openedAt = circuitOpen, now
+		case c.probeSuccesses+1 >= p.config.HalfOpenProbes:
+			// Start over with an empty window.
+			*c = circuit{}
+		default:
+			c.probeSuccesses++
+		}
+		return c.state
+	}
+
+	slotLength := p.window / circuitBreakerBuckets
+	slot := now.UnixNano() / int64(slotLength)
+	b := &c.buckets[slot%circuitBreakerBuckets]
+	if b.slot != slot {
+		*b = circuitBucket{slot: slot}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	if c.state != circuitClosed {
+		return c.state
+	}
+	var requests, errors int
+	for _, b := range c.buckets {
+		if slot-b.slot < circuitBreakerBuckets {
+			requests += b.requests
+			errors += b.errors
+		}
+	}
+	if requests >= p.config.MinRequests && float64(errors) >= float64(requests)*p.config.ErrorRate {
+		c.state, c.openedAt = circuitOpen, now
+	}
+	return c.state
+}
+
+func (p *circuitBreakerFilterFactory) circuit(key string) *circuit {
+	c, ok := p.circuits[key]
+	if !ok {
+		c = &circuit{}
+		p.circuits[key] = c
+	}
+	return c
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *circuitBreakerFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	attribute := shared.AttributeIDXdsRouteName
+	if p.factory.config.Key == circuitBreakerKeyCluster {
+		attribute = shared.AttributeIDXdsClusterName
+	}
+	key, ok := p.handle.GetAttributeString(attribute)
+	if !ok {
+		return shared.HeadersStatusContinue
+	}
+	key = strings.Clone(key)
+	allowed, probe, state := p.factory.allow(key, time.Now())
+	p.setState(key, state)
+	if !allowed {
+		p.count(key, "rejected")
+		config := &p.factory.config
+		p.handle.SendLocalResponse(uint32(config.FallbackStatus), [][2]string{{"Content-Type", config.FallbackContentType}},
+			[]byte(config.FallbackBody), "circuit_breaker_open")
+		return shared.HeadersStatusStop
+	}
+	p.key, p.probe = key, probe
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *circuitBreakerFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.status, _ = strconv.Atoi(headers.GetOne(":status"))
+	return shared.HeadersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *circuitBreakerFilter) OnStreamComplete() {
+	if p.key == "" {
+		return
+	}
+	// The resets, including the upstream timeouts without a response, count as the failures.
+	failed := p.status == 0 || p.status >= 500
+	result := "success"
+	if failed {
+		result = "failure"
+	}
+	p.count(p.key, result)
+	p.setState(p.key, p.factory.record(p.key, p.probe, failed, time.Now()))
+}
+
+func (p *circuitBreakerFilter) setState(key string, state circuitState) {
+	if p.factory.hasStateGauge {
+		p.handle.SetGaugeValue(p.factory.stateGauge, uint64(state), key)
+	}
+}
+
+func (p *circuitBreakerFilter) count(key, result string) {
+	if p.factory.hasRequests {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, key, result)
+	}
+}
@@ -0,0 +1,246 @@
+// Command abicheck tells whether a built dynamic module can be loaded by an Envoy binary, before it
+// is deployed. Envoy refuses a module built against another version of the ABI, and reports it only
+// when the module is loaded with an error such as "ABI version mismatch".
+//
+// The module is loaded to read the ABI version it advertises from
+// envoy_dynamic_module_on_program_init, which runs its initialization, such as the init functions of
+// a Go module. The version Envoy expects is searched for in the Envoy binary, which is copied out of
+// the image with docker if -image is given. It can also be given as is with -expected.
+//
+// The exit code is 0 if compatible, 1 if incompatible, and 2 if the check failed.
+//
+// Usage, from the go directory:
+//
+//	go run ./cmd/abicheck -envoy $(which envoy) libgo_module.so
+//	go run ./cmd/abicheck -image envoyproxy/envoy:dev libgo_module.so
+package main
+
+/*
+#cgo LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+typedef const char* (*program_init)(void);
+
+static const char* call_program_init(void* f) { return ((program_init)f)(); }
+*/
+import "C"
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// programInit is the symbol every module exports, returning its ABI version.
+	programInit = "envoy_dynamic_module_on_program_init"
+	// envoyPath is where the Envoy binary is in the official images.
+	envoyPath = "/usr/local/bin/envoy"
+	// versionLength is the length of an ABI version, the hex SHA-256 of the ABI header.
+	versionLength = 64
+)
+
+func main() {
+	envoy := flag.String("envoy", "", "the path of the Envoy binary")
+	image := flag.String("image", "", "the Envoy image, from which the binary at "+envoyPath+" is copied with docker")
+	expected := flag.String("expected", "", "the ABI version Envoy expects, instead of -envoy or -image")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s (-envoy path | -image ref | -expected version) module.so\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	sources := 0
+	for _, s := range []string{*envoy, *image, *expected} {
+		if s != "" {
+			sources++
+		}
+	}
+	if flag.NArg() != 1 || sources != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	reexecWithoutCgocheck()
+
+	compatible, err := run(flag.Arg(0), *envoy, *image, *expected)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "abicheck: %v\n", err)
+		os.Exit(2)
+	}
+	if !compatible {
+		os.Exit(1)
+	}
+}
+
+// reexecWithoutCgocheck runs the command again with GODEBUG=cgocheck=0 if it isn't set, as Envoy
+// must be run for the Go modules. The Go runtime of the module reads GODEBUG from the environment
+// the process started with, and otherwise panics when program init returns the version.
+func reexecWithoutCgocheck() {
+	if strings.Contains(os.Getenv("GODEBUG"), "cgocheck=0") {
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return
+	}
+	godebug := "cgocheck=0"
+	if v := os.Getenv("GODEBUG"); v != "" {
+		godebug = v + "," + godebug
+	}
+	env := append(os.Environ(), "GODEBUG="+godebug)
+	if err := syscall.Exec(self, os.Args, env); err != nil {
+		fmt.Fprintf(os.Stderr, "abicheck: failed to run with GODEBUG=cgocheck=0: %v\n", err)
+	}
+}
+
+func run(module, envoy, image, expected string) (bool, error) {
+	version, err := moduleVersion(module)
+	if err != nil {
+		return false, err
+	}
+	var source string
+	var versions []string
+	switch {
+	case expected != "":
+		source = "Envoy"
+		versions = []string{strings.ToLower(expected)}
+	case image != "":
+		source = image
+		versions, err = imageVersions(image)
+	default:
+		source = envoy
+		versions, err = binaryVersions(envoy)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("module %s advertises the ABI version %s\n", module, version)
+	for _, v := range versions {
+		if v == version {
+			fmt.Printf("compatible: %s expects the same ABI version\n", source)
+			return true, nil
+		}
+	}
+	if len(versions) == 1 {
+		fmt.Printf("incompatible: %s expects the ABI version %s\n", source, versions[0])
+	} else {
+		fmt.Printf("incompatible: %s expects none of them, but one of:\n", source)
+		for _, v := range versions {
+			fmt.Printf("\t%s\n", v)
+		}
+	}
+	fmt.Println("rebuild the module against the SDK of the same Envoy version")
+	return false, nil
+}
+
+// moduleVersion loads the module and returns the ABI version returned by its program init.
+func moduleVersion(path string) (string, error) {
+	// dlopen searches the library path for a name without a slash.
+	if !strings.Contains(path, "/") {
+		path = "./" + path
+	}
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	// The symbols of the callbacks into Envoy are missing, hence the lazy binding.
+	lib := C.dlopen(cPath, C.RTLD_LAZY|C.RTLD_LOCAL)
+	if lib == nil {
+		return "", fmt.Errorf("failed to load the module: %s", C.GoString(C.dlerror()))
+	}
+	cSymbol := C.CString(programInit)
+	defer C.free(unsafe.Pointer(cSymbol))
+	f := C.dlsym(lib, cSymbol)
+	if f == nil {
+		return "", fmt.Errorf("%s doesn't export %s: not a dynamic module", path, programInit)
+	}
+	version := C.call_program_init(f)
+	if version == nil {
+		return "", fmt.Errorf("%s failed to initialize", path)
+	}
+	return C.GoString(version), nil
+}
+
+// imageVersions copies the Envoy binary out of the image, and returns the ABI versions in it.
+func imageVersions(image string) ([]string, error) {
+	out, err := exec.Command("docker", "create", image).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a container of %s: %w", image, commandError(err))
+	}
+	container := strings.TrimSpace(string(out))
+	defer func() { _ = exec.Command("docker", "rm", container).Run() }()
+
+	dir, err := os.MkdirTemp("", "abicheck")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "envoy")
+	if out, err := exec.Command("docker", "cp", container+":"+envoyPath, binary).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to copy %s out of %s: %w: %s", envoyPath, image, err, bytes.TrimSpace(out))
+	}
+	return binaryVersions(binary)
+}
+
+// binaryVersions returns the strings of the read-only data of the Envoy binary that look like an
+// ABI version. Envoy has the version it expects as a literal, among few others like it if any.
+func binaryVersions(path string) ([]string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the Envoy binary: %w", err)
+	}
+	defer f.Close()
+	section := f.Section(".rodata")
+	if section == nil {
+		return nil, fmt.Errorf("%s has no .rodata section", path)
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the .rodata section of %s: %w", path, err)
+	}
+	versions := hexStrings(data)
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no ABI version found in %s: is it a build of Envoy with dynamic modules?", path)
+	}
+	return versions, nil
+}
+
+// hexStrings returns the distinct NUL-terminated strings of versionLength lowercase hex digits.
+func hexStrings(data []byte) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	start := 0
+	for i, c := range data {
+		if isHex(c) {
+			continue
+		}
+		if c == 0 && i-start == versionLength {
+			if s := string(data[start:i]); !seen[s] {
+				seen[s] = true
+				ret = append(ret, s)
+			}
+		}
+		start = i + 1
+	}
+	return ret
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+// commandError adds the standard error of a failed command to the error.
+func commandError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return err
+}
@@ -0,0 +1,757 @@
+// Command envoyconfig generates an Envoy config running each HTTP filter of the Go module on its own
+// listener, so that a new filter is runnable as soon as it is registered:
+//
+//   - The filters are read from the map passed to RegisterHttpFilterConfigFactories in main.go, and
+//     get the listeners from -port on in the order of the map.
+//   - The config of a filter is found in the Create method of its factory, as the type its
+//     unparsed config is decoded into. The fields of the type are listed above the listener with
+//     their doc comments, as the schema of the config.
+//   - The filter config of the listener has the fields with an example tag, such as
+//     `json:"experiment" example:"checkout"`, so the filters whose config requires a field must
+//     have one on it. The example of a string field is the string, and the others are YAML,
+//     such as `example:"[{name: control, weight: 50}]"`. The nested structs are filled in the same
+//     way. The file paths of the examples are relative to the integration directory.
+//   - -config replaces the generated config of a filter, for the values that only fit an
+//     environment, such as a port already used there.
+//
+// Each listener routes to the httpbin cluster, which is the -upstream address. Usage, from the go
+// directory:
+//
+//	go run ./cmd/envoyconfig [-port 1300] [-config 'name={"key": "value"}'] -o ../integration/envoy.generated.yaml
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxDepth bounds the nesting of the config types, which could refer to themselves.
+const maxDepth = 5
+
+type (
+	// pkg is a parsed package of the module.
+	pkg struct {
+		dir   string
+		types map[string]*ast.TypeSpec
+		// funcs are the functions by name, and the methods by "Type.Name". The init functions are
+		// only in all.
+		funcs map[string]*ast.FuncDecl
+		all   []*ast.FuncDecl
+		// imports are the import paths of the files by their local names.
+		imports map[string]string
+	}
+	// generator finds the configs of the filters in the packages of the module.
+	generator struct {
+		root       string
+		modulePath string
+		pkgs       map[string]*pkg
+	}
+	// filter is a listener of the generated config.
+	filter struct {
+		Name string
+		Port int
+		// Fields is the schema of the config.
+		Fields []field
+		// Config is the example config, indented for the YAML block.
+		Config string
+	}
+	// field is a field of a config, with the fields of the nested structs flattened as "a.b", and
+	// those of the structs in a list as "a[].b".
+	field struct {
+		Name string
+		Type string
+		Doc  string
+	}
+	// overrides is the -config flag.
+	overrides map[string]string
+)
+
+// String implements [flag.Value].
+func (o overrides) String() string { return "" }
+
+// Set implements [flag.Value].
+func (o overrides) Set(s string) error {
+	name, config, ok := strings.Cut(s, "=")
+	if !ok || !json.Valid([]byte(config)) {
+		return fmt.Errorf("must be name=json, got %q", s)
+	}
+	o[name] = config
+	return nil
+}
+
+func main() {
+	dir := flag.String("dir", ".", "the directory of the Go module of the filters")
+	out := flag.String("o", "", "the file to write the config to, instead of the standard output")
+	port := flag.Int("port", 1300, "the port of the listener of the first filter")
+	adminPort := flag.Int("admin-port", 9904, "the port of the admin interface")
+	upstream := flag.String("upstream", "127.0.0.1:1234", "the address of the httpbin cluster")
+	configs := overrides{}
+	flag.Var(configs, "config", "name=json replaces the generated config of the filter, repeated for each")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*dir, *out, *port, *adminPort, *upstream, configs); err != nil {
+		fmt.Fprintf(os.Stderr, "envoyconfig: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, out string, port, adminPort int, upstream string, configs overrides) error {
+	host, upstreamPort, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream %q: %w", upstream, err)
+	}
+	g, err := newGenerator(dir)
+	if err != nil {
+		return err
+	}
+	filters, err := g.filters(port, configs)
+	if err != nil {
+		return err
+	}
+	for name := range configs {
+		return fmt.Errorf("-config of %s: no such filter", name)
+	}
+
+	var b bytes.Buffer
+	err = envoyTemplate.Execute(&b, map[string]any{
+		"AdminPort": adminPort, "Filters": filters, "UpstreamHost": host, "UpstreamPort": upstreamPort,
+	})
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(b.Bytes())
+		return err
+	}
+	return os.WriteFile(out, b.Bytes(), 0o644)
+}
+
+func newGenerator(root string) (*generator, error) {
+	goMod, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the go.mod of the module: %w", err)
+	}
+	line, _, _ := bytes.Cut(goMod, []byte("\n"))
+	modulePath, ok := strings.CutPrefix(strings.TrimSpace(string(line)), "module ")
+	if !ok {
+		return nil, errors.New("the go.mod doesn't start with the module path")
+	}
+	return &generator{root: root, modulePath: modulePath, pkgs: make(map[string]*pkg)}, nil
+}
+
+// pkg parses the package in the directory, relative to the root of the module.
+func (g *generator) pkg(dir string) (*pkg, error) {
+	if p, ok := g.pkgs[dir]; ok {
+		return p, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(g.root, dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	p := &pkg{
+		dir: dir, types: make(map[string]*ast.TypeSpec), funcs: make(map[string]*ast.FuncDecl),
+		imports: make(map[string]string),
+	}
+	fset := token.NewFileSet()
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, imp := range file.Imports {
+			importPath, _ := strconv.Unquote(imp.Path.Value)
+			name := importPath[strings.LastIndex(importPath, "/")+1:]
+			if imp.Name != nil {
+				name = imp.Name.Name
+			}
+			p.imports[name] = importPath
+		}
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if spec, ok := spec.(*ast.TypeSpec); ok {
+						p.types[spec.Name.Name] = spec
+					}
+				}
+			case *ast.FuncDecl:
+				name := decl.Name.Name
+				if decl.Recv != nil {
+					name = receiverType(decl.Recv.List[0].Type) + "." + name
+				}
+				if name != "init" {
+					p.funcs[name] = decl
+				}
+				p.all = append(p.all, decl)
+			}
+		}
+	}
+	g.pkgs[dir] = p
+	return p, nil
+}
+
+// filters returns the registered filters in the order of the registry, with the listener ports
+// from port on.
+func (g *generator) filters(port int, configs overrides) ([]filter, error) {
+	main, err := g.pkg(".")
+	if err != nil {
+		return nil, err
+	}
+	registry := findRegistry(main)
+	if registry == nil {
+		return nil, errors.New("no map literal passed to RegisterHttpFilterConfigFactories in the main package")
+	}
+	var filters []filter
+	for _, elt := range registry.Elts {
+		kv := elt.(*ast.KeyValueExpr)
+		key, ok := kv.Key.(*ast.BasicLit)
+		if !ok {
+			return nil, fmt.Errorf("the filter name %s is not a string literal", types.ExprString(kv.Key))
+		}
+		name, _ := strconv.Unquote(key.Value)
+		f := filter{Name: name, Port: port + len(filters), Config: "{}"}
+
+		factoryPkg, factory, err := g.factoryType(main, kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", name, err)
+		}
+		var config *ast.StructType
+		if create := factoryPkg.funcs[factory+".Create"]; create != nil {
+			config, factoryPkg = g.configType(factoryPkg, create, 1, 0)
+		}
+		if config != nil {
+			f.Fields = g.schema(factoryPkg, config, "", 0)
+			example, err := g.example(factoryPkg, config, 0)
+			if err != nil {
+				return nil, fmt.Errorf("filter %s: %w", name, err)
+			}
+			if example != nil {
+				if f.Config, err = formatConfig(example); err != nil {
+					return nil, fmt.Errorf("filter %s: %w", name, err)
+				}
+			}
+		}
+		if config, ok := configs[name]; ok {
+			f.Config = config
+			delete(configs, name)
+		}
+		f.Config = strings.ReplaceAll(f.Config, "\n", "\n"+strings.Repeat(" ", 26))
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// findRegistry returns the map literal passed to RegisterHttpFilterConfigFactories, possibly
+// through the wrappers of the factories.
+func findRegistry(p *pkg) *ast.CompositeLit {
+	var registry *ast.CompositeLit
+	for _, fn := range p.all {
+		ast.Inspect(fn, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || registry != nil {
+				return registry == nil
+			}
+			if sel, ok := call.Fun.(*ast.SelectorExpr); !ok || sel.Sel.Name != "RegisterHttpFilterConfigFactories" {
+				return true
+			}
+			ast.Inspect(call, func(n ast.Node) bool {
+				if lit, ok := n.(*ast.CompositeLit); ok && registry == nil {
+					if _, ok := lit.Type.(*ast.MapType); ok {
+						registry = lit
+					}
+				}
+				return registry == nil
+			})
+			return false
+		})
+	}
+	return registry
+}
+
+// factoryType returns the package and the name of the type of a factory in the registry, such as
+// &fooFilterConfigFactory{} or &foo.FilterConfigFactory{}.
+func (g *generator) factoryType(p *pkg, expr ast.Expr) (*pkg, string, error) {
+	if unary, ok := expr.(*ast.UnaryExpr); ok && unary.Op == token.AND {
+		expr = unary.X
+	}
+	lit, ok := expr.(*ast.CompositeLit)
+	if !ok {
+		return nil, "", fmt.Errorf("the factory %s is not a composite literal", types.ExprString(expr))
+	}
+	switch t := lit.Type.(type) {
+	case *ast.Ident:
+		return p, t.Name, nil
+	case *ast.SelectorExpr:
+		importPath := p.imports[types.ExprString(t.X)]
+		rel, ok := strings.CutPrefix(importPath, g.modulePath+"/")
+		if !ok {
+			return nil, "", fmt.Errorf("the factory %s is not in the module", types.ExprString(t))
+		}
+		factoryPkg, err := g.pkg(rel)
+		return factoryPkg, t.Sel.Name, err
+	default:
+		return nil, "", fmt.Errorf("unsupported factory type %s", types.ExprString(lit.Type))
+	}
+}
+
+// configType returns the struct the param-th parameter of the function, the unparsed config, is
+// decoded into with json.Unmarshal, following it into the functions of the package it is passed
+// to. It returns nil if the function doesn't decode it.
+func (g *generator) configType(p *pkg, fn *ast.FuncDecl, param, depth int) (*ast.StructType, *pkg) {
+	paramName := paramName(fn, param)
+	if paramName == "" || fn.Body == nil || depth > maxDepth {
+		return nil, nil
+	}
+	var config *ast.StructType
+	var configPkg *pkg
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || config != nil {
+			return config == nil
+		}
+		if types.ExprString(call.Fun) == "json.Unmarshal" && len(call.Args) == 2 && isIdent(call.Args[0], paramName) {
+			target := call.Args[1]
+			if unary, ok := target.(*ast.UnaryExpr); ok && unary.Op == token.AND {
+				target = unary.X
+			}
+			if ident, ok := target.(*ast.Ident); ok {
+				config, configPkg = p.structType(localType(fn.Body, ident.Name)), p
+			}
+			return false
+		}
+		if ident, ok := call.Fun.(*ast.Ident); ok && p.funcs[ident.Name] != nil {
+			for i, arg := range call.Args {
+				if isIdent(arg, paramName) {
+					if config, configPkg = g.configType(p, p.funcs[ident.Name], i, depth+1); config != nil {
+						return false
+					}
+				}
+			}
+		}
+		return true
+	})
+	return config, configPkg
+}
+
+// schema returns the fields of the config struct.
+func (g *generator) schema(p *pkg, config *ast.StructType, prefix string, depth int) []field {
+	var fields []field
+	for _, f := range config.Fields.List {
+		name, ok := jsonName(f)
+		if !ok {
+			if nested := p.structType(embeddedType(f)); nested != nil && depth < maxDepth {
+				fields = append(fields, g.schema(p, nested, prefix, depth+1)...)
+			}
+			continue
+		}
+		fields = append(fields, field{Name: prefix + name, Type: p.jsonType(f.Type, 0), Doc: firstSentence(f.Doc)})
+		if depth >= maxDepth {
+			continue
+		}
+		elem, list := elemType(f.Type)
+		if nested := p.structType(elem); nested != nil {
+			if list {
+				name += "[]"
+			}
+			fields = append(fields, g.schema(p, nested, prefix+name+".", depth+1)...)
+		}
+	}
+	return fields
+}
+
+// example returns the example of the config struct, with the fields of the example tags and the
+// nested structs having some, or nil if none has.
+func (g *generator) example(p *pkg, config *ast.StructType, depth int) (*orderedObject, error) {
+	var ret orderedObject
+	for _, f := range config.Fields.List {
+		name, ok := jsonName(f)
+		if !ok {
+			if nested := p.structType(embeddedType(f)); nested != nil && depth < maxDepth {
+				embedded, err := g.example(p, nested, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				if embedded != nil {
+					ret = append(ret, *embedded...)
+				}
+			}
+			continue
+		}
+		if example, ok := fieldTag(f).Lookup("example"); ok {
+			value, err := exampleValue(f.Type, example)
+			if err != nil {
+				return nil, fmt.Errorf("invalid example of %s: %w", name, err)
+			}
+			ret = append(ret, member{name, value})
+			continue
+		}
+		elem, list := elemType(f.Type)
+		if nested := p.structType(elem); nested != nil && !list && depth < maxDepth {
+			value, err := g.example(p, nested, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				ret = append(ret, member{name, value})
+			}
+		}
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return &ret, nil
+}
+
+// exampleValue returns the value of the example tag of a field of the type.
+func exampleValue(t ast.Expr, example string) (any, error) {
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	if isIdent(t, "string") {
+		return example, nil
+	}
+	var value any
+	if err := yaml.Unmarshal([]byte(example), &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+type (
+	// orderedObject is a JSON object keeping the order of the fields of the struct.
+	orderedObject []member
+	member        struct {
+		name  string
+		value any
+	}
+)
+
+// MarshalJSON implements [json.Marshaler].
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(m.name)
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// formatConfig formats the example with a field per line, and the values on a single line.
+func formatConfig(example *orderedObject) (string, error) {
+	var b strings.Builder
+	b.WriteString("{\n")
+	for i, m := range *example {
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "  %q: %s", m.name, spaceJSON(value))
+		if i < len(*example)-1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+// jsonType returns the JSON type of the Go type, such as "[]string" for []string and "number" for
+// uint64. The other types are left as they are.
+func (p *pkg) jsonType(t ast.Expr, depth int) string {
+	if depth > maxDepth {
+		return types.ExprString(t)
+	}
+	switch t := t.(type) {
+	case *ast.StarExpr:
+		return p.jsonType(t.X, depth+1)
+	case *ast.ArrayType:
+		if isIdent(t.Elt, "byte") {
+			return "string"
+		}
+		return "[]" + p.jsonType(t.Elt, depth+1)
+	case *ast.MapType:
+		return "map[" + p.jsonType(t.Key, depth+1) + "]" + p.jsonType(t.Value, depth+1)
+	case *ast.Ident:
+		switch t.Name {
+		case "string", "bool":
+			return t.Name
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64",
+			"float32", "float64":
+			return "number"
+		case "any":
+			return "any"
+		}
+		if spec := p.types[t.Name]; spec != nil {
+			if _, ok := spec.Type.(*ast.StructType); ok {
+				return "object"
+			}
+			return p.jsonType(spec.Type, depth+1)
+		}
+	case *ast.SelectorExpr:
+		if types.ExprString(t) == "json.RawMessage" {
+			return "any"
+		}
+	}
+	return types.ExprString(t)
+}
+
+// spaceJSON adds a space after the commas and the colons of the compact JSON, outside the strings.
+func spaceJSON(compact []byte) []byte {
+	ret := make([]byte, 0, len(compact)*5/4)
+	inString, escaped := false, false
+	for _, c := range compact {
+		ret = append(ret, c)
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case !inString && (c == ',' || c == ':'):
+			ret = append(ret, ' ')
+		}
+	}
+	return ret
+}
+
+// structType returns the struct of the named type in the package, or nil.
+func (p *pkg) structType(expr ast.Expr) *ast.StructType {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	ident, ok := expr.(*ast.Ident)
+	if !ok || p.types[ident.Name] == nil {
+		return nil
+	}
+	st, _ := p.types[ident.Name].Type.(*ast.StructType)
+	return st
+}
+
+// localType returns the type of the variable declared in the body, as in "var v T", "v := T{}",
+// "v := &T{}", or "v := new(T)", or nil.
+func localType(body *ast.BlockStmt, name string) ast.Expr {
+	var ret ast.Expr
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ValueSpec:
+			for _, ident := range n.Names {
+				if ident.Name == name && n.Type != nil {
+					ret = n.Type
+				}
+			}
+		case *ast.AssignStmt:
+			for i, lhs := range n.Lhs {
+				if !isIdent(lhs, name) || n.Tok != token.DEFINE || i >= len(n.Rhs) {
+					continue
+				}
+				rhs := n.Rhs[i]
+				if unary, ok := rhs.(*ast.UnaryExpr); ok && unary.Op == token.AND {
+					rhs = unary.X
+				}
+				switch rhs := rhs.(type) {
+				case *ast.CompositeLit:
+					ret = rhs.Type
+				case *ast.CallExpr:
+					if isIdent(rhs.Fun, "new") && len(rhs.Args) == 1 {
+						ret = rhs.Args[0]
+					}
+				}
+			}
+		}
+		return ret == nil
+	})
+	return ret
+}
+
+// paramName returns the name of the i-th parameter of the function, or "".
+func paramName(fn *ast.FuncDecl, i int) string {
+	for _, param := range fn.Type.Params.List {
+		if i < len(param.Names) {
+			return param.Names[i].Name
+		}
+		i -= max(len(param.Names), 1)
+		if i < 0 {
+			break
+		}
+	}
+	return ""
+}
+
+// receiverType returns the name of the type of a receiver, such as T for *T.
+func receiverType(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	return types.ExprString(expr)
+}
+
+// jsonName returns the name of the field in JSON, and false if it is embedded or not encoded.
+func jsonName(f *ast.Field) (string, bool) {
+	if len(f.Names) == 0 {
+		return "", false
+	}
+	name, _, _ := strings.Cut(fieldTag(f).Get("json"), ",")
+	if name == "-" || !f.Names[0].IsExported() {
+		return "", false
+	}
+	return cmp.Or(name, f.Names[0].Name), true
+}
+
+func fieldTag(f *ast.Field) reflect.StructTag {
+	if f.Tag == nil {
+		return ""
+	}
+	tag, _ := strconv.Unquote(f.Tag.Value)
+	return reflect.StructTag(tag)
+}
+
+// embeddedType returns the type of an embedded field, or nil.
+func embeddedType(f *ast.Field) ast.Expr {
+	if len(f.Names) != 0 {
+		return nil
+	}
+	return f.Type
+}
+
+// elemType returns the type of the elements of a slice, an array or a map, and true, or the type
+// and false.
+func elemType(t ast.Expr) (ast.Expr, bool) {
+	switch t := t.(type) {
+	case *ast.ArrayType:
+		return t.Elt, true
+	case *ast.MapType:
+		return t.Value, true
+	default:
+		return t, false
+	}
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+// firstSentence returns the first sentence of the doc comment, on a single line.
+func firstSentence(doc *ast.CommentGroup) string {
+	text := strings.Join(strings.Fields(doc.Text()), " ")
+	for i := 0; ; {
+		j := strings.Index(text[i:], ". ")
+		if j < 0 {
+			return text
+		}
+		i += j + 1
+		if !strings.HasSuffix(text[:i], "e.g.") && !strings.HasSuffix(text[:i], "i.e.") {
+			return text[:i]
+		}
+	}
+}
+
+var envoyTemplate = template.Must(template.New("envoy").Parse(`# Code generated by "go run ./cmd/envoyconfig" in the go directory. DO NOT EDIT.
+#
+# Each HTTP filter of the Go module runs on its own listener with the example config of its config
+# type. Regenerate it with "make envoy-config" after registering a filter or changing its config.
+admin:
+  address:
+    socket_address:
+      address: 127.0.0.1
+      port_value: {{.AdminPort}}
+static_resources:
+  listeners:
+{{- range .Filters}}
+{{- if .Fields}}
+    # The config of {{.Name}}:
+    #
+{{- range .Fields}}
+    #   {{.Name}} {{.Type}}{{if .Doc}}: {{.Doc}}{{end}}
+{{- end}}
+{{- else}}
+    # {{.Name}} has no config.
+{{- end}}
+    - name: {{.Name}}
+      address:
+        socket_address:
+          address: 0.0.0.0
+          port_value: {{.Port}}
+      filter_chains:
+        - filters:
+            - name: envoy.filters.network.http_connection_manager
+              typed_config:
+                "@type": type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager
+                stat_prefix: {{.Name}}
+                route_config:
+                  virtual_hosts:
+                    - name: local_route
+                      domains:
+                        - "*"
+                      routes:
+                        - match:
+                            prefix: "/"
+                          route:
+                            cluster: httpbin
+                http_filters:
+                  - name: dynamic_modules/{{.Name}}
+                    typed_config:
+                      # https://www.envoyproxy.io/docs/envoy/latest/api-v3/extensions/dynamic_modules/v3/dynamic_modules.proto#envoy-v3-api-msg-extensions-dynamic-modules-v3-dynamicmoduleconfig
+                      "@type": type.googleapis.com/envoy.extensions.filters.http.dynamic_modules.v3.DynamicModuleFilter
+                      dynamic_module_config:
+                        name: go_module
+                        do_not_close: true
+                      filter_name: {{.Name}}
+                      filter_config:
+                        "@type": "type.googleapis.com/google.protobuf.StringValue"
+                        value: |
+                          {{.Config}}
+                  - name: envoy.filters.http.router
+                    typed_config:
+                      "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+{{- end}}
+  clusters:
+    - name: httpbin
+      connect_timeout: 5s
+      type: strict_dns
+      lb_policy: round_robin
+      load_assignment:
+        cluster_name: httpbin
+        endpoints:
+          - lb_endpoints:
+              - endpoint:
+                  address:
+                    socket_address:
+                      address: {{.UpstreamHost}}
+                      port_value: {{.UpstreamPort}}
+`))
@@ -0,0 +1,256 @@
+// Command jsfilter-test runs the JavaScript filter scripts against synthetic requests without
+// Envoy. The requests and the expectations are described in YAML or JSON fixtures:
+//
+//	script: filter.js # Relative to the fixture.
+//	config:           # Optional. The other fields of the filter config, e.g. limits.
+//	  on_configure: per_vm_quiet
+//	cases:
+//	  - name: sets x-foo
+//	    request:
+//	      headers: {foo: bar}
+//	    response:
+//	      headers: {":status": "200"}
+//	      trailers: {grpc-status: "0"}
+//	    metadata:         # Optional. Pre-populated metadata keyed by the source name.
+//	      route: {ns: {key: value}}
+//	    expect:
+//	      request_headers_status: continue # continue, stop, or buffer.
+//	      request_headers: {x-foo: bar, x-absent: null}
+//	      response_headers: {x-status: "200"}
+//	      response_trailers: {x-js-trailer: "true"}
+//	      metadata: {javascript: {foo: bar}}
+//
+// When a hook stops the iteration, the runner waits until the script continues it, for example,
+// from a ctx.schedule callback, before running the next phase.
+//
+// Usage:
+//
+//	jsfilter-test [-script path] [-timeout duration] fixture.yaml...
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"gopkg.in/yaml.v3"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/javascript"
+)
+
+type (
+	// fixture is the top-level structure of a fixture file.
+	fixture struct {
+		Script string         `yaml:"script"`
+		Config map[string]any `yaml:"config"`
+		Cases  []testCase     `yaml:"cases"`
+	}
+	testCase struct {
+		Name     string                               `yaml:"name"`
+		Request  message                              `yaml:"request"`
+		Response message                              `yaml:"response"`
+		Metadata map[string]map[string]map[string]any `yaml:"metadata"`
+		Expect   expectation                          `yaml:"expect"`
+	}
+	message struct {
+		Headers  map[string]string `yaml:"headers"`
+		Trailers map[string]string `yaml:"trailers"`
+	}
+	// expectation holds the expected values. A null header value means the header must be absent.
+	expectation struct {
+		RequestHeadersStatus  string                    `yaml:"request_headers_status"`
+		ResponseHeadersStatus string                    `yaml:"response_headers_status"`
+		RequestHeaders        map[string]*string        `yaml:"request_headers"`
+		RequestTrailers       map[string]*string        `yaml:"request_trailers"`
+		ResponseHeaders       map[string]*string        `yaml:"response_headers"`
+		ResponseTrailers      map[string]*string        `yaml:"response_trailers"`
+		Metadata              map[string]map[string]any `yaml:"metadata"`
+	}
+)
+
+// metadataSources maps the source names in the fixtures to [shared.MetadataSourceType]. The names
+// are the same as the ones accepted by ctx.getMetadata.
+var metadataSources = map[string]shared.MetadataSourceType{
+	"dynamic":       shared.MetadataSourceTypeDynamic,
+	"route":         shared.MetadataSourceTypeRoute,
+	"cluster":       shared.MetadataSourceTypeCluster,
+	"host":          shared.MetadataSourceTypeHost,
+	"host_locality": shared.MetadataSourceTypeHostLocality,
+}
+
+var headersStatuses = map[shared.HeadersStatus]string{
+	shared.HeadersStatusContinue:         "continue",
+	shared.HeadersStatusStop:             "stop",
+	shared.HeadersStatusStopAllAndBuffer: "buffer",
+}
+
+func main() {
+	script := flag.String("script", "", "path to the script, overriding the one in the fixtures")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long to wait for a stopped hook to be continued")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] fixture.yaml...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		ok, err := runFixture(path, *script, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		failed = failed || !ok
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runFixture runs all the cases in the fixture at path. Returns false if any case failed.
+func runFixture(path, script string, timeout time.Duration) (bool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var f fixture
+	// YAML is a superset of JSON, so this handles both.
+	if err = yaml.Unmarshal(raw, &f); err != nil {
+		return false, fmt.Errorf("failed to parse fixture: %w", err)
+	}
+	if script == "" {
+		if f.Script == "" {
+			return false, fmt.Errorf("script must be set in the fixture or with -script")
+		}
+		script = filepath.Join(filepath.Dir(path), f.Script)
+	}
+	source, err := os.ReadFile(script)
+	if err != nil {
+		return false, err
+	}
+	config := maps.Clone(f.Config)
+	if config == nil {
+		config = map[string]any{}
+	}
+	config["script"] = string(source)
+	unparsedConfig, err := json.Marshal(config)
+	if err != nil {
+		return false, fmt.Errorf("invalid config: %w", err)
+	}
+
+	factory, err := (&javascript.FilterConfigFactory{}).Create(filtertest.NewConfigHandle(), unparsedConfig)
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	for i, c := range f.Cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("case %d", i)
+		}
+		if failures := runCase(factory, &c, timeout); len(failures) > 0 {
+			ok = false
+			fmt.Printf("FAIL %s: %s\n", path, name)
+			for _, failure := range failures {
+				fmt.Printf("    %s\n", failure)
+			}
+		} else {
+			fmt.Printf("PASS %s: %s\n", path, name)
+		}
+	}
+	return ok, nil
+}
+
+// runCase runs the hooks in the order Envoy does and returns the failed expectations.
+func runCase(factory shared.HttpFilterFactory, c *testCase, timeout time.Duration) []string {
+	h := filtertest.NewHandle()
+	h.RequestHeaderMap = filtertest.NewHeaderMap(filtertest.HeadersFromMap(c.Request.Headers)...)
+	h.RequestTrailerMap = filtertest.NewHeaderMap(filtertest.HeadersFromMap(c.Request.Trailers)...)
+	h.ResponseHeaderMap = filtertest.NewHeaderMap(filtertest.HeadersFromMap(c.Response.Headers)...)
+	h.ResponseTrailerMap = filtertest.NewHeaderMap(filtertest.HeadersFromMap(c.Response.Trailers)...)
+	var failures []string
+	for source, namespaces := range c.Metadata {
+		sourceType, ok := metadataSources[source]
+		if !ok {
+			return []string{fmt.Sprintf("unknown metadata source %q", source)}
+		}
+		h.Metadata[sourceType] = namespaces
+	}
+
+	var filter shared.HttpFilter
+	h.Do(func() { filter = factory.Create(h) })
+	defer h.Do(filter.OnStreamComplete)
+
+	var status shared.HeadersStatus
+	h.Do(func() { status = filter.OnRequestHeaders(h.RequestHeaderMap, false) })
+	failures = append(failures, checkStatus("request headers", status, c.Expect.RequestHeadersStatus)...)
+	if status != shared.HeadersStatusContinue &&
+		!h.Await(timeout, func() bool { return h.ContinueRequestCount() > 0 }) {
+		return append(failures, "request was not continued")
+	}
+	if c.Request.Trailers != nil {
+		h.Do(func() { filter.OnRequestTrailers(h.RequestTrailerMap) })
+	}
+
+	h.Do(func() { status = filter.OnResponseHeaders(h.ResponseHeaderMap, false) })
+	failures = append(failures, checkStatus("response headers", status, c.Expect.ResponseHeadersStatus)...)
+	if status != shared.HeadersStatusContinue &&
+		!h.Await(timeout, func() bool { return h.ContinueResponseCount() > 0 }) {
+		return append(failures, "response was not continued")
+	}
+	if c.Response.Trailers != nil {
+		h.Do(func() { filter.OnResponseTrailers(h.ResponseTrailerMap) })
+	}
+	h.Wait()
+
+	failures = append(failures, checkHeaders("request header", h.RequestHeaderMap, c.Expect.RequestHeaders)...)
+	failures = append(failures, checkHeaders("request trailer", h.RequestTrailerMap, c.Expect.RequestTrailers)...)
+	failures = append(failures, checkHeaders("response header", h.ResponseHeaderMap, c.Expect.ResponseHeaders)...)
+	failures = append(failures, checkHeaders("response trailer", h.ResponseTrailerMap, c.Expect.ResponseTrailers)...)
+	for ns, values := range c.Expect.Metadata {
+		for key, want := range values {
+			got := h.DynamicMetadata(ns, key)
+			if got == nil || fmt.Sprint(got) != fmt.Sprint(want) {
+				failures = append(failures, fmt.Sprintf("metadata %s.%s: got %v, want %v", ns, key, got, want))
+			}
+		}
+	}
+	return failures
+}
+
+func checkStatus(hook string, got shared.HeadersStatus, want string) []string {
+	if want == "" || headersStatuses[got] == want {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s status: got %s, want %s", hook, headersStatuses[got], want)}
+}
+
+func checkHeaders(kind string, headers *filtertest.HeaderMap, want map[string]*string) []string {
+	var failures []string
+	for _, key := range slices.Sorted(maps.Keys(want)) {
+		values := headers.Get(key)
+		switch {
+		case want[key] == nil && len(values) > 0:
+			failures = append(failures, fmt.Sprintf("%s %s: got %q, want absent", kind, key, strings.Join(values, ",")))
+		case want[key] != nil && len(values) == 0:
+			failures = append(failures, fmt.Sprintf("%s %s: absent, want %q", kind, key, *want[key]))
+		case want[key] != nil && strings.Join(values, ",") != *want[key]:
+			failures = append(failures, fmt.Sprintf("%s %s: got %q, want %q", kind, key, strings.Join(values, ","), *want[key]))
+		}
+	}
+	return failures
+}
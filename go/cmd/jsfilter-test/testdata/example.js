@@ -0,0 +1,22 @@
+function OnConfigure() {}
+
+function OnRequestHeaders(ctx) {
+    let foo = ctx.getRequestHeader("foo");
+    ctx.setRequestHeader("x-foo", foo);
+    ctx.setMetadata("javascript", "foo", foo);
+    if (ctx.getRequestHeader("js-delay") !== "") {
+        ctx.schedule(10, (c) => c.continueRequest());
+        return "stop";
+    }
+}
+
+function OnResponseHeaders(ctx) {
+    ctx.setResponseHeader("x-dog", ctx.getRequestHeader("dog"));
+    ctx.setResponseHeader("x-metadata-foo", ctx.getMetadata("javascript", "foo") || "");
+    ctx.setResponseHeader("x-route", ctx.getMetadata("example", "route", "route") || "");
+    ctx.setResponseHeader("x-status", ctx.getResponseHeader(":status"));
+}
+
+function OnResponseTrailers(ctx) {
+    ctx.setTrailer("x-js-trailer", "true");
+}
@@ -0,0 +1,183 @@
+// Command newfilter generates the skeleton of a new Go filter of the module from a template:
+//
+//   - <name>.go with the config, the factories and the filter,
+//   - <name>_test.go exercising the filter with filtertest,
+//   - the registration of the filter in main.go,
+//
+// and prints the snippet adding the filter to a listener of envoy.yaml. The templates are:
+//
+//   - passthrough: the hooks continuing the requests, to start from scratch.
+//   - headers: rejecting the requests missing a header and setting the response headers, with a
+//     counter.
+//   - body: buffering the request bodies up to a limit before they are transformed.
+//   - async: stopping the requests while a goroutine works, and continuing them via the scheduler.
+//
+// Usage, from the go directory:
+//
+//	go run ./cmd/newfilter [-template passthrough] [-dir .] name
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// templates has a "filter" and a "test" template per kind, and the envoy.yaml snippet.
+//
+//go:embed templates/*.tmpl
+var templates embed.FS
+
+var (
+	kinds     = []string{"passthrough", "headers", "body", "async"}
+	validName = regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z0-9]+)*$`)
+)
+
+// data is the input of the templates.
+type data struct {
+	// Name is the filter name, in snake case, such as "request_tagger".
+	Name string
+	// Ident is the prefix of the identifiers, in lower camel case, such as "requestTagger".
+	Ident string
+	// Type is Ident in upper camel case, such as "RequestTagger".
+	Type string
+	// Header is Name in kebab case, for the header names, such as "request-tagger".
+	Header string
+}
+
+func main() {
+	kind := flag.String("template", "passthrough", "the template, one of "+strings.Join(kinds, ", "))
+	dir := flag.String("dir", ".", "the directory of the Go module of the filters")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] name\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0), *kind, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "newfilter: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(name, kind, dir string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid name %q: must be in snake case, such as request_tagger", name)
+	}
+	if !slices.Contains(kinds, kind) {
+		return fmt.Errorf("unknown template %q: must be one of %s", kind, strings.Join(kinds, ", "))
+	}
+	d := newData(name)
+	filterPath := filepath.Join(dir, name+".go")
+	testPath := filepath.Join(dir, name+"_test.go")
+	for _, path := range []string{filterPath, testPath} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		}
+	}
+	mainPath := filepath.Join(dir, "main.go")
+	mainSource, err := os.ReadFile(mainPath)
+	if err != nil {
+		return err
+	}
+	registered, err := register(mainSource, d)
+	if err != nil {
+		return err
+	}
+
+	t, err := template.ParseFS(templates, "templates/"+kind+".go.tmpl")
+	if err != nil {
+		return err
+	}
+	filterSource, err := execute(t, "filter", d)
+	if err != nil {
+		return err
+	}
+	testSource, err := execute(t, "test", d)
+	if err != nil {
+		return err
+	}
+	snippet, err := template.ParseFS(templates, "templates/envoy.yaml.tmpl")
+	if err != nil {
+		return err
+	}
+	var yaml bytes.Buffer
+	if err := snippet.Execute(&yaml, d); err != nil {
+		return err
+	}
+
+	// main.go is written last, so that a failure doesn't leave the filter registered without its
+	// source.
+	if err := os.WriteFile(filterPath, filterSource, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(testPath, testSource, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(mainPath, registered, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("created %s and %s, and registered the filter in %s\n", filterPath, testPath, mainPath)
+	fmt.Printf("add the filter to the http_filters of a listener in envoy.yaml:\n\n%s", yaml.String())
+	fmt.Println("\nor run it on its own listener of integration/envoy.generated.yaml with \"make envoy-config\"")
+	return nil
+}
+
+func newData(name string) data {
+	words := strings.Split(name, "_")
+	for i := range words {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	typ := strings.Join(words, "")
+	return data{
+		Name:   name,
+		Ident:  strings.ToLower(typ[:1]) + typ[1:],
+		Type:   typ,
+		Header: strings.ReplaceAll(name, "_", "-"),
+	}
+}
+
+// execute executes the template and formats the result as Go source.
+func execute(t *template.Template, name string, d data) ([]byte, error) {
+	var b bytes.Buffer
+	if err := t.ExecuteTemplate(&b, name, d); err != nil {
+		return nil, err
+	}
+	source, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("the %s template generated invalid Go: %w", name, err)
+	}
+	return source, nil
+}
+
+// register adds the filter at the end of the map of the config factories in the source of
+// main.go.
+func register(source []byte, d data) ([]byte, error) {
+	if bytes.Contains(source, []byte(`"`+d.Name+`":`)) {
+		return nil, fmt.Errorf("%s is already registered in main.go", d.Name)
+	}
+	start := bytes.Index(source, []byte("map[string]shared.HttpFilterConfigFactory{"))
+	if start < 0 {
+		return nil, fmt.Errorf("the map of the config factories is not found in main.go")
+	}
+	// The map ends at the first closing brace at the start of a line after it.
+	end := bytes.Index(source[start:], []byte("\n\t}"))
+	if end < 0 {
+		return nil, fmt.Errorf("the end of the map of the config factories is not found in main.go")
+	}
+	end += start + 1
+	entry := fmt.Sprintf("\t\t%q: &%sFilterConfigFactory{},\n", d.Name, d.Ident)
+	registered := slices.Concat(source[:end], []byte(entry), source[end:])
+	return format.Source(registered)
+}
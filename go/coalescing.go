@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const coalescingDefaultMaxBodyBytes = 1 << 20
+
+type (
+	// coalescingFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	coalescingFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// coalescingFilterConfig is the JSON configuration of the request coalescing filter.
+	coalescingFilterConfig struct {
+		// KeyHeaders are the request headers whose values are part of the key in addition to the
+		// authority and the path. The requests with an Authorization or a Cookie header are not
+		// coalesced unless the header is listed here, so that no response is shared across users.
+		KeyHeaders []string `json:"key_headers"`
+		// MaxBodyBytes is the maximum size of a shared response body. The waiting requests go
+		// upstream themselves when the response is larger. Defaults to 1MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// coalescingFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// The factory is shared by all the filter instances across the worker threads, so the
+	// in-flight requests live here and are guarded by the mutex.
+	coalescingFilterFactory struct {
+		keyHeaders   []string
+		maxBodyBytes int
+		mux          sync.Mutex
+		flights      map[string]*coalescingFlight
+		requests     shared.MetricID
+		hasMetric    bool
+	}
+	// coalescingFlight is an in-flight upstream request, and the identical requests waiting for
+	// its response.
+	coalescingFlight struct {
+		waiters []*coalescingFilter
+	}
+	// coalescingFilter implements [shared.HttpFilter].
+	//
+	// This filter is a singleflight for the GET requests. The first request of a key goes
+	// upstream, and the identical requests arriving before it completes are held. Its response is
+	// buffered and sent to each of them as a local reply through their scheduler, as they may be
+	// on other worker threads.
+	coalescingFilter struct {
+		handle    shared.HttpFilterHandle
+		factory   *coalescingFilterFactory
+		scheduler shared.Scheduler
+		// key is set while this request is the leader of a flight.
+		key      string
+		response *cachedResponse
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *coalescingFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config coalescingFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse request coalescing config: %w", err)
+		}
+	}
+	f := &coalescingFilterFactory{maxBodyBytes: config.MaxBodyBytes, flights: make(map[string]*coalescingFlight)}
+	if f.maxBodyBytes <= 0 {
+		f.maxBodyBytes = coalescingDefaultMaxBodyBytes
+	}
+	for _, name := range config.KeyHeaders {
+		f.keyHeaders = append(f.keyHeaders, strings.ToLower(name))
+	}
+	id, res := handle.DefineCounter("coalescing_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the request coalescing counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *coalescingFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &coalescingFilter{handle: handle, factory: p}
+}
+
+// key returns the coalescing key of the request, or false if the request must not be coalesced.
+func (p *coalescingFilterFactory) key(headers shared.HeaderMap) (string, bool) {
+	if headers.GetOne(":method") != "GET" {
+		return "", false
+	}
+	for _, name := range []string{"authorization", "cookie"} {
+		if len(headers.Get(name)) > 0 && !slices.Contains(p.keyHeaders, name) {
+			return "", false
+		}
+	}
+	var b strings.Builder
+	b.WriteString(headers.GetOne(":authority"))
+	b.WriteByte(0)
+	b.WriteString(headers.GetOne(":path"))
+	for _, name := range p.keyHeaders {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(headers.Get(name), ","))
+	}
+	return b.String(), true
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *coalescingFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if !endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	key, ok := p.factory.key(headers)
+	if !ok {
+		return shared.HeadersStatusContinue
+	}
+	p.factory.mux.Lock()
+	defer p.factory.mux.Unlock()
+	if flight, ok := p.factory.flights[key]; ok {
+		p.scheduler = p.handle.GetScheduler()
+		flight.waiters = append(flight.waiters, p)
+		return shared.HeadersStatusStop
+	}
+	p.factory.flights[key] = &coalescingFlight{}
+	p.key = key
+	p.record("leader")
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *coalescingFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.key == "" {
+		return shared.HeadersStatusContinue
+	}
+	// The cookies are for the leader only.
+	if len(headers.Get("set-cookie")) > 0 {
+		p.finish(nil)
+		return shared.HeadersStatusContinue
+	}
+	status, _ := strconv.Atoi(headers.GetOne(":status"))
+	p.response = &cachedResponse{status: uint32(status)}
+	for _, h := range headers.GetAll() {
+		name := strings.ToLower(h[0])
+		if _, skip := cacheSkippedResponseHeaders[name]; skip {
+			continue
+		}
+		// The header values are only valid during this callback.
+		p.response.headers = append(p.response.headers, [2]string{strings.Clone(name), strings.Clone(h[1])})
+	}
+	if endOfStream {
+		p.finish(p.response)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *coalescingFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.key == "" {
+		return shared.BodyStatusContinue
+	}
+	if len(p.response.body)+int(body.GetSize()) > p.factory.maxBodyBytes {
+		p.finish(nil)
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.response.body = append(p.response.body, chunk...)
+	}
+	if endOfStream {
+		p.finish(p.response)
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *coalescingFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	// The local replies can't carry trailers.
+	if p.key != "" {
+		p.finish(nil)
+	}
+	return shared.TrailersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *coalescingFilter) OnStreamComplete() {
+	// The leader was reset before the response completed.
+	if p.key != "" {
+		p.finish(nil)
+	}
+}
+
+// finish ends the flight, and sends the response to the waiting requests. If the response is
+// nil, they go upstream themselves instead.
+func (p *coalescingFilter) finish(response *cachedResponse) {
+	p.factory.mux.Lock()
+	flight := p.factory.flights[p.key]
+	delete(p.factory.flights, p.key)
+	p.factory.mux.Unlock()
+	p.key, p.response = "", nil
+
+	for _, waiter := range flight.waiters {
+		waiter.scheduler.Schedule(func() {
+			if response == nil {
+				waiter.record("released")
+				waiter.handle.ContinueRequest()
+				return
+			}
+			waiter.record("coalesced")
+			waiter.handle.SendLocalResponse(response.status,
+				append(slices.Clone(response.headers), [2]string{"x-coalesced", "true"}), response.body, "coalesced")
+		})
+	}
+}
+
+func (p *coalescingFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressorDefaultContentTypes are the content types compressed when content_types is not set.
+var compressorDefaultContentTypes = []string{
+	"text/html", "text/plain", "text/css", "text/javascript", "text/xml",
+	"application/javascript", "application/json", "application/xml", "image/svg+xml",
+}
+
+// compressionCodecs are the supported content codings. Each entry validates the level and returns
+// the constructor of the encoders. Adding a codec here is all that is needed to make it
+// configurable.
+var compressionCodecs = map[string]func(level int) (func() compressionEncoder, error){
+	"gzip": func(level int) (func() compressionEncoder, error) {
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, err
+		}
+		return func() compressionEncoder {
+			w, _ := gzip.NewWriterLevel(io.Discard, level)
+			return w
+		}, nil
+	},
+	"br": func(level int) (func() compressionEncoder, error) {
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("brotli: invalid quality %d", level)
+		}
+		return func() compressionEncoder { return brotli.NewWriterLevel(io.Discard, level) }, nil
+	},
+	"zstd": func(level int) (func() compressionEncoder, error) {
+		if level == 0 {
+			level = 3
+		}
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("zstd: invalid level %d", level)
+		}
+		return func() compressionEncoder {
+			// The encoder must not spawn goroutines since it runs on the worker thread.
+			w, _ := zstd.NewWriter(io.Discard,
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+			return w
+		}, nil
+	},
+}
+
+type (
+	// compressorFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	compressorFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// compressorFilterConfig is the JSON configuration of the compressor filter.
+	compressorFilterConfig struct {
+		// Codecs are the content codings in the order of the server preference, which breaks the
+		// ties between the equal quality values in Accept-Encoding. Defaults to gzip only.
+		Codecs []compressionCodecConfig `json:"codecs"`
+		// Level is the gzip compression level used when Codecs is not set.
+		Level int `json:"level"`
+		// MinSize is the minimum Content-Length to compress. Responses without Content-Length are
+		// always compressed since their size is unknown until the end of the stream.
+		MinSize int `json:"min_size"`
+		// ContentTypes are the media types to compress.
+		ContentTypes []string `json:"content_types"`
+	}
+	compressionCodecConfig struct {
+		// Name is the content coding: "gzip", "br", or "zstd".
+		Name string `json:"name"`
+		// Level is the codec specific level or quality. Zero means the codec default.
+		Level int `json:"level"`
+	}
+	// compressionEncoder is implemented by the encoders of all the codecs.
+	compressionEncoder interface {
+		io.WriteCloser
+		Reset(w io.Writer)
+	}
+	// compressionCodec is a configured codec.
+	compressionCodec struct {
+		name string
+		// encoders pools the encoders since they are expensive to allocate.
+		encoders sync.Pool
+	}
+	// compressorFilterFactory implements [shared.HttpFilterFactory].
+	compressorFilterFactory struct {
+		codecs       []*compressionCodec
+		minSize      int
+		contentTypes map[string]struct{}
+	}
+	// compressorFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to transform the response body as it streams through Envoy
+	// rather than buffering the whole body. Each chunk is replaced with its compressed output.
+	compressorFilter struct {
+		handle         shared.HttpFilterHandle
+		factory        *compressorFilterFactory
+		acceptEncoding string
+		// codec and w are non-nil while the response is being compressed.
+		codec *compressionCodec
+		w     compressionEncoder
+		out   bytes.Buffer
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *compressorFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config compressorFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse compressor config: %w", err)
+		}
+	}
+	if len(config.Codecs) == 0 {
+		config.Codecs = []compressionCodecConfig{{Name: "gzip", Level: config.Level}}
+	}
+	if len(config.ContentTypes) == 0 {
+		config.ContentTypes = compressorDefaultContentTypes
+	}
+	f := &compressorFilterFactory{minSize: config.MinSize, contentTypes: make(map[string]struct{})}
+	for _, t := range config.ContentTypes {
+		f.contentTypes[strings.ToLower(t)] = struct{}{}
+	}
+	for _, c := range config.Codecs {
+		newCodec, ok := compressionCodecs[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported codec %q", c.Name)
+		}
+		newEncoder, err := newCodec(c.Level)
+		if err != nil {
+			return nil, err
+		}
+		codec := &compressionCodec{name: c.Name}
+		codec.encoders.New = func() any { return newEncoder() }
+		f.codecs = append(f.codecs, codec)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *compressorFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &compressorFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *compressorFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	// The header value is only valid during this callback.
+	p.acceptEncoding = strings.Clone(strings.Join(headers.Get("accept-encoding"), ","))
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *compressorFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	codec := p.factory.negotiate(p.acceptEncoding)
+	if codec == nil || !p.shouldCompress(headers) {
+		return shared.HeadersStatusContinue
+	}
+	p.codec = codec
+	p.w = codec.encoders.Get().(compressionEncoder)
+	p.w.Reset(&p.out)
+	headers.Set("content-encoding", codec.name)
+	// The compressed size is unknown until the end of the stream.
+	headers.Remove("content-length")
+	headers.Add("vary", "Accept-Encoding")
+	return shared.HeadersStatusContinue
+}
+
+// shouldCompress reports whether the response is eligible for compression.
+func (p *compressorFilter) shouldCompress(headers shared.HeaderMap) bool {
+	switch headers.GetOne(":status") {
+	case "204", "206", "304":
+		return false
+	}
+	if headers.GetOne("content-encoding") != "" {
+		return false
+	}
+	if cl := headers.GetOne("content-length"); cl != "" {
+		if size, err := strconv.Atoi(cl); err == nil && size < p.factory.minSize {
+			return false
+		}
+	}
+	mediaType, _, err := mime.ParseMediaType(headers.GetOne("content-type"))
+	if err != nil {
+		return false
+	}
+	_, ok := p.factory.contentTypes[mediaType]
+	return ok
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *compressorFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.w == nil {
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		_, _ = p.w.Write(chunk)
+	}
+	if endOfStream {
+		p.finish()
+	}
+	body.Drain(body.GetSize())
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *compressorFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	// When the response has trailers, the body ends without endOfStream, so the remaining
+	// compressed data is flushed here.
+	if p.w != nil {
+		p.finish()
+		p.handle.BufferedResponseBody().Append(p.out.Bytes())
+		p.out.Reset()
+	}
+	return shared.TrailersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *compressorFilter) OnStreamComplete() {
+	if p.w != nil {
+		p.release()
+	}
+}
+
+// finish writes the remaining compressed data to p.out and returns the encoder to the pool.
+func (p *compressorFilter) finish() {
+	_ = p.w.Close()
+	p.release()
+}
+
+func (p *compressorFilter) release() {
+	p.w.Reset(io.Discard)
+	p.codec.encoders.Put(p.w)
+	p.codec, p.w = nil, nil
+}
+
+// negotiate returns the codec with the highest quality in the Accept-Encoding header value, or
+// nil if none is acceptable.
+func (p *compressorFilterFactory) negotiate(acceptEncoding string) *compressionCodec {
+	var best *compressionCodec
+	bestQ := 0.0
+	for _, codec := range p.codecs {
+		if q := acceptEncodingQuality(acceptEncoding, codec.name); q > bestQ {
+			best, bestQ = codec, q
+		}
+	}
+	return best
+}
+
+// acceptEncodingQuality returns the quality value of coding in the Accept-Encoding header value.
+// A coding not listed has the quality of "*" if present, and 0 otherwise.
+func acceptEncodingQuality(acceptEncoding, coding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(k, "q") {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch {
+		case strings.EqualFold(name, coding):
+			return q
+		case name == "*":
+			wildcard = q
+		}
+	}
+	return wildcard
+}
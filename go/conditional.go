@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const conditionalDefaultMaxBodyBytes = 1 << 20
+
+// conditionalNotModifiedHeaders are the headers of the 200 response kept in the 304 one, as RFC
+// 9110 requires so that the caches can update their copy.
+var conditionalNotModifiedHeaders = []string{
+	"cache-control", "content-location", "date", "etag", "expires", "last-modified", "vary",
+}
+
+type (
+	// conditionalFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	conditionalFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// conditionalFilterConfig is the JSON configuration of the conditional request filter.
+	conditionalFilterConfig struct {
+		// Weak generates weak ETags, which is right when the upstream may encode the same resource
+		// differently, such as with a varying order of the JSON keys. Defaults to strong ETags.
+		Weak bool `json:"weak"`
+		// MaxBodyBytes is the maximum size of the bodies buffered to generate their ETags. The
+		// larger responses are passed through without one. Defaults to 1MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// conditionalFilterFactory implements [shared.HttpFilterFactory].
+	conditionalFilterFactory struct {
+		config    conditionalFilterConfig
+		responses shared.MetricID
+		hasMetric bool
+	}
+	// conditionalFilter implements [shared.HttpFilter].
+	//
+	// The validators of the upstream are checked as soon as the response headers arrive. Without
+	// an ETag, the response is buffered to hash its body into one, and the 304 is sent in place of
+	// the buffered response, so that the client still saves the download.
+	conditionalFilter struct {
+		handle          shared.HttpFilterHandle
+		factory         *conditionalFilterFactory
+		method          string
+		ifNoneMatch     string
+		ifModifiedSince string
+		// digest is non-nil while the response body is hashed.
+		digest hash.Hash
+		size   int
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *conditionalFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config conditionalFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse conditional config: %w", err)
+		}
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = conditionalDefaultMaxBodyBytes
+	}
+	f := &conditionalFilterFactory{config: config}
+	id, res := handle.DefineCounter("conditional_responses_total", "result")
+	if res == shared.MetricsSuccess {
+		f.responses, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the conditional counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *conditionalFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &conditionalFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *conditionalFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.method = strings.Clone(headers.GetOne(":method"))
+	p.ifNoneMatch = strings.Clone(headers.GetOne("if-none-match"))
+	p.ifModifiedSince = strings.Clone(headers.GetOne("if-modified-since"))
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *conditionalFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if (p.method != http.MethodGet && p.method != http.MethodHead) || headers.GetOne(":status") != "200" {
+		return shared.HeadersStatusContinue
+	}
+	if headers.GetOne("etag") != "" || (p.ifNoneMatch == "" && headers.GetOne("last-modified") != "") {
+		// The upstream validators are enough.
+		if p.notModified(headers) {
+			p.sendNotModified(headers)
+			return shared.HeadersStatusStop
+		}
+		p.record("passed")
+		return shared.HeadersStatusContinue
+	}
+	// The responses to HEAD requests have no body to hash, and the ones not stored are never
+	// revalidated.
+	if p.method != http.MethodGet || parseCacheControl(strings.Join(headers.Get("cache-control"), ",")).has("no-store") {
+		p.record("passed")
+		return shared.HeadersStatusContinue
+	}
+	if size, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && size > p.factory.config.MaxBodyBytes {
+		p.record("too_large")
+		return shared.HeadersStatusContinue
+	}
+	p.digest = sha256.New()
+	if endOfStream {
+		return p.finish(headers)
+	}
+	return shared.HeadersStatusStop
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *conditionalFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.digest == nil {
+		return shared.BodyStatusContinue
+	}
+	p.size += int(body.GetSize())
+	if p.size > p.factory.config.MaxBodyBytes {
+		p.digest = nil
+		p.record("too_large")
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.digest.Write(chunk)
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if p.finish(p.handle.ResponseHeaders()) == shared.HeadersStatusStop {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *conditionalFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.digest != nil && p.finish(p.handle.ResponseHeaders()) == shared.HeadersStatusStop {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// finish sets the ETag of the hashed body, and sends a 304 in place of the response if it
+// matches.
+func (p *conditionalFilter) finish(headers shared.HeaderMap) shared.HeadersStatus {
+	sum := p.digest.Sum(nil)
+	p.digest = nil
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if p.factory.config.Weak {
+		etag = "W/" + etag
+	}
+	headers.Set("etag", etag)
+	if p.notModified(headers) {
+		p.sendNotModified(headers)
+		return shared.HeadersStatusStop
+	}
+	p.record("generated")
+	return shared.HeadersStatusContinue
+}
+
+// notModified evaluates the conditional headers of the request against the validators of the
+// response, as RFC 9110 orders them.
+func (p *conditionalFilter) notModified(headers shared.HeaderMap) bool {
+	if p.ifNoneMatch != "" {
+		etag := headers.GetOne("etag")
+		return etag != "" && etagMatch(p.ifNoneMatch, etag)
+	}
+	if p.ifModifiedSince == "" {
+		return false
+	}
+	since, err := http.ParseTime(p.ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(headers.GetOne("last-modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+func (p *conditionalFilter) sendNotModified(headers shared.HeaderMap) {
+	var notModifiedHeaders [][2]string
+	for _, name := range conditionalNotModifiedHeaders {
+		for _, value := range headers.Get(name) {
+			notModifiedHeaders = append(notModifiedHeaders, [2]string{name, value})
+		}
+	}
+	p.record("not_modified")
+	p.handle.SendLocalResponse(http.StatusNotModified, notModifiedHeaders, nil, "conditional_not_modified")
+}
+
+func (p *conditionalFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.responses, 1, result)
+	}
+}
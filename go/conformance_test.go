@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/conformance"
+)
+
+// conformanceFilters are the filters checked against the lifecycle contract of Envoy, with the
+// configs they are created with. The filters needing a service, a file, or a listener are left
+// out.
+var conformanceFilters = []struct {
+	name    string
+	factory shared.HttpFilterConfigFactory
+	config  string
+}{
+	{"passthrough", &passthroughFilterConfigFactory{}, ""},
+	{"header_auth", &headerAuthFilterConfigFactory{}, "x-auth"},
+	{"delay", &delayFilterConfigFactory{}, ""},
+	{"ratelimit", &rateLimitFilterConfigFactory{}, `{"key": "header", "header": "x-client", "tokens_per_second": 1, "burst": 1}`},
+	{"compressor", &compressorFilterConfigFactory{}, ""},
+	{"cache", &cacheFilterConfigFactory{}, ""},
+	{"sqli", &sqliFilterConfigFactory{}, ""},
+	{"xss", &xssFilterConfigFactory{}, ""},
+	{"pii_redaction", &piiRedactionFilterConfigFactory{}, ""},
+	{"pan_masking", &panMaskingFilterConfigFactory{}, ""},
+	{"body_limit", &bodyLimitFilterConfigFactory{}, `{"max_request_bytes": 8}`},
+	{"circuit_breaker", &circuitBreakerFilterConfigFactory{}, ""},
+	{"adaptive_concurrency", &adaptiveConcurrencyFilterConfigFactory{}, ""},
+	{"json_schema", &jsonSchemaFilterConfigFactory{}, ""},
+	{"json_xml", &jsonXMLFilterConfigFactory{}, ""},
+	{"request_id", &requestIDFilterConfigFactory{}, ""},
+	{"trace_context", &traceContextFilterConfigFactory{}, ""},
+	{"metrics", &metricsFilterConfigFactory{}, ""},
+	{"xfcc", &xfccFilterConfigFactory{}, ""},
+	{"soap", &soapFilterConfigFactory{}, ""},
+	{"multipart", &multipartFilterConfigFactory{}, ""},
+	{"security_headers", &securityHeadersFilterConfigFactory{}, ""},
+	{"header_mutation", &headerMutationFilterConfigFactory{}, `{"request_headers": [["x-mutated", "true"]]}`},
+	{"coalescing", &coalescingFilterConfigFactory{}, ""},
+	{"idempotency", &idempotencyFilterConfigFactory{}, ""},
+	{"llm_usage", &llmUsageFilterConfigFactory{}, ""},
+	{"image_transform", &imageTransformFilterConfigFactory{}, ""},
+	{"conditional", &conditionalFilterConfigFactory{}, ""},
+	{"grpc_status", &grpcStatusFilterConfigFactory{}, ""},
+}
+
+// conformanceExchanges add the requests taking the other paths of the filters above to the
+// default exchanges.
+var conformanceExchanges = append([]conformance.Exchange{
+	{
+		Name:            "authorized",
+		RequestHeaders:  [][2]string{{":method", "GET"}, {":path", "/"}, {":authority", "example.com"}, {"x-auth", "ok"}, {"x-client", "a"}, {"do-delay", "1ms"}},
+		ResponseHeaders: [][2]string{{":status", "200"}, {"content-type", "text/plain"}},
+		ResponseBody:    []byte("hello, world"),
+	},
+	{
+		Name: "idempotent post",
+		RequestHeaders: [][2]string{
+			{":method", "POST"}, {":path", "/orders"}, {":authority", "example.com"}, {"content-type", "application/json"},
+			{"idempotency-key", "key"}, {"x-auth", "ok"},
+		},
+		RequestBody:     []byte(`{"order": 1}`),
+		ResponseHeaders: [][2]string{{":status", "201"}, {"content-type", "application/json"}},
+		ResponseBody:    []byte(`{"id": 1}`),
+	},
+}, conformance.DefaultExchanges...)
+
+func TestConformance(t *testing.T) {
+	for _, f := range conformanceFilters {
+		t.Run(f.name, func(t *testing.T) {
+			configHandle := filtertest.NewConfigHandle()
+			factory, err := f.factory.Create(configHandle, []byte(f.config))
+			if err != nil {
+				t.Fatalf("failed to create the filter factory: %v", err)
+			}
+			conformance.Run(t, factory, conformance.Config{ConfigHandle: configHandle, Exchanges: conformanceExchanges})
+		})
+	}
+}
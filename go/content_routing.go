@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	contentRoutingDefaultMaxBodyBytes = 64 << 10
+	// contentRoutingMaxValueBytes is the maximum size of a field copied to a header.
+	contentRoutingMaxValueBytes = 1 << 10
+)
+
+type (
+	// contentRoutingFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	contentRoutingFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// contentRoutingFilterConfig is the JSON configuration of the content routing filter.
+	contentRoutingFilterConfig struct {
+		// Fields are the body fields copied to the routing headers.
+		Fields []contentRoutingField `json:"fields" example:"[{header: x-tenant-id, path: tenant.id}]"`
+		// MaxBodyBytes is the maximum size of the body to inspect. The larger requests are routed
+		// without the headers. Defaults to 64KiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// contentRoutingField is a body field copied to a routing header.
+	contentRoutingField struct {
+		// Header is the request header the field is copied to. The header sent by the client is
+		// always removed so that it can't pick the route itself. The values longer than 1KiB or
+		// with control characters are not copied.
+		Header string `json:"header"`
+		// Path is the dot separated path of the field in a JSON body, such as "tenant.id" or
+		// "items.0.sku" where the numbers index arrays.
+		Path string `json:"path"`
+		// ProtoPath is the dot separated field numbers of the field in a protobuf body, such as
+		// "1.2" for the field 2 of the message in the field 1.
+		ProtoPath string `json:"proto_path"`
+	}
+	// contentRoutingFilterFactory implements [shared.HttpFilterFactory].
+	contentRoutingFilterFactory struct {
+		fields       []contentRoutingCompiledField
+		maxBodyBytes int
+		requests     shared.MetricID
+		hasMetric    bool
+	}
+	contentRoutingCompiledField struct {
+		header    string
+		path      []string
+		protoPath []uint64
+	}
+	// contentRoutingFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to route on the body. The route is picked at the request
+	// headers, so the headers are held until the body is buffered, and the route cache is cleared
+	// after the routing headers are set so that the router picks the route again.
+	contentRoutingFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *contentRoutingFilterFactory
+		// format is "json", "protobuf", or "grpc" while the body is being buffered.
+		format string
+		body   []byte
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *contentRoutingFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config contentRoutingFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse content routing config: %w", err)
+	}
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("fields must be set")
+	}
+	f := &contentRoutingFilterFactory{maxBodyBytes: config.MaxBodyBytes}
+	if f.maxBodyBytes <= 0 {
+		f.maxBodyBytes = contentRoutingDefaultMaxBodyBytes
+	}
+	for i, field := range config.Fields {
+		if field.Header == "" || (field.Path == "" && field.ProtoPath == "") {
+			return nil, fmt.Errorf("fields[%d]: header and either path or proto_path must be set", i)
+		}
+		compiled := contentRoutingCompiledField{header: strings.ToLower(field.Header)}
+		if field.Path != "" {
+			compiled.path = strings.Split(field.Path, ".")
+		}
+		if field.ProtoPath != "" {
+			for _, s := range strings.Split(field.ProtoPath, ".") {
+				number, err := strconv.ParseUint(s, 10, 29)
+				if err != nil || number == 0 {
+					return nil, fmt.Errorf("fields[%d]: invalid proto_path %q", i, field.ProtoPath)
+				}
+				compiled.protoPath = append(compiled.protoPath, number)
+			}
+		}
+		f.fields = append(f.fields, compiled)
+	}
+	id, res := handle.DefineCounter("content_routing_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the content routing counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *contentRoutingFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &contentRoutingFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *contentRoutingFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	removed := false
+	for _, field := range p.factory.fields {
+		if len(headers.Get(field.header)) > 0 {
+			headers.Remove(field.header)
+			removed = true
+		}
+	}
+	if removed {
+		p.handle.ClearRouteCache()
+	}
+	if endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		p.format = "json"
+	case mediaType == "application/x-protobuf" || mediaType == "application/protobuf":
+		p.format = "protobuf"
+	case mediaType == "application/grpc" || mediaType == "application/grpc+proto":
+		p.format = "grpc"
+	default:
+		p.record("unsupported")
+		return shared.HeadersStatusContinue
+	}
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *contentRoutingFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.format == "" {
+		return shared.BodyStatusContinue
+	}
+	if len(p.body)+int(body.GetSize()) > p.factory.maxBodyBytes {
+		// The request still goes upstream, just without the routing headers.
+		p.format, p.body = "", nil
+		p.record("too_large")
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	p.route()
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *contentRoutingFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.format != "" {
+		p.route()
+	}
+	return shared.TrailersStatusContinue
+}
+
+// route sets the routing headers from the buffered body, and clears the route cache.
+func (p *contentRoutingFilter) route() {
+	format, body := p.format, p.body
+	p.format, p.body = "", nil
+
+	var lookup func(field *contentRoutingCompiledField) (string, bool)
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc any
+		if err := dec.Decode(&doc); err != nil {
+			p.record("malformed")
+			return
+		}
+		lookup = func(field *contentRoutingCompiledField) (string, bool) { return lookupJSONPath(doc, field.path) }
+	case "grpc":
+		// Only the first message of a stream is looked at.
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) > len(body)-5 {
+			p.record("malformed")
+			return
+		}
+		body = body[5 : 5+binary.BigEndian.Uint32(body[1:5])]
+		fallthrough
+	case "protobuf":
+		lookup = func(field *contentRoutingCompiledField) (string, bool) { return lookupProtoPath(body, field.protoPath) }
+	}
+
+	headers := p.handle.RequestHeaders()
+	routed, invalid := false, false
+	for i := range p.factory.fields {
+		value, ok := lookup(&p.factory.fields[i])
+		if !ok {
+			continue
+		}
+		// The value comes from the client, so it is only copied if it is a header value as is
+		// and can't smuggle another header line in.
+		if len(value) > contentRoutingMaxValueBytes || !validHeaderValue([]byte(value)) {
+			invalid = true
+			continue
+		}
+		headers.Set(p.factory.fields[i].header, value)
+		routed = true
+	}
+	if !routed && invalid {
+		p.record("invalid")
+		return
+	}
+	if !routed {
+		p.record("missing")
+		return
+	}
+	p.handle.ClearRouteCache()
+	p.record("routed")
+}
+
+func (p *contentRoutingFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
+
+// lookupJSONPath returns the scalar at the path of the JSON document as a string.
+func lookupJSONPath(doc any, path []string) (string, bool) {
+	if len(path) == 0 {
+		return "", false
+	}
+	for _, key := range path {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", false
+			}
+			doc = v[i]
+		default:
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// lookupProtoPath returns the scalar at the field number path of the protobuf message as a
+// string. The varints are formatted as unsigned integers and the length-delimited fields as
+// strings if they're valid UTF-8. As the last value of a scalar field wins in protobuf, the last
+// occurrence of each field is taken.
+func lookupProtoPath(msg []byte, path []uint64) (string, bool) {
+	if len(path) == 0 {
+		return "", false
+	}
+	var value string
+	found := false
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", false
+		}
+		msg = msg[n:]
+		number, wireType := tag>>3, tag&7
+		var field []byte
+		var scalar string
+		switch wireType {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return "", false
+			}
+			scalar, msg = strconv.FormatUint(v, 10), msg[n:]
+		case 1: // fixed64
+			if len(msg) < 8 {
+				return "", false
+			}
+			scalar, msg = strconv.FormatUint(binary.LittleEndian.Uint64(msg), 10), msg[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return "", false
+			}
+			field, msg = msg[n:n+int(l)], msg[n+int(l):]
+		case 5: // fixed32
+			if len(msg) < 4 {
+				return "", false
+			}
+			scalar, msg = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(msg)), 10), msg[4:]
+		default:
+			return "", false
+		}
+		if number != path[0] {
+			continue
+		}
+		switch {
+		case len(path) > 1 && field != nil:
+			if v, ok := lookupProtoPath(field, path[1:]); ok {
+				value, found = v, true
+			}
+		case len(path) == 1 && field != nil:
+			if utf8.Valid(field) {
+				value, found = string(field), true
+			}
+		case len(path) == 1:
+			value, found = scalar, true
+		}
+	}
+	return value, found
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/chain"
+)
+
+func TestContentRoutingHeaderValues(t *testing.T) {
+	factory, err := (&contentRoutingFilterConfigFactory{}).Create(filtertest.NewConfigHandle(),
+		[]byte(`{"fields": [{"header": "x-tenant-id", "path": "tenant"}]}`))
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	response := chain.Message{Headers: [][2]string{{":status", "200"}}}
+
+	for _, tc := range []struct {
+		name, tenant, want string
+	}{
+		{name: "valid", tenant: `"acme"`, want: "acme"},
+		{name: "CRLF", tenant: `"acme\r\nx-admin: true"`},
+		{name: "LF", tenant: `"acme\nx-admin: true"`},
+		{name: "NUL", tenant: `"acme\u0000"`},
+		{name: "too long", tenant: `"` + strings.Repeat("a", contentRoutingMaxValueBytes+1) + `"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := chain.New(t, factory)
+			result := c.Run(chain.Message{
+				Headers: [][2]string{{":path", "/"}, {"content-type", "application/json"}, {"x-tenant-id", "spoofed"}},
+				Body:    [][]byte{[]byte(`{"tenant": ` + tc.tenant + `}`)},
+			}, response)
+			if result.Request == nil {
+				t.Fatal("the request didn't reach the upstream")
+			}
+			if got := filtertest.NewHeaderMap(result.Request.Headers...).GetOne("x-tenant-id"); got != tc.want {
+				t.Fatalf("upstream x-tenant-id = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/coverage"
+	"time"
+)
+
+// coverageFlushInterval is how often the coverage counters are written to GOCOVERDIR.
+const coverageFlushInterval = time.Second
+
+// init starts writing the coverage counters to GOCOVERDIR if the module is built with -cover,
+// as with "make build-go-cover".
+//
+// A program built with -cover writes them when it exits, but the module is a shared library whose
+// main never runs, and Envoy doesn't tell the module it is shutting down. The counters are
+// written on an interval instead, and cleared after each write so that the files add up to the
+// totals when merged by "go tool covdata". This needs -covermode=atomic. The counts of the last
+// interval before Envoy exits are lost.
+func init() {
+	dir := os.Getenv("GOCOVERDIR")
+	if dir == "" {
+		return
+	}
+	// This fails if the module is not built with -cover, in which case there is nothing to write.
+	if err := coverage.WriteMetaDir(dir); err != nil {
+		return
+	}
+	go func() {
+		for range time.Tick(coverageFlushInterval) {
+			if err := coverage.WriteCountersDir(dir); err != nil {
+				fmt.Fprintf(os.Stderr, "go module: failed to write the coverage counters: %v\n", err)
+				return
+			}
+			if err := coverage.ClearCounters(); err != nil {
+				fmt.Fprintf(os.Stderr, "go module: failed to clear the coverage counters: %v\n", err)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/javascript"
+)
+
+const debugServerDefaultAddress = "127.0.0.1:6060"
+
+var (
+	// debugServers are the running servers by address. The servers outlive the configs, as there
+	// is no hook for the config destruction, and are shared by the configs with the same address
+	// so that the config updates don't fail to bind the port again.
+	debugServers   = map[string]struct{}{}
+	debugServersMu sync.Mutex
+)
+
+type (
+	// debugServerFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	debugServerFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// debugServerFilterConfig is the JSON configuration of the debug server filter.
+	debugServerFilterConfig struct {
+		// Address is the address the debug server listens on. Defaults to "127.0.0.1:6060".
+		Address string `json:"address"`
+		// AllowRemote allows the address to be other than a loopback one. The profiles expose the
+		// internals of the process, so they should only be reachable from the host.
+		AllowRemote bool `json:"allow_remote"`
+	}
+	// debugServerFilterFactory implements [shared.HttpFilterFactory].
+	debugServerFilterFactory struct{}
+	// debugServerFilter implements [shared.HttpFilter].
+	//
+	// The filter does nothing on the requests. Adding it to a listener starts a server in the
+	// module serving the net/http/pprof profiles under /debug/pprof/, and the Go runtime stats as
+	// JSON under /debug/runtime, so that the Go side of Envoy can be profiled without a rebuild:
+	//
+	//	go tool pprof http://127.0.0.1:6060/debug/pprof/profile?seconds=30
+	debugServerFilter struct {
+		shared.EmptyHttpFilter
+	}
+	// debugRuntimeStats is the JSON response of /debug/runtime.
+	debugRuntimeStats struct {
+		Goroutines     uint64  `json:"goroutines"`
+		GOMAXPROCS     int     `json:"gomaxprocs"`
+		CgoCalls       int64   `json:"cgo_calls"`
+		HeapBytes      uint64  `json:"heap_bytes"`
+		HeapGoalBytes  uint64  `json:"heap_goal_bytes"`
+		TotalBytes     uint64  `json:"total_bytes"`
+		TotalAllocated uint64  `json:"total_allocated_bytes"`
+		MemoryLimit    int64   `json:"memory_limit_bytes"`
+		GCPercent      int64   `json:"gc_percent"`
+		GCCycles       uint64  `json:"gc_cycles"`
+		GCPauseP50Ms   float64 `json:"gc_pause_p50_ms"`
+		GCPauseP99Ms   float64 `json:"gc_pause_p99_ms"`
+		GCPauseMaxMs   float64 `json:"gc_pause_max_ms"`
+		GCCPUFraction  float64 `json:"gc_cpu_fraction"`
+		ModuleStarted  string  `json:"module_started"`
+		UptimeSeconds  float64 `json:"uptime_seconds"`
+		// LiveConfigs are the numbers of the filter configs not yet garbage collected by the filter
+		// name, which drop after Envoy destroys the configs replaced by an update.
+		LiveConfigs   map[string]int64 `json:"live_configs"`
+		JavaScriptVMs int64            `json:"javascript_vms"`
+		// LiveFilters and InFlightFilters are the numbers of the filters not yet garbage collected
+		// and of the ones whose stream has not completed by the filter name, when counted with
+		// GO_MODULE_LIVE_FILTERS. The filters live but not in flight after a garbage collection
+		// are leaked.
+		LiveFilters     map[string]int64 `json:"live_filters,omitempty"`
+		InFlightFilters map[string]int64 `json:"in_flight_filters,omitempty"`
+	}
+)
+
+// debugModuleStarted is when the module was loaded, for the uptime.
+var debugModuleStarted = time.Now()
+
+// debugRuntimeMetrics are the [runtime/metrics] read for /debug/runtime, in the order
+// serveDebugRuntime indexes them.
+var debugRuntimeMetrics = []string{
+	"/sched/goroutines:goroutines",
+	"/memory/classes/heap/objects:bytes",
+	"/gc/heap/goal:bytes",
+	"/memory/classes/total:bytes",
+	"/gc/cycles/total:gc-cycles",
+	"/sched/pauses/total/gc:seconds",
+	"/gc/gomemlimit:bytes",
+	"/gc/gogc:percent",
+	"/gc/heap/allocs:bytes",
+	"/cpu/classes/gc/total:cpu-seconds",
+	"/cpu/classes/total:cpu-seconds",
+}
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *debugServerFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config debugServerFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse debug server config: %w", err)
+		}
+	}
+	if config.Address == "" {
+		config.Address = debugServerDefaultAddress
+	}
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", config.Address, err)
+	}
+	if ip := net.ParseIP(host); !config.AllowRemote && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("address %q is not a loopback address; set allow_remote to expose it", config.Address)
+	}
+
+	debugServersMu.Lock()
+	defer debugServersMu.Unlock()
+	if _, ok := debugServers[config.Address]; ok {
+		return &debugServerFilterFactory{}, nil
+	}
+	// The port is bound here so that a port in use fails the config rather than the goroutine.
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", config.Address, err)
+	}
+	debugServers[config.Address] = struct{}{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", serveDebugRuntime)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	logf := handle.Log
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logf(shared.LogLevelError, "debug server on %s stopped: %v", config.Address, err)
+		}
+	}()
+	handle.Log(shared.LogLevelInfo, "debug server listening on %s", config.Address)
+	return &debugServerFilterFactory{}, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *debugServerFilterFactory) Create(shared.HttpFilterHandle) shared.HttpFilter {
+	return &debugServerFilter{}
+}
+
+// serveDebugRuntime serves the runtime stats. With the gc query parameter, a garbage collection is
+// run first so that heap_bytes is the live heap, for example, to compare it before and after a
+// load test.
+func serveDebugRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("gc") {
+		runtime.GC()
+	}
+	samples := make([]metrics.Sample, len(debugRuntimeMetrics))
+	for i, name := range debugRuntimeMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	stats := debugRuntimeStats{
+		Goroutines:     debugUint64(samples[0]),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		HeapBytes:      debugUint64(samples[1]),
+		HeapGoalBytes:  debugUint64(samples[2]),
+		TotalBytes:     debugUint64(samples[3]),
+		GCCycles:       debugUint64(samples[4]),
+		MemoryLimit:    int64(debugUint64(samples[6])),
+		GCPercent:      int64(debugUint64(samples[7])),
+		TotalAllocated: debugUint64(samples[8]),
+		CgoCalls:       runtime.NumCgoCall(),
+		UptimeSeconds:  time.Since(debugModuleStarted).Seconds(),
+		ModuleStarted:  debugModuleStarted.UTC().Format(time.RFC3339),
+		LiveConfigs:    map[string]int64{},
+		JavaScriptVMs:  javascript.LiveVMs(),
+	}
+	for name, live := range liveConfigs {
+		if n := live.Load(); n > 0 {
+			stats.LiveConfigs[name] = n
+		}
+	}
+	if len(liveFilters) > 0 {
+		stats.LiveFilters, stats.InFlightFilters = map[string]int64{}, map[string]int64{}
+		for name, counts := range liveFilters {
+			stats.LiveFilters[name] = counts.live.Load()
+			stats.InFlightFilters[name] = counts.inFlight.Load()
+		}
+	}
+	if samples[5].Value.Kind() == metrics.KindFloat64Histogram {
+		pauses := samples[5].Value.Float64Histogram()
+		stats.GCPauseP50Ms = debugHistogramQuantile(pauses, 0.5) * 1000
+		stats.GCPauseP99Ms = debugHistogramQuantile(pauses, 0.99) * 1000
+		stats.GCPauseMaxMs = debugHistogramQuantile(pauses, 1) * 1000
+	}
+	if gc, total := samples[9], samples[10]; gc.Value.Kind() == metrics.KindFloat64 && total.Value.Kind() == metrics.KindFloat64 && total.Value.Float64() > 0 {
+		stats.GCCPUFraction = gc.Value.Float64() / total.Value.Float64()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+// debugUint64 returns the value of the sample, or zero if the metric is not supported.
+func debugUint64(sample metrics.Sample) uint64 {
+	if sample.Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample.Value.Uint64()
+}
+
+// debugHistogramQuantile returns the upper bound of the bucket of the quantile.
+func debugHistogramQuantile(h *metrics.Float64Histogram, q float64) float64 {
+	var total uint64
+	for _, count := range h.Counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	threshold := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, count := range h.Counts {
+		seen += count
+		if count > 0 && seen >= threshold {
+			if bound := h.Buckets[i+1]; !math.IsInf(bound, 1) {
+				return bound
+			}
+			return h.Buckets[i]
+		}
+	}
+	return 0
+}
@@ -6,6 +6,13 @@ import (
 	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
 )
 
+const (
+	// delayDefault is the delay of the requests whose do-delay header is not a duration.
+	delayDefault = 2 * time.Second
+	// delayMax caps the delays given in the do-delay header.
+	delayMax = 10 * time.Second
+)
+
 type (
 	// delayFilterConfigFactory implements [shared.HttpFilterConfigFactory].
 	delayFilterConfigFactory struct {
@@ -38,17 +45,29 @@ func (p *delayFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpF
 // OnRequestHeaders implements [shared.HttpFilter].
 func (p *delayFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
 	// Check if the headers contain the "do-delay" header to trigger the delay.
-	if len(headers.Get("do-delay")) == 0 {
+	values := headers.Get("do-delay")
+	if len(values) == 0 {
 		// If the header is not present, continue the request processing.
 		return shared.HeadersStatusContinue
 	}
+	// The header is either a duration such as "150ms", or any other value for the default delay.
+	delay, err := time.ParseDuration(values[0])
+	if err != nil || delay < 0 {
+		delay = delayDefault
+	}
+	delay = min(delay, delayMax)
 
 	scheduler := p.handle.GetScheduler()
+	if scheduler == nil {
+		// The request could not be continued from the goroutine, so it is not delayed.
+		p.handle.Log(shared.LogLevelWarn, "no scheduler to delay the request")
+		return shared.HeadersStatusContinue
+	}
 	now := time.Now()
 	p.onRequestHeaders = now
 	go func() {
 		// Simulate some delay.
-		time.Sleep(2 * time.Second)
+		time.Sleep(delay)
 		// Commit the event to continue the request processing.
 		scheduler.Schedule(func() {
 			p.delayLapsed = time.Since(p.onRequestHeaders)
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	extAuthzDefaultPath            = "/"
+	extAuthzDefaultTimeoutMs       = 200
+	extAuthzDefaultStatusOnError   = 403
+	extAuthzDefaultCacheMaxEntries = 1000
+	// extAuthzHeadersToRemove is the authorization response header listing the request headers to
+	// remove before the request goes upstream, the same as the ext_authz filter of Envoy.
+	extAuthzHeadersToRemove = "x-envoy-auth-headers-to-remove"
+)
+
+// extAuthzDefaultRequestHeaders are the request headers sent to the authorization service by
+// default.
+var extAuthzDefaultRequestHeaders = []string{"authorization"}
+
+type (
+	// extAuthzFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	extAuthzFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// extAuthzFilterConfig is the JSON configuration of the external authorization filter.
+	extAuthzFilterConfig struct {
+		// Cluster is the cluster of the authorization service.
+		Cluster string `json:"cluster" example:"httpbin"`
+		// Path is the path the authorization requests are POSTed to. Defaults to "/".
+		Path string `json:"path"`
+		// Authority is the host of the authorization requests. Defaults to the cluster name.
+		Authority string `json:"authority"`
+		// TimeoutMs is the timeout of the authorization requests. Defaults to 200.
+		TimeoutMs uint64 `json:"timeout_ms"`
+		// RequestHeaders are the request headers sent to the authorization service. Defaults to
+		// "authorization".
+		RequestHeaders []string `json:"request_headers"`
+		// IncludeSourceAddress sends the address of the client to the authorization service. Note
+		// that it's a part of the cache key then.
+		IncludeSourceAddress bool `json:"include_source_address"`
+		// AllowedUpstreamHeaders are the headers of an allowing response that are set to the
+		// request before it goes upstream.
+		AllowedUpstreamHeaders []string `json:"allowed_upstream_headers"`
+		// AllowedClientHeadersOnSuccess are the headers of an allowing response that are added to
+		// the response to the client.
+		AllowedClientHeadersOnSuccess []string `json:"allowed_client_headers_on_success"`
+		// AllowedClientHeaders are the headers of a denying response that are sent to the client
+		// along with its status and body.
+		AllowedClientHeaders []string `json:"allowed_client_headers"`
+		// FailureModeAllow lets the requests through when the authorization service can't be
+		// reached or fails with 5xx.
+		FailureModeAllow bool `json:"failure_mode_allow"`
+		// StatusOnError is the status sent to the client when the authorization service fails and
+		// FailureModeAllow is false. Defaults to 403.
+		StatusOnError uint32 `json:"status_on_error"`
+		// CacheTTLMs caches the decisions of the authorization service for the identical
+		// authorization requests. The caching is disabled if zero.
+		CacheTTLMs int `json:"cache_ttl_ms"`
+		// CacheMaxEntries is the maximum number of the cached decisions. Defaults to 1000.
+		CacheMaxEntries int `json:"cache_max_entries"`
+	}
+	// extAuthzRequest is the JSON body of the authorization requests.
+	extAuthzRequest struct {
+		Method        string            `json:"method"`
+		Path          string            `json:"path"`
+		Host          string            `json:"host"`
+		Protocol      string            `json:"protocol,omitempty"`
+		Route         string            `json:"route,omitempty"`
+		SourceAddress string            `json:"source_address,omitempty"`
+		Headers       map[string]string `json:"headers"`
+	}
+	// extAuthzFilterFactory implements [shared.HttpFilterFactory].
+	extAuthzFilterFactory struct {
+		config extAuthzFilterConfig
+		// upstreamHeaders, clientHeadersOnSuccess, and clientHeaders are the lower cased allowed
+		// headers of the config.
+		upstreamHeaders        map[string]struct{}
+		clientHeadersOnSuccess map[string]struct{}
+		clientHeaders          map[string]struct{}
+		// cache is nil if the caching is disabled.
+		cache     *lruCache
+		cacheTTL  time.Duration
+		checks    shared.MetricID
+		hasMetric bool
+	}
+	// extAuthzFilter implements [shared.HttpFilter] and [shared.HttpCalloutCallback].
+	//
+	// This is an in-process alternative to the ext_authz filter of Envoy with an HTTP service. The
+	// request is held while its metadata is POSTed to the authorization service as JSON, and a 2xx
+	// response allows it while any other one denies it. Since the callout is tied to the stream,
+	// it's canceled if the client goes away while waiting.
+	extAuthzFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *extAuthzFilterFactory
+		// cacheKey is set while waiting for a decision that can be cached.
+		cacheKey string
+		// responseHeaders are added to the response on allow.
+		responseHeaders [][2]string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *extAuthzFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config extAuthzFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse ext_authz config: %w", err)
+	}
+	if config.Cluster == "" {
+		return nil, fmt.Errorf("cluster must be set")
+	}
+	if config.Path == "" {
+		config.Path = extAuthzDefaultPath
+	} else if !strings.HasPrefix(config.Path, "/") {
+		return nil, fmt.Errorf("path must start with /")
+	}
+	if config.Authority == "" {
+		config.Authority = config.Cluster
+	}
+	if config.TimeoutMs == 0 {
+		config.TimeoutMs = extAuthzDefaultTimeoutMs
+	}
+	if config.RequestHeaders == nil {
+		config.RequestHeaders = extAuthzDefaultRequestHeaders
+	}
+	requestHeaders := make([]string, len(config.RequestHeaders))
+	for i, h := range config.RequestHeaders {
+		requestHeaders[i] = strings.ToLower(h)
+	}
+	config.RequestHeaders = requestHeaders
+	if config.StatusOnError == 0 {
+		config.StatusOnError = extAuthzDefaultStatusOnError
+	} else if config.StatusOnError < 200 || config.StatusOnError > 599 {
+		return nil, fmt.Errorf("status_on_error must be between 200 and 599")
+	}
+	if config.CacheMaxEntries <= 0 {
+		config.CacheMaxEntries = extAuthzDefaultCacheMaxEntries
+	}
+	f := &extAuthzFilterFactory{
+		config:                 config,
+		upstreamHeaders:        extAuthzHeaderSet(config.AllowedUpstreamHeaders),
+		clientHeadersOnSuccess: extAuthzHeaderSet(config.AllowedClientHeadersOnSuccess),
+		clientHeaders:          extAuthzHeaderSet(config.AllowedClientHeaders),
+	}
+	if config.CacheTTLMs > 0 {
+		f.cache = newLRUCache(config.CacheMaxEntries)
+		f.cacheTTL = time.Duration(config.CacheTTLMs) * time.Millisecond
+	}
+	id, res := handle.DefineCounter("ext_authz_checks_total", "result", "cached")
+	if res == shared.MetricsSuccess {
+		f.checks, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the ext_authz counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *extAuthzFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &extAuthzFilter{handle: handle, factory: p}
+}
+
+func extAuthzHeaderSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[strings.ToLower(name)] = struct{}{}
+	}
+	return set
+}
+
+// relevantHeaders returns the headers of the authorization response that affect the decision, so
+// that only they are cached.
+func (p *extAuthzFilterFactory) relevantHeaders(headers [][2]string) [][2]string {
+	var relevant [][2]string
+	for _, h := range headers {
+		name := strings.ToLower(h[0])
+		_, upstream := p.upstreamHeaders[name]
+		_, onSuccess := p.clientHeadersOnSuccess[name]
+		_, client := p.clientHeaders[name]
+		if upstream || onSuccess || client || name == extAuthzHeadersToRemove || name == ":status" {
+			// ToLower returns the name as is if it is already in lowercase.
+			relevant = append(relevant, [2]string{strings.Clone(name), strings.Clone(h[1])})
+		}
+	}
+	return relevant
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *extAuthzFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	request := extAuthzRequest{
+		Method:  headers.GetOne(":method"),
+		Path:    headers.GetOne(":path"),
+		Host:    headers.GetOne(":authority"),
+		Headers: make(map[string]string, len(config.RequestHeaders)),
+	}
+	request.Protocol, _ = p.handle.GetAttributeString(shared.AttributeIDRequestProtocol)
+	request.Route, _ = p.handle.GetAttributeString(shared.AttributeIDXdsRouteName)
+	if config.IncludeSourceAddress {
+		request.SourceAddress, _ = p.handle.GetAttributeString(shared.AttributeIDSourceAddress)
+	}
+	for _, name := range config.RequestHeaders {
+		if values := headers.Get(name); len(values) > 0 {
+			request.Headers[name] = strings.Join(values, ",")
+		}
+	}
+	// Marshaling copies the header values, and sorts the header names so that the identical
+	// requests have the same body and therefore the same cache key.
+	body, err := json.Marshal(&request)
+	if err != nil {
+		p.handle.Log(shared.LogLevelError, "failed to marshal the authorization request: %v", err)
+		p.onError()
+		return shared.HeadersStatusStop
+	}
+
+	if p.factory.cache != nil {
+		digest := sha256.Sum256(body)
+		p.cacheKey = string(digest[:])
+		if cached := p.factory.cache.get(p.cacheKey, time.Now()); cached != nil {
+			p.cacheKey = ""
+			if p.decide(cached.status, cached.headers, cached.body, "true") {
+				return shared.HeadersStatusContinue
+			}
+			return shared.HeadersStatusStop
+		}
+	}
+
+	calloutHeaders := [][2]string{
+		{":method", "POST"},
+		{":path", config.Path},
+		{":authority", config.Authority},
+		{"content-type", "application/json"},
+	}
+	res, _ := p.handle.HttpCallout(config.Cluster, calloutHeaders, body, config.TimeoutMs, p)
+	if res != shared.HttpCalloutInitSuccess {
+		p.handle.Log(shared.LogLevelWarn, "failed to send the authorization request: %v", res)
+		if p.onError() {
+			return shared.HeadersStatusContinue
+		}
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusStopAllAndBuffer
+}
+
+// OnHttpCalloutDone implements [shared.HttpCalloutCallback].
+func (p *extAuthzFilter) OnHttpCalloutDone(calloutID uint64, result shared.HttpCalloutResult, headers [][2]string, body [][]byte) {
+	if result != shared.HttpCalloutSuccess {
+		p.handle.Log(shared.LogLevelWarn, "authorization request failed: %v", result)
+		if p.onError() {
+			p.handle.ContinueRequest()
+		}
+		return
+	}
+	cacheable := p.cacheKey != "" && extAuthzCacheable(headers)
+	headers = p.factory.relevantHeaders(headers)
+	status := extAuthzStatus(headers)
+	if status >= 500 || status == 0 {
+		p.handle.Log(shared.LogLevelWarn, "authorization service responded with status %d", status)
+		if p.onError() {
+			p.handle.ContinueRequest()
+		}
+		return
+	}
+	joined := bytes.Join(body, nil)
+	if cacheable {
+		now := time.Now()
+		p.factory.cache.put(p.cacheKey, &cachedResponse{
+			status:   status,
+			headers:  headers,
+			body:     joined,
+			storedAt: now,
+			expires:  now.Add(p.factory.cacheTTL),
+		})
+	}
+	if p.decide(status, headers, joined, "false") {
+		p.handle.ContinueRequest()
+	}
+}
+
+// decide applies the decision of the authorization service, and reports whether the request is
+// allowed. A denied request is responded to here.
+func (p *extAuthzFilter) decide(status uint32, headers [][2]string, body []byte, cached string) bool {
+	if status < 200 || status > 299 {
+		var clientHeaders [][2]string
+		for _, h := range headers {
+			if _, ok := p.factory.clientHeaders[h[0]]; ok {
+				clientHeaders = append(clientHeaders, h)
+			}
+		}
+		p.handle.SendLocalResponse(status, clientHeaders, body, "ext_authz_denied")
+		p.record("denied", cached)
+		return false
+	}
+	requestHeaders := p.handle.RequestHeaders()
+	for _, h := range headers {
+		if h[0] == extAuthzHeadersToRemove {
+			for _, name := range strings.Split(h[1], ",") {
+				// The pseudo headers are not for the authorization service to remove.
+				if name = strings.ToLower(strings.TrimSpace(name)); name != "" && !strings.HasPrefix(name, ":") {
+					requestHeaders.Remove(name)
+				}
+			}
+		}
+	}
+	for _, h := range headers {
+		if _, ok := p.factory.upstreamHeaders[h[0]]; ok {
+			requestHeaders.Set(h[0], h[1])
+		}
+		if _, ok := p.factory.clientHeadersOnSuccess[h[0]]; ok {
+			p.responseHeaders = append(p.responseHeaders, h)
+		}
+	}
+	p.record("allowed", cached)
+	return true
+}
+
+// onError handles a failure of the authorization service, and reports whether the request is let
+// through.
+func (p *extAuthzFilter) onError() bool {
+	if p.factory.config.FailureModeAllow {
+		p.handle.RequestHeaders().Set("x-envoy-auth-failure-mode-allowed", "true")
+		p.record("failure_mode_allowed", "false")
+		return true
+	}
+	p.handle.SendLocalResponse(p.factory.config.StatusOnError, nil, nil, "ext_authz_error")
+	p.record("error", "false")
+	return false
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *extAuthzFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	for _, h := range p.responseHeaders {
+		headers.Add(h[0], h[1])
+	}
+	return shared.HeadersStatusContinue
+}
+
+func (p *extAuthzFilter) record(result, cached string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.checks, 1, result, cached)
+	}
+}
+
+// extAuthzStatus returns the status of the authorization response, or 0 if it's missing.
+func extAuthzStatus(headers [][2]string) uint32 {
+	for _, h := range headers {
+		if h[0] == ":status" {
+			status, _ := strconv.ParseUint(h[1], 10, 32)
+			return uint32(status)
+		}
+	}
+	return 0
+}
+
+// extAuthzCacheable reports whether the authorization service allows caching its decision.
+func extAuthzCacheable(headers [][2]string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h[0], "cache-control") {
+			directives := parseCacheControl(h[1])
+			return !directives.has("no-store") && !directives.has("no-cache") && !directives.has("private")
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/conformance"
+)
+
+// TestFaults checks that the filters keep to the lifecycle contract of Envoy when its callbacks
+// fail. passthrough is not run with the body faults, since it panics on purpose when its body
+// mutations have no effect, as the example of the SDK checking them.
+func TestFaults(t *testing.T) {
+	for _, f := range []struct {
+		name    string
+		factory shared.HttpFilterConfigFactory
+		config  string
+		faults  map[string]filtertest.Faults
+	}{
+		{"passthrough", &passthroughFilterConfigFactory{}, "", map[string]filtertest.Faults{
+			"header mutations": {HeaderMutations: true},
+			"nil scheduler":    {NilScheduler: true},
+		}},
+		{"delay", &delayFilterConfigFactory{}, "", map[string]filtertest.Faults{
+			"header mutations": {HeaderMutations: true},
+			"nil scheduler":    {NilScheduler: true},
+		}},
+		{"pii_redaction", &piiRedactionFilterConfigFactory{}, "", map[string]filtertest.Faults{
+			"header mutations": {HeaderMutations: true},
+			"body mutations":   {BodyMutations: true},
+			"body reads":       {BodyReads: true},
+		}},
+		{"json_xml", &jsonXMLFilterConfigFactory{}, `{"upstream_format": "xml"}`, map[string]filtertest.Faults{
+			"header mutations": {HeaderMutations: true},
+			"body mutations":   {BodyMutations: true},
+			"body reads":       {BodyReads: true},
+		}},
+	} {
+		for name, faults := range f.faults {
+			t.Run(f.name+"/"+name, func(t *testing.T) {
+				configHandle := filtertest.NewConfigHandle()
+				factory, err := f.factory.Create(configHandle, []byte(f.config))
+				if err != nil {
+					t.Fatalf("failed to create the filter factory: %v", err)
+				}
+				conformance.Run(t, factory, conformance.Config{
+					ConfigHandle: configHandle, Exchanges: conformanceExchanges, Faults: faults,
+				})
+			})
+		}
+	}
+}
+
+func TestPassthroughHeaderMutationsFault(t *testing.T) {
+	h := filtertest.NewHandle()
+	h.ResponseHeaderMap = filtertest.NewHeaderMap([2]string{":status", "200"})
+	h.Faults.HeaderMutations = true
+	filter := (&passthroughFilterFactory{}).Create(h)
+
+	var status shared.HeadersStatus
+	h.Do(func() { status = filter.OnResponseHeaders(h.ResponseHeaderMap, true) })
+	if status != shared.HeadersStatusContinue {
+		t.Fatalf("OnResponseHeaders = %v, want continue", status)
+	}
+	// The call is recorded, but the header is not set.
+	h.RequireHeaderSet(t, "x-passthrough-response-header", "true")
+	if got := h.ResponseHeaderMap.GetOne("x-passthrough-response-header"); got != "" {
+		t.Fatalf("x-passthrough-response-header = %q, want none", got)
+	}
+}
+
+func TestDelayNilSchedulerFault(t *testing.T) {
+	h := filtertest.NewHandle()
+	h.RequestHeaderMap = filtertest.NewHeaderMap([2]string{":path", "/"}, [2]string{"do-delay", "1ms"})
+	h.Faults.NilScheduler = true
+	filter := (&delayFilterFactory{}).Create(h)
+
+	var status shared.HeadersStatus
+	h.Do(func() { status = filter.OnRequestHeaders(h.RequestHeaderMap, true) })
+	h.Wait()
+	// The request goes on undelayed rather than stopped forever.
+	if status != shared.HeadersStatusContinue {
+		t.Fatalf("OnRequestHeaders = %v, want continue", status)
+	}
+	h.RequireCall(t, "Log", shared.LogLevelWarn)
+	h.RequireNoCall(t, "ContinueRequest")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	featureFlagsDefaultHeaderPrefix = "x-feature-"
+	featureFlagsDefaultPollInterval = 10 * time.Second
+	featureFlagsDefaultTimeout      = 2 * time.Second
+	featureFlagsMetadataNamespace   = "feature_flags"
+	featureFlagsMaxResponseBytes    = 1 << 20
+)
+
+type (
+	// featureFlagsFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	featureFlagsFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// featureFlagsFilterConfig is the JSON configuration of the feature flags filter.
+	featureFlagsFilterConfig struct {
+		Provider featureFlagsProviderConfig `json:"provider"`
+		// Flags are the flags exposed. Defaults to all the flags of the provider.
+		Flags []string `json:"flags"`
+		// HeaderPrefix is the prefix of the request headers the flags are set in, followed by the
+		// flag name. The headers sent by the client are removed. Defaults to "x-feature-".
+		HeaderPrefix string `json:"header_prefix"`
+		// TargetingKeyHeader is the request header whose value buckets the requests for the
+		// fractional rollouts, such as a user ID. The requests without it get the default variant.
+		TargetingKeyHeader string `json:"targeting_key_header"`
+	}
+	// featureFlagsProviderConfig is where the flags come from.
+	featureFlagsProviderConfig struct {
+		// Type is "file" or "http" for a flagd flag definition, or "ofrep" for the bulk
+		// evaluation endpoint of the OpenFeature Remote Evaluation Protocol.
+		Type string `json:"type" example:"file"`
+		// Path is the path of the file for "file".
+		Path string `json:"path" example:"./testdata/feature_flags.json"`
+		// URL is the URL of the flag definition for "http", or the base URL of the OFREP service
+		// for "ofrep".
+		URL string `json:"url"`
+		// PollIntervalMs is how often the provider is polled. Defaults to 10 seconds.
+		PollIntervalMs int `json:"poll_interval_ms"`
+		// TimeoutMs is the timeout of the HTTP requests. Defaults to 2 seconds.
+		TimeoutMs int `json:"timeout_ms"`
+	}
+	// featureFlagsFilterFactory implements [shared.HttpFilterFactory].
+	featureFlagsFilterFactory struct {
+		config    featureFlagsFilterConfig
+		provider  *featureFlagsProvider
+		errors    shared.MetricID
+		hasMetric bool
+	}
+	// featureFlagsFilter implements [shared.HttpFilter].
+	featureFlagsFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *featureFlagsFilterFactory
+		shared.EmptyHttpFilter
+	}
+	// featureFlagsProvider holds the latest flags polled in the background.
+	//
+	// Unlike the files reloaded lazily, the HTTP providers can't be polled on the request path,
+	// so a goroutine polls them. There is no hook to stop it when the filter config is destroyed,
+	// so it is stopped when the factory is garbage collected instead.
+	featureFlagsProvider struct {
+		fetch   func() (map[string]*featureFlag, error)
+		current atomic.Pointer[map[string]*featureFlag]
+		// lastError is the error of the last poll not logged yet. The goroutine has no handle to
+		// log with, so the filters log it.
+		lastError atomic.Pointer[error]
+	}
+	// featureFlag is a flag in the flagd flag definition format. Only the fractional targeting
+	// is supported, and in a simpler form than the JSONLogic of flagd.
+	featureFlag struct {
+		// State is "ENABLED" or "DISABLED". The disabled flags are not exposed.
+		State          string                     `json:"state"`
+		Variants       map[string]json.RawMessage `json:"variants"`
+		DefaultVariant string                     `json:"defaultVariant"`
+		// Fractional are the weights of the variants for a fractional rollout, such as
+		// {"on": 10, "off": 90}.
+		Fractional map[string]int `json:"fractional"`
+		// fractional is Fractional in the order of the variant names.
+		fractional []featureFlagWeight
+		total      int
+	}
+	featureFlagWeight struct {
+		variant string
+		weight  int
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *featureFlagsFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config featureFlagsFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse feature flags config: %w", err)
+	}
+	if config.HeaderPrefix == "" {
+		config.HeaderPrefix = featureFlagsDefaultHeaderPrefix
+	}
+	config.HeaderPrefix = strings.ToLower(config.HeaderPrefix)
+	interval := time.Duration(config.Provider.PollIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = featureFlagsDefaultPollInterval
+	}
+	timeout := time.Duration(config.Provider.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = featureFlagsDefaultTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	provider := &featureFlagsProvider{}
+	switch config.Provider.Type {
+	case "file":
+		if config.Provider.Path == "" {
+			return nil, fmt.Errorf("provider.path must be set")
+		}
+		provider.fetch = func() (map[string]*featureFlag, error) {
+			data, err := os.ReadFile(config.Provider.Path)
+			if err != nil {
+				return nil, err
+			}
+			return parseFlagdDefinition(data)
+		}
+	case "http":
+		if config.Provider.URL == "" {
+			return nil, fmt.Errorf("provider.url must be set")
+		}
+		provider.fetch = func() (map[string]*featureFlag, error) {
+			data, err := featureFlagsRequest(client, http.MethodGet, config.Provider.URL, nil)
+			if err != nil {
+				return nil, err
+			}
+			return parseFlagdDefinition(data)
+		}
+	case "ofrep":
+		if config.Provider.URL == "" {
+			return nil, fmt.Errorf("provider.url must be set")
+		}
+		url := strings.TrimSuffix(config.Provider.URL, "/") + "/ofrep/v1/evaluate/flags"
+		provider.fetch = func() (map[string]*featureFlag, error) {
+			data, err := featureFlagsRequest(client, http.MethodPost, url, []byte(`{"context":{}}`))
+			if err != nil {
+				return nil, err
+			}
+			return parseOFREPBulkResponse(data)
+		}
+	default:
+		return nil, fmt.Errorf("unknown provider.type %q", config.Provider.Type)
+	}
+	// The initial poll of a file must succeed as it's part of the config. The services may be
+	// down for a moment, so the filter starts without the flags instead.
+	flags, err := provider.fetch()
+	if err != nil && config.Provider.Type == "file" {
+		return nil, fmt.Errorf("failed to load the feature flags: %w", err)
+	} else if err != nil {
+		handle.Log(shared.LogLevelWarn, "failed to poll the feature flags: %v", err)
+		flags = map[string]*featureFlag{}
+	}
+	provider.current.Store(&flags)
+
+	f := &featureFlagsFilterFactory{config: config, provider: provider}
+	stop := make(chan struct{})
+	go provider.poll(interval, stop)
+	runtime.AddCleanup(f, func(stop chan struct{}) { close(stop) }, stop)
+
+	id, res := handle.DefineCounter("feature_flags_provider_errors_total")
+	if res == shared.MetricsSuccess {
+		f.errors, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the feature flags counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *featureFlagsFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &featureFlagsFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *featureFlagsFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	if err := p.factory.provider.lastError.Swap(nil); err != nil {
+		p.handle.Log(shared.LogLevelWarn, "failed to poll the feature flags: %v", *err)
+		if p.factory.hasMetric {
+			p.handle.IncrementCounterValue(p.factory.errors, 1)
+		}
+	}
+	// The names are copied since they point to the header map being modified.
+	var spoofed []string
+	for _, h := range headers.GetAll() {
+		if strings.HasPrefix(strings.ToLower(h[0]), config.HeaderPrefix) {
+			spoofed = append(spoofed, strings.Clone(h[0]))
+		}
+	}
+	for _, name := range spoofed {
+		headers.Remove(name)
+	}
+
+	var targetingKey string
+	if config.TargetingKeyHeader != "" {
+		targetingKey = headers.GetOne(config.TargetingKeyHeader)
+	}
+	flags := *p.factory.provider.current.Load()
+	for name, flag := range flags {
+		if len(config.Flags) > 0 && !slices.Contains(config.Flags, name) {
+			continue
+		}
+		value, ok := flag.evaluate(name, targetingKey)
+		if !ok {
+			continue
+		}
+		headers.Set(config.HeaderPrefix+name, value)
+		p.handle.SetMetadata(featureFlagsMetadataNamespace, name, value)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// evaluate returns the value of the flag for the targeting key as a string, or false if the
+// flag is disabled or has no such variant.
+func (f *featureFlag) evaluate(name, targetingKey string) (string, bool) {
+	if f.State == "DISABLED" {
+		return "", false
+	}
+	variant := f.DefaultVariant
+	if f.total > 0 && targetingKey != "" {
+		// The flag name is hashed in so that the same users don't get all the rollouts first.
+		h := fnv.New32a()
+		h.Write([]byte(name + "\x00" + targetingKey))
+		bucket := int(h.Sum32() % uint32(f.total))
+		for _, w := range f.fractional {
+			if bucket < w.weight {
+				variant = w.variant
+				break
+			}
+			bucket -= w.weight
+		}
+	}
+	raw, ok := f.Variants[variant]
+	if !ok {
+		return "", false
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, true
+	}
+	var compact bytes.Buffer
+	if json.Compact(&compact, raw) != nil {
+		return "", false
+	}
+	return compact.String(), true
+}
+
+// poll polls the provider until stop is closed. The flags are kept when a poll fails.
+func (s *featureFlagsProvider) poll(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		flags, err := s.fetch()
+		if err != nil {
+			s.lastError.Store(&err)
+			continue
+		}
+		s.current.Store(&flags)
+	}
+}
+
+func featureFlagsRequest(client *http.Client, method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s responded with %s", method, url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, featureFlagsMaxResponseBytes))
+}
+
+// parseFlagdDefinition parses a flagd flag definition such as
+// {"flags": {"new-checkout": {"state": "ENABLED", "variants": {"on": true, "off": false},
+// "defaultVariant": "off", "fractional": {"on": 10, "off": 90}}}}.
+func parseFlagdDefinition(data []byte) (map[string]*featureFlag, error) {
+	var definition struct {
+		Flags map[string]*featureFlag `json:"flags"`
+	}
+	if err := json.Unmarshal(data, &definition); err != nil {
+		return nil, err
+	}
+	for name, flag := range definition.Flags {
+		if flag == nil {
+			return nil, fmt.Errorf("flag %q is null", name)
+		}
+		if _, ok := flag.Variants[flag.DefaultVariant]; !ok {
+			return nil, fmt.Errorf("flag %q: unknown default variant %q", name, flag.DefaultVariant)
+		}
+		for variant, weight := range flag.Fractional {
+			if _, ok := flag.Variants[variant]; !ok || weight < 0 {
+				return nil, fmt.Errorf("flag %q: invalid fractional variant %q", name, variant)
+			}
+			flag.fractional = append(flag.fractional, featureFlagWeight{variant: variant, weight: weight})
+			flag.total += weight
+		}
+		slices.SortFunc(flag.fractional, func(a, b featureFlagWeight) int { return strings.Compare(a.variant, b.variant) })
+	}
+	if definition.Flags == nil {
+		definition.Flags = map[string]*featureFlag{}
+	}
+	return definition.Flags, nil
+}
+
+// parseOFREPBulkResponse parses the response of the OFREP bulk evaluation, which has the flags
+// already evaluated. The flags that failed to evaluate are left out.
+func parseOFREPBulkResponse(data []byte) (map[string]*featureFlag, error) {
+	var response struct {
+		Flags []struct {
+			Key       string          `json:"key"`
+			Value     json.RawMessage `json:"value"`
+			Variant   string          `json:"variant"`
+			ErrorCode string          `json:"errorCode"`
+		} `json:"flags"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
+	}
+	flags := make(map[string]*featureFlag, len(response.Flags))
+	for _, f := range response.Flags {
+		if f.Key == "" || f.ErrorCode != "" || len(f.Value) == 0 {
+			continue
+		}
+		flags[f.Key] = &featureFlag{Variants: map[string]json.RawMessage{f.Variant: f.Value}, DefaultVariant: f.Variant}
+	}
+	return flags, nil
+}
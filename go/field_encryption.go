@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	// fieldEncryptionPrefix marks the encrypted values, which are
+	// "enc:v1:<key id>:<base64url of the nonce and the ciphertext>".
+	fieldEncryptionPrefix = "enc:v1:"
+
+	fieldEncryptionDefaultMaxBodyBytes = 1 << 20
+)
+
+type (
+	// fieldEncryptionFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	fieldEncryptionFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// fieldEncryptionFilterConfig is the JSON configuration of the field encryption filter.
+	fieldEncryptionFilterConfig struct {
+		// Fields are the dot separated paths of the fields, such as "card.number" or
+		// "users.*.ssn", where "*" matches all the items of an array or the members of an object
+		// and the numbers index the arrays.
+		Fields []string `json:"fields" example:"[json.ssn]"`
+		// Keys are the AES keys. The first one encrypts, and all of them decrypt, so that a new key
+		// can be put first while the values encrypted with the old one are still around.
+		Keys []fieldEncryptionKey `json:"keys" example:"[{id: k1, key: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=}]"`
+		// MaxBodyBytes is the maximum size of the bodies processed. Larger request bodies are
+		// rejected with 413, and larger responses are replaced with 502 so that the fields never
+		// leave unencrypted. Defaults to 1 MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// fieldEncryptionKey is an AES key, which must be 16, 24, or 32 bytes long.
+	fieldEncryptionKey struct {
+		// ID identifies the key in the encrypted values. It must not contain ":".
+		ID string `json:"id"`
+		// Key is the base64 encoded key.
+		Key string `json:"key"`
+		// KeyEnv is the environment variable containing the base64 encoded key, used if Key is
+		// not set.
+		KeyEnv string `json:"key_env"`
+	}
+	// fieldEncryptionFilterFactory implements [shared.HttpFilterFactory].
+	fieldEncryptionFilterFactory struct {
+		fields       [][]string
+		paths        []string
+		activeKey    string
+		keys         map[string]cipher.AEAD
+		maxBodyBytes int
+		bodies       shared.MetricID
+		hasMetric    bool
+	}
+	// fieldEncryptionFilter implements [shared.HttpFilter].
+	//
+	// The fields are encrypted in the JSON responses and decrypted in the JSON requests, so that
+	// the clients only ever hold the ciphertexts and send them back as they are. The values are
+	// encrypted with AES-GCM with the field path as the additional data, so a ciphertext can't be
+	// moved to another field. The rest of the document is kept as is, in the same order.
+	fieldEncryptionFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *fieldEncryptionFilterFactory
+		// headers is set while a body is being buffered.
+		headers shared.HeaderMap
+		body    []byte
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *fieldEncryptionFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config fieldEncryptionFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse field encryption config: %w", err)
+	}
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("fields must be set")
+	}
+	if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("keys must be set")
+	}
+	f := &fieldEncryptionFilterFactory{
+		paths:        config.Fields,
+		activeKey:    config.Keys[0].ID,
+		keys:         make(map[string]cipher.AEAD, len(config.Keys)),
+		maxBodyBytes: config.MaxBodyBytes,
+	}
+	if f.maxBodyBytes <= 0 {
+		f.maxBodyBytes = fieldEncryptionDefaultMaxBodyBytes
+	}
+	for _, field := range config.Fields {
+		if field == "" {
+			return nil, fmt.Errorf("fields must not be empty")
+		}
+		f.fields = append(f.fields, strings.Split(field, "."))
+	}
+	for i, k := range config.Keys {
+		if k.ID == "" || strings.Contains(k.ID, ":") {
+			return nil, fmt.Errorf("keys[%d]: invalid id %q", i, k.ID)
+		}
+		if _, ok := f.keys[k.ID]; ok {
+			return nil, fmt.Errorf("keys[%d]: duplicate id %q", i, k.ID)
+		}
+		encoded := k.Key
+		if encoded == "" && k.KeyEnv != "" {
+			encoded = os.Getenv(k.KeyEnv)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) == 0 {
+			return nil, fmt.Errorf("keys[%d]: key or key_env must be set to a base64 encoded key", i)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %w", i, err)
+		}
+		if f.keys[k.ID], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("keys[%d]: %w", i, err)
+		}
+	}
+	id, res := handle.DefineCounter("field_encryption_bodies_total", "direction", "result")
+	if res == shared.MetricsSuccess {
+		f.bodies, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the field encryption counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *fieldEncryptionFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &fieldEncryptionFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *fieldEncryptionFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream || jsonXMLFormat(headers.GetOne("content-type")) != jsonXMLFormatJSON {
+		return shared.HeadersStatusContinue
+	}
+	if cl, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && cl > p.factory.maxBodyBytes {
+		p.reject(http.StatusRequestEntityTooLarge, "Request body too large\n")
+		return shared.HeadersStatusStop
+	}
+	p.headers = headers
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *fieldEncryptionFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.headers == nil {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.headers = nil
+		p.count("request", "too_large")
+		p.reject(http.StatusRequestEntityTooLarge, "Request body too large\n")
+		return shared.BodyStatusStopNoBuffer
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if !p.decryptRequest(body) {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *fieldEncryptionFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.headers != nil && !p.decryptRequest(nil) {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// decryptRequest decrypts the fields of the buffered request body, and returns false if the
+// request is rejected.
+func (p *fieldEncryptionFilter) decryptRequest(body shared.BodyBuffer) bool {
+	processed, err := p.process(p.factory.decrypt)
+	if err != nil {
+		p.count("request", "error")
+		p.reject(http.StatusBadRequest, fmt.Sprintf("Bad Request: %v\n", err))
+		return false
+	}
+	p.count("request", "decrypted")
+	replaceBody(p.handle.BufferedRequestBody(), body, processed)
+	return true
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *fieldEncryptionFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream || jsonXMLFormat(headers.GetOne("content-type")) != jsonXMLFormatJSON {
+		return shared.HeadersStatusContinue
+	}
+	p.headers, p.body = headers, nil
+	return shared.HeadersStatusStop
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *fieldEncryptionFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.headers == nil {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.headers = nil
+		p.count("response", "too_large")
+		p.reject(http.StatusBadGateway, "Bad Gateway\n")
+		return shared.BodyStatusStopNoBuffer
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if !p.encryptResponse(body) {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *fieldEncryptionFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.headers != nil && !p.encryptResponse(nil) {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// encryptResponse encrypts the fields of the buffered response body. Unlike the other JSON
+// filters, a body that fails to parse is not let through as is, as it may contain the fields.
+func (p *fieldEncryptionFilter) encryptResponse(body shared.BodyBuffer) bool {
+	processed, err := p.process(p.factory.encrypt)
+	if err != nil {
+		p.handle.Log(shared.LogLevelWarn, "failed to encrypt the response body: %v", err)
+		p.count("response", "error")
+		p.reject(http.StatusBadGateway, "Bad Gateway\n")
+		return false
+	}
+	p.count("response", "encrypted")
+	replaceBody(p.handle.BufferedResponseBody(), body, processed)
+	return true
+}
+
+// process applies transform to the fields of the buffered body, and sets Content-Length.
+func (p *fieldEncryptionFilter) process(transform func(v *orderedJSON, path string) error) ([]byte, error) {
+	headers, body := p.headers, p.body
+	p.headers, p.body = nil, nil
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	doc, err := decodeOrderedJSON(dec)
+	if err != nil {
+		return nil, fmt.Errorf("malformed JSON: %w", err)
+	}
+	for i, field := range p.factory.fields {
+		if err = applyJSONPath(doc, field, p.factory.paths[i], transform); err != nil {
+			return nil, err
+		}
+	}
+	var out bytes.Buffer
+	encodeOrderedJSON(&out, doc)
+	headers.Set("content-length", strconv.Itoa(out.Len()))
+	return out.Bytes(), nil
+}
+
+// buffer copies the chunks of the body, and returns false if the body exceeds the limit.
+func (p *fieldEncryptionFilter) buffer(body shared.BodyBuffer) bool {
+	if len(p.body)+int(body.GetSize()) > p.factory.maxBodyBytes {
+		return false
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	return true
+}
+
+func (p *fieldEncryptionFilter) reject(status uint32, message string) {
+	p.handle.SendLocalResponse(status, [][2]string{{"Content-Type", "text/plain"}}, []byte(message), "field_encryption_rejected")
+}
+
+func (p *fieldEncryptionFilter) count(direction, result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.bodies, 1, direction, result)
+	}
+}
+
+// encrypt replaces the value with the encrypted JSON encoding of it. The values already
+// encrypted are left alone so that a ciphertext echoed by the upstream is not encrypted twice.
+func (p *fieldEncryptionFilterFactory) encrypt(v *orderedJSON, path string) error {
+	if s, ok := v.scalar.(string); ok && v.kind == 0 && strings.HasPrefix(s, fieldEncryptionPrefix) {
+		return nil
+	}
+	var plaintext bytes.Buffer
+	encodeOrderedJSON(&plaintext, v)
+	aead := p.keys[p.activeKey]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+plaintext.Len()+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext.Bytes(), []byte(path))
+	*v = orderedJSON{scalar: fieldEncryptionPrefix + p.activeKey + ":" + base64.RawURLEncoding.EncodeToString(sealed)}
+	return nil
+}
+
+// decrypt replaces the encrypted value with the value it decrypts into. The other values are
+// left alone, as the clients may send new values in the clear.
+func (p *fieldEncryptionFilterFactory) decrypt(v *orderedJSON, path string) error {
+	s, ok := v.scalar.(string)
+	if !ok || v.kind != 0 || !strings.HasPrefix(s, fieldEncryptionPrefix) {
+		return nil
+	}
+	keyID, encoded, _ := strings.Cut(strings.TrimPrefix(s, fieldEncryptionPrefix), ":")
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return fmt.Errorf("unknown key %q in %s", keyID, path)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return fmt.Errorf("malformed value in %s", path)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(path))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s", path)
+	}
+	dec := json.NewDecoder(bytes.NewReader(plaintext))
+	dec.UseNumber()
+	decrypted, err := decodeOrderedJSON(dec)
+	if err != nil {
+		return errors.New("malformed decrypted value")
+	}
+	*v = *decrypted
+	return nil
+}
+
+// applyJSONPath calls fn with the values at the path of the document. name is the path as
+// configured, passed on to fn.
+func applyJSONPath(doc *orderedJSON, path []string, name string, fn func(v *orderedJSON, path string) error) error {
+	if len(path) == 0 {
+		return fn(doc, name)
+	}
+	key, rest := path[0], path[1:]
+	switch doc.kind {
+	case '{':
+		for _, m := range doc.members {
+			if key == "*" || m.key == key {
+				if err := applyJSONPath(m.value, rest, name, fn); err != nil {
+					return err
+				}
+			}
+		}
+	case '[':
+		if key == "*" {
+			for _, item := range doc.items {
+				if err := applyJSONPath(item, rest, name, fn); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(doc.items) {
+			return applyJSONPath(doc.items[i], rest, name, fn)
+		}
+	}
+	return nil
+}
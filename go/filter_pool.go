@@ -0,0 +1,32 @@
+package main
+
+import "sync"
+
+// filterPool pools the filters of type T so that the stateless filters don't allocate a new one
+// per request. The filter gets one in its factory's Create and puts it back in OnStreamComplete,
+// after which Envoy calls none of its hooks.
+//
+// The pool is a [sync.Pool], whose caches are per P. The Go code called from Envoy runs on the
+// thread of the worker, so a worker mostly gets back the filters it put.
+//
+// Only the filters that don't reference themselves past OnStreamComplete can be pooled, that is,
+// ones not capturing the filter in goroutines or scheduled callbacks.
+type filterPool[T any] struct {
+	pool sync.Pool
+}
+
+// get returns a zeroed filter.
+func (p *filterPool[T]) get() *T {
+	if f, ok := p.pool.Get().(*T); ok {
+		return f
+	}
+	return new(T)
+}
+
+// put zeroes the filter, so that the next stream doesn't see the state of this one, and returns it
+// to the pool.
+func (p *filterPool[T]) put(f *T) {
+	var zero T
+	*f = zero
+	p.pool.Put(f)
+}
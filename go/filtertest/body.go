@@ -0,0 +1,86 @@
+package filtertest
+
+import (
+	"bytes"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// BodyBuffer implements [shared.BodyBuffer] on top of a list of chunks, like Envoy's buffer.
+type BodyBuffer struct {
+	chunks [][]byte
+	// recorder records the mutations as the calls of name, if set by the handle.
+	recorder *recorder
+	name     string
+	// faults are the faults of the handle, if set by the handle.
+	faults *Faults
+}
+
+var _ shared.BodyBuffer = (*BodyBuffer)(nil)
+
+// NewBodyBuffer creates a [BodyBuffer] with the given chunks.
+func NewBodyBuffer(chunks ...[]byte) *BodyBuffer {
+	b := &BodyBuffer{}
+	for _, chunk := range chunks {
+		b.append(chunk)
+	}
+	return b
+}
+
+// GetChunks implements [shared.BodyBuffer].
+func (b *BodyBuffer) GetChunks() [][]byte {
+	if b.faults.bodyReads() {
+		return nil
+	}
+	return b.chunks
+}
+
+// GetSize implements [shared.BodyBuffer].
+func (b *BodyBuffer) GetSize() uint64 {
+	if b.faults.bodyReads() {
+		return 0
+	}
+	var size uint64
+	for _, chunk := range b.chunks {
+		size += uint64(len(chunk))
+	}
+	return size
+}
+
+// Drain implements [shared.BodyBuffer].
+func (b *BodyBuffer) Drain(numBytes uint64) {
+	b.recorder.record(b.name+".Drain", numBytes)
+	if b.faults.bodyMutations() {
+		return
+	}
+	for numBytes > 0 && len(b.chunks) > 0 {
+		if first := uint64(len(b.chunks[0])); first <= numBytes {
+			numBytes -= first
+			b.chunks = b.chunks[1:]
+			continue
+		}
+		b.chunks[0] = b.chunks[0][numBytes:]
+		numBytes = 0
+	}
+}
+
+// Append implements [shared.BodyBuffer].
+func (b *BodyBuffer) Append(data []byte) {
+	b.recorder.record(b.name+".Append", bytes.Clone(data))
+	if b.faults.bodyMutations() {
+		return
+	}
+	b.append(data)
+}
+
+func (b *BodyBuffer) append(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b.chunks = append(b.chunks, bytes.Clone(data))
+}
+
+// Bytes returns the concatenated content of the buffer, regardless of the faults.
+func (b *BodyBuffer) Bytes() []byte {
+	return bytes.Join(b.chunks, nil)
+}
@@ -0,0 +1,335 @@
+// Package chain runs a chain of HTTP filters on the fakes of [filtertest] as Envoy iterates over
+// them, so that the interactions of the filters can be tested without Envoy, such as a filter
+// relying on a header set by another one, or a local reply of an authentication filter skipping
+// the filters after it:
+//
+//	func TestAuthBeforeRateLimit(t *testing.T) {
+//		c := chain.New(t, authFactory, ratelimitFactory)
+//		result := c.Run(chain.Message{Headers: [][2]string{{":path", "/"}}}, chain.Message{Headers: [][2]string{{":status", "200"}}})
+//		require.Equal(t, 0, result.LocalReply)
+//		require.Nil(t, result.Request)
+//		c.Handles[1].RequireNoCall(t, "SendLocalResponse")
+//	}
+//
+// The request goes through the filters in order, and the response in the reverse order. Each
+// filter processes the message before the next one sees it:
+//
+//   - The headers and the trailers are passed on once the filter continued them, either by
+//     returning continue, or by calling ContinueRequest or ContinueResponse after a stop. A stopped
+//     filter is waited for up to the timeout.
+//   - The body is passed on in the chunks the filter continued. The data the filter buffered is
+//     passed on in one chunk as the filter left it, and the data it stopped without buffering is
+//     dropped. After the headers stopped all, the body is passed to the filter in one chunk once
+//     it continued.
+//   - A local reply on the request path skips the rest of the request path and the upstream, and
+//     goes through the response path of all the filters, as Envoy does. A local reply on the
+//     response path replaces the response as is.
+package chain
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+)
+
+const defaultTimeout = 5 * time.Second
+
+type (
+	// Chain is a chain of filters running a stream.
+	Chain struct {
+		// Handles are the handles of the filters in the order of the chain, on the same emulated
+		// worker thread. Their inputs, such as the attributes, the callout handlers, and the
+		// faults, can be set before Run. Run replaces their header maps with the ones of the
+		// stream, which all the handles share.
+		Handles []*filtertest.Handle
+		// Timeout is how long a stopped filter may take to continue, and the work of the filters
+		// to be done after OnStreamComplete. Defaults to 5s.
+		Timeout time.Duration
+
+		t       testing.TB
+		filters []shared.HttpFilter
+		ran     bool
+	}
+	// Message is a request or a response.
+	Message struct {
+		Headers [][2]string
+		// Body is the body in the chunks the hooks are called with. Nil means none.
+		Body [][]byte
+		// Trailers are the trailers. Nil means none.
+		Trailers [][2]string
+	}
+	// Result is the outcome of a stream.
+	Result struct {
+		// Request is the request as it reached the upstream, or nil if it didn't.
+		Request *Message
+		// Response is the response as it reached the client, or nil if a filter failed to
+		// continue.
+		Response *Message
+		// LocalReply is the index of the filter whose local reply the client got, or -1.
+		LocalReply int
+	}
+
+	// path is the request or the response path of a filter.
+	path struct {
+		name       string
+		onHeaders  func(shared.HeaderMap, bool) shared.HeadersStatus
+		onBody     func(shared.BodyBuffer, bool) shared.BodyStatus
+		onTrailers func(shared.HeaderMap) shared.TrailersStatus
+		// buffer is the field of the handle with the buffered body.
+		buffer    **filtertest.BodyBuffer
+		continues func() int
+	}
+	// message is a message going through the filters.
+	message struct {
+		headers     *filtertest.HeaderMap
+		body        [][]byte
+		trailers    *filtertest.HeaderMap
+		hasBody     bool
+		hasTrailers bool
+	}
+	// outcome is what a filter did with a message.
+	outcome int
+)
+
+const (
+	passed outcome = iota
+	replied
+	failed
+)
+
+// New creates the filters of a stream with the factories, in the order of the chain.
+func New(t testing.TB, factories ...shared.HttpFilterFactory) *Chain {
+	t.Helper()
+	c := &Chain{Handles: filtertest.NewHandles(len(factories)), t: t}
+	for i, factory := range factories {
+		var filter shared.HttpFilter
+		c.Handles[i].Do(func() { filter = factory.Create(c.Handles[i]) })
+		if filter == nil {
+			t.Fatalf("the factory of filter %d created a nil filter", i)
+		}
+		c.filters = append(c.filters, filter)
+	}
+	return c
+}
+
+// Run sends the request through the chain, and the response back if the request reached the
+// upstream, then completes the stream. A chain runs a single stream.
+func (c *Chain) Run(request, response Message) *Result {
+	c.t.Helper()
+	if c.ran {
+		c.t.Fatal("a chain runs a single stream; create another one with New")
+	}
+	c.ran = true
+	defer c.complete()
+
+	result := &Result{LocalReply: -1}
+	m := newMessage(request)
+	for _, h := range c.Handles {
+		h.RequestHeaderMap, h.RequestTrailerMap = m.headers, m.trailers
+	}
+	for i := range c.filters {
+		outcome := c.runFilter(i, c.requestPath(i), m)
+		if outcome == failed {
+			return result
+		}
+		if outcome == replied {
+			result.LocalReply = i
+			response = localReplyMessage(c.Handles[i].LocalResponse())
+			break
+		}
+	}
+	if result.LocalReply < 0 {
+		result.Request = m.message()
+	}
+
+	m = newMessage(response)
+	for _, h := range c.Handles {
+		h.ResponseHeaderMap, h.ResponseTrailerMap = m.headers, m.trailers
+	}
+	for i := len(c.filters) - 1; i >= 0; i-- {
+		switch c.runFilter(i, c.responsePath(i), m) {
+		case failed:
+			return result
+		case replied:
+			reply := localReplyMessage(c.Handles[i].LocalResponse())
+			result.LocalReply, result.Response = i, &reply
+			return result
+		}
+	}
+	result.Response = m.message()
+	return result
+}
+
+func (c *Chain) requestPath(i int) *path {
+	h, f := c.Handles[i], c.filters[i]
+	return &path{
+		name: "request", onHeaders: f.OnRequestHeaders, onBody: f.OnRequestBody, onTrailers: f.OnRequestTrailers,
+		buffer: &h.RequestBody, continues: h.ContinueRequestCount,
+	}
+}
+
+func (c *Chain) responsePath(i int) *path {
+	h, f := c.Handles[i], c.filters[i]
+	return &path{
+		name: "response", onHeaders: f.OnResponseHeaders, onBody: f.OnResponseBody, onTrailers: f.OnResponseTrailers,
+		buffer: &h.ResponseBody, continues: h.ContinueResponseCount,
+	}
+}
+
+// runFilter calls the hooks of the path of filter i with the message as Envoy does, and replaces
+// the body of the message with the one the filter passed on.
+func (c *Chain) runFilter(i int, p *path, m *message) outcome {
+	h := c.Handles[i]
+	reply := h.LocalResponse()
+	hasReplied := func() bool { return h.LocalResponse() != reply }
+	continues := p.continues()
+	// await waits for the filter to continue or to reply after a stop.
+	await := func(hook string) outcome {
+		if !h.Await(c.timeout(), func() bool { return p.continues() > continues || hasReplied() }) {
+			c.t.Errorf("filter %d stopped the %s in %s, and neither continued nor replied in %s", i, p.name, hook, c.timeout())
+			return failed
+		}
+		continues = p.continues()
+		if hasReplied() {
+			return replied
+		}
+		return passed
+	}
+
+	var headersStatus shared.HeadersStatus
+	h.Do(func() { headersStatus = p.onHeaders(m.headers, !m.hasBody && !m.hasTrailers) })
+	if hasReplied() {
+		return replied
+	}
+	hook, stopped := "the headers", headersStatus != shared.HeadersStatusContinue
+	body := m.body
+	if headersStatus == shared.HeadersStatusStopAllAndBuffer || headersStatus == shared.HeadersStatusStopAllAndWatermark {
+		if outcome := await(hook); outcome != passed {
+			return outcome
+		}
+		stopped = false
+		if len(body) > 0 {
+			body = [][]byte{bytes.Join(body, nil)}
+		}
+	}
+
+	var out [][]byte
+	buffering := false
+	for j, chunk := range body {
+		// Envoy keeps the data the filter buffered, as the filter left it, and appends to it.
+		if buffering {
+			*p.buffer = filtertest.NewBodyBuffer((*p.buffer).Bytes(), chunk)
+		} else {
+			*p.buffer = filtertest.NewBodyBuffer(chunk)
+		}
+		buffer := *p.buffer
+		var bodyStatus shared.BodyStatus
+		h.Do(func() { bodyStatus = p.onBody(buffer, j == len(body)-1 && !m.hasTrailers) })
+		if hasReplied() {
+			return replied
+		}
+		hook, stopped = "the body", bodyStatus != shared.BodyStatusContinue
+		buffering = bodyStatus == shared.BodyStatusStopAndBuffer || bodyStatus == shared.BodyStatusStopAndWatermark
+		if !stopped {
+			out = append(out, buffer.Bytes())
+		}
+	}
+	if m.hasTrailers {
+		var trailersStatus shared.TrailersStatus
+		h.Do(func() { trailersStatus = p.onTrailers(m.trailers) })
+		if hasReplied() {
+			return replied
+		}
+		hook, stopped = "the trailers", trailersStatus != shared.TrailersStatusContinue
+	}
+	if stopped {
+		if outcome := await(hook); outcome != passed {
+			return outcome
+		}
+	}
+	if buffering {
+		out = append(out, (*p.buffer).Bytes())
+	}
+	// The end of the stream is still passed on with an empty chunk if all the data was dropped.
+	if len(out) == 0 && m.hasBody {
+		out = [][]byte{{}}
+	}
+	m.body = out
+	return passed
+}
+
+// complete completes the stream, waits for the work of the filters, and checks how they used the
+// handles.
+func (c *Chain) complete() {
+	c.t.Helper()
+	for i, filter := range c.filters {
+		c.Handles[i].Do(filter.OnStreamComplete)
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, h := range c.Handles {
+			h.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(c.timeout()):
+		c.t.Errorf("the scheduled tasks or the callouts of the filters are not done %s after OnStreamComplete", c.timeout())
+	}
+	for i, h := range c.Handles {
+		for _, call := range h.OffWorkerCalls() {
+			c.t.Errorf("filter %d called %s off the worker thread; use the scheduler from the goroutines", i, call)
+		}
+	}
+}
+
+func (c *Chain) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+func newMessage(m Message) *message {
+	return &message{
+		headers:     filtertest.NewHeaderMap(m.Headers...),
+		body:        m.Body,
+		trailers:    filtertest.NewHeaderMap(m.Trailers...),
+		hasBody:     len(m.Body) > 0,
+		hasTrailers: len(m.Trailers) > 0,
+	}
+}
+
+// message returns the message as the filters left it.
+func (m *message) message() *Message {
+	ret := &Message{Headers: m.headers.GetAll(), Body: m.body}
+	if m.hasTrailers {
+		ret.Trailers = m.trailers.GetAll()
+	}
+	return ret
+}
+
+// localReplyMessage returns the response of the local reply.
+func localReplyMessage(reply *filtertest.LocalResponse) Message {
+	m := Message{Headers: reply.Headers, Trailers: reply.Trailers}
+	// SendLocalResponse has the status aside from the headers, unlike SendResponseHeaders.
+	if !slices.ContainsFunc(reply.Headers, func(h [2]string) bool { return h[0] == ":status" }) {
+		m.Headers = append([][2]string{{":status", strconv.FormatUint(uint64(reply.Status), 10)}}, reply.Headers...)
+	}
+	if len(reply.Body) > 0 {
+		m.Body = [][]byte{reply.Body}
+	}
+	return m
+}
+
+// BodyBytes returns the body of the message in one piece.
+func (m *Message) BodyBytes() []byte {
+	return bytes.Join(m.Body, nil)
+}
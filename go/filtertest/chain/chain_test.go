@@ -0,0 +1,171 @@
+package chain_test
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/chain"
+)
+
+type (
+	// factoryFunc implements [shared.HttpFilterFactory] with a function.
+	factoryFunc func(handle shared.HttpFilterHandle) shared.HttpFilter
+
+	// stopFilter stops the request headers after setting x-stopped, and continues them from a
+	// scheduled task.
+	stopFilter struct {
+		handle shared.HttpFilterHandle
+		shared.EmptyHttpFilter
+	}
+	// bufferFilter buffers the request body, and appends "!" to it at the end of the stream.
+	bufferFilter struct {
+		shared.EmptyHttpFilter
+	}
+	// replyFilter replies 403 to the request headers.
+	replyFilter struct {
+		handle shared.HttpFilterHandle
+		shared.EmptyHttpFilter
+	}
+	// traceFilter records the hooks it is called with, and the request bodies it sees.
+	traceFilter struct {
+		name   string
+		trace  *[]string
+		bodies [][]byte
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterFactory].
+func (f factoryFunc) Create(handle shared.HttpFilterHandle) shared.HttpFilter { return f(handle) }
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *stopFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	headers.Set("x-stopped", "true")
+	p.handle.GetScheduler().Schedule(p.handle.ContinueRequest)
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *bufferFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	body.Append([]byte("!"))
+	return shared.BodyStatusContinue
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *replyFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.handle.SendLocalResponse(http.StatusForbidden, [][2]string{{"content-type", "text/plain"}}, []byte("Forbidden\n"), "forbidden")
+	return shared.HeadersStatusStop
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *traceFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	*p.trace = append(*p.trace, p.name+".OnRequestHeaders x-stopped="+headers.GetOne("x-stopped"))
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *traceFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	p.bodies = append(p.bodies, bytes.Join(body.GetChunks(), nil))
+	return shared.BodyStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *traceFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	*p.trace = append(*p.trace, p.name+".OnResponseHeaders :status="+headers.GetOne(":status"))
+	return shared.HeadersStatusContinue
+}
+
+var (
+	request  = chain.Message{Headers: [][2]string{{":method", "POST"}, {":path", "/"}}}
+	response = chain.Message{Headers: [][2]string{{":status", "200"}}}
+)
+
+func TestStopAndContinue(t *testing.T) {
+	var trace []string
+	c := chain.New(t,
+		factoryFunc(func(h shared.HttpFilterHandle) shared.HttpFilter { return &stopFilter{handle: h} }),
+		factoryFunc(func(shared.HttpFilterHandle) shared.HttpFilter { return &traceFilter{name: "next", trace: &trace} }),
+	)
+	result := c.Run(request, response)
+
+	if result.LocalReply != -1 {
+		t.Fatalf("LocalReply = %d, want -1", result.LocalReply)
+	}
+	if result.Request == nil || result.Response == nil {
+		t.Fatalf("Request = %v, Response = %v, want both", result.Request, result.Response)
+	}
+	if got := filtertest.NewHeaderMap(result.Request.Headers...).GetOne("x-stopped"); got != "true" {
+		t.Fatalf("upstream x-stopped = %q, want %q", got, "true")
+	}
+	want := []string{"next.OnRequestHeaders x-stopped=true", "next.OnResponseHeaders :status=200"}
+	if !slices.Equal(trace, want) {
+		t.Fatalf("trace = %q, want %q", trace, want)
+	}
+	c.Handles[0].RequireCall(t, "ContinueRequest")
+}
+
+func TestBufferedBody(t *testing.T) {
+	next := &traceFilter{name: "next", trace: new([]string)}
+	c := chain.New(t,
+		factoryFunc(func(shared.HttpFilterHandle) shared.HttpFilter { return &bufferFilter{} }),
+		factoryFunc(func(shared.HttpFilterHandle) shared.HttpFilter { return next }),
+	)
+	req := request
+	req.Body = [][]byte{[]byte("hello"), []byte(", "), []byte("world")}
+	result := c.Run(req, response)
+
+	if result.Request == nil {
+		t.Fatal("the request didn't reach the upstream")
+	}
+	if got := string(result.Request.BodyBytes()); got != "hello, world!" {
+		t.Fatalf("upstream body = %q, want %q", got, "hello, world!")
+	}
+	// The buffered data is passed on in one chunk.
+	if len(next.bodies) != 1 || string(next.bodies[0]) != "hello, world!" {
+		t.Fatalf("next filter got the chunks %q, want one chunk %q", next.bodies, "hello, world!")
+	}
+}
+
+func TestLocalReplySkipsLaterFilters(t *testing.T) {
+	var trace []string
+	c := chain.New(t,
+		factoryFunc(func(shared.HttpFilterHandle) shared.HttpFilter { return &traceFilter{name: "before", trace: &trace} }),
+		factoryFunc(func(h shared.HttpFilterHandle) shared.HttpFilter { return &replyFilter{handle: h} }),
+		factoryFunc(func(shared.HttpFilterHandle) shared.HttpFilter { return &traceFilter{name: "after", trace: &trace} }),
+	)
+	result := c.Run(request, response)
+
+	if result.LocalReply != 1 {
+		t.Fatalf("LocalReply = %d, want 1", result.LocalReply)
+	}
+	if result.Request != nil {
+		t.Fatalf("the request reached the upstream: %v", result.Request)
+	}
+	if result.Response == nil {
+		t.Fatal("the client got no response")
+	}
+	if got := filtertest.NewHeaderMap(result.Response.Headers...).GetOne(":status"); got != "403" {
+		t.Fatalf("client :status = %q, want %q", got, "403")
+	}
+	if got := string(result.Response.BodyBytes()); got != "Forbidden\n" {
+		t.Fatalf("client body = %q, want %q", got, "Forbidden\n")
+	}
+	// The local reply goes through the response path of all the filters, as in Envoy.
+	want := []string{
+		"before.OnRequestHeaders x-stopped=",
+		"after.OnResponseHeaders :status=403",
+		"before.OnResponseHeaders :status=403",
+	}
+	if !slices.Equal(trace, want) {
+		t.Fatalf("trace = %q, want %q", trace, want)
+	}
+	c.Handles[1].RequireLocalReply(t, http.StatusForbidden)
+}
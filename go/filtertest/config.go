@@ -0,0 +1,153 @@
+package filtertest
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+type metricKind int
+
+const (
+	metricKindCounter metricKind = iota
+	metricKindGauge
+	metricKindHistogram
+)
+
+type (
+	// ConfigHandle implements [shared.HttpFilterConfigHandle].
+	//
+	// It also stores the values of the metrics it defines, which are recorded via [Handle]
+	// whose Config field points to it.
+	ConfigHandle struct {
+		mu      sync.Mutex
+		metrics []*metric
+	}
+	metric struct {
+		name    string
+		kind    metricKind
+		tagKeys []string
+		// values holds the counter and gauge values keyed by the joined tag values.
+		values map[string]uint64
+		// samples holds the histogram samples keyed by the joined tag values.
+		samples map[string][]uint64
+	}
+)
+
+var _ shared.HttpFilterConfigHandle = (*ConfigHandle)(nil)
+
+// NewConfigHandle creates a [ConfigHandle].
+func NewConfigHandle() *ConfigHandle {
+	return &ConfigHandle{}
+}
+
+// Log implements [shared.HttpFilterConfigHandle].
+func (c *ConfigHandle) Log(level shared.LogLevel, format string, args ...any) {
+	log.Printf("[%s] %s", logLevelName(level), fmt.Sprintf(format, args...))
+}
+
+// DefineHistogram implements [shared.HttpFilterConfigHandle].
+func (c *ConfigHandle) DefineHistogram(name string, tagKeys ...string) (shared.MetricID, shared.MetricsResult) {
+	return c.define(name, metricKindHistogram, tagKeys)
+}
+
+// DefineGauge implements [shared.HttpFilterConfigHandle].
+func (c *ConfigHandle) DefineGauge(name string, tagKeys ...string) (shared.MetricID, shared.MetricsResult) {
+	return c.define(name, metricKindGauge, tagKeys)
+}
+
+// DefineCounter implements [shared.HttpFilterConfigHandle].
+func (c *ConfigHandle) DefineCounter(name string, tagKeys ...string) (shared.MetricID, shared.MetricsResult) {
+	return c.define(name, metricKindCounter, tagKeys)
+}
+
+func (c *ConfigHandle) define(name string, kind metricKind, tagKeys []string) (shared.MetricID, shared.MetricsResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = append(c.metrics, &metric{
+		name:    name,
+		kind:    kind,
+		tagKeys: slices.Clone(tagKeys),
+		values:  make(map[string]uint64),
+		samples: make(map[string][]uint64),
+	})
+	return shared.MetricID(len(c.metrics) - 1), shared.MetricsSuccess
+}
+
+// record applies f to the metric identified by id after validating its kind and tags.
+func (c *ConfigHandle) record(id shared.MetricID, kind metricKind, tagValues []string, f func(m *metric, key string)) shared.MetricsResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int(id) >= len(c.metrics) || c.metrics[id].kind != kind {
+		return shared.MetricsNotFound
+	}
+	m := c.metrics[id]
+	if len(tagValues) != len(m.tagKeys) {
+		return shared.MetricsInvalidTags
+	}
+	f(m, strings.Join(tagValues, "\x00"))
+	return shared.MetricsSuccess
+}
+
+// lookup returns the metric with the given name and kind.
+func (c *ConfigHandle) lookup(name string, kind metricKind) *metric {
+	for _, m := range c.metrics {
+		if m.name == name && m.kind == kind {
+			return m
+		}
+	}
+	return nil
+}
+
+// Counter returns the value of the counter with the given name and tag values.
+func (c *ConfigHandle) Counter(name string, tagValues ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m := c.lookup(name, metricKindCounter); m != nil {
+		return m.values[strings.Join(tagValues, "\x00")]
+	}
+	return 0
+}
+
+// Gauge returns the value of the gauge with the given name and tag values.
+func (c *ConfigHandle) Gauge(name string, tagValues ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m := c.lookup(name, metricKindGauge); m != nil {
+		return m.values[strings.Join(tagValues, "\x00")]
+	}
+	return 0
+}
+
+// Histogram returns the samples of the histogram with the given name and tag values.
+func (c *ConfigHandle) Histogram(name string, tagValues ...string) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m := c.lookup(name, metricKindHistogram); m != nil {
+		return slices.Clone(m.samples[strings.Join(tagValues, "\x00")])
+	}
+	return nil
+}
+
+func logLevelName(level shared.LogLevel) string {
+	switch level {
+	case shared.LogLevelTrace:
+		return "trace"
+	case shared.LogLevelDebug:
+		return "debug"
+	case shared.LogLevelInfo:
+		return "info"
+	case shared.LogLevelWarn:
+		return "warn"
+	case shared.LogLevelError:
+		return "error"
+	case shared.LogLevelCritical:
+		return "critical"
+	default:
+		return "off"
+	}
+}
@@ -0,0 +1,348 @@
+// Package conformance checks that an HTTP filter built on the Go SDK respects the lifecycle
+// contract of Envoy, by running a table of scenarios against the filters created by its factory
+// on the fakes of [filtertest]. The contract checked is:
+//
+//   - A stream stopped by the last hook of a phase is continued, with ContinueRequest or
+//     ContinueResponse, or replied to within the timeout, and the continues don't outnumber the
+//     stops.
+//   - A hook sending a local reply stops the iteration, and the stream is not continued after.
+//   - The handle is only used on the worker thread, that is, from the hooks and the scheduled
+//     tasks rather than from the goroutines of the filter.
+//   - The hooks don't panic, whether the bodies come in one chunk or several, and whether the
+//     stream is complete or reset in the middle, and the work of the filter is done after
+//     OnStreamComplete.
+//
+// The scenarios are run with each of the exchanges of the config, which should take the paths of
+// the filter, such as a request that is rejected:
+//
+//	func TestConformance(t *testing.T) {
+//		configHandle := filtertest.NewConfigHandle()
+//		factory, err := (&headerAuthFilterConfigFactory{}).Create(configHandle, []byte("secret"))
+//		require.NoError(t, err)
+//		conformance.Run(t, factory, conformance.Config{ConfigHandle: configHandle, Exchanges: []conformance.Exchange{
+//			{Name: "authorized", RequestHeaders: [][2]string{{":path", "/"}, {"authorization", "secret"}}},
+//			{Name: "unauthorized", RequestHeaders: [][2]string{{":path", "/"}}},
+//		}})
+//	}
+package conformance
+
+import (
+	"runtime/debug"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// DefaultExchanges are the exchanges used if [Config.Exchanges] is empty: a GET and a POST with
+// the bodies and the response trailers.
+var DefaultExchanges = []Exchange{
+	{
+		Name:            "get",
+		RequestHeaders:  [][2]string{{":method", "GET"}, {":path", "/"}, {":authority", "example.com"}},
+		ResponseHeaders: [][2]string{{":status", "200"}, {"content-type", "text/plain"}},
+		ResponseBody:    []byte("hello, world"),
+	},
+	{
+		Name: "post",
+		RequestHeaders: [][2]string{
+			{":method", "POST"}, {":path", "/"}, {":authority", "example.com"}, {"content-type", "application/json"},
+		},
+		RequestBody:      []byte(`{"hello": "world"}`),
+		ResponseHeaders:  [][2]string{{":status", "200"}, {"content-type", "application/json"}},
+		ResponseBody:     []byte(`{"ok": true}`),
+		ResponseTrailers: [][2]string{{"x-trailer", "done"}},
+	},
+}
+
+// scenarios are run with each exchange.
+var scenarios = []struct {
+	name string
+	run  func(s *stream)
+}{
+	{"single chunk", func(s *stream) {
+		if s.request(1) {
+			s.response(1)
+		}
+	}},
+	{"chunked bodies", func(s *stream) {
+		if s.request(3) {
+			s.response(3)
+		}
+	}},
+	{"reset after request headers", func(s *stream) {
+		s.run(s.requestPhase(), 0)
+	}},
+	{"reset after response headers", func(s *stream) {
+		if s.request(1) {
+			s.run(s.responsePhase(), 0)
+		}
+	}},
+}
+
+type (
+	// Config is the configuration of [Run].
+	Config struct {
+		// Exchanges are the requests and the responses the scenarios are run with. Defaults to
+		// [DefaultExchanges].
+		Exchanges []Exchange
+		// ConfigHandle is the handle the factory was created with, so that the metrics of the
+		// filter are recorded. The metrics calls fail if nil, as they do for an undefined metric.
+		ConfigHandle *filtertest.ConfigHandle
+		// Timeout is how long a stopped stream may wait to be continued, and the work of the
+		// filter to be done after OnStreamComplete. Defaults to 5s.
+		Timeout time.Duration
+		// Faults are injected into the handle of each scenario, to check that the filter keeps to
+		// the contract when the callbacks fail, for example, that a stream it can't schedule the
+		// continuation of is continued or replied to all the same.
+		Faults filtertest.Faults
+	}
+	// Exchange is a request and its response. The response is not used if the filter replies
+	// to the request. A nil body or trailers means none.
+	Exchange struct {
+		Name             string
+		RequestHeaders   [][2]string
+		RequestBody      []byte
+		RequestTrailers  [][2]string
+		ResponseHeaders  [][2]string
+		ResponseBody     []byte
+		ResponseTrailers [][2]string
+	}
+
+	// stream drives a filter through a scenario.
+	stream struct {
+		t        *testing.T
+		h        *filtertest.Handle
+		filter   shared.HttpFilter
+		exchange *Exchange
+		timeout  time.Duration
+	}
+	// phase is the request or the response side of the stream.
+	phase struct {
+		name       string
+		onHeaders  func(shared.HeaderMap, bool) shared.HeadersStatus
+		onBody     func(shared.BodyBuffer, bool) shared.BodyStatus
+		onTrailers func(shared.HeaderMap) shared.TrailersStatus
+		headers    *filtertest.HeaderMap
+		body       []byte
+		// buffer is the field of the handle with the buffered body.
+		buffer    **filtertest.BodyBuffer
+		trailers  *filtertest.HeaderMap
+		continues func() int
+	}
+)
+
+// Run runs the scenarios with each exchange against the filters created by the factory, as the
+// subtests named after the exchange and the scenario.
+func Run(t *testing.T, factory shared.HttpFilterFactory, config Config) {
+	exchanges := config.Exchanges
+	if len(exchanges) == 0 {
+		exchanges = DefaultExchanges
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	for i := range exchanges {
+		e := &exchanges[i]
+		t.Run(e.Name, func(t *testing.T) {
+			for _, scenario := range scenarios {
+				t.Run(scenario.name, func(t *testing.T) {
+					h := filtertest.NewHandle()
+					h.Config = config.ConfigHandle
+					h.RequestHeaderMap = filtertest.NewHeaderMap(e.RequestHeaders...)
+					h.RequestTrailerMap = filtertest.NewHeaderMap(e.RequestTrailers...)
+					h.ResponseHeaderMap = filtertest.NewHeaderMap(e.ResponseHeaders...)
+					h.ResponseTrailerMap = filtertest.NewHeaderMap(e.ResponseTrailers...)
+					h.Faults = config.Faults
+					s := &stream{t: t, h: h, exchange: e, timeout: timeout}
+					s.call("Create", func() { s.filter = factory.Create(h) })
+					if s.filter == nil {
+						t.Fatal("the factory created a nil filter")
+					}
+					scenario.run(s)
+					s.complete()
+				})
+			}
+		})
+	}
+}
+
+func (s *stream) requestPhase() *phase {
+	return &phase{
+		name: "request", onHeaders: s.filter.OnRequestHeaders, onBody: s.filter.OnRequestBody,
+		onTrailers: s.filter.OnRequestTrailers, headers: s.h.RequestHeaderMap, body: s.exchange.RequestBody,
+		buffer: &s.h.RequestBody, trailers: s.h.RequestTrailerMap, continues: s.h.ContinueRequestCount,
+	}
+}
+
+func (s *stream) responsePhase() *phase {
+	return &phase{
+		name: "response", onHeaders: s.filter.OnResponseHeaders, onBody: s.filter.OnResponseBody,
+		onTrailers: s.filter.OnResponseTrailers, headers: s.h.ResponseHeaderMap, body: s.exchange.ResponseBody,
+		buffer: &s.h.ResponseBody, trailers: s.h.ResponseTrailerMap, continues: s.h.ContinueResponseCount,
+	}
+}
+
+// request runs the request phase with the body in the number of chunks, and returns whether the
+// stream goes on to the response.
+func (s *stream) request(chunks int) bool {
+	return s.run(s.requestPhase(), chunks)
+}
+
+// response runs the response phase with the body in the number of chunks.
+func (s *stream) response(chunks int) {
+	s.run(s.responsePhase(), chunks)
+}
+
+// run calls the hooks of the phase as Envoy does, and returns whether the stream goes on after
+// it. With zero chunks, only the headers are sent, as if the stream was reset after them.
+func (s *stream) run(p *phase, chunks int) bool {
+	hasTrailers := len(p.trailers.GetAll()) > 0
+	endOfStream := chunks > 0 && len(p.body) == 0 && !hasTrailers
+	stops := 0
+	var headersStatus shared.HeadersStatus
+	s.call("On"+title(p.name)+"Headers", func() { headersStatus = p.onHeaders(p.headers, endOfStream) })
+	stopped := headersStatus != shared.HeadersStatusContinue
+	if s.replied("On"+title(p.name)+"Headers", stopped) {
+		return false
+	}
+	if chunks == 0 {
+		return false
+	}
+	if stopped {
+		stops++
+	}
+
+	buffering := false
+	parts := split(p.body, chunks)
+	for i, chunk := range parts {
+		// Envoy keeps the data the filter buffered, as the filter left it, and appends to it.
+		if buffering {
+			*p.buffer = filtertest.NewBodyBuffer((*p.buffer).Bytes(), chunk)
+		} else {
+			*p.buffer = filtertest.NewBodyBuffer(chunk)
+		}
+		var bodyStatus shared.BodyStatus
+		last := i == len(parts)-1 && !hasTrailers
+		s.call("On"+title(p.name)+"Body", func() { bodyStatus = p.onBody(*p.buffer, last) })
+		stopped = bodyStatus != shared.BodyStatusContinue
+		if s.replied("On"+title(p.name)+"Body", stopped) {
+			return false
+		}
+		if stopped {
+			stops++
+		}
+		buffering = bodyStatus == shared.BodyStatusStopAndBuffer || bodyStatus == shared.BodyStatusStopAndWatermark
+	}
+	if hasTrailers {
+		var trailersStatus shared.TrailersStatus
+		s.call("On"+title(p.name)+"Trailers", func() { trailersStatus = p.onTrailers(p.trailers) })
+		stopped = trailersStatus != shared.TrailersStatusContinue
+		if s.replied("On"+title(p.name)+"Trailers", stopped) {
+			return false
+		}
+		if stopped {
+			stops++
+		}
+	}
+
+	if stopped {
+		if !s.h.Await(s.timeout, func() bool { return p.continues() > 0 || s.h.LocalResponse() != nil }) {
+			s.t.Errorf("the %s was stopped by the last hook, and neither continued nor replied to in %s", p.name, s.timeout)
+			return false
+		}
+		if s.h.LocalResponse() != nil {
+			return false
+		}
+	}
+	if continues := p.continues(); continues > stops {
+		s.t.Errorf("Continue%s was called %d times for %d stops of the iteration", title(p.name), continues, stops)
+	}
+	return true
+}
+
+// call calls the hook on the worker thread, and fails the test if it panics.
+func (s *stream) call(hook string, f func()) {
+	s.t.Helper()
+	var recovered any
+	var stack []byte
+	s.h.Do(func() {
+		defer func() {
+			if recovered = recover(); recovered != nil {
+				stack = debug.Stack()
+			}
+		}()
+		f()
+	})
+	if recovered != nil {
+		s.t.Fatalf("%s panicked: %v\n%s", hook, recovered, stack)
+	}
+}
+
+// replied returns whether the filter replied to the request, and fails the test if the hook that
+// did continued the iteration.
+func (s *stream) replied(hook string, stopped bool) bool {
+	if s.h.LocalResponse() == nil {
+		return false
+	}
+	if !stopped {
+		s.t.Errorf("%s sent a local reply but returned continue; the iteration must stop after a local reply", hook)
+	}
+	return true
+}
+
+// complete completes the stream, waits for the work of the filter, and checks how it used the
+// handle.
+func (s *stream) complete() {
+	s.call("OnStreamComplete", s.filter.OnStreamComplete)
+	done := make(chan struct{})
+	go func() {
+		s.h.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.timeout):
+		s.t.Errorf("the scheduled tasks or the callouts of the filter are not done %s after OnStreamComplete", s.timeout)
+	}
+
+	calls := s.h.Calls()
+	if reply := slices.IndexFunc(calls, isReply); reply >= 0 {
+		for _, call := range calls[reply+1:] {
+			if call.Method == "ContinueRequest" || call.Method == "ContinueResponse" {
+				s.t.Errorf("%s was called after the local reply", call.Method)
+			}
+		}
+	}
+	for _, call := range s.h.OffWorkerCalls() {
+		s.t.Errorf("%s was called off the worker thread; use the scheduler from the goroutines", call)
+	}
+}
+
+func isReply(call filtertest.Call) bool {
+	return call.Method == "SendLocalResponse" || call.Method == "SendResponseHeaders"
+}
+
+// split splits the body into up to n chunks of about the same size.
+func split(body []byte, n int) [][]byte {
+	if len(body) == 0 {
+		return nil
+	}
+	n = min(n, len(body))
+	chunks := make([][]byte, 0, n)
+	for i := range n {
+		chunks = append(chunks, body[i*len(body)/n:(i+1)*len(body)/n])
+	}
+	return chunks
+}
+
+func title(s string) string {
+	return strings.ToUpper(s[:1]) + s[1:]
+}
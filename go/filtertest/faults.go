@@ -0,0 +1,29 @@
+package filtertest
+
+// Faults are the failures of Envoy injected into the filter by the fakes, so that the filter can be
+// tested for degrading gracefully rather than assuming that every callback succeeds. The mutations
+// fail silently as they do in Envoy, for example, on a header map not available in the current
+// phase, since the SDK doesn't return their results.
+//
+// The calls of the filter are recorded all the same. Set the faults after the inputs of the handle,
+// whose mutations would otherwise be dropped too.
+type Faults struct {
+	// HeaderMutations makes Set, Add and Remove of the headers and the trailers have no effect.
+	HeaderMutations bool
+	// BodyMutations makes Drain and Append of the bodies have no effect.
+	BodyMutations bool
+	// BodyReads makes GetChunks of the bodies return no chunk and GetSize return zero, as if the
+	// body was not available.
+	BodyReads bool
+	// NilScheduler makes GetScheduler return nil.
+	NilScheduler bool
+}
+
+// headerMutations returns whether the header mutations fail. It is safe to call on nil.
+func (f *Faults) headerMutations() bool { return f != nil && f.HeaderMutations }
+
+// bodyMutations returns whether the body mutations fail. It is safe to call on nil.
+func (f *Faults) bodyMutations() bool { return f != nil && f.BodyMutations }
+
+// bodyReads returns whether the body reads fail. It is safe to call on nil.
+func (f *Faults) bodyReads() bool { return f != nil && f.BodyReads }
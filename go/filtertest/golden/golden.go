@@ -0,0 +1,284 @@
+// Package golden runs an HTTP filter over fixture requests and responses, and compares what the
+// filter did with golden files, for the regression tests of the filters transforming the traffic.
+//
+// Each fixture is a directory under the fixtures directory with the messages as files, all of
+// which are optional:
+//
+//	testdata/redact-email/
+//		request.headers    # One "name: value" per line. "#" starts a comment line.
+//		request.body
+//		request.trailers
+//		response.headers
+//		response.body
+//		response.trailers
+//		output.golden      # Written by -update.
+//
+// The golden file has the statuses returned by the hooks, the messages as the filter left them,
+// the local reply if any, and the calls recorded by [filtertest.Handle]. The test compares it with
+// the output of the filter, and writes it instead when run with -update:
+//
+//	func TestRedactor(t *testing.T) {
+//		factory, err := (&redactorFilterConfigFactory{}).Create(filtertest.NewConfigHandle(), config)
+//		require.NoError(t, err)
+//		golden.Run(t, "testdata/redactor", factory)
+//	}
+//
+//	go test -run TestRedactor -update
+package golden
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+)
+
+// continueTimeout is how long to wait for a stopped phase to be continued by the filter.
+const continueTimeout = 5 * time.Second
+
+const goldenFile = "output.golden"
+
+var update = flag.Bool("update", false, "write the golden files of the fixtures instead of comparing them")
+
+var (
+	headersStatuses = map[shared.HeadersStatus]string{
+		shared.HeadersStatusContinue:            "continue",
+		shared.HeadersStatusStop:                "stop",
+		shared.HeadersStatusStopAllAndBuffer:    "stop_all_and_buffer",
+		shared.HeadersStatusStopAllAndWatermark: "stop_all_and_watermark",
+	}
+	bodyStatuses = map[shared.BodyStatus]string{
+		shared.BodyStatusContinue:         "continue",
+		shared.BodyStatusStopAndBuffer:    "stop_and_buffer",
+		shared.BodyStatusStopAndWatermark: "stop_and_watermark",
+		shared.BodyStatusStopNoBuffer:     "stop_no_buffer",
+	}
+	trailersStatuses = map[shared.TrailersStatus]string{
+		shared.TrailersStatusContinue: "continue",
+		shared.TrailersStatusStop:     "stop",
+	}
+)
+
+type (
+	// message is a request or a response of a fixture. The fields are nil if the files don't exist.
+	message struct {
+		headers, body, trailers []byte
+	}
+	// output is what the filter did, as written to the golden file.
+	output struct {
+		bytes.Buffer
+	}
+)
+
+// Run runs a filter created by the factory over each fixture in dir, as a subtest named after the
+// fixture, and compares the output with the golden file of the fixture. With -update, the golden
+// files are written instead.
+func Run(t *testing.T, dir string, factory shared.HttpFilterFactory) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read the fixtures: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		fixture := filepath.Join(dir, entry.Name())
+		t.Run(entry.Name(), func(t *testing.T) {
+			got := runFixture(t, fixture, factory)
+			path := filepath.Join(fixture, goldenFile)
+			if *update {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatalf("failed to write the golden file: %v", err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read the golden file, run with -update to create it: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("the output differs from %s, run with -update if the change is intended:\n%s",
+					path, diff(string(want), string(got)))
+			}
+		})
+	}
+}
+
+// runFixture runs the hooks in the order Envoy does, and returns the output.
+func runFixture(t *testing.T, dir string, factory shared.HttpFilterFactory) []byte {
+	t.Helper()
+	request := readMessage(t, dir, "request")
+	response := readMessage(t, dir, "response")
+	h := filtertest.NewHandle()
+	h.RequestHeaderMap = filtertest.NewHeaderMap(parseHeaders(t, request.headers)...)
+	h.RequestBody = filtertest.NewBodyBuffer(request.body)
+	h.RequestTrailerMap = filtertest.NewHeaderMap(parseHeaders(t, request.trailers)...)
+	h.ResponseHeaderMap = filtertest.NewHeaderMap(parseHeaders(t, response.headers)...)
+	h.ResponseBody = filtertest.NewBodyBuffer(response.body)
+	h.ResponseTrailerMap = filtertest.NewHeaderMap(parseHeaders(t, response.trailers)...)
+	var out output
+
+	var filter shared.HttpFilter
+	h.Do(func() { filter = factory.Create(h) })
+	stopped := runPhase(h, &out, "request", filter.OnRequestHeaders, filter.OnRequestBody, filter.OnRequestTrailers,
+		h.RequestHeaderMap, h.RequestBody, h.RequestTrailerMap, request)
+	if stopped && h.LocalResponse() == nil &&
+		!h.Await(continueTimeout, func() bool { return h.ContinueRequestCount() > 0 || h.LocalResponse() != nil }) {
+		t.Fatalf("the request was stopped and not continued in %s", continueTimeout)
+	}
+	if h.LocalResponse() == nil {
+		stopped = runPhase(h, &out, "response", filter.OnResponseHeaders, filter.OnResponseBody, filter.OnResponseTrailers,
+			h.ResponseHeaderMap, h.ResponseBody, h.ResponseTrailerMap, response)
+		if stopped && h.LocalResponse() == nil &&
+			!h.Await(continueTimeout, func() bool { return h.ContinueResponseCount() > 0 || h.LocalResponse() != nil }) {
+			t.Fatalf("the response was stopped and not continued in %s", continueTimeout)
+		}
+	}
+	h.Wait()
+	h.Do(filter.OnStreamComplete)
+
+	out.headers("request headers", h.RequestHeaderMap)
+	out.body("request body", h.RequestBody)
+	out.headers("request trailers", h.RequestTrailerMap)
+	out.headers("response headers", h.ResponseHeaderMap)
+	out.body("response body", h.ResponseBody)
+	out.headers("response trailers", h.ResponseTrailerMap)
+	if local := h.LocalResponse(); local != nil {
+		out.section("local reply")
+		fmt.Fprintf(&out, "status: %d\ndetail: %s\n", local.Status, local.Detail)
+		for _, header := range local.Headers {
+			fmt.Fprintf(&out, "%s: %s\n", header[0], header[1])
+		}
+		out.bytes(local.Body)
+	}
+	if calls := h.Calls(); len(calls) > 0 {
+		out.section("calls")
+		for _, call := range calls {
+			fmt.Fprintln(&out, call)
+		}
+	}
+	return out.Bytes()
+}
+
+// runPhase calls the hooks of the request or the response with the messages of the fixture, and
+// returns whether the last hook stopped the iteration. The body is passed in a single chunk.
+func runPhase(h *filtertest.Handle, out *output, phase string,
+	onHeaders func(shared.HeaderMap, bool) shared.HeadersStatus,
+	onBody func(shared.BodyBuffer, bool) shared.BodyStatus,
+	onTrailers func(shared.HeaderMap) shared.TrailersStatus,
+	headers *filtertest.HeaderMap, body *filtertest.BodyBuffer, trailers *filtertest.HeaderMap, m message,
+) bool {
+	out.section(phase + " hooks")
+	var headersStatus shared.HeadersStatus
+	h.Do(func() { headersStatus = onHeaders(headers, m.body == nil && m.trailers == nil) })
+	fmt.Fprintf(out, "headers: %s\n", headersStatuses[headersStatus])
+	stopped := headersStatus != shared.HeadersStatusContinue
+	if m.body != nil && h.LocalResponse() == nil {
+		var bodyStatus shared.BodyStatus
+		h.Do(func() { bodyStatus = onBody(body, m.trailers == nil) })
+		fmt.Fprintf(out, "body: %s\n", bodyStatuses[bodyStatus])
+		stopped = bodyStatus != shared.BodyStatusContinue
+	}
+	if m.trailers != nil && h.LocalResponse() == nil {
+		var trailersStatus shared.TrailersStatus
+		h.Do(func() { trailersStatus = onTrailers(trailers) })
+		fmt.Fprintf(out, "trailers: %s\n", trailersStatuses[trailersStatus])
+		stopped = trailersStatus != shared.TrailersStatusContinue
+	}
+	return stopped
+}
+
+func readMessage(t *testing.T, dir, name string) message {
+	t.Helper()
+	read := func(ext string) []byte {
+		data, err := os.ReadFile(filepath.Join(dir, name+"."+ext))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			t.Fatalf("failed to read the fixture: %v", err)
+		}
+		// An empty file is an empty message rather than none.
+		if data == nil {
+			data = []byte{}
+		}
+		return data
+	}
+	return message{headers: read("headers"), body: read("body"), trailers: read("trailers")}
+}
+
+// parseHeaders parses the "name: value" lines. The pseudo-headers such as ":path" are supported.
+func parseHeaders(t *testing.T, data []byte) [][2]string {
+	t.Helper()
+	var headers [][2]string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The colon of a pseudo-header is part of the name.
+		name, value, ok := strings.Cut(line[1:], ":")
+		if !ok {
+			t.Fatalf("invalid header on line %d: %q", i+1, line)
+		}
+		headers = append(headers, [2]string{line[:1] + name, strings.TrimSpace(value)})
+	}
+	return headers
+}
+
+func (o *output) section(name string) {
+	fmt.Fprintf(o, "# %s\n", name)
+}
+
+func (o *output) headers(name string, headers *filtertest.HeaderMap) {
+	if len(headers.GetAll()) == 0 {
+		return
+	}
+	o.section(name)
+	for _, header := range headers.GetAll() {
+		fmt.Fprintf(o, "%s: %s\n", header[0], header[1])
+	}
+}
+
+func (o *output) body(name string, body *filtertest.BodyBuffer) {
+	if body.GetSize() == 0 {
+		return
+	}
+	o.section(name)
+	o.bytes(body.Bytes())
+}
+
+// bytes writes the data ending with a newline, so that the next section starts on its own line.
+func (o *output) bytes(data []byte) {
+	o.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		o.WriteString("\n")
+	}
+}
+
+// diff returns the lines of want and got from the first one that differs, which is usually enough
+// to tell what changed without a diff library.
+func diff(want, got string) string {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	i := 0
+	for i < len(wantLines) && i < len(gotLines) && wantLines[i] == gotLines[i] {
+		i++
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "first difference on line %d\n", i+1)
+	for j := i; j < min(i+10, len(wantLines)); j++ {
+		fmt.Fprintf(&b, "- %s\n", wantLines[j])
+	}
+	for j := i; j < min(i+10, len(gotLines)); j++ {
+		fmt.Fprintf(&b, "+ %s\n", gotLines[j])
+	}
+	return b.String()
+}
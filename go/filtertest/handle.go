@@ -0,0 +1,567 @@
+// Package filtertest provides fakes of the Envoy side of the Go SDK so that HTTP filters can be
+// exercised without running Envoy.
+//
+// [Handle] emulates the worker thread a filter runs on. Call the filter hooks via [Handle.Do] so
+// that they are serialized with the scheduled tasks and the callout callbacks as they are in Envoy.
+//
+// The handle also records the calls of the filter that have an effect, in order, so that a test
+// can read as the spec of the filter:
+//
+//	h.Do(func() { filter.OnRequestHeaders(h.RequestHeaderMap, true) })
+//	h.RequireLocalReply(t, http.StatusUnauthorized)
+//	h.RequireNoCall(t, "ContinueRequest")
+//
+// [Handle.Faults] injects the failures of Envoy, such as the header mutations having no effect, to
+// test that the filter degrades gracefully.
+package filtertest
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+type (
+	// Handle implements [shared.HttpFilterHandle].
+	//
+	// The exported fields are the inputs to the filter and can be set before the hooks are called.
+	// What the filter does through the handle is recorded and available via the accessor methods.
+	Handle struct {
+		RequestHeaderMap   *HeaderMap
+		RequestBody        *BodyBuffer
+		RequestTrailerMap  *HeaderMap
+		ResponseHeaderMap  *HeaderMap
+		ResponseBody       *BodyBuffer
+		ResponseTrailerMap *HeaderMap
+		// Metadata is keyed by the source, the namespace and then the key. SetMetadata writes to
+		// the dynamic source. Numbers are stored as float64 as Envoy does.
+		Metadata map[shared.MetadataSourceType]map[string]map[string]any
+		// FilterState is keyed by the filter state key.
+		FilterState map[string][]byte
+		// Attributes holds either a string or a number per attribute.
+		Attributes map[shared.AttributeID]any
+		// PerRouteConfig is returned by GetMostSpecificConfig.
+		PerRouteConfig any
+		// Config stores the metrics recorded by the filter. Metrics calls fail with
+		// [shared.MetricsNotFound] if this is nil.
+		Config *ConfigHandle
+		// CalloutHandler answers the HTTP callouts. HttpCallout fails with
+		// [shared.HttpCalloutInitClusterNotFound] if this is nil.
+		CalloutHandler func(callout Callout) (result shared.HttpCalloutResult, headers [][2]string, body []byte)
+		// Faults are the failures of Envoy injected into the filter. There are none by default.
+		Faults Faults
+
+		// worker serializes the hooks, the scheduled tasks, and the callout callbacks. It is
+		// shared by the handles of [NewHandles].
+		worker *sync.Mutex
+		// pending tracks the scheduled tasks and the callouts in flight.
+		pending sync.WaitGroup
+
+		mu                 sync.Mutex
+		data               map[string]any
+		localResponse      *LocalResponse
+		customFlags        []string
+		continueRequests   int
+		continueResponses  int
+		clearRouteCaches   int
+		callouts           []Callout
+		watermarkCallbacks shared.DownstreamWatermarkCallbacks
+		// recorder records the calls of the filter for [Handle.Calls].
+		recorder recorder
+	}
+
+	// LocalResponse is the response sent by the filter via SendLocalResponse or
+	// SendResponseHeaders, SendResponseData, and SendResponseTrailers.
+	LocalResponse struct {
+		Status   uint32
+		Headers  [][2]string
+		Body     []byte
+		Trailers [][2]string
+		Detail   string
+	}
+
+	// Callout is an HTTP callout made by the filter.
+	Callout struct {
+		Cluster   string
+		Headers   [][2]string
+		Body      []byte
+		TimeoutMs uint64
+	}
+
+	// scheduler implements [shared.Scheduler].
+	scheduler struct {
+		handle *Handle
+	}
+)
+
+var _ shared.HttpFilterHandle = (*Handle)(nil)
+
+// NewHandle creates a [Handle] with empty headers, bodies, and trailers.
+func NewHandle() *Handle {
+	h := &Handle{
+		RequestHeaderMap:   NewHeaderMap(),
+		RequestBody:        NewBodyBuffer(),
+		RequestTrailerMap:  NewHeaderMap(),
+		ResponseHeaderMap:  NewHeaderMap(),
+		ResponseBody:       NewBodyBuffer(),
+		ResponseTrailerMap: NewHeaderMap(),
+		Metadata:           make(map[shared.MetadataSourceType]map[string]map[string]any),
+		FilterState:        make(map[string][]byte),
+		Attributes:         make(map[shared.AttributeID]any),
+		data:               make(map[string]any),
+		worker:             &sync.Mutex{},
+	}
+	h.attachRecorder()
+	return h
+}
+
+// NewHandles creates n handles on the same emulated worker thread, as the filters of a stream
+// are in Envoy, so that the hooks and the tasks of all of them are serialized.
+func NewHandles(n int) []*Handle {
+	handles := make([]*Handle, n)
+	worker := &sync.Mutex{}
+	for i := range handles {
+		handles[i] = NewHandle()
+		handles[i].worker = worker
+	}
+	return handles
+}
+
+// Do runs f on the emulated worker thread.
+func (h *Handle) Do(f func()) {
+	h.worker.Lock()
+	defer h.worker.Unlock()
+	h.attachRecorder()
+	h.recorder.onWorker.Store(true)
+	defer h.recorder.onWorker.Store(false)
+	f()
+}
+
+// Wait blocks until all the scheduled tasks and the callouts in flight are done.
+func (h *Handle) Wait() {
+	h.pending.Wait()
+}
+
+// Await polls cond on the emulated worker thread until it returns true or the timeout elapses.
+// This is useful to wait for the tasks that are scheduled asynchronously, for example, after a
+// timer in a goroutine. Returns false on timeout.
+func (h *Handle) Await(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		var ok bool
+		h.Do(func() { ok = cond() })
+		if ok {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// LocalResponse returns the response sent by the filter, or nil if none was sent.
+func (h *Handle) LocalResponse() *LocalResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.localResponse
+}
+
+// CustomFlags returns the custom flags added by the filter.
+func (h *Handle) CustomFlags() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.customFlags)
+}
+
+// ContinueRequestCount returns the number of ContinueRequest calls.
+func (h *Handle) ContinueRequestCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.continueRequests
+}
+
+// ContinueResponseCount returns the number of ContinueResponse calls.
+func (h *Handle) ContinueResponseCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.continueResponses
+}
+
+// ClearRouteCacheCount returns the number of ClearRouteCache calls.
+func (h *Handle) ClearRouteCacheCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.clearRouteCaches
+}
+
+// Callouts returns the HTTP callouts made by the filter.
+func (h *Handle) Callouts() []Callout {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.callouts)
+}
+
+// DynamicMetadata returns the dynamic metadata value, or nil if not found.
+func (h *Handle) DynamicMetadata(metadataNamespace, key string) any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Metadata[shared.MetadataSourceTypeDynamic][metadataNamespace][key]
+}
+
+// GetMetadataString implements [shared.HttpFilterHandle].
+func (h *Handle) GetMetadataString(source shared.MetadataSourceType, metadataNamespace, key string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.Metadata[source][metadataNamespace][key].(string)
+	return v, ok
+}
+
+// GetMetadataNumber implements [shared.HttpFilterHandle].
+func (h *Handle) GetMetadataNumber(source shared.MetadataSourceType, metadataNamespace, key string) (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return toFloat64(h.Metadata[source][metadataNamespace][key])
+}
+
+// SetMetadata implements [shared.HttpFilterHandle].
+func (h *Handle) SetMetadata(metadataNamespace, key string, value any) {
+	h.recorder.record("SetMetadata", metadataNamespace, key, value)
+	if f, ok := toFloat64(value); ok {
+		value = f
+	} else if _, ok := value.(string); !ok {
+		// Envoy ignores the other types.
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	namespaces := h.Metadata[shared.MetadataSourceTypeDynamic]
+	if namespaces == nil {
+		namespaces = make(map[string]map[string]any)
+		h.Metadata[shared.MetadataSourceTypeDynamic] = namespaces
+	}
+	if namespaces[metadataNamespace] == nil {
+		namespaces[metadataNamespace] = make(map[string]any)
+	}
+	namespaces[metadataNamespace][key] = value
+}
+
+// GetFilterState implements [shared.HttpFilterHandle].
+func (h *Handle) GetFilterState(key string) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.FilterState[key]
+	return v, ok
+}
+
+// SetFilterState implements [shared.HttpFilterHandle].
+func (h *Handle) SetFilterState(key string, value []byte) {
+	h.recorder.record("SetFilterState", key, bytes.Clone(value))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.FilterState[key] = bytes.Clone(value)
+}
+
+// GetAttributeString implements [shared.HttpFilterHandle].
+func (h *Handle) GetAttributeString(attributeID shared.AttributeID) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.Attributes[attributeID].(string)
+	return v, ok
+}
+
+// GetAttributeNumber implements [shared.HttpFilterHandle].
+func (h *Handle) GetAttributeNumber(attributeID shared.AttributeID) (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return toFloat64(h.Attributes[attributeID])
+}
+
+// GetData implements [shared.HttpFilterHandle].
+func (h *Handle) GetData(key string) any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.data[key]
+}
+
+// SetData implements [shared.HttpFilterHandle].
+func (h *Handle) SetData(key string, value any) {
+	h.recorder.record("SetData", key, value)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.data[key] = value
+}
+
+// SendLocalResponse implements [shared.HttpFilterHandle].
+func (h *Handle) SendLocalResponse(status uint32, headers [][2]string, body []byte, detail string) {
+	h.recorder.record("SendLocalResponse", status, slices.Clone(headers), bytes.Clone(body), detail)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.localResponse = &LocalResponse{
+		Status:  status,
+		Headers: slices.Clone(headers),
+		Body:    bytes.Clone(body),
+		Detail:  detail,
+	}
+}
+
+// SendResponseHeaders implements [shared.HttpFilterHandle].
+func (h *Handle) SendResponseHeaders(headers [][2]string, endOfStream bool) {
+	h.recorder.record("SendResponseHeaders", slices.Clone(headers), endOfStream)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.localResponse = &LocalResponse{Headers: slices.Clone(headers)}
+	for _, header := range headers {
+		if header[0] == ":status" {
+			var status uint32
+			_, _ = fmt.Sscan(header[1], &status)
+			h.localResponse.Status = status
+		}
+	}
+}
+
+// SendResponseData implements [shared.HttpFilterHandle].
+func (h *Handle) SendResponseData(body []byte, endOfStream bool) {
+	h.recorder.record("SendResponseData", bytes.Clone(body), endOfStream)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.localResponse == nil {
+		h.localResponse = &LocalResponse{}
+	}
+	h.localResponse.Body = append(h.localResponse.Body, body...)
+}
+
+// SendResponseTrailers implements [shared.HttpFilterHandle].
+func (h *Handle) SendResponseTrailers(trailers [][2]string) {
+	h.recorder.record("SendResponseTrailers", slices.Clone(trailers))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.localResponse == nil {
+		h.localResponse = &LocalResponse{}
+	}
+	h.localResponse.Trailers = slices.Clone(trailers)
+}
+
+// AddCustomFlag implements [shared.HttpFilterHandle].
+func (h *Handle) AddCustomFlag(flag string) {
+	h.recorder.record("AddCustomFlag", flag)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.customFlags = append(h.customFlags, flag)
+}
+
+// ContinueRequest implements [shared.HttpFilterHandle].
+func (h *Handle) ContinueRequest() {
+	h.recorder.record("ContinueRequest")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.continueRequests++
+}
+
+// ContinueResponse implements [shared.HttpFilterHandle].
+func (h *Handle) ContinueResponse() {
+	h.recorder.record("ContinueResponse")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.continueResponses++
+}
+
+// ClearRouteCache implements [shared.HttpFilterHandle].
+func (h *Handle) ClearRouteCache() {
+	h.recorder.record("ClearRouteCache")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clearRouteCaches++
+}
+
+// RequestHeaders implements [shared.HttpFilterHandle].
+func (h *Handle) RequestHeaders() shared.HeaderMap { return h.RequestHeaderMap }
+
+// BufferedRequestBody implements [shared.HttpFilterHandle].
+func (h *Handle) BufferedRequestBody() shared.BodyBuffer { return h.RequestBody }
+
+// RequestTrailers implements [shared.HttpFilterHandle].
+func (h *Handle) RequestTrailers() shared.HeaderMap { return h.RequestTrailerMap }
+
+// ResponseHeaders implements [shared.HttpFilterHandle].
+func (h *Handle) ResponseHeaders() shared.HeaderMap { return h.ResponseHeaderMap }
+
+// BufferedResponseBody implements [shared.HttpFilterHandle].
+func (h *Handle) BufferedResponseBody() shared.BodyBuffer { return h.ResponseBody }
+
+// ResponseTrailers implements [shared.HttpFilterHandle].
+func (h *Handle) ResponseTrailers() shared.HeaderMap { return h.ResponseTrailerMap }
+
+// GetMostSpecificConfig implements [shared.HttpFilterHandle].
+func (h *Handle) GetMostSpecificConfig() any { return h.PerRouteConfig }
+
+// GetScheduler implements [shared.HttpFilterHandle]. It returns nil with [Faults.NilScheduler].
+func (h *Handle) GetScheduler() shared.Scheduler {
+	if h.Faults.NilScheduler {
+		return nil
+	}
+	return &scheduler{handle: h}
+}
+
+// Log implements [shared.HttpFilterHandle].
+func (h *Handle) Log(level shared.LogLevel, format string, args ...any) {
+	h.recorder.record("Log", level, fmt.Sprintf(format, args...))
+	log.Printf("[%s] %s", logLevelName(level), fmt.Sprintf(format, args...))
+}
+
+// HttpCallout implements [shared.HttpFilterHandle].
+//
+// The callout is answered by CalloutHandler on a goroutine, and the callback is invoked on the
+// emulated worker thread.
+func (h *Handle) HttpCallout(cluster string, headers [][2]string, body []byte, timeoutMs uint64,
+	cb shared.HttpCalloutCallback,
+) (shared.HttpCalloutInitResult, uint64) {
+	callout := Callout{Cluster: cluster, Headers: slices.Clone(headers), Body: bytes.Clone(body), TimeoutMs: timeoutMs}
+	h.recorder.record("HttpCallout", callout.Cluster, callout.Headers, callout.Body, timeoutMs)
+	h.mu.Lock()
+	h.callouts = append(h.callouts, callout)
+	calloutID := uint64(len(h.callouts))
+	handler := h.CalloutHandler
+	h.mu.Unlock()
+	if handler == nil {
+		return shared.HttpCalloutInitClusterNotFound, 0
+	}
+	h.pending.Add(1)
+	go func() {
+		defer h.pending.Done()
+		result, respHeaders, respBody := handler(callout)
+		h.Do(func() { cb.OnHttpCalloutDone(calloutID, result, respHeaders, [][]byte{respBody}) })
+	}()
+	return shared.HttpCalloutInitSuccess, calloutID
+}
+
+// StartHttpStream implements [shared.HttpFilterHandle]. Streams are not supported by the fake.
+func (h *Handle) StartHttpStream(string, [][2]string, []byte, bool, uint64, shared.HttpStreamCallback) (shared.HttpCalloutInitResult, uint64) {
+	return shared.HttpCalloutInitClusterNotFound, 0
+}
+
+// SendHttpStreamData implements [shared.HttpFilterHandle].
+func (h *Handle) SendHttpStreamData(uint64, []byte, bool) bool { return false }
+
+// SendHttpStreamTrailers implements [shared.HttpFilterHandle].
+func (h *Handle) SendHttpStreamTrailers(uint64, [][2]string) bool { return false }
+
+// ResetHttpStream implements [shared.HttpFilterHandle].
+func (h *Handle) ResetHttpStream(uint64) {}
+
+// SetDownstreamWatermarkCallbacks implements [shared.HttpFilterHandle].
+func (h *Handle) SetDownstreamWatermarkCallbacks(callbacks shared.DownstreamWatermarkCallbacks) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watermarkCallbacks = callbacks
+}
+
+// ClearDownstreamWatermarkCallbacks implements [shared.HttpFilterHandle].
+func (h *Handle) ClearDownstreamWatermarkCallbacks() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watermarkCallbacks = nil
+}
+
+// RecordHistogramValue implements [shared.HttpFilterHandle].
+func (h *Handle) RecordHistogramValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.record("RecordHistogramValue", id, value, tagsValues)
+	if h.Config == nil {
+		return shared.MetricsNotFound
+	}
+	return h.Config.record(id, metricKindHistogram, tagsValues, func(m *metric, key string) {
+		m.samples[key] = append(m.samples[key], value)
+	})
+}
+
+// SetGaugeValue implements [shared.HttpFilterHandle].
+func (h *Handle) SetGaugeValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.record("SetGaugeValue", id, value, tagsValues)
+	if h.Config == nil {
+		return shared.MetricsNotFound
+	}
+	return h.Config.record(id, metricKindGauge, tagsValues, func(m *metric, key string) {
+		m.values[key] = value
+	})
+}
+
+// IncrementGaugeValue implements [shared.HttpFilterHandle].
+func (h *Handle) IncrementGaugeValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.record("IncrementGaugeValue", id, value, tagsValues)
+	if h.Config == nil {
+		return shared.MetricsNotFound
+	}
+	return h.Config.record(id, metricKindGauge, tagsValues, func(m *metric, key string) {
+		m.values[key] += value
+	})
+}
+
+// DecrementGaugeValue implements [shared.HttpFilterHandle].
+func (h *Handle) DecrementGaugeValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.record("DecrementGaugeValue", id, value, tagsValues)
+	if h.Config == nil {
+		return shared.MetricsNotFound
+	}
+	return h.Config.record(id, metricKindGauge, tagsValues, func(m *metric, key string) {
+		m.values[key] -= value
+	})
+}
+
+// IncrementCounterValue implements [shared.HttpFilterHandle].
+func (h *Handle) IncrementCounterValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.record("IncrementCounterValue", id, value, tagsValues)
+	if h.Config == nil {
+		return shared.MetricsNotFound
+	}
+	return h.Config.record(id, metricKindCounter, tagsValues, func(m *metric, key string) {
+		m.values[key] += value
+	})
+}
+
+// Schedule implements [shared.Scheduler]. The task runs on the emulated worker thread after the
+// current hook returns.
+func (s *scheduler) Schedule(task func()) {
+	s.handle.recorder.record("Schedule")
+	s.handle.pending.Add(1)
+	go func() {
+		defer s.handle.pending.Done()
+		s.handle.Do(task)
+	}()
+}
+
+// toFloat64 converts the numeric value to float64.
+func toFloat64(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
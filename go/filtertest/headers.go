@@ -0,0 +1,120 @@
+package filtertest
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// HeaderMap implements [shared.HeaderMap] on top of an ordered list of headers.
+//
+// Keys are lower-cased as Envoy does, so lookups are case-insensitive.
+type HeaderMap struct {
+	headers [][2]string
+	// recorder records the mutations as the calls of name, if set by the handle.
+	recorder *recorder
+	name     string
+	// faults are the faults of the handle, if set by the handle.
+	faults *Faults
+}
+
+var _ shared.HeaderMap = (*HeaderMap)(nil)
+
+// NewHeaderMap creates a [HeaderMap] with the given headers.
+func NewHeaderMap(headers ...[2]string) *HeaderMap {
+	m := &HeaderMap{}
+	for _, h := range headers {
+		m.add(h[0], h[1])
+	}
+	return m
+}
+
+// HeadersFromMap converts a map to a list of headers sorted by key.
+func HeadersFromMap(headers map[string]string) [][2]string {
+	ret := make([][2]string, 0, len(headers))
+	for k, v := range headers {
+		ret = append(ret, [2]string{k, v})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i][0] < ret[j][0] })
+	return ret
+}
+
+// Get implements [shared.HeaderMap].
+func (m *HeaderMap) Get(key string) []string {
+	key = strings.ToLower(key)
+	var values []string
+	for _, h := range m.headers {
+		if h[0] == key {
+			values = append(values, h[1])
+		}
+	}
+	return values
+}
+
+// GetOne implements [shared.HeaderMap].
+func (m *HeaderMap) GetOne(key string) string {
+	key = strings.ToLower(key)
+	for _, h := range m.headers {
+		if h[0] == key {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// GetAll implements [shared.HeaderMap].
+func (m *HeaderMap) GetAll() [][2]string {
+	ret := make([][2]string, len(m.headers))
+	copy(ret, m.headers)
+	return ret
+}
+
+// Set implements [shared.HeaderMap].
+func (m *HeaderMap) Set(key, value string) {
+	m.recorder.record(m.name+".Set", key, value)
+	if m.faults.headerMutations() {
+		return
+	}
+	m.remove(key)
+	m.add(key, value)
+}
+
+// Add implements [shared.HeaderMap].
+func (m *HeaderMap) Add(key, value string) {
+	m.recorder.record(m.name+".Add", key, value)
+	if m.faults.headerMutations() {
+		return
+	}
+	m.add(key, value)
+}
+
+// Remove implements [shared.HeaderMap].
+func (m *HeaderMap) Remove(key string) {
+	m.recorder.record(m.name+".Remove", key)
+	if m.faults.headerMutations() {
+		return
+	}
+	m.remove(key)
+}
+
+func (m *HeaderMap) add(key, value string) {
+	m.headers = append(m.headers, [2]string{strings.ToLower(key), value})
+}
+
+func (m *HeaderMap) remove(key string) {
+	key = strings.ToLower(key)
+	m.headers = slices.DeleteFunc(m.headers, func(h [2]string) bool { return h[0] == key })
+}
+
+// Map returns the headers as a map. Only the first value is kept for repeated keys.
+func (m *HeaderMap) Map() map[string]string {
+	ret := make(map[string]string, len(m.headers))
+	for _, h := range m.headers {
+		if _, ok := ret[h[0]]; !ok {
+			ret[h[0]] = h[1]
+		}
+	}
+	return ret
+}
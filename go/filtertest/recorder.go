@@ -0,0 +1,197 @@
+package filtertest
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type (
+	// Call is a call made by the filter that has an effect, such as a header set or a local reply.
+	Call struct {
+		// Method is the method name. The methods of the header maps and the bodies are prefixed
+		// with the accessor of the handle returning them, such as "RequestHeaders.Set" or
+		// "ResponseBody.Append".
+		Method string
+		// Args are the arguments as passed, other than the callbacks.
+		Args []any
+	}
+
+	// recorder records the calls in order.
+	recorder struct {
+		mu    sync.Mutex
+		calls []Call
+		// offWorker are the calls made off the emulated worker thread.
+		offWorker []Call
+		// onWorker is set while a function runs via [Handle.Do].
+		onWorker atomic.Bool
+	}
+)
+
+// String returns the call as in the code, for the failure messages.
+func (c Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		switch arg := arg.(type) {
+		case string, []byte:
+			args[i] = fmt.Sprintf("%q", arg)
+		default:
+			args[i] = fmt.Sprintf("%v", arg)
+		}
+	}
+	return c.Method + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (r *recorder) record(method string, args ...any) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call := Call{Method: method, Args: args}
+	r.calls = append(r.calls, call)
+	// The scheduler is the one thing meant to be used from the goroutines.
+	if method != "Schedule" && !r.onWorker.Load() {
+		r.offWorker = append(r.offWorker, call)
+	}
+}
+
+// attachRecorder makes the header maps and the bodies of the handle record their mutations and
+// fail with the faults of the handle, in case they were replaced after NewHandle.
+func (h *Handle) attachRecorder() {
+	for _, m := range []struct {
+		headers *HeaderMap
+		name    string
+	}{
+		{h.RequestHeaderMap, "RequestHeaders"},
+		{h.RequestTrailerMap, "RequestTrailers"},
+		{h.ResponseHeaderMap, "ResponseHeaders"},
+		{h.ResponseTrailerMap, "ResponseTrailers"},
+	} {
+		if m.headers != nil {
+			m.headers.recorder, m.headers.name, m.headers.faults = &h.recorder, m.name, &h.Faults
+		}
+	}
+	if h.RequestBody != nil {
+		h.RequestBody.recorder, h.RequestBody.name, h.RequestBody.faults = &h.recorder, "RequestBody", &h.Faults
+	}
+	if h.ResponseBody != nil {
+		h.ResponseBody.recorder, h.ResponseBody.name, h.ResponseBody.faults = &h.recorder, "ResponseBody", &h.Faults
+	}
+}
+
+// Calls returns the calls with an effect made by the filter so far, in order. The reads, such as
+// the header gets, are not recorded. The header maps and the bodies of the handle record their
+// mutations only when the hooks are called via [Handle.Do].
+func (h *Handle) Calls() []Call {
+	h.recorder.mu.Lock()
+	defer h.recorder.mu.Unlock()
+	return slices.Clone(h.recorder.calls)
+}
+
+// ResetCalls forgets the calls recorded so far, for example, the ones of the request phase before
+// asserting the response phase.
+func (h *Handle) ResetCalls() {
+	h.recorder.mu.Lock()
+	defer h.recorder.mu.Unlock()
+	h.recorder.calls, h.recorder.offWorker = nil, nil
+}
+
+// OffWorkerCalls returns the calls made off the emulated worker thread, that is, not from a hook
+// called via [Handle.Do] or a scheduled task. Envoy's handle must only be used on the worker
+// thread, so any of them is a bug of the filter, typically a goroutine using the handle rather
+// than the scheduler. The detection is best effort: a call from a goroutine while a hook runs
+// is not told apart.
+func (h *Handle) OffWorkerCalls() []Call {
+	h.recorder.mu.Lock()
+	defer h.recorder.mu.Unlock()
+	return slices.Clone(h.recorder.offWorker)
+}
+
+// RequireCall fails the test unless the filter made the call with the arguments. Fewer arguments
+// than the call has match any of the rest.
+func (h *Handle) RequireCall(t testing.TB, method string, args ...any) {
+	t.Helper()
+	for _, call := range h.Calls() {
+		if call.Method == method && len(args) <= len(call.Args) && reflect.DeepEqual(args, call.Args[:len(args)]) {
+			return
+		}
+	}
+	t.Fatalf("expected call %s, got:\n%s", Call{Method: method, Args: args}, h.formatCalls())
+}
+
+// RequireNoCall fails the test if the filter called the method.
+func (h *Handle) RequireNoCall(t testing.TB, method string) {
+	t.Helper()
+	for _, call := range h.Calls() {
+		if call.Method == method {
+			t.Fatalf("unexpected call %s, got:\n%s", call, h.formatCalls())
+		}
+	}
+}
+
+// RequireCallOrder fails the test unless the filter called the methods in the order, not
+// necessarily next to each other.
+func (h *Handle) RequireCallOrder(t testing.TB, methods ...string) {
+	t.Helper()
+	next := 0
+	for _, call := range h.Calls() {
+		if next < len(methods) && call.Method == methods[next] {
+			next++
+		}
+	}
+	if next < len(methods) {
+		t.Fatalf("expected the calls %s in order, missing %s, got:\n%s", strings.Join(methods, ", "), methods[next], h.formatCalls())
+	}
+}
+
+// RequireHeaderSet fails the test unless the filter set or added the header to the value in any of
+// the header maps. The name is case-insensitive as in Envoy.
+func (h *Handle) RequireHeaderSet(t testing.TB, name, value string) {
+	t.Helper()
+	name = strings.ToLower(name)
+	for _, call := range h.Calls() {
+		if (strings.HasSuffix(call.Method, ".Set") || strings.HasSuffix(call.Method, ".Add")) &&
+			strings.ToLower(call.Args[0].(string)) == name && call.Args[1] == value {
+			return
+		}
+	}
+	t.Fatalf("expected the header %s: %s to be set, got:\n%s", name, value, h.formatCalls())
+}
+
+// RequireLocalReply fails the test unless the filter sent a local response with the status, and
+// returns the response for the further checks.
+func (h *Handle) RequireLocalReply(t testing.TB, status uint32) *LocalResponse {
+	t.Helper()
+	resp := h.LocalResponse()
+	if resp == nil {
+		t.Fatalf("expected a local reply with status %d, got none; calls:\n%s", status, h.formatCalls())
+	}
+	if resp.Status != status {
+		t.Fatalf("expected a local reply with status %d, got %d (%s)", status, resp.Status, resp.Detail)
+	}
+	return resp
+}
+
+// RequireNoLocalReply fails the test if the filter sent a local response.
+func (h *Handle) RequireNoLocalReply(t testing.TB) {
+	t.Helper()
+	if resp := h.LocalResponse(); resp != nil {
+		t.Fatalf("unexpected local reply with status %d (%s)", resp.Status, resp.Detail)
+	}
+}
+
+func (h *Handle) formatCalls() string {
+	var b strings.Builder
+	for _, call := range h.Calls() {
+		b.WriteString("\t" + call.String() + "\n")
+	}
+	if b.Len() == 0 {
+		return "\t(none)\n"
+	}
+	return b.String()
+}
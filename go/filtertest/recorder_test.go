@@ -0,0 +1,77 @@
+package filtertest
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeTB records the failure of a helper, and stops the helper as t.Fatalf does.
+type fakeTB struct {
+	testing.TB
+	failure string
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Fatalf(format string, args ...any) {
+	f.failure = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+// requireFailure fails the test unless the helper failed with a message containing want.
+func requireFailure(t *testing.T, want string, helper func(tb testing.TB)) {
+	t.Helper()
+	tb := &fakeTB{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		helper(tb)
+	}()
+	<-done
+	if tb.failure == "" {
+		t.Fatalf("the helper passed, want a failure with %q", want)
+	}
+	if !strings.Contains(tb.failure, want) {
+		t.Fatalf("the helper failed with %q, want %q", tb.failure, want)
+	}
+}
+
+func TestRequireHeaderSet(t *testing.T) {
+	h := NewHandle()
+	h.RequestHeaderMap = NewHeaderMap([2]string{"x-input", "1"})
+	h.Do(func() {
+		h.RequestHeaderMap.Set("X-Set", "a")
+		h.ResponseHeaderMap.Add("x-added", "b")
+		h.ResponseHeaderMap.Remove("x-removed")
+	})
+
+	h.RequireHeaderSet(t, "x-set", "a")
+	h.RequireHeaderSet(t, "X-Added", "b")
+	requireFailure(t, "expected the header x-set: b to be set", func(tb testing.TB) { h.RequireHeaderSet(tb, "x-set", "b") })
+	// The headers of the inputs and the removed ones were not set by the filter.
+	requireFailure(t, "expected the header x-input: 1 to be set", func(tb testing.TB) { h.RequireHeaderSet(tb, "x-input", "1") })
+	requireFailure(t, "expected the header x-removed: ", func(tb testing.TB) { h.RequireHeaderSet(tb, "x-removed", "") })
+}
+
+func TestRequireLocalReply(t *testing.T) {
+	h := NewHandle()
+	h.RequireNoLocalReply(t)
+	requireFailure(t, "expected a local reply with status 403, got none", func(tb testing.TB) {
+		h.RequireLocalReply(tb, http.StatusForbidden)
+	})
+
+	h.Do(func() {
+		h.SendLocalResponse(http.StatusForbidden, [][2]string{{"content-type", "text/plain"}}, []byte("Forbidden\n"), "denied")
+	})
+	resp := h.RequireLocalReply(t, http.StatusForbidden)
+	if string(resp.Body) != "Forbidden\n" || resp.Detail != "denied" {
+		t.Fatalf("RequireLocalReply returned the body %q and the detail %q", resp.Body, resp.Detail)
+	}
+	requireFailure(t, "expected a local reply with status 401, got 403 (denied)", func(tb testing.TB) {
+		h.RequireLocalReply(tb, http.StatusUnauthorized)
+	})
+	requireFailure(t, "unexpected local reply with status 403 (denied)", func(tb testing.TB) { h.RequireNoLocalReply(tb) })
+}
@@ -0,0 +1,238 @@
+// Package replay feeds a stream recorded in Envoy by the record package back into an HTTP filter,
+// so that a bug only seen on the live traffic can be reproduced and fixed in a unit test:
+//
+//	func TestRedactorRecording(t *testing.T) {
+//		replay.Run(t, &redactorFilterConfigFactory{}, "testdata/redactor-1719835200.json")
+//	}
+//
+// The filter is created from the recorded config with [filtertest.Handle], and the hooks are
+// called with the recorded inputs in order. The values the filter read from Envoy in each event,
+// such as the attributes, are set on the handle before it. The recorded callout responses answer
+// the callouts in order.
+//
+// The test fails at the first hook whose status or whose calls differ from the recording, with
+// the calls of the hook and of the asynchronous work that followed it compared as a whole. The
+// logs, the metrics, and SetData are not compared, as they often carry the times and the other
+// values that differ on each run.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/record"
+)
+
+// asyncTimeout is how long to wait for the asynchronous work that followed a hook in the recording,
+// such as a task scheduled after a timer, to make its calls.
+const asyncTimeout = 5 * time.Second
+
+// ignoredMethods are the calls not compared with the recording.
+var ignoredMethods = map[string]bool{
+	"Log":                   true,
+	"SetData":               true,
+	"Schedule":              true,
+	"RecordHistogramValue":  true,
+	"SetGaugeValue":         true,
+	"IncrementGaugeValue":   true,
+	"DecrementGaugeValue":   true,
+	"IncrementCounterValue": true,
+}
+
+// Run replays the recording in the file into a filter created by the factory.
+func Run(t *testing.T, factory shared.HttpFilterConfigFactory, path string) {
+	t.Helper()
+	recording, err := record.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configHandle := filtertest.NewConfigHandle()
+	filterFactory, err := factory.Create(configHandle, []byte(recording.Config))
+	if err != nil {
+		t.Fatalf("failed to create the filter of %s from the recorded config: %v", recording.Filter, err)
+	}
+
+	h := filtertest.NewHandle()
+	h.Config = configHandle
+	var calloutsMu sync.Mutex
+	var callouts []record.Event
+	for _, event := range recording.Events {
+		if event.Hook == record.EventHttpCalloutDone {
+			callouts = append(callouts, event)
+		}
+	}
+	h.CalloutHandler = func(filtertest.Callout) (shared.HttpCalloutResult, [][2]string, []byte) {
+		calloutsMu.Lock()
+		defer calloutsMu.Unlock()
+		if len(callouts) == 0 {
+			return shared.HttpCalloutReset, nil, nil
+		}
+		event := callouts[0]
+		callouts = callouts[1:]
+		return event.CalloutResult, event.Headers, bytes.Join(event.Body, nil)
+	}
+	filter := filterFactory.Create(h)
+
+	events := recording.Events
+	for len(events) > 0 {
+		hook := events[0]
+		// The asynchronous events that follow the hook are compared together with it.
+		next := 1
+		for next < len(events) && isAsync(events[next].Hook) {
+			next++
+		}
+		segment := events[:next]
+		events = events[next:]
+		if isAsync(hook.Hook) {
+			continue
+		}
+
+		for _, event := range segment {
+			applyReads(h, event.Reads)
+		}
+		var want []record.Call
+		for _, event := range segment {
+			want = append(want, event.Calls...)
+		}
+		h.ResetCalls()
+		setInputs(h, hook)
+		var status int
+		h.Do(func() { status = callHook(t, filter, h, hook) })
+		if status != hook.Status {
+			t.Fatalf("%s returned the status %d, recorded %d", hook.Hook, status, hook.Status)
+		}
+		// A timeout leaves the missing calls to the comparison.
+		h.Await(asyncTimeout, func() bool { return countCalls(h.Calls()) >= countCalls(want) })
+		h.Wait()
+		wantCalls, gotCalls := formatCalls(t, want), formatCalls(t, h.Calls())
+		if wantCalls != gotCalls {
+			t.Fatalf("%s made different calls than recorded:\nrecorded:\n%s\nreplayed:\n%s", hook.Hook, wantCalls, gotCalls)
+		}
+	}
+}
+
+// isAsync returns true if the event is not a hook of the filter.
+func isAsync(hook string) bool {
+	return hook == record.EventScheduled || hook == record.EventHttpCalloutDone
+}
+
+// setInputs sets the recorded inputs of the hook on the handle. They are set before [Handle.Do],
+// which makes the new header maps and bodies record the calls.
+func setInputs(h *filtertest.Handle, event record.Event) {
+	switch event.Hook {
+	case "OnRequestHeaders":
+		h.RequestHeaderMap = filtertest.NewHeaderMap(event.Headers...)
+	case "OnRequestBody":
+		h.RequestBody = filtertest.NewBodyBuffer(event.Body...)
+	case "OnRequestTrailers":
+		h.RequestTrailerMap = filtertest.NewHeaderMap(event.Headers...)
+	case "OnResponseHeaders":
+		h.ResponseHeaderMap = filtertest.NewHeaderMap(event.Headers...)
+	case "OnResponseBody":
+		h.ResponseBody = filtertest.NewBodyBuffer(event.Body...)
+	case "OnResponseTrailers":
+		h.ResponseTrailerMap = filtertest.NewHeaderMap(event.Headers...)
+	}
+}
+
+// callHook calls the hook of the event with the inputs set by setInputs, and returns the status.
+func callHook(t *testing.T, filter shared.HttpFilter, h *filtertest.Handle, event record.Event) int {
+	switch event.Hook {
+	case "OnRequestHeaders":
+		return int(filter.OnRequestHeaders(h.RequestHeaderMap, event.EndOfStream))
+	case "OnRequestBody":
+		return int(filter.OnRequestBody(h.RequestBody, event.EndOfStream))
+	case "OnRequestTrailers":
+		return int(filter.OnRequestTrailers(h.RequestTrailerMap))
+	case "OnResponseHeaders":
+		return int(filter.OnResponseHeaders(h.ResponseHeaderMap, event.EndOfStream))
+	case "OnResponseBody":
+		return int(filter.OnResponseBody(h.ResponseBody, event.EndOfStream))
+	case "OnResponseTrailers":
+		return int(filter.OnResponseTrailers(h.ResponseTrailerMap))
+	case "OnStreamComplete":
+		filter.OnStreamComplete()
+		return 0
+	default:
+		t.Fatalf("unknown hook %q in the recording", event.Hook)
+		return 0
+	}
+}
+
+// applyReads sets the values the filter read from Envoy on the handle.
+func applyReads(h *filtertest.Handle, reads []record.Read) {
+	for _, read := range reads {
+		switch read.Method {
+		case "GetAttributeString", "GetAttributeNumber":
+			if !read.Found {
+				delete(h.Attributes, read.Attribute)
+			} else if read.Method == "GetAttributeString" {
+				h.Attributes[read.Attribute] = read.String
+			} else {
+				h.Attributes[read.Attribute] = read.Number
+			}
+		case "GetMetadataString", "GetMetadataNumber":
+			namespaces := h.Metadata[read.Source]
+			if namespaces == nil {
+				namespaces = make(map[string]map[string]any)
+				h.Metadata[read.Source] = namespaces
+			}
+			if namespaces[read.Namespace] == nil {
+				namespaces[read.Namespace] = make(map[string]any)
+			}
+			if !read.Found {
+				delete(namespaces[read.Namespace], read.Key)
+			} else if read.Method == "GetMetadataString" {
+				namespaces[read.Namespace][read.Key] = read.String
+			} else {
+				namespaces[read.Namespace][read.Key] = read.Number
+			}
+		case "GetFilterState":
+			if read.Found {
+				h.FilterState[read.Key] = read.Bytes
+			} else {
+				delete(h.FilterState, read.Key)
+			}
+		}
+	}
+}
+
+// countCalls returns the number of the compared calls.
+func countCalls[C record.Call | filtertest.Call](calls []C) int {
+	n := 0
+	for _, c := range calls {
+		if !ignoredMethods[record.Call(c).Method] {
+			n++
+		}
+	}
+	return n
+}
+
+// formatCalls formats the compared calls one per line, with the arguments as JSON so that the
+// recorded calls and the replayed ones are alike.
+func formatCalls[C record.Call | filtertest.Call](t *testing.T, calls []C) string {
+	var b strings.Builder
+	for _, c := range calls {
+		call := record.Call(c)
+		if ignoredMethods[call.Method] {
+			continue
+		}
+		args, err := json.Marshal(call.Args)
+		if err != nil {
+			t.Fatalf("failed to encode the arguments of %s: %v", call.Method, err)
+		}
+		fmt.Fprintf(&b, "\t%s%s\n", call.Method, args)
+	}
+	if b.Len() == 0 {
+		return "\t(none)\n"
+	}
+	return b.String()
+}
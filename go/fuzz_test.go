@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// The fuzz targets exercise the code handling the bytes from Envoy: the bodies over arbitrary
+// chunk layouts, the header values, and the configs. Run one with, for example:
+//
+//	go test -run '^$' -fuzz FuzzStreamRedactor -fuzztime 1m .
+
+// fuzzChunks splits data into the chunks of the lengths in layout, the last one taking the rest.
+// The zero lengths make empty chunks, which Envoy may hand over as well.
+func fuzzChunks(data, layout []byte) [][]byte {
+	var chunks [][]byte
+	for _, n := range layout {
+		n := min(int(n)%32, len(data))
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return append(chunks, data)
+}
+
+func FuzzStreamRedactor(f *testing.F) {
+	f.Add([]byte("mail alice@example.com or call 555-123-4567, SSN 123-45-6789"), []byte{5, 10, 1, 0, 20})
+	f.Add([]byte("AB 12 34 56 C and bob@example.org"), []byte{2, 2, 2, 2})
+	factory := &piiRedactionFilterFactory{}
+	for _, name := range []string{"email", "phone", "uk_nino", "us_ssn"} {
+		factory.detectors = append(factory.detectors, piiDetector{
+			name: name, re: regexp.MustCompile(piiDetectors[name]), mask: []byte("[" + strings.ToUpper(name) + "]"),
+		})
+	}
+	const maxMatchLength = 32
+	f.Fuzz(func(t *testing.T, data, layout []byte) {
+		// The matches longer than the limit may be split, as documented.
+		for _, r := range factory.find(data) {
+			if r.end-r.start > maxMatchLength {
+				t.Skip()
+			}
+		}
+		var want, got bytes.Buffer
+		whole := &streamRedactor{maxMatchLength: maxMatchLength, find: factory.find}
+		whole.Write(data, true, &want, func(string) {})
+		chunked := &streamRedactor{maxMatchLength: maxMatchLength, find: factory.find}
+		for _, chunk := range fuzzChunks(data, layout) {
+			chunked.Write(chunk, false, &got, func(string) {})
+		}
+		chunked.Write(nil, true, &got, func(string) {})
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("redacted in chunks %q, want %q", got.Bytes(), want.Bytes())
+		}
+	})
+}
+
+func FuzzHeaderValues(f *testing.F) {
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		`By=spiffe://a/b;Hash=abc;Subject="CN=x, O=\"y\"";URI=spiffe://c,By=d`,
+		"no-cache, max-age=60, private=\"set-cookie\"",
+		"fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5",
+		"Basic YWxpY2U6c2VjcmV0",
+	} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, v string) {
+		parseTraceParent(v)
+		parseXFCC(v)
+		parseCacheControl(v)
+		parseAcceptLanguage(v)
+		parseBasicAuth(v)
+	})
+}
+
+func FuzzBasicAuthRoundTrip(f *testing.F) {
+	f.Add("alice", "secret")
+	f.Add("", "pass:with:colons")
+	f.Fuzz(func(t *testing.T, user, password string) {
+		if strings.Contains(user, ":") {
+			t.Skip()
+		}
+		authorization := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+		gotUser, gotPassword, ok := parseBasicAuth(authorization)
+		if !ok || gotUser != user || gotPassword != password {
+			t.Fatalf("parseBasicAuth(%q) = %q, %q, %v", authorization, gotUser, gotPassword, ok)
+		}
+	})
+}
+
+func FuzzConfigs(f *testing.F) {
+	for _, v := range []string{
+		"",
+		"{}",
+		`{"max_request_bytes": 1024, "max_response_bytes": -1}`,
+		`[{"id": 1, "targets": ["body"], "phrases": ["a"], "severity": "critical"}]`,
+		`{"keys": [{"key": "k", "client": "c"}]}`,
+		"alice:$2y$05$abcdefghijklmnopqrstuu",
+		`{"flags": {"f": {"state": "ENABLED", "variants": {"on": true}, "defaultVariant": "on"}}}`,
+		"Content-Disposition: form-data; name=\"f\"; filename=\"a.txt\"\r\nContent-Type: text/plain\r\n",
+		"event: message\nid: 1\ndata: {\"a\": 1}\n",
+		"512MiB",
+	} {
+		f.Add([]byte(v))
+	}
+	logf := func(shared.LogLevel, string, ...any) {}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = parseBodyLimitConfig(data)
+		_, _ = parseSecurityHeadersConfig(data)
+		_, _ = parseRuleWAFRules(data, logf)
+		_, _ = parseAPIKeyFile(data, logf)
+		_, _ = parseHtpasswd(data, logf)
+		_, _ = parseFlagdDefinition(data)
+		_, _ = parseMultipartPartHeaders(data)
+		parseSSEEvent(data)
+		_, _ = parseMemoryLimit(string(data))
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+const (
+	geoIPDefaultCountryHeader  = "x-geo-country"
+	geoIPDefaultASNHeader      = "x-geo-asn"
+	geoIPDefaultReloadInterval = time.Minute
+)
+
+// geoIPDatabases holds the databases by path and reload interval so that all the filter configs
+// referring to the same file share a single copy, including the configs created by a listener
+// update. Databases are typically tens of megabytes, so loading them per config would multiply
+// the memory usage. The configs with another reload_interval_ms get their own copy so that each
+// config reloads at the interval it sets.
+//
+// As there is no hook to tell when the last config referring to a database is destroyed, the
+// databases are never released. A path that is no longer configured stays in memory until Envoy
+// restarts.
+var geoIPDatabases sync.Map // map[geoIPDatabaseKey]*reloadableFile[*maxminddb.Reader]
+
+// geoIPDatabaseKey is the key of [geoIPDatabases].
+type geoIPDatabaseKey struct {
+	path     string
+	interval time.Duration
+}
+
+type (
+	// geoIPFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	geoIPFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// geoIPFilterConfig is the JSON configuration of the GeoIP filter.
+	geoIPFilterConfig struct {
+		// Database is the path to the MaxMind DB with the country data, e.g. GeoLite2-Country.
+		Database string `json:"database" example:"./testdata/geoip.mmdb"`
+		// ASNDatabase is the path to the MaxMind DB with the ASN data, e.g. GeoLite2-ASN. If not
+		// set, the ASN is looked up in Database.
+		ASNDatabase string `json:"asn_database"`
+		// ReloadIntervalMs is how often the files are checked for changes. Defaults to 1 minute.
+		ReloadIntervalMs int `json:"reload_interval_ms"`
+		// CountryHeader and ASNHeader are the request headers set from the lookup results.
+		CountryHeader string `json:"country_header"`
+		ASNHeader     string `json:"asn_header"`
+		// BlockCountries are the ISO 3166-1 alpha-2 country codes rejected with 403.
+		BlockCountries []string `json:"block_countries"`
+		// BlockASNs are the autonomous system numbers rejected with 403.
+		BlockASNs []uint `json:"block_asns"`
+		// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For entries are trusted.
+		TrustedProxies []string `json:"trusted_proxies"`
+	}
+	// geoIPFilterFactory implements [shared.HttpFilterFactory].
+	geoIPFilterFactory struct {
+		config         geoIPFilterConfig
+		country, asn   *reloadableFile[*maxminddb.Reader]
+		trustedProxies *cidrSet
+		lookups        shared.MetricID
+		hasMetric      bool
+	}
+	// geoIPRecord is the subset of the GeoIP2 and GeoLite2 records used by the filter.
+	geoIPRecord struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		ASN uint `maxminddb:"autonomous_system_number"`
+	}
+	// geoIPFilter implements [shared.HttpFilter].
+	geoIPFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *geoIPFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *geoIPFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config geoIPFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse geoip config: %w", err)
+	}
+	if config.Database == "" {
+		return nil, fmt.Errorf("database must be set")
+	}
+	if config.CountryHeader == "" {
+		config.CountryHeader = geoIPDefaultCountryHeader
+	}
+	if config.ASNHeader == "" {
+		config.ASNHeader = geoIPDefaultASNHeader
+	}
+	for i, c := range config.BlockCountries {
+		config.BlockCountries[i] = strings.ToUpper(c)
+	}
+	reloadInterval := time.Duration(config.ReloadIntervalMs) * time.Millisecond
+	if reloadInterval <= 0 {
+		reloadInterval = geoIPDefaultReloadInterval
+	}
+
+	f := &geoIPFilterFactory{config: config}
+	var err error
+	if f.trustedProxies, err = newCIDRSet(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if f.country, err = loadGeoIPDatabase(config.Database, reloadInterval, handle.Log); err != nil {
+		return nil, err
+	}
+	f.asn = f.country
+	if config.ASNDatabase != "" {
+		if f.asn, err = loadGeoIPDatabase(config.ASNDatabase, reloadInterval, handle.Log); err != nil {
+			return nil, err
+		}
+	}
+	id, res := handle.DefineCounter("geoip_lookups_total", "result")
+	if res == shared.MetricsSuccess {
+		f.lookups, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the geoip counter: %v", res)
+	}
+	return f, nil
+}
+
+// loadGeoIPDatabase returns the shared database at path, loading it if this is the first config
+// referring to it with the interval.
+func loadGeoIPDatabase(path string, interval time.Duration, logf logFunc) (*reloadableFile[*maxminddb.Reader], error) {
+	key := geoIPDatabaseKey{path: path, interval: interval}
+	if db, ok := geoIPDatabases.Load(key); ok {
+		return db.(*reloadableFile[*maxminddb.Reader]), nil
+	}
+	db, err := newReloadableFile(path, interval, func(data []byte, _ logFunc) (*maxminddb.Reader, error) {
+		return maxminddb.OpenBytes(data)
+	}, logf)
+	if err != nil {
+		return nil, err
+	}
+	// Another config may have loaded the same file concurrently, in which case that copy is used.
+	actual, _ := geoIPDatabases.LoadOrStore(key, db)
+	return actual.(*reloadableFile[*maxminddb.Reader]), nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *geoIPFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &geoIPFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *geoIPFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	// The headers are only trusted when set by this filter.
+	headers.Remove(config.CountryHeader)
+	headers.Remove(config.ASNHeader)
+
+	addr, ok := clientAddr(p.handle, headers, p.factory.trustedProxies)
+	if !ok {
+		p.record("error")
+		return shared.HeadersStatusContinue
+	}
+	var country, asn geoIPRecord
+	if err := p.factory.country.Load(p.handle.Log).Lookup(addr).Decode(&country); err != nil {
+		p.handle.Log(shared.LogLevelWarn, "geoip country lookup of %s failed: %v", addr, err)
+		p.record("error")
+		return shared.HeadersStatusContinue
+	}
+	if err := p.factory.asn.Load(p.handle.Log).Lookup(addr).Decode(&asn); err != nil {
+		p.handle.Log(shared.LogLevelWarn, "geoip asn lookup of %s failed: %v", addr, err)
+		p.record("error")
+		return shared.HeadersStatusContinue
+	}
+
+	if slices.Contains(config.BlockCountries, country.Country.ISOCode) || slices.Contains(config.BlockASNs, asn.ASN) {
+		p.record("blocked")
+		p.handle.SendLocalResponse(http.StatusForbidden, [][2]string{{"Content-Type", "text/plain"}},
+			[]byte("Forbidden\n"), "geoip_blocked")
+		return shared.HeadersStatusStop
+	}
+	if country.Country.ISOCode == "" && asn.ASN == 0 {
+		p.record("not_found")
+		return shared.HeadersStatusContinue
+	}
+	if country.Country.ISOCode != "" {
+		headers.Set(config.CountryHeader, country.Country.ISOCode)
+	}
+	if asn.ASN != 0 {
+		headers.Set(config.ASNHeader, strconv.FormatUint(uint64(asn.ASN), 10))
+	}
+	p.record("found")
+	return shared.HeadersStatusContinue
+}
+
+func (p *geoIPFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.lookups, 1, result)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	grpcStatusDefaultOriginalTrailer = "x-grpc-original-status"
+	// grpcMessagePrefixLength is the length of the prefix of each gRPC message: the compressed
+	// flag and the 4-byte big-endian length.
+	grpcMessagePrefixLength = 5
+)
+
+// grpcStatusCodes are the gRPC status codes by name, which the config can use instead of the
+// numbers.
+var grpcStatusCodes = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           1,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   4,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   7,
+	"RESOURCE_EXHAUSTED":  8,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         14,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     16,
+}
+
+type (
+	// grpcStatusFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	grpcStatusFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// grpcStatusFilterConfig is the JSON configuration of the gRPC status filter.
+	grpcStatusFilterConfig struct {
+		// StatusMap rewrites the grpc-status the upstream sent to the one sent to the client, such
+		// as {"UNAVAILABLE": "RESOURCE_EXHAUSTED"} to tell the clients to back off rather than
+		// retry elsewhere. The codes are either the names or the numbers of the gRPC status codes.
+		StatusMap map[string]string `json:"status_map"`
+		// OriginalStatusTrailer is the trailer set to the grpc-status of the upstream when it is
+		// rewritten. Defaults to "x-grpc-original-status".
+		OriginalStatusTrailer string `json:"original_status_trailer"`
+		// MessageCountTrailer is the trailer set to the number of the messages of the response,
+		// such as "x-grpc-response-messages". The messages are not counted if empty.
+		MessageCountTrailer string `json:"message_count_trailer"`
+	}
+	// grpcStatusFilterFactory implements [shared.HttpFilterFactory].
+	grpcStatusFilterFactory struct {
+		// statusMap is StatusMap with the codes as the decimal strings of grpc-status.
+		statusMap             map[string]string
+		originalStatusTrailer string
+		messageCountTrailer   string
+		responses             shared.MetricID
+		hasMetric             bool
+	}
+	// grpcStatusFilter implements [shared.HttpFilter].
+	//
+	// The filter only acts on the gRPC requests. The grpc-status is in the response trailers, or in
+	// the response headers of a trailers-only response, which the upstreams send for the errors
+	// before any message. The response body is passed through as it streams, and only the length
+	// prefixes of the messages are read to count them.
+	grpcStatusFilter struct {
+		handle   shared.HttpFilterHandle
+		factory  *grpcStatusFilterFactory
+		grpc     bool
+		messages grpcMessageCounter
+		shared.EmptyHttpFilter
+	}
+	// grpcMessageCounter counts the length-prefixed messages of a gRPC stream, whose prefixes and
+	// messages may be split over any number of chunks.
+	grpcMessageCounter struct {
+		count     int
+		prefix    [grpcMessagePrefixLength]byte
+		prefixLen int
+		// remaining is the number of the bytes of the current message not yet seen.
+		remaining uint64
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *grpcStatusFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config grpcStatusFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse gRPC status config: %w", err)
+		}
+	}
+	f := &grpcStatusFilterFactory{
+		statusMap:             make(map[string]string, len(config.StatusMap)),
+		originalStatusTrailer: config.OriginalStatusTrailer,
+		messageCountTrailer:   config.MessageCountTrailer,
+	}
+	if f.originalStatusTrailer == "" {
+		f.originalStatusTrailer = grpcStatusDefaultOriginalTrailer
+	}
+	for from, to := range config.StatusMap {
+		fromCode, err := parseGRPCStatusCode(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status_map key: %w", err)
+		}
+		toCode, err := parseGRPCStatusCode(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status_map value of %s: %w", from, err)
+		}
+		f.statusMap[strconv.Itoa(fromCode)] = strconv.Itoa(toCode)
+	}
+	id, res := handle.DefineCounter("grpc_status_responses_total", "status", "rewritten")
+	if res == shared.MetricsSuccess {
+		f.responses, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the gRPC status counter: %v", res)
+	}
+	return f, nil
+}
+
+// parseGRPCStatusCode parses the name or the number of a gRPC status code.
+func parseGRPCStatusCode(s string) (int, error) {
+	if code, ok := grpcStatusCodes[strings.ToUpper(s)]; ok {
+		return code, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 0 || code > grpcStatusCodes["UNAUTHENTICATED"] {
+		return 0, fmt.Errorf("unknown gRPC status code %q", s)
+	}
+	return code, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *grpcStatusFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &grpcStatusFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *grpcStatusFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.grpc = strings.HasPrefix(headers.GetOne("content-type"), "application/grpc")
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *grpcStatusFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.grpc && endOfStream {
+		p.onStatus(headers)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *grpcStatusFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.grpc && p.factory.messageCountTrailer != "" {
+		for _, chunk := range body.GetChunks() {
+			p.messages.write(chunk)
+		}
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *grpcStatusFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.grpc {
+		p.onStatus(trailers)
+	}
+	return shared.TrailersStatusContinue
+}
+
+// onStatus rewrites the grpc-status of the trailers, or of the headers of a trailers-only
+// response, and sets the message count.
+func (p *grpcStatusFilter) onStatus(trailers shared.HeaderMap) {
+	status := strings.Clone(trailers.GetOne("grpc-status"))
+	rewritten := "false"
+	if to, ok := p.factory.statusMap[status]; ok && to != status {
+		trailers.Set("grpc-status", to)
+		trailers.Set(p.factory.originalStatusTrailer, status)
+		status, rewritten = to, "true"
+	}
+	if p.factory.messageCountTrailer != "" {
+		trailers.Set(p.factory.messageCountTrailer, strconv.Itoa(p.messages.count))
+	}
+	if p.factory.hasMetric && status != "" {
+		p.handle.IncrementCounterValue(p.factory.responses, 1, status, rewritten)
+	}
+}
+
+// write counts the messages starting in the chunk.
+func (c *grpcMessageCounter) write(chunk []byte) {
+	for len(chunk) > 0 {
+		if c.remaining > 0 {
+			n := min(uint64(len(chunk)), c.remaining)
+			chunk, c.remaining = chunk[n:], c.remaining-n
+			continue
+		}
+		n := copy(c.prefix[c.prefixLen:], chunk)
+		chunk, c.prefixLen = chunk[n:], c.prefixLen+n
+		if c.prefixLen == grpcMessagePrefixLength {
+			c.count++
+			c.remaining = uint64(binary.BigEndian.Uint32(c.prefix[1:]))
+			c.prefixLen = 0
+		}
+	}
+}
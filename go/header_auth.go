@@ -6,6 +6,9 @@ import (
 	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
 )
 
+// headerAuthFilters pools the header auth filters, as they have no state past the stream.
+var headerAuthFilters filterPool[headerAuthFilter]
+
 type (
 	// headerAuthFilterConfigFactory implements [shared.HttpFilterConfigFactory].
 	headerAuthFilterConfigFactory struct {
@@ -33,7 +36,9 @@ func (p *headerAuthFilterConfigFactory) Create(handle shared.HttpFilterConfigHan
 
 // Create implements [shared.HttpFilterFactory].
 func (p *headerAuthFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
-	return &headerAuthFilter{handle: handle, authHeaderName: p.authHeaderName}
+	f := headerAuthFilters.get()
+	f.handle, f.authHeaderName = handle, p.authHeaderName
+	return f
 }
 
 // OnRequestHeaders implements [shared.HttpFilter].
@@ -55,3 +60,12 @@ func (p *headerAuthFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStre
 	}
 	return shared.HeadersStatusContinue
 }
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *headerAuthFilter) OnStreamComplete() {
+	// A nil handle means the filter was already put back, which must not happen twice.
+	if p.handle == nil {
+		return
+	}
+	headerAuthFilters.put(p)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/chain"
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// newHeaderAuthChain returns header_auth in front of header_mutation, which sets x-mutated on both
+// paths.
+func newHeaderAuthChain(t *testing.T) *chain.Chain {
+	return chain.New(t,
+		&headerAuthFilterFactory{authHeaderName: "x-auth"},
+		&headerMutationFilterFactory{config: &headerMutationFilterConfig{
+			RequestHeaders:  [][2]string{{"x-mutated", "request"}},
+			ResponseHeaders: [][2]string{{"x-mutated", "response"}},
+		}},
+	)
+}
+
+func TestHeaderAuthChain(t *testing.T) {
+	response := chain.Message{Headers: [][2]string{{":status", "200"}}}
+
+	t.Run("authorized", func(t *testing.T) {
+		c := newHeaderAuthChain(t)
+		result := c.Run(chain.Message{Headers: [][2]string{{":path", "/"}, {"x-auth", "ok"}}}, response)
+		if result.LocalReply != -1 || result.Request == nil {
+			t.Fatalf("LocalReply = %d, Request = %v, want the request to reach the upstream", result.LocalReply, result.Request)
+		}
+		if got := filtertest.NewHeaderMap(result.Request.Headers...).GetOne("x-mutated"); got != "request" {
+			t.Fatalf("upstream x-mutated = %q, want %q", got, "request")
+		}
+		if got := filtertest.NewHeaderMap(result.Response.Headers...).GetOne("x-mutated"); got != "response" {
+			t.Fatalf("client x-mutated = %q, want %q", got, "response")
+		}
+	})
+
+	t.Run("missing header", func(t *testing.T) {
+		c := newHeaderAuthChain(t)
+		result := c.Run(chain.Message{Headers: [][2]string{{":path", "/"}}}, response)
+		if result.LocalReply != 0 || result.Request != nil {
+			t.Fatalf("LocalReply = %d, Request = %v, want the local reply of header_auth", result.LocalReply, result.Request)
+		}
+		c.Handles[0].RequireLocalReply(t, http.StatusUnauthorized)
+		c.Handles[1].RequireNoCall(t, "RequestHeaders.Set")
+		// The local reply still goes through the response path of header_mutation.
+		if got := filtertest.NewHeaderMap(result.Response.Headers...).GetOne("x-mutated"); got != "response" {
+			t.Fatalf("client x-mutated = %q, want %q", got, "response")
+		}
+	})
+
+	t.Run("reply on response headers", func(t *testing.T) {
+		c := newHeaderAuthChain(t)
+		result := c.Run(chain.Message{Headers: [][2]string{{":path", "/"}, {"x-auth", "on_response_headers"}}}, response)
+		if result.Request == nil {
+			t.Fatal("the request didn't reach the upstream")
+		}
+		if result.LocalReply != 0 {
+			t.Fatalf("LocalReply = %d, want 0", result.LocalReply)
+		}
+		// The local reply on the response path replaces the response header_mutation modified.
+		if got := filtertest.NewHeaderMap(result.Response.Headers...).GetOne(":status"); got != "401" {
+			t.Fatalf("client :status = %q, want %q", got, "401")
+		}
+		if got := filtertest.NewHeaderMap(result.Response.Headers...).GetOne("x-mutated"); got != "" {
+			t.Fatalf("client x-mutated = %q, want none", got)
+		}
+	})
+}
+
+func TestHeaderAuthPooledFilter(t *testing.T) {
+	factory := &headerAuthFilterFactory{authHeaderName: "x-auth"}
+	// stream runs a stream through a filter from the pool. The response headers are those of the
+	// upstream or of the local reply on the request headers, which go through the filter alike.
+	stream := func(headers ...[2]string) (*filtertest.Handle, shared.HttpFilter, shared.HeadersStatus) {
+		h := filtertest.NewHandle()
+		var f shared.HttpFilter
+		var status shared.HeadersStatus
+		h.Do(func() {
+			f = factory.Create(h)
+			f.OnRequestHeaders(filtertest.NewHeaderMap(headers...), true)
+			status = f.OnResponseHeaders(filtertest.NewHeaderMap([2]string{":status", "200"}), true)
+			f.OnStreamComplete()
+		})
+		return h, f, status
+	}
+
+	// The first stream leaves the filter set to reply on the response headers.
+	first, f1, _ := stream([2]string{":path", "/"}, [2]string{"x-auth", "on_response_headers"})
+	first.RequireLocalReply(t, http.StatusUnauthorized)
+	// The second one is replied to on the request headers, before the filter looks at the phase.
+	second, f2, status := stream([2]string{":path", "/"})
+	if f1 != f2 {
+		// sync.Pool may drop the filter, for example, on a GC or when the goroutine moved to
+		// another P.
+		t.Skip("the pool didn't return the same filter")
+	}
+	if status != shared.HeadersStatusContinue {
+		t.Fatalf("OnResponseHeaders() = %v, want the state of the first stream reset", status)
+	}
+	if got := string(second.RequireLocalReply(t, http.StatusUnauthorized).Body); got != "Unauthorized by Go Module at on_request_headers\n" {
+		t.Fatalf("local reply body = %q, want the one of on_request_headers", got)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+type (
+	// headerMutationFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	headerMutationFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// headerMutationFilterConfig is the JSON configuration of the header mutation filter. It is the
+	// same as the one of the header_mutation filter of the Rust module, so that the two filters can
+	// be compared on the same workload.
+	headerMutationFilterConfig struct {
+		RequestHeaders        [][2]string `json:"request_headers"`
+		RemoveRequestHeaders  []string    `json:"remove_request_headers"`
+		ResponseHeaders       [][2]string `json:"response_headers"`
+		RemoveResponseHeaders []string    `json:"remove_response_headers"`
+	}
+	// headerMutationFilterFactory implements [shared.HttpFilterFactory].
+	headerMutationFilterFactory struct {
+		config *headerMutationFilterConfig
+	}
+	// headerMutationFilter implements [shared.HttpFilter].
+	//
+	// This is the Go port of the header_mutation filter of the Rust module. It sets and removes the
+	// headers of the config, and adds the X-Downstream-Address, X-Upstream-Address and
+	// X-Response-Code response headers from the attributes of the stream.
+	headerMutationFilter struct {
+		handle shared.HttpFilterHandle
+		config *headerMutationFilterConfig
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *headerMutationFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config headerMutationFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse header mutation config: %w", err)
+		}
+	}
+	return &headerMutationFilterFactory{config: &config}, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *headerMutationFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &headerMutationFilter{handle: handle, config: p.config}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *headerMutationFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	for _, h := range p.config.RequestHeaders {
+		headers.Set(h[0], h[1])
+	}
+	for _, key := range p.config.RemoveRequestHeaders {
+		headers.Remove(key)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *headerMutationFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if addr, ok := p.handle.GetAttributeString(shared.AttributeIDSourceAddress); ok {
+		headers.Set("X-Downstream-Address", addr)
+	}
+	if addr, ok := p.handle.GetAttributeString(shared.AttributeIDUpstreamAddress); ok {
+		headers.Set("X-Upstream-Address", addr)
+	}
+	if code, ok := p.handle.GetAttributeNumber(shared.AttributeIDResponseCode); ok {
+		headers.Set("X-Response-Code", strconv.Itoa(int(code)))
+	}
+	for _, h := range p.config.ResponseHeaders {
+		headers.Set(h[0], h[1])
+	}
+	for _, key := range p.config.RemoveResponseHeaders {
+		headers.Remove(key)
+	}
+	return shared.HeadersStatusContinue
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// hookTimingEnv is the environment variable of Envoy that turns on the hook timing when true.
+const hookTimingEnv = "GO_MODULE_HOOK_TIMING"
+
+type (
+	// hookTimingFilterConfigFactory implements [shared.HttpFilterConfigFactory] by wrapping the
+	// factory of a filter so that the filters it creates time their hooks.
+	hookTimingFilterConfigFactory struct {
+		name string
+		shared.HttpFilterConfigFactory
+	}
+	// hookTimingFilterFactory implements [shared.HttpFilterFactory].
+	hookTimingFilterFactory struct {
+		name      string
+		factory   shared.HttpFilterFactory
+		durations shared.MetricID
+	}
+	// hookTimingFilter implements [shared.HttpFilter].
+	//
+	// Every hook of the wrapped filter is timed, and the time is recorded in the
+	// go_filter_hook_duration_nanoseconds histogram by the filter name and the hook. It is the
+	// time the Go filter adds to the stream on the worker thread, so that the overhead of each
+	// filter can be told apart and compared across the upgrades. The work the filters offload to
+	// goroutines is not included.
+	hookTimingFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *hookTimingFilterFactory
+		filter  shared.HttpFilter
+	}
+)
+
+// withHookTiming wraps the factories with [hookTimingFilterConfigFactory] if the hook timing is
+// turned on with the GO_MODULE_HOOK_TIMING environment variable. It is off by default, as the
+// clock reads and the histogram records add a little to every hook.
+func withHookTiming(factories map[string]shared.HttpFilterConfigFactory) map[string]shared.HttpFilterConfigFactory {
+	if enabled, _ := strconv.ParseBool(os.Getenv(hookTimingEnv)); !enabled {
+		return factories
+	}
+	wrapped := make(map[string]shared.HttpFilterConfigFactory, len(factories))
+	for name, factory := range factories {
+		wrapped[name] = &hookTimingFilterConfigFactory{name: name, HttpFilterConfigFactory: factory}
+	}
+	return wrapped
+}
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *hookTimingFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	factory, err := p.HttpFilterConfigFactory.Create(handle, unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	id, res := handle.DefineHistogram("go_filter_hook_duration_nanoseconds", "filter", "hook")
+	if res != shared.MetricsSuccess {
+		handle.Log(shared.LogLevelWarn, "failed to define the hook timing histogram: %v", res)
+		return factory, nil
+	}
+	return &hookTimingFilterFactory{name: p.name, factory: factory, durations: id}, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *hookTimingFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &hookTimingFilter{handle: handle, factory: p, filter: p.factory.Create(handle)}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *hookTimingFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	defer p.record("request_headers", time.Now())
+	return p.filter.OnRequestHeaders(headers, endOfStream)
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *hookTimingFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	defer p.record("request_body", time.Now())
+	return p.filter.OnRequestBody(body, endOfStream)
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *hookTimingFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	defer p.record("request_trailers", time.Now())
+	return p.filter.OnRequestTrailers(trailers)
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *hookTimingFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	defer p.record("response_headers", time.Now())
+	return p.filter.OnResponseHeaders(headers, endOfStream)
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *hookTimingFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	defer p.record("response_body", time.Now())
+	return p.filter.OnResponseBody(body, endOfStream)
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *hookTimingFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	defer p.record("response_trailers", time.Now())
+	return p.filter.OnResponseTrailers(trailers)
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *hookTimingFilter) OnStreamComplete() {
+	defer p.record("stream_complete", time.Now())
+	p.filter.OnStreamComplete()
+}
+
+func (p *hookTimingFilter) record(hook string, start time.Time) {
+	p.handle.RecordHistogramValue(p.factory.durations, uint64(time.Since(start).Nanoseconds()), p.factory.name, hook)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	icapDefaultTimeoutMs    = 5000
+	icapDefaultMaxBodyBytes = 10 << 20
+)
+
+// icapForwardedHeaders are the request headers sent to the ICAP server along with the body. The
+// others are not needed for a scan, and may be sensitive.
+var icapForwardedHeaders = []string{"content-type", "content-length", "content-disposition", "content-encoding"}
+
+type (
+	// icapFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	icapFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// icapFilterConfig is the JSON configuration of the ICAP filter.
+	icapFilterConfig struct {
+		// Address is the host:port of the ICAP server.
+		Address string `json:"address" example:"127.0.0.1:1344"`
+		// Service is the path of the REQMOD service on the server, such as "avscan" for c-icap
+		// with the ClamAV module.
+		Service string `json:"service" example:"avscan"`
+		// TimeoutMs is the timeout of a scan including the connection. Defaults to 5000.
+		TimeoutMs int `json:"timeout_ms"`
+		// MaxBodyBytes is the size cutoff of the bodies scanned. Defaults to 10MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+		// BlockOversized rejects the bodies over MaxBodyBytes with 413 rather than letting them
+		// through unscanned.
+		BlockOversized bool `json:"block_oversized"`
+		// FailOpen lets the requests through when the ICAP server can't be reached or fails.
+		// Otherwise, they are rejected with 503.
+		FailOpen bool `json:"fail_open"`
+	}
+	// icapFilterFactory implements [shared.HttpFilterFactory].
+	icapFilterFactory struct {
+		config    icapFilterConfig
+		host      string
+		timeout   time.Duration
+		scans     shared.MetricID
+		hasMetric bool
+	}
+	// icapFilter implements [shared.HttpFilter].
+	//
+	// The request body is buffered and sent to the ICAP server in REQMOD mode before the request
+	// goes upstream. The scan is a network call, so it runs in a goroutine and the request is
+	// resumed via the scheduler, like the Redis cache filter.
+	icapFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *icapFilterFactory
+		// head is the encapsulated HTTP request head. It is set while the body is being buffered.
+		head []byte
+		body []byte
+		shared.EmptyHttpFilter
+	}
+	// icapResult is the verdict of the ICAP server.
+	icapResult struct {
+		infected bool
+		threat   string
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *icapFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config icapFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse ICAP config: %w", err)
+	}
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", config.Address, err)
+	}
+	if config.Service == "" {
+		return nil, fmt.Errorf("service must be set")
+	}
+	config.Service = strings.TrimPrefix(config.Service, "/")
+	if config.TimeoutMs <= 0 {
+		config.TimeoutMs = icapDefaultTimeoutMs
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = icapDefaultMaxBodyBytes
+	}
+	f := &icapFilterFactory{config: config, host: host, timeout: time.Duration(config.TimeoutMs) * time.Millisecond}
+	id, res := handle.DefineCounter("icap_scans_total", "result")
+	if res == shared.MetricsSuccess {
+		f.scans, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the ICAP counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *icapFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &icapFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *icapFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	if cl, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && cl > p.factory.config.MaxBodyBytes {
+		if p.oversized() {
+			return shared.HeadersStatusStop
+		}
+		return shared.HeadersStatusContinue
+	}
+	// The head is what the upstream would see, so the scanners that look at the URL or the file
+	// name work as they would in a forward proxy.
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/1.1\r\nHost: %s\r\n", headers.GetOne(":method"), headers.GetOne(":path"), headers.GetOne(":authority"))
+	for _, name := range icapForwardedHeaders {
+		for _, v := range headers.Get(name) {
+			head.WriteString(name + ": " + v + "\r\n")
+		}
+	}
+	head.WriteString("\r\n")
+	p.head = head.Bytes()
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *icapFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.head == nil {
+		return shared.BodyStatusContinue
+	}
+	if len(p.body)+int(body.GetSize()) > p.factory.config.MaxBodyBytes {
+		p.head, p.body = nil, nil
+		if p.oversized() {
+			return shared.BodyStatusStopNoBuffer
+		}
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	if endOfStream {
+		p.scan()
+	}
+	return shared.BodyStatusStopAndBuffer
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *icapFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.head == nil {
+		return shared.TrailersStatusContinue
+	}
+	p.scan()
+	return shared.TrailersStatusStop
+}
+
+// oversized handles a body over the cutoff, and reports whether the request is rejected.
+func (p *icapFilter) oversized() bool {
+	if !p.factory.config.BlockOversized {
+		p.record("oversized")
+		return false
+	}
+	p.record("oversized_blocked")
+	p.handle.SendLocalResponse(http.StatusRequestEntityTooLarge, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte("Payload Too Large\n"), "icap_oversized")
+	return true
+}
+
+// scan sends the buffered request to the ICAP server in a goroutine, and resumes or rejects the
+// request with the result.
+func (p *icapFilter) scan() {
+	head, body := p.head, p.body
+	p.head, p.body = nil, nil
+	scheduler := p.handle.GetScheduler()
+	go func() {
+		result, err := p.factory.reqmod(head, body)
+		scheduler.Schedule(func() {
+			switch {
+			case err != nil:
+				p.handle.Log(shared.LogLevelWarn, "ICAP scan failed: %v", err)
+				if p.factory.config.FailOpen {
+					p.record("failure_mode_allowed")
+					p.handle.ContinueRequest()
+					return
+				}
+				p.record("error")
+				p.handle.SendLocalResponse(http.StatusServiceUnavailable, [][2]string{{"Content-Type", "text/plain"}},
+					[]byte("Service Unavailable\n"), "icap_error")
+			case result.infected:
+				p.handle.Log(shared.LogLevelInfo, "blocked an infected upload: %s", result.threat)
+				p.record("infected")
+				p.handle.SendLocalResponse(http.StatusForbidden, [][2]string{{"Content-Type", "text/plain"}},
+					[]byte("Forbidden: the upload is infected\n"), "icap_infected")
+			default:
+				p.record("clean")
+				p.handle.ContinueRequest()
+			}
+		})
+	}()
+}
+
+func (p *icapFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.scans, 1, result)
+	}
+}
+
+// reqmod sends the request to the ICAP server in REQMOD mode, and returns its verdict. The
+// server is asked to answer 204 if the request is clean, so the body is not sent back.
+func (p *icapFilterFactory) reqmod(head, body []byte) (*icapResult, error) {
+	conn, err := net.DialTimeout("tcp", p.config.Address, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(p.timeout))
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "REQMOD icap://%s/%s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: req-hdr=0, req-body=%d\r\n\r\n",
+		p.config.Address, p.config.Service, p.host, len(head))
+	_, _ = w.Write(head)
+	if len(body) > 0 {
+		fmt.Fprintf(w, "%x\r\n", len(body))
+		_, _ = w.Write(body)
+		_, _ = w.WriteString("\r\n")
+	}
+	_, _ = w.WriteString("0\r\n\r\n")
+	if err = w.Flush(); err != nil {
+		return nil, err
+	}
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	version, rest, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(rest, " ")
+	if version != "ICAP/1.0" {
+		return nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	headers, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case "204":
+		return &icapResult{}, nil
+	case "200":
+		// The servers report the threat in different headers. A modified request without any
+		// of them is taken as clean, since only the verdict is used.
+		threat := headers.Get("X-Infection-Found")
+		if threat == "" {
+			threat = headers.Get("X-Virus-Id")
+		}
+		if threat == "" {
+			threat = headers.Get("X-Violations-Found")
+		}
+		if threat != "" || strings.Contains(headers.Get("Encapsulated"), "res-hdr") {
+			return &icapResult{infected: true, threat: threat}, nil
+		}
+		return &icapResult{}, nil
+	default:
+		return nil, fmt.Errorf("ICAP server responded with %q", line)
+	}
+}
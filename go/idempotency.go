@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	idempotencyDefaultHeader       = "idempotency-key"
+	idempotencyDefaultTTL          = 24 * time.Hour
+	idempotencyDefaultMaxEntries   = 10000
+	idempotencyDefaultMaxBodyBytes = 1 << 20
+	idempotencyMaxKeyLength        = 255
+)
+
+var idempotencyDefaultMethods = []string{"POST", "PUT"}
+
+type (
+	// idempotencyFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	idempotencyFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// idempotencyFilterConfig is the JSON configuration of the Idempotency-Key filter.
+	idempotencyFilterConfig struct {
+		// Header is the request header carrying the key. Defaults to "idempotency-key".
+		Header string `json:"header"`
+		// Methods are the methods the keys are enforced for. Defaults to POST and PUT.
+		Methods []string `json:"methods"`
+		// KeyHeaders are the request headers that scope the keys, such as "authorization", so that
+		// the clients can't replay the responses of each other.
+		KeyHeaders []string `json:"key_headers"`
+		// TTLMs is how long the responses are kept for the retries. Defaults to 24 hours.
+		TTLMs int `json:"ttl_ms"`
+		// MaxEntries is the maximum number of the stored responses. The least recently used one
+		// is evicted when the store is full. Defaults to 10000.
+		MaxEntries int `json:"max_entries"`
+		// MaxBodyBytes is the maximum size of a stored response body. The larger responses are not
+		// stored, so their retries go upstream again. Defaults to 1MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// idempotencyFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// The factory is shared by all the filter instances across the worker threads, so the store
+	// and the in-flight keys live here.
+	idempotencyFilterFactory struct {
+		header       string
+		methods      []string
+		keyHeaders   []string
+		ttl          time.Duration
+		maxBodyBytes int
+		store        *lruCache
+		mux          sync.Mutex
+		inFlight     map[string]struct{}
+		requests     shared.MetricID
+		hasMetric    bool
+	}
+	// idempotencyFilter implements [shared.HttpFilter].
+	//
+	// The first response of a key is stored and replayed to the retries with the same key. The
+	// retries are only replayed if they are the same request, which is told by a hash of the
+	// method, the path, and the body. Otherwise, they are rejected with 422 as the key was reused.
+	// The duplicates arriving while the first request is in flight are rejected with 409.
+	idempotencyFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *idempotencyFilterFactory
+		key     string
+		// fingerprint hashes the request. It is nil if the request has no key.
+		fingerprint hash.Hash
+		// requestDone is set when the request including the body has been hashed.
+		requestDone bool
+		// stored is the response to replay once the request has been hashed.
+		stored *cachedResponse
+		// leader is set while this request is the in-flight one of the key.
+		leader   bool
+		response *cachedResponse
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *idempotencyFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config idempotencyFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse Idempotency-Key config: %w", err)
+		}
+	}
+	if config.Header == "" {
+		config.Header = idempotencyDefaultHeader
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = idempotencyDefaultMethods
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = idempotencyDefaultMaxEntries
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = idempotencyDefaultMaxBodyBytes
+	}
+	f := &idempotencyFilterFactory{
+		header:       strings.ToLower(config.Header),
+		ttl:          time.Duration(config.TTLMs) * time.Millisecond,
+		maxBodyBytes: config.MaxBodyBytes,
+		store:        newLRUCache(config.MaxEntries),
+		inFlight:     make(map[string]struct{}),
+	}
+	if f.ttl <= 0 {
+		f.ttl = idempotencyDefaultTTL
+	}
+	for _, method := range config.Methods {
+		f.methods = append(f.methods, strings.ToUpper(method))
+	}
+	for _, name := range config.KeyHeaders {
+		f.keyHeaders = append(f.keyHeaders, strings.ToLower(name))
+	}
+	id, res := handle.DefineCounter("idempotency_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the Idempotency-Key counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *idempotencyFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &idempotencyFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *idempotencyFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	method := headers.GetOne(":method")
+	idempotencyKey := headers.GetOne(p.factory.header)
+	if idempotencyKey == "" || !slices.Contains(p.factory.methods, method) {
+		return shared.HeadersStatusContinue
+	}
+	if len(idempotencyKey) > idempotencyMaxKeyLength {
+		p.reject(http.StatusBadRequest, "invalid_key", "Bad Request: the idempotency key is too long\n")
+		return shared.HeadersStatusStop
+	}
+	var b strings.Builder
+	for _, name := range p.factory.keyHeaders {
+		b.WriteString(strings.Join(headers.Get(name), ","))
+		b.WriteByte(0)
+	}
+	b.WriteString(idempotencyKey)
+	p.key = b.String()
+	p.fingerprint = sha256.New()
+	p.fingerprint.Write([]byte(method + "\x00" + headers.GetOne(":path") + "\x00"))
+
+	now := time.Now()
+	if p.stored = p.factory.store.get(p.key, now); p.stored == nil {
+		p.factory.mux.Lock()
+		_, inFlight := p.factory.inFlight[p.key]
+		// The leader stores its response before it leaves the flight, so the store is checked
+		// again in case the leader finished since.
+		if !inFlight {
+			if p.stored = p.factory.store.get(p.key, now); p.stored == nil {
+				p.factory.inFlight[p.key] = struct{}{}
+				p.leader = true
+			}
+		}
+		p.factory.mux.Unlock()
+		if inFlight {
+			p.reject(http.StatusConflict, "conflict", "Conflict: a request with the same idempotency key is in progress\n")
+			return shared.HeadersStatusStop
+		}
+	}
+	if endOfStream {
+		p.requestDone = true
+		if p.stored != nil {
+			p.replay()
+			return shared.HeadersStatusStop
+		}
+		return shared.HeadersStatusContinue
+	}
+	if p.stored != nil {
+		// The request is held until the body tells whether it is the same request.
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *idempotencyFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.fingerprint == nil {
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.fingerprint.Write(chunk)
+	}
+	if !endOfStream {
+		if p.stored != nil {
+			return shared.BodyStatusStopAndBuffer
+		}
+		return shared.BodyStatusContinue
+	}
+	p.requestDone = true
+	if p.stored != nil {
+		p.replay()
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *idempotencyFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.fingerprint == nil {
+		return shared.TrailersStatusContinue
+	}
+	p.requestDone = true
+	if p.stored != nil {
+		p.replay()
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// replay sends the stored response if the request is the same as the one it was for.
+func (p *idempotencyFilter) replay() {
+	stored := p.stored
+	p.stored = nil
+	if hex.EncodeToString(p.fingerprint.Sum(nil)) != stored.fingerprint {
+		p.reject(http.StatusUnprocessableEntity, "mismatch",
+			"Unprocessable Entity: the idempotency key was used for a different request\n")
+		return
+	}
+	p.record("replayed")
+	p.handle.SendLocalResponse(stored.status,
+		append(slices.Clone(stored.headers), [2]string{"idempotent-replayed", "true"}), stored.body, "idempotency_replayed")
+}
+
+func (p *idempotencyFilter) reject(status uint32, result, body string) {
+	p.record(result)
+	p.handle.SendLocalResponse(status, [][2]string{{"Content-Type", "text/plain"}}, []byte(body), "idempotency_"+result)
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *idempotencyFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if !p.leader {
+		return shared.HeadersStatusContinue
+	}
+	status, _ := strconv.Atoi(headers.GetOne(":status"))
+	// The failed requests can be retried with the same key.
+	if status < 200 || status >= 500 || !p.requestDone {
+		p.finish(nil)
+		return shared.HeadersStatusContinue
+	}
+	p.response = &cachedResponse{status: uint32(status)}
+	for _, h := range headers.GetAll() {
+		name := strings.ToLower(h[0])
+		if _, skip := cacheSkippedResponseHeaders[name]; skip {
+			continue
+		}
+		// The header values are only valid during this callback.
+		p.response.headers = append(p.response.headers, [2]string{strings.Clone(name), strings.Clone(h[1])})
+	}
+	if endOfStream {
+		p.finish(p.response)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *idempotencyFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.leader {
+		return shared.BodyStatusContinue
+	}
+	if len(p.response.body)+int(body.GetSize()) > p.factory.maxBodyBytes {
+		p.finish(nil)
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.response.body = append(p.response.body, chunk...)
+	}
+	if endOfStream {
+		p.finish(p.response)
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *idempotencyFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	// The local replies can't carry trailers.
+	if p.leader {
+		p.finish(nil)
+	}
+	return shared.TrailersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *idempotencyFilter) OnStreamComplete() {
+	// The request was reset before the response completed.
+	if p.leader {
+		p.finish(nil)
+	}
+}
+
+// finish stores the response if any, and ends the in-flight state of the key.
+func (p *idempotencyFilter) finish(response *cachedResponse) {
+	if response != nil {
+		now := time.Now()
+		response.storedAt, response.expires = now, now.Add(p.factory.ttl)
+		response.fingerprint = hex.EncodeToString(p.fingerprint.Sum(nil))
+		p.factory.store.put(p.key, response)
+		p.record("stored")
+	} else {
+		p.record("not_stored")
+	}
+	p.factory.mux.Lock()
+	delete(p.factory.inFlight, p.key)
+	p.factory.mux.Unlock()
+	p.leader, p.response = false, nil
+}
+
+func (p *idempotencyFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Registers the WebP decoder.
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/bodypool"
+)
+
+const (
+	imageTransformDefaultMaxInputBytes  = 10 << 20
+	imageTransformDefaultMaxInputPixels = 40_000_000
+	imageTransformDefaultMaxDimension   = 4096
+	imageTransformDefaultJPEGQuality    = 85
+)
+
+// imageTransformMediaTypes maps the media types of the images to their format names, as returned
+// by [image.Decode].
+var imageTransformMediaTypes = map[string]string{
+	"image/jpeg": "jpeg", "image/png": "png", "image/gif": "gif", "image/webp": "webp",
+}
+
+type (
+	// imageTransformFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	imageTransformFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// imageTransformFilterConfig is the JSON configuration of the image transform filter.
+	//
+	// The transformation is requested with the query parameters w and h for the maximum width and
+	// height, which keep the aspect ratio and never enlarge the image, format for "jpeg", "png",
+	// "gif" or "webp", and q for the JPEG quality, such as "/photo.png?w=320&format=jpeg&q=70".
+	imageTransformFilterConfig struct {
+		// NegotiateWebP converts the images to WebP when the Accept header lists image/webp, unless
+		// the format parameter is set. The original image is kept if the WebP one isn't smaller.
+		NegotiateWebP bool `json:"negotiate_webp"`
+		// MaxWidth and MaxHeight are the maximum w and h. Default to 4096.
+		MaxWidth  int `json:"max_width"`
+		MaxHeight int `json:"max_height"`
+		// MaxInputBytes is the maximum size of the images transformed. The larger images are passed
+		// through. Defaults to 10MiB.
+		MaxInputBytes int `json:"max_input_bytes"`
+		// MaxInputPixels is the maximum number of pixels of the images transformed, so that a small
+		// file can't decode to a huge image. The larger images are passed through. Defaults to 40
+		// million.
+		MaxInputPixels int `json:"max_input_pixels"`
+		// MaxConcurrency is the maximum number of images transformed at once across the worker
+		// threads. The images over it are passed through rather than queued. Defaults to the number
+		// of CPUs.
+		MaxConcurrency int `json:"max_concurrency"`
+	}
+	// imageTransformFilterFactory implements [shared.HttpFilterFactory].
+	imageTransformFilterFactory struct {
+		config imageTransformFilterConfig
+		// slots limits the concurrent transformations.
+		slots     chan struct{}
+		responses shared.MetricID
+		hasMetric bool
+	}
+	// imageTransformFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to offload CPU-heavy work from the worker threads. The image is
+	// decoded, resized and encoded in a goroutine while the response is held, and the result is
+	// applied through the scheduler on the worker thread of the stream.
+	imageTransformFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *imageTransformFilterFactory
+		// target is non-nil if the response is transformed.
+		target *imageTarget
+		// buffering is set while the response body is being buffered.
+		buffering bool
+		body      []byte
+		shared.EmptyHttpFilter
+	}
+	// imageTarget is the requested transformation.
+	imageTarget struct {
+		width, height int
+		// format is empty to keep the format of the image.
+		format  string
+		quality int
+		// negotiated is set if the format was picked by the Accept header.
+		negotiated bool
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *imageTransformFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config imageTransformFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse image transform config: %w", err)
+		}
+	}
+	if config.MaxWidth <= 0 {
+		config.MaxWidth = imageTransformDefaultMaxDimension
+	}
+	if config.MaxHeight <= 0 {
+		config.MaxHeight = imageTransformDefaultMaxDimension
+	}
+	if config.MaxInputBytes <= 0 {
+		config.MaxInputBytes = imageTransformDefaultMaxInputBytes
+	}
+	if config.MaxInputPixels <= 0 {
+		config.MaxInputPixels = imageTransformDefaultMaxInputPixels
+	}
+	if config.MaxConcurrency <= 0 {
+		config.MaxConcurrency = runtime.NumCPU()
+	}
+	f := &imageTransformFilterFactory{config: config, slots: make(chan struct{}, config.MaxConcurrency)}
+	id, res := handle.DefineCounter("image_transform_responses_total", "result")
+	if res == shared.MetricsSuccess {
+		f.responses, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the image transform counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *imageTransformFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &imageTransformFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *imageTransformFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	target, err := p.factory.parseTarget(headers)
+	if err != nil {
+		p.record("invalid")
+		p.handle.SendLocalResponse(http.StatusBadRequest, [][2]string{{"content-type", "text/plain"}},
+			[]byte(err.Error()+"\n"), "image_transform_invalid")
+		return shared.HeadersStatusStop
+	}
+	p.target = target
+	return shared.HeadersStatusContinue
+}
+
+// parseTarget returns the transformation requested, or nil if none is.
+func (p *imageTransformFilterFactory) parseTarget(headers shared.HeaderMap) (*imageTarget, error) {
+	_, rawQuery, _ := strings.Cut(headers.GetOne(":path"), "?")
+	query, _ := url.ParseQuery(rawQuery)
+	target := &imageTarget{format: query.Get("format"), quality: imageTransformDefaultJPEGQuality}
+	for _, param := range []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"w", &target.width, p.config.MaxWidth},
+		{"h", &target.height, p.config.MaxHeight},
+		{"q", &target.quality, 100},
+	} {
+		if s := query.Get(param.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > param.max {
+				return nil, fmt.Errorf("%s must be between 1 and %d", param.name, param.max)
+			}
+			*param.value = n
+		}
+	}
+	switch target.format {
+	case "", "jpeg", "png", "gif", "webp":
+	default:
+		return nil, fmt.Errorf("format must be jpeg, png, gif or webp")
+	}
+	if target.format == "" && p.config.NegotiateWebP {
+		accept := headers.GetOne("accept")
+		if strings.Contains(strings.ToLower(accept), "image/webp") && acceptQuality(accept, "image/webp") > 0 {
+			target.format, target.negotiated = "webp", true
+		}
+	}
+	if target.width == 0 && target.height == 0 && target.format == "" {
+		return nil, nil
+	}
+	return target, nil
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *imageTransformFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.target == nil || endOfStream || headers.GetOne(":status") != "200" || headers.GetOne("content-encoding") != "" {
+		return shared.HeadersStatusContinue
+	}
+	mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	if _, ok := imageTransformMediaTypes[mediaType]; !ok {
+		return shared.HeadersStatusContinue
+	}
+	if p.target.negotiated {
+		// The cached responses must vary even when this one is passed through.
+		headers.Add("vary", "Accept")
+	}
+	if size, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && size > p.factory.config.MaxInputBytes {
+		p.record("too_large")
+		return shared.HeadersStatusContinue
+	}
+	p.buffering = true
+	return shared.HeadersStatusStop
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *imageTransformFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.buffering {
+		return shared.BodyStatusContinue
+	}
+	if len(p.body)+int(body.GetSize()) > p.factory.config.MaxInputBytes {
+		bodypool.Put(p.body)
+		p.buffering, p.body = false, nil
+		p.record("too_large")
+		return shared.BodyStatusContinue
+	}
+	p.body = bodypool.Append(p.body, body)
+	if endOfStream && !p.transform() {
+		return shared.BodyStatusContinue
+	}
+	return shared.BodyStatusStopAndBuffer
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *imageTransformFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.buffering && p.transform() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// transform starts transforming the buffered image in a goroutine, and returns false if the
+// response is passed through instead.
+func (p *imageTransformFilter) transform() bool {
+	data, target := p.body, *p.target
+	p.buffering, p.body = false, nil
+	select {
+	case p.factory.slots <- struct{}{}:
+	default:
+		bodypool.Put(data)
+		p.record("busy")
+		return false
+	}
+	maxPixels := p.factory.config.MaxInputPixels
+	scheduler := p.handle.GetScheduler()
+	go func() {
+		out, mediaType, err := transformImage(data, target, maxPixels)
+		bodypool.Put(data)
+		<-p.factory.slots
+		scheduler.Schedule(func() {
+			switch {
+			case err != nil:
+				p.handle.Log(shared.LogLevelDebug, "failed to transform the image: %v", err)
+				p.record("error")
+			case out == nil:
+				p.record("unchanged")
+			default:
+				p.record("transformed")
+				buffered := p.handle.BufferedResponseBody()
+				buffered.Drain(buffered.GetSize())
+				buffered.Append(out)
+				headers := p.handle.ResponseHeaders()
+				headers.Set("content-type", mediaType)
+				headers.Set("content-length", strconv.Itoa(len(out)))
+				// The validators of the original image don't match the transformed one.
+				headers.Remove("etag")
+				headers.Remove("last-modified")
+			}
+			p.handle.ContinueResponse()
+		})
+	}()
+	return true
+}
+
+// transformImage returns the image transformed with its media type, or nil if the image already
+// matches the target.
+func transformImage(data []byte, target imageTarget, maxPixels int) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, "", fmt.Errorf("%dx%d image is too large", config.Width, config.Height)
+	}
+	width, height := fitImage(config.Width, config.Height, target.width, target.height)
+	if target.format == "" {
+		target.format = format
+	}
+	if width == config.Width && height == config.Height && target.format == format {
+		return nil, "", nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if width != config.Width || height != config.Height {
+		resized := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Src, nil)
+		img = resized
+	}
+	var out bytes.Buffer
+	switch target.format {
+	case "jpeg":
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: target.quality})
+	case "png":
+		err = png.Encode(&out, img)
+	case "gif":
+		err = gif.Encode(&out, img, nil)
+	case "webp":
+		// Lossless, as there is no lossy WebP encoder in pure Go.
+		err = nativewebp.Encode(&out, img, nil)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if target.negotiated && width == config.Width && height == config.Height && out.Len() >= len(data) {
+		// The client didn't ask for the conversion, so it is only worth it when the image shrinks.
+		return nil, "", nil
+	}
+	return out.Bytes(), "image/" + target.format, nil
+}
+
+// fitImage returns the size of the image scaled down to fit in the maximum width and height,
+// keeping its aspect ratio. A zero maximum is unbounded.
+func fitImage(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+	if scale == 1 {
+		return width, height
+	}
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+func (p *imageTransformFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.responses, 1, result)
+	}
+}
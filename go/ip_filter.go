@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	ipFilterActionDeny = "deny"
+	ipFilterActionTag  = "tag"
+
+	ipFilterDefaultTagHeader = "x-ip-filter"
+)
+
+type (
+	// ipFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	ipFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// ipFilterConfig is the JSON configuration of the IP filter.
+	ipFilterConfig struct {
+		// Allow is the list of the allowed CIDRs. If empty, all addresses not denied are allowed.
+		Allow []string `json:"allow"`
+		// Deny is the list of the denied CIDRs. It takes precedence over Allow.
+		Deny []string `json:"deny"`
+		// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For entries are trusted.
+		TrustedProxies []string `json:"trusted_proxies"`
+		// Action is either "deny" to reply with 403 or "tag" to set TagHeader to "allowed" or
+		// "denied" and let the request through. Defaults to "deny".
+		Action string `json:"action"`
+		// TagHeader defaults to "x-ip-filter".
+		TagHeader string `json:"tag_header"`
+	}
+	// ipFilterFactory implements [shared.HttpFilterFactory].
+	ipFilterFactory struct {
+		allow, deny, trustedProxies *cidrSet
+		action, tagHeader           string
+		requests                    shared.MetricID
+		hasMetric                   bool
+	}
+	// ipFilter implements [shared.HttpFilter].
+	ipFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *ipFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *ipFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config ipFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse ip filter config: %w", err)
+	}
+	switch config.Action {
+	case "":
+		config.Action = ipFilterActionDeny
+	case ipFilterActionDeny, ipFilterActionTag:
+	default:
+		return nil, fmt.Errorf("unknown action %q", config.Action)
+	}
+	if config.TagHeader == "" {
+		config.TagHeader = ipFilterDefaultTagHeader
+	}
+	f := &ipFilterFactory{action: config.Action, tagHeader: config.TagHeader}
+	var err error
+	if f.allow, err = newCIDRSet(config.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if f.deny, err = newCIDRSet(config.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	if f.trustedProxies, err = newCIDRSet(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	id, res := handle.DefineCounter("ip_filter_requests_total", "decision")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the ip filter counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *ipFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &ipFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *ipFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	addr, ok := clientAddr(p.handle, headers, p.factory.trustedProxies)
+	allowed := ok && !p.factory.deny.Contains(addr) && (p.factory.allow.Len() == 0 || p.factory.allow.Contains(addr))
+	decision := "allowed"
+	if !allowed {
+		decision = "denied"
+	}
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, decision)
+	}
+
+	if p.factory.action == ipFilterActionTag {
+		// Set overwrites the header possibly sent by the client.
+		headers.Set(p.factory.tagHeader, decision)
+		return shared.HeadersStatusContinue
+	}
+	if !allowed {
+		p.handle.SendLocalResponse(http.StatusForbidden, [][2]string{{"Content-Type", "text/plain"}},
+			[]byte("Forbidden\n"), "ip_filter_denied")
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// clientAddr returns the address of the client. Starting from the downstream address, the
+// X-Forwarded-For entries are walked from right to left for as long as the hop is a trusted proxy,
+// so the result is the address of the first untrusted hop.
+func clientAddr(handle shared.HttpFilterHandle, headers shared.HeaderMap, trustedProxies *cidrSet) (netip.Addr, bool) {
+	source, ok := handle.GetAttributeString(shared.AttributeIDSourceAddress)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	addr, err := netip.ParseAddr(source)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if trustedProxies.Len() == 0 {
+		return addr, true
+	}
+	hops := headers.Get("x-forwarded-for")
+	for i := len(hops) - 1; i >= 0; i-- {
+		entries := strings.Split(hops[i], ",")
+		for j := len(entries) - 1; j >= 0; j-- {
+			if !trustedProxies.Contains(addr) {
+				return addr, true
+			}
+			hop, err := netip.ParseAddr(strings.TrimSpace(entries[j]))
+			if err != nil {
+				// A malformed entry can't be trusted, so the last trusted hop is the client.
+				return addr, true
+			}
+			addr = hop.Unmap()
+		}
+	}
+	return addr, true
+}
+
+// cidrSet is a set of CIDRs stored in binary radix trees, one per address family, so that the
+// lookup cost depends on the address length rather than the number of the CIDRs.
+type cidrSet struct {
+	v4, v6 cidrNode
+	n      int
+}
+
+type cidrNode struct {
+	children [2]*cidrNode
+	// terminal is set if a CIDR ends at this node, in which case all the addresses below match.
+	terminal bool
+}
+
+// newCIDRSet parses the CIDRs. A bare address is treated as a single host CIDR.
+func newCIDRSet(cidrs []string) (*cidrSet, error) {
+	s := &cidrSet{}
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(c)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		s.Insert(prefix)
+	}
+	return s, nil
+}
+
+// Insert adds the prefix to the set.
+func (s *cidrSet) Insert(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	if addr.Is4In6() {
+		addr, bits = addr.Unmap(), max(bits-96, 0)
+	}
+	node := s.root(addr)
+	raw := addr.AsSlice()
+	for i := range bits {
+		if node.terminal {
+			// A shorter prefix already covers this one.
+			return
+		}
+		b := raw[i/8] >> (7 - i%8) & 1
+		if node.children[b] == nil {
+			node.children[b] = &cidrNode{}
+		}
+		node = node.children[b]
+	}
+	node.terminal = true
+	// Longer prefixes below are now redundant.
+	node.children = [2]*cidrNode{}
+	s.n++
+}
+
+// Contains reports whether the address is in any of the CIDRs.
+func (s *cidrSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	node := s.root(addr)
+	raw := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(raw)*8 {
+			return false
+		}
+		node = node.children[raw[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// Len returns the number of the CIDRs inserted.
+func (s *cidrSet) Len() int { return s.n }
+
+func (s *cidrSet) root(addr netip.Addr) *cidrNode {
+	if addr.Is4() {
+		return &s.v4
+	}
+	return &s.v6
+}
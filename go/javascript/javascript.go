@@ -0,0 +1,865 @@
+// Package javascript implements an HTTP filter that runs the JavaScript hooks defined in the
+// filter config. It is a separate package so that the filter can be exercised without Envoy,
+// for example, by cmd/jsfilter-test.
+package javascript
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	javaScriptExportedSymbolOnConfig          = "OnConfigure"
+	javaScriptExportedSymbolOnRequestHeaders  = "OnRequestHeaders"
+	javaScriptExportedSymbolOnResponseHeaders = "OnResponseHeaders"
+	// The trailers hooks are optional.
+	javaScriptExportedSymbolOnRequestTrailers  = "OnRequestTrailers"
+	javaScriptExportedSymbolOnResponseTrailers = "OnResponseTrailers"
+
+	functionDeclTemplate = `globalThis.%[1]s = %[1]s`
+
+	// javaScriptOnConfigurePerVM calls OnConfigure on every VM in the pool. This is the default.
+	javaScriptOnConfigurePerVM = "per_vm"
+	// javaScriptOnConfigurePerVMQuiet calls OnConfigure on every VM too, so that the globals it
+	// sets up are the same on every worker, but only keeps the console output of its first call.
+	// This is useful when OnConfigure logs something that should not be repeated per VM. Its side
+	// effects outside the VM, if any, still happen on every VM.
+	javaScriptOnConfigurePerVMQuiet = "per_vm_quiet"
+
+	// The values a hook can return to control the iteration of the filter chain.
+	javaScriptStatusContinue = "continue"
+	javaScriptStatusStop     = "stop"
+	javaScriptStatusBuffer   = "buffer"
+)
+
+// javaScriptMetadataSources maps the source names accepted by ctx.getMetadata to [shared.MetadataSourceType].
+var javaScriptMetadataSources = map[string]shared.MetadataSourceType{
+	"dynamic":       shared.MetadataSourceTypeDynamic,
+	"route":         shared.MetadataSourceTypeRoute,
+	"cluster":       shared.MetadataSourceTypeCluster,
+	"host":          shared.MetadataSourceTypeHost,
+	"host_locality": shared.MetadataSourceTypeHostLocality,
+}
+
+// javaScriptLiveVMs is the number of the VMs not yet garbage collected, across the configs.
+var javaScriptLiveVMs atomic.Int64
+
+// javaScriptWatchdogInterval is how often the allocations of a running hook are checked against
+// max_memory_bytes.
+const javaScriptWatchdogInterval = time.Millisecond
+
+var (
+	errJavaScriptExecutionTimeout    = errors.New("JavaScript execution time limit exceeded")
+	errJavaScriptStringTooLong       = errors.New("JavaScript string length limit exceeded")
+	errJavaScriptArrayTooLong        = errors.New("JavaScript array length limit exceeded")
+	errJavaScriptMemoryLimitExceeded = errors.New("JavaScript memory limit exceeded")
+)
+
+type (
+	// FilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	FilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// javaScriptFilterFactory implements [shared.HttpFilterFactory].
+	javaScriptFilterFactory struct {
+		config  *javaScriptFilterConfig
+		program *goja.Program
+		// vms has a VM per worker thread, so that the hooks of a worker never wait for another's.
+		// The VMs past min_vms are nil until a worker needs them.
+		vms []atomic.Pointer[javaScriptVM]
+		// configured is set once OnConfigure was called on a VM.
+		configured atomic.Bool
+	}
+	// javaScriptFilter implements [shared.HttpFilter].
+	javaScriptFilter struct {
+		handle          shared.HttpFilterHandle
+		factory         *javaScriptFilterFactory
+		vm              *javaScriptVM
+		requestHeaders  map[string]string
+		responseHeaders map[string]string
+		shared.EmptyHttpFilter
+	}
+	// javaScriptFilterConfig is the structured configuration of the JavaScript filter.
+	//
+	// The filter config can also be the plain script source, in which case the defaults are used.
+	javaScriptFilterConfig struct {
+		// Script is the JavaScript source code.
+		Script string `json:"script" example:"function OnConfigure() {} function OnRequestHeaders(ctx) {} function OnResponseHeaders(ctx) {}"`
+		// OnConfigure is either "per_vm" (default) or "per_vm_quiet" to only keep the console output
+		// of the first call.
+		OnConfigure string `json:"on_configure"`
+		// Limits are the resource limits applied to each VM.
+		Limits javaScriptLimits `json:"limits"`
+		// Concurrency is the number of Envoy worker threads, as in the --concurrency flag, which is
+		// the number of VMs in the pool. Defaults to the number of CPUs as Envoy does.
+		Concurrency int `json:"concurrency"`
+		// MinVMs is the number of VMs created with the config. The others are created on the first
+		// request of their worker, so that a heavy script doesn't delay the config updates and the
+		// routes rarely used don't hold a VM per worker. Defaults to 1, as the first VM checks the
+		// script.
+		MinVMs int `json:"min_vms"`
+		// IdleTimeoutMs is the time after which the VMs past min_vms that weren't used are released.
+		// Zero keeps them.
+		IdleTimeoutMs int `json:"idle_timeout_ms"`
+	}
+	// javaScriptLimits protects Envoy from pathological scripts. Zero values mean no limit.
+	//
+	// A VM that exceeds any of the limits fails the current hook and is replaced in the pool
+	// with a fresh VM created from the same program.
+	javaScriptLimits struct {
+		// MaxCallStackSize is the maximum depth of the JavaScript call stack.
+		MaxCallStackSize int `json:"max_call_stack_size"`
+		// MaxExecutionTimeMs is the maximum wall time of a single hook invocation, including the
+		// top level of the script and OnConfigure when the VM is created.
+		MaxExecutionTimeMs int `json:"max_execution_time_ms"`
+		// MaxStringLength is the maximum length of the strings built by the String builtins, such
+		// as repeat and padStart, Array.prototype.join, and JSON.stringify, and of those passed
+		// from the script to the host, for example, header names and values. The strings built
+		// with the + operator are bounded by max_memory_bytes.
+		MaxStringLength int `json:"max_string_length"`
+		// MaxArrayLength is the maximum length of the arrays grown by the Array builtins, such as
+		// push and concat, and String.prototype.split.
+		MaxArrayLength int `json:"max_array_length"`
+		// MaxMemoryBytes is the maximum number of bytes a hook may allocate. Goja doesn't account
+		// the memory per VM, so the heap allocations of the whole process are sampled while the
+		// hook runs, and those of the other workers count too: the limit is an upper bound to
+		// stop a runaway script, and should leave room for the rest of the process.
+		MaxMemoryBytes int `json:"max_memory_bytes"`
+	}
+	javaScriptVM struct {
+		*goja.Runtime
+		index  int
+		limits *javaScriptLimits
+		// lastUsed is the Unix time in nanoseconds when a filter last got the VM.
+		lastUsed          atomic.Int64
+		mux               sync.Mutex
+		onRequestHeaders  goja.Callable
+		onResponseHeaders goja.Callable
+		// These are nil if the script doesn't define the optional trailers hooks.
+		onRequestTrailers  goja.Callable
+		onResponseTrailers goja.Callable
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *FilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	config, err := parseJavaScriptFilterConfig(unparsedConfig)
+	if err != nil {
+		log.Printf("failed to parse JavaScript filter config: %v", err)
+		return nil, err
+	}
+	// Compile the script once and share the program across the VM pool.
+	program, err := goja.Compile("filter.js", config.Script, false)
+	if err != nil {
+		log.Printf("failed to compile JavaScript: %v", err)
+		return nil, err
+	}
+
+	c := &javaScriptFilterFactory{config: config, program: program, vms: make([]atomic.Pointer[javaScriptVM], config.Concurrency)}
+	// The VMs are independent once the script is compiled, so they are created concurrently for
+	// a heavy script not to delay the config by the number of VMs.
+	errs := make([]error, config.MinVMs)
+	var wg sync.WaitGroup
+	for i := range config.MinVMs {
+		wg.Go(func() {
+			vm, err := c.newVM()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			vm.index = i
+			c.vms[i].Store(vm)
+		})
+	}
+	wg.Wait()
+	// The VMs run the same script, so they likely fail the same way.
+	for _, err := range errs {
+		if err != nil {
+			log.Printf("failed to create JavaScript VM: %v", err)
+			return nil, err
+		}
+	}
+	if config.IdleTimeoutMs > 0 && config.MinVMs < config.Concurrency {
+		stop := make(chan struct{})
+		go releaseIdleJavaScriptVMs(c.vms[config.MinVMs:], time.Duration(config.IdleTimeoutMs)*time.Millisecond, stop)
+		runtime.AddCleanup(c, func(stop chan struct{}) { close(stop) }, stop)
+	}
+	return c, nil
+}
+
+// parseJavaScriptFilterConfig parses the filter config which is either a JSON object
+// described by [javaScriptFilterConfig] or the plain script source.
+func parseJavaScriptFilterConfig(unparsedConfig []byte) (*javaScriptFilterConfig, error) {
+	config := &javaScriptFilterConfig{}
+	if strings.HasPrefix(strings.TrimSpace(string(unparsedConfig)), "{") && json.Unmarshal(unparsedConfig, config) == nil {
+		if config.Script == "" {
+			return nil, fmt.Errorf("script must be set")
+		}
+	} else {
+		config.Script = string(unparsedConfig)
+	}
+	switch config.OnConfigure {
+	case "":
+		config.OnConfigure = javaScriptOnConfigurePerVM
+	case javaScriptOnConfigurePerVM, javaScriptOnConfigurePerVMQuiet:
+	default:
+		return nil, fmt.Errorf("invalid on_configure %q: must be %q or %q",
+			config.OnConfigure, javaScriptOnConfigurePerVM, javaScriptOnConfigurePerVMQuiet)
+	}
+	if config.Concurrency < 0 {
+		return nil, fmt.Errorf("concurrency must not be negative")
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = runtime.NumCPU()
+	}
+	if config.MinVMs < 0 || config.IdleTimeoutMs < 0 {
+		return nil, fmt.Errorf("min_vms and idle_timeout_ms must not be negative")
+	}
+	config.MinVMs = min(max(config.MinVMs, 1), config.Concurrency)
+	return config, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *javaScriptFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	vm := p.vm(javaScriptWorkerSlot() % len(p.vms))
+	vm.lastUsed.Store(time.Now().UnixNano())
+	return &javaScriptFilter{
+		handle:          handle,
+		factory:         p,
+		vm:              vm,
+		requestHeaders:  make(map[string]string),
+		responseHeaders: make(map[string]string),
+	}
+}
+
+// vm returns the VM in the slot, creating it if it doesn't exist yet.
+func (p *javaScriptFilterFactory) vm(slot int) *javaScriptVM {
+	for {
+		if vm := p.vms[slot].Load(); vm != nil {
+			return vm
+		}
+		fresh, err := p.newVM()
+		if err != nil {
+			// The first VM is never released, so the worker can share it instead.
+			log.Printf("failed to create JavaScript VM: %v", err)
+			return p.vms[0].Load()
+		}
+		fresh.index = slot
+		if p.vms[slot].CompareAndSwap(nil, fresh) {
+			return fresh
+		}
+	}
+}
+
+// releaseIdleJavaScriptVMs releases the VMs not used for the timeout until stop is closed. It
+// doesn't reference the factory, so that the factory can be collected and stop the goroutine.
+// The filters that still have a released VM keep using it until they are done.
+func releaseIdleJavaScriptVMs(vms []atomic.Pointer[javaScriptVM], timeout time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		idleSince := time.Now().Add(-timeout).UnixNano()
+		for i := range vms {
+			if vm := vms[i].Load(); vm != nil && vm.lastUsed.Load() < idleSince {
+				vms[i].CompareAndSwap(vm, nil)
+			}
+		}
+	}
+}
+
+// recycle replaces vm in the pool with a fresh VM created from the same program.
+func (p *javaScriptFilterFactory) recycle(vm *javaScriptVM) {
+	fresh, err := p.newVM()
+	if err != nil {
+		log.Printf("failed to recycle JavaScript VM: %v", err)
+		return
+	}
+	fresh.index = vm.index
+	p.vms[vm.index].CompareAndSwap(vm, fresh)
+}
+
+// newVM creates a VM from the program, including the ones created lazily and the recycled ones.
+func (p *javaScriptFilterFactory) newVM() (*javaScriptVM, error) {
+	quietConfigure := p.config.OnConfigure == javaScriptOnConfigurePerVMQuiet && !p.configured.CompareAndSwap(false, true)
+	return newJavaScriptVM(p.program, &p.config.Limits, quietConfigure, os.Stdout)
+}
+
+// newJavaScriptVM runs the program on a new VM and calls OnConfigure, discarding what it writes to
+// the console if quietConfigure is set.
+func newJavaScriptVM(program *goja.Program, limits *javaScriptLimits, quietConfigure bool, w io.Writer) (*javaScriptVM, error) {
+	vm := goja.New()
+	if limits.MaxCallStackSize > 0 {
+		vm.SetMaxCallStackSize(limits.MaxCallStackSize)
+	}
+	ret := &javaScriptVM{Runtime: vm, limits: limits}
+	if err := ret.setSizeLimits(); err != nil {
+		return nil, err
+	}
+	out := w
+	if quietConfigure {
+		out = io.Discard
+	}
+	console := vm.NewObject()
+	err := console.Set("log", func(call goja.FunctionCall) goja.Value {
+		args := make([]interface{}, 0, len(call.Arguments))
+		for _, a := range call.Arguments {
+			args = append(args, a.Export())
+		}
+		_, _ = fmt.Fprint(out, args...)
+		return goja.Undefined()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set console.log: %w", err)
+	}
+	err = vm.Set("console", console)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set console: %w", err)
+	}
+
+	err = ret.run(func() error {
+		_, err := vm.RunProgram(program)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to run script: %w", err)
+	}
+
+	// Call OnConfigure.
+	onConfigure, ok := goja.AssertFunction(vm.GlobalObject().Get(javaScriptExportedSymbolOnConfig))
+	if !ok {
+		return nil, fmt.Errorf("failed to get %s function", javaScriptExportedSymbolOnConfig)
+	}
+	_, err = ret.call(onConfigure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s function: %w", javaScriptExportedSymbolOnConfig, err)
+	}
+	out = w
+
+	// Check two exported functions.
+	ret.onRequestHeaders, ok = goja.AssertFunction(vm.GlobalObject().Get(javaScriptExportedSymbolOnRequestHeaders))
+	if !ok {
+		return nil, fmt.Errorf("failed to get %s function", javaScriptExportedSymbolOnRequestHeaders)
+	}
+	ret.onResponseHeaders, ok = goja.AssertFunction(vm.GlobalObject().Get(javaScriptExportedSymbolOnResponseHeaders))
+	if !ok {
+		return nil, fmt.Errorf("failed to get %s function", javaScriptExportedSymbolOnResponseHeaders)
+	}
+	ret.onRequestTrailers, _ = goja.AssertFunction(vm.GlobalObject().Get(javaScriptExportedSymbolOnRequestTrailers))
+	ret.onResponseTrailers, _ = goja.AssertFunction(vm.GlobalObject().Get(javaScriptExportedSymbolOnResponseTrailers))
+	javaScriptLiveVMs.Add(1)
+	runtime.AddCleanup(ret, func(struct{}) { javaScriptLiveVMs.Add(-1) }, struct{}{})
+	return ret, nil
+}
+
+// LiveVMs returns the number of the VMs that are not yet garbage collected, across the configs.
+// The VMs of a config are freed after Envoy destroys it, so that a count growing with the config
+// updates is a leak.
+func LiveVMs() int64 {
+	return javaScriptLiveVMs.Load()
+}
+
+// call invokes fn with the configured limits applied.
+func (v *javaScriptVM) call(fn goja.Callable, args ...goja.Value) (ret goja.Value, err error) {
+	err = v.run(func() error {
+		ret, err = fn(goja.Undefined(), args...)
+		return err
+	})
+	return ret, err
+}
+
+// run runs f, which runs JavaScript on the VM, with a watchdog interrupting it when it exceeds the
+// max_execution_time_ms or the max_memory_bytes limit.
+func (v *javaScriptVM) run(f func() error) error {
+	// The interrupts of the size limits are cleared too, as they may land after the script ended.
+	defer v.ClearInterrupt()
+	if v.limits.MaxExecutionTimeMs <= 0 && v.limits.MaxMemoryBytes <= 0 {
+		return f()
+	}
+	var deadline time.Time
+	if v.limits.MaxExecutionTimeMs > 0 {
+		deadline = time.Now().Add(time.Duration(v.limits.MaxExecutionTimeMs) * time.Millisecond)
+	}
+	next := func() time.Duration {
+		if v.limits.MaxMemoryBytes > 0 {
+			return javaScriptWatchdogInterval
+		}
+		return time.Until(deadline)
+	}
+	allocs := javaScriptHeapAllocs()
+
+	// mux orders the checks of the watchdog with the end of f, so that no interrupt lands on the
+	// VM once run returns.
+	var (
+		mux   sync.Mutex
+		done  bool
+		timer *time.Timer
+	)
+	check := func() {
+		mux.Lock()
+		defer mux.Unlock()
+		switch {
+		case done:
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			v.Interrupt(errJavaScriptExecutionTimeout)
+		case v.limits.MaxMemoryBytes > 0 && javaScriptHeapAllocs()-allocs > uint64(v.limits.MaxMemoryBytes):
+			v.Interrupt(errJavaScriptMemoryLimitExceeded)
+		default:
+			timer.Reset(next())
+		}
+	}
+	mux.Lock()
+	timer = time.AfterFunc(next(), check)
+	mux.Unlock()
+
+	err := f()
+	mux.Lock()
+	done = true
+	timer.Stop()
+	mux.Unlock()
+	return err
+}
+
+// javaScriptHeapAllocs returns the cumulative bytes allocated on the heap by the process.
+func javaScriptHeapAllocs() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// setSizeLimits wraps the builtins that build strings and arrays to enforce the max_string_length
+// and max_array_length limits inside the VM. The builtins that take the size from their arguments
+// are checked before they allocate, and the others once they return.
+func (v *javaScriptVM) setSizeLimits() error {
+	if v.limits.MaxStringLength > 0 {
+		stringProto := v.Get("String").ToObject(v.Runtime).Get("prototype").ToObject(v.Runtime)
+		for _, name := range []string{"repeat", "padStart", "padEnd"} {
+			err := v.wrapBuiltin(stringProto, name, func(call goja.FunctionCall) {
+				size := call.Argument(0).ToInteger()
+				if name == "repeat" {
+					size *= int64(len(call.This.String()))
+				}
+				if size > int64(v.limits.MaxStringLength) {
+					v.exceeded(errJavaScriptStringTooLong)
+				}
+			}, v.checkString)
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range []string{"concat", "replace", "replaceAll"} {
+			if err := v.wrapBuiltin(stringProto, name, nil, v.checkString); err != nil {
+				return err
+			}
+		}
+		arrayProto := v.Get("Array").ToObject(v.Runtime).Get("prototype").ToObject(v.Runtime)
+		if err := v.wrapBuiltin(arrayProto, "join", nil, v.checkString); err != nil {
+			return err
+		}
+		if err := v.wrapBuiltin(v.Get("JSON").ToObject(v.Runtime), "stringify", nil, v.checkString); err != nil {
+			return err
+		}
+	}
+	if v.limits.MaxArrayLength > 0 {
+		// The array builtins growing this are checked on this, and the others on their result.
+		checkThis := func(call goja.FunctionCall, _ goja.Value) { v.checkArray(call, call.This) }
+		arrayProto := v.Get("Array").ToObject(v.Runtime).Get("prototype").ToObject(v.Runtime)
+		for _, name := range []string{"push", "unshift", "splice", "fill"} {
+			if err := v.wrapBuiltin(arrayProto, name, nil, checkThis); err != nil {
+				return err
+			}
+		}
+		if err := v.wrapBuiltin(arrayProto, "concat", nil, v.checkArray); err != nil {
+			return err
+		}
+		array := v.Get("Array").ToObject(v.Runtime)
+		for _, name := range []string{"from", "of"} {
+			if err := v.wrapBuiltin(array, name, nil, v.checkArray); err != nil {
+				return err
+			}
+		}
+		stringProto := v.Get("String").ToObject(v.Runtime).Get("prototype").ToObject(v.Runtime)
+		if err := v.wrapBuiltin(stringProto, "split", nil, v.checkArray); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapBuiltin replaces the builtin function of obj with one calling before, then the builtin,
+// then after with its result.
+func (v *javaScriptVM) wrapBuiltin(obj *goja.Object, name string, before func(goja.FunctionCall), after func(goja.FunctionCall, goja.Value)) error {
+	builtin, ok := goja.AssertFunction(obj.Get(name))
+	if !ok {
+		return fmt.Errorf("failed to get the %s builtin", name)
+	}
+	return obj.DefineDataProperty(name, v.ToValue(func(call goja.FunctionCall) goja.Value {
+		if before != nil {
+			before(call)
+		}
+		ret, err := builtin(call.This, call.Arguments...)
+		if err != nil {
+			// The exceptions and the interrupts propagate as if the builtin was called directly.
+			panic(err)
+		}
+		if after != nil {
+			after(call, ret)
+		}
+		return ret
+	}), goja.FLAG_TRUE, goja.FLAG_FALSE, goja.FLAG_TRUE)
+}
+
+// checkString is the check of the builtins returning a string against max_string_length.
+func (v *javaScriptVM) checkString(_ goja.FunctionCall, value goja.Value) {
+	if s, ok := value.(goja.String); ok && s.Length() > v.limits.MaxStringLength {
+		v.exceeded(errJavaScriptStringTooLong)
+	}
+}
+
+// checkArray is the check of the builtins returning an array against max_array_length.
+func (v *javaScriptVM) checkArray(_ goja.FunctionCall, value goja.Value) {
+	if obj, ok := value.(*goja.Object); ok && obj.ClassName() == "Array" && obj.Get("length").ToInteger() > int64(v.limits.MaxArrayLength) {
+		v.exceeded(errJavaScriptArrayTooLong)
+	}
+}
+
+// exceeded fails the running hook with err. The exception thrown could be caught by the script, so
+// the VM is interrupted too.
+func (v *javaScriptVM) exceeded(err error) {
+	v.Interrupt(err)
+	panic(v.NewGoError(err))
+}
+
+// exportString converts the value passed from the script to a Go string. This fails the hook if
+// the string exceeds the max_string_length limit.
+func (v *javaScriptVM) exportString(value goja.Value) string {
+	s := value.String()
+	if limit := v.limits.MaxStringLength; limit > 0 && len(s) > limit {
+		v.exceeded(errJavaScriptStringTooLong)
+	}
+	return s
+}
+
+// isJavaScriptLimitError returns true if err is caused by exceeding one of [javaScriptLimits].
+func isJavaScriptLimitError(err error) bool {
+	var stackOverflow *goja.StackOverflowError
+	return errors.As(err, &stackOverflow) ||
+		errors.Is(err, errJavaScriptExecutionTimeout) ||
+		errors.Is(err, errJavaScriptStringTooLong) ||
+		errors.Is(err, errJavaScriptArrayTooLong) ||
+		errors.Is(err, errJavaScriptMemoryLimitExceeded)
+}
+
+// handleError logs the error returned by the hook and recycles the VM if it exceeded a limit. The
+// hooks stop the iteration on an error, so the stream is replied to with a 500 rather than left to
+// the stream timeout.
+func (p *javaScriptFilter) handleError(hook string, err error) {
+	log.Printf("failed to call %s: %v", hook, err)
+	detail := "javascript_error"
+	if isJavaScriptLimitError(err) {
+		p.factory.recycle(p.vm)
+		detail = "javascript_limit_exceeded"
+	}
+	p.handle.SendLocalResponse(http.StatusInternalServerError, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte("Internal Server Error\n"), detail)
+}
+
+// setIterationFunctions sets the functions that control the iteration to the ctx object:
+//
+//   - `stopIteration(): void`: Stops the iteration as if the hook returned "stop".
+//   - `schedule(delayMs: Number, callback: Function): void`: Calls callback after delayMs on the
+//     worker thread. The callback receives an object with `continueRequest()` and `continueResponse()`
+//     which resume the iteration stopped by the hook.
+func (p *javaScriptFilter) setIterationFunctions(vm *javaScriptVM, obj *goja.Object, stopped *bool) {
+	_ = obj.Set("stopIteration", func(goja.FunctionCall) goja.Value {
+		*stopped = true
+		return goja.Undefined()
+	})
+	_ = obj.Set("schedule", func(call goja.FunctionCall) goja.Value {
+		delay := time.Duration(call.Argument(0).ToInteger()) * time.Millisecond
+		callback, ok := goja.AssertFunction(call.Argument(1))
+		if !ok {
+			panic(vm.NewTypeError("schedule: callback must be a function"))
+		}
+		scheduler := p.handle.GetScheduler()
+		go func() {
+			time.Sleep(delay)
+			scheduler.Schedule(func() { p.runScheduled(vm, callback) })
+		}()
+		return goja.Undefined()
+	})
+}
+
+// setMetadataFunctions sets the functions that access the metadata to the ctx object:
+//
+//   - `getMetadata(namespace: String, key: String, source?: String): String | Number | undefined`:
+//     Gets the metadata value. source is one of "dynamic" (default), "route", "cluster", "host",
+//     and "host_locality".
+//   - `setMetadata(namespace: String, key: String, value: String | Number): void`: Sets the
+//     dynamic metadata value.
+func (p *javaScriptFilter) setMetadataFunctions(vm *javaScriptVM, obj *goja.Object) {
+	_ = obj.Set("getMetadata", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 2 {
+			return goja.Undefined()
+		}
+		namespace := call.Argument(0).String()
+		key := call.Argument(1).String()
+		source := shared.MetadataSourceTypeDynamic
+		if len(call.Arguments) > 2 {
+			var ok bool
+			source, ok = javaScriptMetadataSources[call.Argument(2).String()]
+			if !ok {
+				panic(vm.NewTypeError("getMetadata: invalid source %q", call.Argument(2).String()))
+			}
+		}
+		if value, ok := p.handle.GetMetadataString(source, namespace, key); ok {
+			// The value is a view of the Envoy owned memory, so copy it before handing it to the VM.
+			return vm.ToValue(strings.Clone(value))
+		}
+		if value, ok := p.handle.GetMetadataNumber(source, namespace, key); ok {
+			return vm.ToValue(value)
+		}
+		return goja.Undefined()
+	})
+	_ = obj.Set("setMetadata", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 3 {
+			return goja.Undefined()
+		}
+		namespace := vm.exportString(call.Argument(0))
+		key := vm.exportString(call.Argument(1))
+		switch value := call.Argument(2).Export().(type) {
+		case int64, float64:
+			p.handle.SetMetadata(namespace, key, value)
+		case string:
+			p.handle.SetMetadata(namespace, key, vm.exportString(call.Argument(2)))
+		default:
+			panic(vm.NewTypeError("setMetadata: value must be a string or a number"))
+		}
+		return goja.Undefined()
+	})
+}
+
+// runScheduled runs the callback passed to ctx.schedule on the worker thread.
+func (p *javaScriptFilter) runScheduled(vm *javaScriptVM, callback goja.Callable) {
+	vm.mux.Lock()
+	defer vm.mux.Unlock()
+	obj := vm.NewObject()
+	_ = obj.Set("continueRequest", func(goja.FunctionCall) goja.Value {
+		p.handle.ContinueRequest()
+		return goja.Undefined()
+	})
+	_ = obj.Set("continueResponse", func(goja.FunctionCall) goja.Value {
+		p.handle.ContinueResponse()
+		return goja.Undefined()
+	})
+	if _, err := vm.call(callback, obj); err != nil {
+		p.handleError("scheduled callback", err)
+	}
+}
+
+// hookStatus returns the status decided by a hook: the returned value if any, otherwise "stop"
+// if stopIteration was called, otherwise "continue".
+func hookStatus(ret goja.Value, stopped bool) string {
+	if ret != nil && !goja.IsUndefined(ret) && !goja.IsNull(ret) {
+		return ret.String()
+	}
+	if stopped {
+		return javaScriptStatusStop
+	}
+	return javaScriptStatusContinue
+}
+
+// headersStatus converts the value returned by a hook to [shared.HeadersStatus].
+func headersStatus(hook string, ret goja.Value, stopped bool) shared.HeadersStatus {
+	switch status := hookStatus(ret, stopped); status {
+	case javaScriptStatusContinue:
+		return shared.HeadersStatusContinue
+	case javaScriptStatusStop:
+		return shared.HeadersStatusStop
+	case javaScriptStatusBuffer:
+		return shared.HeadersStatusStopAllAndBuffer
+	default:
+		log.Printf("invalid status %q returned from %s", status, hook)
+		return shared.HeadersStatusContinue
+	}
+}
+
+// trailersStatus converts the value returned by a hook to [shared.TrailersStatus].
+// There's nothing left to buffer at the trailers phase, so "buffer" is the same as "stop".
+func trailersStatus(hook string, ret goja.Value, stopped bool) shared.TrailersStatus {
+	switch status := hookStatus(ret, stopped); status {
+	case javaScriptStatusContinue:
+		return shared.TrailersStatusContinue
+	case javaScriptStatusStop, javaScriptStatusBuffer:
+		return shared.TrailersStatusStop
+	default:
+		log.Printf("invalid status %q returned from %s", status, hook)
+		return shared.TrailersStatusContinue
+	}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *javaScriptFilter) OnRequestHeaders(headers shared.HeaderMap, _ bool) shared.HeadersStatus {
+	// The headers are views of the Envoy owned memory, and are kept for the later phases.
+	for _, header := range headers.GetAll() {
+		p.requestHeaders[strings.Clone(header[0])] = strings.Clone(header[1])
+	}
+	p.vm.mux.Lock()
+	defer p.vm.mux.Unlock()
+	vm := p.vm
+	obj := vm.NewObject()
+	_ = obj.Set("getRequestHeader", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 1 {
+			return vm.ToValue("")
+		}
+		key := call.Argument(0).String()
+		return vm.ToValue(p.requestHeaders[key])
+	})
+	_ = obj.Set("setRequestHeader", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 2 {
+			return goja.Undefined()
+		}
+		key := vm.exportString(call.Argument(0))
+		value := vm.exportString(call.Argument(1))
+		p.requestHeaders[key] = value
+		headers.Set(key, value)
+		return goja.Undefined()
+	})
+	var stopped bool
+	p.setIterationFunctions(vm, obj, &stopped)
+	p.setMetadataFunctions(vm, obj)
+	ret, err := vm.call(vm.onRequestHeaders, obj)
+	if err != nil {
+		p.handleError(javaScriptExportedSymbolOnRequestHeaders, err)
+		return shared.HeadersStatusStop
+	}
+	return headersStatus(javaScriptExportedSymbolOnRequestHeaders, ret, stopped)
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *javaScriptFilter) OnResponseHeaders(headers shared.HeaderMap, _ bool) shared.HeadersStatus {
+	// The headers are views of the Envoy owned memory, and are kept for the later phases.
+	for _, header := range headers.GetAll() {
+		p.responseHeaders[strings.Clone(header[0])] = strings.Clone(header[1])
+	}
+	p.vm.mux.Lock()
+	defer p.vm.mux.Unlock()
+	vm := p.vm
+	obj := vm.NewObject()
+	_ = obj.Set("getRequestHeader", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 1 {
+			return vm.ToValue("")
+		}
+		key := call.Argument(0).String()
+		return vm.ToValue(p.requestHeaders[key])
+	})
+
+	// Setting request header in response phase is not allowed.
+
+	_ = obj.Set("getResponseHeader", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 1 {
+			return vm.ToValue("")
+		}
+		key := call.Argument(0).String()
+		return vm.ToValue(p.responseHeaders[key])
+	})
+	_ = obj.Set("setResponseHeader", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 2 {
+			return goja.Undefined()
+		}
+		key := vm.exportString(call.Argument(0))
+		value := vm.exportString(call.Argument(1))
+		p.responseHeaders[key] = value
+		headers.Set(key, value)
+		return goja.Undefined()
+	})
+	var stopped bool
+	p.setIterationFunctions(vm, obj, &stopped)
+	p.setMetadataFunctions(vm, obj)
+	ret, err := vm.call(vm.onResponseHeaders, obj)
+	if err != nil {
+		p.handleError(javaScriptExportedSymbolOnResponseHeaders, err)
+		return shared.HeadersStatusStop
+	}
+	return headersStatus(javaScriptExportedSymbolOnResponseHeaders, ret, stopped)
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *javaScriptFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.vm.onRequestTrailers == nil {
+		return shared.TrailersStatusContinue
+	}
+	return p.callTrailersHook(javaScriptExportedSymbolOnRequestTrailers, p.vm.onRequestTrailers, trailers)
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *javaScriptFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.vm.onResponseTrailers == nil {
+		return shared.TrailersStatusContinue
+	}
+	return p.callTrailersHook(javaScriptExportedSymbolOnResponseTrailers, p.vm.onResponseTrailers, trailers)
+}
+
+// callTrailersHook calls the trailers hook with the ctx object that has the following properties:
+//
+//   - `getRequestHeader(name: String): String`: Function to get a request header value.
+//   - `getTrailer(name: String): String`: Function to get a trailer value.
+//   - `setTrailer(name: String, value: String): void`: Function to set a trailer value.
+//   - The functions set by [javaScriptFilter.setIterationFunctions] and [javaScriptFilter.setMetadataFunctions].
+func (p *javaScriptFilter) callTrailersHook(hook string, fn goja.Callable, trailers shared.HeaderMap) shared.TrailersStatus {
+	p.vm.mux.Lock()
+	defer p.vm.mux.Unlock()
+	vm := p.vm
+	obj := vm.NewObject()
+	_ = obj.Set("getRequestHeader", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 1 {
+			return vm.ToValue("")
+		}
+		key := call.Argument(0).String()
+		return vm.ToValue(p.requestHeaders[key])
+	})
+	_ = obj.Set("getTrailer", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 1 {
+			return vm.ToValue("")
+		}
+		key := call.Argument(0).String()
+		// The value is a view of the Envoy owned memory, so copy it before handing it to the VM.
+		return vm.ToValue(strings.Clone(trailers.GetOne(key)))
+	})
+	_ = obj.Set("setTrailer", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 2 {
+			return goja.Undefined()
+		}
+		key := vm.exportString(call.Argument(0))
+		value := vm.exportString(call.Argument(1))
+		trailers.Set(key, value)
+		return goja.Undefined()
+	})
+	var stopped bool
+	p.setIterationFunctions(vm, obj, &stopped)
+	p.setMetadataFunctions(vm, obj)
+	ret, err := vm.call(fn, obj)
+	if err != nil {
+		p.handleError(hook, err)
+		return shared.TrailersStatusStop
+	}
+	return trailersStatus(hook, ret, stopped)
+}
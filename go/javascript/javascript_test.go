@@ -0,0 +1,112 @@
+package javascript
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+)
+
+func TestOnConfigurePerVMQuietSetsUpEveryVM(t *testing.T) {
+	config := `{
+		"script": "var greeting; function OnConfigure() { greeting = 'hello'; } function OnRequestHeaders(ctx) {} function OnResponseHeaders(ctx) {}",
+		"on_configure": "per_vm_quiet",
+		"concurrency": 3
+	}`
+	factory, err := (&FilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := factory.(*javaScriptFilterFactory)
+	// The VMs past min_vms are created lazily, and the first one is recycled.
+	f.vm(1)
+	f.vm(2)
+	f.recycle(f.vms[0].Load())
+	for i := range f.vms {
+		if got := f.vms[i].Load().GlobalObject().Get("greeting").String(); got != "hello" {
+			t.Errorf("greeting of VM %d = %q, want %q", i, got, "hello")
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name, limits, onRequestHeaders string
+	}{
+		{
+			name:             "call stack",
+			limits:           `{"max_call_stack_size": 100}`,
+			onRequestHeaders: `function f() { f(); } f();`,
+		},
+		{
+			name:             "execution time",
+			limits:           `{"max_execution_time_ms": 50}`,
+			onRequestHeaders: `for (;;) {}`,
+		},
+		{
+			name:             "string built in the VM",
+			limits:           `{"max_string_length": 1024}`,
+			onRequestHeaders: `let s = 'a'; for (;;) { s = s.concat(s); }`,
+		},
+		{
+			name:             "string repeated in the VM",
+			limits:           `{"max_string_length": 1024}`,
+			onRequestHeaders: `'a'.repeat(1 << 30);`,
+		},
+		{
+			name:             "caught string limit",
+			limits:           `{"max_string_length": 1024}`,
+			onRequestHeaders: `try { 'a'.repeat(2048); } catch (e) {} for (;;) {}`,
+		},
+		{
+			name:             "string passed to the host",
+			limits:           `{"max_string_length": 1024}`,
+			onRequestHeaders: `let s = 'a'; for (let i = 0; i < 11; i++) { s += s; } ctx.setRequestHeader('x-long', s);`,
+		},
+		{
+			name:             "array",
+			limits:           `{"max_array_length": 1024}`,
+			onRequestHeaders: `const a = []; for (;;) { a.push(0); }`,
+		},
+		{
+			name:             "memory",
+			limits:           `{"max_memory_bytes": 16777216, "max_execution_time_ms": 10000}`,
+			onRequestHeaders: `let s = 'a'; const a = []; for (;;) { s += 'a'; a[a.length] = s; }`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := `{
+				"script": "function OnConfigure() {} function OnRequestHeaders(ctx) { ` + tc.onRequestHeaders + ` } function OnResponseHeaders(ctx) {}",
+				"limits": ` + tc.limits + `,
+				"concurrency": 1
+			}`
+			factory, err := (&FilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm := factory.(*javaScriptFilterFactory).vms[0].Load()
+			h := filtertest.NewHandle()
+			h.Do(func() {
+				factory.Create(h).OnRequestHeaders(filtertest.NewHeaderMap(), true)
+			})
+			if detail := h.RequireLocalReply(t, http.StatusInternalServerError).Detail; detail != "javascript_limit_exceeded" {
+				t.Fatalf("local reply detail = %q, want %q", detail, "javascript_limit_exceeded")
+			}
+			if factory.(*javaScriptFilterFactory).vms[0].Load() == vm {
+				t.Fatal("the VM that exceeded the limit wasn't recycled")
+			}
+		})
+	}
+}
+
+func TestOnConfigureExecutionTime(t *testing.T) {
+	config := `{
+		"script": "function OnConfigure() { for (;;) {} } function OnRequestHeaders(ctx) {} function OnResponseHeaders(ctx) {}",
+		"limits": {"max_execution_time_ms": 50}
+	}`
+	_, err := (&FilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(config))
+	if !errors.Is(err, errJavaScriptExecutionTimeout) {
+		t.Fatalf("Create() = %v, want %v", err, errJavaScriptExecutionTimeout)
+	}
+}
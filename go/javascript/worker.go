@@ -0,0 +1,32 @@
+package javascript
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// javaScriptWorkerSlots are the slots assigned to the threads calling the filter by thread ID.
+	javaScriptWorkerSlots sync.Map
+	// javaScriptNextWorkerSlot is the slot assigned to the next thread seen.
+	javaScriptNextWorkerSlot atomic.Int64
+)
+
+// javaScriptWorkerSlot returns the slot of the Envoy worker thread calling the filter, numbered
+// from zero in the order the workers are first seen, so that the filters of a worker always get
+// the same VM of the pool.
+//
+// The SDK doesn't tell the worker, but the Go code called from Envoy runs on the calling thread,
+// so the thread ID identifies it. Where the thread ID is not available, the slots are handed out
+// round-robin, and the VMs are shared by the workers as before.
+func javaScriptWorkerSlot() int {
+	tid, ok := javaScriptThreadID()
+	if !ok {
+		return int(javaScriptNextWorkerSlot.Add(1) - 1)
+	}
+	if slot, ok := javaScriptWorkerSlots.Load(tid); ok {
+		return slot.(int)
+	}
+	slot, _ := javaScriptWorkerSlots.LoadOrStore(tid, int(javaScriptNextWorkerSlot.Add(1)-1))
+	return slot.(int)
+}
@@ -0,0 +1,8 @@
+package javascript
+
+import "syscall"
+
+// javaScriptThreadID returns the ID of the calling thread.
+func javaScriptThreadID() (int, bool) {
+	return syscall.Gettid(), true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package javascript
+
+// javaScriptThreadID returns false, as the thread ID is only available on Linux.
+func javaScriptThreadID() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/bodypool"
+)
+
+const (
+	jsonSchemaDefaultMaxBodyBytes = 1 << 20
+	// jsonSchemaMaxCachedSchemas is the number of the compiled schemas kept in [jsonSchemas].
+	jsonSchemaMaxCachedSchemas = 256
+)
+
+// jsonSchemas caches the compiled schemas by the hash of their location and contents, so that the
+// routes and the configs using the same schema share a single compiled copy, and an unchanged
+// schema is not compiled again when Envoy updates the config. The cache is bounded, as every
+// change of a schema file adds an entry, and the evicted schemas stay alive as long as the configs
+// using them.
+var jsonSchemas = &jsonSchemaCache{entries: make(map[string]*list.Element), order: list.New()}
+
+type (
+	// jsonSchemaFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	jsonSchemaFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// jsonSchemaFilterConfig is the JSON configuration of the JSON Schema filter. The same format
+	// is used for the per-route configuration, which overrides the filter configuration.
+	jsonSchemaFilterConfig struct {
+		// Schema is the inline schema. Draft 2020-12 is assumed unless $schema says otherwise.
+		Schema json.RawMessage `json:"schema"`
+		// SchemaFile is the path to the schema, used if Schema is not set. The relative $refs are
+		// resolved against the file.
+		SchemaFile string `json:"schema_file"`
+		// Disabled turns the validation off, typically on a route.
+		Disabled bool `json:"disabled"`
+		// MaxBodyBytes is the maximum size of the request bodies validated. Larger bodies are
+		// rejected with 413. Defaults to 1 MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// jsonSchemaCache is a least recently used cache of the compiled schemas.
+	jsonSchemaCache struct {
+		mux     sync.Mutex
+		entries map[string]*list.Element
+		// order has the most recently used entry at the front.
+		order *list.List
+	}
+	jsonSchemaCacheEntry struct {
+		key    string
+		schema *jsonschema.Schema
+	}
+	// jsonSchemaConfig is a parsed configuration.
+	jsonSchemaConfig struct {
+		// schema is nil if the validation is disabled.
+		schema       *jsonschema.Schema
+		maxBodyBytes int
+	}
+	// jsonSchemaFilterFactory implements [shared.HttpFilterFactory].
+	jsonSchemaFilterFactory struct {
+		config    *jsonSchemaConfig
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// jsonSchemaFilter implements [shared.HttpFilter].
+	//
+	// Only the requests with a body are validated, so the schema of a route doesn't get in the
+	// way of its GET requests.
+	jsonSchemaFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *jsonSchemaFilterFactory
+		config  *jsonSchemaConfig
+		// validating is set while the body is being buffered.
+		validating bool
+		body       []byte
+		shared.EmptyHttpFilter
+	}
+	// jsonSchemaViolation is an entry of the violations in the error responses.
+	jsonSchemaViolation struct {
+		// Location is the JSON pointer to the invalid value in the body.
+		Location string `json:"location"`
+		Message  string `json:"message"`
+	}
+	// jsonSchemaErrorBody is the body of the error responses.
+	jsonSchemaErrorBody struct {
+		Message    string                `json:"message"`
+		Violations []jsonSchemaViolation `json:"violations,omitempty"`
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *jsonSchemaFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	config, err := parseJSONSchemaConfig(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	f := &jsonSchemaFilterFactory{config: config}
+	id, res := handle.DefineCounter("json_schema_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the json schema counter: %v", res)
+	}
+	return f, nil
+}
+
+// CreatePerRoute implements [shared.HttpFilterConfigFactory].
+func (p *jsonSchemaFilterConfigFactory) CreatePerRoute(unparsedConfig []byte) (any, error) {
+	return parseJSONSchemaConfig(unparsedConfig)
+}
+
+func parseJSONSchemaConfig(unparsedConfig []byte) (*jsonSchemaConfig, error) {
+	var config jsonSchemaFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse json schema config: %w", err)
+		}
+	}
+	parsed := &jsonSchemaConfig{maxBodyBytes: config.MaxBodyBytes}
+	if parsed.maxBodyBytes <= 0 {
+		parsed.maxBodyBytes = jsonSchemaDefaultMaxBodyBytes
+	}
+	if config.Disabled {
+		return parsed, nil
+	}
+	var err error
+	switch {
+	case len(config.Schema) > 0:
+		parsed.schema, err = compileJSONSchema("inline.json", config.Schema)
+	case config.SchemaFile != "":
+		var path string
+		var data []byte
+		if path, err = filepath.Abs(config.SchemaFile); err == nil {
+			data, err = os.ReadFile(path)
+		}
+		if err == nil {
+			parsed.schema, err = compileJSONSchema((&url.URL{Scheme: "file", Path: path}).String(), data)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// compileJSONSchema compiles the schema at the location, or returns the cached one.
+func compileJSONSchema(location string, data []byte) (*jsonschema.Schema, error) {
+	h := sha256.New()
+	h.Write([]byte(location))
+	h.Write([]byte{0})
+	h.Write(data)
+	key := hex.EncodeToString(h.Sum(nil))
+	if schema := jsonSchemas.get(key); schema != nil {
+		return schema, nil
+	}
+
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the schema %s: %w", location, err)
+	}
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	c.AssertFormat()
+	if err := c.AddResource(location, doc); err != nil {
+		return nil, fmt.Errorf("failed to add the schema %s: %w", location, err)
+	}
+	schema, err := c.Compile(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile the schema %s: %w", location, err)
+	}
+	return jsonSchemas.put(key, schema), nil
+}
+
+// get returns the schema cached under key, or nil if there is none.
+func (c *jsonSchemaCache) get(key string) *jsonschema.Schema {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*jsonSchemaCacheEntry).schema
+}
+
+// put stores the schema under key, evicting the least recently used entry if the cache is full.
+// If another config compiled the same schema concurrently, that copy is kept and returned.
+func (c *jsonSchemaCache) put(key string, schema *jsonschema.Schema) *jsonschema.Schema {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*jsonSchemaCacheEntry).schema
+	}
+	if c.order.Len() >= jsonSchemaMaxCachedSchemas {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*jsonSchemaCacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&jsonSchemaCacheEntry{key: key, schema: schema})
+	return schema
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *jsonSchemaFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &jsonSchemaFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *jsonSchemaFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.config = p.factory.config
+	if routeConfig, ok := p.handle.GetMostSpecificConfig().(*jsonSchemaConfig); ok {
+		p.config = routeConfig
+	}
+	if p.config.schema == nil || endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		p.reject(http.StatusUnsupportedMediaType, "unsupported_media_type", "request body must be JSON", nil)
+		return shared.HeadersStatusStop
+	}
+	p.validating = true
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *jsonSchemaFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.validating {
+		return shared.BodyStatusContinue
+	}
+	if len(p.body)+int(body.GetSize()) > p.config.maxBodyBytes {
+		bodypool.Put(p.body)
+		p.validating, p.body = false, nil
+		p.reject(http.StatusRequestEntityTooLarge, "too_large", "request body too large", nil)
+		return shared.BodyStatusStopNoBuffer
+	}
+	p.body = bodypool.Append(p.body, body)
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if !p.validate() {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *jsonSchemaFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.validating && !p.validate() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// validate validates the buffered body, and returns false if the request is rejected.
+func (p *jsonSchemaFilter) validate() bool {
+	p.validating = false
+	body := p.body
+	p.body = nil
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	bodypool.Put(body)
+	if err != nil {
+		p.reject(http.StatusBadRequest, "malformed", "request body is not valid JSON",
+			[]jsonSchemaViolation{{Location: "", Message: err.Error()}})
+		return false
+	}
+	err = p.config.schema.Validate(doc)
+	var validationErr *jsonschema.ValidationError
+	if errors.As(err, &validationErr) {
+		p.reject(http.StatusBadRequest, "invalid", "request body does not match the schema", jsonSchemaViolations(validationErr))
+		return false
+	}
+	p.count("valid")
+	return true
+}
+
+func (p *jsonSchemaFilter) reject(status int, result, message string, violations []jsonSchemaViolation) {
+	p.count(result)
+	body, _ := json.Marshal(jsonSchemaErrorBody{Message: message, Violations: violations})
+	p.handle.SendLocalResponse(uint32(status), [][2]string{{"Content-Type", "application/json"}},
+		append(body, '\n'), "json_schema_"+result)
+}
+
+func (p *jsonSchemaFilter) count(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
+
+// jsonSchemaViolations returns the leaf errors of the validation error, which are the ones that
+// say what is actually wrong rather than which subschema failed.
+func jsonSchemaViolations(err *jsonschema.ValidationError) []jsonSchemaViolation {
+	var violations []jsonSchemaViolation
+	for _, unit := range err.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		violations = append(violations, jsonSchemaViolation{Location: unit.InstanceLocation, Message: unit.Error.String()})
+	}
+	slices.SortStableFunc(violations, func(a, b jsonSchemaViolation) int { return strings.Compare(a.Location, b.Location) })
+	return violations
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestJSONSchemaCacheBounded(t *testing.T) {
+	compile := func(i int) {
+		t.Helper()
+		if _, err := compileJSONSchema("inline.json", []byte(`{"maxLength": `+strconv.Itoa(i)+`}`)); err != nil {
+			t.Fatalf("compileJSONSchema() = %v", err)
+		}
+	}
+	first, err := compileJSONSchema("inline.json", []byte(`{"maxLength": 0}`))
+	if err != nil {
+		t.Fatalf("compileJSONSchema() = %v", err)
+	}
+	// Every change of a schema file compiles a new schema.
+	for i := 1; i <= 2*jsonSchemaMaxCachedSchemas; i++ {
+		compile(i)
+	}
+	jsonSchemas.mux.Lock()
+	n := len(jsonSchemas.entries)
+	jsonSchemas.mux.Unlock()
+	if n > jsonSchemaMaxCachedSchemas {
+		t.Fatalf("%d cached schemas, want at most %d", n, jsonSchemaMaxCachedSchemas)
+	}
+	if again, _ := compileJSONSchema("inline.json", []byte(`{"maxLength": 0}`)); again == first {
+		t.Fatal("the least recently used schema wasn't evicted")
+	}
+}
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	jsonXMLFormatJSON = "json"
+	jsonXMLFormatXML  = "xml"
+
+	jsonXMLArrayStyleRepeat = "repeat"
+	jsonXMLArrayStyleWrap   = "wrap"
+
+	jsonXMLDefaultMaxBodyBytes = 1 << 20
+)
+
+// jsonXMLMediaTypes are the Content-Type header values of the converted bodies by format.
+var jsonXMLMediaTypes = map[string]string{
+	jsonXMLFormatJSON: "application/json",
+	jsonXMLFormatXML:  "application/xml; charset=utf-8",
+}
+
+// jsonXMLElementCases converts the JSON keys into the XML element names by element_case.
+var jsonXMLElementCases = map[string]func(words []string) string{
+	"as_is": nil,
+	"snake_case": func(words []string) string {
+		return strings.ToLower(strings.Join(words, "_"))
+	},
+	"kebab-case": func(words []string) string {
+		return strings.ToLower(strings.Join(words, "-"))
+	},
+	"camelCase": func(words []string) string {
+		var b strings.Builder
+		for i, w := range words {
+			if i == 0 {
+				b.WriteString(strings.ToLower(w))
+			} else {
+				b.WriteString(capitalize(w))
+			}
+		}
+		return b.String()
+	},
+	"PascalCase": func(words []string) string {
+		var b strings.Builder
+		for _, w := range words {
+			b.WriteString(capitalize(w))
+		}
+		return b.String()
+	},
+}
+
+type (
+	// jsonXMLFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	jsonXMLFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// jsonXMLFilterConfig is the JSON configuration of the JSON/XML conversion filter.
+	jsonXMLFilterConfig struct {
+		// UpstreamFormat is the format the upstream speaks: "json" or "xml". The request bodies in
+		// the other format are converted, and the Accept header is rewritten to ask the upstream
+		// for this format. Defaults to "json".
+		UpstreamFormat string `json:"upstream_format"`
+		// RootElement is the name of the root element of the XML documents converted from JSON.
+		// The root element is dropped when converting XML into JSON. Defaults to "root".
+		RootElement string `json:"root_element"`
+		// ItemElement is the name of the elements of the arrays that have no name of their own,
+		// such as the top-level and the nested arrays. An element whose children are all named so
+		// is converted into a JSON array. Defaults to "item".
+		ItemElement string `json:"item_element"`
+		// AttributePrefix marks the JSON keys converted from and into the XML attributes.
+		// Defaults to "@".
+		AttributePrefix string `json:"attribute_prefix"`
+		// TextKey is the JSON key of the text of the XML elements that also have attributes or
+		// children. Defaults to "#text".
+		TextKey string `json:"text_key"`
+		// ElementCase converts the JSON keys into the XML element names: "as_is", "snake_case",
+		// "kebab-case", "camelCase", or "PascalCase". Defaults to "as_is". Either way, the
+		// characters not allowed in the XML names are replaced with "_".
+		ElementCase string `json:"element_case"`
+		// ArrayStyle is how the JSON arrays in the objects are converted into XML: "repeat" repeats
+		// the element of the key for each item, and "wrap" puts the ItemElement elements in the
+		// element of the key. Defaults to "repeat".
+		ArrayStyle string `json:"array_style"`
+		// InferTypes converts the XML text that looks like a JSON number, boolean, or null into it
+		// rather than into a string.
+		InferTypes bool `json:"infer_types"`
+		// MaxBodyBytes is the maximum size of the bodies converted. Larger request bodies are
+		// rejected with 413, and larger response bodies are let through unconverted.
+		// Defaults to 1 MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// jsonXMLFilterFactory implements [shared.HttpFilterFactory].
+	jsonXMLFilterFactory struct {
+		config      jsonXMLFilterConfig
+		elementCase func(words []string) string
+		conversions shared.MetricID
+		hasMetric   bool
+	}
+	// jsonXMLFilter implements [shared.HttpFilter].
+	//
+	// The bodies are buffered since neither format can be converted before the end of the value
+	// being converted is known, and the headers are held until then so that Content-Type and
+	// Content-Length can be set for the converted body.
+	jsonXMLFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *jsonXMLFilterFactory
+		// accept is the format the client prefers, or empty if it has no preference.
+		accept string
+		// headers and target are set while a body is being buffered for the conversion into the
+		// target format.
+		headers shared.HeaderMap
+		target  string
+		body    []byte
+		shared.EmptyHttpFilter
+	}
+	// orderedJSON is a JSON value that keeps the order of the object members.
+	orderedJSON struct {
+		// kind is '{', '[', or 0 for the scalars.
+		kind    byte
+		members []orderedJSONMember
+		items   []*orderedJSON
+		// scalar is the decoded scalar: a string, a [json.Number], a bool, or nil.
+		scalar any
+	}
+	orderedJSONMember struct {
+		key   string
+		value *orderedJSON
+	}
+	// xmlNode is a parsed XML element.
+	xmlNode struct {
+		name     string
+		attrs    []xml.Attr
+		children []*xmlNode
+		text     strings.Builder
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *jsonXMLFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config jsonXMLFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse json xml config: %w", err)
+		}
+	}
+	switch config.UpstreamFormat {
+	case "":
+		config.UpstreamFormat = jsonXMLFormatJSON
+	case jsonXMLFormatJSON, jsonXMLFormatXML:
+	default:
+		return nil, fmt.Errorf("unknown upstream_format %q", config.UpstreamFormat)
+	}
+	switch config.ArrayStyle {
+	case "":
+		config.ArrayStyle = jsonXMLArrayStyleRepeat
+	case jsonXMLArrayStyleRepeat, jsonXMLArrayStyleWrap:
+	default:
+		return nil, fmt.Errorf("unknown array_style %q", config.ArrayStyle)
+	}
+	if config.ElementCase == "" {
+		config.ElementCase = "as_is"
+	}
+	elementCase, ok := jsonXMLElementCases[config.ElementCase]
+	if !ok {
+		return nil, fmt.Errorf("unknown element_case %q", config.ElementCase)
+	}
+	if config.RootElement == "" {
+		config.RootElement = "root"
+	}
+	if config.ItemElement == "" {
+		config.ItemElement = "item"
+	}
+	if config.AttributePrefix == "" {
+		config.AttributePrefix = "@"
+	}
+	if config.TextKey == "" {
+		config.TextKey = "#text"
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = jsonXMLDefaultMaxBodyBytes
+	}
+	f := &jsonXMLFilterFactory{config: config, elementCase: elementCase}
+	id, res := handle.DefineCounter("json_xml_conversions_total", "direction", "result")
+	if res == shared.MetricsSuccess {
+		f.conversions, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the json xml counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *jsonXMLFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &jsonXMLFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *jsonXMLFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	upstream := p.factory.config.UpstreamFormat
+	p.accept = preferredJSONXMLFormat(strings.Join(headers.Get("accept"), ","))
+	if p.accept != "" && p.accept != upstream {
+		headers.Set("accept", jsonXMLMediaTypes[upstream])
+	}
+	if endOfStream || jsonXMLFormat(headers.GetOne("content-type")) != otherJSONXMLFormat(upstream) {
+		return shared.HeadersStatusContinue
+	}
+	if cl, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && cl > p.factory.config.MaxBodyBytes {
+		p.reject(http.StatusRequestEntityTooLarge, "Request body too large\n")
+		return shared.HeadersStatusStop
+	}
+	p.headers, p.target = headers, upstream
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *jsonXMLFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.target == "" {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.target = ""
+		p.reject(http.StatusRequestEntityTooLarge, "Request body too large\n")
+		return shared.BodyStatusStopNoBuffer
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if !p.convertRequest(body) {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *jsonXMLFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.target != "" && !p.convertRequest(nil) {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+func (p *jsonXMLFilter) convertRequest(body shared.BodyBuffer) bool {
+	converted, err := p.convert()
+	if err != nil {
+		p.count("request", "error")
+		p.reject(http.StatusBadRequest, fmt.Sprintf("Malformed request body: %v\n", err))
+		return false
+	}
+	p.count("request", "converted")
+	replaceBody(p.handle.BufferedRequestBody(), body, converted)
+	return true
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *jsonXMLFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream || p.accept == "" || jsonXMLFormat(headers.GetOne("content-type")) != otherJSONXMLFormat(p.accept) {
+		return shared.HeadersStatusContinue
+	}
+	if cl, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && cl > p.factory.config.MaxBodyBytes {
+		return shared.HeadersStatusContinue
+	}
+	p.headers, p.target = headers, p.accept
+	return shared.HeadersStatusStop
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *jsonXMLFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.target == "" {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.handle.Log(shared.LogLevelWarn, "not converting the response body larger than %d bytes",
+			p.factory.config.MaxBodyBytes)
+		p.count("response", "too_large")
+		p.target, p.headers, p.body = "", nil, nil
+		return shared.BodyStatusContinue
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	p.convertResponse(body)
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *jsonXMLFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.target != "" {
+		p.convertResponse(nil)
+	}
+	return shared.TrailersStatusContinue
+}
+
+// convertResponse converts the buffered response body. A body that fails to convert is let
+// through as is since the upstream is the one to blame.
+func (p *jsonXMLFilter) convertResponse(body shared.BodyBuffer) {
+	headers := p.headers
+	converted, err := p.convert()
+	if err != nil {
+		p.handle.Log(shared.LogLevelWarn, "failed to convert the response body: %v", err)
+		p.count("response", "error")
+		return
+	}
+	p.count("response", "converted")
+	headers.Add("vary", "Accept")
+	replaceBody(p.handle.BufferedResponseBody(), body, converted)
+}
+
+// convert converts the buffered body into the target format, and sets the headers for it.
+func (p *jsonXMLFilter) convert() ([]byte, error) {
+	config := &p.factory.config
+	headers, target, body := p.headers, p.target, p.body
+	p.headers, p.target, p.body = nil, "", nil
+	var converted []byte
+	var err error
+	if target == jsonXMLFormatXML {
+		converted, err = jsonToXML(body, config, p.factory.elementCase)
+	} else {
+		converted, err = xmlToJSON(body, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	headers.Set("content-type", jsonXMLMediaTypes[target])
+	headers.Set("content-length", strconv.Itoa(len(converted)))
+	return converted, nil
+}
+
+// buffer copies the chunks of the body, and returns false if the body exceeds the limit.
+func (p *jsonXMLFilter) buffer(body shared.BodyBuffer) bool {
+	if len(p.body)+int(body.GetSize()) > p.factory.config.MaxBodyBytes {
+		return false
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	return true
+}
+
+func (p *jsonXMLFilter) reject(status uint32, message string) {
+	p.handle.SendLocalResponse(status, [][2]string{{"Content-Type", "text/plain"}}, []byte(message), "json_xml_rejected")
+}
+
+func (p *jsonXMLFilter) count(direction, result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.conversions, 1, direction, result)
+	}
+}
+
+// replaceBody replaces the whole body, the earlier chunks of which are in buffered and the last
+// one in body. body is nil if the body ended with the trailers.
+func replaceBody(buffered, body shared.BodyBuffer, data []byte) {
+	buffered.Drain(buffered.GetSize())
+	if body == nil {
+		buffered.Append(data)
+		return
+	}
+	body.Drain(body.GetSize())
+	body.Append(data)
+}
+
+// jsonXMLFormat returns the format of the Content-Type header value, or empty if it is neither.
+func jsonXMLFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	switch {
+	case err != nil:
+		return ""
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return jsonXMLFormatJSON
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return jsonXMLFormatXML
+	}
+	return ""
+}
+
+func otherJSONXMLFormat(format string) string {
+	if format == jsonXMLFormatJSON {
+		return jsonXMLFormatXML
+	}
+	return jsonXMLFormatJSON
+}
+
+// preferredJSONXMLFormat returns the format with the higher quality in the Accept header value,
+// or empty if neither is preferred.
+func preferredJSONXMLFormat(accept string) string {
+	jsonQ := max(acceptQuality(accept, "application/json"), 0)
+	xmlQ := max(acceptQuality(accept, "application/xml"), acceptQuality(accept, "text/xml"))
+	switch {
+	case xmlQ > jsonQ:
+		return jsonXMLFormatXML
+	case jsonQ > xmlQ:
+		return jsonXMLFormatJSON
+	}
+	return ""
+}
+
+// acceptQuality returns the quality value of the media type in the Accept header value by the most
+// specific matching range, or 0 if none matches.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		var s int
+		switch {
+		case name == mediaType:
+			s = 2
+		case name == typ+"/*":
+			s = 1
+		case name == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		specificity, q = s, 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(k, "q") {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+	}
+	return q
+}
+
+// jsonToXML converts the JSON document into XML, wrapping it in the root element.
+func jsonToXML(data []byte, config *jsonXMLFilterConfig, elementCase func([]string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeOrderedJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+	enc := xml.NewEncoder(&out)
+	w := &xmlWriter{enc: enc, config: config, elementCase: elementCase}
+	w.element(config.RootElement, v)
+	if w.err == nil {
+		w.err = enc.Flush()
+	}
+	return out.Bytes(), w.err
+}
+
+func decodeOrderedJSON(dec *json.Decoder) (*orderedJSON, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return &orderedJSON{scalar: tok}, nil
+	}
+	v := &orderedJSON{kind: byte(delim)}
+	for dec.More() {
+		if v.kind == '{' {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			v.members = append(v.members, orderedJSONMember{key: key.(string), value: value})
+		} else {
+			item, err := decodeOrderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			v.items = append(v.items, item)
+		}
+	}
+	// The closing delimiter.
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// encodeOrderedJSON writes the value as compact JSON in the order it was decoded in.
+func encodeOrderedJSON(out *bytes.Buffer, v *orderedJSON) {
+	switch v.kind {
+	case '{':
+		out.WriteByte('{')
+		for i, m := range v.members {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			encoded, _ := json.Marshal(m.key)
+			out.Write(encoded)
+			out.WriteByte(':')
+			encodeOrderedJSON(out, m.value)
+		}
+		out.WriteByte('}')
+	case '[':
+		out.WriteByte('[')
+		for i, item := range v.items {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			encodeOrderedJSON(out, item)
+		}
+		out.WriteByte(']')
+	default:
+		switch s := v.scalar.(type) {
+		case string:
+			encoded, _ := json.Marshal(s)
+			out.Write(encoded)
+		case json.Number:
+			out.WriteString(s.String())
+		case bool:
+			out.WriteString(strconv.FormatBool(s))
+		default:
+			out.WriteString("null")
+		}
+	}
+}
+
+// xmlWriter writes the JSON values as XML, and keeps the first error.
+type xmlWriter struct {
+	enc         *xml.Encoder
+	config      *jsonXMLFilterConfig
+	elementCase func([]string) string
+	err         error
+}
+
+func (w *xmlWriter) token(t xml.Token) {
+	if w.err == nil {
+		w.err = w.enc.EncodeToken(t)
+	}
+}
+
+func (w *xmlWriter) element(name string, v *orderedJSON) {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch v.kind {
+	case '{':
+		var children []orderedJSONMember
+		var text *orderedJSON
+		for _, m := range v.members {
+			switch {
+			case m.key == w.config.TextKey && m.value.kind == 0:
+				text = m.value
+			case strings.HasPrefix(m.key, w.config.AttributePrefix) && m.value.kind == 0:
+				name := w.name(strings.TrimPrefix(m.key, w.config.AttributePrefix))
+				start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: name}, Value: jsonScalarText(m.value.scalar)})
+			default:
+				children = append(children, m)
+			}
+		}
+		w.token(start)
+		if text != nil {
+			w.token(xml.CharData(jsonScalarText(text.scalar)))
+		}
+		for _, m := range children {
+			name := w.name(m.key)
+			if m.value.kind == '[' && w.config.ArrayStyle == jsonXMLArrayStyleRepeat {
+				for _, item := range m.value.items {
+					w.element(name, item)
+				}
+				continue
+			}
+			w.element(name, m.value)
+		}
+	case '[':
+		w.token(start)
+		for _, item := range v.items {
+			w.element(w.config.ItemElement, item)
+		}
+	default:
+		w.token(start)
+		if v.scalar != nil {
+			w.token(xml.CharData(jsonScalarText(v.scalar)))
+		}
+	}
+	w.token(start.End())
+}
+
+// name returns the XML element or attribute name of the JSON key.
+func (w *xmlWriter) name(key string) string {
+	if w.elementCase != nil {
+		key = w.elementCase(splitWords(key))
+	}
+	return sanitizeXMLName(key)
+}
+
+func jsonScalarText(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// splitWords splits the key into the words by the separators and the case changes, so that
+// "userID", "user_id", and "user-id" all become ["user", "ID"] or ["user", "id"].
+func splitWords(s string) []string {
+	var words []string
+	runes := []rune(s)
+	start := 0
+	for i := 0; i <= len(runes); i++ {
+		if i == len(runes) || runes[i] == '_' || runes[i] == '-' || unicode.IsSpace(runes[i]) {
+			if i > start {
+				words = append(words, string(runes[start:i]))
+			}
+			start = i + 1
+			continue
+		}
+		// A word starts at an upper case letter after a lower case one, or at the last upper case
+		// letter of an acronym followed by a lower case one as in "HTTPServer".
+		if i > start && unicode.IsUpper(runes[i]) &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return words
+}
+
+func capitalize(w string) string {
+	r := []rune(strings.ToLower(w))
+	if len(r) > 0 {
+		r[0] = unicode.ToUpper(r[0])
+	}
+	return string(r)
+}
+
+// sanitizeXMLName replaces the characters not allowed in the XML names with "_", and prefixes the
+// names that don't start with a letter or "_", or start with the reserved "xml".
+func sanitizeXMLName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+		case i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+		case i == 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+			b.WriteByte('_')
+		default:
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	s := b.String()
+	if s == "" || (len(s) >= 3 && strings.EqualFold(s[:3], "xml")) {
+		s = "_" + s
+	}
+	return s
+}
+
+// xmlToJSON converts the XML document into JSON. The root element is dropped, so its content
+// becomes the JSON value.
+func xmlToJSON(data []byte, config *jsonXMLFilterConfig) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.CharsetReader = xmlCharsetReader
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name.Local, attrs: t.Attr}
+			switch {
+			case len(stack) > 0:
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			case root != nil:
+				return nil, fmt.Errorf("multiple root elements")
+			default:
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+	var out bytes.Buffer
+	writeXMLNodeJSON(&out, root, config)
+	return out.Bytes(), nil
+}
+
+// xmlCharsetReader decodes the documents declaring the encodings other than UTF-8 that are common
+// enough to bother with: US-ASCII, which is a subset of UTF-8, and ISO-8859-1.
+func xmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "latin1":
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", charset)
+}
+
+func writeXMLNodeJSON(out *bytes.Buffer, n *xmlNode, config *jsonXMLFilterConfig) {
+	text := strings.TrimSpace(n.text.String())
+	var attrs []xml.Attr
+	for _, a := range n.attrs {
+		// The namespace declarations are not data.
+		if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" {
+			attrs = append(attrs, a)
+		}
+	}
+	if len(attrs) == 0 && len(n.children) == 0 {
+		writeXMLTextJSON(out, text, config.InferTypes)
+		return
+	}
+	if len(attrs) == 0 && text == "" && allNamed(n.children, config.ItemElement) {
+		out.WriteByte('[')
+		for i, c := range n.children {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeXMLNodeJSON(out, c, config)
+		}
+		out.WriteByte(']')
+		return
+	}
+
+	out.WriteByte('{')
+	first := true
+	key := func(k string) {
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+		encoded, _ := json.Marshal(k)
+		out.Write(encoded)
+		out.WriteByte(':')
+	}
+	for _, a := range attrs {
+		key(config.AttributePrefix + a.Name.Local)
+		writeXMLTextJSON(out, a.Value, config.InferTypes)
+	}
+	if text != "" {
+		key(config.TextKey)
+		writeXMLTextJSON(out, text, config.InferTypes)
+	}
+	// The repeated elements become an array at the position of the first one.
+	written := make(map[string]bool)
+	for _, c := range n.children {
+		if written[c.name] {
+			continue
+		}
+		written[c.name] = true
+		var same []*xmlNode
+		for _, s := range n.children {
+			if s.name == c.name {
+				same = append(same, s)
+			}
+		}
+		key(c.name)
+		if len(same) == 1 {
+			writeXMLNodeJSON(out, c, config)
+			continue
+		}
+		out.WriteByte('[')
+		for i, s := range same {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeXMLNodeJSON(out, s, config)
+		}
+		out.WriteByte(']')
+	}
+	out.WriteByte('}')
+}
+
+func writeXMLTextJSON(out *bytes.Buffer, text string, inferTypes bool) {
+	if inferTypes {
+		switch text {
+		case "true", "false", "null":
+			out.WriteString(text)
+			return
+		}
+		if json.Valid([]byte(text)) && text != "" && (text[0] == '-' || (text[0] >= '0' && text[0] <= '9')) {
+			out.WriteString(text)
+			return
+		}
+	}
+	encoded, _ := json.Marshal(text)
+	out.Write(encoded)
+}
+
+func allNamed(nodes []*xmlNode, name string) bool {
+	for _, n := range nodes {
+		if n.name != name {
+			return false
+		}
+	}
+	return len(nodes) > 0
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/golden"
+)
+
+func TestJSONXMLGolden(t *testing.T) {
+	factory, err := (&jsonXMLFilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(`{"upstream_format": "xml"}`))
+	if err != nil {
+		t.Fatalf("failed to create the filter factory: %v", err)
+	}
+	golden.Run(t, "testdata/json_xml", factory)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// liveFiltersEnv is the environment variable of Envoy that turns on the counting of the filters
+// when true.
+const liveFiltersEnv = "GO_MODULE_LIVE_FILTERS"
+
+var (
+	// liveConfigs are the numbers of the filter configs that are not yet garbage collected, by
+	// the filter name. It is only written by withLiveConfigs at the init, so it is read without a
+	// lock.
+	liveConfigs = map[string]*atomic.Int64{}
+	// liveFilters are the counts of the filters by the filter name, if turned on with the
+	// GO_MODULE_LIVE_FILTERS environment variable. Like liveConfigs, it is only written at the
+	// init.
+	liveFilters = map[string]*liveFilterCounts{}
+)
+
+type (
+	// liveConfigFilterConfigFactory implements [shared.HttpFilterConfigFactory] by wrapping the
+	// factory of a filter so that its configs are counted in liveConfigs.
+	//
+	// The SDK has no hook for the destruction of a config: Envoy destroys it after a listener
+	// update drained the streams using it, and the SDK then drops the factory. The count is
+	// decremented when the factory is garbage collected, so that the configs leaked by a filter,
+	// for example, through a goroutine that is never stopped, show up on the debug server.
+	liveConfigFilterConfigFactory struct {
+		live    *atomic.Int64
+		filters *liveFilterCounts
+		shared.HttpFilterConfigFactory
+	}
+	// liveConfigFilterFactory implements [shared.HttpFilterFactory].
+	liveConfigFilterFactory struct {
+		filters *liveFilterCounts
+		shared.HttpFilterFactory
+	}
+	// liveFilterCounts are the counts of the filters of a filter name.
+	//
+	// The SDK pins each filter until Envoy destroys it, after the stream completed. A filter that
+	// is never unpinned, or that is kept by a goroutine after it was, stays live after the garbage
+	// collection, which shows up on the debug server long before it adds up to an OOM. The pins
+	// themselves are internal to the SDK, so the filters are counted by the module instead.
+	liveFilterCounts struct {
+		// inFlight are the filters created whose stream has not completed yet.
+		inFlight atomic.Int64
+		// live are the filters not yet garbage collected.
+		live atomic.Int64
+	}
+	// liveFilter implements [shared.HttpFilter] by counting the wrapped filter in
+	// [liveFilterCounts].
+	liveFilter struct {
+		counts    *liveFilterCounts
+		completed bool
+		shared.HttpFilter
+	}
+)
+
+// withLiveConfigs wraps the factories with [liveConfigFilterConfigFactory]. The filters are
+// counted too if turned on with the GO_MODULE_LIVE_FILTERS environment variable. It is off by
+// default, as each filter is then wrapped and tracked by the garbage collector.
+func withLiveConfigs(factories map[string]shared.HttpFilterConfigFactory) map[string]shared.HttpFilterConfigFactory {
+	countFilters, _ := strconv.ParseBool(os.Getenv(liveFiltersEnv))
+	wrapped := make(map[string]shared.HttpFilterConfigFactory, len(factories))
+	for name, factory := range factories {
+		live := &atomic.Int64{}
+		liveConfigs[name] = live
+		if countFilters {
+			liveFilters[name] = &liveFilterCounts{}
+		}
+		wrapped[name] = &liveConfigFilterConfigFactory{live: live, filters: liveFilters[name], HttpFilterConfigFactory: factory}
+	}
+	return wrapped
+}
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *liveConfigFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	factory, err := p.HttpFilterConfigFactory.Create(handle, unparsedConfig)
+	if err != nil || factory == nil {
+		return factory, err
+	}
+	// The wrapper is what the SDK holds, so it is collected with the config rather than the
+	// factory, which the filter may share across its configs.
+	wrapped := &liveConfigFilterFactory{filters: p.filters, HttpFilterFactory: factory}
+	p.live.Add(1)
+	runtime.AddCleanup(wrapped, func(live *atomic.Int64) { live.Add(-1) }, p.live)
+	return wrapped, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *liveConfigFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	filter := p.HttpFilterFactory.Create(handle)
+	if p.filters == nil || filter == nil {
+		return filter
+	}
+	wrapped := &liveFilter{counts: p.filters, HttpFilter: filter}
+	p.filters.inFlight.Add(1)
+	p.filters.live.Add(1)
+	runtime.AddCleanup(wrapped, func(counts *liveFilterCounts) { counts.live.Add(-1) }, p.filters)
+	return wrapped
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *liveFilter) OnStreamComplete() {
+	if !p.completed {
+		p.completed = true
+		p.counts.inFlight.Add(-1)
+	}
+	p.HttpFilter.OnStreamComplete()
+}
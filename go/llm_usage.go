@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	// llmUsageDefaultTenantHeader is the header the api_key filter sets from the tenant of the key.
+	llmUsageDefaultTenantHeader       = "x-api-key-tenant"
+	llmUsageDefaultUsageHeaderPrefix  = "x-llm-usage-"
+	llmUsageDefaultMaxBodyBytes       = 1 << 20
+	llmUsageDefaultCharactersPerToken = 4
+	llmUsageMetadataNamespace         = "llm_usage"
+)
+
+type (
+	// llmUsageFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	llmUsageFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// llmUsageFilterConfig is the JSON configuration of the LLM usage filter.
+	llmUsageFilterConfig struct {
+		// TenantHeader is the request header the usage is attributed to. Defaults to
+		// "x-api-key-tenant", which the api_key filter sets.
+		TenantHeader string `json:"tenant_header"`
+		// HashTenant replaces the tenant with a hash of it in the metrics, for when the tenant
+		// header is a secret such as an API key.
+		HashTenant bool `json:"hash_tenant"`
+		// UsageHeaderPrefix is the prefix of the response headers with the usage, followed by
+		// "input-tokens", "output-tokens", "total-tokens" and "estimated". The streaming responses
+		// have sent their headers before the usage is known, so it is only in the metrics and the
+		// dynamic metadata for them. Defaults to "x-llm-usage-".
+		UsageHeaderPrefix string `json:"usage_header_prefix"`
+		// MaxBodyBytes is the maximum size of the request and of the non-streaming response bodies
+		// inspected. Defaults to 1MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+		// CharactersPerToken is used to estimate the tokens of the text when the API doesn't
+		// report the usage. Defaults to 4, which is about right for English.
+		CharactersPerToken float64 `json:"characters_per_token"`
+	}
+	// llmUsageFilterFactory implements [shared.HttpFilterFactory].
+	llmUsageFilterFactory struct {
+		config    llmUsageFilterConfig
+		tokens    shared.MetricID
+		hasMetric bool
+	}
+	// llmUsageFilter implements [shared.HttpFilter].
+	//
+	// This filter understands the chat completions API of OpenAI and the messages API of
+	// Anthropic, both streaming and not, and the APIs compatible with them.
+	llmUsageFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *llmUsageFilterFactory
+		tenant  string
+		// request is the request body while it's being copied.
+		request         []byte
+		requestTooLarge bool
+		// requestCharacters is the number of characters of the prompt, for the estimation.
+		requestCharacters int
+		// format is "json" or "sse" if the response is accounted.
+		format string
+		// headers is the held response headers of a JSON response.
+		headers shared.HeaderMap
+		// body is the JSON response body, or the incomplete line of an SSE response.
+		body  []byte
+		usage llmUsage
+		done  bool
+		shared.EmptyHttpFilter
+	}
+	// llmUsage is the usage found in the response.
+	llmUsage struct {
+		model string
+		// input and output are the reported tokens, or -1 if not reported.
+		input, output int
+		// outputCharacters is the number of characters generated, for the estimation.
+		outputCharacters int
+	}
+	// llmEvent is a response body, or an event of a streaming response. It has the fields of the
+	// different APIs, as only one is present at a time.
+	llmEvent struct {
+		Model string `json:"model"`
+		Usage *struct {
+			PromptTokens     *int `json:"prompt_tokens"`
+			CompletionTokens *int `json:"completion_tokens"`
+			InputTokens      *int `json:"input_tokens"`
+			OutputTokens     *int `json:"output_tokens"`
+		} `json:"usage"`
+		Choices []struct {
+			Text    llmText `json:"text"`
+			Message struct {
+				Content llmText `json:"content"`
+			} `json:"message"`
+			Delta struct {
+				Content llmText `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+		Content llmText `json:"content"`
+		// Message is the message of the message_start event of Anthropic.
+		Message *llmEvent `json:"message"`
+		// Delta is the delta of the content_block_delta event of Anthropic.
+		Delta struct {
+			Text llmText `json:"text"`
+		} `json:"delta"`
+	}
+	// llmRequest is the request body of the different APIs.
+	llmRequest struct {
+		Model    string  `json:"model"`
+		System   llmText `json:"system"`
+		Prompt   llmText `json:"prompt"`
+		Messages []struct {
+			Content llmText `json:"content"`
+		} `json:"messages"`
+	}
+	// llmText is a text that is either a string, or an array of content blocks with the text in
+	// their text field.
+	llmText string
+)
+
+// UnmarshalJSON implements [json.Unmarshaler].
+func (t *llmText) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		var blocks []struct {
+			Text llmText `json:"text"`
+		}
+		if err := json.Unmarshal(data, &blocks); err != nil {
+			return err
+		}
+		var text strings.Builder
+		for _, block := range blocks {
+			text.WriteString(string(block.Text))
+		}
+		*t = llmText(text.String())
+		return nil
+	}
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Such as the content blocks of the images.
+		return nil
+	}
+	if s != nil {
+		*t = llmText(*s)
+	}
+	return nil
+}
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *llmUsageFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config llmUsageFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse LLM usage config: %w", err)
+		}
+	}
+	if config.TenantHeader == "" {
+		config.TenantHeader = llmUsageDefaultTenantHeader
+	}
+	if config.UsageHeaderPrefix == "" {
+		config.UsageHeaderPrefix = llmUsageDefaultUsageHeaderPrefix
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = llmUsageDefaultMaxBodyBytes
+	}
+	if config.CharactersPerToken <= 0 {
+		config.CharactersPerToken = llmUsageDefaultCharactersPerToken
+	}
+	f := &llmUsageFilterFactory{config: config}
+	id, res := handle.DefineCounter("llm_tokens_total", "tenant", "model", "type", "source")
+	if res == shared.MetricsSuccess {
+		f.tokens, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the LLM usage counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *llmUsageFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &llmUsageFilter{handle: handle, factory: p, usage: llmUsage{input: -1, output: -1}}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *llmUsageFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.tenant = "unknown"
+	if tenant := headers.GetOne(p.factory.config.TenantHeader); tenant != "" {
+		if p.factory.config.HashTenant {
+			sum := sha256.Sum256([]byte(tenant))
+			p.tenant = "sha256:" + hex.EncodeToString(sum[:8])
+		} else {
+			p.tenant = strings.Clone(tenant)
+		}
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *llmUsageFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	// The request is copied as it goes upstream, as it is only needed for the estimation.
+	if !p.requestTooLarge {
+		if len(p.request)+int(body.GetSize()) > p.factory.config.MaxBodyBytes {
+			p.request, p.requestTooLarge = nil, true
+		} else {
+			for _, chunk := range body.GetChunks() {
+				p.request = append(p.request, chunk...)
+			}
+		}
+	}
+	if endOfStream {
+		p.parseRequest()
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *llmUsageFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	p.parseRequest()
+	return shared.TrailersStatusContinue
+}
+
+func (p *llmUsageFilter) parseRequest() {
+	body := p.request
+	p.request = nil
+	var request llmRequest
+	if len(body) == 0 || json.Unmarshal(body, &request) != nil {
+		return
+	}
+	p.usage.model = request.Model
+	p.requestCharacters = utf8.RuneCountInString(string(request.System)) + utf8.RuneCountInString(string(request.Prompt))
+	for _, message := range request.Messages {
+		p.requestCharacters += utf8.RuneCountInString(string(message.Content))
+	}
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *llmUsageFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	// The errors are not billed.
+	if endOfStream || headers.GetOne(":status") != "200" {
+		return shared.HeadersStatusContinue
+	}
+	mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	switch {
+	case mediaType == "text/event-stream":
+		p.format = "sse"
+		return shared.HeadersStatusContinue
+	case jsonXMLFormat(mediaType) == jsonXMLFormatJSON:
+		// The headers are held so that the usage headers can be added.
+		p.format, p.headers = "json", headers
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *llmUsageFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	switch p.format {
+	case "sse":
+		for _, chunk := range body.GetChunks() {
+			p.scanEvents(chunk)
+		}
+		if endOfStream {
+			p.finish()
+		}
+		return shared.BodyStatusContinue
+	case "json":
+		if len(p.body)+int(body.GetSize()) > p.factory.config.MaxBodyBytes {
+			// The usage can't be known without the whole body, so it isn't recorded.
+			p.format, p.headers, p.body, p.done = "", nil, nil, true
+			return shared.BodyStatusContinue
+		}
+		for _, chunk := range body.GetChunks() {
+			p.body = append(p.body, chunk...)
+		}
+		if !endOfStream {
+			return shared.BodyStatusStopAndBuffer
+		}
+		p.finishJSON()
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *llmUsageFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	switch p.format {
+	case "sse":
+		p.finish()
+	case "json":
+		p.finishJSON()
+	}
+	return shared.TrailersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *llmUsageFilter) OnStreamComplete() {
+	// An aborted stream is billed for what was generated.
+	if p.format == "sse" {
+		p.finish()
+	}
+}
+
+// scanEvents applies the complete data lines of the SSE response. The incomplete last line is
+// kept for the next chunk.
+func (p *llmUsageFilter) scanEvents(chunk []byte) {
+	p.body = append(p.body, chunk...)
+	for {
+		i := bytes.IndexByte(p.body, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(p.body[:i], []byte("\r"))
+		p.body = p.body[i+1:]
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 || data[0] != '{' {
+			// Such as the "[DONE]" of OpenAI.
+			continue
+		}
+		var event llmEvent
+		if json.Unmarshal(data, &event) == nil {
+			p.usage.apply(&event)
+		}
+	}
+	if len(p.body) > p.factory.config.MaxBodyBytes {
+		p.body = nil
+	}
+}
+
+// finishJSON applies the JSON response body, and adds the usage headers.
+func (p *llmUsageFilter) finishJSON() {
+	headers, body := p.headers, p.body
+	p.format, p.headers, p.body = "", nil, nil
+	var event llmEvent
+	if json.Unmarshal(body, &event) != nil {
+		p.done = true
+		return
+	}
+	p.usage.apply(&event)
+	input, output, estimated := p.tokens()
+	prefix := p.factory.config.UsageHeaderPrefix
+	headers.Set(prefix+"input-tokens", strconv.Itoa(input))
+	headers.Set(prefix+"output-tokens", strconv.Itoa(output))
+	headers.Set(prefix+"total-tokens", strconv.Itoa(input+output))
+	if estimated {
+		headers.Set(prefix+"estimated", "true")
+	}
+	p.finish()
+}
+
+// finish records the usage once.
+func (p *llmUsageFilter) finish() {
+	if p.done {
+		return
+	}
+	p.done = true
+	input, output, _ := p.tokens()
+	model := p.usage.model
+	if model == "" {
+		model = "unknown"
+	}
+	p.handle.SetMetadata(llmUsageMetadataNamespace, "tenant", p.tenant)
+	p.handle.SetMetadata(llmUsageMetadataNamespace, "model", model)
+	p.handle.SetMetadata(llmUsageMetadataNamespace, "input_tokens", input)
+	p.handle.SetMetadata(llmUsageMetadataNamespace, "output_tokens", output)
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.tokens, uint64(input), p.tenant, model, "input", p.source(p.usage.input))
+		p.handle.IncrementCounterValue(p.factory.tokens, uint64(output), p.tenant, model, "output", p.source(p.usage.output))
+	}
+}
+
+// tokens returns the input and output tokens, estimating the ones not reported.
+func (p *llmUsageFilter) tokens() (input, output int, estimated bool) {
+	input, output = p.usage.input, p.usage.output
+	if input < 0 {
+		input, estimated = p.estimate(p.requestCharacters), true
+	}
+	if output < 0 {
+		output, estimated = p.estimate(p.usage.outputCharacters), true
+	}
+	return input, output, estimated
+}
+
+func (p *llmUsageFilter) estimate(characters int) int {
+	return int(math.Ceil(float64(characters) / p.factory.config.CharactersPerToken))
+}
+
+func (p *llmUsageFilter) source(reported int) string {
+	if reported < 0 {
+		return "estimated"
+	}
+	return "reported"
+}
+
+// apply updates the usage with the response body or event. The usage reported by the events is
+// cumulative, so the latest wins.
+func (u *llmUsage) apply(event *llmEvent) {
+	if event.Model != "" {
+		u.model = event.Model
+	}
+	if usage := event.Usage; usage != nil {
+		for _, input := range []*int{usage.PromptTokens, usage.InputTokens} {
+			if input != nil {
+				u.input = *input
+			}
+		}
+		for _, output := range []*int{usage.CompletionTokens, usage.OutputTokens} {
+			if output != nil {
+				u.output = *output
+			}
+		}
+	}
+	for _, choice := range event.Choices {
+		for _, text := range []llmText{choice.Text, choice.Message.Content, choice.Delta.Content} {
+			u.outputCharacters += utf8.RuneCountInString(string(text))
+		}
+	}
+	u.outputCharacters += utf8.RuneCountInString(string(event.Content)) + utf8.RuneCountInString(string(event.Delta.Text))
+	if event.Message != nil {
+		u.apply(event.Message)
+	}
+}
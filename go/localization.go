@@ -0,0 +1,213 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const localizationDefaultHeader = "x-locale"
+
+type (
+	// localizationFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	localizationFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// localizationFilterConfig is the JSON configuration of the localization filter.
+	localizationFilterConfig struct {
+		// SupportedLocales are the locales the service has, such as "en-US" and "fr".
+		SupportedLocales []string `json:"supported_locales" example:"[en-US, fr]"`
+		// DefaultLocale is the locale when none of the client matches. Defaults to the first of
+		// SupportedLocales.
+		DefaultLocale string `json:"default_locale"`
+		// Header is the request header the locale is set in. Defaults to "x-locale".
+		Header string `json:"header"`
+		// Redirect redirects the requests without a locale prefix in the path, such as "/about",
+		// to the path prefixed with the locale, such as "/fr/about". A locale prefix always wins
+		// over Accept-Language, so that the links to a locale work.
+		Redirect bool `json:"redirect"`
+		// RedirectExcludedPrefixes are the paths not redirected, such as "/api/" and "/static/".
+		RedirectExcludedPrefixes []string `json:"redirect_excluded_prefixes"`
+	}
+	// localizationFilterFactory implements [shared.HttpFilterFactory].
+	localizationFilterFactory struct {
+		config    localizationFilterConfig
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// localizationFilter implements [shared.HttpFilter].
+	localizationFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *localizationFilterFactory
+		locale  string
+		// negotiated is set if the locale was picked by Accept-Language, so the responses vary on it.
+		negotiated bool
+		shared.EmptyHttpFilter
+	}
+	// languageRange is a language range of Accept-Language with its quality value.
+	languageRange struct {
+		tag string
+		q   float64
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *localizationFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config localizationFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse localization config: %w", err)
+	}
+	if len(config.SupportedLocales) == 0 {
+		return nil, fmt.Errorf("supported_locales must be set")
+	}
+	for _, locale := range config.SupportedLocales {
+		if locale == "" || strings.ContainsAny(locale, "/,; ") {
+			return nil, fmt.Errorf("invalid locale %q", locale)
+		}
+	}
+	if config.DefaultLocale == "" {
+		config.DefaultLocale = config.SupportedLocales[0]
+	} else if !slices.Contains(config.SupportedLocales, config.DefaultLocale) {
+		return nil, fmt.Errorf("default_locale %q is not supported", config.DefaultLocale)
+	}
+	if config.Header == "" {
+		config.Header = localizationDefaultHeader
+	}
+	f := &localizationFilterFactory{config: config}
+	id, res := handle.DefineCounter("localization_requests_total", "locale", "source")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the localization counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *localizationFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &localizationFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *localizationFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	path := headers.GetOne(":path")
+	if p.locale = p.factory.pathLocale(path); p.locale != "" {
+		p.record("path")
+		headers.Set(config.Header, p.locale)
+		return shared.HeadersStatusContinue
+	}
+	p.locale, p.negotiated = p.factory.negotiate(strings.Join(headers.Get("accept-language"), ",")), true
+	if config.Redirect && !slices.ContainsFunc(config.RedirectExcludedPrefixes, func(prefix string) bool {
+		return strings.HasPrefix(path, prefix)
+	}) {
+		p.record("redirect")
+		p.handle.SendLocalResponse(http.StatusFound, [][2]string{
+			{"location", "/" + p.locale + path},
+			{"vary", "Accept-Language"},
+			{"cache-control", "private"},
+		}, nil, "localization_redirect")
+		return shared.HeadersStatusStop
+	}
+	p.record("accept_language")
+	headers.Set(config.Header, p.locale)
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *localizationFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.locale == "" {
+		return shared.HeadersStatusContinue
+	}
+	// The upstream knows better which locale the content is in, such as when it has no
+	// translation.
+	if len(headers.Get("content-language")) == 0 {
+		headers.Set("content-language", p.locale)
+	}
+	if p.negotiated {
+		headers.Add("vary", "Accept-Language")
+	}
+	return shared.HeadersStatusContinue
+}
+
+// pathLocale returns the supported locale the path is prefixed with, or empty if there is none.
+func (p *localizationFilterFactory) pathLocale(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	segment, _, _ = strings.Cut(segment, "?")
+	for _, locale := range p.config.SupportedLocales {
+		if strings.EqualFold(segment, locale) {
+			return locale
+		}
+	}
+	return ""
+}
+
+// negotiate returns the supported locale that best matches the Accept-Language header value.
+// Each range, from the highest quality, is matched exactly, then by a supported locale more
+// specific than it, such as "fr-FR" for "fr", and then with its subtags removed one by one, such
+// as "fr" for "fr-CA".
+func (p *localizationFilterFactory) negotiate(acceptLanguage string) string {
+	for _, r := range parseAcceptLanguage(acceptLanguage) {
+		if r.tag == "*" {
+			break
+		}
+		for _, locale := range p.config.SupportedLocales {
+			if strings.EqualFold(locale, r.tag) {
+				return locale
+			}
+		}
+		for _, locale := range p.config.SupportedLocales {
+			if len(locale) > len(r.tag) && strings.EqualFold(locale[:len(r.tag)+1], r.tag+"-") {
+				return locale
+			}
+		}
+		for tag := r.tag; strings.Contains(tag, "-"); {
+			tag = tag[:strings.LastIndex(tag, "-")]
+			for _, locale := range p.config.SupportedLocales {
+				if strings.EqualFold(locale, tag) {
+					return locale
+				}
+			}
+		}
+	}
+	return p.config.DefaultLocale
+}
+
+// parseAcceptLanguage returns the language ranges of the Accept-Language header value from the
+// highest quality, leaving out the ones with q=0.
+func parseAcceptLanguage(acceptLanguage string) []languageRange {
+	var ranges []languageRange
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(k, "q") {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, languageRange{tag: tag, q: q})
+		}
+	}
+	slices.SortStableFunc(ranges, func(a, b languageRange) int { return cmp.Compare(b.q, a.q) })
+	return ranges
+}
+
+func (p *localizationFilter) record(source string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, p.locale, source)
+	}
+}
@@ -4,16 +4,77 @@ import (
 	sdk "github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go"
 	_ "github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/abi"
 	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/javascript"
 )
 
 func main() {}
 
 // init registers HTTP filter config factories.
 func init() {
-	sdk.RegisterHttpFilterConfigFactories(map[string]shared.HttpFilterConfigFactory{
-		"passthrough": &passthroughFilterConfigFactory{},
-		"header_auth": &headerAuthFilterConfigFactory{},
-		"delay":       &delayFilterConfigFactory{},
-		"javascript":  &javaScriptFilterConfigFactory{},
-	})
+	sdk.RegisterHttpFilterConfigFactories(withHookTiming(withLiveConfigs(withRecording(map[string]shared.HttpFilterConfigFactory{
+		"passthrough":          &passthroughFilterConfigFactory{},
+		"header_auth":          &headerAuthFilterConfigFactory{},
+		"delay":                &delayFilterConfigFactory{},
+		"javascript":           &javascript.FilterConfigFactory{},
+		"ratelimit":            &rateLimitFilterConfigFactory{},
+		"basic_auth":           &basicAuthFilterConfigFactory{},
+		"api_key":              &apiKeyFilterConfigFactory{},
+		"compressor":           &compressorFilterConfigFactory{},
+		"cache":                &cacheFilterConfigFactory{},
+		"redis_cache":          &redisCacheFilterConfigFactory{},
+		"shadow":               &shadowFilterConfigFactory{},
+		"ab_test":              &abTestFilterConfigFactory{},
+		"canary":               &canaryFilterConfigFactory{},
+		"ip_filter":            &ipFilterConfigFactory{},
+		"geoip":                &geoIPFilterConfigFactory{},
+		"rule_waf":             &ruleWAFFilterConfigFactory{},
+		"sqli":                 &sqliFilterConfigFactory{},
+		"xss":                  &xssFilterConfigFactory{},
+		"pii_redaction":        &piiRedactionFilterConfigFactory{},
+		"pan_masking":          &panMaskingFilterConfigFactory{},
+		"body_limit":           &bodyLimitFilterConfigFactory{},
+		"response_limit":       &responseLimitFilterConfigFactory{},
+		"circuit_breaker":      &circuitBreakerFilterConfigFactory{},
+		"adaptive_concurrency": &adaptiveConcurrencyFilterConfigFactory{},
+		"openapi":              &openAPIFilterConfigFactory{},
+		"json_schema":          &jsonSchemaFilterConfigFactory{},
+		"json_xml":             &jsonXMLFilterConfigFactory{},
+		"sticky_session":       &stickySessionFilterConfigFactory{},
+		"request_id":           &requestIDFilterConfigFactory{},
+		"trace_context":        &traceContextFilterConfigFactory{},
+		"metrics":              &metricsFilterConfigFactory{},
+		"access_logger":        &accessLoggerFilterConfigFactory{},
+		"otlp_access_log":      &otlpAccessLogFilterConfigFactory{},
+		"audit_log":            &auditLogFilterConfigFactory{},
+		"ext_authz":            &extAuthzFilterConfigFactory{},
+		"xfcc":                 &xfccFilterConfigFactory{},
+		"content_routing":      &contentRoutingFilterConfigFactory{},
+		"soap":                 &soapFilterConfigFactory{},
+		"multipart":            &multipartFilterConfigFactory{},
+		"icap":                 &icapFilterConfigFactory{},
+		"security_headers":     &securityHeadersFilterConfigFactory{},
+		"header_mutation":      &headerMutationFilterConfigFactory{},
+		"maintenance":          &maintenanceFilterConfigFactory{},
+		"coalescing":           &coalescingFilterConfigFactory{},
+		"idempotency":          &idempotencyFilterConfigFactory{},
+		"replay_protection":    &replayProtectionFilterConfigFactory{},
+		"field_encryption":     &fieldEncryptionFilterConfigFactory{},
+		"tokenization":         &tokenizationFilterConfigFactory{},
+		"localization":         &localizationFilterConfigFactory{},
+		"feature_flags":        &featureFlagsFilterConfigFactory{},
+		"cel_policy":           &celPolicyFilterConfigFactory{},
+		"llm_usage":            &llmUsageFilterConfigFactory{},
+		"sse_transform":        &sseTransformFilterConfigFactory{},
+		"ndjson":               &ndjsonFilterConfigFactory{},
+		"image_transform":      &imageTransformFilterConfigFactory{},
+		"static_assets":        &staticAssetsFilterConfigFactory{},
+		"redirect_map":         &redirectMapFilterConfigFactory{},
+		"query_params":         &queryParamsFilterConfigFactory{},
+		"conditional":          &conditionalFilterConfigFactory{},
+		"abi_bench":            &abiBenchFilterConfigFactory{},
+		"debug_server":         &debugServerFilterConfigFactory{},
+		"runtime_tuning":       &runtimeTuningFilterConfigFactory{},
+		"grpc_status":          &grpcStatusFilterConfigFactory{},
+	}))))
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	maintenanceDefaultRetryAfter    = 300
+	maintenanceDefaultCheckInterval = time.Second
+	maintenanceDefaultMessage       = "The service is down for planned maintenance."
+	maintenanceDefaultPage          = `<!DOCTYPE html>
+<html>
+<head><title>Service Unavailable</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>{{.Message}}</p>
+<p>Please try again in {{.RetryAfterMinutes}} minutes.</p>
+</body>
+</html>
+`
+)
+
+type (
+	// maintenanceFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	maintenanceFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// maintenanceFilterConfig is the JSON configuration of the maintenance filter.
+	maintenanceFilterConfig struct {
+		// Enabled turns the maintenance mode on.
+		Enabled bool `json:"enabled"`
+		// FlagFile turns the maintenance mode on while the file exists, so that it can be toggled
+		// with a touch and a rm on the Envoy host without a config push.
+		FlagFile string `json:"flag_file"`
+		// FlagCheckIntervalMs is how often FlagFile is checked. Defaults to 1 second.
+		FlagCheckIntervalMs int `json:"flag_check_interval_ms"`
+		// PathPrefixes are the paths under maintenance. Defaults to all the paths.
+		PathPrefixes []string `json:"path_prefixes"`
+		// RetryAfterSeconds is sent in the Retry-After header. Defaults to 300.
+		RetryAfterSeconds int `json:"retry_after_seconds"`
+		// Message is the message shown on the page.
+		Message string `json:"message"`
+		// PageTemplate is the html/template of the page. The data has the Message,
+		// RetryAfterSeconds, and RetryAfterMinutes fields.
+		PageTemplate string `json:"page_template"`
+		// BypassHeader and BypassToken let the operators through to check on the service before
+		// the maintenance mode is turned off. The header is removed before the request goes
+		// upstream.
+		BypassHeader string `json:"bypass_header"`
+		BypassToken  string `json:"bypass_token"`
+	}
+	// maintenanceFilterFactory implements [shared.HttpFilterFactory].
+	maintenanceFilterFactory struct {
+		config     maintenanceFilterConfig
+		flag       *maintenanceFlag
+		page       []byte
+		retryAfter string
+		requests   shared.MetricID
+		hasMetric  bool
+	}
+	// maintenanceFilter implements [shared.HttpFilter].
+	maintenanceFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *maintenanceFilterFactory
+		shared.EmptyHttpFilter
+	}
+	// maintenanceFlag tracks whether a flag file exists. Like [reloadableFile], the file is checked
+	// lazily at most once per interval across all the worker threads.
+	maintenanceFlag struct {
+		path      string
+		interval  time.Duration
+		on        atomic.Bool
+		lastCheck atomic.Int64
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *maintenanceFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config maintenanceFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse maintenance config: %w", err)
+	}
+	if (config.BypassHeader == "") != (config.BypassToken == "") {
+		return nil, fmt.Errorf("bypass_header and bypass_token must be set together")
+	}
+	config.BypassHeader = strings.ToLower(config.BypassHeader)
+	if config.RetryAfterSeconds <= 0 {
+		config.RetryAfterSeconds = maintenanceDefaultRetryAfter
+	}
+	if config.Message == "" {
+		config.Message = maintenanceDefaultMessage
+	}
+	if config.PageTemplate == "" {
+		config.PageTemplate = maintenanceDefaultPage
+	}
+	tmpl, err := template.New("maintenance").Parse(config.PageTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page_template: %w", err)
+	}
+	// The page doesn't depend on the request, so it is rendered once.
+	var page bytes.Buffer
+	if err = tmpl.Execute(&page, map[string]any{
+		"Message":           config.Message,
+		"RetryAfterSeconds": config.RetryAfterSeconds,
+		"RetryAfterMinutes": (config.RetryAfterSeconds + 59) / 60,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to render page_template: %w", err)
+	}
+	f := &maintenanceFilterFactory{config: config, page: page.Bytes(), retryAfter: strconv.Itoa(config.RetryAfterSeconds)}
+	if config.FlagFile != "" {
+		interval := time.Duration(config.FlagCheckIntervalMs) * time.Millisecond
+		if interval <= 0 {
+			interval = maintenanceDefaultCheckInterval
+		}
+		f.flag = &maintenanceFlag{path: config.FlagFile, interval: interval}
+		f.flag.check()
+		f.flag.lastCheck.Store(time.Now().UnixNano())
+	}
+	id, res := handle.DefineCounter("maintenance_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the maintenance counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *maintenanceFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &maintenanceFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *maintenanceFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	var bypass bool
+	if config.BypassHeader != "" {
+		token := headers.GetOne(config.BypassHeader)
+		bypass = subtle.ConstantTimeCompare([]byte(token), []byte(config.BypassToken)) == 1
+		headers.Remove(config.BypassHeader)
+	}
+	if !p.factory.enabled() || !p.matches(headers.GetOne(":path")) {
+		return shared.HeadersStatusContinue
+	}
+	if bypass {
+		p.record("bypassed")
+		return shared.HeadersStatusContinue
+	}
+	p.record("blocked")
+	p.handle.SendLocalResponse(http.StatusServiceUnavailable, [][2]string{
+		{"Content-Type", "text/html; charset=utf-8"},
+		{"Retry-After", p.factory.retryAfter},
+		{"Cache-Control", "no-store"},
+	}, p.factory.page, "maintenance")
+	return shared.HeadersStatusStop
+}
+
+func (p *maintenanceFilter) matches(path string) bool {
+	if len(p.factory.config.PathPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.factory.config.PathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *maintenanceFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
+
+// enabled returns whether the maintenance mode is on.
+func (p *maintenanceFilterFactory) enabled() bool {
+	if p.config.Enabled {
+		return true
+	}
+	return p.flag != nil && p.flag.isOn()
+}
+
+func (f *maintenanceFlag) isOn() bool {
+	now := time.Now().UnixNano()
+	last := f.lastCheck.Load()
+	if time.Duration(now-last) >= f.interval && f.lastCheck.CompareAndSwap(last, now) {
+		f.check()
+	}
+	return f.on.Load()
+}
+
+func (f *maintenanceFlag) check() {
+	_, err := os.Stat(f.path)
+	f.on.Store(err == nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// metricsMethods are the methods labeled as is. The others are labeled "OTHER", so that a client
+// can't blow up the number of the time series with made up methods.
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+type (
+	// metricsFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	metricsFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// metricsFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// This is the Go counterpart of the metrics filter of the Rust module. The metrics are defined
+	// once per filter config, and the filters only record to them by the IDs.
+	metricsFilterFactory struct {
+		requests    shared.MetricID
+		hasRequests bool
+		duration    shared.MetricID
+		hasDuration bool
+	}
+	// metricsFilter implements [shared.HttpFilter].
+	metricsFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *metricsFilterFactory
+		start   time.Time
+		route   string
+		method  string
+		status  int
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *metricsFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	f := &metricsFilterFactory{}
+	if id, res := handle.DefineCounter("http_requests_total", "route", "method", "response_class"); res == shared.MetricsSuccess {
+		f.requests, f.hasRequests = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the requests counter: %v", res)
+	}
+	if id, res := handle.DefineHistogram("http_request_duration_ms", "route", "method", "response_class"); res == shared.MetricsSuccess {
+		f.duration, f.hasDuration = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the request duration histogram: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *metricsFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &metricsFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *metricsFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.start = time.Now()
+	route, _ := p.handle.GetAttributeString(shared.AttributeIDXdsRouteName)
+	p.route = strings.Clone(route)
+	if p.route == "" {
+		p.route = "unknown"
+	}
+	p.method = "OTHER"
+	if method := headers.GetOne(":method"); metricsMethods[method] {
+		p.method = strings.Clone(method)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *metricsFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.status, _ = strconv.Atoi(headers.GetOne(":status"))
+	return shared.HeadersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+//
+// The request is recorded here rather than at the end of the response, so the requests reset
+// before the response completes are recorded as well.
+func (p *metricsFilter) OnStreamComplete() {
+	if p.start.IsZero() {
+		return
+	}
+	class := responseClass(p.status)
+	if p.factory.hasRequests {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, p.route, p.method, class)
+	}
+	if p.factory.hasDuration {
+		p.handle.RecordHistogramValue(p.factory.duration, uint64(time.Since(p.start).Milliseconds()), p.route, p.method, class)
+	}
+}
+
+// responseClass returns the class of the status code such as "2xx", or "none" if the stream ended
+// without a response.
+func responseClass(status int) string {
+	if status < 100 || status > 599 {
+		return "none"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
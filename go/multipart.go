@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	multipartDefaultMaxParts      = 100
+	multipartDefaultMaxFieldBytes = 64 << 10
+	multipartDefaultMaxFileBytes  = 10 << 20
+	multipartDefaultMaxHoldBytes  = 64 << 10
+	// multipartMaxHeaderBytes is the maximum size of the headers of a part.
+	multipartMaxHeaderBytes = 8 << 10
+	// multipartMaxExtractBytes is the maximum size of a field copied to a header.
+	multipartMaxExtractBytes = 1 << 10
+)
+
+type (
+	// multipartFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	multipartFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// multipartFilterConfig is the JSON configuration of the multipart filter.
+	multipartFilterConfig struct {
+		// MaxParts is the maximum number of the parts. Defaults to 100.
+		MaxParts int `json:"max_parts"`
+		// MaxFieldBytes is the maximum size of a field that is not a file. Defaults to 64KiB.
+		MaxFieldBytes int64 `json:"max_field_bytes"`
+		// MaxFileBytes is the maximum size of a file. Defaults to 10MiB.
+		MaxFileBytes int64 `json:"max_file_bytes"`
+		// AllowedFileTypes are the media types of the files allowed, such as "image/png" or
+		// "image/*". Any type is allowed if empty.
+		AllowedFileTypes []string `json:"allowed_file_types"`
+		// StripFields are the names of the fields removed from the body.
+		StripFields []string `json:"strip_fields"`
+		// AllowedFields, if set, are the only names of the fields kept in the body. The others are
+		// removed.
+		AllowedFields []string `json:"allowed_fields"`
+		// ExtractFields maps the names of the text fields to the request headers they are copied
+		// to. The headers are held until all of these fields are seen, or MaxHoldBytes of the body
+		// is, so the fields should come before the files.
+		ExtractFields map[string]string `json:"extract_fields"`
+		// MaxHoldBytes is the maximum size of the body held while looking for ExtractFields.
+		// Defaults to 64KiB.
+		MaxHoldBytes int `json:"max_hold_bytes"`
+	}
+	// multipartFilterFactory implements [shared.HttpFilterFactory].
+	multipartFilterFactory struct {
+		config        multipartFilterConfig
+		stripFields   map[string]bool
+		allowedFields map[string]bool
+		requests      shared.MetricID
+		stripped      shared.MetricID
+		hasMetric     bool
+	}
+	// multipartFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to inspect and rewrite a structured body as it streams: the
+	// parts are parsed chunk by chunk, so an upload of any size only takes the memory of a few
+	// chunks, and a part over the limits is rejected as soon as it's seen.
+	multipartFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *multipartFilterFactory
+		stream  *multipartStream
+		out     bytes.Buffer
+		// holding is set while the headers are held for ExtractFields.
+		holding   bool
+		held      int
+		extracted map[string]string
+		shared.EmptyHttpFilter
+	}
+	// multipartPart is a part of the body being parsed.
+	multipartPart struct {
+		name        string
+		filename    string
+		contentType string
+		size        int64
+		// skip is set if the part is removed from the body.
+		skip bool
+		// value is the content of a text field being extracted.
+		value   []byte
+		extract bool
+	}
+	// multipartError is a body rejected by the filter.
+	multipartError struct {
+		status int
+		result string
+	}
+)
+
+func (e *multipartError) Error() string { return e.result }
+
+var errMultipartMalformed = &multipartError{status: http.StatusBadRequest, result: "malformed"}
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *multipartFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config multipartFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse multipart config: %w", err)
+		}
+	}
+	if config.MaxParts <= 0 {
+		config.MaxParts = multipartDefaultMaxParts
+	}
+	if config.MaxFieldBytes <= 0 {
+		config.MaxFieldBytes = multipartDefaultMaxFieldBytes
+	}
+	if config.MaxFileBytes <= 0 {
+		config.MaxFileBytes = multipartDefaultMaxFileBytes
+	}
+	if config.MaxHoldBytes <= 0 {
+		config.MaxHoldBytes = multipartDefaultMaxHoldBytes
+	}
+	for i, t := range config.AllowedFileTypes {
+		config.AllowedFileTypes[i] = strings.ToLower(t)
+	}
+	for field, header := range config.ExtractFields {
+		if header == "" {
+			return nil, fmt.Errorf("extract_fields: header of %q must be set", field)
+		}
+		config.ExtractFields[field] = strings.ToLower(header)
+	}
+	f := &multipartFilterFactory{config: config, stripFields: make(map[string]bool)}
+	for _, name := range config.StripFields {
+		f.stripFields[name] = true
+	}
+	if config.AllowedFields != nil {
+		f.allowedFields = make(map[string]bool, len(config.AllowedFields))
+		for _, name := range config.AllowedFields {
+			f.allowedFields[name] = true
+		}
+	}
+	id, res := handle.DefineCounter("multipart_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the multipart counter: %v", res)
+	}
+	if id, res = handle.DefineCounter("multipart_fields_stripped_total"); res == shared.MetricsSuccess {
+		f.stripped = id
+	} else {
+		f.hasMetric = false
+		handle.Log(shared.LogLevelWarn, "failed to define the multipart stripped fields counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *multipartFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &multipartFilter{handle: handle, factory: p}
+}
+
+// fileTypeAllowed reports whether a file of the media type is allowed.
+func (p *multipartFilterFactory) fileTypeAllowed(mediaType string) bool {
+	if len(p.config.AllowedFileTypes) == 0 {
+		return true
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	return slices.Contains(p.config.AllowedFileTypes, mediaType) || slices.Contains(p.config.AllowedFileTypes, major+"/*")
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *multipartFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	// The headers are only for this filter to set.
+	for _, header := range config.ExtractFields {
+		if len(headers.Get(header)) > 0 {
+			headers.Remove(header)
+			p.handle.ClearRouteCache()
+		}
+	}
+	if endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	mediaType, params, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return shared.HeadersStatusContinue
+	}
+	p.stream = newMultipartStream(params["boundary"], p.onPart, p.onData)
+	if len(p.factory.stripFields) > 0 || p.factory.allowedFields != nil {
+		// The body is shorter if any field is removed.
+		headers.Remove("content-length")
+	}
+	if len(config.ExtractFields) > 0 {
+		p.holding = true
+		p.extracted = make(map[string]string, len(config.ExtractFields))
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *multipartFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.stream == nil {
+		return shared.BodyStatusContinue
+	}
+	p.held += int(body.GetSize())
+	var err error
+	for _, chunk := range body.GetChunks() {
+		if err = p.stream.write(chunk, &p.out); err != nil {
+			break
+		}
+	}
+	if err == nil && endOfStream {
+		err = p.finish(&p.out)
+	}
+	if err != nil {
+		p.reject(err)
+		return shared.BodyStatusStopNoBuffer
+	}
+	body.Drain(body.GetSize())
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+	if p.holding {
+		if !endOfStream && len(p.extracted) < len(p.factory.config.ExtractFields) && p.held <= p.factory.config.MaxHoldBytes {
+			return shared.BodyStatusStopAndBuffer
+		}
+		p.release()
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *multipartFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.stream == nil {
+		return shared.TrailersStatusContinue
+	}
+	// When the request has trailers, the body ends without endOfStream.
+	if err := p.finish(&p.out); err != nil {
+		p.reject(err)
+		return shared.TrailersStatusStop
+	}
+	p.handle.BufferedRequestBody().Append(p.out.Bytes())
+	p.out.Reset()
+	if p.holding {
+		p.release()
+	}
+	return shared.TrailersStatusContinue
+}
+
+// finish checks the end of the body.
+func (p *multipartFilter) finish(out *bytes.Buffer) error {
+	err := p.stream.close(out)
+	p.stream = nil
+	if err == nil {
+		p.record("ok")
+	}
+	return err
+}
+
+// release sets the extracted headers, and lets the held request go.
+func (p *multipartFilter) release() {
+	p.holding = false
+	if len(p.extracted) == 0 {
+		return
+	}
+	headers := p.handle.RequestHeaders()
+	for header, value := range p.extracted {
+		headers.Set(header, value)
+	}
+	p.handle.ClearRouteCache()
+}
+
+// onPart is called with the headers of each part, and decides whether the part is kept.
+func (p *multipartFilter) onPart(part *multipartPart, index int) error {
+	config := &p.factory.config
+	if index >= config.MaxParts {
+		return &multipartError{status: http.StatusRequestEntityTooLarge, result: "too_many_parts"}
+	}
+	if p.factory.stripFields[part.name] || (p.factory.allowedFields != nil && !p.factory.allowedFields[part.name]) {
+		part.skip = true
+		if p.factory.hasMetric {
+			p.handle.IncrementCounterValue(p.factory.stripped, 1)
+		}
+		return nil
+	}
+	if part.filename != "" {
+		if !p.factory.fileTypeAllowed(part.contentType) {
+			return &multipartError{status: http.StatusUnsupportedMediaType, result: "file_type"}
+		}
+		return nil
+	}
+	if _, ok := config.ExtractFields[part.name]; ok && p.holding {
+		part.extract = true
+	}
+	return nil
+}
+
+// onData is called with the content of the kept parts as it streams.
+func (p *multipartFilter) onData(part *multipartPart, data []byte, end bool) error {
+	part.size += int64(len(data))
+	limit := p.factory.config.MaxFieldBytes
+	if part.filename != "" {
+		limit = p.factory.config.MaxFileBytes
+	}
+	if part.size > limit {
+		return &multipartError{status: http.StatusRequestEntityTooLarge, result: "part_too_large"}
+	}
+	if !part.extract {
+		return nil
+	}
+	if part.size > multipartMaxExtractBytes {
+		part.extract, part.value = false, nil
+		return nil
+	}
+	part.value = append(part.value, data...)
+	if end {
+		header := p.factory.config.ExtractFields[part.name]
+		if _, seen := p.extracted[header]; !seen && validHeaderValue(part.value) {
+			p.extracted[header] = string(part.value)
+		}
+	}
+	return nil
+}
+
+func (p *multipartFilter) reject(err error) {
+	p.stream, p.holding = nil, false
+	var multipartErr *multipartError
+	if !errors.As(err, &multipartErr) {
+		multipartErr = errMultipartMalformed
+	}
+	p.record(multipartErr.result)
+	p.handle.SendLocalResponse(uint32(multipartErr.status), [][2]string{{"Content-Type", "text/plain"}},
+		[]byte(http.StatusText(multipartErr.status)+"\n"), "multipart_"+multipartErr.result)
+}
+
+func (p *multipartFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
+
+// validHeaderValue reports whether v can be a header value as is.
+func validHeaderValue(v []byte) bool {
+	for _, c := range v {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	multipartStatePreamble = iota
+	multipartStateBoundaryLine
+	multipartStateHeaders
+	multipartStateBody
+	multipartStateEpilogue
+)
+
+// multipartStream parses a multipart body streamed in chunks, writing the kept parts to the output
+// as it goes.
+//
+// The stream is parsed as if it started with "\r\n" so that the first delimiter looks the same as
+// the others, and those two bytes are dropped from the output. Like the other streaming filters,
+// the bytes at the end of a chunk that might be the start of a delimiter are held back until the
+// next chunk.
+type multipartStream struct {
+	// delimiter is "\r\n--" followed by the boundary.
+	delimiter []byte
+	state     int
+	pending   []byte
+	// drop is the number of the bytes still to be dropped from the output.
+	drop   int
+	part   *multipartPart
+	parts  int
+	onPart func(part *multipartPart, index int) error
+	onData func(part *multipartPart, data []byte, end bool) error
+}
+
+func newMultipartStream(boundary string, onPart func(*multipartPart, int) error, onData func(*multipartPart, []byte, bool) error) *multipartStream {
+	return &multipartStream{
+		delimiter: []byte("\r\n--" + boundary),
+		pending:   []byte("\r\n"),
+		drop:      2,
+		onPart:    onPart,
+		onData:    onData,
+	}
+}
+
+// write parses the chunk, and writes the output that is final to out.
+func (s *multipartStream) write(chunk []byte, out *bytes.Buffer) error {
+	s.pending = append(s.pending, chunk...)
+	for {
+		progressed, err := s.step(out)
+		if err != nil || !progressed {
+			return err
+		}
+	}
+}
+
+// close checks that the body ended after the close delimiter, and writes the rest to out.
+func (s *multipartStream) close(out *bytes.Buffer) error {
+	if s.state != multipartStateEpilogue {
+		return errMultipartMalformed
+	}
+	s.emit(out, s.pending)
+	s.pending = nil
+	return nil
+}
+
+func (s *multipartStream) emit(out *bytes.Buffer, data []byte) {
+	n := min(s.drop, len(data))
+	s.drop -= n
+	out.Write(data[n:])
+}
+
+// step consumes what it can of the pending bytes in the current state, and reports whether it
+// made progress.
+func (s *multipartStream) step(out *bytes.Buffer) (bool, error) {
+	switch s.state {
+	case multipartStatePreamble, multipartStateBody:
+		i := bytes.Index(s.pending, s.delimiter)
+		end := i
+		if i < 0 {
+			// Hold back what might be the start of a delimiter.
+			end = max(0, len(s.pending)-len(s.delimiter)+1)
+		}
+		data := s.pending[:end]
+		if s.state == multipartStatePreamble {
+			s.emit(out, data)
+		} else if !s.part.skip {
+			if err := s.onData(s.part, data, i >= 0); err != nil {
+				return false, err
+			}
+			s.emit(out, data)
+		}
+		if i < 0 {
+			s.pending = s.pending[end:]
+			return false, nil
+		}
+		s.pending = s.pending[end:]
+		s.state = multipartStateBoundaryLine
+		return true, nil
+
+	case multipartStateBoundaryLine:
+		rest := s.pending[len(s.delimiter):]
+		if len(rest) < 2 {
+			return false, nil
+		}
+		if rest[0] == '-' && rest[1] == '-' {
+			s.emit(out, s.pending[:len(s.delimiter)+2])
+			s.pending = s.pending[len(s.delimiter)+2:]
+			s.state = multipartStateEpilogue
+			return true, nil
+		}
+		i := bytes.Index(rest, []byte("\r\n"))
+		if i < 0 {
+			if len(rest) > multipartMaxHeaderBytes {
+				return false, errMultipartMalformed
+			}
+			return false, nil
+		}
+		// Only the transport padding may follow the boundary.
+		if len(bytes.Trim(rest[:i], " \t")) > 0 {
+			return false, errMultipartMalformed
+		}
+		s.state = multipartStateHeaders
+		return true, nil
+
+	case multipartStateHeaders:
+		// The headers start at the end of the boundary line, which was checked to be there.
+		start := len(s.delimiter) + bytes.Index(s.pending[len(s.delimiter):], []byte("\r\n"))
+		i := bytes.Index(s.pending[start:], []byte("\r\n\r\n"))
+		if i < 0 {
+			if len(s.pending) > multipartMaxHeaderBytes {
+				return false, errMultipartMalformed
+			}
+			return false, nil
+		}
+		end := start + i + 4
+		part, err := parseMultipartPartHeaders(s.pending[start+2 : end])
+		if err != nil {
+			return false, err
+		}
+		if err := s.onPart(part, s.parts); err != nil {
+			return false, err
+		}
+		s.parts++
+		s.part = part
+		if !part.skip {
+			s.emit(out, s.pending[:end])
+		}
+		s.pending = s.pending[end:]
+		s.state = multipartStateBody
+		return true, nil
+
+	case multipartStateEpilogue:
+		s.emit(out, s.pending)
+		s.pending = s.pending[:0]
+		return false, nil
+	}
+	return false, nil
+}
+
+// parseMultipartPartHeaders parses the headers of a part ending with the empty line.
+func parseMultipartPartHeaders(raw []byte) (*multipartPart, error) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil {
+		return nil, errMultipartMalformed
+	}
+	disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil || disposition != "form-data" {
+		return nil, errMultipartMalformed
+	}
+	part := &multipartPart{name: params["name"], filename: params["filename"]}
+	if part.filename != "" {
+		part.contentType = "application/octet-stream"
+		if ct := header.Get("Content-Type"); ct != "" {
+			if part.contentType, _, err = mime.ParseMediaType(ct); err != nil {
+				return nil, errMultipartMalformed
+			}
+		}
+	}
+	return part, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+const (
+	ndjsonDefaultMaxLineBytes = 1 << 20
+	ndjsonDefaultRedaction    = "[REDACTED]"
+)
+
+// ndjsonContentTypes are the media types of the newline-delimited JSON bodies.
+var ndjsonContentTypes = map[string]struct{}{
+	"application/x-ndjson": {}, "application/ndjson": {}, "application/jsonl": {},
+	"application/x-jsonlines": {}, "application/jsonlines": {},
+}
+
+type (
+	// ndjsonFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	ndjsonFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// ndjsonFilterConfig is the JSON configuration of the NDJSON filter.
+	ndjsonFilterConfig struct {
+		// SkipRequest and SkipResponse disable the processing of the request and the response bodies.
+		SkipRequest  bool `json:"skip_request"`
+		SkipResponse bool `json:"skip_response"`
+		// RedactFields are the dot-separated paths of the fields redacted in each line, such as
+		// "user.email" and "items.*.card", with "*" matching any key or index.
+		RedactFields []string `json:"redact_fields"`
+		// Redaction replaces the redacted values. Defaults to "[REDACTED]".
+		Redaction string `json:"redaction"`
+		// Schema is the inline JSON Schema each line must match, and SchemaFile the path to it.
+		Schema     json.RawMessage `json:"schema"`
+		SchemaFile string          `json:"schema_file"`
+		// PassInvalid passes the lines that are not JSON or don't match the schema as they are.
+		// They are dropped by default.
+		PassInvalid bool `json:"pass_invalid"`
+		// MaxLineBytes is the maximum size of a line. The longer lines are handled as invalid, so
+		// that a line never ending doesn't grow the buffer. Defaults to 1MiB.
+		MaxLineBytes int `json:"max_line_bytes"`
+	}
+	// ndjsonFilterFactory implements [shared.HttpFilterFactory].
+	ndjsonFilterFactory struct {
+		config    ndjsonFilterConfig
+		redact    [][]string
+		schema    *jsonschema.Schema
+		lines     shared.MetricID
+		hasMetric bool
+	}
+	// ndjsonFilter implements [shared.HttpFilter].
+	//
+	// Each complete line is processed and sent on as soon as it arrives, so only an incomplete
+	// line is held.
+	ndjsonFilter struct {
+		handle                      shared.HttpFilterHandle
+		factory                     *ndjsonFilterFactory
+		requestLines, responseLines *ndjsonLines
+		out                         bytes.Buffer
+		shared.EmptyHttpFilter
+	}
+	// ndjsonLines splits a body into lines.
+	ndjsonLines struct {
+		direction string
+		// pending is the incomplete line held for the next chunk.
+		pending []byte
+		// overflow is set while the rest of an overlong line is skipped or passed through.
+		overflow bool
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *ndjsonFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config ndjsonFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse NDJSON config: %w", err)
+	}
+	if config.Redaction == "" {
+		config.Redaction = ndjsonDefaultRedaction
+	}
+	if config.MaxLineBytes <= 0 {
+		config.MaxLineBytes = ndjsonDefaultMaxLineBytes
+	}
+	f := &ndjsonFilterFactory{config: config}
+	for _, field := range config.RedactFields {
+		if field == "" {
+			return nil, fmt.Errorf("redact_fields must not be empty")
+		}
+		f.redact = append(f.redact, strings.Split(field, "."))
+	}
+	var err error
+	switch {
+	case len(config.Schema) > 0:
+		f.schema, err = compileJSONSchema("inline.json", config.Schema)
+	case config.SchemaFile != "":
+		var path string
+		var data []byte
+		if path, err = filepath.Abs(config.SchemaFile); err == nil {
+			data, err = os.ReadFile(path)
+		}
+		if err == nil {
+			f.schema, err = compileJSONSchema((&url.URL{Scheme: "file", Path: path}).String(), data)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, res := handle.DefineCounter("ndjson_lines_total", "direction", "result")
+	if res == shared.MetricsSuccess {
+		f.lines, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the NDJSON counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *ndjsonFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &ndjsonFilter{handle: handle, factory: p}
+}
+
+func (p *ndjsonFilter) newLines(headers shared.HeaderMap, endOfStream bool, direction string) *ndjsonLines {
+	if endOfStream || headers.GetOne("content-encoding") != "" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	if _, ok := ndjsonContentTypes[mediaType]; !ok {
+		return nil
+	}
+	headers.Remove("content-length")
+	return &ndjsonLines{direction: direction}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *ndjsonFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if !p.factory.config.SkipRequest {
+		p.requestLines = p.newLines(headers, endOfStream, "request")
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *ndjsonFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	p.process(p.requestLines, body, endOfStream)
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *ndjsonFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	p.flush(p.requestLines, p.handle.BufferedRequestBody())
+	return shared.TrailersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *ndjsonFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if !p.factory.config.SkipResponse {
+		p.responseLines = p.newLines(headers, endOfStream, "response")
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *ndjsonFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	p.process(p.responseLines, body, endOfStream)
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *ndjsonFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	p.flush(p.responseLines, p.handle.BufferedResponseBody())
+	return shared.TrailersStatusContinue
+}
+
+// process replaces the chunks in the body with their complete lines processed.
+func (p *ndjsonFilter) process(lines *ndjsonLines, body shared.BodyBuffer, endOfStream bool) {
+	if lines == nil {
+		return
+	}
+	for _, chunk := range body.GetChunks() {
+		lines.pending = append(lines.pending, chunk...)
+	}
+	p.processLines(lines, endOfStream)
+	body.Drain(body.GetSize())
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+}
+
+// flush appends the last line to the body when the body ends with the trailers.
+func (p *ndjsonFilter) flush(lines *ndjsonLines, body shared.BodyBuffer) {
+	if lines == nil {
+		return
+	}
+	p.processLines(lines, true)
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+}
+
+// processLines writes the complete pending lines to out, processed. At the end of the stream,
+// the last line is processed even without its newline.
+func (p *ndjsonFilter) processLines(lines *ndjsonLines, endOfStream bool) {
+	pending := lines.pending
+	for {
+		i := bytes.IndexByte(pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := pending[:i+1]
+		pending = pending[i+1:]
+		if lines.overflow {
+			// The end of an overlong line.
+			lines.overflow = false
+			if p.factory.config.PassInvalid {
+				p.out.Write(line)
+			}
+			continue
+		}
+		p.processLine(lines.direction, line)
+	}
+	switch {
+	case lines.overflow:
+		if p.factory.config.PassInvalid {
+			p.out.Write(pending)
+		}
+		pending = nil
+	case len(pending) > p.factory.config.MaxLineBytes:
+		p.record(lines.direction, "too_large")
+		if p.factory.config.PassInvalid {
+			p.out.Write(pending)
+		}
+		pending, lines.overflow = nil, !endOfStream
+	case endOfStream && len(pending) > 0:
+		p.processLine(lines.direction, pending)
+		pending = nil
+	}
+	// The pending bytes are moved to the start so that the buffer doesn't grow forever.
+	lines.pending = append(lines.pending[:0:0], pending...)
+}
+
+// processLine writes the line to out with its line ending, unless it is dropped.
+func (p *ndjsonFilter) processLine(direction string, line []byte) {
+	content := bytes.TrimRight(line, "\r\n")
+	ending := line[len(content):]
+	if len(bytes.TrimSpace(content)) == 0 {
+		p.out.Write(line)
+		return
+	}
+	processed, result := p.factory.processLine(content)
+	p.record(direction, result)
+	if processed == nil {
+		if p.factory.config.PassInvalid {
+			p.out.Write(line)
+		}
+		return
+	}
+	p.out.Write(processed)
+	p.out.Write(ending)
+}
+
+// processLine validates and redacts the line. It returns nil if the line is invalid.
+func (p *ndjsonFilterFactory) processLine(line []byte) ([]byte, string) {
+	if p.schema != nil {
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(line))
+		if err != nil {
+			return nil, "malformed"
+		}
+		var validationErr *jsonschema.ValidationError
+		if errors.As(p.schema.Validate(doc), &validationErr) {
+			return nil, "invalid"
+		}
+	}
+	if len(p.redact) == 0 {
+		if p.schema == nil && !json.Valid(line) {
+			return nil, "malformed"
+		}
+		return line, "passed"
+	}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	doc, err := decodeOrderedJSON(dec)
+	if err != nil {
+		return nil, "malformed"
+	}
+	redacted := false
+	for _, path := range p.redact {
+		_ = applyJSONPath(doc, path, "", func(v *orderedJSON, _ string) error {
+			*v, redacted = orderedJSON{scalar: p.config.Redaction}, true
+			return nil
+		})
+	}
+	if !redacted {
+		return line, "passed"
+	}
+	var out bytes.Buffer
+	encodeOrderedJSON(&out, doc)
+	return out.Bytes(), "redacted"
+}
+
+func (p *ndjsonFilter) record(direction, result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.lines, 1, direction, result)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+const openAPIDefaultMaxBodyBytes = 1 << 20
+
+type (
+	// openAPIFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	openAPIFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// openAPIFilterConfig is the JSON configuration of the OpenAPI validation filter.
+	openAPIFilterConfig struct {
+		// SpecFile is the path to the OpenAPI 3 spec in YAML or JSON.
+		SpecFile string `json:"spec_file" example:"./testdata/openapi.yaml"`
+		// ValidateResponses enables the validation of the responses, in which case the invalid ones
+		// are replaced with a 502.
+		ValidateResponses bool `json:"validate_responses"`
+		// MaxBodyBytes is the maximum size of the bodies validated. Larger request bodies are
+		// rejected with 413, and larger response bodies are let through unvalidated.
+		// Defaults to 1 MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// openAPIFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// The spec is loaded, validated, and compiled into the router once when the config is
+	// created, and the result is shared by the filters on all the worker threads.
+	openAPIFilterFactory struct {
+		config     openAPIFilterConfig
+		router     routers.Router
+		violations shared.MetricID
+		hasMetric  bool
+	}
+	// openAPIFilter implements [shared.HttpFilter].
+	openAPIFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *openAPIFilterFactory
+		// input is set once the request has matched an operation.
+		input *openapi3filter.RequestValidationInput
+		// validating is set while the request or the response body is being buffered.
+		validating bool
+		body       []byte
+		// tooLarge is set if the response body exceeds the limit, in which case it is let through.
+		tooLarge       bool
+		responseStatus int
+		responseHeader http.Header
+		shared.EmptyHttpFilter
+	}
+	// openAPIViolation is an entry of the violations in the error responses.
+	openAPIViolation struct {
+		// Location is where the violation is, such as "query.limit" or "body/items/0/name".
+		Location string `json:"location"`
+		Message  string `json:"message"`
+	}
+	// openAPIErrorBody is the body of the error responses.
+	openAPIErrorBody struct {
+		Message    string             `json:"message"`
+		Violations []openAPIViolation `json:"violations,omitempty"`
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *openAPIFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config openAPIFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse openapi config: %w", err)
+	}
+	if config.SpecFile == "" {
+		return nil, fmt.Errorf("spec_file must be set")
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = openAPIDefaultMaxBodyBytes
+	}
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromFile(config.SpecFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", config.SpecFile, err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid spec %s: %w", config.SpecFile, err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the router of %s: %w", config.SpecFile, err)
+	}
+	f := &openAPIFilterFactory{config: config, router: router}
+	id, res := handle.DefineCounter("openapi_violations_total", "direction")
+	if res == shared.MetricsSuccess {
+		f.violations, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the openapi counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *openAPIFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &openAPIFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *openAPIFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	req, err := openAPIRequest(headers)
+	if err != nil {
+		p.reject(http.StatusBadRequest, "request", "invalid request", []openAPIViolation{{Location: "path", Message: err.Error()}})
+		return shared.HeadersStatusStop
+	}
+	route, pathParams, err := p.factory.router.FindRoute(req)
+	switch {
+	case errors.Is(err, routers.ErrMethodNotAllowed):
+		p.reject(http.StatusMethodNotAllowed, "request", "method not allowed", nil)
+		return shared.HeadersStatusStop
+	case err != nil:
+		p.reject(http.StatusNotFound, "request", "no matching operation", nil)
+		return shared.HeadersStatusStop
+	}
+	p.input = &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			MultiError: true,
+			// The authentication is left to the other filters.
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		},
+	}
+	if !endOfStream && route.Operation.RequestBody != nil {
+		p.validating = true
+		return shared.HeadersStatusStop
+	}
+	if !p.validateRequest() {
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *openAPIFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.validating {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.reject(http.StatusRequestEntityTooLarge, "request", "request body too large", nil)
+		return shared.BodyStatusStopNoBuffer
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if !p.validateRequest() {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *openAPIFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.validating && !p.validateRequest() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// validateRequest validates the request with the buffered body, and returns false if it is
+// rejected.
+func (p *openAPIFilter) validateRequest() bool {
+	p.validating = false
+	p.input.Request.Body = io.NopCloser(bytes.NewReader(p.body))
+	p.body = nil
+	if err := openapi3filter.ValidateRequest(context.Background(), p.input); err != nil {
+		p.reject(http.StatusBadRequest, "request", "request validation failed", openAPIViolations("", err))
+		return false
+	}
+	return true
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *openAPIFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.input == nil || !p.factory.config.ValidateResponses {
+		return shared.HeadersStatusContinue
+	}
+	p.responseStatus, _ = strconv.Atoi(headers.GetOne(":status"))
+	p.responseHeader = make(http.Header)
+	for _, kv := range headers.GetAll() {
+		if !strings.HasPrefix(kv[0], ":") {
+			p.responseHeader.Add(strings.Clone(kv[0]), strings.Clone(kv[1]))
+		}
+	}
+	if endOfStream {
+		if !p.validateResponse() {
+			return shared.HeadersStatusStop
+		}
+		return shared.HeadersStatusContinue
+	}
+	// Hold the headers until the body is validated.
+	p.validating = true
+	return shared.HeadersStatusStop
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *openAPIFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.validating || p.tooLarge {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.handle.Log(shared.LogLevelWarn, "skipping the validation of the response body larger than %d bytes",
+			p.factory.config.MaxBodyBytes)
+		p.tooLarge, p.body = true, nil
+		return shared.BodyStatusContinue
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if !p.validateResponse() {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *openAPIFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.validating && !p.tooLarge && !p.validateResponse() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// validateResponse validates the response with the buffered body, and returns false if it is
+// replaced.
+func (p *openAPIFilter) validateResponse() bool {
+	p.validating = false
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: p.input,
+		Status:                 p.responseStatus,
+		Header:                 p.responseHeader,
+		Body:                   io.NopCloser(bytes.NewReader(p.body)),
+		Options:                p.input.Options,
+	}
+	p.body = nil
+	if err := openapi3filter.ValidateResponse(context.Background(), input); err != nil {
+		p.reject(http.StatusBadGateway, "response", "response validation failed", openAPIViolations("", err))
+		return false
+	}
+	return true
+}
+
+// buffer copies the chunks of the body, and returns false if the body exceeds the limit.
+func (p *openAPIFilter) buffer(body shared.BodyBuffer) bool {
+	if len(p.body)+int(body.GetSize()) > p.factory.config.MaxBodyBytes {
+		return false
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	return true
+}
+
+func (p *openAPIFilter) reject(status int, direction, message string, violations []openAPIViolation) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.violations, 1, direction)
+	}
+	body, _ := json.Marshal(openAPIErrorBody{Message: message, Violations: violations})
+	p.handle.SendLocalResponse(uint32(status), [][2]string{{"Content-Type", "application/json"}},
+		append(body, '\n'), "openapi_"+direction+"_rejected")
+}
+
+// openAPIRequest converts the request headers into the [http.Request] the validation works on.
+func openAPIRequest(headers shared.HeaderMap) (*http.Request, error) {
+	// The header values are only valid during the callback, so the request is built from copies.
+	u, err := url.ParseRequestURI(strings.Clone(headers.GetOne(":path")))
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme, u.Host = strings.Clone(headers.GetOne(":scheme")), strings.Clone(headers.GetOne(":authority"))
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	req := &http.Request{
+		Method: strings.Clone(headers.GetOne(":method")),
+		URL:    u,
+		Host:   u.Host,
+		Header: make(http.Header),
+		Body:   http.NoBody,
+	}
+	for _, kv := range headers.GetAll() {
+		if !strings.HasPrefix(kv[0], ":") {
+			req.Header.Add(strings.Clone(kv[0]), strings.Clone(kv[1]))
+		}
+	}
+	return req, nil
+}
+
+// openAPIViolations flattens the validation error into the violations.
+func openAPIViolations(location string, err error) []openAPIViolation {
+	var violations []openAPIViolation
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		for _, err := range e {
+			violations = append(violations, openAPIViolations(location, err)...)
+		}
+		return violations
+	case *openapi3filter.RequestError:
+		switch {
+		case e.Parameter != nil:
+			location = e.Parameter.In + "." + e.Parameter.Name
+		case e.RequestBody != nil:
+			location = "body"
+		}
+		if nested := openAPINestedViolations(location, e.Err); nested != nil {
+			return nested
+		}
+	case *openapi3filter.ResponseError:
+		if nested := openAPINestedViolations("body", e.Err); nested != nil {
+			return nested
+		}
+	case *openapi3.SchemaError:
+		if pointer := e.JSONPointer(); len(pointer) > 0 {
+			location += "/" + strings.Join(pointer, "/")
+		}
+		return []openAPIViolation{{Location: location, Message: e.Reason}}
+	}
+	return []openAPIViolation{{Location: location, Message: err.Error()}}
+}
+
+// openAPINestedViolations returns the violations of the schema errors wrapped in a request or a
+// response error, or nil if err is something else.
+func openAPINestedViolations(location string, err error) []openAPIViolation {
+	switch err.(type) {
+	case openapi3.MultiError, *openapi3.SchemaError:
+		return openAPIViolations(location, err)
+	}
+	return nil
+}
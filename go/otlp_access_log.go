@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	otlpAccessLogDefaultServiceName     = "envoy"
+	otlpAccessLogDefaultBatchSize       = 512
+	otlpAccessLogDefaultFlushIntervalMs = 1000
+	otlpAccessLogDefaultQueueSize       = 2048
+	otlpAccessLogDefaultTimeoutMs       = 5000
+	otlpAccessLogScopeName              = "github.com/envoyproxy/dynamic-modules-examples/go/otlp_access_log"
+	// otlpSeverityInfo is the INFO severity number of the OTLP log data model.
+	otlpSeverityInfo = 9
+)
+
+// otlpAccessLogExporters are the exporters by their settings. Like the access log writers, the
+// exporters outlive the filter configs, so the configs with the same settings share one.
+var otlpAccessLogExporters sync.Map // map[string]*otlpAccessLogExporter
+
+type (
+	// otlpAccessLogFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	otlpAccessLogFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// otlpAccessLogFilterConfig is the JSON configuration of the OTLP access log filter.
+	otlpAccessLogFilterConfig struct {
+		// Endpoint is the OTLP/HTTP logs endpoint of the collector, such as
+		// "http://127.0.0.1:4318/v1/logs". The records are sent as JSON.
+		Endpoint string `json:"endpoint" example:"http://127.0.0.1:4318/v1/logs"`
+		// Headers are added to the export requests, e.g. for the authentication.
+		Headers map[string]string `json:"headers"`
+		// ServiceName is the service.name resource attribute. Defaults to "envoy".
+		ServiceName string `json:"service_name"`
+		// ResourceAttributes are the other resource attributes.
+		ResourceAttributes map[string]string `json:"resource_attributes"`
+		// BatchSize is the maximum number of the records per export request. Defaults to 512.
+		BatchSize int `json:"batch_size"`
+		// FlushIntervalMs is how long a record waits for its batch to fill up. Defaults to 1000.
+		FlushIntervalMs int `json:"flush_interval_ms"`
+		// QueueSize is the number of the records waiting to be exported. The records are dropped
+		// when it is full. Defaults to 2048.
+		QueueSize int `json:"queue_size"`
+		// TimeoutMs is the timeout of the export requests. Defaults to 5000.
+		TimeoutMs int `json:"timeout_ms"`
+	}
+	// otlpAccessLogFilterFactory implements [shared.HttpFilterFactory].
+	otlpAccessLogFilterFactory struct {
+		exporter  *otlpAccessLogExporter
+		records   shared.MetricID
+		hasMetric bool
+	}
+	// otlpAccessLogFilter implements [shared.HttpFilter].
+	//
+	// The filter only queues the record. The exporter goroutine batches and sends them, and keeps
+	// the results in atomic counters since it can't touch the metrics from outside the worker
+	// threads. The filters move those counts into the metric as the streams complete.
+	otlpAccessLogFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *otlpAccessLogFilterFactory
+		record  otlpAccessLogRecord
+		shared.EmptyHttpFilter
+	}
+	// otlpAccessLogRecord is what is exported of a request.
+	otlpAccessLogRecord struct {
+		start         time.Time
+		duration      time.Duration
+		method        string
+		path          string
+		protocol      string
+		authority     string
+		clientIP      string
+		route         string
+		userAgent     string
+		status        int
+		bytesReceived int64
+		bytesSent     int64
+	}
+	// otlpAccessLogExporter batches the records and exports them from its own goroutine.
+	otlpAccessLogExporter struct {
+		endpoint      string
+		headers       map[string]string
+		resource      otlpResource
+		batchSize     int
+		flushInterval time.Duration
+		client        *http.Client
+		queue         chan otlpAccessLogRecord
+		// exported and failed are the numbers of the records not yet reported to the metric.
+		exported atomic.Uint64
+		failed   atomic.Uint64
+		// logf is the log of the config that started the exporter.
+		logf logFunc
+	}
+
+	// The types below are the subset of the OTLP/HTTP JSON encoding of the logs used here.
+	otlpLogsRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpLogRecord struct {
+		TimeUnixNano         string         `json:"timeUnixNano"`
+		ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+		SeverityNumber       int            `json:"severityNumber"`
+		SeverityText         string         `json:"severityText"`
+		Body                 otlpAnyValue   `json:"body"`
+		Attributes           []otlpKeyValue `json:"attributes"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	// otlpAnyValue has one of the values set. The 64-bit integers are strings in the JSON encoding.
+	otlpAnyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *otlpAccessLogFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config otlpAccessLogFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse otlp access log config: %w", err)
+	}
+	if u, err := url.Parse(config.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an http or https URL")
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = otlpAccessLogDefaultServiceName
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = otlpAccessLogDefaultBatchSize
+	}
+	if config.FlushIntervalMs <= 0 {
+		config.FlushIntervalMs = otlpAccessLogDefaultFlushIntervalMs
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = otlpAccessLogDefaultQueueSize
+	}
+	if config.TimeoutMs <= 0 {
+		config.TimeoutMs = otlpAccessLogDefaultTimeoutMs
+	}
+	f := &otlpAccessLogFilterFactory{exporter: startOTLPAccessLogExporter(&config, handle.Log)}
+	id, res := handle.DefineCounter("otlp_access_log_records_total", "result")
+	if res == shared.MetricsSuccess {
+		f.records, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the otlp access log counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *otlpAccessLogFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &otlpAccessLogFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *otlpAccessLogFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	r := &p.record
+	r.start = time.Now()
+	r.method = strings.Clone(headers.GetOne(":method"))
+	r.path = strings.Clone(headers.GetOne(":path"))
+	r.authority = strings.Clone(headers.GetOne(":authority"))
+	r.userAgent = strings.Clone(headers.GetOne("user-agent"))
+	if protocol, ok := p.handle.GetAttributeString(shared.AttributeIDRequestProtocol); ok {
+		r.protocol = strings.Clone(protocol)
+	}
+	if source, ok := p.handle.GetAttributeString(shared.AttributeIDSourceAddress); ok {
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			source = host
+		}
+		r.clientIP = strings.Clone(source)
+	}
+	if route, ok := p.handle.GetAttributeString(shared.AttributeIDXdsRouteName); ok {
+		r.route = strings.Clone(route)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *otlpAccessLogFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	p.record.status, _ = strconv.Atoi(headers.GetOne(":status"))
+	return shared.HeadersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *otlpAccessLogFilter) OnStreamComplete() {
+	r := &p.record
+	if r.start.IsZero() {
+		return
+	}
+	r.duration = time.Since(r.start)
+	if size, ok := p.handle.GetAttributeNumber(shared.AttributeIDRequestSize); ok {
+		r.bytesReceived = int64(size)
+	}
+	if size, ok := p.handle.GetAttributeNumber(shared.AttributeIDResponseSize); ok {
+		r.bytesSent = int64(size)
+	}
+	exporter := p.factory.exporter
+	dropped := false
+	select {
+	case exporter.queue <- *r:
+	default:
+		dropped = true
+	}
+	if !p.factory.hasMetric {
+		return
+	}
+	if dropped {
+		p.handle.IncrementCounterValue(p.factory.records, 1, "dropped")
+	}
+	if n := exporter.exported.Swap(0); n > 0 {
+		p.handle.IncrementCounterValue(p.factory.records, n, "exported")
+	}
+	if n := exporter.failed.Swap(0); n > 0 {
+		p.handle.IncrementCounterValue(p.factory.records, n, "failed")
+	}
+}
+
+// startOTLPAccessLogExporter returns the exporter of the settings, starting it if it is not
+// running yet.
+func startOTLPAccessLogExporter(config *otlpAccessLogFilterConfig, logf logFunc) *otlpAccessLogExporter {
+	key, _ := json.Marshal(config)
+	if e, ok := otlpAccessLogExporters.Load(string(key)); ok {
+		return e.(*otlpAccessLogExporter)
+	}
+	e := &otlpAccessLogExporter{
+		endpoint:      config.Endpoint,
+		headers:       config.Headers,
+		resource:      otlpResource{Attributes: []otlpKeyValue{otlpString("service.name", config.ServiceName)}},
+		batchSize:     config.BatchSize,
+		flushInterval: time.Duration(config.FlushIntervalMs) * time.Millisecond,
+		client:        &http.Client{Timeout: time.Duration(config.TimeoutMs) * time.Millisecond},
+		queue:         make(chan otlpAccessLogRecord, config.QueueSize),
+		logf:          logf,
+	}
+	for _, k := range slices.Sorted(maps.Keys(config.ResourceAttributes)) {
+		e.resource.Attributes = append(e.resource.Attributes, otlpString(k, config.ResourceAttributes[k]))
+	}
+	if actual, loaded := otlpAccessLogExporters.LoadOrStore(string(key), e); loaded {
+		return actual.(*otlpAccessLogExporter)
+	}
+	go e.run()
+	return e
+}
+
+// run exports the batches when they fill up, or when the oldest record has waited for the flush
+// interval. A batch is exported before the next one is started, so a slow collector backs up the
+// queue and the records are dropped there rather than piling up in memory.
+func (e *otlpAccessLogExporter) run() {
+	timer := time.NewTimer(e.flushInterval)
+	timer.Stop()
+	var batch []otlpLogRecord
+	for {
+		select {
+		case r := <-e.queue:
+			if len(batch) == 0 {
+				timer.Reset(e.flushInterval)
+			}
+			batch = append(batch, r.toOTLP())
+			if len(batch) < e.batchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		}
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpAccessLogExporter) export(batch []otlpLogRecord) {
+	err := e.send(batch)
+	if err != nil {
+		e.logf(shared.LogLevelError, "failed to export %d access log records to %s: %v", len(batch), e.endpoint, err)
+		e.failed.Add(uint64(len(batch)))
+		return
+	}
+	e.exported.Add(uint64(len(batch)))
+}
+
+func (e *otlpAccessLogExporter) send(batch []otlpLogRecord) error {
+	body, err := json.Marshal(otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource:  e.resource,
+		ScopeLogs: []otlpScopeLogs{{Scope: otlpScope{Name: otlpAccessLogScopeName}, LogRecords: batch}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// toOTLP returns the log record with the attributes named by the OpenTelemetry HTTP semantic
+// conventions where there is one.
+func (r *otlpAccessLogRecord) toOTLP() otlpLogRecord {
+	body := fmt.Sprintf("%s %s %d", r.method, r.path, r.status)
+	record := otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(r.start.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(r.start.Add(r.duration).UnixNano(), 10),
+		SeverityNumber:       otlpSeverityInfo,
+		SeverityText:         "INFO",
+		Body:                 otlpAnyValue{StringValue: &body},
+	}
+	for _, kv := range [][2]string{
+		{"http.request.method", r.method},
+		{"url.path", r.path},
+		{"server.address", r.authority},
+		{"network.protocol.name", r.protocol},
+		{"client.address", r.clientIP},
+		{"http.route", r.route},
+		{"user_agent.original", r.userAgent},
+	} {
+		if kv[1] != "" {
+			record.Attributes = append(record.Attributes, otlpString(kv[0], kv[1]))
+		}
+	}
+	if r.status != 0 {
+		record.Attributes = append(record.Attributes, otlpInt("http.response.status_code", int64(r.status)))
+	}
+	record.Attributes = append(record.Attributes,
+		otlpInt("http.request.body.size", r.bytesReceived),
+		otlpInt("http.response.body.size", r.bytesSent),
+		otlpInt("duration_ms", r.duration.Milliseconds()),
+	)
+	return record
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpKeyValue {
+	s := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &s}}
+}
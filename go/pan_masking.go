@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	// panMaxMatchLength is the length of the longest candidate: 19 digits with the separators.
+	panMaxMatchLength = 19*2 - 1
+	panVisibleDigits  = 4
+)
+
+// panCandidate matches 13 to 19 digits optionally separated by single spaces or dashes.
+var panCandidate = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+type (
+	// panMaskingFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	panMaskingFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// panMaskingFilterConfig is the JSON configuration of the PAN masking filter.
+	panMaskingFilterConfig struct {
+		// SkipRequest and SkipResponse disable the masking of the request and the response bodies.
+		SkipRequest  bool `json:"skip_request"`
+		SkipResponse bool `json:"skip_response"`
+		// ContentTypes are the media types of the bodies masked. Defaults to the same as the PII
+		// redaction filter.
+		ContentTypes []string `json:"content_types"`
+		// MaskChar replaces the masked digits. Defaults to "*".
+		MaskChar string `json:"mask_char"`
+	}
+	// panMaskingFilterFactory implements [shared.HttpFilterFactory].
+	panMaskingFilterFactory struct {
+		config       panMaskingFilterConfig
+		contentTypes map[string]struct{}
+		maskChar     byte
+		masked       shared.MetricID
+		hasMetric    bool
+	}
+	// panMaskingFilter implements [shared.HttpFilter].
+	//
+	// The masks have the same length as the PANs, so unlike the PII redaction filter, the bodies
+	// keep their Content-Length.
+	panMaskingFilter struct {
+		handle                        shared.HttpFilterHandle
+		factory                       *panMaskingFilterFactory
+		requestMasker, responseMasker *streamRedactor
+		out                           bytes.Buffer
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *panMaskingFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config panMaskingFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse pan masking config: %w", err)
+		}
+	}
+	if len(config.ContentTypes) == 0 {
+		config.ContentTypes = piiRedactionDefaultContentTypes
+	}
+	if config.MaskChar == "" {
+		config.MaskChar = "*"
+	}
+	if len(config.MaskChar) != 1 {
+		return nil, fmt.Errorf("mask_char must be a single byte")
+	}
+	f := &panMaskingFilterFactory{config: config, contentTypes: make(map[string]struct{}), maskChar: config.MaskChar[0]}
+	for _, t := range config.ContentTypes {
+		f.contentTypes[strings.ToLower(t)] = struct{}{}
+	}
+	id, res := handle.DefineCounter("pan_masked_total", "direction")
+	if res == shared.MetricsSuccess {
+		f.masked, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the pan masking counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *panMaskingFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &panMaskingFilter{handle: handle, factory: p}
+}
+
+// find returns the masks of the Luhn valid PANs in data.
+func (p *panMaskingFilterFactory) find(data []byte) []redaction {
+	var redactions []redaction
+	for _, m := range panCandidate.FindAllIndex(data, -1) {
+		pan := data[m[0]:m[1]]
+		if !luhnValid(pan) {
+			continue
+		}
+		masked := bytes.Clone(pan)
+		visible := panVisibleDigits
+		for i := len(masked) - 1; i >= 0; i-- {
+			if masked[i] < '0' || masked[i] > '9' {
+				continue
+			}
+			if visible > 0 {
+				visible--
+				continue
+			}
+			masked[i] = p.maskChar
+		}
+		redactions = append(redactions, redaction{start: m[0], end: m[1], replacement: masked})
+	}
+	return redactions
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum. Non-digits are ignored.
+func luhnValid(s []byte) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// newMasker returns the masker for the body with the headers, or nil if the body is not masked.
+func (p *panMaskingFilter) newMasker(headers shared.HeaderMap, endOfStream bool) *streamRedactor {
+	if endOfStream || headers.GetOne("content-encoding") != "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(headers.GetOne("content-type"))
+	if err != nil {
+		return nil
+	}
+	if _, ok := p.factory.contentTypes[mediaType]; !ok {
+		return nil
+	}
+	return &streamRedactor{maxMatchLength: panMaxMatchLength, find: p.factory.find}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *panMaskingFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if !p.factory.config.SkipRequest {
+		p.requestMasker = p.newMasker(headers, endOfStream)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *panMaskingFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	p.mask(p.requestMasker, body, endOfStream, "request")
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *panMaskingFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	p.flush(p.requestMasker, p.handle.BufferedRequestBody(), "request")
+	return shared.TrailersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *panMaskingFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if !p.factory.config.SkipResponse {
+		p.responseMasker = p.newMasker(headers, endOfStream)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *panMaskingFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	p.mask(p.responseMasker, body, endOfStream, "response")
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *panMaskingFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	p.flush(p.responseMasker, p.handle.BufferedResponseBody(), "response")
+	return shared.TrailersStatusContinue
+}
+
+// mask replaces the chunks in the body with their masked version.
+func (p *panMaskingFilter) mask(masker *streamRedactor, body shared.BodyBuffer, endOfStream bool, direction string) {
+	if masker == nil {
+		return
+	}
+	record := func(string) { p.record(direction) }
+	for _, chunk := range body.GetChunks() {
+		masker.Write(chunk, false, &p.out, record)
+	}
+	if endOfStream {
+		masker.Write(nil, true, &p.out, record)
+	}
+	body.Drain(body.GetSize())
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+}
+
+// flush appends the held back bytes to the body when the body ends with the trailers.
+func (p *panMaskingFilter) flush(masker *streamRedactor, body shared.BodyBuffer, direction string) {
+	if masker == nil {
+		return
+	}
+	masker.Write(nil, true, &p.out, func(string) { p.record(direction) })
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+}
+
+func (p *panMaskingFilter) record(direction string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.masked, 1, direction)
+	}
+}
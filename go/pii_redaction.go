@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	piiRedactionDefaultMaxMatchLength = 256
+	// streamRedactorContextLength is the number of the emitted bytes kept as the look-behind context
+	// of the next match, e.g. for \b.
+	streamRedactorContextLength = 8
+)
+
+// piiDetectors are the built-in detectors by name.
+var piiDetectors = map[string]string{
+	"email":   `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"phone":   `(?:\+\d{1,3}[ .-]?)?(?:\(\d{3}\)|\b\d{3})[ .-]?\d{3}[ .-]\d{4}\b`,
+	"us_ssn":  `\b\d{3}-\d{2}-\d{4}\b`,
+	"uk_nino": `\b[A-CEGHJ-PR-TW-Z]{2} ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`,
+}
+
+// piiRedactionDefaultContentTypes are the content types redacted when content_types is not set.
+var piiRedactionDefaultContentTypes = []string{
+	"application/json", "application/xml", "text/html", "text/plain", "text/csv", "text/xml",
+}
+
+type (
+	// piiRedactionFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	piiRedactionFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// piiRedactionFilterConfig is the JSON configuration of the PII redaction filter.
+	piiRedactionFilterConfig struct {
+		// Detectors are the detectors applied. Defaults to all the built-in ones.
+		Detectors []piiDetectorConfig `json:"detectors"`
+		// ContentTypes are the media types of the responses redacted.
+		ContentTypes []string `json:"content_types"`
+		// MaxMatchLength is the maximum length of a match, which bounds the number of the bytes held
+		// back at the end of each chunk. Longer matches spanning the chunks are not redacted.
+		// Defaults to 256.
+		MaxMatchLength int `json:"max_match_length"`
+	}
+	piiDetectorConfig struct {
+		// Name is either one of the built-in detectors, "email", "phone", "us_ssn" and "uk_nino", or
+		// the name of a custom detector given Pattern.
+		Name string `json:"name"`
+		// Pattern is the RE2 regular expression of a custom detector.
+		Pattern string `json:"pattern"`
+		// Mask replaces the matches. Defaults to the upper-cased name in brackets, e.g. "[EMAIL]".
+		Mask string `json:"mask"`
+	}
+	piiDetector struct {
+		name string
+		re   *regexp.Regexp
+		mask []byte
+	}
+	// piiRedactionFilterFactory implements [shared.HttpFilterFactory].
+	piiRedactionFilterFactory struct {
+		detectors      []piiDetector
+		contentTypes   map[string]struct{}
+		maxMatchLength int
+		redactions     shared.MetricID
+		hasMetric      bool
+	}
+	// piiRedactionFilter implements [shared.HttpFilter].
+	//
+	// Like the compressor filter, this filter rewrites the response body as it streams rather than
+	// buffering it. See streamRedactor for how the matches spanning the chunks are handled.
+	piiRedactionFilter struct {
+		handle   shared.HttpFilterHandle
+		factory  *piiRedactionFilterFactory
+		redactor *streamRedactor
+		out      bytes.Buffer
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *piiRedactionFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config piiRedactionFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse pii redaction config: %w", err)
+		}
+	}
+	if len(config.Detectors) == 0 {
+		for name := range piiDetectors {
+			config.Detectors = append(config.Detectors, piiDetectorConfig{Name: name})
+		}
+		// Make the order deterministic, which decides the mask of the overlapping matches.
+		slices.SortFunc(config.Detectors, func(a, b piiDetectorConfig) int { return strings.Compare(a.Name, b.Name) })
+	}
+	if len(config.ContentTypes) == 0 {
+		config.ContentTypes = piiRedactionDefaultContentTypes
+	}
+	if config.MaxMatchLength <= 0 {
+		config.MaxMatchLength = piiRedactionDefaultMaxMatchLength
+	}
+	f := &piiRedactionFilterFactory{contentTypes: make(map[string]struct{}), maxMatchLength: config.MaxMatchLength}
+	for _, t := range config.ContentTypes {
+		f.contentTypes[strings.ToLower(t)] = struct{}{}
+	}
+	for _, d := range config.Detectors {
+		pattern := d.Pattern
+		if pattern == "" {
+			var ok bool
+			if pattern, ok = piiDetectors[d.Name]; !ok {
+				return nil, fmt.Errorf("unknown detector %q without pattern", d.Name)
+			}
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("detector %s: %w", d.Name, err)
+		}
+		mask := d.Mask
+		if mask == "" {
+			mask = "[" + strings.ToUpper(d.Name) + "]"
+		}
+		f.detectors = append(f.detectors, piiDetector{name: d.Name, re: re, mask: []byte(mask)})
+	}
+	id, res := handle.DefineCounter("pii_redactions_total", "detector")
+	if res == shared.MetricsSuccess {
+		f.redactions, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the pii redaction counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *piiRedactionFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &piiRedactionFilter{handle: handle, factory: p}
+}
+
+// find returns the matches of all the detectors in data.
+func (p *piiRedactionFilterFactory) find(data []byte) []redaction {
+	var redactions []redaction
+	for _, d := range p.detectors {
+		for _, m := range d.re.FindAllIndex(data, -1) {
+			redactions = append(redactions, redaction{start: m[0], end: m[1], replacement: d.mask, label: d.name})
+		}
+	}
+	return redactions
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *piiRedactionFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream || headers.GetOne("content-encoding") != "" {
+		// The compressed bodies can't be inspected.
+		return shared.HeadersStatusContinue
+	}
+	mediaType, _, err := mime.ParseMediaType(headers.GetOne("content-type"))
+	if err != nil {
+		return shared.HeadersStatusContinue
+	}
+	if _, ok := p.factory.contentTypes[mediaType]; !ok {
+		return shared.HeadersStatusContinue
+	}
+	p.redactor = &streamRedactor{maxMatchLength: p.factory.maxMatchLength, find: p.factory.find}
+	// The masks may change the length of the body.
+	headers.Remove("content-length")
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *piiRedactionFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.redactor == nil {
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.redactor.Write(chunk, false, &p.out, p.record)
+	}
+	if endOfStream {
+		p.redactor.Write(nil, true, &p.out, p.record)
+	}
+	body.Drain(body.GetSize())
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *piiRedactionFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	// When the response has trailers, the body ends without endOfStream, so the held back bytes are
+	// flushed here.
+	if p.redactor != nil {
+		p.redactor.Write(nil, true, &p.out, p.record)
+		p.handle.BufferedResponseBody().Append(p.out.Bytes())
+		p.out.Reset()
+	}
+	return shared.TrailersStatusContinue
+}
+
+func (p *piiRedactionFilter) record(label string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.redactions, 1, label)
+	}
+}
+
+type (
+	// streamRedactor replaces the matches in a body streamed in chunks.
+	//
+	// A match may span the chunks, so the last maxMatchLength bytes of the data seen so far are
+	// held back until the next chunk, and the cut is moved before any match reaching it since the
+	// match might extend into the next chunk. A few of the emitted bytes are kept as the context
+	// of the next search so that the look-behind assertions such as \b keep working.
+	streamRedactor struct {
+		maxMatchLength int
+		find           func(data []byte) []redaction
+		context        []byte
+		pending        []byte
+	}
+	// redaction replaces data[start:end] with replacement.
+	redaction struct {
+		start, end  int
+		replacement []byte
+		label       string
+	}
+)
+
+// Write processes the chunk, and writes the redacted bytes that are final to out. If final is set,
+// all the bytes held back are written. onRedact is called with the label of every redaction.
+func (r *streamRedactor) Write(chunk []byte, final bool, out *bytes.Buffer, onRedact func(label string)) {
+	data := make([]byte, 0, len(r.context)+len(r.pending)+len(chunk))
+	data = append(append(append(data, r.context...), r.pending...), chunk...)
+	base := len(r.context)
+
+	redactions := r.find(data)
+	slices.SortStableFunc(redactions, func(a, b redaction) int { return a.start - b.start })
+	cut := len(data)
+	if !final {
+		cut = max(base, len(data)-r.maxMatchLength)
+	}
+	// Drop the matches in the context, which have been handled already, and the overlapping ones.
+	pos := base
+	kept := redactions[:0]
+	for _, m := range redactions {
+		if m.start >= pos && m.end > m.start {
+			kept = append(kept, m)
+			pos = m.end
+		}
+	}
+	for _, m := range kept {
+		if !final && m.start < cut && m.end >= cut {
+			cut = m.start
+			break
+		}
+	}
+
+	pos = base
+	for _, m := range kept {
+		if m.end > cut {
+			break
+		}
+		out.Write(data[pos:m.start])
+		out.Write(m.replacement)
+		onRedact(m.label)
+		pos = m.end
+	}
+	out.Write(data[pos:cut])
+
+	r.context = append(r.context[:0], data[max(0, cut-streamRedactorContextLength):cut]...)
+	r.pending = append(r.pending[:0], data[cut:]...)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+type (
+	// queryParamsFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	queryParamsFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// queryParamsFilterConfig is the JSON configuration of the query parameters filter. The
+	// operations are applied in the order of the fields.
+	queryParamsFilterConfig struct {
+		// Remove are the names of the parameters removed. A name ending with "*" is a prefix, such
+		// as "utm_*" for the tracking parameters.
+		Remove []string `json:"remove"`
+		// RemoveEmpty removes the parameters without a value, such as "a" and "a=".
+		RemoveEmpty bool `json:"remove_empty"`
+		// Rename maps the old names of the parameters to their new names.
+		Rename map[string]string `json:"rename"`
+		// Set replaces all the values of the parameters, adding them if they are missing.
+		Set map[string]string `json:"set"`
+		// Add appends a value to the parameters.
+		Add map[string]string `json:"add"`
+		// Sort sorts the parameters by name, keeping the order of the values of a name, so that the
+		// same query written in different orders is one cache key.
+		Sort bool `json:"sort"`
+		// NormalizeEncoding re-encodes all the parameters the same way, so that "%7E" and "~", or
+		// "%20" and "+", are the same.
+		NormalizeEncoding bool `json:"normalize_encoding"`
+	}
+	// queryParamsFilterFactory implements [shared.HttpFilterFactory].
+	queryParamsFilterFactory struct {
+		config             queryParamsFilterConfig
+		removeNames        map[string]struct{}
+		removePrefixes     []string
+		setNames, addNames []string
+		requests           shared.MetricID
+		hasMetric          bool
+	}
+	// queryParamsFilter implements [shared.HttpFilter].
+	queryParamsFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *queryParamsFilterFactory
+		shared.EmptyHttpFilter
+	}
+	// queryParam is a parameter of the query.
+	queryParam struct {
+		name, value string
+		// raw is the parameter as it was in the query, and is empty once the parameter changes.
+		raw string
+		// decoded is set if name and value were decoded from raw.
+		decoded bool
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *queryParamsFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config queryParamsFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse query params config: %w", err)
+	}
+	f := &queryParamsFilterFactory{config: config, removeNames: map[string]struct{}{}}
+	for _, name := range config.Remove {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			f.removePrefixes = append(f.removePrefixes, prefix)
+		} else {
+			f.removeNames[name] = struct{}{}
+		}
+	}
+	for from, to := range config.Rename {
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("rename: the names must not be empty")
+		}
+	}
+	// The names are sorted so that the parameters are added in the same order on each request.
+	f.setNames = slices.Sorted(maps.Keys(config.Set))
+	f.addNames = slices.Sorted(maps.Keys(config.Add))
+	for _, name := range slices.Concat(f.setNames, f.addNames) {
+		if name == "" {
+			return nil, fmt.Errorf("set and add: the names must not be empty")
+		}
+	}
+	id, res := handle.DefineCounter("query_params_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the query params counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *queryParamsFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &queryParamsFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *queryParamsFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	path := headers.GetOne(":path")
+	urlPath, query, _ := strings.Cut(path, "?")
+	query = p.factory.rewrite(query)
+	newPath := urlPath
+	if query != "" {
+		newPath += "?" + query
+	}
+	if newPath == path {
+		p.record("unchanged")
+		return shared.HeadersStatusContinue
+	}
+	p.record("modified")
+	headers.Set(":path", newPath)
+	// The routes may match on the query parameters.
+	p.handle.ClearRouteCache()
+	return shared.HeadersStatusContinue
+}
+
+// rewrite returns the query with the operations of the config applied.
+func (p *queryParamsFilterFactory) rewrite(query string) string {
+	var params []queryParam
+	for raw := range strings.SplitSeq(query, "&") {
+		if raw == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(raw, "=")
+		param := queryParam{name: name, value: value, raw: raw}
+		// The undecodable parameters are matched and kept as they are.
+		if n, err := url.QueryUnescape(name); err == nil {
+			if v, err := url.QueryUnescape(value); err == nil {
+				param.name, param.value, param.decoded = n, v, true
+			}
+		}
+		params = append(params, param)
+	}
+
+	params = slices.DeleteFunc(params, func(param queryParam) bool {
+		if _, ok := p.removeNames[param.name]; ok {
+			return true
+		}
+		for _, prefix := range p.removePrefixes {
+			if strings.HasPrefix(param.name, prefix) {
+				return true
+			}
+		}
+		return p.config.RemoveEmpty && param.value == ""
+	})
+	for i := range params {
+		if to, ok := p.config.Rename[params[i].name]; ok {
+			params[i] = queryParam{name: to, value: params[i].value}
+		}
+	}
+	for _, name := range p.setNames {
+		params = slices.DeleteFunc(params, func(param queryParam) bool { return param.name == name })
+		params = append(params, queryParam{name: name, value: p.config.Set[name]})
+	}
+	for _, name := range p.addNames {
+		params = append(params, queryParam{name: name, value: p.config.Add[name]})
+	}
+	if p.config.Sort {
+		slices.SortStableFunc(params, func(a, b queryParam) int { return strings.Compare(a.name, b.name) })
+	}
+
+	var out strings.Builder
+	for i, param := range params {
+		if i > 0 {
+			out.WriteByte('&')
+		}
+		if param.raw != "" && (!p.config.NormalizeEncoding || !param.decoded) {
+			out.WriteString(param.raw)
+			continue
+		}
+		out.WriteString(url.QueryEscape(param.name))
+		out.WriteByte('=')
+		out.WriteString(url.QueryEscape(param.value))
+	}
+	return out.String()
+}
+
+func (p *queryParamsFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	// The descriptors a token bucket can be keyed by.
+	rateLimitKeyHeader   = "header"
+	rateLimitKeyClientIP = "client_ip"
+	rateLimitKeyRoute    = "route"
+
+	// rateLimitDefaultMaxBuckets bounds the memory used by the buckets when max_buckets is not set.
+	rateLimitDefaultMaxBuckets = 10000
+)
+
+type (
+	// rateLimitFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	rateLimitFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// rateLimitFilterConfig is the JSON configuration of the rate limit filter.
+	rateLimitFilterConfig struct {
+		// Key is the descriptor the buckets are keyed by: "header", "client_ip", or "route".
+		Key string `json:"key" example:"client_ip"`
+		// Header is the request header used as the key when Key is "header".
+		Header string `json:"header"`
+		// TokensPerSecond is the fill rate of each bucket.
+		TokensPerSecond float64 `json:"tokens_per_second" example:"10"`
+		// Burst is the capacity of each bucket. Defaults to TokensPerSecond rounded up.
+		Burst float64 `json:"burst"`
+		// MaxBuckets is the maximum number of buckets kept in memory. When it is reached, the
+		// bucket refilled the soonest is removed for a new key, which is one that is already full
+		// if any, so that a flood of new keys doesn't reset the buckets of the limited ones.
+		MaxBuckets int `json:"max_buckets"`
+	}
+	// rateLimitFilterFactory implements [shared.HttpFilterFactory].
+	//
+	// The factory is shared by all the filter instances across the worker threads, so the buckets
+	// live here and are guarded by the mutex.
+	rateLimitFilterFactory struct {
+		config    rateLimitFilterConfig
+		mux       sync.Mutex
+		buckets   map[string]*tokenBucket
+		byFull    tokenBucketHeap
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// tokenBucket is refilled lazily when it is taken from.
+	tokenBucket struct {
+		key        string
+		tokens     float64
+		lastRefill time.Time
+		// full is when the bucket is refilled to the full capacity, and index its index in the
+		// heap ordered by it.
+		full  time.Time
+		index int
+	}
+	// tokenBucketHeap implements [heap.Interface] ordering the buckets by when they are full.
+	tokenBucketHeap []*tokenBucket
+	// rateLimitFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to share state across the filter instances, and how to use the
+	// metrics API.
+	rateLimitFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *rateLimitFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *rateLimitFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config rateLimitFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse rate limit config: %w", err)
+	}
+	switch config.Key {
+	case rateLimitKeyHeader:
+		if config.Header == "" {
+			return nil, fmt.Errorf("header must be set when key is %q", rateLimitKeyHeader)
+		}
+	case rateLimitKeyClientIP, rateLimitKeyRoute:
+	default:
+		return nil, fmt.Errorf("invalid key %q: must be %q, %q, or %q",
+			config.Key, rateLimitKeyHeader, rateLimitKeyClientIP, rateLimitKeyRoute)
+	}
+	if config.TokensPerSecond <= 0 {
+		return nil, fmt.Errorf("tokens_per_second must be positive")
+	}
+	if config.Burst == 0 {
+		config.Burst = math.Ceil(config.TokensPerSecond)
+	}
+	if config.Burst < 1 {
+		return nil, fmt.Errorf("burst must be at least 1")
+	}
+	if config.MaxBuckets <= 0 {
+		config.MaxBuckets = rateLimitDefaultMaxBuckets
+	}
+
+	f := &rateLimitFilterFactory{config: config, buckets: make(map[string]*tokenBucket)}
+	id, res := handle.DefineCounter("ratelimit_requests_total", "decision")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the rate limit counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *rateLimitFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &rateLimitFilter{handle: handle, factory: p}
+}
+
+// take takes a token from the bucket of key. If no token is available, it returns false and how
+// long it takes until the next token is available.
+func (p *rateLimitFilterFactory) take(key string, now time.Time) (bool, time.Duration) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	b, ok := p.buckets[key]
+	if !ok {
+		if len(p.buckets) >= p.config.MaxBuckets {
+			// A full bucket is indistinguishable from a new one, and the one full the soonest is
+			// the least limited otherwise.
+			delete(p.buckets, heap.Pop(&p.byFull).(*tokenBucket).key)
+		}
+		// The key views the memory of Envoy, only valid during the callback.
+		b = &tokenBucket{key: strings.Clone(key), tokens: p.config.Burst, lastRefill: now}
+		p.buckets[b.key] = b
+		heap.Push(&p.byFull, b)
+	}
+	b.tokens = min(p.config.Burst, b.tokens+now.Sub(b.lastRefill).Seconds()*p.config.TokensPerSecond)
+	b.lastRefill = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((p.config.Burst - b.tokens) / p.config.TokensPerSecond * float64(time.Second)))
+	heap.Fix(&p.byFull, b.index)
+	if allowed {
+		return true, 0
+	}
+	wait := (1 - b.tokens) / p.config.TokensPerSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Len implements [heap.Interface].
+func (h tokenBucketHeap) Len() int { return len(h) }
+
+// Less implements [heap.Interface].
+func (h tokenBucketHeap) Less(i, j int) bool { return h[i].full.Before(h[j].full) }
+
+// Swap implements [heap.Interface].
+func (h tokenBucketHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+// Push implements [heap.Interface].
+func (h *tokenBucketHeap) Push(x any) {
+	b := x.(*tokenBucket)
+	b.index = len(*h)
+	*h = append(*h, b)
+}
+
+// Pop implements [heap.Interface].
+func (h *tokenBucketHeap) Pop() any {
+	old := *h
+	b := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return b
+}
+
+// key returns the descriptor of the request, or false if the request has none.
+func (p *rateLimitFilter) key(headers shared.HeaderMap) (string, bool) {
+	switch p.factory.config.Key {
+	case rateLimitKeyHeader:
+		v := headers.GetOne(p.factory.config.Header)
+		return v, v != ""
+	case rateLimitKeyClientIP:
+		addr, ok := p.handle.GetAttributeString(shared.AttributeIDSourceAddress)
+		if !ok {
+			return "", false
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		return addr, true
+	default:
+		return p.handle.GetAttributeString(shared.AttributeIDXdsRouteName)
+	}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *rateLimitFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	key, ok := p.key(headers)
+	if !ok {
+		// Requests without the descriptor are not rate limited.
+		p.record("skipped")
+		return shared.HeadersStatusContinue
+	}
+	allowed, wait := p.factory.take(key, time.Now())
+	if allowed {
+		p.record("allowed")
+		return shared.HeadersStatusContinue
+	}
+	p.record("limited")
+	retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+	p.handle.SendLocalResponse(http.StatusTooManyRequests,
+		[][2]string{{"Content-Type", "text/plain"}, {"Retry-After", retryAfter}},
+		[]byte("Too Many Requests\n"), "rate_limited")
+	return shared.HeadersStatusStop
+}
+
+func (p *rateLimitFilter) record(decision string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, decision)
+	}
+}
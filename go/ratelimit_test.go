@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+)
+
+func TestRateLimitKeyFlood(t *testing.T) {
+	factory, err := (&rateLimitFilterConfigFactory{}).Create(filtertest.NewConfigHandle(),
+		[]byte(`{"key": "header", "header": "x-client", "tokens_per_second": 1, "burst": 2, "max_buckets": 10}`))
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	f := factory.(*rateLimitFilterFactory)
+
+	now := time.Now()
+	for range 2 {
+		if allowed, _ := f.take("limited", now); !allowed {
+			t.Fatal("the burst of the limited key was denied")
+		}
+	}
+	if allowed, _ := f.take("limited", now); allowed {
+		t.Fatal("the limited key was allowed past its burst")
+	}
+	// A flood of new keys fills the table many times over before the limited key is refilled.
+	for i := range 100 {
+		now = now.Add(time.Millisecond)
+		if allowed, _ := f.take("flood-"+strconv.Itoa(i), now); !allowed {
+			t.Fatalf("the new key %d was denied", i)
+		}
+	}
+	if len(f.buckets) > 10 {
+		t.Fatalf("%d buckets, want at most max_buckets", len(f.buckets))
+	}
+	if allowed, _ := f.take("limited", now); allowed {
+		t.Fatal("the limited key was reset by the flood of new keys")
+	}
+	// Once refilled, it is let through again.
+	if allowed, _ := f.take("limited", now.Add(time.Second)); !allowed {
+		t.Fatal("the limited key wasn't refilled")
+	}
+}
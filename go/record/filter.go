@@ -0,0 +1,194 @@
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// recordingSeq tells apart the files of the streams completed in the same nanosecond.
+var recordingSeq atomic.Uint64
+
+type (
+	// ConfigFactory implements [shared.HttpFilterConfigFactory] by wrapping the factory of a
+	// filter so that each stream of the filters it creates is recorded to a file in Dir, named
+	// after Name.
+	ConfigFactory struct {
+		Name string
+		Dir  string
+		shared.HttpFilterConfigFactory
+	}
+	// filterFactory implements [shared.HttpFilterFactory].
+	filterFactory struct {
+		name    string
+		dir     string
+		config  string
+		factory shared.HttpFilterFactory
+		// logf is the log of the config handle, for the failures to write the recordings.
+		logf func(level shared.LogLevel, format string, args ...any)
+	}
+	// filter implements [shared.HttpFilter] by recording the hooks of the wrapped filter.
+	filter struct {
+		factory  *filterFactory
+		recorder *recorder
+		handle   *handle
+		filter   shared.HttpFilter
+	}
+	// recorder accumulates the events of a stream. The filter may misuse the handle from a
+	// goroutine, so the calls are serialized.
+	recorder struct {
+		mu     sync.Mutex
+		events []Event
+		// done is set when the stream completed, after which nothing is recorded.
+		done bool
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *ConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	factory, err := p.HttpFilterConfigFactory.Create(handle, unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(p.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the recording directory: %w", err)
+	}
+	return &filterFactory{
+		name: p.Name, dir: p.Dir, config: string(unparsedConfig), factory: factory, logf: handle.Log,
+	}, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *filterFactory) Create(envoyHandle shared.HttpFilterHandle) shared.HttpFilter {
+	r := &recorder{}
+	h := newHandle(envoyHandle, r)
+	return &filter{factory: p, recorder: r, handle: h, filter: p.factory.Create(h)}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *filter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	event := p.recorder.begin(Event{Hook: "OnRequestHeaders", Headers: headers.GetAll(), EndOfStream: endOfStream})
+	status := p.filter.OnRequestHeaders(p.handle.headers(headers, "RequestHeaders"), endOfStream)
+	p.recorder.end(event, int(status))
+	return status
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *filter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	event := p.recorder.begin(Event{Hook: "OnRequestBody", Body: cloneChunks(body.GetChunks()), EndOfStream: endOfStream})
+	status := p.filter.OnRequestBody(p.handle.body(body, "RequestBody"), endOfStream)
+	p.recorder.end(event, int(status))
+	return status
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *filter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	event := p.recorder.begin(Event{Hook: "OnRequestTrailers", Headers: trailers.GetAll()})
+	status := p.filter.OnRequestTrailers(p.handle.headers(trailers, "RequestTrailers"))
+	p.recorder.end(event, int(status))
+	return status
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *filter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	event := p.recorder.begin(Event{Hook: "OnResponseHeaders", Headers: headers.GetAll(), EndOfStream: endOfStream})
+	status := p.filter.OnResponseHeaders(p.handle.headers(headers, "ResponseHeaders"), endOfStream)
+	p.recorder.end(event, int(status))
+	return status
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *filter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	event := p.recorder.begin(Event{Hook: "OnResponseBody", Body: cloneChunks(body.GetChunks()), EndOfStream: endOfStream})
+	status := p.filter.OnResponseBody(p.handle.body(body, "ResponseBody"), endOfStream)
+	p.recorder.end(event, int(status))
+	return status
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *filter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	event := p.recorder.begin(Event{Hook: "OnResponseTrailers", Headers: trailers.GetAll()})
+	status := p.filter.OnResponseTrailers(p.handle.headers(trailers, "ResponseTrailers"))
+	p.recorder.end(event, int(status))
+	return status
+}
+
+// OnStreamComplete implements [shared.HttpFilter]. The recording is written to the file on a
+// goroutine so that the worker thread doesn't wait for the disk.
+func (p *filter) OnStreamComplete() {
+	p.recorder.begin(Event{Hook: "OnStreamComplete"})
+	p.filter.OnStreamComplete()
+	p.recorder.mu.Lock()
+	recording := Recording{Filter: p.factory.name, Config: p.factory.config, Events: p.recorder.events}
+	p.recorder.events, p.recorder.done = nil, true
+	p.recorder.mu.Unlock()
+	go p.factory.write(&recording)
+}
+
+// write writes the recording to a new file in the directory.
+func (p *filterFactory) write(recording *Recording) {
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		p.logf(shared.LogLevelWarn, "failed to encode the recording of %s: %v", p.name, err)
+		return
+	}
+	name := fmt.Sprintf("%s-%d-%d.json", p.name, time.Now().UnixNano(), recordingSeq.Add(1))
+	if err := os.WriteFile(filepath.Join(p.dir, name), data, 0o644); err != nil {
+		p.logf(shared.LogLevelWarn, "failed to write the recording of %s: %v", p.name, err)
+	}
+}
+
+// begin starts a new event, to which the reads and the calls are added until the next one, and
+// returns its index.
+func (r *recorder) begin(event Event) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return -1
+	}
+	r.events = append(r.events, event)
+	return len(r.events) - 1
+}
+
+// end sets the status of the event. A local reply runs the response hooks within the hook
+// sending it, so the event may not be the last one.
+func (r *recorder) end(event, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if event >= 0 && event < len(r.events) {
+		r.events[event].Status = status
+	}
+}
+
+func (r *recorder) call(method string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) > 0 {
+		event := &r.events[len(r.events)-1]
+		event.Calls = append(event.Calls, Call{Method: method, Args: args})
+	}
+}
+
+func (r *recorder) read(read Read) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) > 0 {
+		event := &r.events[len(r.events)-1]
+		event.Reads = append(event.Reads, read)
+	}
+}
+
+func cloneChunks(chunks [][]byte) [][]byte {
+	ret := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		ret[i] = bytes.Clone(chunk)
+	}
+	return ret
+}
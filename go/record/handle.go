@@ -0,0 +1,296 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+type (
+	// handle implements [shared.HttpFilterHandle] by recording the reads and the calls of the
+	// filter, and passing them to Envoy's handle.
+	handle struct {
+		shared.HttpFilterHandle
+		recorder *recorder
+	}
+	// headerMap implements [shared.HeaderMap] by recording the mutations as the calls of name.
+	headerMap struct {
+		shared.HeaderMap
+		recorder *recorder
+		name     string
+	}
+	// bodyBuffer implements [shared.BodyBuffer] by recording the mutations as the calls of name.
+	bodyBuffer struct {
+		shared.BodyBuffer
+		recorder *recorder
+		name     string
+	}
+	// scheduler implements [shared.Scheduler] by recording the tasks as they run.
+	scheduler struct {
+		shared.Scheduler
+		recorder *recorder
+	}
+	// calloutCallback implements [shared.HttpCalloutCallback] by recording the response.
+	calloutCallback struct {
+		callback shared.HttpCalloutCallback
+		recorder *recorder
+	}
+)
+
+func newHandle(envoyHandle shared.HttpFilterHandle, r *recorder) *handle {
+	return &handle{HttpFilterHandle: envoyHandle, recorder: r}
+}
+
+// headers wraps the header map, keeping nil as nil.
+func (h *handle) headers(m shared.HeaderMap, name string) shared.HeaderMap {
+	if m == nil {
+		return nil
+	}
+	return &headerMap{HeaderMap: m, recorder: h.recorder, name: name}
+}
+
+// body wraps the body buffer, keeping nil as nil.
+func (h *handle) body(b shared.BodyBuffer, name string) shared.BodyBuffer {
+	if b == nil {
+		return nil
+	}
+	return &bodyBuffer{BodyBuffer: b, recorder: h.recorder, name: name}
+}
+
+// GetMetadataString implements [shared.HttpFilterHandle].
+func (h *handle) GetMetadataString(source shared.MetadataSourceType, metadataNamespace, key string) (string, bool) {
+	v, ok := h.HttpFilterHandle.GetMetadataString(source, metadataNamespace, key)
+	h.recorder.read(Read{Method: "GetMetadataString", Source: source, Namespace: metadataNamespace, Key: key, Found: ok, String: v})
+	return v, ok
+}
+
+// GetMetadataNumber implements [shared.HttpFilterHandle].
+func (h *handle) GetMetadataNumber(source shared.MetadataSourceType, metadataNamespace, key string) (float64, bool) {
+	v, ok := h.HttpFilterHandle.GetMetadataNumber(source, metadataNamespace, key)
+	h.recorder.read(Read{Method: "GetMetadataNumber", Source: source, Namespace: metadataNamespace, Key: key, Found: ok, Number: v})
+	return v, ok
+}
+
+// SetMetadata implements [shared.HttpFilterHandle].
+func (h *handle) SetMetadata(metadataNamespace, key string, value any) {
+	h.recorder.call("SetMetadata", metadataNamespace, key, value)
+	h.HttpFilterHandle.SetMetadata(metadataNamespace, key, value)
+}
+
+// GetFilterState implements [shared.HttpFilterHandle].
+func (h *handle) GetFilterState(key string) ([]byte, bool) {
+	v, ok := h.HttpFilterHandle.GetFilterState(key)
+	h.recorder.read(Read{Method: "GetFilterState", Key: key, Found: ok, Bytes: bytes.Clone(v)})
+	return v, ok
+}
+
+// SetFilterState implements [shared.HttpFilterHandle].
+func (h *handle) SetFilterState(key string, value []byte) {
+	h.recorder.call("SetFilterState", key, bytes.Clone(value))
+	h.HttpFilterHandle.SetFilterState(key, value)
+}
+
+// GetAttributeString implements [shared.HttpFilterHandle].
+func (h *handle) GetAttributeString(attributeID shared.AttributeID) (string, bool) {
+	v, ok := h.HttpFilterHandle.GetAttributeString(attributeID)
+	h.recorder.read(Read{Method: "GetAttributeString", Attribute: attributeID, Found: ok, String: v})
+	return v, ok
+}
+
+// GetAttributeNumber implements [shared.HttpFilterHandle].
+func (h *handle) GetAttributeNumber(attributeID shared.AttributeID) (float64, bool) {
+	v, ok := h.HttpFilterHandle.GetAttributeNumber(attributeID)
+	h.recorder.read(Read{Method: "GetAttributeNumber", Attribute: attributeID, Found: ok, Number: v})
+	return v, ok
+}
+
+// SetData implements [shared.HttpFilterHandle]. Only the key is recorded, as the value may not be
+// encodable.
+func (h *handle) SetData(key string, value any) {
+	h.recorder.call("SetData", key)
+	h.HttpFilterHandle.SetData(key, value)
+}
+
+// SendLocalResponse implements [shared.HttpFilterHandle].
+func (h *handle) SendLocalResponse(status uint32, headers [][2]string, body []byte, detail string) {
+	h.recorder.call("SendLocalResponse", status, slices.Clone(headers), bytes.Clone(body), detail)
+	h.HttpFilterHandle.SendLocalResponse(status, headers, body, detail)
+}
+
+// SendResponseHeaders implements [shared.HttpFilterHandle].
+func (h *handle) SendResponseHeaders(headers [][2]string, endOfStream bool) {
+	h.recorder.call("SendResponseHeaders", slices.Clone(headers), endOfStream)
+	h.HttpFilterHandle.SendResponseHeaders(headers, endOfStream)
+}
+
+// SendResponseData implements [shared.HttpFilterHandle].
+func (h *handle) SendResponseData(body []byte, endOfStream bool) {
+	h.recorder.call("SendResponseData", bytes.Clone(body), endOfStream)
+	h.HttpFilterHandle.SendResponseData(body, endOfStream)
+}
+
+// SendResponseTrailers implements [shared.HttpFilterHandle].
+func (h *handle) SendResponseTrailers(trailers [][2]string) {
+	h.recorder.call("SendResponseTrailers", slices.Clone(trailers))
+	h.HttpFilterHandle.SendResponseTrailers(trailers)
+}
+
+// AddCustomFlag implements [shared.HttpFilterHandle].
+func (h *handle) AddCustomFlag(flag string) {
+	h.recorder.call("AddCustomFlag", flag)
+	h.HttpFilterHandle.AddCustomFlag(flag)
+}
+
+// ContinueRequest implements [shared.HttpFilterHandle].
+func (h *handle) ContinueRequest() {
+	h.recorder.call("ContinueRequest")
+	h.HttpFilterHandle.ContinueRequest()
+}
+
+// ContinueResponse implements [shared.HttpFilterHandle].
+func (h *handle) ContinueResponse() {
+	h.recorder.call("ContinueResponse")
+	h.HttpFilterHandle.ContinueResponse()
+}
+
+// ClearRouteCache implements [shared.HttpFilterHandle].
+func (h *handle) ClearRouteCache() {
+	h.recorder.call("ClearRouteCache")
+	h.HttpFilterHandle.ClearRouteCache()
+}
+
+// RequestHeaders implements [shared.HttpFilterHandle].
+func (h *handle) RequestHeaders() shared.HeaderMap {
+	return h.headers(h.HttpFilterHandle.RequestHeaders(), "RequestHeaders")
+}
+
+// BufferedRequestBody implements [shared.HttpFilterHandle].
+func (h *handle) BufferedRequestBody() shared.BodyBuffer {
+	return h.body(h.HttpFilterHandle.BufferedRequestBody(), "RequestBody")
+}
+
+// RequestTrailers implements [shared.HttpFilterHandle].
+func (h *handle) RequestTrailers() shared.HeaderMap {
+	return h.headers(h.HttpFilterHandle.RequestTrailers(), "RequestTrailers")
+}
+
+// ResponseHeaders implements [shared.HttpFilterHandle].
+func (h *handle) ResponseHeaders() shared.HeaderMap {
+	return h.headers(h.HttpFilterHandle.ResponseHeaders(), "ResponseHeaders")
+}
+
+// BufferedResponseBody implements [shared.HttpFilterHandle].
+func (h *handle) BufferedResponseBody() shared.BodyBuffer {
+	return h.body(h.HttpFilterHandle.BufferedResponseBody(), "ResponseBody")
+}
+
+// ResponseTrailers implements [shared.HttpFilterHandle].
+func (h *handle) ResponseTrailers() shared.HeaderMap {
+	return h.headers(h.HttpFilterHandle.ResponseTrailers(), "ResponseTrailers")
+}
+
+// GetScheduler implements [shared.HttpFilterHandle].
+func (h *handle) GetScheduler() shared.Scheduler {
+	return &scheduler{Scheduler: h.HttpFilterHandle.GetScheduler(), recorder: h.recorder}
+}
+
+// Log implements [shared.HttpFilterHandle].
+func (h *handle) Log(level shared.LogLevel, format string, args ...any) {
+	h.recorder.call("Log", level, fmt.Sprintf(format, args...))
+	h.HttpFilterHandle.Log(level, format, args...)
+}
+
+// HttpCallout implements [shared.HttpFilterHandle].
+func (h *handle) HttpCallout(cluster string, headers [][2]string, body []byte, timeoutMs uint64,
+	cb shared.HttpCalloutCallback,
+) (shared.HttpCalloutInitResult, uint64) {
+	h.recorder.call("HttpCallout", cluster, slices.Clone(headers), bytes.Clone(body), timeoutMs)
+	return h.HttpFilterHandle.HttpCallout(cluster, headers, body, timeoutMs, &calloutCallback{callback: cb, recorder: h.recorder})
+}
+
+// StartHttpStream implements [shared.HttpFilterHandle]. Only the start is recorded.
+func (h *handle) StartHttpStream(cluster string, headers [][2]string, body []byte, endOfStream bool, timeoutMs uint64,
+	cb shared.HttpStreamCallback,
+) (shared.HttpCalloutInitResult, uint64) {
+	h.recorder.call("StartHttpStream", cluster, slices.Clone(headers), bytes.Clone(body), endOfStream, timeoutMs)
+	return h.HttpFilterHandle.StartHttpStream(cluster, headers, body, endOfStream, timeoutMs, cb)
+}
+
+// RecordHistogramValue implements [shared.HttpFilterHandle].
+func (h *handle) RecordHistogramValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.call("RecordHistogramValue", id, value, tagsValues)
+	return h.HttpFilterHandle.RecordHistogramValue(id, value, tagsValues...)
+}
+
+// SetGaugeValue implements [shared.HttpFilterHandle].
+func (h *handle) SetGaugeValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.call("SetGaugeValue", id, value, tagsValues)
+	return h.HttpFilterHandle.SetGaugeValue(id, value, tagsValues...)
+}
+
+// IncrementGaugeValue implements [shared.HttpFilterHandle].
+func (h *handle) IncrementGaugeValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.call("IncrementGaugeValue", id, value, tagsValues)
+	return h.HttpFilterHandle.IncrementGaugeValue(id, value, tagsValues...)
+}
+
+// DecrementGaugeValue implements [shared.HttpFilterHandle].
+func (h *handle) DecrementGaugeValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.call("DecrementGaugeValue", id, value, tagsValues)
+	return h.HttpFilterHandle.DecrementGaugeValue(id, value, tagsValues...)
+}
+
+// IncrementCounterValue implements [shared.HttpFilterHandle].
+func (h *handle) IncrementCounterValue(id shared.MetricID, value uint64, tagsValues ...string) shared.MetricsResult {
+	h.recorder.call("IncrementCounterValue", id, value, tagsValues)
+	return h.HttpFilterHandle.IncrementCounterValue(id, value, tagsValues...)
+}
+
+// Set implements [shared.HeaderMap].
+func (m *headerMap) Set(key, value string) {
+	m.recorder.call(m.name+".Set", key, value)
+	m.HeaderMap.Set(key, value)
+}
+
+// Add implements [shared.HeaderMap].
+func (m *headerMap) Add(key, value string) {
+	m.recorder.call(m.name+".Add", key, value)
+	m.HeaderMap.Add(key, value)
+}
+
+// Remove implements [shared.HeaderMap].
+func (m *headerMap) Remove(key string) {
+	m.recorder.call(m.name+".Remove", key)
+	m.HeaderMap.Remove(key)
+}
+
+// Drain implements [shared.BodyBuffer].
+func (b *bodyBuffer) Drain(numBytes uint64) {
+	b.recorder.call(b.name+".Drain", numBytes)
+	b.BodyBuffer.Drain(numBytes)
+}
+
+// Append implements [shared.BodyBuffer].
+func (b *bodyBuffer) Append(data []byte) {
+	b.recorder.call(b.name+".Append", bytes.Clone(data))
+	b.BodyBuffer.Append(data)
+}
+
+// Schedule implements [shared.Scheduler]. The task starts an [EventScheduled] event when it runs.
+func (s *scheduler) Schedule(task func()) {
+	s.recorder.call("Schedule")
+	s.Scheduler.Schedule(func() {
+		s.recorder.begin(Event{Hook: EventScheduled})
+		task()
+	})
+}
+
+// OnHttpCalloutDone implements [shared.HttpCalloutCallback].
+func (c *calloutCallback) OnHttpCalloutDone(calloutID uint64, result shared.HttpCalloutResult, headers [][2]string, body [][]byte) {
+	c.recorder.begin(Event{
+		Hook: EventHttpCalloutDone, Headers: slices.Clone(headers), Body: cloneChunks(body), CalloutResult: result,
+	})
+	c.callback.OnHttpCalloutDone(calloutID, result, headers, body)
+}
@@ -0,0 +1,107 @@
+// Package record records what an HTTP filter sees and does on the live streams, so that a stream
+// that misbehaves only in production can be replayed offline into the filter with
+// [github.com/envoyproxy/dynamic-modules-examples/go/filtertest/replay].
+//
+// Wrap the factory of a filter with [ConfigFactory], and each stream of the filters it creates is
+// written as a JSON [Recording] to a file in the directory when it completes:
+//
+//	sdk.RegisterHttpFilterConfigFactories(map[string]shared.HttpFilterConfigFactory{
+//		"redactor": &record.ConfigFactory{Name: "redactor", Dir: "/tmp/recordings",
+//			HttpFilterConfigFactory: &redactorFilterConfigFactory{}},
+//	})
+//
+// The recording has the inputs of each hook, the values the filter read from the handle, and the
+// calls the filter made, in order. The whole bodies are kept in memory until the stream
+// completes, so the recording is meant for the debugging rather than being left on.
+//
+// What the recording does not capture, and the replay can't reproduce:
+//   - The values of the handle other than the attributes, the metadata, and the filter state,
+//     such as GetData and the per-route config.
+//   - The streams started with StartHttpStream, whose callbacks are not recorded.
+//   - What the filter does after the stream completed.
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// The events other than the hooks of [shared.HttpFilter], whose method name they have.
+const (
+	// EventScheduled is a task scheduled via the scheduler of the handle that ran.
+	EventScheduled = "Scheduled"
+	// EventHttpCalloutDone is the callback of an HTTP callout.
+	EventHttpCalloutDone = "OnHttpCalloutDone"
+)
+
+type (
+	// Recording is a stream recorded by [ConfigFactory].
+	Recording struct {
+		// Filter is the name of the filter given to [ConfigFactory].
+		Filter string `json:"filter"`
+		// Config is the unparsed config of the filter.
+		Config string `json:"config"`
+		// Events are the hooks and the asynchronous callbacks in the order they ran.
+		Events []Event `json:"events"`
+	}
+
+	// Event is a hook of the filter or an asynchronous callback run on the worker thread.
+	Event struct {
+		// Hook is the method name of the hook, such as "OnRequestHeaders", or one of
+		// [EventScheduled] and [EventHttpCalloutDone].
+		Hook string `json:"hook"`
+		// Headers are the headers or the trailers passed to the hook, or the response headers of
+		// the callout.
+		Headers [][2]string `json:"headers,omitempty"`
+		// Body are the chunks of the body passed to the hook, or the response body of the
+		// callout.
+		Body        [][]byte `json:"body,omitempty"`
+		EndOfStream bool     `json:"end_of_stream,omitempty"`
+		// Status is the status returned by the hook, such as [shared.HeadersStatus].
+		Status        int                      `json:"status"`
+		CalloutResult shared.HttpCalloutResult `json:"callout_result,omitempty"`
+		// Reads are the values the filter read from the handle during the event.
+		Reads []Read `json:"reads,omitempty"`
+		// Calls are the calls the filter made during the event, named and with the arguments as
+		// in [github.com/envoyproxy/dynamic-modules-examples/go/filtertest.Call].
+		Calls []Call `json:"calls,omitempty"`
+	}
+
+	// Read is a value read from the handle.
+	Read struct {
+		// Method is one of GetAttributeString, GetAttributeNumber, GetMetadataString,
+		// GetMetadataNumber, and GetFilterState.
+		Method    string                    `json:"method"`
+		Attribute shared.AttributeID        `json:"attribute,omitempty"`
+		Source    shared.MetadataSourceType `json:"source,omitempty"`
+		Namespace string                    `json:"namespace,omitempty"`
+		Key       string                    `json:"key,omitempty"`
+		// Found is false if the value was not found.
+		Found  bool    `json:"found"`
+		String string  `json:"string,omitempty"`
+		Number float64 `json:"number,omitempty"`
+		Bytes  []byte  `json:"bytes,omitempty"`
+	}
+
+	// Call is a call made by the filter.
+	Call struct {
+		Method string `json:"method"`
+		Args   []any  `json:"args,omitempty"`
+	}
+)
+
+// Load reads the recording in the file.
+func Load(path string) (*Recording, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recording Recording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		return nil, fmt.Errorf("failed to parse the recording %s: %w", path, err)
+	}
+	return &recording, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/record"
+)
+
+const (
+	// recordDirEnv is the environment variable of Envoy that turns on the recording of the
+	// streams to the files in the directory.
+	recordDirEnv = "GO_MODULE_RECORD_DIR"
+	// recordFiltersEnv is the environment variable of Envoy that limits the recording to the
+	// comma-separated filter names. All the filters are recorded if unset.
+	recordFiltersEnv = "GO_MODULE_RECORD_FILTERS"
+)
+
+// withRecording wraps the factories with [record.ConfigFactory] if the recording is turned on
+// with the GO_MODULE_RECORD_DIR environment variable, so that a stream hitting a bug only seen in
+// production can be replayed into the filter in a unit test with the replay package of
+// filtertest. It is off by default, as every stream is written to a file.
+func withRecording(factories map[string]shared.HttpFilterConfigFactory) map[string]shared.HttpFilterConfigFactory {
+	dir := os.Getenv(recordDirEnv)
+	if dir == "" {
+		return factories
+	}
+	var names []string
+	if filters := os.Getenv(recordFiltersEnv); filters != "" {
+		names = strings.Split(filters, ",")
+	}
+	wrapped := make(map[string]shared.HttpFilterConfigFactory, len(factories))
+	for name, factory := range factories {
+		if names != nil && !slices.Contains(names, name) {
+			wrapped[name] = factory
+			continue
+		}
+		wrapped[name] = &record.ConfigFactory{Name: name, Dir: dir, HttpFilterConfigFactory: factory}
+	}
+	return wrapped
+}
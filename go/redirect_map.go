@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const redirectMapDefaultReloadInterval = 10 * time.Second
+
+type (
+	// redirectMapFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	redirectMapFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// redirectMapFilterConfig is the JSON configuration of the redirect map filter.
+	redirectMapFilterConfig struct {
+		// File is the path to the redirects, which is reloaded when it changes.
+		//
+		// A ".csv" file has the source, target, status and match columns, where the last two are
+		// optional and a first row starting with "source" is a header:
+		//
+		//	source,target,status,match
+		//	/old,/new,301
+		//	/blog/,https://blog.example.com/,308,prefix
+		//
+		// Any other file is a JSON array of objects with the same fields.
+		File string `json:"file" example:"./testdata/redirects.csv"`
+		// ReloadIntervalMs is how often the file is checked for changes. Defaults to 10 seconds.
+		ReloadIntervalMs int `json:"reload_interval_ms"`
+		// DefaultStatus is the status of the redirects without one. Defaults to 301.
+		DefaultStatus int `json:"default_status"`
+		// DropQuery drops the query of the request from the redirects. By default it is added to
+		// the query of the target.
+		DropQuery bool `json:"drop_query"`
+	}
+	// redirectRule is a redirect of the file.
+	redirectRule struct {
+		// Source is the request path, without the query.
+		Source string `json:"source"`
+		// Target is the URL or the path redirected to. With a "prefix" match, the rest of the path
+		// after Source is appended to it.
+		Target string `json:"target"`
+		// Status is 301, 302, 303, 307 or 308.
+		Status int `json:"status"`
+		// Match is "exact", the default, or "prefix". The exact matches win over the prefix ones,
+		// and the longest prefix wins.
+		Match string `json:"match"`
+	}
+	// redirectMap is the parsed file, indexed for the lookups to not depend on its size.
+	redirectMap struct {
+		exact    map[string]*redirectRule
+		prefixes map[string]*redirectRule
+		// prefixLengths are the distinct lengths of the prefixes, longest first.
+		prefixLengths []int
+	}
+	// redirectMapFilterFactory implements [shared.HttpFilterFactory].
+	redirectMapFilterFactory struct {
+		config    redirectMapFilterConfig
+		redirects *reloadableFile[*redirectMap]
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// redirectMapFilter implements [shared.HttpFilter].
+	redirectMapFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *redirectMapFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *redirectMapFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config redirectMapFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse redirect map config: %w", err)
+	}
+	if config.File == "" {
+		return nil, fmt.Errorf("file must be set")
+	}
+	if config.DefaultStatus == 0 {
+		config.DefaultStatus = http.StatusMovedPermanently
+	} else if !isRedirectStatus(config.DefaultStatus) {
+		return nil, fmt.Errorf("invalid default_status %d", config.DefaultStatus)
+	}
+	interval := time.Duration(config.ReloadIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = redirectMapDefaultReloadInterval
+	}
+	f := &redirectMapFilterFactory{config: config}
+	redirects, err := newReloadableFile(config.File, interval, f.parseRedirects, handle.Log)
+	if err != nil {
+		return nil, err
+	}
+	f.redirects = redirects
+	id, res := handle.DefineCounter("redirect_map_redirects_total", "match", "status")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the redirect map counter: %v", res)
+	}
+	return f, nil
+}
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// parseRedirects parses the CSV or JSON redirects.
+func (p *redirectMapFilterFactory) parseRedirects(data []byte, logf logFunc) (*redirectMap, error) {
+	var rules []redirectRule
+	if strings.EqualFold(filepath.Ext(p.config.File), ".csv") {
+		r := csv.NewReader(bytes.NewReader(data))
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		r.Comment = '#'
+		for i := 0; ; i++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 && strings.EqualFold(record[0], "source") {
+				continue
+			}
+			if len(record) < 2 || len(record) > 4 {
+				line, _ := r.FieldPos(0)
+				return nil, fmt.Errorf("line %d: expected 2 to 4 fields, got %d", line, len(record))
+			}
+			rule := redirectRule{Source: record[0], Target: record[1]}
+			if len(record) > 2 && record[2] != "" {
+				if rule.Status, err = strconv.Atoi(record[2]); err != nil {
+					line, _ := r.FieldPos(2)
+					return nil, fmt.Errorf("line %d: invalid status %q", line, record[2])
+				}
+			}
+			if len(record) > 3 {
+				rule.Match = record[3]
+			}
+			rules = append(rules, rule)
+		}
+	} else if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	m := &redirectMap{exact: map[string]*redirectRule{}, prefixes: map[string]*redirectRule{}}
+	for i := range rules {
+		rule := &rules[i]
+		if !strings.HasPrefix(rule.Source, "/") || strings.Contains(rule.Source, "?") {
+			return nil, fmt.Errorf("redirect %d: source must start with / and have no query", i)
+		}
+		if rule.Target == "" || strings.ContainsAny(rule.Target, "\r\n") {
+			return nil, fmt.Errorf("redirect %d: invalid target %q", i, rule.Target)
+		}
+		if rule.Status == 0 {
+			rule.Status = p.config.DefaultStatus
+		} else if !isRedirectStatus(rule.Status) {
+			return nil, fmt.Errorf("redirect %d: invalid status %d", i, rule.Status)
+		}
+		var index map[string]*redirectRule
+		switch rule.Match {
+		case "", "exact":
+			rule.Match, index = "exact", m.exact
+		case "prefix":
+			index = m.prefixes
+			if !slices.Contains(m.prefixLengths, len(rule.Source)) {
+				m.prefixLengths = append(m.prefixLengths, len(rule.Source))
+			}
+		default:
+			return nil, fmt.Errorf("redirect %d: unknown match %q", i, rule.Match)
+		}
+		if _, ok := index[rule.Source]; ok {
+			// The later ones win, so that a redirect can be overridden by appending to the file.
+			logf(shared.LogLevelDebug, "redirect %d: duplicate source %s", i, rule.Source)
+		}
+		index[rule.Source] = rule
+	}
+	slices.SortFunc(m.prefixLengths, func(a, b int) int { return b - a })
+	return m, nil
+}
+
+// lookup returns the redirect of the path and its target, or nil if there is none.
+func (m *redirectMap) lookup(path string) (*redirectRule, string) {
+	if rule, ok := m.exact[path]; ok {
+		return rule, rule.Target
+	}
+	for _, n := range m.prefixLengths {
+		if n > len(path) {
+			continue
+		}
+		if rule, ok := m.prefixes[path[:n]]; ok {
+			return rule, rule.Target + path[n:]
+		}
+	}
+	return nil, ""
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *redirectMapFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &redirectMapFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *redirectMapFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	path, query, _ := strings.Cut(headers.GetOne(":path"), "?")
+	rule, location := p.factory.redirects.Load(p.handle.Log).lookup(path)
+	if rule == nil {
+		return shared.HeadersStatusContinue
+	}
+	if query != "" && !p.factory.config.DropQuery {
+		if strings.Contains(location, "?") {
+			location += "&" + query
+		} else {
+			location += "?" + query
+		}
+	}
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, rule.Match, strconv.Itoa(rule.Status))
+	}
+	p.handle.SendLocalResponse(uint32(rule.Status), [][2]string{{"location", location}}, nil, "redirect_map")
+	return shared.HeadersStatusStop
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisCacheDefaultKeyPrefix   = "envoy-cache:"
+	redisCacheDefaultTimeout     = 100 * time.Millisecond
+	redisCacheDefaultLockTimeout = 5 * time.Second
+	// redisCacheLockPollInterval is how often a request waiting for another one to fill the cache
+	// checks the cache.
+	redisCacheLockPollInterval = 50 * time.Millisecond
+)
+
+// redisCacheReleaseLock deletes the fill lock only if it is still held by the caller, so that a
+// lock that expired and was taken by another request is left alone.
+var redisCacheReleaseLock = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+type (
+	// redisCacheFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	redisCacheFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// redisCacheFilterConfig is the JSON configuration of the Redis cache filter.
+	redisCacheFilterConfig struct {
+		cachePolicyConfig
+		// Address is the host:port of the Redis server.
+		Address  string `json:"address" example:"127.0.0.1:6379"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+		// KeyPrefix is prepended to the Redis keys. Defaults to "envoy-cache:".
+		KeyPrefix string `json:"key_prefix"`
+		// TimeoutMs is the timeout of each Redis command. Defaults to 100ms.
+		TimeoutMs int `json:"timeout_ms"`
+		// LockTimeoutMs is how long a request filling the cache holds the lock, and therefore the
+		// longest the concurrent requests for the same key wait for it. Defaults to 5 seconds.
+		LockTimeoutMs int `json:"lock_timeout_ms"`
+	}
+	// redisCacheFilterFactory implements [shared.HttpFilterFactory].
+	redisCacheFilterFactory struct {
+		policy      *cachePolicy
+		client      *redis.Client
+		keyPrefix   string
+		timeout     time.Duration
+		lockTimeout time.Duration
+		lookups     shared.MetricID
+		hasMetric   bool
+	}
+	// redisCachedResponse is the serialized form of [cachedResponse]. The expiry is the TTL of
+	// the Redis key.
+	redisCachedResponse struct {
+		Status   uint32      `json:"status"`
+		Headers  [][2]string `json:"headers"`
+		Body     []byte      `json:"body"`
+		StoredAt time.Time   `json:"stored_at"`
+	}
+	// redisCacheFilter implements [shared.HttpFilter].
+	//
+	// This is the distributed variant of the cache filter that lets multiple Envoy instances share
+	// a cache. The lookups are network calls, so they run in a goroutine and the request is
+	// resumed via the scheduler. Only one request per key fills the cache at a time while the
+	// others wait for it, similarly to singleflight.
+	redisCacheFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *redisCacheFilterFactory
+		// redisKey and lockToken are set if this request holds the lock to fill the cache.
+		redisKey  string
+		lockToken string
+		recorder  cacheRecorder
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *redisCacheFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config redisCacheFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse Redis cache config: %w", err)
+	}
+	if config.Address == "" {
+		return nil, fmt.Errorf("address must be set")
+	}
+	f := &redisCacheFilterFactory{
+		policy: newCachePolicy(&config.cachePolicyConfig),
+		client: redis.NewClient(&redis.Options{
+			Addr:     config.Address,
+			Password: config.Password,
+			DB:       config.DB,
+		}),
+		keyPrefix:   config.KeyPrefix,
+		timeout:     time.Duration(config.TimeoutMs) * time.Millisecond,
+		lockTimeout: time.Duration(config.LockTimeoutMs) * time.Millisecond,
+	}
+	if f.keyPrefix == "" {
+		f.keyPrefix = redisCacheDefaultKeyPrefix
+	}
+	if f.timeout <= 0 {
+		f.timeout = redisCacheDefaultTimeout
+	}
+	if f.lockTimeout <= 0 {
+		f.lockTimeout = redisCacheDefaultLockTimeout
+	}
+	id, res := handle.DefineCounter("redis_cache_lookups_total", "result")
+	if res == shared.MetricsSuccess {
+		f.lookups, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the Redis cache counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *redisCacheFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &redisCacheFilter{handle: handle, factory: p, recorder: cacheRecorder{policy: p.policy}}
+}
+
+// redisKey hashes the cache key to keep the Redis keys short.
+func (p *redisCacheFilterFactory) redisKey(cacheKey string) string {
+	digest := sha256.Sum256([]byte(cacheKey))
+	return p.keyPrefix + hex.EncodeToString(digest[:])
+}
+
+// get returns the cached response, or nil on a miss.
+func (p *redisCacheFilterFactory) get(redisKey string) (*cachedResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	data, err := p.client.Get(ctx, redisKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r redisCachedResponse
+	if err = json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &cachedResponse{status: r.Status, headers: r.Headers, body: r.Body, storedAt: r.StoredAt}, nil
+}
+
+// lookup looks up the cache, and acquires the lock to fill the cache on a miss. If another
+// request holds the lock, it waits until that request fills the cache or gives up.
+//
+// Returns the result for the metrics, the cached response on a hit, and the lock token if the
+// caller should fill the cache.
+func (p *redisCacheFilterFactory) lookup(redisKey string) (string, *cachedResponse, string) {
+	cached, err := p.get(redisKey)
+	if err != nil {
+		return "error", nil, ""
+	}
+	if cached != nil {
+		return "hit", cached, ""
+	}
+
+	token := rand.Text()
+	lockKey := redisKey + ":lock"
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	acquired, err := p.client.SetNX(ctx, lockKey, token, p.lockTimeout).Result()
+	cancel()
+	if err != nil {
+		return "error", nil, ""
+	}
+	if acquired {
+		return "miss", nil, token
+	}
+
+	deadline := time.Now().Add(p.lockTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(redisCacheLockPollInterval)
+		if cached, err = p.get(redisKey); err != nil {
+			return "error", nil, ""
+		} else if cached != nil {
+			return "coalesced", cached, ""
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
+		locked, err := p.client.Exists(ctx, lockKey).Result()
+		cancel()
+		if err != nil {
+			return "error", nil, ""
+		}
+		if locked == 0 {
+			// The other request released the lock without filling the cache, for example, because
+			// the response was not cacheable.
+			break
+		}
+	}
+	return "miss", nil, ""
+}
+
+// store stores the response and releases the lock.
+func (p *redisCacheFilterFactory) store(redisKey, lockToken string, response *cachedResponse) error {
+	defer p.release(redisKey, lockToken)
+	data, err := json.Marshal(&redisCachedResponse{
+		Status:   response.status,
+		Headers:  response.headers,
+		Body:     response.body,
+		StoredAt: response.storedAt,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	return p.client.Set(ctx, redisKey, data, response.expires.Sub(response.storedAt)).Err()
+}
+
+// release releases the lock to fill the cache.
+func (p *redisCacheFilterFactory) release(redisKey, lockToken string) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	_ = redisCacheReleaseLock.Run(ctx, p.client, []string{redisKey + ":lock"}, lockToken).Err()
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *redisCacheFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	cacheKey, ok := p.factory.policy.cacheKey(headers)
+	if !ok {
+		return shared.HeadersStatusContinue
+	}
+	redisKey := p.factory.redisKey(cacheKey)
+	scheduler := p.handle.GetScheduler()
+	go func() {
+		result, cached, lockToken := p.factory.lookup(redisKey)
+		scheduler.Schedule(func() {
+			p.record(result)
+			if cached != nil {
+				sendCachedResponse(p.handle, cached, time.Now())
+				return
+			}
+			if lockToken != "" {
+				p.redisKey, p.lockToken = redisKey, lockToken
+			}
+			p.handle.ContinueRequest()
+		})
+	}()
+	return shared.HeadersStatusStop
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *redisCacheFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.lockToken == "" {
+		return shared.HeadersStatusContinue
+	}
+	headers.Set("x-cache", "MISS")
+	if response := p.recorder.onResponseHeaders(headers, endOfStream); response != nil {
+		p.store(response)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *redisCacheFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if response := p.recorder.onResponseBody(body, endOfStream); response != nil {
+		p.store(response)
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *redisCacheFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	p.recorder.onResponseTrailers()
+	return shared.TrailersStatusContinue
+}
+
+// OnStreamComplete implements [shared.HttpFilter].
+func (p *redisCacheFilter) OnStreamComplete() {
+	// Let the waiting requests go to the upstream if the response was not stored.
+	if p.lockToken != "" {
+		redisKey, lockToken := p.redisKey, p.lockToken
+		go p.factory.release(redisKey, lockToken)
+	}
+}
+
+// store stores the response in a goroutine to not block the worker thread.
+func (p *redisCacheFilter) store(response *cachedResponse) {
+	redisKey, lockToken := p.redisKey, p.lockToken
+	p.lockToken = ""
+	logf := p.handle.Log
+	go func() {
+		if err := p.factory.store(redisKey, lockToken, response); err != nil {
+			logf(shared.LogLevelWarn, "failed to store the response in Redis: %v", err)
+		}
+	}()
+}
+
+func (p *redisCacheFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.lookups, 1, result)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+type (
+	// logFunc is the signature of [shared.HttpFilterHandle.Log] and [shared.HttpFilterConfigHandle.Log].
+	logFunc func(level shared.LogLevel, format string, args ...any)
+
+	// reloadableFile holds the value parsed from a file, and reloads it when the file changes so
+	// that the filters can pick up the changes without a config push.
+	//
+	// There is no hook to stop a goroutine when the filter config is destroyed, so the file is
+	// checked lazily by Load at most once per interval across all the worker threads.
+	reloadableFile[T any] struct {
+		path     string
+		interval time.Duration
+		parse    func(data []byte, logf logFunc) (T, error)
+		current  atomic.Pointer[reloadedValue[T]]
+		// lastCheck is the Unix nano time the file was last checked for changes.
+		lastCheck atomic.Int64
+	}
+	reloadedValue[T any] struct {
+		value   T
+		modTime time.Time
+		size    int64
+	}
+)
+
+// newReloadableFile loads the file at path. Unlike the reloads, the initial load fails on errors.
+func newReloadableFile[T any](path string, interval time.Duration, parse func(data []byte, logf logFunc) (T, error), logf logFunc) (*reloadableFile[T], error) {
+	f := &reloadableFile[T]{path: path, interval: interval, parse: parse}
+	v, err := f.load(logf)
+	if err != nil {
+		return nil, err
+	}
+	f.current.Store(v)
+	f.lastCheck.Store(time.Now().UnixNano())
+	return f, nil
+}
+
+// Load returns the latest value, reloading the file first if it has changed.
+func (f *reloadableFile[T]) Load(logf logFunc) T {
+	now := time.Now().UnixNano()
+	last := f.lastCheck.Load()
+	if time.Duration(now-last) >= f.interval && f.lastCheck.CompareAndSwap(last, now) {
+		f.maybeReload(logf)
+	}
+	return f.current.Load().value
+}
+
+func (f *reloadableFile[T]) maybeReload(logf logFunc) {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		logf(shared.LogLevelWarn, "failed to stat %s: %v", f.path, err)
+		return
+	}
+	if current := f.current.Load(); stat.ModTime().Equal(current.modTime) && stat.Size() == current.size {
+		return
+	}
+	v, err := f.load(logf)
+	if err != nil {
+		// Keep serving with the previous value.
+		logf(shared.LogLevelWarn, "failed to reload %s: %v", f.path, err)
+		return
+	}
+	f.current.Store(v)
+	logf(shared.LogLevelInfo, "reloaded %s", f.path)
+}
+
+func (f *reloadableFile[T]) load(logf logFunc) (*reloadedValue[T], error) {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := f.parse(data, logf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", f.path, err)
+	}
+	return &reloadedValue[T]{value: value, modTime: stat.ModTime(), size: stat.Size()}, nil
+}
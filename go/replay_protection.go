@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	replayProtectionDefaultTimestampHeader = "x-timestamp"
+	replayProtectionDefaultNonceHeader     = "x-nonce"
+	replayProtectionDefaultSignatureHeader = "x-signature"
+	replayProtectionDefaultMaxSkew         = 5 * time.Minute
+	replayProtectionDefaultMaxNonces       = 100000
+	replayProtectionMaxNonceLength         = 128
+)
+
+type (
+	// replayProtectionFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	replayProtectionFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// replayProtectionFilterConfig is the JSON configuration of the replay protection filter.
+	replayProtectionFilterConfig struct {
+		// Secret is the key the requests are signed with.
+		Secret string `json:"secret" example:"example-secret"`
+		// SecretFile is the path to the file containing the secret, used if Secret is not set.
+		// The surrounding whitespace is trimmed.
+		SecretFile string `json:"secret_file"`
+		// TimestampHeader is the request header carrying the Unix time in seconds the request was
+		// signed at. Defaults to "x-timestamp".
+		TimestampHeader string `json:"timestamp_header"`
+		// NonceHeader is the request header carrying the unique value of the request. Defaults to
+		// "x-nonce".
+		NonceHeader string `json:"nonce_header"`
+		// SignatureHeader is the request header carrying the hex HMAC-SHA256 of the timestamp, the
+		// nonce, the method, and the path, separated by "\n". Defaults to "x-signature".
+		SignatureHeader string `json:"signature_header"`
+		// MaxSkewMs is how far the timestamp can be from the current time. Defaults to 5 minutes.
+		MaxSkewMs int `json:"max_skew_ms"`
+		// MaxNonces is the maximum number of the nonces remembered. The requests are rejected with
+		// 503 when the store is full, as forgetting the nonces early would let them be replayed.
+		// Defaults to 100000.
+		MaxNonces int `json:"max_nonces"`
+	}
+	// replayProtectionFilterFactory implements [shared.HttpFilterFactory].
+	replayProtectionFilterFactory struct {
+		config    replayProtectionFilterConfig
+		secret    []byte
+		maxSkew   time.Duration
+		nonces    *nonceStore
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// replayProtectionFilter implements [shared.HttpFilter].
+	//
+	// The timestamp bounds how long a captured request can be replayed, and the nonce rules out
+	// the replays within that window. Both are signed so neither can be changed by the attacker.
+	replayProtectionFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *replayProtectionFilterFactory
+		shared.EmptyHttpFilter
+	}
+	// nonceStore remembers the nonces seen in a sliding window of two generations. A nonce is
+	// remembered for at least the window, which is twice the max skew as that's how long its
+	// timestamp stays acceptable.
+	//
+	// The nonces are only remembered by this Envoy, so the clients must not be load balanced
+	// across several of them to replay a request to each.
+	nonceStore struct {
+		mux       sync.Mutex
+		window    time.Duration
+		maxNonces int
+		current   map[string]struct{}
+		previous  map[string]struct{}
+		// rotatedAt is when current was started.
+		rotatedAt time.Time
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *replayProtectionFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config replayProtectionFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse replay protection config: %w", err)
+	}
+	secret := []byte(config.Secret)
+	if len(secret) == 0 && config.SecretFile != "" {
+		data, err := os.ReadFile(config.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the secret file: %w", err)
+		}
+		secret = bytes.TrimSpace(data)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret or secret_file must be set")
+	}
+	if config.TimestampHeader == "" {
+		config.TimestampHeader = replayProtectionDefaultTimestampHeader
+	}
+	if config.NonceHeader == "" {
+		config.NonceHeader = replayProtectionDefaultNonceHeader
+	}
+	if config.SignatureHeader == "" {
+		config.SignatureHeader = replayProtectionDefaultSignatureHeader
+	}
+	if config.MaxNonces <= 0 {
+		config.MaxNonces = replayProtectionDefaultMaxNonces
+	}
+	maxSkew := time.Duration(config.MaxSkewMs) * time.Millisecond
+	if maxSkew <= 0 {
+		maxSkew = replayProtectionDefaultMaxSkew
+	}
+	f := &replayProtectionFilterFactory{
+		config:  config,
+		secret:  secret,
+		maxSkew: maxSkew,
+		nonces:  newNonceStore(2*maxSkew, config.MaxNonces, time.Now()),
+	}
+	id, res := handle.DefineCounter("replay_protection_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the replay protection counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *replayProtectionFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &replayProtectionFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *replayProtectionFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	timestamp := headers.GetOne(config.TimestampHeader)
+	nonce := headers.GetOne(config.NonceHeader)
+	signature := headers.GetOne(config.SignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return p.reject(http.StatusUnauthorized, "missing")
+	}
+	if len(nonce) > replayProtectionMaxNonceLength {
+		return p.reject(http.StatusUnauthorized, "invalid_nonce")
+	}
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, p.factory.sign(timestamp, nonce, headers.GetOne(":method"), headers.GetOne(":path"))) {
+		return p.reject(http.StatusUnauthorized, "invalid_signature")
+	}
+	// The signature is checked first so that the unsigned requests can't fill the store.
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	now := time.Now()
+	if err != nil || now.Sub(time.Unix(seconds, 0)).Abs() > p.factory.maxSkew {
+		return p.reject(http.StatusUnauthorized, "stale")
+	}
+	switch p.factory.nonces.add(nonce, now) {
+	case nonceReplayed:
+		return p.reject(http.StatusUnauthorized, "replayed")
+	case nonceStoreFull:
+		return p.reject(http.StatusServiceUnavailable, "store_full")
+	}
+	p.record("ok")
+	return shared.HeadersStatusContinue
+}
+
+// sign returns the HMAC-SHA256 of the signed fields of a request.
+func (p *replayProtectionFilterFactory) sign(timestamp, nonce, method, path string) []byte {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write([]byte(strings.Join([]string{timestamp, nonce, method, path}, "\n")))
+	return h.Sum(nil)
+}
+
+func (p *replayProtectionFilter) reject(status uint32, result string) shared.HeadersStatus {
+	p.record(result)
+	p.handle.SendLocalResponse(status, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte(http.StatusText(int(status))+"\n"), "replay_protection_"+result)
+	return shared.HeadersStatusStop
+}
+
+func (p *replayProtectionFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
+
+// nonceAddResult is the result of [nonceStore.add].
+type nonceAddResult int
+
+const (
+	nonceAdded nonceAddResult = iota
+	nonceReplayed
+	nonceStoreFull
+)
+
+func newNonceStore(window time.Duration, maxNonces int, now time.Time) *nonceStore {
+	return &nonceStore{
+		window:    window,
+		maxNonces: maxNonces,
+		current:   make(map[string]struct{}),
+		previous:  make(map[string]struct{}),
+		rotatedAt: now,
+	}
+}
+
+// add remembers the nonce unless it has been seen.
+func (s *nonceStore) add(nonce string, now time.Time) nonceAddResult {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if elapsed := now.Sub(s.rotatedAt); elapsed >= 2*s.window {
+		// Both generations are out of the window.
+		s.current, s.previous, s.rotatedAt = make(map[string]struct{}), make(map[string]struct{}), now
+	} else if elapsed >= s.window {
+		s.current, s.previous, s.rotatedAt = make(map[string]struct{}), s.current, s.rotatedAt.Add(s.window)
+	}
+	if _, ok := s.current[nonce]; ok {
+		return nonceReplayed
+	}
+	if _, ok := s.previous[nonce]; ok {
+		return nonceReplayed
+	}
+	if len(s.current)+len(s.previous) >= s.maxNonces {
+		return nonceStoreFull
+	}
+	// The header values are only valid during the callback.
+	s.current[strings.Clone(nonce)] = struct{}{}
+	return nonceAdded
+}
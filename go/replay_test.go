@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/chain"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/replay"
+	"github.com/envoyproxy/dynamic-modules-examples/go/record"
+)
+
+// TestRecordReplay records a stream of a filter with the record package, and replays the
+// recording into a new filter, which must do the same.
+func TestRecordReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		factory  shared.HttpFilterConfigFactory
+		config   string
+		request  chain.Message
+		response chain.Message
+	}{
+		{
+			name:    "header_mutation",
+			factory: &headerMutationFilterConfigFactory{},
+			config:  `{"request_headers": [["x-mutated", "true"]], "remove_response_headers": ["server"]}`,
+			request: chain.Message{Headers: [][2]string{{":method", "GET"}, {":path", "/"}}},
+			response: chain.Message{
+				Headers: [][2]string{{":status", "200"}, {"server", "upstream"}},
+				Body:    [][]byte{[]byte("hello")},
+			},
+		},
+		{
+			name:    "json_xml",
+			factory: &jsonXMLFilterConfigFactory{},
+			config:  `{"upstream_format": "xml"}`,
+			request: chain.Message{
+				Headers: [][2]string{{":method", "POST"}, {":path", "/"}, {"content-type", "application/json"}, {"accept", "application/json"}},
+				Body:    [][]byte{[]byte(`{"id":`), []byte(`1}`)},
+			},
+			response: chain.Message{
+				Headers: [][2]string{{":status", "200"}, {"content-type", "application/xml"}},
+				Body:    [][]byte{[]byte("<root><id>1</id></root>")},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			configHandle := filtertest.NewConfigHandle()
+			factory, err := (&record.ConfigFactory{Name: tc.name, Dir: dir, HttpFilterConfigFactory: tc.factory}).
+				Create(configHandle, []byte(tc.config))
+			if err != nil {
+				t.Fatalf("failed to create the filter factory: %v", err)
+			}
+			c := chain.New(t, factory)
+			c.Handles[0].Config = configHandle
+			c.Handles[0].Attributes[shared.AttributeIDSourceAddress] = "192.0.2.1:12345"
+			c.Run(tc.request, tc.response)
+
+			replay.Run(t, tc.factory, awaitRecording(t, dir))
+		})
+	}
+}
+
+// awaitRecording returns the path of the recording written to the directory, which happens on a
+// goroutine after the stream completed.
+func awaitRecording(t *testing.T, dir string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The file is complete once it parses.
+		if len(paths) > 0 {
+			if _, err := record.Load(paths[0]); err == nil {
+				return paths[0]
+			}
+		}
+		if time.Now().After(deadline) {
+			entries, _ := os.ReadDir(dir)
+			t.Fatalf("no recording was written in %s: %v", dir, entries)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	requestIDDefaultHeader = "x-request-id"
+	// requestIDMetadataNamespace is the dynamic metadata namespace the ID is set in, under "id".
+	requestIDMetadataNamespace = "request_id"
+	// requestIDMaxClientLength bounds the client-provided IDs that are trusted, so that a client
+	// can't smuggle an arbitrarily large value into the logs.
+	requestIDMaxClientLength = 128
+)
+
+type (
+	// requestIDFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	requestIDFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// requestIDFilterConfig is the JSON configuration of the request ID filter.
+	requestIDFilterConfig struct {
+		// Header is the request header carrying the ID. Defaults to "x-request-id".
+		Header string `json:"header"`
+		// ResponseHeader is the response header the ID is echoed in. Defaults to Header.
+		ResponseHeader string `json:"response_header"`
+		// TrustClient keeps the ID the client provided, as long as it is printable ASCII of at most
+		// 128 characters. Otherwise the ID is always generated, and the client-provided one is
+		// replaced.
+		TrustClient bool `json:"trust_client"`
+	}
+	// requestIDFilterFactory implements [shared.HttpFilterFactory].
+	requestIDFilterFactory struct {
+		config    requestIDFilterConfig
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// requestIDFilter implements [shared.HttpFilter].
+	//
+	// The HTTP connection manager generates its own UUIDv4 request IDs by default, so it should be
+	// configured with generate_request_id set to false for the IDs generated here to be seen.
+	requestIDFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *requestIDFilterFactory
+		id      string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *requestIDFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config requestIDFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse request id config: %w", err)
+		}
+	}
+	if config.Header == "" {
+		config.Header = requestIDDefaultHeader
+	}
+	if config.ResponseHeader == "" {
+		config.ResponseHeader = config.Header
+	}
+	f := &requestIDFilterFactory{config: config}
+	id, res := handle.DefineCounter("request_id_requests_total", "source")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the request id counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *requestIDFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &requestIDFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *requestIDFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	source := "generated"
+	if client := headers.GetOne(config.Header); client != "" {
+		if config.TrustClient && validClientRequestID(client) {
+			p.id, source = strings.Clone(client), "client"
+		} else {
+			source = "overridden"
+		}
+	}
+	if p.id == "" {
+		p.id = newUUIDv7(time.Now())
+		headers.Set(config.Header, p.id)
+	}
+	p.handle.SetMetadata(requestIDMetadataNamespace, "id", p.id)
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, source)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *requestIDFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.id != "" {
+		headers.Set(p.factory.config.ResponseHeader, p.id)
+	}
+	return shared.HeadersStatusContinue
+}
+
+func validClientRequestID(id string) bool {
+	if len(id) > requestIDMaxClientLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUIDv7 returns a UUIDv7 as defined by RFC 9562: the Unix time in milliseconds followed by
+// random bits, so that the IDs sort by the time they were generated.
+func newUUIDv7(now time.Time) string {
+	var u [16]byte
+	_, _ = rand.Read(u[6:])
+	binary.BigEndian.PutUint64(u[:8], uint64(now.UnixMilli())<<16|uint64(binary.BigEndian.Uint16(u[6:8])))
+	u[6] = 0x70 | u[6]&0x0f
+	u[8] = 0x80 | u[8]&0x3f
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
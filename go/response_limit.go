@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	responseLimitActionTruncate = "truncate"
+	responseLimitActionReplace  = "replace"
+	responseLimitActionReset    = "reset"
+
+	responseLimitDefaultMarker    = "\n[response truncated]\n"
+	responseLimitDefaultErrorBody = "Upstream response too large\n"
+)
+
+type (
+	// responseLimitFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	responseLimitFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// responseLimitFilterConfig is the JSON configuration of the response limit filter.
+	responseLimitFilterConfig struct {
+		// MaxResponseBytes is the maximum size of the response body.
+		MaxResponseBytes uint64 `json:"max_response_bytes" example:"1048576"`
+		// Action is what happens to the responses over the limit:
+		//   - "truncate" passes the body up to the limit followed by TruncationMarker, and discards
+		//     the rest.
+		//   - "replace" replies with 502 and ErrorBody instead. The responses without Content-Length
+		//     are buffered up to the limit since the status can't be changed once sent.
+		//   - "reset" streams the response and resets the stream once the limit is exceeded.
+		// Defaults to "truncate".
+		Action string `json:"action"`
+		// TruncationMarker is appended to the truncated bodies.
+		TruncationMarker *string `json:"truncation_marker"`
+		// ErrorBody is the body of the 502 responses of the replace action.
+		ErrorBody string `json:"error_body"`
+	}
+	// responseLimitFilterFactory implements [shared.HttpFilterFactory].
+	responseLimitFilterFactory struct {
+		config    responseLimitFilterConfig
+		marker    []byte
+		exceeded  shared.MetricID
+		hasMetric bool
+	}
+	// responseLimitFilter implements [shared.HttpFilter].
+	responseLimitFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *responseLimitFilterFactory
+		// active is set if the body needs to be accounted for.
+		active   bool
+		received uint64
+		// truncated is set once the body has been truncated, after which the rest is discarded.
+		truncated bool
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *responseLimitFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config responseLimitFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse response limit config: %w", err)
+	}
+	if config.MaxResponseBytes == 0 {
+		return nil, fmt.Errorf("max_response_bytes must be set")
+	}
+	switch config.Action {
+	case "":
+		config.Action = responseLimitActionTruncate
+	case responseLimitActionTruncate, responseLimitActionReplace, responseLimitActionReset:
+	default:
+		return nil, fmt.Errorf("unknown action %q", config.Action)
+	}
+	marker := responseLimitDefaultMarker
+	if config.TruncationMarker != nil {
+		marker = *config.TruncationMarker
+	}
+	if config.ErrorBody == "" {
+		config.ErrorBody = responseLimitDefaultErrorBody
+	}
+	f := &responseLimitFilterFactory{config: config, marker: []byte(marker)}
+	id, res := handle.DefineCounter("response_limit_exceeded_total", "action")
+	if res == shared.MetricsSuccess {
+		f.exceeded, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the response limit counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *responseLimitFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &responseLimitFilter{handle: handle, factory: p}
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *responseLimitFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream {
+		return shared.HeadersStatusContinue
+	}
+	config := &p.factory.config
+	contentLength, err := strconv.ParseUint(headers.GetOne("content-length"), 10, 64)
+	hasContentLength := err == nil
+	if hasContentLength && contentLength <= config.MaxResponseBytes {
+		return shared.HeadersStatusContinue
+	}
+	p.active = true
+	switch config.Action {
+	case responseLimitActionTruncate:
+		// The length is unknown until the body is truncated or not.
+		headers.Remove("content-length")
+	case responseLimitActionReplace:
+		if hasContentLength {
+			p.record()
+			p.replace()
+		}
+		// Hold the headers until the whole body is known to be within the limit.
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *responseLimitFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.active {
+		return shared.BodyStatusContinue
+	}
+	if p.truncated {
+		body.Drain(body.GetSize())
+		return shared.BodyStatusContinue
+	}
+	size := body.GetSize()
+	limit := p.factory.config.MaxResponseBytes
+	if p.received+size <= limit {
+		p.received += size
+		if p.factory.config.Action == responseLimitActionReplace && !endOfStream {
+			return shared.BodyStatusStopAndBuffer
+		}
+		return shared.BodyStatusContinue
+	}
+	p.record()
+
+	switch p.factory.config.Action {
+	case responseLimitActionTruncate:
+		keep := make([]byte, 0, limit-p.received+uint64(len(p.factory.marker)))
+		for _, chunk := range body.GetChunks() {
+			keep = append(keep, chunk[:min(uint64(len(chunk)), limit-p.received-uint64(len(keep)))]...)
+		}
+		keep = append(keep, p.factory.marker...)
+		body.Drain(size)
+		body.Append(keep)
+		p.truncated = true
+		return shared.BodyStatusContinue
+	case responseLimitActionReplace:
+		p.replace()
+	default:
+		// The response headers have been sent already, so Envoy resets the stream instead of
+		// sending the local response.
+		p.handle.SendLocalResponse(http.StatusBadGateway, nil, nil, "response_limit_reset")
+	}
+	return shared.BodyStatusStopNoBuffer
+}
+
+func (p *responseLimitFilter) replace() {
+	p.active = false
+	p.handle.SendLocalResponse(http.StatusBadGateway, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte(p.factory.config.ErrorBody), "response_limit_replaced")
+}
+
+func (p *responseLimitFilter) record() {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.exceeded, 1, p.factory.config.Action)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/scan"
+)
+
+const (
+	ruleWAFModeBlock  = "block"
+	ruleWAFModeDetect = "detect"
+
+	ruleWAFTargetPath    = "path"
+	ruleWAFTargetQuery   = "query"
+	ruleWAFTargetHeaders = "headers"
+	ruleWAFTargetBody    = "body"
+
+	ruleWAFDefaultAnomalyThreshold = 5
+	ruleWAFDefaultMaxBodyBytes     = 64 * 1024
+	ruleWAFDefaultReloadInterval   = 5 * time.Second
+	ruleWAFDefaultRuleIDsHeader    = "x-waf-rule-ids"
+	ruleWAFMetadataNamespace       = "rule_waf"
+)
+
+// ruleWAFSeverityScores are the anomaly scores of the severities as in the OWASP Core Rule Set.
+var ruleWAFSeverityScores = map[string]int{"critical": 5, "error": 4, "warning": 3, "notice": 2}
+
+type (
+	// ruleWAFFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	ruleWAFFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// ruleWAFFilterConfig is the JSON configuration of the rule WAF filter.
+	ruleWAFFilterConfig struct {
+		// RulesFile is the path to the JSON file holding the list of the rules. It is reloaded when
+		// it changes.
+		RulesFile string `json:"rules_file" example:"./testdata/waf_rules.json"`
+		// ParanoiaLevel enables the rules whose paranoia level is less than or equal to it.
+		// Defaults to 1.
+		ParanoiaLevel int `json:"paranoia_level"`
+		// AnomalyThreshold is the total score of the matched rules at which the request is
+		// considered an attack. Defaults to 5, i.e. a single critical rule.
+		AnomalyThreshold int `json:"anomaly_threshold"`
+		// Mode is either "block" to reply with 403 to the attacks or "detect" to only report them.
+		// Defaults to "block".
+		Mode string `json:"mode"`
+		// MaxBodyBytes is the number of the body bytes inspected. Defaults to 64 KiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+		// RuleIDsHeader is the response header listing the matched rule IDs. Defaults to
+		// "x-waf-rule-ids".
+		RuleIDsHeader string `json:"rule_ids_header"`
+		// ReloadIntervalMs is how often the rules file is checked for changes. Defaults to 5 seconds.
+		ReloadIntervalMs int `json:"reload_interval_ms"`
+	}
+	// ruleWAFRuleConfig is a rule in the rules file.
+	ruleWAFRuleConfig struct {
+		ID  int    `json:"id"`
+		Msg string `json:"msg"`
+		// Targets are the parts of the request inspected: "path", "query", "headers", and "body".
+		Targets []string `json:"targets"`
+		// Pattern is the RE2 regular expression matched against the decoded values of the targets.
+		Pattern string `json:"pattern"`
+		// Phrases is the list of the phrases any of which matches, regardless of the case, like the
+		// @pm operator of ModSecurity. It is set instead of Pattern, and stays fast with thousands
+		// of phrases.
+		Phrases []string `json:"phrases"`
+		// Severity is "critical", "error", "warning", or "notice".
+		Severity string `json:"severity"`
+		// ParanoiaLevel defaults to 1.
+		ParanoiaLevel int `json:"paranoia_level"`
+	}
+	// ruleWAFRule is a compiled rule, which has either re or phrases set.
+	ruleWAFRule struct {
+		id            int
+		targets       map[string]bool
+		re            *regexp.Regexp
+		phrases       *scan.Matcher
+		score         int
+		paranoiaLevel int
+	}
+	// ruleWAFFilterFactory implements [shared.HttpFilterFactory].
+	ruleWAFFilterFactory struct {
+		config    ruleWAFFilterConfig
+		rules     *reloadableFile[[]*ruleWAFRule]
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// ruleWAFFilter implements [shared.HttpFilter].
+	//
+	// The headers, the path and the query are inspected first. If the request has a body, the
+	// request is held until the body is inspected as well, so that nothing reaches the upstream
+	// before the verdict.
+	ruleWAFFilter struct {
+		handle      shared.HttpFilterHandle
+		factory     *ruleWAFFilterFactory
+		rules       []*ruleWAFRule
+		contentType string
+		body        []byte
+		// matched is the IDs of the rules matched so far, and score is the sum of their scores.
+		matched []int
+		score   int
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *ruleWAFFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config ruleWAFFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse rule waf config: %w", err)
+	}
+	if config.RulesFile == "" {
+		return nil, fmt.Errorf("rules_file must be set")
+	}
+	switch config.Mode {
+	case "":
+		config.Mode = ruleWAFModeBlock
+	case ruleWAFModeBlock, ruleWAFModeDetect:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", config.Mode)
+	}
+	if config.ParanoiaLevel <= 0 {
+		config.ParanoiaLevel = 1
+	}
+	if config.AnomalyThreshold <= 0 {
+		config.AnomalyThreshold = ruleWAFDefaultAnomalyThreshold
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = ruleWAFDefaultMaxBodyBytes
+	}
+	if config.RuleIDsHeader == "" {
+		config.RuleIDsHeader = ruleWAFDefaultRuleIDsHeader
+	}
+	reloadInterval := time.Duration(config.ReloadIntervalMs) * time.Millisecond
+	if reloadInterval <= 0 {
+		reloadInterval = ruleWAFDefaultReloadInterval
+	}
+	rules, err := newReloadableFile(config.RulesFile, reloadInterval, parseRuleWAFRules, handle.Log)
+	if err != nil {
+		return nil, err
+	}
+	f := &ruleWAFFilterFactory{config: config, rules: rules}
+	id, res := handle.DefineCounter("rule_waf_requests_total", "action")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the rule waf counter: %v", res)
+	}
+	return f, nil
+}
+
+// parseRuleWAFRules parses and compiles the rules file.
+func parseRuleWAFRules(data []byte, _ logFunc) ([]*ruleWAFRule, error) {
+	var configs []ruleWAFRuleConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	rules := make([]*ruleWAFRule, 0, len(configs))
+	for _, c := range configs {
+		score, ok := ruleWAFSeverityScores[c.Severity]
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unknown severity %q", c.ID, c.Severity)
+		}
+		rule := &ruleWAFRule{id: c.ID, targets: make(map[string]bool), score: score, paranoiaLevel: max(c.ParanoiaLevel, 1)}
+		var err error
+		switch {
+		case c.Pattern != "" && len(c.Phrases) > 0:
+			return nil, fmt.Errorf("rule %d: only one of pattern and phrases can be set", c.ID)
+		case len(c.Phrases) > 0:
+			rule.phrases, err = scan.NewMatcher(c.Phrases, true)
+		default:
+			rule.re, err = regexp.Compile(c.Pattern)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", c.ID, err)
+		}
+		for _, t := range c.Targets {
+			switch t {
+			case ruleWAFTargetPath, ruleWAFTargetQuery, ruleWAFTargetHeaders, ruleWAFTargetBody:
+				rule.targets[t] = true
+			default:
+				return nil, fmt.Errorf("rule %d: unknown target %q", c.ID, t)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *ruleWAFFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &ruleWAFFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *ruleWAFFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	// The rules are pinned for the whole request so that a reload doesn't mix two rule sets.
+	p.rules = p.factory.rules.Load(p.handle.Log)
+
+	path, rawQuery, _ := strings.Cut(headers.GetOne(":path"), "?")
+	if decoded, err := url.PathUnescape(path); err == nil {
+		path = decoded
+	}
+	p.inspect(ruleWAFTargetPath, path)
+	if query, err := url.ParseQuery(rawQuery); err == nil {
+		for k, vs := range query {
+			p.inspect(ruleWAFTargetQuery, append(vs, k)...)
+		}
+	} else {
+		p.inspect(ruleWAFTargetQuery, rawQuery)
+	}
+	for _, h := range headers.GetAll() {
+		if !strings.HasPrefix(h[0], ":") {
+			p.inspect(ruleWAFTargetHeaders, h[1])
+		}
+	}
+
+	if endOfStream || p.isAttack() {
+		if p.verdict() {
+			return shared.HeadersStatusStop
+		}
+		return shared.HeadersStatusContinue
+	}
+	// The header value is only valid during this callback.
+	p.contentType = strings.Clone(headers.GetOne("content-type"))
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *ruleWAFFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.rules == nil {
+		// The verdict has already been made.
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		if remaining := p.factory.config.MaxBodyBytes - len(p.body); remaining > 0 {
+			p.body = append(p.body, chunk[:min(len(chunk), remaining)]...)
+		}
+	}
+	if !endOfStream && len(p.body) < p.factory.config.MaxBodyBytes {
+		return shared.BodyStatusStopAndBuffer
+	}
+	p.inspectBody()
+	if p.verdict() {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *ruleWAFFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.rules == nil {
+		return shared.TrailersStatusContinue
+	}
+	p.inspectBody()
+	if p.verdict() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *ruleWAFFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if len(p.matched) > 0 {
+		headers.Set(p.factory.config.RuleIDsHeader, p.matchedIDs())
+	}
+	return shared.HeadersStatusContinue
+}
+
+// inspectBody inspects the form fields of the URL encoded bodies, and the raw body otherwise.
+func (p *ruleWAFFilter) inspectBody() {
+	mediaType, _, _ := mime.ParseMediaType(p.contentType)
+	if mediaType == "application/x-www-form-urlencoded" {
+		if form, err := url.ParseQuery(string(p.body)); err == nil {
+			for k, vs := range form {
+				p.inspect(ruleWAFTargetBody, append(vs, k)...)
+			}
+			return
+		}
+	}
+	p.inspect(ruleWAFTargetBody, string(p.body))
+}
+
+// inspect matches the values against the enabled rules of the target. A rule is counted at most
+// once per request.
+func (p *ruleWAFFilter) inspect(target string, values ...string) {
+	for _, rule := range p.rules {
+		if !rule.targets[target] || rule.paranoiaLevel > p.factory.config.ParanoiaLevel || slices.Contains(p.matched, rule.id) {
+			continue
+		}
+		for _, v := range values {
+			if rule.match(v) {
+				p.matched = append(p.matched, rule.id)
+				p.score += rule.score
+				break
+			}
+		}
+	}
+}
+
+func (r *ruleWAFRule) match(v string) bool {
+	if r.phrases != nil {
+		return r.phrases.MatchString(v)
+	}
+	return r.re.MatchString(v)
+}
+
+func (p *ruleWAFFilter) isAttack() bool {
+	return p.score >= p.factory.config.AnomalyThreshold
+}
+
+// verdict reports the result in the dynamic metadata and the metrics, and sends the 403 response
+// if the request is blocked, in which case it returns true.
+func (p *ruleWAFFilter) verdict() bool {
+	p.rules = nil
+	action := "allowed"
+	if len(p.matched) > 0 {
+		ids := p.matchedIDs()
+		p.handle.SetMetadata(ruleWAFMetadataNamespace, "matched_rule_ids", ids)
+		p.handle.SetMetadata(ruleWAFMetadataNamespace, "anomaly_score", p.score)
+		action = "detected"
+	}
+	blocked := p.isAttack() && p.factory.config.Mode == ruleWAFModeBlock
+	if blocked {
+		action = "blocked"
+	}
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, action)
+	}
+	if blocked {
+		p.handle.SendLocalResponse(http.StatusForbidden,
+			[][2]string{{"Content-Type", "text/plain"}, {p.factory.config.RuleIDsHeader, p.matchedIDs()}},
+			[]byte("Forbidden\n"), "rule_waf_blocked")
+	}
+	return blocked
+}
+
+func (p *ruleWAFFilter) matchedIDs() string {
+	ids := make([]string, len(p.matched))
+	for i, id := range p.matched {
+		ids[i] = strconv.Itoa(id)
+	}
+	return strings.Join(ids, ",")
+}
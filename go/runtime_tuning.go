@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+// runtimeTuningMu serializes the tunings, as the configs may be loaded concurrently.
+var runtimeTuningMu sync.Mutex
+
+// runtimeTuningMemoryUnits are the units of the memory limit, as in GOMEMLIMIT.
+var runtimeTuningMemoryUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1},
+}
+
+type (
+	// runtimeTuningFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	runtimeTuningFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// runtimeTuningFilterConfig is the JSON configuration of the runtime tuning filter.
+	//
+	// The Go runtime shares the Envoy process, so its garbage collector competes with the proxy
+	// for the CPU and the memory. The GOGC, GOMEMLIMIT and GOMAXPROCS environment variables of
+	// Envoy already apply when the module is loaded. This config sets them when it is loaded
+	// instead, so they can be changed without restarting Envoy. The runtime settings are global,
+	// so the last config loaded wins.
+	runtimeTuningFilterConfig struct {
+		// GCPercent is GOGC. A negative value turns the garbage collector off until the memory
+		// limit is reached. Unset keeps the current value.
+		GCPercent *int `json:"gc_percent"`
+		// MemoryLimit is GOMEMLIMIT, such as "512MiB". Unset keeps the current value.
+		MemoryLimit string `json:"memory_limit"`
+		// MaxProcs caps GOMAXPROCS, which defaults to the number of CPUs, so that the module's
+		// goroutines can't take every core from the Envoy workers. Zero keeps the current value.
+		MaxProcs int `json:"max_procs"`
+	}
+	// runtimeTuningFilterFactory implements [shared.HttpFilterFactory].
+	runtimeTuningFilterFactory struct{}
+	// runtimeTuningFilter implements [shared.HttpFilter]. It does nothing on the requests.
+	runtimeTuningFilter struct {
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *runtimeTuningFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config runtimeTuningFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse runtime tuning config: %w", err)
+	}
+	memoryLimit := int64(-1)
+	if config.MemoryLimit != "" {
+		var err error
+		if memoryLimit, err = parseMemoryLimit(config.MemoryLimit); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxProcs < 0 {
+		return nil, fmt.Errorf("max_procs must not be negative")
+	}
+
+	runtimeTuningMu.Lock()
+	defer runtimeTuningMu.Unlock()
+	if config.GCPercent != nil {
+		previous := debug.SetGCPercent(*config.GCPercent)
+		handle.Log(shared.LogLevelInfo, "set GOGC to %d (was %d)", *config.GCPercent, previous)
+	}
+	if memoryLimit >= 0 {
+		// A negative limit only reads the current one.
+		previous := debug.SetMemoryLimit(memoryLimit)
+		handle.Log(shared.LogLevelInfo, "set GOMEMLIMIT to %d bytes (was %d)", memoryLimit, previous)
+	}
+	if config.MaxProcs > 0 {
+		// The cap is applied to the number of CPUs rather than the current value, so that a
+		// config raising it takes effect after one lowering it.
+		procs := min(runtime.NumCPU(), config.MaxProcs)
+		previous := runtime.GOMAXPROCS(procs)
+		handle.Log(shared.LogLevelInfo, "set GOMAXPROCS to %d (was %d)", procs, previous)
+	}
+	return &runtimeTuningFilterFactory{}, nil
+}
+
+// parseMemoryLimit parses a memory limit in the GOMEMLIMIT format, such as "512MiB", or "off".
+func parseMemoryLimit(s string) (int64, error) {
+	if s == "off" {
+		return math.MaxInt64, nil
+	}
+	number, multiplier := s, int64(1)
+	for _, unit := range runtimeTuningMemoryUnits {
+		if n, ok := strings.CutSuffix(s, unit.suffix); ok {
+			number, multiplier = n, unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid memory_limit %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *runtimeTuningFilterFactory) Create(shared.HttpFilterHandle) shared.HttpFilter {
+	return &runtimeTuningFilter{}
+}
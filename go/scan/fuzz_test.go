@@ -0,0 +1,85 @@
+package scan
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// fuzzChunks splits data into the chunks of the lengths in layout, the last one taking the rest.
+func fuzzChunks(data, layout []byte) [][]byte {
+	var chunks [][]byte
+	for _, n := range layout {
+		n := min(int(n)%16, len(data))
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return append(chunks, data)
+}
+
+func FuzzIndex(f *testing.F) {
+	f.Add([]byte("the quick brown fox"), []byte("brown"), []byte{3, 8, 0, 1})
+	f.Add([]byte("aaab"), []byte("aab"), []byte{1, 1, 1})
+	f.Fuzz(func(t *testing.T, data, sep, layout []byte) {
+		chunks := fuzzChunks(data, layout)
+		if got, want := Index(chunks, sep), int64(bytes.Index(data, sep)); got != want {
+			t.Fatalf("Index(%q, %q) = %d, want %d", chunks, sep, got, want)
+		}
+		if len(sep) > 0 {
+			if got, want := IndexByte(chunks, sep[0]), int64(bytes.IndexByte(data, sep[0])); got != want {
+				t.Fatalf("IndexByte(%q, %q) = %d, want %d", chunks, sep[0], got, want)
+			}
+		}
+	})
+}
+
+func FuzzMatcher(f *testing.F) {
+	f.Add([]byte("Shell_Exec($cmd)"), "shell_exec\npassthru", []byte{4, 4}, true)
+	f.Add([]byte("abababc"), "abc\nbab\nb", []byte{1, 2, 3}, false)
+	f.Fuzz(func(t *testing.T, data []byte, patterns string, layout []byte, ignoreCase bool) {
+		m, err := NewMatcher(strings.Split(patterns, "\n"), ignoreCase)
+		if err != nil {
+			t.Skip()
+		}
+		fold := func(b []byte) []byte {
+			if !ignoreCase {
+				return b
+			}
+			// Byte by byte, as the data need not be UTF-8.
+			folded := bytes.Clone(b)
+			for i, c := range folded {
+				if 'A' <= c && c <= 'Z' {
+					folded[i] = c + 'a' - 'A'
+				}
+			}
+			return folded
+		}
+		// Count the occurrences by their ends the slow way.
+		folded := fold(data)
+		var want []Match
+		for end := 1; end <= len(data); end++ {
+			for i, p := range m.Patterns() {
+				if bytes.HasSuffix(folded[:end], fold([]byte(p))) {
+					want = append(want, Match{Pattern: i, End: int64(end)})
+				}
+			}
+		}
+		var got []Match
+		m.ScanChunks(fuzzChunks(data, layout), func(match Match) bool {
+			got = append(got, match)
+			return true
+		})
+		if len(got) != len(want) {
+			t.Fatalf("got %d matches, want %d", len(got), len(want))
+		}
+		for _, match := range got {
+			p := fold([]byte(m.Patterns()[match.Pattern]))
+			if !bytes.HasSuffix(folded[:match.End], p) {
+				t.Fatalf("match %+v is not an occurrence", match)
+			}
+		}
+		if m.MatchString(string(data)) != (len(want) > 0) || m.MatchChunks(fuzzChunks(data, layout)) != (len(want) > 0) {
+			t.Fatalf("MatchString or MatchChunks disagrees with %d matches", len(want))
+		}
+	})
+}
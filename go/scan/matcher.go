@@ -0,0 +1,171 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	// Matcher finds any of a set of patterns in a single pass over the input, using the
+	// Aho-Corasick automaton. The time is linear in the input whatever the number of patterns,
+	// which is what the phrase lists of the WAF rules need. A Matcher is safe for concurrent use.
+	Matcher struct {
+		// next is the transition table of the automaton, indexed by the state and the byte.
+		next [][256]int32
+		// out are the indexes of the patterns ending at each state.
+		out [][]int
+		// fold maps the input bytes before the transitions, to lower case if the case is ignored.
+		fold     [256]byte
+		patterns []string
+	}
+	// Match is an occurrence of a pattern.
+	Match struct {
+		// Pattern is the index of the pattern.
+		Pattern int
+		// End is the offset in the stream right after the last byte of the occurrence.
+		End int64
+	}
+	// Scanner scans a stream written in chunks, such as a body over the body callbacks, for the
+	// patterns of a [Matcher]. The matches spanning the chunks are found. A Scanner is not safe for
+	// concurrent use.
+	Scanner struct {
+		m      *Matcher
+		state  int32
+		offset int64
+	}
+)
+
+// NewMatcher builds a Matcher of the patterns. If ignoreCase is set, the ASCII letters match
+// regardless of their case.
+func NewMatcher(patterns []string, ignoreCase bool) (*Matcher, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("no patterns")
+	}
+	m := &Matcher{patterns: patterns}
+	for i := range m.fold {
+		c := byte(i)
+		if ignoreCase && 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		m.fold[i] = c
+	}
+
+	// Build the trie of the patterns, where -1 is no transition.
+	m.addState()
+	for i, pattern := range patterns {
+		if pattern == "" {
+			return nil, fmt.Errorf("pattern %d is empty", i)
+		}
+		var state int32
+		for j := 0; j < len(pattern); j++ {
+			c := m.fold[pattern[j]]
+			if m.next[state][c] < 0 {
+				m.next[state][c] = m.addState()
+			}
+			state = m.next[state][c]
+		}
+		m.out[state] = append(m.out[state], i)
+	}
+
+	// Turn the trie into the automaton breadth first, replacing the missing transitions with the
+	// ones of the failure state, which is the longest proper suffix of the state in the trie.
+	fail := make([]int32, len(m.next))
+	var queue []int32
+	for c := range 256 {
+		if s := m.next[0][c]; s > 0 {
+			queue = append(queue, s)
+		} else {
+			m.next[0][c] = 0
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		m.out[state] = append(m.out[state], m.out[fail[state]]...)
+		for c := range 256 {
+			if s := m.next[state][c]; s >= 0 {
+				fail[s] = m.next[fail[state]][c]
+				queue = append(queue, s)
+			} else {
+				m.next[state][c] = m.next[fail[state]][c]
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *Matcher) addState() int32 {
+	var next [256]int32
+	for i := range next {
+		next[i] = -1
+	}
+	m.next = append(m.next, next)
+	m.out = append(m.out, nil)
+	return int32(len(m.next) - 1)
+}
+
+// Patterns returns the patterns of the Matcher.
+func (m *Matcher) Patterns() []string {
+	return m.patterns
+}
+
+// MatchString returns true if s contains any of the patterns.
+func (m *Matcher) MatchString(s string) bool {
+	var state int32
+	for i := 0; i < len(s); i++ {
+		state = m.next[state][m.fold[s[i]]]
+		if len(m.out[state]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchChunks returns true if the stream of the chunks contains any of the patterns.
+func (m *Matcher) MatchChunks(chunks [][]byte) bool {
+	s := m.NewScanner()
+	for _, chunk := range chunks {
+		if !s.Write(chunk, func(Match) bool { return false }) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanChunks calls fn for each match in the stream of the chunks, in the order of their ends,
+// until fn returns false.
+func (m *Matcher) ScanChunks(chunks [][]byte, fn func(Match) bool) {
+	s := m.NewScanner()
+	for _, chunk := range chunks {
+		if !s.Write(chunk, fn) {
+			return
+		}
+	}
+}
+
+// NewScanner returns a Scanner at the start of a stream.
+func (m *Matcher) NewScanner() *Scanner {
+	return &Scanner{m: m}
+}
+
+// Write scans the next chunk of the stream, and calls fn for each match ending in it, in the order
+// of their ends. It stops and returns false as soon as fn returns false.
+func (s *Scanner) Write(chunk []byte, fn func(Match) bool) bool {
+	m, state := s.m, s.state
+	for i, c := range chunk {
+		state = m.next[state][m.fold[c]]
+		for _, pattern := range m.out[state] {
+			if !fn(Match{Pattern: pattern, End: s.offset + int64(i) + 1}) {
+				s.state, s.offset = state, s.offset+int64(i)+1
+				return false
+			}
+		}
+	}
+	s.state, s.offset = state, s.offset+int64(len(chunk))
+	return true
+}
+
+// Reset moves the Scanner back to the start of a stream.
+func (s *Scanner) Reset() {
+	s.state, s.offset = 0, 0
+}
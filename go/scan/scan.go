@@ -0,0 +1,47 @@
+// Package scan provides byte scanning helpers for the filters inspecting bodies.
+//
+// Envoy hands the bodies over as lists of chunks, and a match may span the chunks. The helpers
+// scan the chunks as one stream without concatenating them, and [Scanner] keeps the state between
+// the body callbacks, so that a filter doesn't need to buffer the body to search it.
+package scan
+
+import "bytes"
+
+// Index returns the offset of the first occurrence of sep in the stream of the chunks, or -1 if
+// there is none. The chunks are searched with [bytes.Index], and only the bytes around their
+// boundaries are copied.
+func Index(chunks [][]byte, sep []byte) int64 {
+	if len(sep) == 0 {
+		return 0
+	}
+	var offset int64
+	// tail is the end of the stream so far that may be the start of a match.
+	var tail []byte
+	for _, chunk := range chunks {
+		if len(tail) > 0 {
+			window := append(tail[:len(tail):len(tail)], chunk[:min(len(chunk), len(sep)-1)]...)
+			if i := bytes.Index(window, sep); i >= 0 {
+				return offset - int64(len(tail)) + int64(i)
+			}
+		}
+		if i := bytes.Index(chunk, sep); i >= 0 {
+			return offset + int64(i)
+		}
+		offset += int64(len(chunk))
+		tail = append(tail, chunk...)
+		tail = tail[max(0, len(tail)-(len(sep)-1)):]
+	}
+	return -1
+}
+
+// IndexByte returns the offset of the first c in the stream of the chunks, or -1 if there is none.
+func IndexByte(chunks [][]byte, c byte) int64 {
+	var offset int64
+	for _, chunk := range chunks {
+		if i := bytes.IndexByte(chunk, c); i >= 0 {
+			return offset + int64(i)
+		}
+		offset += int64(len(chunk))
+	}
+	return -1
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	securityHeadersDefaultHSTS               = "max-age=31536000; includeSubDomains"
+	securityHeadersDefaultCSP                = "default-src 'self'; frame-ancestors 'none'"
+	securityHeadersDefaultContentTypeOptions = "nosniff"
+	securityHeadersDefaultReferrerPolicy     = "strict-origin-when-cross-origin"
+	securityHeadersDefaultPermissionsPolicy  = "camera=(), geolocation=(), microphone=()"
+)
+
+type (
+	// securityHeadersFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	securityHeadersFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// securityHeadersFilterConfig is the JSON configuration of the security headers filter. The
+	// same format is used for the per-route configuration, which replaces the filter
+	// configuration.
+	//
+	// Each header defaults to a safe value when omitted, and is left alone when set to "".
+	securityHeadersFilterConfig struct {
+		// StrictTransportSecurity is only sent on HTTPS, as the browsers ignore it otherwise.
+		StrictTransportSecurity *string `json:"strict_transport_security"`
+		ContentSecurityPolicy   *string `json:"content_security_policy"`
+		XContentTypeOptions     *string `json:"x_content_type_options"`
+		ReferrerPolicy          *string `json:"referrer_policy"`
+		PermissionsPolicy       *string `json:"permissions_policy"`
+		// ReportOnly sends the CSP as Content-Security-Policy-Report-Only, leaving the policy of the
+		// upstream in force, so that a new policy can be tried out without breaking anything.
+		ReportOnly bool `json:"report_only"`
+	}
+	// securityHeaders are the headers set on the responses.
+	securityHeaders struct {
+		hsts string
+		// headers are the other headers, whose upstream values are replaced.
+		headers [][2]string
+	}
+	// securityHeadersFilterFactory implements [shared.HttpFilterFactory].
+	securityHeadersFilterFactory struct {
+		headers *securityHeaders
+	}
+	// securityHeadersFilter implements [shared.HttpFilter].
+	//
+	// The upstream values of the headers are replaced rather than kept, since two values of these
+	// headers either combine into something stricter than intended, or the browser picks one.
+	securityHeadersFilter struct {
+		handle  shared.HttpFilterHandle
+		headers *securityHeaders
+		https   bool
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *securityHeadersFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	headers, err := parseSecurityHeadersConfig(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &securityHeadersFilterFactory{headers: headers}, nil
+}
+
+// CreatePerRoute implements [shared.HttpFilterConfigFactory].
+func (p *securityHeadersFilterConfigFactory) CreatePerRoute(unparsedConfig []byte) (any, error) {
+	return parseSecurityHeadersConfig(unparsedConfig)
+}
+
+func parseSecurityHeadersConfig(unparsedConfig []byte) (*securityHeaders, error) {
+	var config securityHeadersFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse security headers config: %w", err)
+		}
+	}
+	value := func(v *string, def string) string {
+		if v == nil {
+			return def
+		}
+		return *v
+	}
+	csp := "content-security-policy"
+	if config.ReportOnly {
+		csp = "content-security-policy-report-only"
+	}
+	h := &securityHeaders{hsts: value(config.StrictTransportSecurity, securityHeadersDefaultHSTS)}
+	for _, header := range [][2]string{
+		{csp, value(config.ContentSecurityPolicy, securityHeadersDefaultCSP)},
+		{"x-content-type-options", value(config.XContentTypeOptions, securityHeadersDefaultContentTypeOptions)},
+		{"referrer-policy", value(config.ReferrerPolicy, securityHeadersDefaultReferrerPolicy)},
+		{"permissions-policy", value(config.PermissionsPolicy, securityHeadersDefaultPermissionsPolicy)},
+	} {
+		if strings.ContainsAny(header[1], "\r\n") {
+			return nil, fmt.Errorf("invalid %s value %q", header[0], header[1])
+		}
+		if header[1] != "" {
+			h.headers = append(h.headers, header)
+		}
+	}
+	if strings.ContainsAny(h.hsts, "\r\n") {
+		return nil, fmt.Errorf("invalid strict-transport-security value %q", h.hsts)
+	}
+	return h, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *securityHeadersFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &securityHeadersFilter{handle: handle, headers: p.headers}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *securityHeadersFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if routeHeaders, ok := p.handle.GetMostSpecificConfig().(*securityHeaders); ok {
+		p.headers = routeHeaders
+	}
+	// The TLS may be terminated in front of Envoy.
+	proto := headers.GetOne("x-forwarded-proto")
+	if proto == "" {
+		proto = headers.GetOne(":scheme")
+	}
+	p.https = strings.EqualFold(proto, "https")
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *securityHeadersFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	for _, h := range p.headers.headers {
+		headers.Set(h[0], h[1])
+	}
+	if p.headers.hsts != "" {
+		if p.https {
+			headers.Set("strict-transport-security", p.headers.hsts)
+		} else {
+			// The upstream can't tell whether the client uses HTTPS, so its value can't be trusted.
+			headers.Remove("strict-transport-security")
+		}
+	}
+	return shared.HeadersStatusContinue
+}
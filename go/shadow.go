@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	shadowDefaultTimeoutMs     = 1000
+	shadowDefaultMaxBodyBytes  = 1 << 20
+	shadowDefaultLogPercentage = 10
+)
+
+// shadowSkippedHeaders are not copied to the shadow requests since they are hop-by-hop or set by
+// the callout.
+var shadowSkippedHeaders = map[string]struct{}{
+	"connection": {}, "content-length": {}, "keep-alive": {}, "proxy-connection": {},
+	"transfer-encoding": {}, "upgrade": {},
+}
+
+type (
+	// shadowFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	shadowFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// shadowFilterConfig is the JSON configuration of the shadow filter.
+	shadowFilterConfig struct {
+		// Cluster is the cluster the shadow requests are sent to.
+		Cluster string `json:"cluster" example:"httpbin"`
+		// Percentage is the percentage of the matching requests to shadow. Defaults to 100.
+		Percentage *float64 `json:"percentage"`
+		// MatchHeaders restricts the shadowing to the requests with all of these headers. An empty
+		// value matches any value.
+		MatchHeaders map[string]string `json:"match_headers"`
+		// TimeoutMs is the timeout of the shadow requests. Defaults to 1000.
+		TimeoutMs uint64 `json:"timeout_ms"`
+		// MaxBodyBytes is the maximum request body size to shadow. Larger requests are not
+		// shadowed. Defaults to 1MiB. It is also the maximum response body size to diff.
+		MaxBodyBytes int `json:"max_body_bytes"`
+		// Diff compares the shadow responses with the original ones when set.
+		Diff *shadowDiffConfig `json:"diff"`
+	}
+	// shadowDiffConfig configures the diffing of the shadow responses.
+	shadowDiffConfig struct {
+		// CompareHeaders are the response headers compared. Defaults to Content-Type, as most of
+		// the others, such as Date, differ anyway.
+		CompareHeaders []string `json:"compare_headers"`
+		// IgnoreJSONFields are the dot-separated paths of the fields ignored in the JSON bodies,
+		// such as "created_at" and "items.*.id", with "*" matching any key or index.
+		IgnoreJSONFields []string `json:"ignore_json_fields"`
+		// LogPercentage is the percentage of the mismatches logged with their difference.
+		// Defaults to 10.
+		LogPercentage *float64 `json:"log_percentage"`
+	}
+	// shadowFilterFactory implements [shared.HttpFilterFactory].
+	shadowFilterFactory struct {
+		cluster      string
+		percentage   float64
+		matchHeaders map[string]string
+		timeoutMs    uint64
+		maxBodyBytes int
+		// diff is non-nil if the shadow responses are diffed.
+		diff      *shadowDiffConfig
+		ignored   [][]string
+		requests  shared.MetricID
+		diffs     shared.MetricID
+		hasMetric bool
+		hasDiffs  bool
+	}
+	// shadowFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates the HTTP callouts. The selected requests are copied to the shadow
+	// cluster while the original requests proceed normally, and the shadow responses are discarded
+	// unless they are diffed. Note that the callouts are tied to the stream, so a shadow request
+	// still in flight when the original stream completes is canceled. To diff the responses, the
+	// end of the original response is therefore held until the shadow response arrives, at most
+	// for the timeout; the rest of it is streamed to the client as usual.
+	shadowFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *shadowFilterFactory
+		// headers and body are non-nil while the request is being copied.
+		headers [][2]string
+		body    []byte
+		// diff is non-nil while the responses are being diffed.
+		diff *shadowDiff
+		shared.EmptyHttpFilter
+	}
+	// shadowDiff is the state of the diffing of the responses of a request.
+	shadowDiff struct {
+		method, path    string
+		primary, shadow shadowResponse
+		// primaryDone and shadowDone are set when the responses are complete.
+		primaryDone, shadowDone bool
+		// held is set while the end of the original response waits for the shadow response.
+		held bool
+	}
+	// shadowResponse is a response captured for the diffing.
+	shadowResponse struct {
+		status      string
+		contentType string
+		// headers are the values of the compared headers.
+		headers []string
+		body    []byte
+		// tooLarge is set if the body is larger than the maximum and isn't captured.
+		tooLarge bool
+	}
+	// shadowCalloutCallback implements [shared.HttpCalloutCallback]. It discards the responses.
+	shadowCalloutCallback struct{}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *shadowFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config shadowFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse shadow config: %w", err)
+	}
+	if config.Cluster == "" {
+		return nil, fmt.Errorf("cluster must be set")
+	}
+	f := &shadowFilterFactory{
+		cluster:      config.Cluster,
+		percentage:   100,
+		matchHeaders: make(map[string]string, len(config.MatchHeaders)),
+		timeoutMs:    config.TimeoutMs,
+		maxBodyBytes: config.MaxBodyBytes,
+	}
+	if config.Percentage != nil {
+		if *config.Percentage < 0 || *config.Percentage > 100 {
+			return nil, fmt.Errorf("percentage must be between 0 and 100")
+		}
+		f.percentage = *config.Percentage
+	}
+	for k, v := range config.MatchHeaders {
+		f.matchHeaders[strings.ToLower(k)] = v
+	}
+	if f.timeoutMs == 0 {
+		f.timeoutMs = shadowDefaultTimeoutMs
+	}
+	if f.maxBodyBytes <= 0 {
+		f.maxBodyBytes = shadowDefaultMaxBodyBytes
+	}
+	id, res := handle.DefineCounter("shadow_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the shadow counter: %v", res)
+	}
+	if diff := config.Diff; diff != nil {
+		if diff.CompareHeaders == nil {
+			diff.CompareHeaders = []string{"content-type"}
+		}
+		for i, name := range diff.CompareHeaders {
+			diff.CompareHeaders[i] = strings.ToLower(name)
+		}
+		for _, field := range diff.IgnoreJSONFields {
+			if field == "" {
+				return nil, fmt.Errorf("ignore_json_fields must not be empty")
+			}
+			f.ignored = append(f.ignored, strings.Split(field, "."))
+		}
+		if diff.LogPercentage == nil {
+			percentage := float64(shadowDefaultLogPercentage)
+			diff.LogPercentage = &percentage
+		} else if *diff.LogPercentage < 0 || *diff.LogPercentage > 100 {
+			return nil, fmt.Errorf("diff.log_percentage must be between 0 and 100")
+		}
+		f.diff = diff
+		id, res := handle.DefineCounter("shadow_diffs_total", "result")
+		if res == shared.MetricsSuccess {
+			f.diffs, f.hasDiffs = id, true
+		} else {
+			handle.Log(shared.LogLevelWarn, "failed to define the shadow diffs counter: %v", res)
+		}
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *shadowFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &shadowFilter{handle: handle, factory: p}
+}
+
+// shouldShadow reports whether the request is selected for shadowing.
+func (p *shadowFilterFactory) shouldShadow(headers shared.HeaderMap) bool {
+	for name, want := range p.matchHeaders {
+		got := headers.Get(name)
+		if len(got) == 0 || (want != "" && got[0] != want) {
+			return false
+		}
+	}
+	return p.percentage >= 100 || rand.Float64()*100 < p.percentage
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *shadowFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if !p.factory.shouldShadow(headers) {
+		return shared.HeadersStatusContinue
+	}
+	if p.factory.diff != nil {
+		p.diff = &shadowDiff{method: strings.Clone(headers.GetOne(":method")), path: strings.Clone(headers.GetOne(":path"))}
+	}
+	// The header values are only valid during this callback.
+	for _, h := range headers.GetAll() {
+		name := strings.ToLower(h[0])
+		if _, skip := shadowSkippedHeaders[name]; skip {
+			continue
+		}
+		value := strings.Clone(h[1])
+		if name == ":authority" {
+			// Same as the request mirroring of Envoy so that the shadow traffic is distinguishable.
+			value += "-shadow"
+		}
+		p.headers = append(p.headers, [2]string{strings.Clone(name), value})
+	}
+	if endOfStream {
+		p.send()
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *shadowFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.headers == nil {
+		return shared.BodyStatusContinue
+	}
+	if len(p.body)+int(body.GetSize()) > p.factory.maxBodyBytes {
+		p.record("body_too_large")
+		p.headers, p.body, p.diff = nil, nil, nil
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	if endOfStream {
+		p.send()
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *shadowFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	// The callouts cannot carry trailers, so the request is shadowed without them.
+	if p.headers != nil {
+		p.send()
+	}
+	return shared.TrailersStatusContinue
+}
+
+func (p *shadowFilter) send() {
+	var cb shared.HttpCalloutCallback = shadowCalloutCallback{}
+	if p.diff != nil {
+		cb = p
+	}
+	res, _ := p.handle.HttpCallout(p.factory.cluster, p.headers, p.body, p.factory.timeoutMs, cb)
+	if res == shared.HttpCalloutInitSuccess {
+		p.record("sent")
+	} else {
+		p.handle.Log(shared.LogLevelDebug, "failed to send the shadow request: %v", res)
+		p.record("failed")
+		p.diff = nil
+	}
+	p.headers, p.body = nil, nil
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *shadowFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.diff == nil {
+		return shared.HeadersStatusContinue
+	}
+	// The header values are only valid during this callback.
+	primary := &p.diff.primary
+	primary.status = strings.Clone(headers.GetOne(":status"))
+	primary.contentType = strings.Clone(headers.GetOne("content-type"))
+	for _, name := range p.factory.diff.CompareHeaders {
+		primary.headers = append(primary.headers, strings.Clone(strings.Join(headers.Get(name), ",")))
+	}
+	if endOfStream && !p.primaryDone() {
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *shadowFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.diff == nil {
+		return shared.BodyStatusContinue
+	}
+	primary := &p.diff.primary
+	if !primary.tooLarge && len(primary.body)+int(body.GetSize()) > p.factory.maxBodyBytes {
+		primary.tooLarge, primary.body = true, nil
+	}
+	if !primary.tooLarge {
+		for _, chunk := range body.GetChunks() {
+			primary.body = append(primary.body, chunk...)
+		}
+	}
+	if endOfStream && !p.primaryDone() {
+		return shared.BodyStatusStopAndBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *shadowFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.diff != nil && !p.primaryDone() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// primaryDone marks the original response complete, and reports whether it may continue. It
+// can't if the shadow response is still in flight.
+func (p *shadowFilter) primaryDone() bool {
+	p.diff.primaryDone = true
+	if !p.diff.shadowDone {
+		p.diff.held = true
+		return false
+	}
+	p.compare()
+	return true
+}
+
+// OnHttpCalloutDone implements [shared.HttpCalloutCallback].
+func (p *shadowFilter) OnHttpCalloutDone(calloutID uint64, result shared.HttpCalloutResult, headers [][2]string, body [][]byte) {
+	d := p.diff
+	if d == nil {
+		return
+	}
+	if result != shared.HttpCalloutSuccess {
+		p.handle.Log(shared.LogLevelDebug, "shadow request failed: %v", result)
+		p.recordDiff("shadow_failed")
+		p.diff = nil
+	} else {
+		d.shadowDone = true
+		d.shadow.headers = make([]string, len(p.factory.diff.CompareHeaders))
+		for i, name := range p.factory.diff.CompareHeaders {
+			var values []string
+			for _, h := range headers {
+				if strings.EqualFold(h[0], name) {
+					values = append(values, h[1])
+				}
+			}
+			// The header values are only valid during this callback, and Join returns a single
+			// value as is.
+			d.shadow.headers[i] = strings.Clone(strings.Join(values, ","))
+		}
+		for _, h := range headers {
+			switch strings.ToLower(h[0]) {
+			case ":status":
+				d.shadow.status = strings.Clone(h[1])
+			case "content-type":
+				d.shadow.contentType = strings.Clone(h[1])
+			}
+		}
+		for _, chunk := range body {
+			if len(d.shadow.body)+len(chunk) > p.factory.maxBodyBytes {
+				d.shadow.tooLarge, d.shadow.body = true, nil
+				break
+			}
+			d.shadow.body = append(d.shadow.body, chunk...)
+		}
+		if d.primaryDone {
+			p.compare()
+		}
+	}
+	if d.held {
+		p.handle.ContinueResponse()
+	}
+}
+
+// compare diffs the complete responses, and records the result.
+func (p *shadowFilter) compare() {
+	d, config := p.diff, p.factory.diff
+	p.diff = nil
+	result, difference := p.factory.diffResponses(d)
+	p.recordDiff(result)
+	if difference != "" && *config.LogPercentage > 0 && rand.Float64()*100 < *config.LogPercentage {
+		p.handle.Log(shared.LogLevelInfo, "shadow response mismatch for %s %s: %s", d.method, d.path, difference)
+	}
+}
+
+// diffResponses returns the result of the diffing of the responses, and the first difference
+// found if they don't match.
+func (p *shadowFilterFactory) diffResponses(d *shadowDiff) (result, difference string) {
+	if d.primary.status != d.shadow.status {
+		return "status_mismatch", fmt.Sprintf("status %s != %s", d.primary.status, d.shadow.status)
+	}
+	for i, name := range p.diff.CompareHeaders {
+		if d.primary.headers[i] != d.shadow.headers[i] {
+			return "header_mismatch", fmt.Sprintf("%s: %q != %q", name, d.primary.headers[i], d.shadow.headers[i])
+		}
+	}
+	if d.primary.tooLarge || d.shadow.tooLarge {
+		return "body_too_large", ""
+	}
+	if at, ok := p.diffBodies(d); !ok {
+		return "body_mismatch", "body at " + at
+	}
+	return "match", ""
+}
+
+// diffBodies reports whether the bodies are equal, and if not, where they first differ. The JSON
+// bodies are compared regardless of the order of the members and of the ignored fields.
+func (p *shadowFilterFactory) diffBodies(d *shadowDiff) (string, bool) {
+	if jsonXMLFormat(d.primary.contentType) != jsonXMLFormatJSON || jsonXMLFormat(d.shadow.contentType) != jsonXMLFormatJSON {
+		if bytes.Equal(d.primary.body, d.shadow.body) {
+			return "", true
+		}
+		i := 0
+		for i < len(d.primary.body) && i < len(d.shadow.body) && d.primary.body[i] == d.shadow.body[i] {
+			i++
+		}
+		return "byte " + strconv.Itoa(i), false
+	}
+	var docs [2]*orderedJSON
+	for i, body := range [][]byte{d.primary.body, d.shadow.body} {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		doc, err := decodeOrderedJSON(dec)
+		if err != nil {
+			return "malformed JSON", bytes.Equal(d.primary.body, d.shadow.body)
+		}
+		for _, field := range p.ignored {
+			_ = applyJSONPath(doc, field, "", func(v *orderedJSON, _ string) error {
+				*v = orderedJSON{}
+				return nil
+			})
+		}
+		docs[i] = doc
+	}
+	return diffOrderedJSON(docs[0], docs[1], "$")
+}
+
+// diffOrderedJSON reports whether the values are equal regardless of the order of the members,
+// and if not, the path where they first differ.
+func diffOrderedJSON(a, b *orderedJSON, path string) (string, bool) {
+	if a.kind != b.kind {
+		return path, false
+	}
+	switch a.kind {
+	case '{':
+		if len(a.members) != len(b.members) {
+			return path, false
+		}
+		members := make(map[string]*orderedJSON, len(b.members))
+		for _, m := range b.members {
+			members[m.key] = m.value
+		}
+		for _, m := range a.members {
+			other, ok := members[m.key]
+			if !ok {
+				return path + "." + m.key, false
+			}
+			if at, ok := diffOrderedJSON(m.value, other, path+"."+m.key); !ok {
+				return at, false
+			}
+		}
+	case '[':
+		if len(a.items) != len(b.items) {
+			return path, false
+		}
+		for i := range a.items {
+			if at, ok := diffOrderedJSON(a.items[i], b.items[i], path+"["+strconv.Itoa(i)+"]"); !ok {
+				return at, false
+			}
+		}
+	default:
+		x, xNumber := a.scalar.(json.Number)
+		y, yNumber := b.scalar.(json.Number)
+		if xNumber && yNumber {
+			// So that 1 and 1.0 are equal.
+			xf, xErr := x.Float64()
+			yf, yErr := y.Float64()
+			if xErr == nil && yErr == nil {
+				return path, xf == yf
+			}
+		}
+		if a.scalar != b.scalar {
+			return path, false
+		}
+	}
+	return "", true
+}
+
+func (p *shadowFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
+
+func (p *shadowFilter) recordDiff(result string) {
+	if p.factory.hasDiffs {
+		p.handle.IncrementCounterValue(p.factory.diffs, 1, result)
+	}
+}
+
+// OnHttpCalloutDone implements [shared.HttpCalloutCallback].
+func (shadowCalloutCallback) OnHttpCalloutDone(uint64, shared.HttpCalloutResult, [][2]string, [][]byte) {
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	soap11Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Namespace = "http://www.w3.org/2003/05/soap-envelope"
+
+	soapDefaultMaxBodyBytes        = 1 << 20
+	soapDefaultMaxDepth            = 32
+	soapDefaultMaxElements         = 10000
+	soapDefaultMaxEntityReferences = 1000
+	soapDefaultOperationHeader     = "x-soap-operation"
+	soapDefaultActionHeader        = "x-soap-action"
+)
+
+type (
+	// soapFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	soapFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// soapFilterConfig is the JSON configuration of the SOAP filter.
+	soapFilterConfig struct {
+		// MaxBodyBytes is the maximum size of the envelopes. Defaults to 1 MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+		// MaxDepth is the maximum nesting depth of the elements. Defaults to 32.
+		MaxDepth int `json:"max_depth"`
+		// MaxElements is the maximum number of the elements. Defaults to 10000.
+		MaxElements int `json:"max_elements"`
+		// MaxEntityReferences is the maximum number of the entity and character references such as
+		// "&amp;". Defaults to 1000.
+		MaxEntityReferences int `json:"max_entity_references"`
+		// OperationHeader is the request header the operation, the name of the first element in
+		// the Body, is set in. Defaults to "x-soap-operation".
+		OperationHeader string `json:"operation_header"`
+		// ActionHeader is the request header the action is set in, either from the SOAPAction
+		// header of SOAP 1.1 or the action parameter of the Content-Type of SOAP 1.2. Defaults to
+		// "x-soap-action".
+		ActionHeader string `json:"action_header"`
+		// Operations are the operations labeled as is in the metrics. The others are labeled
+		// "other" so that a client can't blow up the number of the time series.
+		Operations []string `json:"operations"`
+	}
+	// soapFilterFactory implements [shared.HttpFilterFactory].
+	soapFilterFactory struct {
+		config     soapFilterConfig
+		operations map[string]bool
+		requests   shared.MetricID
+		hasMetric  bool
+	}
+	// soapFilter implements [shared.HttpFilter].
+	//
+	// The envelope is buffered and parsed before the request goes anywhere, so the operation can
+	// be used for routing. The route cache is cleared after the headers are set.
+	//
+	// The DTDs are rejected outright as SOAP forbids them, which rules out XXE and the entity
+	// expansion attacks such as billion laughs, since no entity can be declared without one.
+	soapFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *soapFilterFactory
+		// version is "1.1" or "1.2" while the envelope is being buffered.
+		version string
+		action  string
+		body    []byte
+		shared.EmptyHttpFilter
+	}
+	// soapEnvelope is what the inspection found out about an envelope.
+	soapEnvelope struct {
+		namespace string
+		operation string
+	}
+	// soapError is an envelope rejected by the inspection.
+	soapError struct {
+		result  string
+		message string
+	}
+)
+
+func (e *soapError) Error() string { return e.message }
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *soapFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config soapFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse SOAP config: %w", err)
+		}
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = soapDefaultMaxBodyBytes
+	}
+	if config.MaxDepth <= 0 {
+		config.MaxDepth = soapDefaultMaxDepth
+	}
+	if config.MaxElements <= 0 {
+		config.MaxElements = soapDefaultMaxElements
+	}
+	if config.MaxEntityReferences <= 0 {
+		config.MaxEntityReferences = soapDefaultMaxEntityReferences
+	}
+	if config.OperationHeader == "" {
+		config.OperationHeader = soapDefaultOperationHeader
+	}
+	if config.ActionHeader == "" {
+		config.ActionHeader = soapDefaultActionHeader
+	}
+	f := &soapFilterFactory{config: config, operations: make(map[string]bool, len(config.Operations))}
+	for _, op := range config.Operations {
+		f.operations[op] = true
+	}
+	id, res := handle.DefineCounter("soap_requests_total", "operation", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the SOAP counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *soapFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &soapFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *soapFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	// The headers are only for this filter to set.
+	if len(headers.Get(config.OperationHeader)) > 0 || len(headers.Get(config.ActionHeader)) > 0 {
+		headers.Remove(config.OperationHeader)
+		headers.Remove(config.ActionHeader)
+		p.handle.ClearRouteCache()
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+	soapAction := headers.Get("soapaction")
+	switch {
+	case mediaType == "application/soap+xml":
+		p.version, p.action = "1.2", params["action"]
+	case mediaType == "text/xml" && len(soapAction) > 0:
+		p.version, p.action = "1.1", strings.Trim(soapAction[0], `"`)
+	default:
+		return shared.HeadersStatusContinue
+	}
+	p.action = strings.Clone(p.action)
+	if endOfStream {
+		p.reject(&soapError{result: "malformed", message: "missing envelope"})
+	}
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *soapFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if p.version == "" {
+		return shared.BodyStatusContinue
+	}
+	if len(p.body)+int(body.GetSize()) > p.factory.config.MaxBodyBytes {
+		p.reject(&soapError{result: "too_large", message: "envelope too large"})
+		return shared.BodyStatusStopNoBuffer
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if !p.inspect() {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *soapFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.version != "" && !p.inspect() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// inspect inspects the buffered envelope and sets the headers, and returns false if the request
+// is rejected.
+func (p *soapFilter) inspect() bool {
+	body := p.body
+	p.body = nil
+	envelope, err := inspectSOAPEnvelope(body, &p.factory.config)
+	if err != nil {
+		var soapErr *soapError
+		if !errors.As(err, &soapErr) {
+			soapErr = &soapError{result: "malformed", message: "malformed envelope"}
+		}
+		p.reject(soapErr)
+		return false
+	}
+	if (p.version == "1.1") != (envelope.namespace == soap11Namespace) {
+		p.reject(&soapError{result: "malformed", message: "envelope version does not match the content type"})
+		return false
+	}
+	p.version = ""
+
+	headers := p.handle.RequestHeaders()
+	headers.Set(p.factory.config.OperationHeader, envelope.operation)
+	if p.action != "" {
+		headers.Set(p.factory.config.ActionHeader, p.action)
+	}
+	p.handle.ClearRouteCache()
+	p.record(envelope.operation, "ok")
+	return true
+}
+
+// reject responds with a SOAP fault of the version of the request.
+func (p *soapFilter) reject(err *soapError) {
+	p.record("", err.result)
+	status := http.StatusBadRequest
+	if err.result == "too_large" {
+		status = http.StatusRequestEntityTooLarge
+	}
+	var fault bytes.Buffer
+	var contentType string
+	if p.version == "1.2" {
+		contentType = "application/soap+xml; charset=utf-8"
+		fault.WriteString(`<env:Envelope xmlns:env="` + soap12Namespace + `"><env:Body><env:Fault>` +
+			`<env:Code><env:Value>env:Sender</env:Value></env:Code><env:Reason><env:Text xml:lang="en">`)
+		_ = xml.EscapeText(&fault, []byte(err.message))
+		fault.WriteString(`</env:Text></env:Reason></env:Fault></env:Body></env:Envelope>`)
+	} else {
+		contentType = "text/xml; charset=utf-8"
+		fault.WriteString(`<soap:Envelope xmlns:soap="` + soap11Namespace + `"><soap:Body><soap:Fault>` +
+			`<faultcode>soap:Client</faultcode><faultstring>`)
+		_ = xml.EscapeText(&fault, []byte(err.message))
+		fault.WriteString(`</faultstring></soap:Fault></soap:Body></soap:Envelope>`)
+	}
+	p.version = ""
+	p.handle.SendLocalResponse(uint32(status), [][2]string{{"Content-Type", contentType}}, fault.Bytes(), "soap_"+err.result)
+}
+
+func (p *soapFilter) record(operation, result string) {
+	if !p.factory.hasMetric {
+		return
+	}
+	if !p.factory.operations[operation] {
+		operation = "other"
+	}
+	p.handle.IncrementCounterValue(p.factory.requests, 1, operation, result)
+}
+
+// inspectSOAPEnvelope parses the envelope within the limits of the config, and returns its
+// namespace and operation.
+func inspectSOAPEnvelope(body []byte, config *soapFilterConfig) (*soapEnvelope, error) {
+	// The decoder resolves the references itself, so they are counted in the raw body. This
+	// overcounts the "&" in CDATA sections, which is fine for a limit.
+	if bytes.Count(body, []byte("&")) > config.MaxEntityReferences {
+		return nil, &soapError{result: "limit_exceeded", message: "too many entity references"}
+	}
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.CharsetReader = xmlCharsetReader
+	envelope := &soapEnvelope{}
+	// path is the local names of the open elements.
+	var path []string
+	elements := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.Directive:
+			return nil, &soapError{result: "dtd", message: "DTDs are not allowed"}
+		case xml.ProcInst:
+			if t.Target != "xml" {
+				return nil, &soapError{result: "malformed", message: "processing instructions are not allowed"}
+			}
+		case xml.StartElement:
+			elements++
+			if len(path) == config.MaxDepth || elements > config.MaxElements {
+				return nil, &soapError{result: "limit_exceeded", message: "envelope too deep or too large"}
+			}
+			switch len(path) {
+			case 0:
+				if t.Name.Local != "Envelope" || (t.Name.Space != soap11Namespace && t.Name.Space != soap12Namespace) {
+					return nil, &soapError{result: "malformed", message: "not a SOAP envelope"}
+				}
+				envelope.namespace = t.Name.Space
+			case 1:
+				if t.Name.Space != envelope.namespace || (t.Name.Local != "Header" && t.Name.Local != "Body") {
+					return nil, &soapError{result: "malformed", message: "unexpected element in the envelope"}
+				}
+			case 2:
+				if path[1] == "Body" && envelope.operation == "" {
+					envelope.operation = t.Name.Local
+				}
+			}
+			path = append(path, t.Name.Local)
+		case xml.EndElement:
+			path = path[:len(path)-1]
+		}
+	}
+	if envelope.namespace == "" {
+		return nil, &soapError{result: "malformed", message: "not a SOAP envelope"}
+	}
+	if envelope.operation == "" {
+		return nil, &soapError{result: "malformed", message: "empty body"}
+	}
+	return envelope, nil
+}
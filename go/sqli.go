@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	sqliModeBlock  = "block"
+	sqliModeDetect = "detect"
+
+	sqliDefaultMaxBodyBytes = 64 * 1024
+	sqliDefaultDetectHeader = "x-sqli-detected"
+	sqliMetadataNamespace   = "sqli"
+)
+
+// sqliRules are the detection rules by name. Each rule is evaluated against the token stream of
+// the input in every quoting context.
+var sqliRules = []struct {
+	name  string
+	match func(tokens []sqlToken, quoted bool) bool
+}{
+	{"union_select", sqliUnionSelect},
+	{"tautology", sqliTautology},
+	{"stacked_query", sqliStackedQuery},
+	{"comment_truncation", sqliCommentTruncation},
+	{"time_based", sqliTimeBased},
+}
+
+type (
+	// sqliFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	sqliFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// sqliFilterConfig is the JSON configuration of the SQL injection filter.
+	sqliFilterConfig struct {
+		// Mode is either "block" to reply with 403 or "detect" to set DetectHeader on the request
+		// and let it through. Defaults to "block".
+		Mode string `json:"mode"`
+		// DetectHeader is the request header listing the matched rules in the detect mode.
+		// Defaults to "x-sqli-detected".
+		DetectHeader string `json:"detect_header"`
+		// MaxBodyBytes is the maximum size of the form and JSON bodies inspected. Larger bodies are
+		// inspected up to this size. Defaults to 64 KiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// sqliFilterFactory implements [shared.HttpFilterFactory].
+	sqliFilterFactory struct {
+		config     sqliFilterConfig
+		detections shared.MetricID
+		hasMetric  bool
+	}
+	// sqliFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates the libinjection approach in pure Go: rather than matching the raw
+	// input with regular expressions, the input is tokenized as SQL and the rules look at the
+	// shape of the token stream, which is far less prone to false positives on plain text.
+	sqliFilter struct {
+		handle    shared.HttpFilterHandle
+		factory   *sqliFilterFactory
+		headers   shared.HeaderMap
+		mediaType string
+		body      []byte
+		// inspecting is set while the body is being buffered for the inspection.
+		inspecting bool
+		matched    []string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *sqliFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config sqliFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse sqli config: %w", err)
+		}
+	}
+	switch config.Mode {
+	case "":
+		config.Mode = sqliModeBlock
+	case sqliModeBlock, sqliModeDetect:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", config.Mode)
+	}
+	if config.DetectHeader == "" {
+		config.DetectHeader = sqliDefaultDetectHeader
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = sqliDefaultMaxBodyBytes
+	}
+	f := &sqliFilterFactory{config: config}
+	id, res := handle.DefineCounter("sqli_detections_total", "rule", "location")
+	if res == shared.MetricsSuccess {
+		f.detections, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the sqli counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *sqliFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &sqliFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *sqliFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	// The header is only trusted when set by this filter.
+	headers.Remove(p.factory.config.DetectHeader)
+	_, rawQuery, _ := strings.Cut(headers.GetOne(":path"), "?")
+	if query, err := url.ParseQuery(rawQuery); err == nil {
+		for _, vs := range query {
+			p.inspect("query", vs...)
+		}
+	}
+	if !endOfStream {
+		mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+		switch mediaType {
+		case "application/x-www-form-urlencoded", "application/json":
+			p.mediaType = mediaType
+			p.headers = headers
+			p.inspecting = true
+			return shared.HeadersStatusStop
+		}
+	}
+	if p.verdict(headers) {
+		return shared.HeadersStatusStop
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *sqliFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.inspecting {
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		if remaining := p.factory.config.MaxBodyBytes - len(p.body); remaining > 0 {
+			p.body = append(p.body, chunk[:min(len(chunk), remaining)]...)
+		}
+	}
+	if !endOfStream && len(p.body) < p.factory.config.MaxBodyBytes {
+		return shared.BodyStatusStopAndBuffer
+	}
+	p.inspectBody()
+	if p.verdict(p.headers) {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *sqliFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if !p.inspecting {
+		return shared.TrailersStatusContinue
+	}
+	p.inspectBody()
+	if p.verdict(p.headers) {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+func (p *sqliFilter) inspectBody() {
+	p.inspecting = false
+	switch p.mediaType {
+	case "application/x-www-form-urlencoded":
+		if form, err := url.ParseQuery(string(p.body)); err == nil {
+			for _, vs := range form {
+				p.inspect("body", vs...)
+			}
+		}
+	case "application/json":
+		var v any
+		if err := json.Unmarshal(p.body, &v); err == nil {
+			p.inspectJSON(v)
+		}
+	}
+}
+
+// inspectJSON inspects the string values in the JSON document.
+func (p *sqliFilter) inspectJSON(v any) {
+	switch v := v.(type) {
+	case string:
+		p.inspect("body", v)
+	case []any:
+		for _, e := range v {
+			p.inspectJSON(e)
+		}
+	case map[string]any:
+		for _, e := range v {
+			p.inspectJSON(e)
+		}
+	}
+}
+
+// inspect records the rules matched by the values.
+func (p *sqliFilter) inspect(location string, values ...string) {
+	for _, v := range values {
+		for _, rule := range detectSQLi(v) {
+			if p.factory.hasMetric {
+				p.handle.IncrementCounterValue(p.factory.detections, 1, rule, location)
+			}
+			if !slices.Contains(p.matched, rule) {
+				p.matched = append(p.matched, rule)
+			}
+		}
+	}
+}
+
+// verdict acts on the matched rules, and returns true if the request is blocked.
+func (p *sqliFilter) verdict(headers shared.HeaderMap) bool {
+	p.headers = nil
+	if len(p.matched) == 0 {
+		return false
+	}
+	rules := strings.Join(p.matched, ",")
+	p.handle.SetMetadata(sqliMetadataNamespace, "rules", rules)
+	if p.factory.config.Mode == sqliModeDetect {
+		headers.Set(p.factory.config.DetectHeader, rules)
+		return false
+	}
+	p.handle.SendLocalResponse(http.StatusForbidden, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte("Forbidden\n"), "sqli_blocked")
+	return true
+}
+
+// detectSQLi returns the names of the rules matched by the input. Like libinjection, the input is
+// tokenized as is, and as if it was injected into a single and a double quoted string literal.
+func detectSQLi(input string) []string {
+	var matched []string
+	for _, quote := range []string{"", "'", `"`} {
+		if quote != "" && !strings.Contains(input, quote) {
+			// The whole input would be a single string literal.
+			continue
+		}
+		tokens := tokenizeSQL(quote + input)
+		for _, rule := range sqliRules {
+			if !slices.Contains(matched, rule.name) && rule.match(tokens, quote != "") {
+				matched = append(matched, rule.name)
+			}
+		}
+	}
+	return matched
+}
+
+// sqliUnionSelect matches "UNION [ALL|DISTINCT] SELECT".
+func sqliUnionSelect(tokens []sqlToken, _ bool) bool {
+	tokens = withoutNoise(tokens)
+	for i, t := range tokens {
+		if t.typ != sqlTokenUnion {
+			continue
+		}
+		next := tokens[i+1:]
+		if len(next) > 0 && (next[0].value == "all" || next[0].value == "distinct") {
+			next = next[1:]
+		}
+		if len(next) > 0 && next[0].value == "select" {
+			return true
+		}
+	}
+	return false
+}
+
+// sqliTautology matches the comparisons of literals following a logical operator, such as
+// "OR 1=1" and "' OR 'a'='a".
+func sqliTautology(tokens []sqlToken, _ bool) bool {
+	tokens = withoutNoise(tokens)
+	for i := 0; i+3 < len(tokens); i++ {
+		if tokens[i].typ == sqlTokenLogic && tokens[i+1].isOperand() &&
+			tokens[i+2].typ == sqlTokenCompare && tokens[i+3].isOperand() {
+			return true
+		}
+	}
+	return false
+}
+
+// sqliStackedStatements are the statements that sqliStackedQuery looks for, with the words one of
+// which must follow the statement keyword to tell it apart from plain text such as "; update later".
+var sqliStackedStatements = map[string][]string{
+	"select": {"from"}, "insert": {"into"}, "update": {"set"}, "delete": {"from"},
+	"drop": {"table", "database"}, "create": {"table", "database"}, "alter": {"table", "database"},
+	"truncate": {"table"}, "exec": nil, "execute": nil, "declare": nil, "shutdown": nil,
+}
+
+// sqliStackedQuery matches a statement following a semicolon, such as "; DROP TABLE users".
+func sqliStackedQuery(tokens []sqlToken, _ bool) bool {
+	tokens = withoutNoise(tokens)
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i].typ != sqlTokenSemicolon || tokens[i+1].typ != sqlTokenKeyword {
+			continue
+		}
+		follows, ok := sqliStackedStatements[tokens[i+1].value]
+		if !ok {
+			continue
+		}
+		if follows == nil {
+			return true
+		}
+		for _, t := range tokens[i+2 : min(i+8, len(tokens))] {
+			if slices.Contains(follows, t.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sqliCommentTruncation matches a string literal closed by the input and followed by a comment
+// that truncates the rest of the query, such as "admin'--".
+func sqliCommentTruncation(tokens []sqlToken, quoted bool) bool {
+	return quoted && len(tokens) >= 2 && tokens[0].typ == sqlTokenString && tokens[0].closed &&
+		tokens[1].typ == sqlTokenComment
+}
+
+// sqliTimeBased matches the calls to the functions used for blind time-based injections.
+func sqliTimeBased(tokens []sqlToken, _ bool) bool {
+	for i := 0; i+1 < len(tokens); i++ {
+		switch {
+		case tokens[i].typ == sqlTokenFunction && tokens[i+1].typ == sqlTokenLeftParen:
+			switch tokens[i].value {
+			case "sleep", "benchmark", "pg_sleep":
+				return true
+			}
+		case tokens[i].value == "waitfor" && tokens[i+1].value == "delay":
+			return true
+		}
+	}
+	return false
+}
+
+// withoutNoise removes the parentheses and the comments, which are commonly inserted to evade the
+// detection, e.g. "UNION/**/SELECT".
+func withoutNoise(tokens []sqlToken) []sqlToken {
+	out := make([]sqlToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.typ != sqlTokenLeftParen && t.typ != sqlTokenRightParen && t.typ != sqlTokenComment {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+type sqlTokenType int
+
+const (
+	sqlTokenString sqlTokenType = iota
+	sqlTokenNumber
+	sqlTokenBareword
+	sqlTokenKeyword
+	sqlTokenUnion
+	sqlTokenLogic
+	sqlTokenCompare
+	sqlTokenOperator
+	sqlTokenFunction
+	sqlTokenComment
+	sqlTokenLeftParen
+	sqlTokenRightParen
+	sqlTokenComma
+	sqlTokenSemicolon
+)
+
+// sqlToken is a token of the SQL tokenizer. value is lower-cased for the words.
+type sqlToken struct {
+	typ   sqlTokenType
+	value string
+	// closed is set for the string literals terminated by a quote.
+	closed bool
+}
+
+func (t sqlToken) isOperand() bool {
+	return t.typ == sqlTokenString || t.typ == sqlTokenNumber || t.typ == sqlTokenBareword
+}
+
+// sqlWords maps the SQL words to their token type. The other words are barewords.
+var sqlWords = map[string]sqlTokenType{
+	"union": sqlTokenUnion,
+	"and":   sqlTokenLogic, "or": sqlTokenLogic, "xor": sqlTokenLogic,
+	"like": sqlTokenCompare, "rlike": sqlTokenCompare, "regexp": sqlTokenCompare, "is": sqlTokenCompare,
+	"sleep": sqlTokenFunction, "benchmark": sqlTokenFunction, "pg_sleep": sqlTokenFunction,
+	"char": sqlTokenFunction, "concat": sqlTokenFunction, "version": sqlTokenFunction,
+	"database": sqlTokenFunction, "substring": sqlTokenFunction, "ascii": sqlTokenFunction,
+}
+
+func init() {
+	for _, k := range []string{
+		"select", "insert", "update", "delete", "drop", "create", "alter", "exec", "execute", "declare",
+		"shutdown", "truncate", "from", "where", "having", "order", "group", "by", "into", "values",
+		"table", "all", "distinct", "waitfor", "delay", "null", "true", "false", "case", "when",
+		"then", "else", "end", "not", "limit", "offset", "set",
+	} {
+		sqlWords[k] = sqlTokenKeyword
+	}
+}
+
+// tokenizeSQL splits the input into SQL tokens. Whitespace is skipped.
+func tokenizeSQL(s string) []sqlToken {
+	var tokens []sqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case c == '\'' || c == '"':
+			end, closed := scanSQLString(s, i)
+			tokens = append(tokens, sqlToken{typ: sqlTokenString, value: s[i:end], closed: closed})
+			i = end
+		case c == '`':
+			end := strings.IndexByte(s[i+1:], '`')
+			if end < 0 {
+				end = len(s)
+			} else {
+				end += i + 2
+			}
+			tokens = append(tokens, sqlToken{typ: sqlTokenBareword, value: s[i:end]})
+			i = end
+		case c == '#' || strings.HasPrefix(s[i:], "--"):
+			tokens = append(tokens, sqlToken{typ: sqlTokenComment, value: s[i:]})
+			i = len(s)
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				end = len(s)
+			} else {
+				end += i + 4
+			}
+			tokens = append(tokens, sqlToken{typ: sqlTokenComment, value: s[i:end]})
+			i = end
+		case isSQLDigit(c) || (c == '.' && i+1 < len(s) && isSQLDigit(s[i+1])):
+			end := i + 1
+			for end < len(s) && (isSQLWordByte(s[end]) || s[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, sqlToken{typ: sqlTokenNumber, value: s[i:end]})
+			i = end
+		case isSQLWordByte(c) || c == '@' || c == '$':
+			end := i + 1
+			for end < len(s) && (isSQLWordByte(s[end]) || s[end] == '@' || s[end] == '$') {
+				end++
+			}
+			word := strings.ToLower(s[i:end])
+			typ, ok := sqlWords[word]
+			if !ok {
+				typ = sqlTokenBareword
+			}
+			tokens = append(tokens, sqlToken{typ: typ, value: word})
+			i = end
+		case c == '(':
+			tokens = append(tokens, sqlToken{typ: sqlTokenLeftParen, value: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, sqlToken{typ: sqlTokenRightParen, value: ")"})
+			i++
+		case c == ',':
+			tokens = append(tokens, sqlToken{typ: sqlTokenComma, value: ","})
+			i++
+		case c == ';':
+			tokens = append(tokens, sqlToken{typ: sqlTokenSemicolon, value: ";"})
+			i++
+		default:
+			end := i + 1
+			for end < len(s) && strings.IndexByte("=<>!|&+-*/%^~:", s[end]) >= 0 && !strings.HasPrefix(s[end:], "--") {
+				end++
+			}
+			op := s[i:end]
+			typ := sqlTokenOperator
+			switch op {
+			case "=", "==", "<>", "!=", "<", ">", "<=", ">=", "<=>":
+				typ = sqlTokenCompare
+			case "||", "&&":
+				typ = sqlTokenLogic
+			}
+			tokens = append(tokens, sqlToken{typ: typ, value: op})
+			i = end
+		}
+	}
+	return tokens
+}
+
+// scanSQLString returns the end of the string literal starting at s[start], and whether it is
+// terminated. Both the doubled quotes and the backslash escapes are supported.
+func scanSQLString(s string, start int) (end int, closed bool) {
+	quote := s[start]
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1, true
+		}
+	}
+	return len(s), false
+}
+
+func isSQLDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isSQLWordByte(c byte) bool {
+	return c == '_' || isSQLDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z') || c >= 0x80
+}
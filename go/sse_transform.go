@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const sseTransformDefaultMaxEventBytes = 64 << 10
+
+type (
+	// sseTransformFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	sseTransformFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// sseTransformFilterConfig is the JSON configuration of the SSE transform filter.
+	sseTransformFilterConfig struct {
+		// Rules are applied to each event in order, until one drops it.
+		Rules []sseTransformRule `json:"rules"`
+		// MaxEventBytes is the maximum size of an event. The larger events are passed through as
+		// they are, so that an event never ending doesn't grow the buffer. Defaults to 64KiB.
+		MaxEventBytes int `json:"max_event_bytes"`
+	}
+	// sseTransformRule matches the events and drops or rewrites them.
+	sseTransformRule struct {
+		// Event matches the event type. The events without a type are "message". Empty matches
+		// any event.
+		Event string `json:"event"`
+		// MatchFields matches the events whose data is a JSON object with these values at the
+		// dot-separated paths, such as {"type": "ping"}.
+		MatchFields map[string]string `json:"match_fields"`
+		// Action is "drop" or "rewrite".
+		Action string `json:"action"`
+		// RemoveFields are the dot-separated paths of the fields removed from the JSON data of
+		// "rewrite", with "*" matching any key or index.
+		RemoveFields []string `json:"remove_fields"`
+		// SetFields are the JSON values set at the dot-separated paths in the JSON data of
+		// "rewrite". The parent of each path must be an object.
+		SetFields map[string]json.RawMessage `json:"set_fields"`
+	}
+	// sseTransformFilterFactory implements [shared.HttpFilterFactory].
+	sseTransformFilterFactory struct {
+		transforms    []sseTransform
+		maxEventBytes int
+		events        shared.MetricID
+		hasMetric     bool
+	}
+	// sseTransform is the callback applied to each event. It returns false to drop the event, or
+	// true with the event possibly rewritten.
+	sseTransform func(event *sseEvent) bool
+	// sseEvent is a parsed event of a text/event-stream body.
+	sseEvent struct {
+		// fields are the lines of the event in order, including the comments with an empty name.
+		fields []sseField
+		// rewritten is set if the event must be serialized again.
+		rewritten bool
+	}
+	sseField struct {
+		name, value string
+	}
+	// sseTransformFilter implements [shared.HttpFilter].
+	//
+	// This filter demonstrates how to handle the response bodies that never end. The events are
+	// parsed as they arrive, and each complete event is transformed and sent on right away, so
+	// only an incomplete event is held, and at most up to the maximum event size.
+	sseTransformFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *sseTransformFilterFactory
+		active  bool
+		// pending is the incomplete event held for the next chunk.
+		pending []byte
+		// passthrough is set while the rest of an oversized event is passed through.
+		passthrough bool
+		out         bytes.Buffer
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *sseTransformFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config sseTransformFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse SSE transform config: %w", err)
+	}
+	f := &sseTransformFilterFactory{maxEventBytes: config.MaxEventBytes}
+	if f.maxEventBytes <= 0 {
+		f.maxEventBytes = sseTransformDefaultMaxEventBytes
+	}
+	for i, rule := range config.Rules {
+		transform, err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		f.transforms = append(f.transforms, transform)
+	}
+	id, res := handle.DefineCounter("sse_transform_events_total", "result")
+	if res == shared.MetricsSuccess {
+		f.events, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the SSE transform counter: %v", res)
+	}
+	return f, nil
+}
+
+// compile returns the callback of the rule.
+func (r *sseTransformRule) compile() (sseTransform, error) {
+	type setField struct {
+		parent []string
+		name   string
+		value  *orderedJSON
+	}
+	var removed [][]string
+	var set []setField
+	switch r.Action {
+	case "drop":
+	case "rewrite":
+		for _, path := range r.RemoveFields {
+			if path == "" {
+				return nil, fmt.Errorf("remove_fields must not be empty")
+			}
+			removed = append(removed, strings.Split(path, "."))
+		}
+		for path, raw := range r.SetFields {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.UseNumber()
+			value, err := decodeOrderedJSON(dec)
+			if err != nil || path == "" {
+				return nil, fmt.Errorf("invalid set_fields %q", path)
+			}
+			keys := strings.Split(path, ".")
+			set = append(set, setField{parent: keys[:len(keys)-1], name: keys[len(keys)-1], value: value})
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+	match := make(map[string][]string, len(r.MatchFields))
+	for path := range r.MatchFields {
+		match[path] = strings.Split(path, ".")
+	}
+	return func(event *sseEvent) bool {
+		if r.Event != "" && event.eventType() != r.Event {
+			return true
+		}
+		var doc *orderedJSON
+		if len(match) > 0 || r.Action == "rewrite" {
+			dec := json.NewDecoder(strings.NewReader(event.data()))
+			dec.UseNumber()
+			var err error
+			if doc, err = decodeOrderedJSON(dec); err != nil || doc.kind != '{' {
+				// Such as the "[DONE]" of OpenAI, which is neither matched nor rewritten.
+				return true
+			}
+		}
+		for path, keys := range match {
+			matched := false
+			_ = applyJSONPath(doc, keys, path, func(v *orderedJSON, path string) error {
+				matched = matched || sseScalarString(v) == r.MatchFields[path]
+				return nil
+			})
+			if !matched {
+				return true
+			}
+		}
+		if r.Action == "drop" {
+			return false
+		}
+		for _, keys := range removed {
+			name := keys[len(keys)-1]
+			_ = applyJSONPath(doc, keys[:len(keys)-1], "", func(v *orderedJSON, _ string) error {
+				v.members = slices.DeleteFunc(v.members, func(m orderedJSONMember) bool { return name == "*" || m.key == name })
+				return nil
+			})
+		}
+		for _, field := range set {
+			_ = applyJSONPath(doc, field.parent, "", func(v *orderedJSON, _ string) error {
+				if v.kind != '{' {
+					return nil
+				}
+				for i := range v.members {
+					if v.members[i].key == field.name {
+						v.members[i].value = field.value
+						return nil
+					}
+				}
+				v.members = append(v.members, orderedJSONMember{key: field.name, value: field.value})
+				return nil
+			})
+		}
+		var out bytes.Buffer
+		encodeOrderedJSON(&out, doc)
+		event.setData(out.String())
+		return true
+	}, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *sseTransformFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &sseTransformFilter{handle: handle, factory: p}
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *sseTransformFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream || headers.GetOne("content-encoding") != "" {
+		return shared.HeadersStatusContinue
+	}
+	if mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type")); mediaType != "text/event-stream" {
+		return shared.HeadersStatusContinue
+	}
+	p.active = true
+	headers.Remove("content-length")
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *sseTransformFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.active {
+		return shared.BodyStatusContinue
+	}
+	for _, chunk := range body.GetChunks() {
+		p.pending = append(p.pending, chunk...)
+	}
+	p.transform(endOfStream)
+	body.Drain(body.GetSize())
+	body.Append(p.out.Bytes())
+	p.out.Reset()
+	return shared.BodyStatusContinue
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *sseTransformFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.active {
+		p.transform(true)
+		p.handle.BufferedResponseBody().Append(p.out.Bytes())
+		p.out.Reset()
+	}
+	return shared.TrailersStatusContinue
+}
+
+// transform writes the complete pending events to out, transformed. At the end of the stream,
+// the incomplete event is written as it is.
+func (p *sseTransformFilter) transform(endOfStream bool) {
+	for {
+		block, rest, ok := nextSSEEvent(p.pending, endOfStream)
+		if !ok {
+			break
+		}
+		p.pending = rest
+		if p.passthrough {
+			p.passthrough = false
+			p.out.Write(block)
+			continue
+		}
+		event := parseSSEEvent(block)
+		keep := true
+		for _, transform := range p.factory.transforms {
+			if keep = transform(event); !keep {
+				break
+			}
+		}
+		switch {
+		case !keep:
+			p.record("dropped")
+		case event.rewritten:
+			p.record("rewritten")
+			event.writeTo(&p.out)
+		default:
+			p.record("passed")
+			p.out.Write(block)
+		}
+	}
+	if endOfStream || len(p.pending) > p.factory.maxEventBytes {
+		if !endOfStream && !p.passthrough {
+			p.record("too_large")
+			p.passthrough = true
+		}
+		p.out.Write(p.pending)
+		p.pending = nil
+	}
+	// The pending bytes are moved to the start so that the buffer doesn't grow forever.
+	p.pending = append(p.pending[:0:0], p.pending...)
+}
+
+func (p *sseTransformFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.events, 1, result)
+	}
+}
+
+// nextSSEEvent returns the first event of buf with its terminating blank line, and the rest. The
+// lines end with CRLF, LF or CR, so a CR at the end of buf may be the start of a CRLF unless it's
+// the end of the stream.
+func nextSSEEvent(buf []byte, endOfStream bool) (block, rest []byte, ok bool) {
+	i := 0
+	for i < len(buf) {
+		j := bytes.IndexAny(buf[i:], "\r\n")
+		if j < 0 {
+			break
+		}
+		end := i + j
+		next := end + 1
+		if buf[end] == '\r' {
+			if next == len(buf) && !endOfStream {
+				break
+			}
+			if next < len(buf) && buf[next] == '\n' {
+				next++
+			}
+		}
+		if end == i {
+			return buf[:next], buf[next:], true
+		}
+		i = next
+	}
+	return nil, buf, false
+}
+
+// parseSSEEvent parses the lines of an event.
+func parseSSEEvent(block []byte) *sseEvent {
+	event := &sseEvent{}
+	for _, line := range strings.FieldsFunc(string(block), func(r rune) bool { return r == '\r' || r == '\n' }) {
+		name, value, _ := strings.Cut(line, ":")
+		event.fields = append(event.fields, sseField{name: name, value: strings.TrimPrefix(value, " ")})
+	}
+	return event
+}
+
+// eventType returns the type of the event.
+func (e *sseEvent) eventType() string {
+	for _, f := range e.fields {
+		if f.name == "event" {
+			return f.value
+		}
+	}
+	return "message"
+}
+
+// data returns the data lines of the event joined by LF.
+func (e *sseEvent) data() string {
+	var lines []string
+	for _, f := range e.fields {
+		if f.name == "data" {
+			lines = append(lines, f.value)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// setData replaces the data lines of the event, keeping the position of the first one.
+func (e *sseEvent) setData(data string) {
+	var fields []sseField
+	replaced := false
+	for _, f := range e.fields {
+		if f.name != "data" {
+			fields = append(fields, f)
+		} else if !replaced {
+			for _, line := range strings.Split(data, "\n") {
+				fields = append(fields, sseField{name: "data", value: line})
+			}
+			replaced = true
+		}
+	}
+	e.fields, e.rewritten = fields, true
+}
+
+// writeTo writes the event with LF line endings.
+func (e *sseEvent) writeTo(out *bytes.Buffer) {
+	for _, f := range e.fields {
+		out.WriteString(f.name)
+		out.WriteString(": ")
+		out.WriteString(f.value)
+		out.WriteByte('\n')
+	}
+	out.WriteByte('\n')
+}
+
+// sseScalarString returns the scalar as a string, with the strings unquoted.
+func sseScalarString(v *orderedJSON) string {
+	if v.kind != 0 {
+		return ""
+	}
+	if s, ok := v.scalar.(string); ok {
+		return s
+	}
+	var out bytes.Buffer
+	encodeOrderedJSON(&out, v)
+	return out.String()
+}
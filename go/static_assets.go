@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	staticAssetsDefaultCacheControl   = "public, max-age=86400"
+	staticAssetsDefaultReloadInterval = 10 * time.Second
+	staticAssetsDefaultMaxFileBytes   = 1 << 20
+	staticAssetsACMEChallengePrefix   = "/.well-known/acme-challenge/"
+)
+
+// staticAssetsContentTypes are the content types of the usual well-known files, which
+// [mime.TypeByExtension] only knows if the host has a mime.types file.
+var staticAssetsContentTypes = map[string]string{
+	".txt": "text/plain; charset=utf-8",
+	".ico": "image/x-icon",
+}
+
+type (
+	// staticAssetsFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	staticAssetsFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// staticAssetsFilterConfig is the JSON configuration of the static assets filter.
+	staticAssetsFilterConfig struct {
+		Assets []staticAssetConfig `json:"assets"`
+		// ACMEChallengeDir is the directory of the ACME HTTP-01 challenge files, named by their
+		// tokens, served under /.well-known/acme-challenge/. The challenges without a file go
+		// upstream, so that another ACME client can still answer them.
+		ACMEChallengeDir string `json:"acme_challenge_dir"`
+		// ReloadIntervalMs is how often the asset files are checked for changes. Defaults to 10
+		// seconds.
+		ReloadIntervalMs int `json:"reload_interval_ms"`
+		// MaxFileBytes is the maximum size of the files, as they are held in memory. Defaults to
+		// 1MiB.
+		MaxFileBytes int64 `json:"max_file_bytes"`
+	}
+	// staticAssetConfig is a path served by the filter.
+	staticAssetConfig struct {
+		// Path is the request path, without the query, such as "/robots.txt".
+		Path string `json:"path"`
+		// Content is the inline body, and File the path to the file of the body. Exactly one must be
+		// set.
+		Content string `json:"content"`
+		File    string `json:"file"`
+		// ContentType defaults to the one of the extension of Path, or of File.
+		ContentType string `json:"content_type"`
+		// CacheControl defaults to "public, max-age=86400".
+		CacheControl string `json:"cache_control"`
+	}
+	// staticAssetsFilterFactory implements [shared.HttpFilterFactory].
+	staticAssetsFilterFactory struct {
+		assets       map[string]*staticAssetEntry
+		acmeDir      string
+		maxFileBytes int64
+		responses    shared.MetricID
+		hasMetric    bool
+	}
+	// staticAssetEntry is a configured asset, with its body either inline or in a file.
+	staticAssetEntry struct {
+		inline       *staticAsset
+		file         *reloadableFile[*staticAsset]
+		contentType  string
+		cacheControl string
+	}
+	// staticAsset is the body of an asset and its ETag.
+	staticAsset struct {
+		body []byte
+		etag string
+	}
+	// staticAssetsFilter implements [shared.HttpFilter].
+	//
+	// The assets are answered with local responses, so these requests never reach the upstream.
+	staticAssetsFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *staticAssetsFilterFactory
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *staticAssetsFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config staticAssetsFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse static assets config: %w", err)
+	}
+	interval := time.Duration(config.ReloadIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = staticAssetsDefaultReloadInterval
+	}
+	if config.MaxFileBytes <= 0 {
+		config.MaxFileBytes = staticAssetsDefaultMaxFileBytes
+	}
+	f := &staticAssetsFilterFactory{
+		assets:       make(map[string]*staticAssetEntry, len(config.Assets)),
+		acmeDir:      config.ACMEChallengeDir,
+		maxFileBytes: config.MaxFileBytes,
+	}
+	for i, asset := range config.Assets {
+		if !strings.HasPrefix(asset.Path, "/") || strings.Contains(asset.Path, "?") {
+			return nil, fmt.Errorf("assets[%d]: path must start with / and have no query", i)
+		}
+		if _, ok := f.assets[asset.Path]; ok {
+			return nil, fmt.Errorf("assets[%d]: duplicate path %s", i, asset.Path)
+		}
+		entry := &staticAssetEntry{contentType: asset.ContentType, cacheControl: asset.CacheControl}
+		if entry.contentType == "" {
+			entry.contentType = staticAssetContentType(asset.Path, asset.File)
+		}
+		if entry.cacheControl == "" {
+			entry.cacheControl = staticAssetsDefaultCacheControl
+		}
+		switch {
+		case (asset.Content == "") == (asset.File == ""):
+			return nil, fmt.Errorf("assets[%d]: exactly one of content and file must be set", i)
+		case asset.Content != "":
+			entry.inline = newStaticAsset([]byte(asset.Content))
+		default:
+			file, err := newReloadableFile(asset.File, interval, f.parseFile, handle.Log)
+			if err != nil {
+				return nil, fmt.Errorf("assets[%d]: %w", i, err)
+			}
+			entry.file = file
+		}
+		f.assets[asset.Path] = entry
+	}
+	id, res := handle.DefineCounter("static_assets_responses_total", "result")
+	if res == shared.MetricsSuccess {
+		f.responses, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the static assets counter: %v", res)
+	}
+	return f, nil
+}
+
+func (p *staticAssetsFilterFactory) parseFile(data []byte, _ logFunc) (*staticAsset, error) {
+	if int64(len(data)) > p.maxFileBytes {
+		return nil, fmt.Errorf("file is larger than %d bytes", p.maxFileBytes)
+	}
+	return newStaticAsset(data), nil
+}
+
+func newStaticAsset(body []byte) *staticAsset {
+	sum := sha256.Sum256(body)
+	return &staticAsset{body: body, etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+}
+
+// staticAssetContentType returns the content type of the extension of the request path, or else
+// of the file.
+func staticAssetContentType(path, file string) string {
+	for _, name := range []string{path, file} {
+		ext := strings.ToLower(filepath.Ext(name))
+		if contentType, ok := staticAssetsContentTypes[ext]; ok {
+			return contentType
+		}
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *staticAssetsFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &staticAssetsFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *staticAssetsFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	path, _, _ := strings.Cut(headers.GetOne(":path"), "?")
+	var asset *staticAsset
+	var contentType, cacheControl string
+	if entry, ok := p.factory.assets[path]; ok {
+		if asset = entry.inline; asset == nil {
+			asset = entry.file.Load(p.handle.Log)
+		}
+		contentType, cacheControl = entry.contentType, entry.cacheControl
+	} else if token, ok := strings.CutPrefix(path, staticAssetsACMEChallengePrefix); ok && p.factory.acmeDir != "" {
+		if asset = p.acmeChallenge(token); asset == nil {
+			return shared.HeadersStatusContinue
+		}
+		// The key authorizations change with each challenge.
+		contentType, cacheControl = "application/octet-stream", "no-store"
+	} else {
+		return shared.HeadersStatusContinue
+	}
+
+	switch headers.GetOne(":method") {
+	case http.MethodGet, http.MethodHead:
+	default:
+		p.record("method_not_allowed")
+		p.handle.SendLocalResponse(http.StatusMethodNotAllowed, [][2]string{{"allow", "GET, HEAD"}}, nil, "static_assets_method_not_allowed")
+		return shared.HeadersStatusStop
+	}
+	responseHeaders := [][2]string{{"cache-control", cacheControl}, {"etag", asset.etag}}
+	if etagMatch(headers.GetOne("if-none-match"), asset.etag) {
+		p.record("not_modified")
+		p.handle.SendLocalResponse(http.StatusNotModified, responseHeaders, nil, "static_assets_not_modified")
+		return shared.HeadersStatusStop
+	}
+	// Envoy drops the body of the local responses to HEAD requests.
+	p.record("served")
+	p.handle.SendLocalResponse(http.StatusOK, append(responseHeaders, [2]string{"content-type", contentType}), asset.body, "static_assets")
+	return shared.HeadersStatusStop
+}
+
+// acmeChallenge returns the key authorization of the token, or nil if there is no file for it.
+// The file is read on each request as the challenges are rare and short-lived.
+func (p *staticAssetsFilter) acmeChallenge(token string) *staticAsset {
+	// The tokens are base64url, which also keeps the path in the directory.
+	if token == "" || strings.TrimLeft(token, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return nil
+	}
+	path := filepath.Join(p.factory.acmeDir, token)
+	if stat, err := os.Stat(path); err != nil || !stat.Mode().IsRegular() || stat.Size() > p.factory.maxFileBytes {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		p.handle.Log(shared.LogLevelWarn, "failed to read the ACME challenge %s: %v", path, err)
+		return nil
+	}
+	return newStaticAsset(data)
+}
+
+// etagMatch reports whether the If-None-Match header matches the ETag, comparing weakly as
+// RFC 9110 requires.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *staticAssetsFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.responses, 1, result)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	stickySessionDefaultCookie       = "sticky_session"
+	stickySessionDefaultHashHeader   = "x-sticky-session"
+	stickySessionDefaultCookieMaxAge = 24 * 60 * 60
+)
+
+type (
+	// stickySessionFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	stickySessionFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// stickySessionFilterConfig is the JSON configuration of the sticky session filter.
+	stickySessionFilterConfig struct {
+		// Secret is the key the cookies are signed with. Changing it starts new sessions for
+		// everyone.
+		Secret string `json:"secret" example:"example-secret"`
+		// SecretFile is the path to the file containing the secret, used if Secret is not set.
+		// The surrounding whitespace is trimmed.
+		SecretFile string `json:"secret_file"`
+		// Cookie is the name of the affinity cookie. Defaults to "sticky_session".
+		Cookie string `json:"cookie"`
+		// CookieMaxAgeSeconds is how long a session sticks to its host. Defaults to 1 day.
+		CookieMaxAgeSeconds int `json:"cookie_max_age_seconds"`
+		// HashHeader is the request header set to the session key. The route must hash on it with
+		// a hash_policy, and the cluster must use the RING_HASH or MAGLEV load balancer.
+		// Defaults to "x-sticky-session".
+		HashHeader string `json:"hash_header"`
+		// Secure sets the Secure attribute of the cookie.
+		Secure bool `json:"secure"`
+	}
+	// stickySessionFilterFactory implements [shared.HttpFilterFactory].
+	stickySessionFilterFactory struct {
+		config    stickySessionFilterConfig
+		secret    []byte
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// stickySessionFilter implements [shared.HttpFilter].
+	//
+	// The cookie carries a random session key, its expiry, and their HMAC, so the key can't be
+	// forged to pin a client to a host of its choosing. The key itself doesn't name a host: the
+	// hash-based load balancer maps it to one, so the session moves only when the host set changes.
+	stickySessionFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *stickySessionFilterFactory
+		// setCookie is set if a new session was started and its cookie needs to be set.
+		setCookie string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *stickySessionFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config stickySessionFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse sticky session config: %w", err)
+	}
+	secret := []byte(config.Secret)
+	if len(secret) == 0 && config.SecretFile != "" {
+		data, err := os.ReadFile(config.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the secret file: %w", err)
+		}
+		secret = bytes.TrimSpace(data)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret or secret_file must be set")
+	}
+	if config.Cookie == "" {
+		config.Cookie = stickySessionDefaultCookie
+	}
+	if config.CookieMaxAgeSeconds <= 0 {
+		config.CookieMaxAgeSeconds = stickySessionDefaultCookieMaxAge
+	}
+	if config.HashHeader == "" {
+		config.HashHeader = stickySessionDefaultHashHeader
+	}
+	f := &stickySessionFilterFactory{config: config, secret: secret}
+	id, res := handle.DefineCounter("sticky_session_requests_total", "session")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the sticky session counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *stickySessionFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &stickySessionFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *stickySessionFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	now := time.Now()
+	session := "new"
+	var key string
+	if cookie, ok := requestCookie(headers, config.Cookie); ok {
+		var err error
+		if key, err = p.factory.verify(cookie, now); err != nil {
+			p.handle.Log(shared.LogLevelDebug, "ignoring the sticky session cookie: %v", err)
+			session = "invalid"
+		} else {
+			session = "existing"
+		}
+	}
+	if key == "" {
+		key = rand.Text()
+		expiry := now.Add(time.Duration(config.CookieMaxAgeSeconds) * time.Second)
+		p.setCookie = (&http.Cookie{
+			Name:     config.Cookie,
+			Value:    p.factory.sign(key, expiry),
+			Path:     "/",
+			MaxAge:   config.CookieMaxAgeSeconds,
+			HttpOnly: true,
+			Secure:   config.Secure,
+			SameSite: http.SameSiteLaxMode,
+		}).String()
+	}
+	// Set rather than add, so the client can't choose the host with the header either.
+	headers.Set(config.HashHeader, key)
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, session)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *stickySessionFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.setCookie != "" {
+		headers.Add("set-cookie", p.setCookie)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// sign returns the cookie value of the session: the key, the expiry in Unix seconds, and the
+// HMAC-SHA256 of both, separated by ".".
+func (p *stickySessionFilterFactory) sign(key string, expiry time.Time) string {
+	payload := key + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(p.mac(payload))
+}
+
+// verify returns the session key of the cookie value if it is signed and not expired.
+func (p *stickySessionFilterFactory) verify(cookie string, now time.Time) (string, error) {
+	i := strings.LastIndexByte(cookie, '.')
+	if i < 0 {
+		return "", fmt.Errorf("malformed cookie")
+	}
+	payload, sig := cookie[:i], cookie[i+1:]
+	decoded, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(decoded, p.mac(payload)) {
+		return "", fmt.Errorf("bad signature")
+	}
+	key, expiry, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || key == "" {
+		return "", fmt.Errorf("malformed cookie")
+	}
+	if now.Unix() >= unix {
+		return "", fmt.Errorf("expired cookie")
+	}
+	return key, nil
+}
+
+func (p *stickySessionFilterFactory) mac(payload string) []byte {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	tokenizationDefaultTimeoutMs    = 200
+	tokenizationDefaultTokenPrefix  = "tok_"
+	tokenizationDefaultCacheTTL     = time.Minute
+	tokenizationDefaultCacheEntries = 10000
+	tokenizationDefaultMaxBodyBytes = 1 << 20
+)
+
+// The results of processing a body.
+const (
+	// tokenizationDone means the body was processed, or left alone.
+	tokenizationDone = iota
+	// tokenizationPending means a callout is in flight, and the stream is resumed when it's done.
+	tokenizationPending
+	// tokenizationRejected means the stream was responded to.
+	tokenizationRejected
+)
+
+type (
+	// tokenizationFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	tokenizationFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// tokenizationFilterConfig is the JSON configuration of the tokenization filter.
+	tokenizationFilterConfig struct {
+		// Cluster is the cluster of the tokenization service. It must be configured in Envoy.
+		Cluster string `json:"cluster" example:"httpbin"`
+		// Authority is the :authority header of the calls. Defaults to the cluster name.
+		Authority string `json:"authority"`
+		// TokenizePath is the path {"values": [...]} is POSTed to, which must respond with
+		// {"tokens": [...]} in the same order. Defaults to "/tokenize".
+		TokenizePath string `json:"tokenize_path"`
+		// DetokenizePath is the path {"tokens": [...]} is POSTed to, which must respond with
+		// {"values": [...]} in the same order. Defaults to "/detokenize".
+		DetokenizePath string `json:"detokenize_path"`
+		// TimeoutMs is the timeout of the calls. Defaults to 200.
+		TimeoutMs uint64 `json:"timeout_ms"`
+		// Fields are the dot separated paths of the fields, as in the field encryption filter.
+		Fields []string `json:"fields" example:"[card.number]"`
+		// TokenPrefix tells the tokens from the values. Defaults to "tok_".
+		TokenPrefix string `json:"token_prefix"`
+		// CacheTTLMs is how long the tokens and the values are cached for. Defaults to 1 minute,
+		// and a negative value disables the cache.
+		CacheTTLMs int `json:"cache_ttl_ms"`
+		// CacheMaxEntries is the maximum number of the cached tokens. Defaults to 10000.
+		CacheMaxEntries int `json:"cache_max_entries"`
+		// MaxBodyBytes is the maximum size of the bodies processed. Larger request bodies are
+		// rejected with 413, and larger responses are let through with the tokens. Defaults to
+		// 1 MiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+		tokenizationRouteConfig
+	}
+	// tokenizationRouteConfig is the configuration that can be overridden per route.
+	tokenizationRouteConfig struct {
+		// Detokenize replaces the tokens in the responses with the values. It should only be
+		// enabled on the routes of the clients allowed to see the values.
+		Detokenize bool `json:"detokenize"`
+	}
+	// tokenizationFilterFactory implements [shared.HttpFilterFactory].
+	tokenizationFilterFactory struct {
+		config    tokenizationFilterConfig
+		fields    [][]string
+		cache     *lruCache
+		cacheTTL  time.Duration
+		bodies    shared.MetricID
+		hasMetric bool
+	}
+	// tokenizationFilter implements [shared.HttpFilter] and [shared.HttpCalloutCallback].
+	//
+	// The sensitive values in the request bodies are replaced with the tokens before the request
+	// goes upstream, so the upstream never sees them, and the tokens in the responses are replaced
+	// back on the routes allowed to. The bodies are held while the tokenization service is
+	// called, and the calls are batched per body.
+	tokenizationFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *tokenizationFilterFactory
+		route   *tokenizationRouteConfig
+		// response is set while the response body is being processed.
+		response bool
+		// buffering is set while a body is being buffered.
+		buffering bool
+		body      []byte
+		// doc, fields, and lookups are set while a callout is in flight. lookups are the values
+		// or tokens looked up, and fields are the fields to replace for each.
+		doc     *orderedJSON
+		fields  map[string][]*orderedJSON
+		lookups []string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *tokenizationFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config tokenizationFilterConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse tokenization config: %w", err)
+	}
+	if config.Cluster == "" {
+		return nil, fmt.Errorf("cluster must be set")
+	}
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("fields must be set")
+	}
+	if config.Authority == "" {
+		config.Authority = config.Cluster
+	}
+	if config.TokenizePath == "" {
+		config.TokenizePath = "/tokenize"
+	}
+	if config.DetokenizePath == "" {
+		config.DetokenizePath = "/detokenize"
+	}
+	if config.TimeoutMs == 0 {
+		config.TimeoutMs = tokenizationDefaultTimeoutMs
+	}
+	if config.TokenPrefix == "" {
+		config.TokenPrefix = tokenizationDefaultTokenPrefix
+	}
+	if config.CacheMaxEntries <= 0 {
+		config.CacheMaxEntries = tokenizationDefaultCacheEntries
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = tokenizationDefaultMaxBodyBytes
+	}
+	f := &tokenizationFilterFactory{config: config, cacheTTL: time.Duration(config.CacheTTLMs) * time.Millisecond}
+	if config.CacheTTLMs == 0 {
+		f.cacheTTL = tokenizationDefaultCacheTTL
+	}
+	if f.cacheTTL > 0 {
+		f.cache = newLRUCache(config.CacheMaxEntries)
+	}
+	for _, field := range config.Fields {
+		if field == "" {
+			return nil, fmt.Errorf("fields must not be empty")
+		}
+		f.fields = append(f.fields, strings.Split(field, "."))
+	}
+	id, res := handle.DefineCounter("tokenization_bodies_total", "direction", "result")
+	if res == shared.MetricsSuccess {
+		f.bodies, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the tokenization counter: %v", res)
+	}
+	return f, nil
+}
+
+// CreatePerRoute implements [shared.HttpFilterConfigFactory].
+func (p *tokenizationFilterConfigFactory) CreatePerRoute(unparsedConfig []byte) (any, error) {
+	var config tokenizationRouteConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse tokenization per-route config: %w", err)
+	}
+	return &config, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *tokenizationFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &tokenizationFilter{handle: handle, factory: p, route: &p.config.tokenizationRouteConfig}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *tokenizationFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if route, ok := p.handle.GetMostSpecificConfig().(*tokenizationRouteConfig); ok {
+		p.route = route
+	}
+	if endOfStream || jsonXMLFormat(headers.GetOne("content-type")) != jsonXMLFormatJSON {
+		return shared.HeadersStatusContinue
+	}
+	if cl, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && cl > p.factory.config.MaxBodyBytes {
+		p.reject(http.StatusRequestEntityTooLarge, "too_large")
+		return shared.HeadersStatusStop
+	}
+	p.buffering = true
+	return shared.HeadersStatusStop
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *tokenizationFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.buffering {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.reject(http.StatusRequestEntityTooLarge, "too_large")
+		return shared.BodyStatusStopNoBuffer
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	return tokenizationBodyStatus(p.process(body))
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *tokenizationFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.buffering && p.process(nil) != tokenizationDone {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *tokenizationFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if endOfStream || !p.route.Detokenize || jsonXMLFormat(headers.GetOne("content-type")) != jsonXMLFormatJSON {
+		return shared.HeadersStatusContinue
+	}
+	if cl, err := strconv.Atoi(headers.GetOne("content-length")); err == nil && cl > p.factory.config.MaxBodyBytes {
+		p.count("too_large")
+		return shared.HeadersStatusContinue
+	}
+	p.response, p.buffering, p.body = true, true, nil
+	return shared.HeadersStatusStop
+}
+
+// OnResponseBody implements [shared.HttpFilter].
+func (p *tokenizationFilter) OnResponseBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.buffering {
+		return shared.BodyStatusContinue
+	}
+	if !p.buffer(body) {
+		p.buffering, p.body = false, nil
+		p.count("too_large")
+		return shared.BodyStatusContinue
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	return tokenizationBodyStatus(p.process(body))
+}
+
+// OnResponseTrailers implements [shared.HttpFilter].
+func (p *tokenizationFilter) OnResponseTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if p.buffering && p.process(nil) != tokenizationDone {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+func tokenizationBodyStatus(result int) shared.BodyStatus {
+	switch result {
+	case tokenizationPending:
+		// The last chunk is buffered along with the others for the callout to replace.
+		return shared.BodyStatusStopAndBuffer
+	case tokenizationRejected:
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// buffer copies the chunks of the body, and returns false if the body exceeds the limit.
+func (p *tokenizationFilter) buffer(body shared.BodyBuffer) bool {
+	if len(p.body)+int(body.GetSize()) > p.factory.config.MaxBodyBytes {
+		return false
+	}
+	for _, chunk := range body.GetChunks() {
+		p.body = append(p.body, chunk...)
+	}
+	return true
+}
+
+// process replaces the fields of the buffered body with the cached tokens or values, and calls
+// the tokenization service for the rest. body is the last chunk, or nil if the body ended with
+// the trailers.
+func (p *tokenizationFilter) process(body shared.BodyBuffer) int {
+	data := p.body
+	p.buffering, p.body = false, nil
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	doc, err := decodeOrderedJSON(dec)
+	if err != nil {
+		if p.response {
+			// The tokens are safe to let through.
+			p.count("malformed")
+			return tokenizationDone
+		}
+		p.reject(http.StatusBadRequest, "malformed")
+		return tokenizationRejected
+	}
+
+	prefix := p.factory.config.TokenPrefix
+	fields := make(map[string][]*orderedJSON)
+	for i, path := range p.factory.fields {
+		_ = applyJSONPath(doc, path, p.factory.config.Fields[i], func(v *orderedJSON, _ string) error {
+			var s string
+			switch scalar := v.scalar.(type) {
+			case string:
+				s = scalar
+			case json.Number:
+				s = scalar.String()
+			default:
+				return nil
+			}
+			// Only the values are tokenized, and only the tokens are detokenized.
+			if v.kind == 0 && s != "" && strings.HasPrefix(s, prefix) == p.response {
+				fields[s] = append(fields[s], v)
+			}
+			return nil
+		})
+	}
+	if len(fields) == 0 {
+		p.count("skipped")
+		return tokenizationDone
+	}
+
+	var lookups []string
+	now := time.Now()
+	for s, vs := range fields {
+		if p.factory.cache != nil {
+			if cached := p.factory.cache.get(tokenizationCacheKey(p.response, s), now); cached != nil {
+				for _, v := range vs {
+					*v = orderedJSON{scalar: string(cached.body)}
+				}
+				delete(fields, s)
+				continue
+			}
+		}
+		lookups = append(lookups, s)
+	}
+	if len(lookups) == 0 {
+		p.replace(body, doc, "cached")
+		return tokenizationDone
+	}
+
+	config := &p.factory.config
+	path, request := config.TokenizePath, map[string][]string{"values": lookups}
+	if p.response {
+		path, request = config.DetokenizePath, map[string][]string{"tokens": lookups}
+	}
+	payload, _ := json.Marshal(request)
+	res, _ := p.handle.HttpCallout(config.Cluster, [][2]string{
+		{":method", "POST"},
+		{":path", path},
+		{":authority", config.Authority},
+		{"content-type", "application/json"},
+	}, payload, config.TimeoutMs, p)
+	if res != shared.HttpCalloutInitSuccess {
+		p.handle.Log(shared.LogLevelWarn, "failed to call the tokenization service: %v", res)
+		return p.fail()
+	}
+	p.doc, p.fields, p.lookups = doc, fields, lookups
+	return tokenizationPending
+}
+
+// OnHttpCalloutDone implements [shared.HttpCalloutCallback].
+func (p *tokenizationFilter) OnHttpCalloutDone(calloutID uint64, result shared.HttpCalloutResult, headers [][2]string, body [][]byte) {
+	doc, fields, lookups := p.doc, p.fields, p.lookups
+	p.doc, p.fields, p.lookups = nil, nil, nil
+	var results []string
+	if result != shared.HttpCalloutSuccess {
+		p.handle.Log(shared.LogLevelWarn, "tokenization service call failed: %v", result)
+	} else if status := extAuthzStatus(headers); status != http.StatusOK {
+		p.handle.Log(shared.LogLevelWarn, "tokenization service responded with status %d", status)
+	} else {
+		var response struct {
+			Tokens []string `json:"tokens"`
+			Values []string `json:"values"`
+		}
+		if err := json.Unmarshal(bytes.Join(body, nil), &response); err != nil {
+			p.handle.Log(shared.LogLevelWarn, "malformed tokenization service response: %v", err)
+		} else if results = response.Tokens; p.response {
+			results = response.Values
+		}
+	}
+	if len(results) != len(lookups) {
+		if p.fail() == tokenizationDone {
+			p.handle.ContinueResponse()
+		}
+		return
+	}
+
+	now := time.Now()
+	for i, s := range lookups {
+		for _, v := range fields[s] {
+			*v = orderedJSON{scalar: results[i]}
+		}
+		if p.factory.cache != nil {
+			// Both ways, as the tokens come back in the responses.
+			expires := now.Add(p.factory.cacheTTL)
+			p.factory.cache.put(tokenizationCacheKey(p.response, s), &cachedResponse{body: []byte(results[i]), storedAt: now, expires: expires})
+			p.factory.cache.put(tokenizationCacheKey(!p.response, results[i]), &cachedResponse{body: []byte(s), storedAt: now, expires: expires})
+		}
+	}
+	p.replace(nil, doc, "called")
+	if p.response {
+		p.handle.ContinueResponse()
+	} else {
+		p.handle.ContinueRequest()
+	}
+}
+
+// tokenizationCacheKey returns the cache key of a token to detokenize or a value to tokenize.
+func tokenizationCacheKey(token bool, s string) string {
+	if token {
+		return "token\x00" + s
+	}
+	return "value\x00" + s
+}
+
+// replace replaces the body with the document and sets Content-Length.
+func (p *tokenizationFilter) replace(body shared.BodyBuffer, doc *orderedJSON, result string) {
+	var out bytes.Buffer
+	encodeOrderedJSON(&out, doc)
+	if p.response {
+		p.handle.ResponseHeaders().Set("content-length", strconv.Itoa(out.Len()))
+		replaceBody(p.handle.BufferedResponseBody(), body, out.Bytes())
+	} else {
+		p.handle.RequestHeaders().Set("content-length", strconv.Itoa(out.Len()))
+		replaceBody(p.handle.BufferedRequestBody(), body, out.Bytes())
+	}
+	p.count(result)
+}
+
+// fail handles a failure of the tokenization service. The requests are rejected as the values
+// must not go upstream, and the responses go out with the tokens.
+func (p *tokenizationFilter) fail() int {
+	if p.response {
+		p.count("error")
+		return tokenizationDone
+	}
+	p.reject(http.StatusServiceUnavailable, "error")
+	return tokenizationRejected
+}
+
+func (p *tokenizationFilter) reject(status uint32, result string) {
+	p.count(result)
+	p.handle.SendLocalResponse(status, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte(http.StatusText(int(status))+"\n"), "tokenization_"+result)
+}
+
+func (p *tokenizationFilter) count(result string) {
+	if !p.factory.hasMetric {
+		return
+	}
+	direction := "request"
+	if p.response {
+		direction = "response"
+	}
+	p.handle.IncrementCounterValue(p.factory.bodies, 1, direction, result)
+}
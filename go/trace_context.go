@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	traceContextDefaultResponseHeader = "x-trace-id"
+	// traceContextMetadataNamespace is the dynamic metadata namespace the trace_id, span_id, and
+	// parent_span_id are set in.
+	traceContextMetadataNamespace = "trace_context"
+	// traceContextMaxTracestateMembers is the limit of the list members of tracestate by the spec.
+	traceContextMaxTracestateMembers = 32
+)
+
+type (
+	// traceContextFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	traceContextFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// traceContextFilterConfig is the JSON configuration of the trace context filter.
+	traceContextFilterConfig struct {
+		// TranslateB3 continues the trace of the B3 headers, either the single "b3" header or the
+		// "x-b3-*" ones, when the request has no valid traceparent.
+		TranslateB3 bool `json:"translate_b3"`
+		// SamplePercentage is the percentage of the new traces that are sampled. The traces
+		// continued from the client keep their sampled flag. Defaults to 100.
+		SamplePercentage *float64 `json:"sample_percentage"`
+		// ResponseHeader is the response header the trace ID is stamped in, for debugging.
+		// Defaults to "x-trace-id".
+		ResponseHeader string `json:"response_header"`
+		// TracestateKey, if set, is the tracestate member this proxy records its span ID in. It is
+		// moved to the front of the list as the spec requires of an updated member.
+		TracestateKey string `json:"tracestate_key"`
+	}
+	// traceContextFilterFactory implements [shared.HttpFilterFactory].
+	traceContextFilterFactory struct {
+		config           traceContextFilterConfig
+		samplePercentage float64
+		requests         shared.MetricID
+		hasMetric        bool
+	}
+	// traceContextFilter implements [shared.HttpFilter].
+	//
+	// The filter acts as a span of its own: the upstream sees a traceparent whose parent is the
+	// span ID generated here, so the traces show the hop through the proxy.
+	traceContextFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *traceContextFilterFactory
+		traceID string
+		shared.EmptyHttpFilter
+	}
+	// traceParent is a parsed traceparent header, or its equivalent translated from B3.
+	traceParent struct {
+		traceID  string
+		parentID string
+		sampled  bool
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *traceContextFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config traceContextFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse trace context config: %w", err)
+		}
+	}
+	if config.ResponseHeader == "" {
+		config.ResponseHeader = traceContextDefaultResponseHeader
+	}
+	if config.TracestateKey != "" && !validTracestateKey(config.TracestateKey) {
+		return nil, fmt.Errorf("invalid tracestate_key %q", config.TracestateKey)
+	}
+	f := &traceContextFilterFactory{config: config, samplePercentage: 100}
+	if config.SamplePercentage != nil {
+		if *config.SamplePercentage < 0 || *config.SamplePercentage > 100 {
+			return nil, fmt.Errorf("sample_percentage must be between 0 and 100")
+		}
+		f.samplePercentage = *config.SamplePercentage
+	}
+	id, res := handle.DefineCounter("trace_context_requests_total", "source")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the trace context counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *traceContextFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &traceContextFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *traceContextFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	source := "traceparent"
+	parent, ok := parseTraceParent(headers.GetOne("traceparent"))
+	if !ok && config.TranslateB3 {
+		source = "b3"
+		parent, ok = parseB3(headers)
+	}
+	if ok {
+		parent.traceID, parent.parentID = strings.Clone(parent.traceID), strings.Clone(parent.parentID)
+	} else {
+		source = "generated"
+		parent = traceParent{
+			traceID: randomHex(16),
+			sampled: mathrand.Float64()*100 < p.factory.samplePercentage,
+		}
+		// A tracestate without its traceparent belongs to nothing.
+		headers.Remove("tracestate")
+	}
+
+	spanID := randomHex(8)
+	flags := "00"
+	if parent.sampled {
+		flags = "01"
+	}
+	headers.Set("traceparent", "00-"+parent.traceID+"-"+spanID+"-"+flags)
+	if config.TracestateKey != "" {
+		headers.Set("tracestate", updateTracestate(strings.Join(headers.Get("tracestate"), ","), config.TracestateKey, spanID))
+	}
+
+	p.traceID = parent.traceID
+	p.handle.SetMetadata(traceContextMetadataNamespace, "trace_id", parent.traceID)
+	p.handle.SetMetadata(traceContextMetadataNamespace, "span_id", spanID)
+	if parent.parentID != "" {
+		p.handle.SetMetadata(traceContextMetadataNamespace, "parent_span_id", parent.parentID)
+	}
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, source)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnResponseHeaders implements [shared.HttpFilter].
+func (p *traceContextFilter) OnResponseHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	if p.traceID != "" {
+		headers.Set(p.factory.config.ResponseHeader, p.traceID)
+	}
+	return shared.HeadersStatusContinue
+}
+
+// parseTraceParent parses the traceparent header value. The versions other than 00 are parsed as
+// 00 as long as they start like it, as the spec asks for forward compatibility.
+func parseTraceParent(value string) (traceParent, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && (value[:2] == "00" || value[55] != '-')) {
+		return traceParent{}, false
+	}
+	version, traceID, parentID, flags := value[0:2], value[3:35], value[36:52], value[53:55]
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' || version == "ff" ||
+		!isLowerHex(version) || !isLowerHex(traceID) || !isLowerHex(parentID) || !isLowerHex(flags) ||
+		isZeroHex(traceID) || isZeroHex(parentID) {
+		return traceParent{}, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return traceParent{traceID: traceID, parentID: parentID, sampled: flagBits[0]&1 == 1}, true
+}
+
+// parseB3 parses the single b3 header, or the multiple x-b3-* headers. The 64-bit trace IDs are
+// left-padded to 128 bits.
+func parseB3(headers shared.HeaderMap) (traceParent, bool) {
+	var traceID, spanID, sampled string
+	if single := headers.GetOne("b3"); single != "" {
+		parts := strings.Split(strings.ToLower(single), "-")
+		if len(parts) < 2 {
+			return traceParent{}, false
+		}
+		traceID, spanID = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else {
+		traceID = strings.ToLower(headers.GetOne("x-b3-traceid"))
+		spanID = strings.ToLower(headers.GetOne("x-b3-spanid"))
+		sampled = headers.GetOne("x-b3-sampled")
+		if headers.GetOne("x-b3-flags") == "1" {
+			sampled = "d"
+		}
+	}
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || !isLowerHex(traceID) || !isLowerHex(spanID) ||
+		isZeroHex(traceID) || isZeroHex(spanID) {
+		return traceParent{}, false
+	}
+	// The debug flag implies sampling. A missing decision is taken as sampled, deferring to the
+	// upstream as B3 does.
+	return traceParent{traceID: traceID, parentID: spanID, sampled: sampled != "0"}, true
+}
+
+// updateTracestate puts the member of the key at the front of the tracestate, dropping the old
+// one and the members beyond the limit.
+func updateTracestate(tracestate, key, value string) string {
+	members := []string{key + "=" + value}
+	for _, m := range strings.Split(tracestate, ",") {
+		m = strings.TrimSpace(m)
+		k, _, ok := strings.Cut(m, "=")
+		if !ok || k == key || len(members) == traceContextMaxTracestateMembers {
+			continue
+		}
+		members = append(members, m)
+	}
+	return strings.Join(members, ",")
+}
+
+// validTracestateKey reports whether the key is a simple tracestate key: a lower case letter
+// followed by up to 255 lower case letters, digits, and "_-*/".
+func validTracestateKey(key string) bool {
+	if len(key) > 256 || key[0] < 'a' || key[0] > 'z' {
+		return false
+	}
+	for i := 1; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && !strings.ContainsRune("_-*/", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9') && !(s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZeroHex(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+)
+
+const (
+	xfccHeader              = "x-forwarded-client-cert"
+	xfccDefaultHeaderPrefix = "x-client-cert-"
+)
+
+type (
+	// xfccFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	xfccFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// xfccFilterConfig is the JSON configuration of the XFCC filter.
+	xfccFilterConfig struct {
+		xfccRouteConfig
+		// Source is where the client certificate comes from: "xfcc" for the
+		// x-forwarded-client-cert header set by a trusted proxy in front, or "tls" for the peer
+		// certificate of the downstream connection. Defaults to "xfcc".
+		//
+		// With "xfcc", the HTTP connection manager must forward the header, for example, with
+		// forward_client_cert_details: ALWAYS_FORWARD_ONLY, and the proxy in front must be the only
+		// way in. With "tls", an x-forwarded-client-cert header from the client is a spoof.
+		Source string `json:"source"`
+		// RequireIdentity rejects the requests without a client certificate even if AllowedSANs is
+		// empty.
+		RequireIdentity bool `json:"require_identity"`
+		// HeaderPrefix is the prefix of the identity headers set to the request: "subject",
+		// "uri-san", "dns-san", and "hash". Defaults to "x-client-cert-".
+		HeaderPrefix string `json:"header_prefix"`
+	}
+	// xfccRouteConfig is the part of the configuration that can be overridden per route.
+	xfccRouteConfig struct {
+		// AllowedSANs are the patterns of the URI and DNS SANs allowed in. A "*" matches any
+		// sequence of characters except "/", so "spiffe://example.org/ns/*/sa/frontend" matches
+		// the service account in any namespace. Any client is allowed in if empty.
+		AllowedSANs []string `json:"allowed_sans"`
+	}
+	// xfccFilterFactory implements [shared.HttpFilterFactory].
+	xfccFilterFactory struct {
+		config    xfccFilterConfig
+		requests  shared.MetricID
+		hasMetric bool
+	}
+	// xfccFilter implements [shared.HttpFilter].
+	//
+	// This filter turns the client certificate into normalized identity headers so that the
+	// upstream doesn't need to parse XFCC or terminate TLS itself. The client can't set these
+	// headers: a request that arrives with any of them is rejected.
+	xfccFilter struct {
+		handle  shared.HttpFilterHandle
+		factory *xfccFilterFactory
+		shared.EmptyHttpFilter
+	}
+	// xfccElement is the client certificate of an x-forwarded-client-cert element.
+	xfccElement struct {
+		hash    string
+		subject string
+		uriSANs []string
+		dnsSANs []string
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *xfccFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config xfccFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse XFCC config: %w", err)
+		}
+	}
+	switch config.Source {
+	case "":
+		config.Source = "xfcc"
+	case "xfcc", "tls":
+	default:
+		return nil, fmt.Errorf("unknown source %q", config.Source)
+	}
+	if config.HeaderPrefix == "" {
+		config.HeaderPrefix = xfccDefaultHeaderPrefix
+	}
+	config.HeaderPrefix = strings.ToLower(config.HeaderPrefix)
+	if err := config.xfccRouteConfig.validate(); err != nil {
+		return nil, err
+	}
+	f := &xfccFilterFactory{config: config}
+	id, res := handle.DefineCounter("xfcc_requests_total", "result")
+	if res == shared.MetricsSuccess {
+		f.requests, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the XFCC counter: %v", res)
+	}
+	return f, nil
+}
+
+// CreatePerRoute implements [shared.HttpFilterConfigFactory].
+func (p *xfccFilterConfigFactory) CreatePerRoute(unparsedConfig []byte) (any, error) {
+	var config xfccRouteConfig
+	if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse XFCC per-route config: %w", err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *xfccRouteConfig) validate() error {
+	for _, pattern := range c.AllowedSANs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowed SAN pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// allows reports whether any of the SANs of the certificate matches the allowlist.
+func (c *xfccRouteConfig) allows(cert *xfccElement) bool {
+	if len(c.AllowedSANs) == 0 {
+		return true
+	}
+	for _, sans := range [][]string{cert.uriSANs, cert.dnsSANs} {
+		for _, san := range sans {
+			for _, pattern := range c.AllowedSANs {
+				if ok, _ := path.Match(pattern, san); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *xfccFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &xfccFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *xfccFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	config := &p.factory.config
+	for _, h := range headers.GetAll() {
+		if strings.HasPrefix(strings.ToLower(h[0]), config.HeaderPrefix) {
+			return p.reject("spoofed", "spoofed identity header")
+		}
+	}
+
+	var cert *xfccElement
+	switch config.Source {
+	case "xfcc":
+		if values := headers.Get(xfccHeader); len(values) > 0 {
+			// Each proxy appends its element, so the last one is from the proxy right in front.
+			elements, ok := parseXFCC(strings.Join(values, ","))
+			if !ok {
+				return p.reject("invalid", "invalid x-forwarded-client-cert")
+			}
+			cert = &elements[len(elements)-1]
+		}
+	case "tls":
+		if len(headers.Get(xfccHeader)) > 0 {
+			return p.reject("spoofed", "spoofed x-forwarded-client-cert")
+		}
+		cert = p.peerCertificate()
+	}
+
+	routeConfig := &config.xfccRouteConfig
+	if c, ok := p.handle.GetMostSpecificConfig().(*xfccRouteConfig); ok {
+		routeConfig = c
+	}
+	if cert == nil {
+		if config.RequireIdentity || len(routeConfig.AllowedSANs) > 0 {
+			return p.reject("missing", "client certificate required")
+		}
+		p.record("anonymous")
+		return shared.HeadersStatusContinue
+	}
+	if !routeConfig.allows(cert) {
+		return p.reject("denied", "client certificate not allowed")
+	}
+
+	identity := [][2]string{
+		{"hash", cert.hash},
+		{"subject", cert.subject},
+		{"uri-san", strings.Join(cert.uriSANs, ",")},
+		{"dns-san", strings.Join(cert.dnsSANs, ",")},
+	}
+	for _, h := range identity {
+		if h[1] != "" {
+			headers.Set(config.HeaderPrefix+h[0], h[1])
+		}
+	}
+	p.record("allowed")
+	return shared.HeadersStatusContinue
+}
+
+// peerCertificate returns the peer certificate of the downstream connection, or nil if the
+// connection isn't mTLS. Only the first SANs of each type are exposed as the attributes.
+func (p *xfccFilter) peerCertificate() *xfccElement {
+	subject, _ := p.handle.GetAttributeString(shared.AttributeIDConnectionSubjectPeerCertificate)
+	hash, _ := p.handle.GetAttributeString(shared.AttributeIDConnectionSha256PeerCertificateDigest)
+	if subject == "" && hash == "" {
+		return nil
+	}
+	cert := &xfccElement{hash: strings.Clone(hash), subject: strings.Clone(subject)}
+	if uri, _ := p.handle.GetAttributeString(shared.AttributeIDConnectionUriSanPeerCertificate); uri != "" {
+		cert.uriSANs = []string{strings.Clone(uri)}
+	}
+	if dns, _ := p.handle.GetAttributeString(shared.AttributeIDConnectionDnsSanPeerCertificate); dns != "" {
+		cert.dnsSANs = []string{strings.Clone(dns)}
+	}
+	return cert
+}
+
+func (p *xfccFilter) reject(result, detail string) shared.HeadersStatus {
+	p.record(result)
+	p.handle.Log(shared.LogLevelDebug, "rejected the request: %s", detail)
+	p.handle.SendLocalResponse(http.StatusForbidden, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte("Forbidden\n"), "xfcc_"+result)
+	return shared.HeadersStatusStop
+}
+
+func (p *xfccFilter) record(result string) {
+	if p.factory.hasMetric {
+		p.handle.IncrementCounterValue(p.factory.requests, 1, result)
+	}
+}
+
+// parseXFCC parses the x-forwarded-client-cert header value into its elements. The elements are
+// separated by "," and their key=value pairs by ";", and the values may be quoted to contain them.
+//
+// The returned strings are copies since the header value is only valid during the callback.
+func parseXFCC(value string) ([]xfccElement, bool) {
+	var elements []xfccElement
+	for _, element := range splitXFCC(value, ',') {
+		var e xfccElement
+		for _, pair := range splitXFCC(element, ';') {
+			key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return nil, false
+			}
+			if strings.HasPrefix(v, `"`) {
+				if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+					return nil, false
+				}
+				v = strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`)
+			}
+			v = strings.Clone(v)
+			switch strings.ToLower(key) {
+			case "hash":
+				e.hash = v
+			case "subject":
+				e.subject = v
+			case "uri":
+				e.uriSANs = append(e.uriSANs, v)
+			case "dns":
+				e.dnsSANs = append(e.dnsSANs, v)
+			}
+		}
+		elements = append(elements, e)
+	}
+	return elements, len(elements) > 0
+}
+
+// splitXFCC splits s by sep outside of the quoted strings.
+func splitXFCC(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/envoy/source/extensions/dynamic_modules/sdk/go/shared"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/bodypool"
+)
+
+const (
+	xssModeBlock    = "block"
+	xssModeSanitize = "sanitize"
+
+	xssDefaultMaxBodyBytes = 64 * 1024
+	// xssMaxDecodeRounds bounds the decoding of the nested encodings such as %253Cscript%253E.
+	xssMaxDecodeRounds = 4
+)
+
+// xssPatterns are matched against the decoded, lower-cased values with the control characters
+// removed, so that e.g. "java&#x09;script:" and "%253Cscript" are caught too.
+var xssPatterns = []struct {
+	name string
+	re   *regexp.Regexp
+	// uri is set for the patterns matching the URIs, which HTML escaping doesn't neutralize, so
+	// the sanitize mode removes the whole value.
+	uri bool
+}{
+	{"script_tag", regexp.MustCompile(`<\s*/?\s*script\b`), false},
+	{"event_handler", regexp.MustCompile(`<[a-z!/][^>]*[\s/"']on[a-z]+\s*=`), false},
+	{"javascript_uri", regexp.MustCompile(`(?:java|vb|live)script:`), true},
+	{"data_uri", regexp.MustCompile(`data:\s*(?:text/html|image/svg\+xml|application/(?:x-)?javascript)`), true},
+}
+
+type (
+	// xssFilterConfigFactory implements [shared.HttpFilterConfigFactory].
+	xssFilterConfigFactory struct {
+		shared.EmptyHttpFilterConfigFactory
+	}
+	// xssFilterConfig is the JSON configuration of the XSS filter.
+	xssFilterConfig struct {
+		// Mode is either "block" to reply with 403, or "sanitize" to HTML escape the offending
+		// query parameters and body fields, or empty them for the URI payloads, and let the
+		// request through. Defaults to "block".
+		Mode string `json:"mode"`
+		// MaxBodyBytes is the maximum size of the form and JSON bodies inspected. Larger bodies are
+		// rejected with 413 in the block mode, as a payload could hide behind the padding, and
+		// passed through uninspected in the sanitize mode. Defaults to 64 KiB.
+		MaxBodyBytes int `json:"max_body_bytes"`
+	}
+	// xssFilterFactory implements [shared.HttpFilterFactory].
+	xssFilterFactory struct {
+		config     xssFilterConfig
+		detections shared.MetricID
+		hasMetric  bool
+	}
+	// xssFilter implements [shared.HttpFilter].
+	//
+	// In the sanitize mode, this filter demonstrates how to rewrite the whole request body once it
+	// has been buffered: both the buffered and the last received chunks are replaced.
+	xssFilter struct {
+		handle    shared.HttpFilterHandle
+		factory   *xssFilterFactory
+		headers   shared.HeaderMap
+		mediaType string
+		body      []byte
+		// inspecting is set while the body is being buffered for the inspection.
+		inspecting bool
+		matched    []string
+		shared.EmptyHttpFilter
+	}
+)
+
+// Create implements [shared.HttpFilterConfigFactory].
+func (p *xssFilterConfigFactory) Create(handle shared.HttpFilterConfigHandle, unparsedConfig []byte) (shared.HttpFilterFactory, error) {
+	var config xssFilterConfig
+	if len(unparsedConfig) > 0 {
+		if err := json.Unmarshal(unparsedConfig, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse xss config: %w", err)
+		}
+	}
+	switch config.Mode {
+	case "":
+		config.Mode = xssModeBlock
+	case xssModeBlock, xssModeSanitize:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", config.Mode)
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = xssDefaultMaxBodyBytes
+	}
+	f := &xssFilterFactory{config: config}
+	id, res := handle.DefineCounter("xss_detections_total", "pattern", "location")
+	if res == shared.MetricsSuccess {
+		f.detections, f.hasMetric = id, true
+	} else {
+		handle.Log(shared.LogLevelWarn, "failed to define the xss counter: %v", res)
+	}
+	return f, nil
+}
+
+// Create implements [shared.HttpFilterFactory].
+func (p *xssFilterFactory) Create(handle shared.HttpFilterHandle) shared.HttpFilter {
+	return &xssFilter{handle: handle, factory: p}
+}
+
+// OnRequestHeaders implements [shared.HttpFilter].
+func (p *xssFilter) OnRequestHeaders(headers shared.HeaderMap, endOfStream bool) shared.HeadersStatus {
+	path, rawQuery, hasQuery := strings.Cut(headers.GetOne(":path"), "?")
+	if hasQuery {
+		if sanitized, changed := p.inspectForm("query", rawQuery); changed {
+			headers.Set(":path", path+"?"+sanitized)
+		}
+	}
+	if p.blocked() {
+		return shared.HeadersStatusStop
+	}
+	if !endOfStream {
+		mediaType, _, _ := mime.ParseMediaType(headers.GetOne("content-type"))
+		switch mediaType {
+		case "application/x-www-form-urlencoded", "application/json":
+			p.mediaType = mediaType
+			p.headers = headers
+			p.inspecting = true
+			return shared.HeadersStatusStop
+		}
+	}
+	return shared.HeadersStatusContinue
+}
+
+// OnRequestBody implements [shared.HttpFilter].
+func (p *xssFilter) OnRequestBody(body shared.BodyBuffer, endOfStream bool) shared.BodyStatus {
+	if !p.inspecting {
+		return shared.BodyStatusContinue
+	}
+	p.body = bodypool.Append(p.body, body)
+	if len(p.body) > p.factory.config.MaxBodyBytes {
+		bodypool.Put(p.body)
+		p.inspecting, p.headers, p.body = false, nil, nil
+		if p.factory.config.Mode == xssModeBlock {
+			p.handle.SendLocalResponse(http.StatusRequestEntityTooLarge, [][2]string{{"Content-Type", "text/plain"}},
+				[]byte("Payload Too Large\n"), "xss_body_too_large")
+			return shared.BodyStatusStopNoBuffer
+		}
+		return shared.BodyStatusContinue
+	}
+	if !endOfStream {
+		return shared.BodyStatusStopAndBuffer
+	}
+	if sanitized, changed := p.inspectBody(); changed {
+		buffered := p.handle.BufferedRequestBody()
+		buffered.Drain(buffered.GetSize())
+		body.Drain(body.GetSize())
+		body.Append(sanitized)
+		p.headers.Set("content-length", strconv.Itoa(len(sanitized)))
+	}
+	bodypool.Put(p.body)
+	p.inspecting, p.headers, p.body = false, nil, nil
+	if p.blocked() {
+		return shared.BodyStatusStopNoBuffer
+	}
+	return shared.BodyStatusContinue
+}
+
+// OnRequestTrailers implements [shared.HttpFilter].
+func (p *xssFilter) OnRequestTrailers(trailers shared.HeaderMap) shared.TrailersStatus {
+	if !p.inspecting {
+		return shared.TrailersStatusContinue
+	}
+	if sanitized, changed := p.inspectBody(); changed {
+		buffered := p.handle.BufferedRequestBody()
+		buffered.Drain(buffered.GetSize())
+		buffered.Append(sanitized)
+		p.headers.Set("content-length", strconv.Itoa(len(sanitized)))
+	}
+	bodypool.Put(p.body)
+	p.inspecting, p.headers, p.body = false, nil, nil
+	if p.blocked() {
+		return shared.TrailersStatusStop
+	}
+	return shared.TrailersStatusContinue
+}
+
+// inspectBody inspects the buffered body, and returns the sanitized body if any field has changed.
+func (p *xssFilter) inspectBody() ([]byte, bool) {
+	switch p.mediaType {
+	case "application/x-www-form-urlencoded":
+		sanitized, changed := p.inspectForm("body", string(p.body))
+		return []byte(sanitized), changed
+	case "application/json":
+		var v any
+		if err := json.Unmarshal(p.body, &v); err != nil {
+			return nil, false
+		}
+		v, changed := p.inspectJSON(v)
+		if !changed {
+			return nil, false
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		// Keep the escaped entities readable.
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return nil, false
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true
+	}
+	return nil, false
+}
+
+// inspectForm inspects the values of the URL encoded form or query, and returns it with the
+// offending values sanitized. The order and the encoding of the other pairs are preserved.
+func (p *xssFilter) inspectForm(location, form string) (string, bool) {
+	pairs := strings.Split(form, "&")
+	changed := false
+	for i, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		// In the forms, '+' is the only encoding that doesn't apply to the other contexts.
+		if sanitized, ok := p.inspect(location, strings.ReplaceAll(value, "+", " ")); ok {
+			pairs[i] = key + "=" + url.QueryEscape(sanitized)
+			changed = true
+		}
+	}
+	return strings.Join(pairs, "&"), changed
+}
+
+// inspectJSON inspects the string values in the JSON document, and returns it with the offending
+// values sanitized.
+func (p *xssFilter) inspectJSON(v any) (any, bool) {
+	changed := false
+	switch v := v.(type) {
+	case string:
+		if sanitized, ok := p.inspect("body", v); ok {
+			return sanitized, true
+		}
+	case []any:
+		for i, e := range v {
+			var c bool
+			v[i], c = p.inspectJSON(e)
+			changed = changed || c
+		}
+	case map[string]any:
+		for k, e := range v {
+			var c bool
+			v[k], c = p.inspectJSON(e)
+			changed = changed || c
+		}
+	}
+	return v, changed
+}
+
+// inspect records the patterns matched by the value. In the sanitize mode, it returns the decoded
+// value HTML escaped, or empty for the URI payloads, if any pattern matched.
+func (p *xssFilter) inspect(location, value string) (string, bool) {
+	decoded := decodeXSS(value)
+	normalized := normalizeXSS(decoded)
+	found, uri := false, false
+	for _, pattern := range xssPatterns {
+		if !pattern.re.MatchString(normalized) {
+			continue
+		}
+		found, uri = true, uri || pattern.uri
+		if p.factory.hasMetric {
+			p.handle.IncrementCounterValue(p.factory.detections, 1, pattern.name, location)
+		}
+		if !slices.Contains(p.matched, pattern.name) {
+			p.matched = append(p.matched, pattern.name)
+		}
+	}
+	if !found || p.factory.config.Mode != xssModeSanitize {
+		return "", false
+	}
+	if uri {
+		return "", true
+	}
+	return html.EscapeString(decoded), true
+}
+
+// blocked reports the matched patterns in the dynamic metadata, and sends the 403 response if the
+// request is blocked, in which case it returns true.
+func (p *xssFilter) blocked() bool {
+	if len(p.matched) == 0 {
+		return false
+	}
+	p.handle.SetMetadata("xss", "patterns", strings.Join(p.matched, ","))
+	if p.factory.config.Mode != xssModeBlock {
+		return false
+	}
+	p.handle.SendLocalResponse(http.StatusForbidden, [][2]string{{"Content-Type", "text/plain"}},
+		[]byte("Forbidden\n"), "xss_blocked")
+	return true
+}
+
+// decodeXSS repeatedly URL and HTML entity decodes the value until it no longer changes, so that
+// the double encoded payloads are decoded as the application would eventually see them.
+func decodeXSS(s string) string {
+	for range xssMaxDecodeRounds {
+		decoded := html.UnescapeString(percentDecode(s))
+		if decoded == s {
+			break
+		}
+		s = decoded
+	}
+	return s
+}
+
+// percentDecode decodes the percent encoded bytes. Unlike url.PathUnescape, the malformed escapes
+// are kept as is rather than failing the whole value.
+func percentDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%' && i+2 < len(s) && isHexDigit(s[i+1]) && isHexDigit(s[i+2]):
+			v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'f')
+}
+
+// normalizeXSS lower-cases the value and removes the control characters, which the browsers
+// ignore inside the URI schemes, e.g. "java\tscript:".
+func normalizeXSS(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.ToLower(s))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest"
+	"github.com/envoyproxy/dynamic-modules-examples/go/filtertest/chain"
+)
+
+func TestXSSPaddedBody(t *testing.T) {
+	factory, err := (&xssFilterConfigFactory{}).Create(filtertest.NewConfigHandle(), []byte(`{"max_body_bytes": 1024}`))
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	response := chain.Message{Headers: [][2]string{{":status", "200"}}}
+	request := func(body ...string) chain.Message {
+		m := chain.Message{Headers: [][2]string{{":method", "POST"}, {":path", "/"}, {"content-type", "application/json"}}}
+		for _, chunk := range body {
+			m.Body = append(m.Body, []byte(chunk))
+		}
+		return m
+	}
+	payload := `{"name": "<script>alert(1)</script>", "padding": "`
+
+	t.Run("payload", func(t *testing.T) {
+		c := chain.New(t, factory)
+		if result := c.Run(request(payload+`"}`), response); result.Request != nil {
+			t.Fatal("the request reached the upstream")
+		}
+		c.Handles[0].RequireLocalReply(t, http.StatusForbidden)
+	})
+
+	t.Run("padded payload", func(t *testing.T) {
+		c := chain.New(t, factory)
+		padding := strings.Repeat("a", 512)
+		if result := c.Run(request(payload, padding, padding, `"}`), response); result.Request != nil {
+			t.Fatal("the request reached the upstream")
+		}
+		c.Handles[0].RequireLocalReply(t, http.StatusRequestEntityTooLarge)
+	})
+}
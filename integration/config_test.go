@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// TestEnvoyConfigs checks that the hand-written configs of the tests, such as envoy.yaml, agree
+// with envoy.generated.yaml, which "make check" keeps in sync with the filters of the Go module:
+// every registered filter is run by a test, every Go filter of the hand-written configs is
+// registered and loaded as the generated config does, and its config only sets the fields of its
+// config type. It runs without Envoy.
+func TestEnvoyConfigs(t *testing.T) {
+	generated, err := os.ReadFile("envoy.generated.yaml")
+	require.NoError(t, err)
+	paths, err := filepath.Glob("*.yaml")
+	require.NoError(t, err)
+
+	// The generated config lists the fields of each config type above the listener of the filter,
+	// as "#   name type: doc", with the nested fields as "a.b" and "a[].b".
+	schemas := map[string]map[string]bool{}
+	for _, block := range regexp.MustCompile(`(?m)^    # The config of (\w+):\n    #\n((?:    #   .*\n)+)`).FindAllStringSubmatch(string(generated), -1) {
+		fields := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSuffix(block[2], "\n"), "\n") {
+			name, _, _ := strings.Cut(strings.TrimPrefix(line, "    #   "), " ")
+			name, _, _ = strings.Cut(name, ".")
+			fields[strings.TrimSuffix(name, "[]")] = true
+		}
+		schemas[block[1]] = fields
+	}
+
+	generatedFilters := map[string]goModuleFilter{}
+	for _, f := range goModuleFilters(t, generated) {
+		generatedFilters[f.name] = f
+	}
+	require.NotEmpty(t, generatedFilters)
+	tested := map[string]bool{}
+	for _, path := range paths {
+		if path == "envoy.generated.yaml" {
+			continue
+		}
+		handWritten, err := os.ReadFile(path)
+		require.NoError(t, err)
+		for _, f := range goModuleFilters(t, handWritten) {
+			tested[f.name] = true
+			want, ok := generatedFilters[f.name]
+			if !ok {
+				t.Errorf("%s: %s is not a filter of the Go module", path, f.name)
+				continue
+			}
+			require.Equal(t, want.module, f.module, "%s: the dynamic_module_config of %s", path, f.name)
+			// The configs that aren't JSON objects, such as the plain script of javascript, are
+			// the filters' own formats.
+			var config map[string]json.RawMessage
+			if schema := schemas[f.name]; schema != nil && json.Unmarshal([]byte(f.config), &config) == nil {
+				for field := range config {
+					if !schema[field] {
+						t.Errorf("%s: %s has no config field %q", path, f.name, field)
+					}
+				}
+			}
+		}
+	}
+	for name := range generatedFilters {
+		if !tested[name] {
+			t.Errorf("%s is not run by any test config", name)
+		}
+	}
+}
+
+// goModuleFilter is a filter of the Go module in an Envoy config.
+type goModuleFilter struct {
+	name   string
+	module map[string]any
+	config string
+}
+
+// goModuleFilters returns the HTTP filters of the Go module in the Envoy config.
+func goModuleFilters(t *testing.T, config []byte) []goModuleFilter {
+	var root any
+	require.NoError(t, yaml.Unmarshal(config, &root))
+	var filters []goModuleFilter
+	var walk func(node any)
+	walk = func(node any) {
+		switch node := node.(type) {
+		case map[string]any:
+			module, _ := node["dynamic_module_config"].(map[string]any)
+			name, _ := node["filter_name"].(string)
+			if module != nil && module["name"] == "go_module" && name != "" {
+				f := goModuleFilter{name: name, module: module}
+				if filterConfig, ok := node["filter_config"].(map[string]any); ok {
+					f.config, _ = filterConfig["value"].(string)
+				}
+				filters = append(filters, f)
+			}
+			for _, v := range node {
+				walk(v)
+			}
+		case []any:
+			for _, v := range node {
+				walk(v)
+			}
+		}
+	}
+	walk(root)
+	return filters
+}
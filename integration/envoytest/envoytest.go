@@ -0,0 +1,424 @@
+// Package envoytest runs Envoy loading the dynamic modules for the end-to-end tests, as the
+// integration tests of this repository do:
+//
+//	envoytest.StartHTTPBin(t, ":1234")
+//	envoy := envoytest.StartEnvoy(t, envoytest.Config{ConfigPath: "envoy.yaml"})
+//	envoy.WaitReady()
+//	resp, err := http.Get("http://localhost:1062/uuid")
+//	...
+//	stats := envoy.Stats()
+//
+// The modules are searched in the working directory of Envoy, so copy the built modules there
+// first. Envoy is run in a container with testcontainers if [Config.Image] is set, and with func-e
+// otherwise, which must then be a tool of the module running the tests:
+//
+//	go get -tool github.com/tetratelabs/func-e/cmd/func-e
+//
+// A container runs on the host network unless [Config.Ports] are set, in which case the ports are
+// mapped to random ones on the host, so that the subtests can run their own Envoy in parallel:
+//
+//	envoy := envoytest.StartEnvoy(t, envoytest.Config{ConfigPath: "envoy.yaml", Image: image,
+//		Ports: []int{1062}, HostPorts: []int{1234}})
+//	resp, err := http.Get("http://" + envoy.Address(1062) + "/uuid")
+//
+// The upstreams on the host are then reached from the container at
+// host.testcontainers.internal rather than 127.0.0.1.
+package envoytest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mccutchen/go-httpbin/v2/httpbin"
+	"github.com/moby/moby/api/types/container"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	defaultAdminAddress = "localhost:9901"
+	defaultReadyTimeout = 120 * time.Second
+	// coverageFlushWait is how long to wait before stopping Envoy with [Config.CoverageDir], for
+	// the module to write the counters of the last requests, which it does every second.
+	coverageFlushWait = 2 * time.Second
+	// containerDir is where the working directory is mounted in the Envoy container.
+	containerDir = "/integration"
+)
+
+type (
+	// Config is the configuration of the Envoy process started by [StartEnvoy].
+	Config struct {
+		// ConfigPath is the path of the Envoy config, relative to Dir.
+		ConfigPath string
+		// Dir is the working directory of Envoy, where the modules are searched and the relative
+		// paths of the config are resolved. Defaults to the current directory.
+		Dir string
+		// Image is the Envoy image to run in a container. If empty, Envoy is run with
+		// `go tool func-e`.
+		Image string
+		// Ports are the ports of the listeners in the config that are mapped to random ports on
+		// the host, read with [Envoy.Address]. The admin port is mapped too. If empty, the
+		// container runs on the host network. Ignored without Image.
+		Ports []int
+		// HostPorts are the ports on the host that the container with Ports reaches at
+		// host.testcontainers.internal, such as the ones of the upstream servers of the test.
+		HostPorts []int
+		// Concurrency is the number of the worker threads. Defaults to 1.
+		Concurrency int
+		// AdminAddress is the address of the admin interface in the config. Defaults to
+		// "localhost:9901".
+		AdminAddress string
+		// AccessLogsDir is a directory, relative to Dir, that is emptied and made writable by
+		// Envoy before it starts, for the access loggers of the config to write to.
+		AccessLogsDir string
+		// CoverageDir is a directory, relative to Dir, where the Go module built with -cover
+		// writes its coverage counters, passed to Envoy as GOCOVERDIR. It is made writable by
+		// Envoy but not emptied, so that the Envoys of a test add to the same directory.
+		CoverageDir string
+		// Env are the additional environment variables of Envoy, such as "GODEBUG=cgocheck=0".
+		Env []string
+		// Args are the additional arguments of Envoy, such as "--component-log-level".
+		Args []string
+	}
+	// Envoy is a running Envoy process. It is stopped when the test finishes.
+	Envoy struct {
+		t      testing.TB
+		config Config
+		// container is the container of Envoy, if run with an image.
+		container testcontainers.Container
+		// adminAddress is the address of the admin interface on the host.
+		adminAddress string
+		// baseID is the --base-id of Envoy, which finds its process for [Envoy.CPUTime].
+		baseID string
+		// pid is the process of Envoy found by [Envoy.CPUTime].
+		pid string
+	}
+	// testLogConsumer writes the logs of the container to the test log.
+	testLogConsumer struct {
+		t testing.TB
+	}
+)
+
+// StartEnvoy starts Envoy with the config and registers its shutdown in the test cleanup. Call
+// [Envoy.WaitReady] before sending the requests.
+func StartEnvoy(t testing.TB, config Config) *Envoy {
+	t.Helper()
+	if config.Dir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			t.Fatalf("failed to get the working directory: %v", err)
+		}
+		config.Dir = dir
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.AdminAddress == "" {
+		config.AdminAddress = defaultAdminAddress
+	}
+	if config.AccessLogsDir != "" {
+		dir := filepath.Join(config.Dir, config.AccessLogsDir)
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("failed to remove the access logs directory: %v", err)
+		}
+		// Envoy may run as another user in the container.
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatalf("failed to create the access logs directory: %v", err)
+		}
+		if err := os.Chmod(dir, 0o777); err != nil {
+			t.Fatalf("failed to make the access logs directory writable: %v", err)
+		}
+	}
+	if config.CoverageDir != "" {
+		dir := filepath.Join(config.Dir, config.CoverageDir)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatalf("failed to create the coverage directory: %v", err)
+		}
+		if err := os.Chmod(dir, 0o777); err != nil {
+			t.Fatalf("failed to make the coverage directory writable: %v", err)
+		}
+		config.Env = append(slices.Clone(config.Env), "GOCOVERDIR="+config.CoverageDir)
+	}
+
+	baseID := strconv.Itoa(time.Now().Nanosecond())
+	args := append([]string{
+		"--concurrency", strconv.Itoa(config.Concurrency),
+		"--base-id", baseID,
+	}, config.Args...)
+	e := &Envoy{t: t, config: config, adminAddress: config.AdminAddress, baseID: baseID}
+	if config.Image != "" {
+		e.startContainer(args)
+		e.waitCoverageFlush()
+		return e
+	}
+	cmd := exec.Command("go", append([]string{"tool", "func-e", "run", "-c", config.ConfigPath}, args...)...) // nolint: gosec
+	cmd.Dir = config.Dir
+	cmd.Env = append(os.Environ(), "ENVOY_DYNAMIC_MODULES_SEARCH_PATH="+config.Dir)
+	cmd.Env = append(cmd.Env, config.Env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start Envoy: %v", err)
+	}
+	t.Cleanup(func() {
+		// Interrupt for a graceful shutdown, and kill if Envoy is still running after a while.
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			t.Logf("failed to interrupt Envoy: %v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			_ = cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			_ = cmd.Process.Kill()
+			<-done
+		}
+	})
+	e.waitCoverageFlush()
+	return e
+}
+
+// waitCoverageFlush waits for the module to write its coverage counters before Envoy is stopped,
+// if [Config.CoverageDir] is set. The cleanup runs before the one stopping Envoy, which was
+// registered earlier.
+func (e *Envoy) waitCoverageFlush() {
+	if e.config.CoverageDir != "" {
+		e.t.Cleanup(func() { time.Sleep(coverageFlushWait) })
+	}
+}
+
+// startContainer starts the Envoy container, and waits for it to be ready if its ports are
+// mapped, as the wait needs the mapped admin port.
+func (e *Envoy) startContainer(args []string) {
+	e.t.Helper()
+	_, adminPort, err := net.SplitHostPort(e.config.AdminAddress)
+	if err != nil {
+		e.t.Fatalf("invalid admin address %q: %v", e.config.AdminAddress, err)
+	}
+	env := make(map[string]string, len(e.config.Env))
+	for _, kv := range e.config.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	request := testcontainers.ContainerRequest{
+		Image: e.config.Image,
+		Cmd:   append([]string{"--config-path", containerDir + "/" + e.config.ConfigPath}, args...),
+		Env:   env,
+		ConfigModifier: func(c *container.Config) {
+			c.WorkingDir = containerDir
+		},
+		HostConfigModifier: func(hc *container.HostConfig) {
+			hc.Binds = append(hc.Binds, e.config.Dir+":"+containerDir)
+			if len(e.config.Ports) == 0 {
+				hc.NetworkMode = "host"
+			}
+		},
+		LogConsumerCfg: &testcontainers.LogConsumerConfig{Consumers: []testcontainers.LogConsumer{&testLogConsumer{t: e.t}}},
+	}
+	if len(e.config.Ports) > 0 {
+		for _, port := range e.config.Ports {
+			request.ExposedPorts = append(request.ExposedPorts, strconv.Itoa(port)+"/tcp")
+		}
+		request.ExposedPorts = append(request.ExposedPorts, adminPort+"/tcp")
+		request.HostAccessPorts = e.config.HostPorts
+		request.WaitingFor = wait.ForHTTP("/ready").WithPort(adminPort + "/tcp").WithStartupTimeout(defaultReadyTimeout)
+	}
+	ctr, err := testcontainers.GenericContainer(context.Background(), testcontainers.GenericContainerRequest{
+		ContainerRequest: request,
+		Started:          true,
+	})
+	testcontainers.CleanupContainer(e.t, ctr)
+	if err != nil {
+		e.t.Fatalf("failed to start the Envoy container: %v", err)
+	}
+	e.container = ctr
+	if len(e.config.Ports) > 0 {
+		port, _ := strconv.Atoi(adminPort)
+		e.adminAddress = e.Address(port)
+	}
+}
+
+// Address returns the address on the host of the port of a listener of Envoy, which is mapped to
+// a random port if [Config.Ports] are set.
+func (e *Envoy) Address(port int) string {
+	e.t.Helper()
+	if e.container == nil || len(e.config.Ports) == 0 {
+		return "localhost:" + strconv.Itoa(port)
+	}
+	ctx := context.Background()
+	host, err := e.container.Host(ctx)
+	if err != nil {
+		e.t.Fatalf("failed to get the host of the Envoy container: %v", err)
+	}
+	mapped, err := e.container.MappedPort(ctx, strconv.Itoa(port)+"/tcp")
+	if err != nil {
+		e.t.Fatalf("port %d of the Envoy container is not mapped: %v", port, err)
+	}
+	return net.JoinHostPort(host, mapped.Port())
+}
+
+// Accept implements [testcontainers.LogConsumer].
+func (c *testLogConsumer) Accept(log testcontainers.Log) {
+	c.t.Log(strings.TrimRight(string(log.Content), "\n"))
+}
+
+// WaitReady waits until the admin interface reports that Envoy is live, which is after the
+// listeners are initialized, and fails the test if it doesn't in two minutes.
+func (e *Envoy) WaitReady() {
+	e.t.Helper()
+	deadline := time.Now().Add(defaultReadyTimeout)
+	for {
+		resp, err := http.Get("http://" + e.adminAddress + "/ready")
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if time.Now().After(deadline) {
+			e.t.Fatalf("Envoy is not ready: %v", err)
+		}
+		e.t.Logf("Envoy not ready yet: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// CPUTime returns the user and system CPU time used by the Envoy process so far. It is read from
+// /proc, so it fails unless Envoy runs on the same Linux kernel as the test, which a container
+// does on a Linux host.
+func (e *Envoy) CPUTime() (time.Duration, error) {
+	if e.pid == "" {
+		pid, err := e.findProcess()
+		if err != nil {
+			return 0, err
+		}
+		e.pid = pid
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", e.pid, "stat"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the stat of Envoy: %w", err)
+	}
+	// The command in the second field may contain spaces, so the fields are counted after it.
+	_, rest, ok := strings.Cut(string(stat), ") ")
+	fields := strings.Fields(rest)
+	if !ok || len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected stat of Envoy: %q", stat)
+	}
+	var ticks int64
+	// utime and stime are the 14th and 15th fields, in the clock ticks of 1/100s of the proc ABI.
+	for _, field := range fields[11:13] {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected stat of Envoy: %q", stat)
+		}
+		ticks += n
+	}
+	return time.Duration(ticks) * 10 * time.Millisecond, nil
+}
+
+// findProcess returns the process ID of Envoy, whose command line has its base ID, as func-e and
+// the container runtime don't tell it.
+func (e *Envoy) findProcess() (string, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return "", fmt.Errorf("failed to list the processes: %w", err)
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(string(cmdline), "\x00")
+		if filepath.Base(args[0]) != "envoy" {
+			continue
+		}
+		for i := 1; i < len(args); i++ {
+			if args[i-1] == "--base-id" && args[i] == e.baseID {
+				return entry.Name(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no Envoy process with base ID %s", e.baseID)
+}
+
+// Stats returns the stats of the admin interface by the metric name, including the ones defined
+// by the modules.
+func (e *Envoy) Stats() map[string]*io_prometheus_client.MetricFamily {
+	e.t.Helper()
+	resp, err := http.Get("http://" + e.adminAddress + "/stats/prometheus")
+	if err != nil {
+		e.t.Fatalf("failed to get the stats: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	stats := map[string]*io_prometheus_client.MetricFamily{}
+	decoder := expfmt.NewDecoder(resp.Body, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for {
+		var metricFamily io_prometheus_client.MetricFamily
+		if err := decoder.Decode(&metricFamily); err == io.EOF {
+			return stats
+		} else if err != nil {
+			e.t.Fatalf("failed to decode the stats: %v", err)
+		}
+		stats[metricFamily.GetName()] = &metricFamily
+	}
+}
+
+// AccessLogs returns the lines written so far to the file in [Config.AccessLogsDir], or nil if
+// the file doesn't exist yet.
+func (e *Envoy) AccessLogs(name string) []string {
+	e.t.Helper()
+	file, err := os.Open(filepath.Join(e.config.Dir, e.config.AccessLogsDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		e.t.Fatalf("failed to open the access log: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		e.t.Fatalf("failed to read the access log: %v", err)
+	}
+	return lines
+}
+
+// StartHTTPBin starts the httpbin server on the address as the upstream of the tests, and
+// registers its shutdown in the test cleanup.
+func StartHTTPBin(t testing.TB, addr string) {
+	t.Helper()
+	server := &http.Server{Addr: addr, Handler: httpbin.New(),
+		ReadHeaderTimeout: 5 * time.Second, IdleTimeout: 5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	t.Cleanup(func() { _ = server.Close() })
+}
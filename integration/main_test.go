@@ -1,45 +1,316 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
 	"io"
+	"maps"
+	"math/rand/v2"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/textproto"
 	"os"
 	"os/exec"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/mccutchen/go-httpbin/v2/httpbin"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyproxy/dynamic-modules-examples/integration/envoytest"
 )
 
 func TestIntegration(t *testing.T) {
 	cwd, err := os.Getwd()
 	require.NoError(t, err)
 
+	// COVERAGE_DIR collects the coverage of the Go module built with "make build-go-cover" from
+	// all the Envoys of the test, and reports it once they are stopped, as with
+	// "make integration-coverage".
+	coverageDir := os.Getenv("COVERAGE_DIR")
+	if coverageDir != "" {
+		require.NoError(t, os.RemoveAll(coverageDir))
+		t.Cleanup(func() { reportCoverage(t, coverageDir) })
+	}
+
 	// Setup the httpbin upstream local server.
-	httpbinHandler := httpbin.New()
-	server := &http.Server{Addr: ":1234", Handler: httpbinHandler,
-		ReadHeaderTimeout: 5 * time.Second, IdleTimeout: 5 * time.Second,
-		WriteTimeout: 5 * time.Second,
+	envoytest.StartHTTPBin(t, ":1234")
+
+	// Setup the shadow upstream server for the shadow filter. It records the requests it receives.
+	shadowRequests := make(chan string, 100)
+	shadowServer := &http.Server{Addr: ":1235", ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			select {
+			case shadowRequests <- r.Method + " " + r.Host + r.URL.Path + " " + string(body):
+			default:
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := shadowServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("shadow server error: %v", err)
+		}
+	}()
+	defer func() { _ = shadowServer.Close() }()
+
+	// Setup the OTLP collector for the otlp_access_log filter. It records the export requests it
+	// receives.
+	otlpRequests := make(chan []byte, 100)
+	otlpServer := &http.Server{Addr: ":4318", ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/json" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			select {
+			case otlpRequests <- body:
+			default:
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := otlpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("OTLP server error: %v", err)
+		}
+	}()
+	defer func() { _ = otlpServer.Close() }()
+
+	// Setup the authorization service for the ext_authz filter. It allows "Bearer good" and counts
+	// the authorization requests it receives.
+	var extAuthzChecks atomic.Int32
+	extAuthzServer := &http.Server{Addr: ":1236", ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var check struct {
+				Method  string            `json:"method"`
+				Path    string            `json:"path"`
+				Headers map[string]string `json:"headers"`
+			}
+			if r.Method != http.MethodPost || r.URL.Path != "/check" || json.NewDecoder(r.Body).Decode(&check) != nil ||
+				check.Method == "" || check.Path == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			extAuthzChecks.Add(1)
+			if check.Headers["authorization"] != "Bearer good" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.Header().Set("X-Internal", "not for the client")
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte("denied"))
+				return
+			}
+			w.Header().Set("X-Auth-User", "alice")
+			w.Header().Set("X-Auth-Session", "s1")
+			w.Header().Set("X-Envoy-Auth-Headers-To-Remove", "authorization")
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := extAuthzServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("ext_authz server error: %v", err)
+		}
+	}()
+	defer func() { _ = extAuthzServer.Close() }()
+
+	// Setup the ICAP server for the icap filter. It flags the bodies with the EICAR test string like
+	// c-icap with ClamAV does.
+	icapListener, err := net.Listen("tcp", "127.0.0.1:1344")
+	require.NoError(t, err)
+	defer func() { _ = icapListener.Close() }()
+	go func() {
+		for {
+			conn, err := icapListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				tp := textproto.NewReader(r)
+				if line, err := tp.ReadLine(); err != nil || !strings.HasPrefix(line, "REQMOD icap://127.0.0.1:1344/avscan ") {
+					return
+				}
+				headers, err := tp.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				_, offset, _ := strings.Cut(headers.Get("Encapsulated"), "req-body=")
+				n, err := strconv.Atoi(offset)
+				if err != nil {
+					return
+				}
+				if _, err = io.ReadFull(r, make([]byte, n)); err != nil {
+					return
+				}
+				body, err := io.ReadAll(httputil.NewChunkedReader(r))
+				if err != nil {
+					return
+				}
+				if bytes.Contains(body, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+					const res = "HTTP/1.1 403 Forbidden\r\n\r\n"
+					_, _ = fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\n"+
+						"Encapsulated: res-hdr=0, null-body=%d\r\n\r\n%s", len(res), res)
+					return
+				}
+				_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n"))
+			}()
+		}
+	}()
+
+	// Setup the slow upstream for the coalescing filter. It counts the requests it receives.
+	var coalescingHits atomic.Int32
+	coalescingServer := &http.Server{Addr: ":1238", ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hit := coalescingHits.Add(1)
+			time.Sleep(time.Second)
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = fmt.Fprintf(w, "%s %d", r.URL.Path, hit)
+		}),
+	}
+	go func() {
+		if err := coalescingServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("coalescing server error: %v", err)
+		}
+	}()
+	defer func() { _ = coalescingServer.Close() }()
+
+	// Setup the tokenization service for the tokenization filter. It counts the calls it receives.
+	var tokenizationCalls atomic.Int32
+	var tokenizationMux sync.Mutex
+	tokenizationVault := make(map[string]string)
+	tokenizationServer := &http.Server{Addr: ":1239", ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var request struct {
+				Values []string `json:"values"`
+				Tokens []string `json:"tokens"`
+			}
+			if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&request) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tokenizationCalls.Add(1)
+			tokenizationMux.Lock()
+			defer tokenizationMux.Unlock()
+			var response struct {
+				Values []string `json:"values,omitempty"`
+				Tokens []string `json:"tokens,omitempty"`
+			}
+			switch r.URL.Path {
+			case "/tokenize":
+				for _, v := range request.Values {
+					token := fmt.Sprintf("tok_%d", len(tokenizationVault))
+					tokenizationVault[token] = v
+					response.Tokens = append(response.Tokens, token)
+				}
+			case "/detokenize":
+				for _, token := range request.Tokens {
+					response.Values = append(response.Values, tokenizationVault[token])
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(&response)
+		}),
+	}
+	go func() {
+		if err := tokenizationServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("tokenization server error: %v", err)
+		}
+	}()
+	defer func() { _ = tokenizationServer.Close() }()
+
+	// Setup the OFREP service for the feature_flags filter. The banner flag can be changed to test the polling.
+	var ofrepBanner atomic.Value
+	ofrepBanner.Store("spring")
+	ofrepServer := &http.Server{Addr: ":1240", ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/ofrep/v1/evaluate/flags" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"flags":[{"key":"banner","value":%q,"variant":"current"},{"key":"beta","value":true,"variant":"on"}]}`, ofrepBanner.Load())
+		}),
 	}
 	go func() {
-		if err = server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			t.Logf("HTTP server error: %v", err)
+		if err := ofrepServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("OFREP server error: %v", err)
 		}
 	}()
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		_ = server.Shutdown(ctx)
+	defer func() { _ = ofrepServer.Close() }()
+
+	// Setup the LLM API server for the llm_usage filter. /v1/chat/completions is OpenAI-like and
+	// reports the usage, and /v1/messages is Anthropic-like and streams. /v1/no-usage doesn't
+	// report the usage.
+	llmServer := &http.Server{Addr: ":1241", ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			switch r.URL.Path {
+			case "/v1/chat/completions":
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = io.WriteString(w, `{"model":"gpt-test","choices":[{"message":{"role":"assistant","content":"Hello!"}}],"usage":{"prompt_tokens":11,"completion_tokens":3,"total_tokens":14}}`)
+			case "/v1/messages":
+				w.Header().Set("Content-Type", "text/event-stream")
+				for _, event := range []string{
+					`{"type":"message_start","message":{"model":"claude-test","usage":{"input_tokens":20,"output_tokens":1}}}`,
+					`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+					`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`,
+				} {
+					_, _ = fmt.Fprintf(w, "data: %s\n\n", event)
+					w.(http.Flusher).Flush()
+				}
+			case "/v1/no-usage":
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = io.WriteString(w, `{"model":"local","choices":[{"message":{"content":"twelve chars"}}]}`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	}
+	go func() {
+		if err := llmServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			t.Logf("LLM server error: %v", err)
+		}
 	}()
+	defer func() { _ = llmServer.Close() }()
+
+	// Setup the Redis server for the redis_cache filter.
+	redisServer := miniredis.NewMiniRedis()
+	require.NoError(t, redisServer.StartAddr("127.0.0.1:16379"))
+	defer redisServer.Close()
+
+	// Setup the greeter gRPC server for the grpc_status filter.
+	startGreeter(t, "127.0.0.1:1242")
 
 	// Health check to ensure the server is up before starting tests.
 	require.Eventually(t, func() bool {
@@ -54,58 +325,30 @@ func TestIntegration(t *testing.T) {
 		return resp.StatusCode == 200
 	}, 10*time.Second, 500*time.Millisecond)
 
-	// Create a directory for the access logs to be written to.
+	// Generate the MaxMind DB for the geoip filter. It is rewritten by the geoip test to exercise the reload.
+	geoIPDatabase := cwd + "/testdata/geoip.mmdb"
+	writeGeoIPDatabase(t, geoIPDatabase, "US")
+	defer func() { _ = os.Remove(geoIPDatabase) }()
+
+	// The access logs are written to the access_logs directory.
 	accessLogsDir := cwd + "/access_logs"
-	require.NoError(t, os.RemoveAll(accessLogsDir))
-	require.NoError(t, os.Mkdir(accessLogsDir, 0o700))
-	require.NoError(t, os.Chmod(accessLogsDir, 0o777))
-
-	if envoyImage := cmp.Or(os.Getenv("ENVOY_IMAGE")); envoyImage != "" {
-		cmd := exec.Command(
-			"docker",
-			"run",
-			"--network", "host",
-			"-v", cwd+":/integration",
-			"-w", "/integration",
-			"-e", "GODEBUG=cgocheck=0",
-			"--rm",
-			envoyImage,
-			"--concurrency", "1",
-			"--config-path", "/integration/envoy.yaml",
-			"--component-log-level", "dynamic_modules:debug",
-			"--base-id", strconv.Itoa(time.Now().Nanosecond()),
-		)
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		require.NoError(t, cmd.Start())
-		t.Cleanup(func() { require.NoError(t, cmd.Process.Signal(os.Interrupt)) })
-	} else {
-		// Now run Envoy with the env variable set for dynamic modules.
-		cmd := exec.Command("go", // nolint: gosec
-			"tool", "func-e", "run",
-			"-c", "envoy.yaml",
-			"--log-level", "warn",
-			"--concurrency", "1",
-			"--component-log-level", "dynamic_modules:debug",
-			"--base-id", strconv.Itoa(time.Now().Nanosecond()),
-		)
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = append(os.Environ(),
-			"ENVOY_DYNAMIC_MODULES_SEARCH_PATH="+cwd,
-			"GODEBUG=cgocheck=0",
-		)
-		require.NoError(t, cmd.Start())
-		defer func() {
-			// Send SIGTERM for graceful shutdown
-			if err := cmd.Process.Signal(os.Interrupt); err != nil {
-				t.Logf("failed to interrupt envoy: %v", err)
-			}
-			time.Sleep(3 * time.Second)
-			require.NoError(t, cmd.Process.Kill())
-		}()
+	// ENVOY_CONCURRENCY raises the number of the workers for the stress tests. The other tests
+	// expect a single worker.
+	concurrency, _ := strconv.Atoi(os.Getenv("ENVOY_CONCURRENCY"))
+	envoyEnv := []string{"GODEBUG=cgocheck=0", "GO_MODULE_HOOK_TIMING=true", "GO_MODULE_LIVE_FILTERS=true"}
+	if gorace := os.Getenv("GORACE"); gorace != "" {
+		envoyEnv = append(envoyEnv, "GORACE="+gorace)
 	}
+	envoy := envoytest.StartEnvoy(t, envoytest.Config{
+		ConfigPath:    "envoy.yaml",
+		Concurrency:   concurrency,
+		Image:         os.Getenv("ENVOY_IMAGE"),
+		AccessLogsDir: "access_logs",
+		CoverageDir:   coverageDir,
+		Env:           envoyEnv,
+		Args:          []string{"--log-level", "warn", "--component-log-level", "dynamic_modules:debug"},
+	})
+	envoy.WaitReady()
 
 	t.Run("http_access_logger", func(t *testing.T) {
 		t.Run("health checking", func(t *testing.T) {
@@ -418,16 +661,19 @@ func TestIntegration(t *testing.T) {
 			// We also need to check that the response headers were mutated.
 			require.Equal(t, "cat", resp.Header.Get("x-dog"))
 			require.Equal(t, "200", resp.Header.Get("x-status"))
+			// The dynamic metadata set at the request phase is readable at the response phase.
+			require.Equal(t, "bar", resp.Header.Get("x-metadata-foo"))
 			return true
 		}, 30*time.Second, 200*time.Millisecond)
 	})
 
-	t.Run("http_metrics", func(t *testing.T) {
-		// Send test request
+	t.Run("javascript_schedule", func(t *testing.T) {
 		require.Eventually(t, func() bool {
-			req, err := http.NewRequest("GET", "http://localhost:1062/uuid", nil)
+			req, err := http.NewRequest("GET", "http://localhost:1062/headers", nil)
 			require.NoError(t, err)
+			req.Header.Set("js-delay", "true")
 
+			start := time.Now()
 			resp, err := http.DefaultClient.Do(req)
 			if err != nil {
 				t.Logf("Envoy not ready yet: %v", err)
@@ -442,56 +688,3553 @@ func TestIntegration(t *testing.T) {
 				return false
 			}
 			t.Logf("response: status=%d body=%s", resp.StatusCode, string(body))
-			return resp.StatusCode == 200
+			require.Equal(t, 200, resp.StatusCode)
+			// The script stops the iteration and continues it 500ms later.
+			require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+			return true
 		}, 30*time.Second, 200*time.Millisecond)
+	})
 
-		// Check the metrics endpoint
-		lastStatsOutput := ""
-		t.Cleanup(func() {
-			t.Logf("last stats output:\n%s", lastStatsOutput)
-		})
+	t.Run("ratelimit", func(t *testing.T) {
 		require.Eventually(t, func() bool {
-			req, err := http.NewRequest("GET", "http://localhost:9901/stats/prometheus", nil)
-			require.NoError(t, err)
-
-			resp, err := http.DefaultClient.Do(req)
-			require.NoError(t, err)
-			defer func() {
+			// Use a fresh key on every attempt so that the retries start with a full bucket.
+			key := strconv.FormatInt(time.Now().UnixNano(), 10)
+			var statuses []int
+			var retryAfter string
+			for range 3 {
+				req, err := http.NewRequest("GET", "http://localhost:1065/uuid", nil)
+				require.NoError(t, err)
+				req.Header.Set("x-ratelimit-key", key)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Logf("Envoy not ready yet: %v", err)
+					return false
+				}
 				require.NoError(t, resp.Body.Close())
-			}()
+				statuses = append(statuses, resp.StatusCode)
+				retryAfter = resp.Header.Get("Retry-After")
+			}
+			t.Logf("statuses=%v retry-after=%s", statuses, retryAfter)
+			if !slices.Equal(statuses, []int{200, 200, 429}) {
+				return false
+			}
+			require.NotEmpty(t, retryAfter)
+			return true
+		}, 30*time.Second, 200*time.Millisecond)
+	})
 
-			// Check that the route_latency_ms metric is present
-			body, err := io.ReadAll(resp.Body)
-			require.NoError(t, err)
-			lastStatsOutput = string(body)
+	t.Run("basic_auth", func(t *testing.T) {
+		for _, tc := range []struct {
+			name       string
+			user       string
+			password   string
+			expStatus  int
+			expWWWAuth string
+		}{
+			{name: "no credentials", expStatus: http.StatusUnauthorized, expWWWAuth: `Basic realm="integration", charset="UTF-8"`},
+			{name: "wrong password", user: "alice", password: "wrong", expStatus: http.StatusUnauthorized},
+			{name: "bcrypt", user: "alice", password: "alice-password", expStatus: http.StatusOK},
+			{name: "apr1", user: "bob", password: "bob-password", expStatus: http.StatusOK},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("GET", "http://localhost:1066/uuid", nil)
+					require.NoError(t, err)
+					if tc.user != "" {
+						req.SetBasicAuth(tc.user, tc.password)
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					t.Logf("response: status=%d www-authenticate=%s", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+					if resp.StatusCode != tc.expStatus {
+						return false
+					}
+					if tc.expWWWAuth != "" {
+						require.Equal(t, tc.expWWWAuth, resp.Header.Get("WWW-Authenticate"))
+					}
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
 
-			decoder := expfmt.NewDecoder(bytes.NewReader(body), expfmt.NewFormat(expfmt.TypeTextPlain))
-			for {
-				var metricFamily io_prometheus_client.MetricFamily
-				err := decoder.Decode(&metricFamily)
-				if err == io.EOF {
-					break
+	t.Run("api_key", func(t *testing.T) {
+		for _, tc := range []struct {
+			name      string
+			path      string
+			header    string
+			expStatus int
+			expTenant string
+		}{
+			{name: "missing", path: "/headers", expStatus: http.StatusUnauthorized},
+			{name: "invalid", path: "/headers", header: "wrong", expStatus: http.StatusUnauthorized},
+			{name: "inline key", path: "/headers", header: "inline-key", expStatus: http.StatusOK, expTenant: "acme"},
+			{name: "file key in query", path: "/headers?api_key=file-key", expStatus: http.StatusOK, expTenant: "globex"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("GET", "http://localhost:1067"+tc.path, nil)
+					require.NoError(t, err)
+					if tc.header != "" {
+						req.Header.Set("x-api-key", tc.header)
+					}
+					// This must be overwritten by the filter.
+					req.Header.Set("x-api-key-tenant", "spoofed")
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					t.Logf("response: status=%d body=%s", resp.StatusCode, string(body))
+					if resp.StatusCode != tc.expStatus {
+						return false
+					}
+					if tc.expTenant != "" {
+						var headersBody struct {
+							Headers map[string][]string `json:"headers"`
+						}
+						require.NoError(t, json.Unmarshal(body, &headersBody))
+						require.Equal(t, []string{tc.expTenant}, headersBody.Headers["X-Api-Key-Tenant"])
+					}
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("compressor", func(t *testing.T) {
+		for _, tc := range []struct {
+			name           string
+			acceptEncoding string
+			expEncoding    string
+		}{
+			{name: "gzip", acceptEncoding: "br;q=0.5, gzip", expEncoding: "gzip"},
+			{name: "server preference", acceptEncoding: "gzip, br, zstd", expEncoding: "zstd"},
+			{name: "quality", acceptEncoding: "zstd;q=0.1, br;q=0.8, gzip;q=0.5", expEncoding: "br"},
+			{name: "not accepted", acceptEncoding: "identity", expEncoding: ""},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("GET", "http://localhost:1068/json", nil)
+					require.NoError(t, err)
+					// Setting the header explicitly disables the transparent decompression of the client.
+					req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					require.Equal(t, http.StatusOK, resp.StatusCode)
+					require.Equal(t, tc.expEncoding, resp.Header.Get("Content-Encoding"))
+					if tc.expEncoding == "zstd" || tc.expEncoding == "br" {
+						// Only the negotiation is checked for the codecs without a decoder in the standard library.
+						return true
+					}
+					var body io.Reader = resp.Body
+					if tc.expEncoding == "gzip" {
+						gz, err := gzip.NewReader(resp.Body)
+						require.NoError(t, err)
+						body = gz
+					}
+					decoded, err := io.ReadAll(body)
+					require.NoError(t, err)
+					require.True(t, json.Valid(decoded), string(decoded))
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			// HttpBin responds with "Cache-Control: public, max-age=60". The nonce makes every attempt start with a miss.
+			url := "http://localhost:1069/cache/60?nonce=" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			var bodies []string
+			var results []string
+			for range 2 {
+				req, err := http.NewRequest("GET", url, nil)
+				require.NoError(t, err)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Logf("Envoy not ready yet: %v", err)
+					return false
 				}
+				body, err := io.ReadAll(resp.Body)
 				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				bodies = append(bodies, string(body))
+				results = append(results, resp.Header.Get("x-cache"))
+			}
+			t.Logf("results=%v", results)
+			require.Equal(t, []string{"MISS", "HIT"}, results)
+			require.Equal(t, bodies[0], bodies[1])
+			return true
+		}, 30*time.Second, 200*time.Millisecond)
+	})
 
-				if metricFamily.GetName() != "route_latency_ms" {
-					continue
+	t.Run("redis_cache", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			// HttpBin responds with "Cache-Control: public, max-age=60". The nonce makes every attempt start with a miss.
+			url := "http://localhost:1070/cache/60?nonce=" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			var bodies []string
+			var results []string
+			for range 2 {
+				req, err := http.NewRequest("GET", url, nil)
+				require.NoError(t, err)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Logf("Envoy not ready yet: %v", err)
+					return false
 				}
-				for _, metric := range metricFamily.GetMetric() {
-					hist := metric.GetHistogram()
-					require.NotNil(t, hist)
-					labels := make(map[string]string)
-					for _, label := range metric.GetLabel() {
-						labels[label.GetName()] = label.GetValue()
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				bodies = append(bodies, string(body))
+				results = append(results, resp.Header.Get("x-cache"))
+			}
+			t.Logf("results=%v", results)
+			// The response is stored asynchronously, so the second request can still miss.
+			if results[1] != "HIT" {
+				return false
+			}
+			require.Equal(t, "MISS", results[0])
+			require.Equal(t, bodies[0], bodies[1])
+			return true
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("shadow", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("POST", "http://localhost:1071/anything/shadow", strings.NewReader("shadowed body"))
+			require.NoError(t, err)
+			req.Header.Set("x-shadow", "true")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			// The original request is served by httpbin regardless of the shadow.
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			select {
+			case got := <-shadowRequests:
+				t.Logf("shadow request: %s", got)
+				require.Equal(t, "POST localhost:1071-shadow/anything/shadow shadowed body", got)
+				return true
+			case <-time.After(time.Second):
+				return false
+			}
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("ab_test", func(t *testing.T) {
+		do := func(header, value string) (*http.Response, bool) {
+			req, err := http.NewRequest("GET", "http://localhost:1072/uuid", nil)
+			require.NoError(t, err)
+			req.Header.Set(header, value)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return nil, false
+			}
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			return resp, true
+		}
+		for _, variant := range []string{"control", "treatment"} {
+			t.Run("sticky "+variant, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					resp, ok := do("Cookie", "ab_checkout="+variant)
+					if !ok {
+						return false
 					}
-					require.Equal(t, map[string]string{"version": "v1.0.0", "route_name": "catch_all"}, labels)
-					if hist.GetSampleCount() > 0 {
-						return true
+					require.Equal(t, variant, resp.Header.Get("x-route"))
+					require.Empty(t, resp.Header.Get("Set-Cookie"))
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+		t.Run("deterministic", func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				var routes []string
+				for range 3 {
+					resp, ok := do("x-user-id", "user-1")
+					if !ok {
+						return false
 					}
+					route := resp.Header.Get("x-route")
+					require.Contains(t, resp.Header.Get("Set-Cookie"), "ab_checkout="+route)
+					routes = append(routes, route)
 				}
-			}
-			t.Logf("route_latency_ms metric not found or no samples yet")
-			return false
-		}, 5*time.Second, 200*time.Millisecond)
+				require.Equal(t, routes[0], routes[1])
+				require.Equal(t, routes[0], routes[2])
+				return true
+			}, 30*time.Second, 200*time.Millisecond)
+		})
 	})
+
+	t.Run("canary", func(t *testing.T) {
+		do := func(header, value string) (*http.Response, bool) {
+			req, err := http.NewRequest("GET", "http://localhost:1073/uuid", nil)
+			require.NoError(t, err)
+			req.Header.Set(header, value)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return nil, false
+			}
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			return resp, true
+		}
+		for _, tc := range []struct{ header, value, cluster string }{
+			{"Cookie", "canary=1", "httpbin_canary"},
+			{"Cookie", "canary=0", "httpbin"},
+			{"x-canary", "true", "httpbin_canary"},
+			{"x-canary", "false", "httpbin"},
+		} {
+			t.Run(tc.header+" "+tc.value, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					resp, ok := do(tc.header, tc.value)
+					if !ok {
+						return false
+					}
+					require.Equal(t, tc.cluster, resp.Header.Get("x-upstream-cluster"))
+					require.Empty(t, resp.Header.Get("Set-Cookie"))
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+		t.Run("assign", func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				resp, ok := do("x-user-id", "new-user")
+				if !ok {
+					return false
+				}
+				cookie := "canary=0"
+				if resp.Header.Get("x-upstream-cluster") == "httpbin_canary" {
+					cookie = "canary=1"
+				}
+				require.Contains(t, resp.Header.Get("Set-Cookie"), cookie)
+				return true
+			}, 30*time.Second, 200*time.Millisecond)
+		})
+	})
+
+	t.Run("ip_filter", func(t *testing.T) {
+		for _, tc := range []struct {
+			xff     string
+			expCode int
+		}{
+			{"", http.StatusOK},
+			{"198.51.100.7", http.StatusOK},
+			{"203.0.113.7", http.StatusForbidden},
+			{"192.0.2.1", http.StatusForbidden},
+			{"203.0.113.7, 198.51.100.7", http.StatusOK},
+		} {
+			t.Run(tc.xff, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("GET", "http://localhost:1074/uuid", nil)
+					require.NoError(t, err)
+					if tc.xff != "" {
+						req.Header.Set("x-forwarded-for", tc.xff)
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					require.NoError(t, resp.Body.Close())
+					return resp.StatusCode == tc.expCode
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("geoip", func(t *testing.T) {
+		do := func(xff string) (int, map[string][]string, bool) {
+			req, err := http.NewRequest("GET", "http://localhost:1075/headers", nil)
+			require.NoError(t, err)
+			req.Header.Set("x-forwarded-for", xff)
+			req.Header.Set("x-geo-country", "spoofed")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return 0, nil, false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			var body struct {
+				Headers map[string][]string `json:"headers"`
+			}
+			if resp.StatusCode == http.StatusOK {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			}
+			return resp.StatusCode, body.Headers, true
+		}
+		t.Run("enrich", func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				status, headers, ok := do("198.51.100.7")
+				if !ok {
+					return false
+				}
+				require.Equal(t, http.StatusOK, status)
+				require.Equal(t, []string{"US"}, headers["X-Geo-Country"])
+				require.Equal(t, []string{"64496"}, headers["X-Geo-Asn"])
+				return true
+			}, 30*time.Second, 200*time.Millisecond)
+		})
+		t.Run("not found", func(t *testing.T) {
+			status, headers, ok := do("192.0.2.200")
+			require.True(t, ok)
+			require.Equal(t, http.StatusOK, status)
+			require.NotContains(t, headers, "X-Geo-Country")
+		})
+		t.Run("blocked country", func(t *testing.T) {
+			status, _, ok := do("203.0.113.7")
+			require.True(t, ok)
+			require.Equal(t, http.StatusForbidden, status)
+		})
+		t.Run("blocked asn", func(t *testing.T) {
+			status, _, ok := do("192.0.2.7")
+			require.True(t, ok)
+			require.Equal(t, http.StatusForbidden, status)
+		})
+		t.Run("reload", func(t *testing.T) {
+			writeGeoIPDatabase(t, geoIPDatabase, "CA")
+			require.Eventually(t, func() bool {
+				status, headers, ok := do("198.51.100.7")
+				return ok && status == http.StatusOK && slices.Equal(headers["X-Geo-Country"], []string{"CA"})
+			}, 10*time.Second, 200*time.Millisecond)
+		})
+	})
+
+	t.Run("rule_waf", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, path, body string
+			expCode          int
+			expRuleIDs       string
+		}{
+			{"clean", "/anything?q=hello", "", http.StatusOK, ""},
+			{"sqli query", "/anything?q=1%20UNION%20SELECT%20password", "", http.StatusForbidden, "942100"},
+			{"xss form body", "/anything", "comment=%3Cscript%3Ealert(1)%3C%2Fscript%3E", http.StatusForbidden, "941100"},
+			{"path traversal", "/anything?file=../../etc/passwd", "", http.StatusForbidden, "930100"},
+			{"php function phrase", "/anything", "code=Shell_Exec%28%24cmd%29", http.StatusForbidden, "933150"},
+			{"below threshold", "/anything/backup.sql", "", http.StatusOK, "920440"},
+			{"paranoia level 2 rule disabled", "/anything?q=hello--", "", http.StatusOK, ""},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					method, body := "GET", io.Reader(nil)
+					if tc.body != "" {
+						method, body = "POST", strings.NewReader(tc.body)
+					}
+					req, err := http.NewRequest(method, "http://localhost:1076"+tc.path, body)
+					require.NoError(t, err)
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					require.NoError(t, resp.Body.Close())
+					require.Equal(t, tc.expCode, resp.StatusCode)
+					require.Equal(t, tc.expRuleIDs, resp.Header.Get("x-waf-rule-ids"))
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("sqli", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, path, contentType, body string
+			expCode                       int
+		}{
+			{"benign query", "/anything?name=o%27neil&q=select+one+or+more", "", "", http.StatusOK},
+			{"tautology query", "/anything?id=1%27+or+%271%27%3D%271", "", "", http.StatusForbidden},
+			{"union json body", "/anything", "application/json", `{"filter": {"name": "x' UNION SELECT password FROM users--"}}`, http.StatusForbidden},
+			{"stacked form body", "/anything", "application/x-www-form-urlencoded", "id=1%3B+DROP+TABLE+users", http.StatusForbidden},
+			{"benign form body", "/anything", "application/x-www-form-urlencoded", "comment=Tom+%26+Jerry", http.StatusOK},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					method, body := "GET", io.Reader(nil)
+					if tc.body != "" {
+						method, body = "POST", strings.NewReader(tc.body)
+					}
+					req, err := http.NewRequest(method, "http://localhost:1077"+tc.path, body)
+					require.NoError(t, err)
+					if tc.contentType != "" {
+						req.Header.Set("Content-Type", tc.contentType)
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					require.NoError(t, resp.Body.Close())
+					require.Equal(t, tc.expCode, resp.StatusCode)
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("xss", func(t *testing.T) {
+		type anythingBody struct {
+			Args map[string][]string `json:"args"`
+			JSON map[string]any      `json:"json"`
+		}
+		do := func(method, path, body string) (anythingBody, bool) {
+			var reqBody io.Reader
+			if body != "" {
+				reqBody = strings.NewReader(body)
+			}
+			req, err := http.NewRequest(method, "http://localhost:1078"+path, reqBody)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return anythingBody{}, false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var got anythingBody
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+			return got, true
+		}
+		t.Run("double encoded query", func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				got, ok := do("GET", "/anything?q=%253Cscript%253Ealert(1)%253C%252Fscript%253E&page=2", "")
+				if !ok {
+					return false
+				}
+				require.Equal(t, []string{"&lt;script&gt;alert(1)&lt;/script&gt;"}, got.Args["q"])
+				require.Equal(t, []string{"2"}, got.Args["page"])
+				return true
+			}, 30*time.Second, 200*time.Millisecond)
+		})
+		t.Run("javascript uri query", func(t *testing.T) {
+			got, ok := do("GET", "/anything?next=java%26%23x09%3Bscript%3Aalert(1)", "")
+			require.True(t, ok)
+			require.Equal(t, []string{""}, got.Args["next"])
+		})
+		t.Run("json body", func(t *testing.T) {
+			got, ok := do("POST", "/anything", `{"name":"<img src=x onerror=alert(1)>","note":"a+b"}`)
+			require.True(t, ok)
+			require.Equal(t, "&lt;img src=x onerror=alert(1)&gt;", got.JSON["name"])
+			require.Equal(t, "a+b", got.JSON["note"])
+		})
+	})
+
+	t.Run("pii_redaction", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("GET", "http://localhost:1079/anything?contact=alice@example.com&ssn=123-45-6789&employee=EMP-123456", nil)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			var got struct {
+				Args map[string][]string `json:"args"`
+			}
+			require.NoError(t, json.Unmarshal(body, &got))
+			require.Equal(t, []string{"[EMAIL]"}, got.Args["contact"])
+			require.Equal(t, []string{"***-**-****"}, got.Args["ssn"])
+			require.Equal(t, []string{"[EMPLOYEE_ID]"}, got.Args["employee"])
+			require.NotContains(t, string(body), "alice@example.com")
+			return true
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("pan_masking", func(t *testing.T) {
+		do := func(method, path, body string) (map[string]any, bool) {
+			var reqBody io.Reader
+			if body != "" {
+				reqBody = strings.NewReader(body)
+			}
+			req, err := http.NewRequest(method, "http://localhost:1080"+path, reqBody)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return nil, false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var got map[string]any
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+			return got, true
+		}
+		t.Run("request", func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				got, ok := do("POST", "/anything", `{"card":"4111 1111 1111 1111","order":"1234567890123"}`)
+				if !ok {
+					return false
+				}
+				require.Equal(t, map[string]any{"card": "**** **** **** 1111", "order": "1234567890123"}, got["json"])
+				return true
+			}, 30*time.Second, 200*time.Millisecond)
+		})
+		t.Run("response", func(t *testing.T) {
+			got, ok := do("GET", "/anything?card=378282246310005", "")
+			require.True(t, ok)
+			require.Equal(t, map[string]any{"card": []any{"***********0005"}}, got["args"])
+		})
+	})
+
+	t.Run("body_limit", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, path string
+			size       int
+			chunked    bool
+			expCode    int
+		}{
+			{"under limit", "/anything", 512, false, http.StatusOK},
+			{"content-length over limit", "/anything", 2048, false, http.StatusRequestEntityTooLarge},
+			{"streamed over limit", "/anything", 4096, true, http.StatusRequestEntityTooLarge},
+			{"per-route limit", "/anything/small", 32, false, http.StatusRequestEntityTooLarge},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					var body io.Reader = bytes.NewReader(bytes.Repeat([]byte("a"), tc.size))
+					if tc.chunked {
+						// Hide the size so that the body is sent without Content-Length.
+						body = io.MultiReader(body)
+					}
+					req, err := http.NewRequest("POST", "http://localhost:1081"+tc.path, body)
+					require.NoError(t, err)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					require.NoError(t, resp.Body.Close())
+					require.Equal(t, tc.expCode, resp.StatusCode)
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("response_limit", func(t *testing.T) {
+		for _, tc := range []struct {
+			path      string
+			expLength int
+			truncated bool
+		}{
+			{"/bytes/512", 512, false},
+			{"/bytes/4096", 1024 + len("[truncated]"), true},
+			{"/stream-bytes/65536?chunk_size=1000", 1024 + len("[truncated]"), true},
+		} {
+			t.Run(tc.path, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("GET", "http://localhost:1082"+tc.path, nil)
+					require.NoError(t, err)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					require.Equal(t, http.StatusOK, resp.StatusCode)
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					require.Len(t, body, tc.expLength)
+					require.Equal(t, tc.truncated, bytes.HasSuffix(body, []byte("[truncated]")))
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("circuit_breaker", func(t *testing.T) {
+		// The failures on the /status route trip its circuit, which then serves the fallback.
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("GET", "http://localhost:1083/status/500", nil)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Logf("circuit not open yet: status %d", resp.StatusCode)
+				return false
+			}
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"error":"circuit open"}`, string(body))
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			return true
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The circuits are tracked per route, so the other routes are not affected.
+		req, err := http.NewRequest("GET", "http://localhost:1083/anything", nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, resp.Body.Close())
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("adaptive_concurrency", func(t *testing.T) {
+		// The limit is pinned to a single request in flight, so a request arriving while a slow one
+		// is in flight is shed.
+		require.Eventually(t, func() bool {
+			slow := make(chan error, 1)
+			go func() {
+				resp, err := http.Get("http://localhost:1084/delay/2")
+				if err == nil {
+					err = resp.Body.Close()
+				}
+				slow <- err
+			}()
+			defer func() {
+				<-slow
+			}()
+			time.Sleep(500 * time.Millisecond)
+
+			req, err := http.NewRequest("GET", "http://localhost:1084/anything", nil)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Logf("request not shed yet: status %d", resp.StatusCode)
+				return false
+			}
+			require.Equal(t, "2", resp.Header.Get("Retry-After"))
+			return true
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("openapi", func(t *testing.T) {
+		for _, tc := range []struct {
+			name          string
+			method        string
+			path          string
+			body          string
+			expStatus     int
+			expViolations []string
+		}{
+			{name: "valid query", method: "GET", path: "/anything/pets?limit=10", expStatus: http.StatusOK},
+			{name: "invalid query", method: "GET", path: "/anything/pets?limit=1000", expStatus: http.StatusBadRequest, expViolations: []string{"query.limit"}},
+			{name: "valid body", method: "POST", path: "/anything/pets", body: `{"name":"rex","tags":["good"]}`, expStatus: http.StatusOK},
+			{name: "invalid body", method: "POST", path: "/anything/pets", body: `{"name":"","tags":[1]}`, expStatus: http.StatusBadRequest, expViolations: []string{"body/name", "body/tags/0"}},
+			{name: "unknown path", method: "GET", path: "/anything/cats", expStatus: http.StatusNotFound},
+			{name: "unknown method", method: "DELETE", path: "/anything/pets", expStatus: http.StatusMethodNotAllowed},
+			{name: "invalid response", method: "GET", path: "/anything/pets/1", expStatus: http.StatusBadGateway, expViolations: []string{"body/name"}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest(tc.method, "http://localhost:1085"+tc.path, strings.NewReader(tc.body))
+					require.NoError(t, err)
+					if tc.body != "" {
+						req.Header.Set("Content-Type", "application/json")
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					require.Equal(t, tc.expStatus, resp.StatusCode, string(body))
+					if tc.expStatus == http.StatusOK {
+						return true
+					}
+					var errorBody struct {
+						Violations []struct {
+							Location string `json:"location"`
+						} `json:"violations"`
+					}
+					require.NoError(t, json.Unmarshal(body, &errorBody))
+					var locations []string
+					for _, v := range errorBody.Violations {
+						locations = append(locations, v.Location)
+					}
+					require.Subset(t, locations, tc.expViolations)
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("json_schema", func(t *testing.T) {
+		for _, tc := range []struct {
+			name          string
+			path          string
+			contentType   string
+			body          string
+			expStatus     int
+			expViolations []string
+		}{
+			{name: "valid", path: "/anything/pets", body: `{"name":"rex","tags":["good"]}`, expStatus: http.StatusOK},
+			{name: "invalid", path: "/anything/pets", body: `{"name":"","age":-1}`, expStatus: http.StatusBadRequest, expViolations: []string{"/age", "/name"}},
+			{name: "malformed", path: "/anything/pets", body: `{"name":`, expStatus: http.StatusBadRequest, expViolations: []string{""}},
+			{name: "not json", path: "/anything/pets", contentType: "text/plain", body: "rex", expStatus: http.StatusUnsupportedMediaType},
+			{name: "route schema", path: "/anything/orders", body: `{"items":["a"]}`, expStatus: http.StatusOK},
+			{name: "invalid route schema", path: "/anything/orders", body: `{"items":[]}`, expStatus: http.StatusBadRequest, expViolations: []string{"/items"}},
+			{name: "disabled route", path: "/anything/raw", contentType: "text/plain", body: "anything", expStatus: http.StatusOK},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("POST", "http://localhost:1086"+tc.path, strings.NewReader(tc.body))
+					require.NoError(t, err)
+					req.Header.Set("Content-Type", cmp.Or(tc.contentType, "application/json"))
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					require.Equal(t, tc.expStatus, resp.StatusCode, string(body))
+					if tc.expStatus == http.StatusOK {
+						return true
+					}
+					var errorBody struct {
+						Violations []struct {
+							Location string `json:"location"`
+						} `json:"violations"`
+					}
+					require.NoError(t, json.Unmarshal(body, &errorBody))
+					var locations []string
+					for _, v := range errorBody.Violations {
+						locations = append(locations, v.Location)
+					}
+					require.Equal(t, tc.expViolations, locations)
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("json_xml", func(t *testing.T) {
+		for _, tc := range []struct {
+			name           string
+			method         string
+			path           string
+			accept         string
+			contentType    string
+			body           string
+			expStatus      int
+			expContentType string
+			expBody        []string
+		}{
+			{
+				name: "json response as xml", method: "GET", path: "/anything/json-xml?userId=1", accept: "application/xml",
+				expStatus: http.StatusOK, expContentType: "application/xml; charset=utf-8",
+				expBody: []string{"<response>", "<method>GET</method>", "<user_id>1</user_id>"},
+			},
+			{
+				name: "xml response as json", method: "GET", path: "/xml", accept: "application/json",
+				expStatus: http.StatusOK, expContentType: "application/json",
+				expBody: []string{`"slide":[`, `"@title":"Sample Slide Show"`},
+			},
+			{
+				name: "xml request as json", method: "POST", path: "/anything/json-xml", contentType: "application/xml",
+				body:      `<order><itemCount>2</itemCount><express>true</express><tag>a</tag><tag>b</tag></order>`,
+				expStatus: http.StatusOK, expContentType: "application/json",
+				expBody: []string{`"json":{"express":true,"itemCount":2,"tag":["a","b"]}`},
+			},
+			{
+				name: "malformed xml request", method: "POST", path: "/anything/json-xml", contentType: "application/xml",
+				body: `<order>`, expStatus: http.StatusBadRequest,
+			},
+			{
+				name: "no preference", method: "GET", path: "/anything/json-xml",
+				expStatus: http.StatusOK, expContentType: "application/json",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest(tc.method, "http://localhost:1087"+tc.path, strings.NewReader(tc.body))
+					require.NoError(t, err)
+					if tc.accept != "" {
+						req.Header.Set("Accept", tc.accept)
+					}
+					if tc.contentType != "" {
+						req.Header.Set("Content-Type", tc.contentType)
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					require.Equal(t, tc.expStatus, resp.StatusCode, string(body))
+					if tc.expStatus != http.StatusOK {
+						return true
+					}
+					require.Equal(t, tc.expContentType, resp.Header.Get("Content-Type"))
+					require.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+					// httpbin echoes the JSON bodies with indentation, so compare them compacted.
+					if tc.expContentType == "application/json" {
+						var compacted bytes.Buffer
+						require.NoError(t, json.Compact(&compacted, body))
+						body = compacted.Bytes()
+					}
+					for _, exp := range tc.expBody {
+						require.Contains(t, string(body), exp)
+					}
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("sticky_session", func(t *testing.T) {
+		// do returns the session key the upstream received and the cookie set on the response.
+		do := func(cookie string) (key string, setCookie *http.Cookie, ok bool) {
+			req, err := http.NewRequest("GET", "http://localhost:1088/headers", nil)
+			require.NoError(t, err)
+			req.Header.Set("x-sticky-session", "chosen-by-client")
+			if cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "sticky_session", Value: cookie})
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return "", nil, false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var body struct {
+				Headers map[string][]string `json:"headers"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Headers["X-Sticky-Session"], 1)
+			key = body.Headers["X-Sticky-Session"][0]
+			require.NotEqual(t, "chosen-by-client", key)
+			for _, c := range resp.Cookies() {
+				if c.Name == "sticky_session" {
+					setCookie = c
+				}
+			}
+			return key, setCookie, true
+		}
+
+		var key string
+		var cookie *http.Cookie
+		require.Eventually(t, func() bool {
+			var ok bool
+			key, cookie, ok = do("")
+			return ok
+		}, 30*time.Second, 200*time.Millisecond)
+		require.NotNil(t, cookie)
+		require.Equal(t, 3600, cookie.MaxAge)
+		require.True(t, cookie.HttpOnly)
+
+		t.Run("existing session", func(t *testing.T) {
+			got, setCookie, ok := do(cookie.Value)
+			require.True(t, ok)
+			require.Equal(t, key, got)
+			require.Nil(t, setCookie)
+		})
+		t.Run("tampered cookie", func(t *testing.T) {
+			got, setCookie, ok := do("attacker" + cookie.Value[strings.Index(cookie.Value, "."):])
+			require.True(t, ok)
+			require.NotEqual(t, key, got)
+			require.NotEqual(t, "attacker", got)
+			require.NotNil(t, setCookie)
+		})
+	})
+
+	t.Run("request_id", func(t *testing.T) {
+		uuidV7 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+		for _, tc := range []struct {
+			name     string
+			clientID string
+			expID    string
+		}{
+			{name: "generated"},
+			{name: "client", clientID: "client-provided-id", expID: "client-provided-id"},
+			{name: "invalid client", clientID: strings.Repeat("x", 200)},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("GET", "http://localhost:1089/headers", nil)
+					require.NoError(t, err)
+					if tc.clientID != "" {
+						req.Header.Set("x-request-id", tc.clientID)
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					require.Equal(t, http.StatusOK, resp.StatusCode)
+					var body struct {
+						Headers map[string][]string `json:"headers"`
+					}
+					require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+					id := resp.Header.Get("x-request-id")
+					if tc.expID != "" {
+						require.Equal(t, tc.expID, id)
+					} else {
+						require.Regexp(t, uuidV7, id)
+					}
+					require.Equal(t, []string{id}, body.Headers["X-Request-Id"])
+					require.Equal(t, id, resp.Header.Get("x-request-id-metadata"))
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("trace_context", func(t *testing.T) {
+		traceParent := regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-(0[01])$`)
+		for _, tc := range []struct {
+			name       string
+			headers    map[string]string
+			expTraceID string
+			expSampled string
+			// expTracestate is the tracestate after the member of the filter.
+			expTracestate string
+		}{
+			{name: "generated", expSampled: "01"},
+			{
+				name: "traceparent",
+				headers: map[string]string{
+					"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+					"tracestate":  "vendor=abc,envoy=old",
+				},
+				expTraceID: "4bf92f3577b34da6a3ce929d0e0e4736", expSampled: "00", expTracestate: "vendor=abc",
+			},
+			{
+				name:       "b3 single",
+				headers:    map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"},
+				expTraceID: "80f198ee56343ba864fe8b2a57d3eff7", expSampled: "01",
+			},
+			{
+				name:       "b3 multi",
+				headers:    map[string]string{"x-b3-traceid": "a3ce929d0e0e4736", "x-b3-spanid": "00f067aa0ba902b7", "x-b3-sampled": "0"},
+				expTraceID: "0000000000000000a3ce929d0e0e4736", expSampled: "00",
+			},
+			{
+				name:       "invalid traceparent",
+				headers:    map[string]string{"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "tracestate": "vendor=abc"},
+				expSampled: "01",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest("GET", "http://localhost:1090/headers", nil)
+					require.NoError(t, err)
+					for k, v := range tc.headers {
+						req.Header.Set(k, v)
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Logf("Envoy not ready yet: %v", err)
+						return false
+					}
+					defer func() {
+						require.NoError(t, resp.Body.Close())
+					}()
+					require.Equal(t, http.StatusOK, resp.StatusCode)
+					var body struct {
+						Headers map[string][]string `json:"headers"`
+					}
+					require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+					require.Len(t, body.Headers["Traceparent"], 1)
+					m := traceParent.FindStringSubmatch(body.Headers["Traceparent"][0])
+					require.NotNil(t, m, body.Headers["Traceparent"][0])
+					traceID, spanID, sampled := m[1], m[2], m[3]
+					if tc.expTraceID != "" {
+						require.Equal(t, tc.expTraceID, traceID)
+					}
+					require.Equal(t, tc.expSampled, sampled)
+					require.Equal(t, traceID, resp.Header.Get("x-trace-id"))
+					require.Equal(t, spanID, resp.Header.Get("x-span-id"))
+					expTracestate := "envoy=" + spanID
+					if tc.expTracestate != "" {
+						expTracestate += "," + tc.expTracestate
+					}
+					require.Equal(t, []string{expTracestate}, body.Headers["Tracestate"])
+					return true
+				}, 30*time.Second, 200*time.Millisecond)
+			})
+		}
+	})
+
+	t.Run("go_metrics", func(t *testing.T) {
+		for _, path := range []string{"/uuid", "/status/404"} {
+			require.Eventually(t, func() bool {
+				resp, err := http.Get("http://localhost:1091" + path)
+				if err != nil {
+					t.Logf("Envoy not ready yet: %v", err)
+					return false
+				}
+				require.NoError(t, resp.Body.Close())
+				return true
+			}, 30*time.Second, 200*time.Millisecond)
+		}
+		req, err := http.NewRequest("PURGE", "http://localhost:1091/anything", nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		// labelsOf returns the labels of each metric of the family.
+		labelsOf := func(family *io_prometheus_client.MetricFamily) []map[string]string {
+			var all []map[string]string
+			for _, metric := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				all = append(all, labels)
+			}
+			return all
+		}
+		expLabels := []map[string]string{
+			{"route": "go_metrics_catch_all", "method": "GET", "response_class": "2xx"},
+			{"route": "go_metrics_status", "method": "GET", "response_class": "4xx"},
+			{"route": "go_metrics_catch_all", "method": "OTHER", "response_class": "2xx"},
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:9901/stats/prometheus")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			found := map[string][]map[string]string{}
+			decoder := expfmt.NewDecoder(bytes.NewReader(body), expfmt.NewFormat(expfmt.TypeTextPlain))
+			for {
+				var metricFamily io_prometheus_client.MetricFamily
+				err := decoder.Decode(&metricFamily)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				switch metricFamily.GetName() {
+				case "http_requests_total", "http_request_duration_ms":
+					found[metricFamily.GetName()] = labelsOf(&metricFamily)
+				}
+			}
+			for _, name := range []string{"http_requests_total", "http_request_duration_ms"} {
+				for _, exp := range expLabels {
+					if !slices.ContainsFunc(found[name], func(labels map[string]string) bool {
+						return maps.Equal(labels, exp)
+					}) {
+						t.Logf("%s%v not found yet", name, exp)
+						return false
+					}
+				}
+			}
+			return true
+		}, 5*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("go_access_logger", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("GET", "http://localhost:1092/status/201", nil)
+			require.NoError(t, err)
+			req.Header.Set("User-Agent", `go-access-logger "test"`)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusCreated
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The lines are written asynchronously, so wait for them to show up.
+		require.Eventually(t, func() bool {
+			content, err := os.ReadFile(accessLogsDir + "/go_access.json")
+			if err != nil {
+				t.Logf("go access log not written yet: %v", err)
+				return false
+			}
+			for line := range strings.Lines(string(content)) {
+				var log struct {
+					Method       string `json:"method"`
+					Path         string `json:"path"`
+					Route        string `json:"route"`
+					ResponseCode int    `json:"response_code"`
+					UserAgent    string `json:"user_agent"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(line), &log), line)
+				if log.Path == "/status/201" {
+					require.Equal(t, "GET", log.Method)
+					require.Equal(t, "go_access_log", log.Route)
+					require.Equal(t, http.StatusCreated, log.ResponseCode)
+					require.Equal(t, `go-access-logger "test"`, log.UserAgent)
+					return true
+				}
+			}
+			return false
+		}, 30*time.Second, 200*time.Millisecond)
+		require.Eventually(t, func() bool {
+			content, err := os.ReadFile(accessLogsDir + "/go_access_combined.log")
+			if err != nil {
+				t.Logf("go access log not written yet: %v", err)
+				return false
+			}
+			for line := range strings.Lines(string(content)) {
+				if strings.Contains(line, `"GET /status/201 HTTP/1.1" 201 `) {
+					require.True(t, strings.HasSuffix(line, `"-" "go-access-logger \"test\""`+"\n"), line)
+					return true
+				}
+			}
+			return false
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("otlp_access_log", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1093/anything/otlp-access-log")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		type anyValue struct {
+			StringValue string `json:"stringValue"`
+			IntValue    string `json:"intValue"`
+		}
+		type keyValue struct {
+			Key   string   `json:"key"`
+			Value anyValue `json:"value"`
+		}
+		attributes := func(kvs []keyValue) map[string]string {
+			m := make(map[string]string)
+			for _, kv := range kvs {
+				m[kv.Key] = cmp.Or(kv.Value.StringValue, kv.Value.IntValue)
+			}
+			return m
+		}
+		timeout := time.After(30 * time.Second)
+		for {
+			select {
+			case body := <-otlpRequests:
+				var req struct {
+					ResourceLogs []struct {
+						Resource struct {
+							Attributes []keyValue `json:"attributes"`
+						} `json:"resource"`
+						ScopeLogs []struct {
+							LogRecords []struct {
+								Attributes []keyValue `json:"attributes"`
+							} `json:"logRecords"`
+						} `json:"scopeLogs"`
+					} `json:"resourceLogs"`
+				}
+				require.NoError(t, json.Unmarshal(body, &req), string(body))
+				for _, rl := range req.ResourceLogs {
+					require.Equal(t, map[string]string{"service.name": "integration-test", "deployment.environment": "test"},
+						attributes(rl.Resource.Attributes))
+					for _, sl := range rl.ScopeLogs {
+						for _, record := range sl.LogRecords {
+							attrs := attributes(record.Attributes)
+							if attrs["url.path"] != "/anything/otlp-access-log" {
+								continue
+							}
+							require.Equal(t, "GET", attrs["http.request.method"])
+							require.Equal(t, "200", attrs["http.response.status_code"])
+							require.Equal(t, "otlp_access_log", attrs["http.route"])
+							return
+						}
+					}
+				}
+			case <-timeout:
+				t.Fatal("the access log record was not exported")
+			}
+		}
+	})
+
+	t.Run("audit_log", func(t *testing.T) {
+		for _, path := range []string{"/anything/not-audited", "/anything/audited?token=secret&page=2"} {
+			require.Eventually(t, func() bool {
+				req, err := http.NewRequest("POST", "http://localhost:1094"+path, strings.NewReader(`{"message":"a body longer than the excerpt"}`))
+				require.NoError(t, err)
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer secret")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Logf("Envoy not ready yet: %v", err)
+					return false
+				}
+				require.NoError(t, resp.Body.Close())
+				return resp.StatusCode == http.StatusOK
+			}, 30*time.Second, 200*time.Millisecond)
+		}
+
+		require.Eventually(t, func() bool {
+			content, err := os.ReadFile(accessLogsDir + "/audit.log")
+			if err != nil {
+				t.Logf("audit log not written yet: %v", err)
+				return false
+			}
+			require.NotContains(t, string(content), "not-audited")
+			require.NotContains(t, string(content), "secret")
+			for line := range strings.Lines(string(content)) {
+				var record struct {
+					Route                string            `json:"route"`
+					Method               string            `json:"method"`
+					Path                 string            `json:"path"`
+					Status               int               `json:"status"`
+					RequestHeaders       map[string]string `json:"request_headers"`
+					ResponseHeaders      map[string]string `json:"response_headers"`
+					RequestBody          string            `json:"request_body"`
+					RequestBodyTruncated bool              `json:"request_body_truncated"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+				require.Equal(t, "audited", record.Route)
+				require.Equal(t, "POST", record.Method)
+				require.Regexp(t, `^/anything/audited\?token=hmac-sha256:[0-9a-f]{64}&page=2$`, record.Path)
+				require.Equal(t, http.StatusOK, record.Status)
+				require.Equal(t, "application/json", record.RequestHeaders["content-type"])
+				require.Regexp(t, `^hmac-sha256:[0-9a-f]{64}$`, record.RequestHeaders["authorization"])
+				require.Equal(t, "application/json", record.ResponseHeaders["content-type"])
+				require.Equal(t, `{"message":"a bo`, record.RequestBody)
+				require.True(t, record.RequestBodyTruncated)
+				return true
+			}
+			return false
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("ext_authz", func(t *testing.T) {
+		get := func(port, authorization string) (*http.Response, []byte) {
+			req, err := http.NewRequest("GET", "http://localhost:"+port+"/headers", nil)
+			require.NoError(t, err)
+			if authorization != "" {
+				req.Header.Set("Authorization", authorization)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, body
+		}
+		type headersResponse struct {
+			Headers map[string][]string `json:"headers"`
+		}
+
+		// The allowed request gets the headers from the authorization service.
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("GET", "http://localhost:1095/headers", nil)
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer good")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+		checks := extAuthzChecks.Load()
+		for range 3 {
+			resp, body := get("1095", "Bearer good")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "s1", resp.Header.Get("X-Auth-Session"))
+			var headers headersResponse
+			require.NoError(t, json.Unmarshal(body, &headers))
+			require.Equal(t, []string{"alice"}, headers.Headers["X-Auth-User"])
+			require.NotContains(t, headers.Headers, "Authorization")
+		}
+		// The decision is cached.
+		require.Equal(t, checks, extAuthzChecks.Load())
+
+		// The denied request gets the status, the body, and only the allowed headers.
+		resp, body := get("1095", "Bearer bad")
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, "denied", string(body))
+		require.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+		require.Empty(t, resp.Header.Get("X-Internal"))
+
+		// The unavailable authorization service lets the request through in the failure mode allow.
+		resp, body = get("1096", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var headers headersResponse
+		require.NoError(t, json.Unmarshal(body, &headers))
+		require.Equal(t, []string{"true"}, headers.Headers["X-Envoy-Auth-Failure-Mode-Allowed"])
+	})
+
+	t.Run("xfcc", func(t *testing.T) {
+		get := func(path string, headers map[string]string) (int, map[string][]string) {
+			req, err := http.NewRequest("GET", "http://localhost:1097"+path, nil)
+			require.NoError(t, err)
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var body struct {
+				Headers map[string][]string `json:"headers"`
+			}
+			if resp.StatusCode == http.StatusOK {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			}
+			return resp.StatusCode, body.Headers
+		}
+		const frontend = `Hash=1f2e3d;Subject="CN=frontend,O=Example";URI=spiffe://example.org/ns/prod/sa/frontend`
+		const backend = `By=spiffe://example.org/ns/prod/sa/gateway;Hash=4c5b6a;URI=spiffe://example.org/ns/prod/sa/backend;DNS=backend.internal.example.org`
+
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("GET", "http://localhost:1097/headers", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Forwarded-Client-Cert", frontend)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The identity of the last element is normalized into the headers.
+		status, headers := get("/headers", map[string]string{"X-Forwarded-Client-Cert": "Hash=aaaa;URI=spiffe://other.org/sa/x," + frontend})
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, []string{"1f2e3d"}, headers["X-Client-Cert-Hash"])
+		require.Equal(t, []string{"CN=frontend,O=Example"}, headers["X-Client-Cert-Subject"])
+		require.Equal(t, []string{"spiffe://example.org/ns/prod/sa/frontend"}, headers["X-Client-Cert-Uri-San"])
+		require.NotContains(t, headers, "X-Client-Cert-Dns-San")
+
+		status, headers = get("/headers", map[string]string{"X-Forwarded-Client-Cert": backend})
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, []string{"backend.internal.example.org"}, headers["X-Client-Cert-Dns-San"])
+
+		// The per-route allowlist only lets the frontend in.
+		status, _ = get("/anything/frontend-only", map[string]string{"X-Forwarded-Client-Cert": frontend})
+		require.Equal(t, http.StatusOK, status)
+		status, _ = get("/anything/frontend-only", map[string]string{"X-Forwarded-Client-Cert": backend})
+		require.Equal(t, http.StatusForbidden, status)
+
+		// A certificate not in the allowlist, no certificate, a malformed header, and a spoofed
+		// identity header are rejected.
+		status, _ = get("/headers", map[string]string{"X-Forwarded-Client-Cert": "Hash=aaaa;URI=spiffe://other.org/sa/x"})
+		require.Equal(t, http.StatusForbidden, status)
+		status, _ = get("/headers", nil)
+		require.Equal(t, http.StatusForbidden, status)
+		status, _ = get("/headers", map[string]string{"X-Forwarded-Client-Cert": `Subject="unterminated`})
+		require.Equal(t, http.StatusForbidden, status)
+		status, _ = get("/headers", map[string]string{"X-Forwarded-Client-Cert": frontend, "X-Client-Cert-Subject": "CN=admin"})
+		require.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("content_routing", func(t *testing.T) {
+		post := func(contentType string, body []byte, tenantHeader string) (string, string) {
+			req, err := http.NewRequest("POST", "http://localhost:1098/anything", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentType)
+			if tenantHeader != "" {
+				req.Header.Set("X-Tenant-Id", tenantHeader)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var echo struct {
+				Headers map[string][]string `json:"headers"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+			return resp.Header.Get("X-Route"), strings.Join(echo.Headers["X-Tenant-Id"], ",")
+		}
+
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1098/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		route, tenant := post("application/json", []byte(`{"tenant": {"id": "acme"}, "items": []}`), "")
+		require.Equal(t, "acme", route)
+		require.Equal(t, "acme", tenant)
+
+		route, tenant = post("application/json", []byte(`{"tenant": {"id": "globex"}}`), "")
+		require.Equal(t, "default", route)
+		require.Equal(t, "globex", tenant)
+
+		// The header from the client is replaced, or removed if the body has no tenant.
+		route, tenant = post("application/json", []byte(`{"tenant": {"id": "globex"}}`), "acme")
+		require.Equal(t, "default", route)
+		require.Equal(t, "globex", tenant)
+		route, tenant = post("application/json", []byte(`{}`), "acme")
+		require.Equal(t, "default", route)
+		require.Empty(t, tenant)
+
+		// The field 2 of the message in the field 1 is "acme".
+		message := []byte{0x0a, 0x06, 0x12, 0x04, 'a', 'c', 'm', 'e', 0x18, 0x01}
+		route, tenant = post("application/x-protobuf", message, "")
+		require.Equal(t, "acme", route)
+		require.Equal(t, "acme", tenant)
+	})
+
+	t.Run("soap", func(t *testing.T) {
+		post := func(contentType, soapAction, envelope string) (*http.Response, []byte) {
+			req, err := http.NewRequest("POST", "http://localhost:1099/anything", strings.NewReader(envelope))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentType)
+			if soapAction != "" {
+				req.Header.Set("SOAPAction", soapAction)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, body
+		}
+		envelope := func(body string) string {
+			return `<?xml version="1.0" encoding="utf-8"?>` +
+				`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">` +
+				`<soap:Header/><soap:Body>` + body + `</soap:Body></soap:Envelope>`
+		}
+
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1099/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The operation and the action are extracted, and the request is routed by the operation.
+		resp, body := post("text/xml; charset=utf-8", `"urn:example#GetPrice"`,
+			envelope(`<m:GetPrice xmlns:m="urn:example"><m:Item>Apples &amp; Pears</m:Item></m:GetPrice>`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "pricing", resp.Header.Get("X-Route"))
+		var echo struct {
+			Headers map[string][]string `json:"headers"`
+		}
+		require.NoError(t, json.Unmarshal(body, &echo))
+		require.Equal(t, []string{"GetPrice"}, echo.Headers["X-Soap-Operation"])
+		require.Equal(t, []string{"urn:example#GetPrice"}, echo.Headers["X-Soap-Action"])
+
+		resp, _ = post("application/soap+xml; charset=utf-8; action=\"urn:example#GetStock\"", "",
+			`<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><m:GetStock xmlns:m="urn:example"/></env:Body></env:Envelope>`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "default", resp.Header.Get("X-Route"))
+
+		// XXE, too deep, and non-SOAP payloads are rejected with a SOAP fault.
+		for _, payload := range []string{
+			`<?xml version="1.0"?><!DOCTYPE foo [<!ENTITY xxe SYSTEM "file:///etc/passwd">]>` + envelope(`<m:GetPrice xmlns:m="urn:example">&xxe;</m:GetPrice>`),
+			envelope(strings.Repeat("<a>", 10) + strings.Repeat("</a>", 10)),
+			`<GetPrice/>`,
+		} {
+			resp, body = post("text/xml", `"urn:example#GetPrice"`, payload)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			require.Contains(t, string(body), "<faultcode>soap:Client</faultcode>")
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		type field struct{ name, filename, contentType, value string }
+		post := func(fields []field) (int, map[string][]string, map[string]string, map[string][]string) {
+			var body bytes.Buffer
+			w := multipart.NewWriter(&body)
+			for _, f := range fields {
+				if f.filename == "" {
+					require.NoError(t, w.WriteField(f.name, f.value))
+					continue
+				}
+				h := textproto.MIMEHeader{}
+				h.Set("Content-Disposition", `form-data; name="`+f.name+`"; filename="`+f.filename+`"`)
+				h.Set("Content-Type", f.contentType)
+				part, err := w.CreatePart(h)
+				require.NoError(t, err)
+				_, err = part.Write([]byte(f.value))
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Close())
+			resp, err := http.Post("http://localhost:1100/anything", w.FormDataContentType(), &body)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var echo struct {
+				Form    map[string][]string `json:"form"`
+				Files   map[string][]string `json:"files"`
+				Headers map[string][]string `json:"headers"`
+			}
+			if resp.StatusCode == http.StatusOK {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+			}
+			files := make(map[string]string)
+			for name, values := range echo.Files {
+				files[name] = strings.Join(values, ",")
+			}
+			return resp.StatusCode, echo.Form, files, echo.Headers
+		}
+
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1100/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The disallowed field is stripped, the tenant is copied to the header, and the file
+		// streams through.
+		file := strings.Repeat("0123456789", 50000)
+		status, form, files, headers := post([]field{
+			{name: "tenant", value: "acme"},
+			{name: "internal_token", value: "s3cr3t"},
+			{name: "file", filename: "notes.txt", contentType: "text/plain", value: file},
+		})
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, []string{"acme"}, form["tenant"])
+		require.NotContains(t, form, "internal_token")
+		require.Len(t, files["file"], len(file))
+		require.Equal(t, []string{"acme"}, headers["X-Tenant"])
+
+		// The disallowed file type and the file over the limit are rejected.
+		status, _, _, _ = post([]field{{name: "file", filename: "run.sh", contentType: "application/x-sh", value: "echo"}})
+		require.Equal(t, http.StatusUnsupportedMediaType, status)
+		status, _, _, _ = post([]field{{name: "file", filename: "big.png", contentType: "image/png", value: strings.Repeat("x", 700000)}})
+		require.Equal(t, http.StatusRequestEntityTooLarge, status)
+	})
+
+	t.Run("icap", func(t *testing.T) {
+		post := func(port string, body []byte) int {
+			resp, err := http.Post("http://localhost:"+port+"/anything", "application/octet-stream", bytes.NewReader(body))
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Post("http://localhost:1101/anything", "text/plain", strings.NewReader("clean"))
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+		require.Equal(t, http.StatusOK, post("1101", bytes.Repeat([]byte("clean "), 1000)))
+		require.Equal(t, http.StatusForbidden, post("1101", eicar))
+		require.Equal(t, http.StatusRequestEntityTooLarge, post("1101", make([]byte, 100000)))
+
+		// The ICAP server of this listener is down, and it fails open.
+		require.Equal(t, http.StatusOK, post("1102", eicar))
+	})
+
+	t.Run("security_headers", func(t *testing.T) {
+		get := func(path string, https bool) http.Header {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost:1103"+path, nil)
+			require.NoError(t, err)
+			if https {
+				req.Header.Set("X-Forwarded-Proto", "https")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			return resp.Header
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1103/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The conflicting upstream values are replaced, and HSTS is only sent on HTTPS.
+		headers := get("/response-headers?Referrer-Policy=unsafe-url&Strict-Transport-Security=max-age=1", false)
+		require.Equal(t, []string{"no-referrer"}, headers.Values("Referrer-Policy"))
+		require.Equal(t, "nosniff", headers.Get("X-Content-Type-Options"))
+		require.Equal(t, "default-src 'self'; frame-ancestors 'none'", headers.Get("Content-Security-Policy"))
+		require.NotEmpty(t, headers.Get("Permissions-Policy"))
+		require.Empty(t, headers.Values("Strict-Transport-Security"))
+		headers = get("/anything", true)
+		require.Equal(t, "max-age=31536000; includeSubDomains", headers.Get("Strict-Transport-Security"))
+
+		// The per-route config tries out a new policy in the report-only mode.
+		headers = get("/anything/docs", false)
+		require.Empty(t, headers.Get("Content-Security-Policy"))
+		require.Equal(t, "default-src 'self'; script-src 'self' cdn.example.com", headers.Get("Content-Security-Policy-Report-Only"))
+		require.Empty(t, headers.Get("Permissions-Policy"))
+		require.Equal(t, "strict-origin-when-cross-origin", headers.Get("Referrer-Policy"))
+	})
+
+	t.Run("maintenance", func(t *testing.T) {
+		get := func(bypass string) (*http.Response, string) {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost:1104/anything", nil)
+			require.NoError(t, err)
+			if bypass != "" {
+				req.Header.Set("X-Maintenance-Bypass", bypass)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, string(body)
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1104/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// Creating the flag file turns the maintenance mode on.
+		flagFile := cwd + "/testdata/maintenance.flag"
+		require.NoError(t, os.WriteFile(flagFile, nil, 0o644))
+		defer func() { _ = os.Remove(flagFile) }()
+		require.Eventually(t, func() bool {
+			resp, _ := get("")
+			return resp.StatusCode == http.StatusServiceUnavailable
+		}, 5*time.Second, 100*time.Millisecond)
+		resp, body := get("")
+		require.Equal(t, "120", resp.Header.Get("Retry-After"))
+		require.Contains(t, body, "Back soon.")
+		require.Contains(t, body, "try again in 2 minutes")
+
+		// The operators get through with the bypass token, which is not sent upstream.
+		resp, body = get("letmein")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NotContains(t, body, "letmein")
+		resp, _ = get("wrong")
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+		// The other paths are not under maintenance.
+		resp2, err := http.Get("http://localhost:1104/status/200")
+		require.NoError(t, err)
+		require.NoError(t, resp2.Body.Close())
+		require.Equal(t, http.StatusOK, resp2.StatusCode)
+
+		// Removing the flag file turns it off.
+		require.NoError(t, os.Remove(flagFile))
+		require.Eventually(t, func() bool {
+			resp, _ := get("")
+			return resp.StatusCode == http.StatusOK
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		get := func(path string) (int, string, bool) {
+			resp, err := http.Get("http://localhost:1105" + path)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp.StatusCode, string(body), resp.Header.Get("X-Coalesced") == "true"
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1105/ready")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The concurrent identical requests share a single upstream request.
+		before := coalescingHits.Load()
+		const n = 10
+		type result struct {
+			status    int
+			body      string
+			coalesced bool
+		}
+		results := make(chan result, n)
+		for range n {
+			go func() {
+				status, body, coalesced := get("/stampede")
+				results <- result{status, body, coalesced}
+			}()
+		}
+		var bodies []string
+		coalesced := 0
+		for range n {
+			r := <-results
+			require.Equal(t, http.StatusOK, r.status)
+			bodies = append(bodies, r.body)
+			if r.coalesced {
+				coalesced++
+			}
+		}
+		hits := int(coalescingHits.Load() - before)
+		require.Less(t, hits, n)
+		require.Equal(t, n-hits, coalesced)
+		require.Contains(t, bodies, fmt.Sprintf("/stampede %d", before+1))
+
+		// The requests with credentials are not coalesced.
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:1105/private", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Empty(t, resp.Header.Get("X-Coalesced"))
+	})
+
+	t.Run("idempotency", func(t *testing.T) {
+		post := func(path, key, authorization, body string) (*http.Response, string) {
+			req, err := http.NewRequest(http.MethodPost, "http://localhost:1106"+path, strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Idempotency-Key", key)
+			req.Header.Set("Authorization", authorization)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			respBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, string(respBody)
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1106/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The retry gets the stored response.
+		resp, first := post("/anything", "order-1", "alice", `{"amount": 10}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+		resp, retry := post("/anything", "order-1", "alice", `{"amount": 10}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+		require.Equal(t, first, retry)
+
+		// The key can't be reused for another request, but it is scoped by the Authorization.
+		resp, _ = post("/anything", "order-1", "alice", `{"amount": 20}`)
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		resp, _ = post("/anything", "order-1", "bob", `{"amount": 20}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+
+		// The duplicate of an in-flight request is rejected.
+		done := make(chan int)
+		go func() {
+			resp, _ := post("/delay/1", "order-2", "alice", "")
+			done <- resp.StatusCode
+		}()
+		time.Sleep(300 * time.Millisecond)
+		resp, _ = post("/delay/1", "order-2", "alice", "")
+		require.Equal(t, http.StatusConflict, resp.StatusCode)
+		require.Equal(t, http.StatusOK, <-done)
+
+		// The server errors are not stored, so they can be retried.
+		for range 2 {
+			resp, _ = post("/status/500", "order-3", "alice", "")
+			require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+			require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+		}
+	})
+
+	t.Run("replay_protection", func(t *testing.T) {
+		send := func(timestamp int64, nonce, path string, signed bool) int {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost:1107"+path, nil)
+			require.NoError(t, err)
+			ts := strconv.FormatInt(timestamp, 10)
+			mac := hmac.New(sha256.New, []byte("replay-secret"))
+			mac.Write([]byte(ts + "\n" + nonce + "\nGET\n" + path))
+			signature := hex.EncodeToString(mac.Sum(nil))
+			if !signed {
+				signature = strings.Repeat("0", len(signature))
+			}
+			req.Header.Set("X-Timestamp", ts)
+			req.Header.Set("X-Nonce", nonce)
+			req.Header.Set("X-Signature", signature)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1107/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusUnauthorized
+		}, 30*time.Second, 200*time.Millisecond)
+
+		now := time.Now().Unix()
+		nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+		require.Equal(t, http.StatusOK, send(now, nonce, "/anything", true))
+		// The same request is replayed.
+		require.Equal(t, http.StatusUnauthorized, send(now, nonce, "/anything", true))
+		// The signature is wrong.
+		require.Equal(t, http.StatusUnauthorized, send(now, nonce+"-2", "/anything", false))
+		// The timestamp is too old.
+		require.Equal(t, http.StatusUnauthorized, send(now-120, nonce+"-3", "/anything", true))
+		require.Equal(t, http.StatusOK, send(now, nonce+"-4", "/anything/other", true))
+	})
+
+	t.Run("field_encryption", func(t *testing.T) {
+		type echo struct {
+			Data string `json:"data"`
+			JSON struct {
+				SSN any `json:"ssn"`
+			} `json:"json"`
+		}
+		post := func(body string) (int, echo) {
+			resp, err := http.Post("http://localhost:1108/anything", "application/json", strings.NewReader(body))
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var e echo
+			if resp.StatusCode == http.StatusOK {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+			}
+			return resp.StatusCode, e
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1108/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The field is encrypted in the response.
+		status, e := post(`{"ssn": "123-45-6789"}`)
+		require.Equal(t, http.StatusOK, status)
+		encrypted, ok := e.JSON.SSN.(string)
+		require.True(t, ok)
+		require.True(t, strings.HasPrefix(encrypted, "enc:v1:k1:"), encrypted)
+
+		// The encrypted field sent back is decrypted before it goes upstream.
+		status, e = post(`{"json": {"ssn": "` + encrypted + `"}, "note": "<keep>"}`)
+		require.Equal(t, http.StatusOK, status)
+		require.JSONEq(t, `{"json": {"ssn": "123-45-6789"}, "note": "<keep>"}`, e.Data)
+
+		// The tampered values are rejected.
+		status, _ = post(`{"json": {"ssn": "` + encrypted[:len(encrypted)-4] + `AAAA"}}`)
+		require.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("tokenization", func(t *testing.T) {
+		type echo struct {
+			Data string `json:"data"`
+			JSON struct {
+				Card struct {
+					Number string `json:"number"`
+				} `json:"card"`
+			} `json:"json"`
+		}
+		post := func(path string) echo {
+			resp, err := http.Post("http://localhost:1109"+path, "application/json",
+				strings.NewReader(`{"card": {"number": "4111111111111111"}, "amount": 10}`))
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var e echo
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+			return e
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1109/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The upstream only sees the token, and so does the client of a route not allowed to
+		// detokenize.
+		e := post("/anything")
+		require.NotContains(t, e.Data, "4111111111111111")
+		require.True(t, strings.HasPrefix(e.JSON.Card.Number, "tok_"), e.JSON.Card.Number)
+		require.Equal(t, int32(1), tokenizationCalls.Load())
+
+		// The allowed route gets the value back, and both ways are cached.
+		e = post("/anything/authorized")
+		require.NotContains(t, e.Data, "4111111111111111")
+		require.Equal(t, "4111111111111111", e.JSON.Card.Number)
+		require.Equal(t, int32(1), tokenizationCalls.Load())
+	})
+
+	t.Run("localization", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		get := func(path, acceptLanguage string) (*http.Response, string) {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost:1110"+path, nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept-Language", acceptLanguage)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var echo struct {
+				Headers map[string][]string `json:"headers"`
+			}
+			if resp.StatusCode == http.StatusOK {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+			}
+			return resp, strings.Join(echo.Headers["X-Locale"], ",")
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1110/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		for _, tc := range []struct{ acceptLanguage, locale string }{
+			{"de;q=0.9, fr-CA;q=0.8, en;q=0.1", "de-DE"},
+			{"fr-CA, en;q=0.5", "fr"},
+			{"en-GB;q=0, en;q=0.5", "en-US"},
+			{"ja", "en-US"},
+		} {
+			resp, locale := get("/headers", tc.acceptLanguage)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, tc.locale, locale, tc.acceptLanguage)
+			require.Equal(t, tc.locale, resp.Header.Get("Content-Language"))
+			require.Contains(t, resp.Header.Values("Vary"), "Accept-Language")
+		}
+
+		// The paths without a locale are redirected, and the locale in the path wins.
+		resp, _ := get("/about?x=1", "fr")
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		require.Equal(t, "/fr/about?x=1", resp.Header.Get("Location"))
+		resp, locale := get("/fr/headers", "de")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "fr", locale)
+	})
+
+	t.Run("feature_flags", func(t *testing.T) {
+		get := func(port int, userID string) map[string][]string {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/headers", port), nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Feature-Theme", "spoofed")
+			req.Header.Set("X-Feature-Admin", "true")
+			if userID != "" {
+				req.Header.Set("X-User-Id", userID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var echo struct {
+				Headers map[string][]string `json:"headers"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+			return echo.Headers
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1111/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The flags of the client are removed, and the disabled ones are not set.
+		headers := get(1111, "")
+		require.Equal(t, []string{"dark"}, headers["X-Feature-Theme"])
+		require.Equal(t, []string{"false"}, headers["X-Feature-New-Checkout"])
+		require.NotContains(t, headers, "X-Feature-Admin")
+		require.NotContains(t, headers, "X-Feature-Legacy-Search")
+
+		// The rollout is stable per user, and splits the users.
+		seen := map[string]bool{}
+		for i := range 20 {
+			userID := fmt.Sprintf("user-%d", i)
+			value := get(1111, userID)["X-Feature-New-Checkout"]
+			require.Equal(t, value, get(1111, userID)["X-Feature-New-Checkout"])
+			seen[strings.Join(value, ",")] = true
+		}
+		require.Equal(t, map[string]bool{"true": true, "false": true}, seen)
+
+		// Only the listed flags of the OFREP service are set, and its changes are polled.
+		headers = get(1112, "")
+		require.Equal(t, []string{"spring"}, headers["X-Feature-Banner"])
+		require.NotContains(t, headers, "X-Feature-Beta")
+		ofrepBanner.Store("summer")
+		require.Eventually(t, func() bool {
+			return slices.Equal([]string{"summer"}, get(1112, "")["X-Feature-Banner"])
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("shadow_diff", func(t *testing.T) {
+		get := func(path string) {
+			resp, err := http.Get("http://localhost:1113" + path)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			// The end of the response is held until the shadow response arrives, but not lost.
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.True(t, json.Valid(body), string(body))
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1113/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The shadow is the same httpbin, so /json matches while each /uuid differs.
+		get("/json")
+		get("/uuid")
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:9901/stats/prometheus")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			results := map[string]float64{}
+			decoder := expfmt.NewDecoder(resp.Body, expfmt.NewFormat(expfmt.TypeTextPlain))
+			for {
+				var metricFamily io_prometheus_client.MetricFamily
+				err := decoder.Decode(&metricFamily)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				if metricFamily.GetName() != "shadow_diffs_total" {
+					continue
+				}
+				for _, metric := range metricFamily.GetMetric() {
+					for _, label := range metric.GetLabel() {
+						results[label.GetValue()] = metric.GetCounter().GetValue()
+					}
+				}
+			}
+			t.Logf("shadow diffs: %v", results)
+			return results["match"] >= 1 && results["body_mismatch"] >= 1
+		}, 5*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("cel_policy", func(t *testing.T) {
+		do := func(method, path string, headers map[string]string) (*http.Response, map[string][]string) {
+			req, err := http.NewRequest(method, "http://localhost:1114"+path, nil)
+			require.NoError(t, err)
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var echo struct {
+				Headers map[string][]string `json:"headers"`
+			}
+			if resp.StatusCode == http.StatusOK {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+			}
+			return resp, echo.Headers
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1114/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		resp, _ := do(http.MethodDelete, "/anything", nil)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp, _ = do(http.MethodDelete, "/anything", map[string]string{"X-Admin": "1"})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, headers := do(http.MethodGet, "/anything", map[string]string{"X-Env": "staging", "X-Debug": "1"})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, []string{"true"}, headers["X-Staging"])
+		require.NotContains(t, headers, "X-Debug")
+		_, headers = do(http.MethodGet, "/anything", nil)
+		require.NotContains(t, headers, "X-Staging")
+
+		// The route header picks the route again.
+		resp, _ = do(http.MethodGet, "/anything/tea", nil)
+		require.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+		// The per-route config has no policies.
+		resp, _ = do(http.MethodDelete, "/anything/open", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("llm_usage", func(t *testing.T) {
+		post := func(path, body string) (*http.Response, string) {
+			req, err := http.NewRequest(http.MethodPost, "http://localhost:1115"+path, strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Tenant", "acme")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			respBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, string(respBody)
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Post("http://localhost:1115/v1/chat/completions", "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		resp, _ := post("/v1/chat/completions", `{"model":"gpt-test","messages":[{"role":"user","content":"Hi"}]}`)
+		require.Equal(t, "11", resp.Header.Get("X-Llm-Usage-Input-Tokens"))
+		require.Equal(t, "3", resp.Header.Get("X-Llm-Usage-Output-Tokens"))
+		require.Equal(t, "14", resp.Header.Get("X-Llm-Usage-Total-Tokens"))
+		require.Empty(t, resp.Header.Get("X-Llm-Usage-Estimated"))
+
+		// The usage is estimated from the 16 characters of the prompt and the 12 of the completion.
+		resp, _ = post("/v1/no-usage", `{"model":"local","messages":[{"role":"user","content":"sixteen chars!!!"}]}`)
+		require.Equal(t, "4", resp.Header.Get("X-Llm-Usage-Input-Tokens"))
+		require.Equal(t, "3", resp.Header.Get("X-Llm-Usage-Output-Tokens"))
+		require.Equal(t, "true", resp.Header.Get("X-Llm-Usage-Estimated"))
+
+		// The streaming response is passed through, and its usage is only in the metrics.
+		resp, body := post("/v1/messages", `{"model":"claude-test","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+		require.Contains(t, body, "message_delta")
+		require.Empty(t, resp.Header.Get("X-Llm-Usage-Input-Tokens"))
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:9901/stats/prometheus")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			tokens := map[string]float64{}
+			decoder := expfmt.NewDecoder(resp.Body, expfmt.NewFormat(expfmt.TypeTextPlain))
+			for {
+				var metricFamily io_prometheus_client.MetricFamily
+				err := decoder.Decode(&metricFamily)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				if metricFamily.GetName() != "llm_tokens_total" {
+					continue
+				}
+				for _, metric := range metricFamily.GetMetric() {
+					labels := make(map[string]string)
+					for _, label := range metric.GetLabel() {
+						labels[label.GetName()] = label.GetValue()
+					}
+					if labels["tenant"] == "acme" && labels["model"] == "claude-test" {
+						tokens[labels["type"]+"/"+labels["source"]] = metric.GetCounter().GetValue()
+					}
+				}
+			}
+			t.Logf("claude-test tokens: %v", tokens)
+			return tokens["input/reported"] == 20 && tokens["output/reported"] == 7
+		}, 5*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("sse_transform", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1116/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		start := time.Now()
+		resp, err := http.Get("http://localhost:1116/sse?count=3&duration=2s")
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		// Each event is sent on as soon as it is complete, not at the end of the stream.
+		reader := bufio.NewReader(resp.Body)
+		var first string
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			first += line
+			if line == "\n" {
+				break
+			}
+		}
+		require.Less(t, time.Since(start), time.Second)
+		require.Equal(t, "event: ping\ndata: {\"id\":0,\"proxied\":true}\n\n", first)
+
+		// The event 1 is dropped.
+		rest, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "event: ping\ndata: {\"id\":2,\"proxied\":true}\n\n", string(rest))
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1117/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The lines are redacted, and the ones not matching the schema are dropped.
+		body := `{"id":1,"user":{"email":"alice@example.com","name":"Alice"}}` + "\n" +
+			`{"user":{"email":"bob@example.com"}}` + "\n" +
+			"not json\n" +
+			`{"id":2}` + "\n"
+		resp, err := http.Post("http://localhost:1117/anything", "application/x-ndjson", strings.NewReader(body))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var echo struct {
+			Data string `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+		require.Equal(t, `{"id":1,"user":{"email":"[REDACTED]","name":"Alice"}}`+"\n"+`{"id":2}`+"\n", echo.Data)
+	})
+
+	t.Run("image_transform", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1118/image/png")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		get := func(path, accept string) (*http.Response, []byte) {
+			req, err := http.NewRequest("GET", "http://localhost:"+path, nil)
+			require.NoError(t, err)
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			return resp, body
+		}
+
+		// The image is resized keeping its aspect ratio.
+		resp, body := get("1118/image/png?w=50", "")
+		require.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+		config, err := png.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 50, config.Width)
+		require.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+
+		// The image is converted to WebP when the client accepts it and it is smaller.
+		resp, body = get("1118/image/png", "image/webp,image/*")
+		require.Equal(t, "image/webp", resp.Header.Get("Content-Type"))
+		require.Equal(t, "Accept", resp.Header.Get("Vary"))
+		require.Equal(t, "RIFF", string(body[:4]))
+		require.Equal(t, "WEBP", string(body[8:12]))
+
+		// Without a transformation, the image is passed through unchanged.
+		_, original := get("1234/image/png", "")
+		_, body = get("1118/image/png", "")
+		require.Equal(t, original, body)
+
+		// The invalid parameters are rejected.
+		resp, err = http.Get("http://localhost:1118/image/png?w=5000")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("static_assets", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1119/robots.txt")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		get := func(path string, header http.Header) (*http.Response, string) {
+			req, err := http.NewRequest("GET", "http://localhost:1119"+path, nil)
+			require.NoError(t, err)
+			maps.Copy(req.Header, header)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, string(body)
+		}
+
+		// The inline assets are served with the caching headers.
+		resp, body := get("/robots.txt?v=1", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "User-agent: *\nDisallow: /\n", body)
+		require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		require.Equal(t, "public, max-age=86400", resp.Header.Get("Cache-Control"))
+		etag := resp.Header.Get("ETag")
+		require.NotEmpty(t, etag)
+
+		// The revalidations with the same ETag are answered with 304.
+		resp, body = get("/robots.txt", http.Header{"If-None-Match": {`"other", W/` + etag}})
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+		require.Empty(t, body)
+		require.Equal(t, etag, resp.Header.Get("ETag"))
+
+		// The assets are also served from files.
+		resp, body = get("/.well-known/security.txt", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, body, "Contact: mailto:security@example.com")
+		require.Equal(t, "public, max-age=60", resp.Header.Get("Cache-Control"))
+
+		// The ACME challenges are served from their directory, and the unknown ones go upstream.
+		resp, body = get("/.well-known/acme-challenge/test-token_1", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "test-token_1.key-thumbprint", body)
+		require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+		resp, _ = get("/.well-known/acme-challenge/unknown", nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// The other methods are not allowed.
+		resp, err := http.Post("http://localhost:1119/robots.txt", "text/plain", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		require.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+	})
+
+	t.Run("redirect_map", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		get := func(path string) *http.Response {
+			resp, err := client.Get("http://localhost:1120" + path)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			return resp
+		}
+		require.Eventually(t, func() bool {
+			resp, err := client.Get("http://localhost:1120/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The exact matches keep the query.
+		resp := get("/old-page?a=1")
+		require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		require.Equal(t, "/anything/new-page?a=1", resp.Header.Get("Location"))
+
+		// The prefix matches append the rest of the path, and the exact ones win over them.
+		resp = get("/docs/guide/intro")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		require.Equal(t, "https://docs.example.com/guide/intro", resp.Header.Get("Location"))
+		resp = get("/docs/legacy")
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		require.Equal(t, "/anything/legacy", resp.Header.Get("Location"))
+
+		// The map is reloaded when the file changes.
+		redirectsFile := cwd + "/testdata/redirects.csv"
+		original, err := os.ReadFile(redirectsFile)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, os.WriteFile(redirectsFile, original, 0o644)) }()
+		require.Equal(t, http.StatusOK, get("/anything/added").StatusCode)
+		require.NoError(t, os.WriteFile(redirectsFile, append(slices.Clone(original), "/anything/added,/anything/target,307\n"...), 0o644))
+		require.Eventually(t, func() bool {
+			return get("/anything/added").StatusCode == http.StatusTemporaryRedirect
+		}, 5*time.Second, 100*time.Millisecond)
+		require.Equal(t, "/anything/target", get("/anything/added").Header.Get("Location"))
+	})
+
+	t.Run("query_params", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1121/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		upstreamURL := func(query string) string {
+			resp, err := http.Get("http://localhost:1121/anything?" + query)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var echo struct {
+				URL string `json:"url"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+			_, upstreamQuery, _ := strings.Cut(echo.URL, "?")
+			return upstreamQuery
+		}
+
+		// The tracking parameters are removed, and the rest is renamed, sorted and re-encoded.
+		require.Equal(t, "a=1&api_version=2&b=~&query=hello+world",
+			upstreamURL("utm_source=news&q=hello%20world&b=~&fbclid=x&empty=&a=1&api_version=1"))
+		// The same query in another order is the same cache key.
+		require.Equal(t, "a=1&api_version=2&b=~&query=hello+world",
+			upstreamURL("b=%7e&a=1&q=hello+world"))
+	})
+
+	t.Run("conditional", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1122/json")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		get := func(path string, header http.Header) (*http.Response, []byte) {
+			req, err := http.NewRequest("GET", "http://localhost:1122"+path, nil)
+			require.NoError(t, err)
+			maps.Copy(req.Header, header)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, body
+		}
+
+		// The ETag is generated from the body when the upstream doesn't send one.
+		resp, body := get("/json", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NotEmpty(t, body)
+		etag := resp.Header.Get("ETag")
+		require.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+
+		// The revalidations with the ETag get a 304 without the body.
+		resp, body = get("/json", http.Header{"If-None-Match": {etag}})
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+		require.Empty(t, body)
+		require.Equal(t, etag, resp.Header.Get("ETag"))
+		resp, _ = get("/json", http.Header{"If-None-Match": {`W/"stale", W/` + etag}})
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+		resp, body = get("/json", http.Header{"If-None-Match": {`"stale"`}})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NotEmpty(t, body)
+
+		// The Last-Modified of the upstream is used for If-Modified-Since.
+		const lastModified = "/response-headers?Last-Modified=Mon,%2001%20Jan%202024%2000:00:00%20GMT"
+		resp, _ = get(lastModified, http.Header{"If-Modified-Since": {"Tue, 02 Jan 2024 00:00:00 GMT"}})
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+		require.Equal(t, "Mon, 01 Jan 2024 00:00:00 GMT", resp.Header.Get("Last-Modified"))
+		resp, _ = get(lastModified, http.Header{"If-Modified-Since": {"Sun, 31 Dec 2023 00:00:00 GMT"}})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("abi_bench", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1123/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// ABI_BENCH_REQUESTS raises the number of requests for a stable benchmark, such as with
+		// "make bench-abi".
+		requests, err := strconv.Atoi(cmp.Or(os.Getenv("ABI_BENCH_REQUESTS"), "20"))
+		require.NoError(t, err)
+		operations := []string{
+			"header_get", "header_get_all", "header_set", "attribute",
+			"scheduler", "body_get_chunks", "body_get_size",
+		}
+		totals := map[string]float64{}
+		for range requests {
+			resp, err := http.Post("http://localhost:1123/anything", "text/plain", strings.NewReader("hello"))
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			for _, operation := range operations {
+				ns, err := strconv.ParseFloat(resp.Header.Get("X-Abi-Bench-"+operation+"-Ns"), 64)
+				require.NoError(t, err, operation)
+				require.Positive(t, ns, operation)
+				totals[operation] += ns
+			}
+		}
+		for _, operation := range operations {
+			t.Logf("%-16s %8.1f ns/call", operation, totals[operation]/float64(requests))
+		}
+	})
+
+	t.Run("debug_server", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1124/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The runtime stats of the module are served as JSON.
+		resp, err := http.Get("http://127.0.0.1:6060/debug/runtime")
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var stats struct {
+			Goroutines int   `json:"goroutines"`
+			HeapBytes  int64 `json:"heap_bytes"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+		require.Positive(t, stats.Goroutines)
+		require.Positive(t, stats.HeapBytes)
+
+		// The filter of the request above is unpinned and collected once its stream completed.
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://127.0.0.1:6060/debug/runtime?gc")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var filters struct {
+				LiveFilters     map[string]int64 `json:"live_filters"`
+				InFlightFilters map[string]int64 `json:"in_flight_filters"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&filters))
+			live, counted := filters.LiveFilters["debug_server"]
+			return counted && live == 0 && filters.InFlightFilters["debug_server"] == 0
+		}, 10*time.Second, 100*time.Millisecond)
+
+		// The pprof profiles are served too.
+		resp, err = http.Get("http://127.0.0.1:6060/debug/pprof/goroutine?debug=1")
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "goroutine profile:")
+	})
+
+	t.Run("runtime_tuning", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1125/anything")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusOK
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// The settings are read back from the debug server of the same module.
+		resp, err := http.Get("http://127.0.0.1:6060/debug/runtime")
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		var stats struct {
+			GOMAXPROCS  int   `json:"gomaxprocs"`
+			MemoryLimit int64 `json:"memory_limit_bytes"`
+			GCPercent   int   `json:"gc_percent"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+		require.Equal(t, 1, stats.GOMAXPROCS)
+		require.Equal(t, int64(1<<30), stats.MemoryLimit)
+		require.Equal(t, 50, stats.GCPercent)
+	})
+
+	t.Run("scheduler_stress", func(t *testing.T) {
+		// The requests going through the scheduler paths at once, from the goroutines of the delay
+		// and JavaScript filters and the scheduler loop of the ABI benchmark. Run against the module
+		// built with -race to catch the races between the workers and the goroutines.
+		requests, err := strconv.Atoi(cmp.Or(os.Getenv("STRESS_REQUESTS"), "30"))
+		require.NoError(t, err)
+		type target struct{ url, header string }
+		targets := []target{
+			{"http://localhost:1062/headers", "do-delay"},
+			{"http://localhost:1062/headers", "js-delay"},
+			{"http://localhost:1123/anything", ""},
+		}
+		var wg sync.WaitGroup
+		statuses := make([]int, requests)
+		for i := range requests {
+			wg.Go(func() {
+				tg := targets[i%len(targets)]
+				req, err := http.NewRequest("GET", tg.url, nil)
+				if err != nil {
+					return
+				}
+				if tg.header != "" {
+					req.Header.Set(tg.header, "true")
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Logf("request %d failed: %v", i, err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+				statuses[i] = resp.StatusCode
+			})
+		}
+		wg.Wait()
+		for i, status := range statuses {
+			require.Equal(t, http.StatusOK, status, "request %d to %s", i, targets[i%len(targets)].url)
+		}
+	})
+
+	t.Run("scheduler_stress_delayed_streams", func(t *testing.T) {
+		// STRESS_DELAYED_STREAMS requests are held by the delay filter at once, each for a random
+		// delay, and about a third of them are cancelled by the client while or after they are
+		// delayed. The others must all be continued by the Commit of their scheduler, which would
+		// hang if one were lost, and the filters and schedulers of all of them must be freed.
+		streams, err := strconv.Atoi(cmp.Or(os.Getenv("STRESS_DELAYED_STREAMS"), "2000"))
+		require.NoError(t, err)
+		type runtimeStats struct {
+			Goroutines      int              `json:"goroutines"`
+			LiveFilters     map[string]int64 `json:"live_filters"`
+			InFlightFilters map[string]int64 `json:"in_flight_filters"`
+		}
+		readStats := func() runtimeStats {
+			resp, err := http.Get("http://127.0.0.1:6060/debug/runtime?gc")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var stats runtimeStats
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+			return stats
+		}
+		baseline := readStats()
+		t.Logf("baseline: %+v", baseline)
+
+		// Each request has a connection of its own, so that the cancellations don't affect others.
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		defer client.CloseIdleConnections()
+		var wg sync.WaitGroup
+		var committed, cancelled atomic.Int64
+		var failure error
+		var failureMu sync.Mutex
+		fail := func(err error) {
+			failureMu.Lock()
+			failure = cmp.Or(failure, err)
+			failureMu.Unlock()
+		}
+		start := make(chan struct{})
+		for i := range streams {
+			wg.Go(func() {
+				delay := time.Millisecond + rand.N(time.Second)
+				// The cancelled requests are timed out before, around or after the Commit.
+				timeout := 30 * time.Second
+				cancel := i%3 == 0
+				if cancel {
+					timeout = rand.N(3 * delay / 2)
+				}
+				ctx, cancelCtx := context.WithTimeout(t.Context(), timeout)
+				defer cancelCtx()
+				req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost:1062/headers", nil)
+				if err != nil {
+					fail(err)
+					return
+				}
+				req.Header.Set("do-delay", delay.String())
+				<-start
+				resp, err := client.Do(req)
+				if err != nil {
+					if cancel && errors.Is(err, context.DeadlineExceeded) {
+						cancelled.Add(1)
+						return
+					}
+					fail(fmt.Errorf("request %d delayed by %s: %w", i, delay, err))
+					return
+				}
+				defer func() { _ = resp.Body.Close() }()
+				var body struct {
+					Headers map[string][]string `json:"headers"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					if cancel && errors.Is(err, context.DeadlineExceeded) {
+						cancelled.Add(1)
+						return
+					}
+					fail(fmt.Errorf("request %d delayed by %s: %w", i, delay, err))
+					return
+				}
+				lapsed, err := time.ParseDuration(resp.Header.Get("x-delay-filter-lapsed"))
+				if resp.StatusCode != http.StatusOK || !slices.Contains(body.Headers["Delay-Filter-On-Scheduled"], "yes") || err != nil || lapsed < delay {
+					fail(fmt.Errorf("request %d delayed by %s was not continued by the scheduler: status %d, lapsed %q, headers %v",
+						i, delay, resp.StatusCode, resp.Header.Get("x-delay-filter-lapsed"), body.Headers))
+					return
+				}
+				committed.Add(1)
+			})
+		}
+		close(start)
+		wg.Wait()
+		t.Logf("%d requests committed, %d cancelled", committed.Load(), cancelled.Load())
+		require.NoError(t, failure)
+		require.Equal(t, int64(streams), committed.Load()+cancelled.Load())
+
+		// The workers are not deadlocked by the cancellations.
+		req, err := http.NewRequest("GET", "http://localhost:1062/headers", nil)
+		require.NoError(t, err)
+		req.Header.Set("do-delay", "10ms")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// The goroutines of the cancelled requests hold their filter and its scheduler until the
+		// delay lapsed, and the scheduler is only deleted once it is collected. A filter of the
+		// delay filter still live after the garbage collection is a leaked scheduler.
+		var last runtimeStats
+		require.Eventually(t, func() bool {
+			last = readStats()
+			return last.LiveFilters["delay"] == 0 && last.InFlightFilters["delay"] == 0 &&
+				last.Goroutines <= baseline.Goroutines+5
+		}, 30*time.Second, time.Second, "the delay filter leaks: baseline %+v, last %+v", baseline, &last)
+	})
+
+	t.Run("soak", func(t *testing.T) {
+		// The soak test drives the filters using goroutines, the scheduler and the JavaScript VMs
+		// for SOAK_DURATION, such as "10m", and checks that the goroutines and the live heap of the
+		// module return to where they were after a warm-up, which catches the leaks that the short
+		// tests don't.
+		duration, err := time.ParseDuration(cmp.Or(os.Getenv("SOAK_DURATION"), "0"))
+		require.NoError(t, err)
+		if duration <= 0 {
+			t.Skip("SOAK_DURATION is not set")
+		}
+		type runtimeStats struct {
+			Goroutines int   `json:"goroutines"`
+			HeapBytes  int64 `json:"heap_bytes"`
+		}
+		readStats := func() runtimeStats {
+			resp, err := http.Get("http://127.0.0.1:6060/debug/runtime?gc")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			var stats runtimeStats
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+			return stats
+		}
+		targets := []struct{ url, header string }{
+			{"http://localhost:1062/headers", ""},
+			{"http://localhost:1062/headers", "do-delay"},
+			{"http://localhost:1062/headers", "js-delay"},
+			{"http://localhost:1123/anything", ""},
+		}
+		drive := func(d time.Duration) (sent, failed int64) {
+			var sentCount, failedCount atomic.Int64
+			deadline := time.Now().Add(d)
+			var wg sync.WaitGroup
+			for worker := range 16 {
+				wg.Go(func() {
+					for i := worker; time.Now().Before(deadline); i++ {
+						target := targets[i%len(targets)]
+						req, err := http.NewRequest("GET", target.url, nil)
+						require.NoError(t, err)
+						if target.header != "" {
+							req.Header.Set(target.header, "true")
+						}
+						sentCount.Add(1)
+						resp, err := http.DefaultClient.Do(req)
+						if err != nil {
+							failedCount.Add(1)
+							continue
+						}
+						_, _ = io.Copy(io.Discard, resp.Body)
+						_ = resp.Body.Close()
+						if resp.StatusCode != http.StatusOK {
+							failedCount.Add(1)
+						}
+					}
+				})
+			}
+			wg.Wait()
+			return sentCount.Load(), failedCount.Load()
+		}
+
+		// The warm-up fills the pools and the lazily created VMs, which are not leaks.
+		drive(10 * time.Second)
+		baseline := readStats()
+		t.Logf("baseline: %+v", baseline)
+		sent, failed := drive(duration)
+		t.Logf("sent %d requests, %d failed", sent, failed)
+		require.Zero(t, failed)
+
+		// The goroutines of the delayed requests take a moment to finish.
+		var last runtimeStats
+		require.Eventually(t, func() bool {
+			last = readStats()
+			t.Logf("after the soak: %+v", last)
+			return last.Goroutines <= baseline.Goroutines+5 && last.HeapBytes <= baseline.HeapBytes*3/2+16<<20
+		}, 30*time.Second, time.Second, "the module leaks: baseline %+v, last %+v", baseline, &last)
+	})
+
+	t.Run("lds_reload", func(t *testing.T) {
+		// A second Envoy loads the listener on 1126 from a file, which is rewritten under traffic
+		// with a new version of the JavaScript filter config each time. The requests must not
+		// fail on the swaps, and the replaced configs and their VMs must be freed after the
+		// listener drained them. RELOAD_SWAPS sets the number of the swaps.
+		ldsDir := cwd + "/lds"
+		require.NoError(t, os.RemoveAll(ldsDir))
+		require.NoError(t, os.Mkdir(ldsDir, 0o755))
+		defer func() { _ = os.RemoveAll(ldsDir) }()
+		writeReloadListener(t, ldsDir, 0)
+		reloadEnvoy := envoytest.StartEnvoy(t, envoytest.Config{
+			ConfigPath:   "lds_reload.yaml",
+			Image:        os.Getenv("ENVOY_IMAGE"),
+			CoverageDir:  coverageDir,
+			AdminAddress: "localhost:9902",
+			Env:          []string{"GODEBUG=cgocheck=0"},
+			Args:         []string{"--log-level", "warn", "--drain-time-s", "1", "--drain-strategy", "immediate"},
+		})
+		reloadEnvoy.WaitReady()
+
+		version := func() string {
+			resp, err := http.Get("http://localhost:1126/headers")
+			if err != nil {
+				return ""
+			}
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			return resp.Header.Get("x-lds-version")
+		}
+		require.Eventually(t, func() bool { return version() == "0" }, 10*time.Second, 100*time.Millisecond)
+
+		var sent, serverErrors, transportErrors atomic.Int64
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Go(func() {
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					sent.Add(1)
+					resp, err := http.Get("http://localhost:1126/headers")
+					if err != nil {
+						// The connections drained by the swaps may be closed under a request.
+						transportErrors.Add(1)
+						continue
+					}
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+					if resp.StatusCode >= 500 {
+						serverErrors.Add(1)
+					}
+				}
+			})
+		}
+		swaps, _ := strconv.Atoi(cmp.Or(os.Getenv("RELOAD_SWAPS"), "20"))
+		for i := 1; i <= swaps; i++ {
+			writeReloadListener(t, ldsDir, i)
+			require.Eventually(t, func() bool { return version() == strconv.Itoa(i) }, 10*time.Second, 50*time.Millisecond)
+		}
+		close(stop)
+		wg.Wait()
+		t.Logf("sent %d requests over %d swaps, %d transport errors", sent.Load(), swaps, transportErrors.Load())
+		require.Zero(t, serverErrors.Load())
+
+		// Only the config of the last version and its VM remain once the drained configs are
+		// collected.
+		var stats struct {
+			LiveConfigs   map[string]int64 `json:"live_configs"`
+			JavaScriptVMs int64            `json:"javascript_vms"`
+		}
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://127.0.0.1:6061/debug/runtime?gc")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+			t.Logf("live configs: %v, JavaScript VMs: %d", stats.LiveConfigs, stats.JavaScriptVMs)
+			return stats.LiveConfigs["javascript"] == 1 && stats.JavaScriptVMs == 1
+		}, 30*time.Second, time.Second)
+	})
+
+	t.Run("sdk_bench", func(t *testing.T) {
+		// A third Envoy runs the same workloads through the filters of each SDK on their own
+		// listeners, and the latencies and the CPU of Envoy per request are compared. The requests
+		// are few by default so that the listeners are only checked; SDK_BENCH_REQUESTS and
+		// SDK_BENCH_CONCURRENCY set them for a stable benchmark, such as with "make bench-sdk".
+		benchEnvoy := envoytest.StartEnvoy(t, envoytest.Config{
+			ConfigPath:   "sdk_bench.yaml",
+			Image:        os.Getenv("ENVOY_IMAGE"),
+			CoverageDir:  coverageDir,
+			AdminAddress: "localhost:9903",
+			Env:          []string{"GODEBUG=cgocheck=0"},
+			Args:         []string{"--log-level", "warn"},
+		})
+		benchEnvoy.WaitReady()
+
+		requests, err := strconv.Atoi(cmp.Or(os.Getenv("SDK_BENCH_REQUESTS"), "50"))
+		require.NoError(t, err)
+		concurrency, err := strconv.Atoi(cmp.Or(os.Getenv("SDK_BENCH_CONCURRENCY"), "4"))
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: concurrency}}
+		for _, c := range []struct {
+			name string
+			port int
+			// mutated is whether the filter sets the headers of the header_mutation workload.
+			mutated bool
+		}{
+			{name: "baseline", port: 1128},
+			{name: "go_passthrough", port: 1129},
+			{name: "rust_passthrough", port: 1130},
+			{name: "javascript_passthrough", port: 1131},
+			{name: "go_header_mutation", port: 1132, mutated: true},
+			{name: "rust_header_mutation", port: 1133, mutated: true},
+			{name: "javascript_header_mutation", port: 1134, mutated: true},
+		} {
+			url := fmt.Sprintf("http://localhost:%d/headers", c.port)
+			require.Eventually(t, func() bool {
+				resp, err := client.Get(url)
+				if err != nil {
+					return false
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				require.NoError(t, resp.Body.Close())
+				return resp.StatusCode == http.StatusOK
+			}, 30*time.Second, 200*time.Millisecond, c.name)
+
+			// The warm-up opens the connections and, for JavaScript, compiles the script on the
+			// worker before the measurement.
+			sdkBenchRun(t, client, url, max(requests/10, concurrency), concurrency, c.mutated)
+			cpuBefore, cpuErr := benchEnvoy.CPUTime()
+			start := time.Now()
+			latencies := sdkBenchRun(t, client, url, requests, concurrency, c.mutated)
+			elapsed := time.Since(start)
+			cpuAfter, err := benchEnvoy.CPUTime()
+			cpu := "n/a"
+			if cpuErr == nil && err == nil {
+				cpu = fmt.Sprintf("%.1fµs/req", float64((cpuAfter-cpuBefore).Microseconds())/float64(requests))
+			} else {
+				t.Logf("CPU time of Envoy not available: %v", cmp.Or(cpuErr, err))
+			}
+			slices.Sort(latencies)
+			t.Logf("%-28s p50 %8s  p99 %8s  %8.0f req/s  cpu %s", c.name,
+				latencies[len(latencies)/2], latencies[(len(latencies)*99)/100],
+				float64(requests)/elapsed.Seconds(), cpu)
+		}
+	})
+
+	t.Run("generated_config", func(t *testing.T) {
+		// envoy.generated.yaml, generated with "make envoy-config", runs each Go filter on its own
+		// listener with the example config of its config type. Envoy refuses the whole config if
+		// any filter fails to create its config, so starting it checks that every registered filter
+		// is runnable with the generated config, after which each listener must answer.
+		config, err := os.ReadFile("envoy.generated.yaml")
+		require.NoError(t, err)
+		listeners := regexp.MustCompile(`(?m)^    - name: (\w+)\n(?:.*\n){3}\s+port_value: (\d+)$`).FindAllStringSubmatch(string(config), -1)
+		require.NotEmpty(t, listeners)
+
+		generatedEnvoy := envoytest.StartEnvoy(t, envoytest.Config{
+			ConfigPath:   "envoy.generated.yaml",
+			Image:        os.Getenv("ENVOY_IMAGE"),
+			CoverageDir:  coverageDir,
+			AdminAddress: "localhost:9904",
+			Env:          []string{"GODEBUG=cgocheck=0"},
+			Args:         []string{"--log-level", "warn"},
+		})
+		generatedEnvoy.WaitReady()
+
+		for _, listener := range listeners {
+			name, port := listener[1], listener[2]
+			require.Eventually(t, func() bool {
+				resp, err := http.Get("http://localhost:" + port + "/headers")
+				if err != nil {
+					t.Logf("%s not answering yet: %v", name, err)
+					return false
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				require.NoError(t, resp.Body.Close())
+				t.Logf("%s answered %d", name, resp.StatusCode)
+				return true
+			}, 10*time.Second, 200*time.Millisecond, name)
+		}
+	})
+
+	t.Run("grpc", func(t *testing.T) {
+		conn, err := grpc.NewClient("localhost:1135", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, conn.Close()) }()
+		sayHello := func(name string) (*wrapperspb.StringValue, metadata.MD, error) {
+			ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+			defer cancel()
+			var reply wrapperspb.StringValue
+			var trailer metadata.MD
+			err := conn.Invoke(ctx, "/helloworld.Greeter/SayHello", wrapperspb.String(name), &reply, grpc.Trailer(&trailer))
+			return &reply, trailer, err
+		}
+		sayHelloStream := func(name string) ([]string, []time.Time, metadata.MD, error) {
+			ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+			defer cancel()
+			stream, err := conn.NewStream(ctx, &greeterServiceDesc.Streams[0], "/helloworld.Greeter/SayHelloStream")
+			require.NoError(t, err)
+			require.NoError(t, stream.SendMsg(wrapperspb.String(name)))
+			require.NoError(t, stream.CloseSend())
+			var replies []string
+			var received []time.Time
+			for {
+				var reply wrapperspb.StringValue
+				if err = stream.RecvMsg(&reply); err != nil {
+					break
+				}
+				replies = append(replies, reply.GetValue())
+				received = append(received, time.Now())
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			return replies, received, stream.Trailer(), err
+		}
+		require.Eventually(t, func() bool {
+			_, _, err := sayHello("ready")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+			}
+			return err == nil
+		}, 30*time.Second, 200*time.Millisecond)
+
+		t.Run("trailers", func(t *testing.T) {
+			reply, trailer, err := sayHello("world")
+			require.NoError(t, err)
+			require.Equal(t, "Hello world", reply.GetValue())
+			// The trailers of the upstream are propagated along with the one set by the filter.
+			require.Equal(t, []string{"hello"}, trailer.Get("x-greeter"))
+			require.Equal(t, []string{"1"}, trailer.Get("x-grpc-response-messages"))
+			require.Empty(t, trailer.Get("x-grpc-original-status"))
+		})
+
+		t.Run("trailers-only status", func(t *testing.T) {
+			_, trailer, err := sayHello("unavailable")
+			// UNAVAILABLE is rewritten to RESOURCE_EXHAUSTED in the headers of the trailers-only
+			// response, and the message is kept.
+			require.Equal(t, codes.ResourceExhausted, status.Code(err), err)
+			require.Equal(t, "the greeter is unavailable", status.Convert(err).Message())
+			require.Equal(t, []string{"14"}, trailer.Get("x-grpc-original-status"))
+			require.Equal(t, []string{"0"}, trailer.Get("x-grpc-response-messages"))
+		})
+
+		t.Run("streaming", func(t *testing.T) {
+			replies, received, trailer, err := sayHelloStream("abcd")
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", "b", "c", "d"}, replies)
+			// The messages are sent every 100ms, and must be streamed rather than buffered by the
+			// filter until the end of the response.
+			require.GreaterOrEqual(t, received[len(received)-1].Sub(received[0]), 200*time.Millisecond)
+			require.Equal(t, []string{"stream"}, trailer.Get("x-greeter"))
+			require.Equal(t, []string{"4"}, trailer.Get("x-grpc-response-messages"))
+			require.Empty(t, trailer.Get("x-grpc-original-status"))
+		})
+
+		t.Run("streaming status in trailers", func(t *testing.T) {
+			replies, _, trailer, err := sayHelloStream("unavailable")
+			require.Len(t, replies, len("unavailable"))
+			require.Equal(t, codes.ResourceExhausted, status.Code(err), err)
+			require.Equal(t, []string{"14"}, trailer.Get("x-grpc-original-status"))
+			require.Equal(t, []string{"11"}, trailer.Get("x-grpc-response-messages"))
+		})
+
+		require.Eventually(t, func() bool {
+			responses := map[string]float64{}
+			for _, metric := range envoy.Stats()["grpc_status_responses_total"].GetMetric() {
+				labels := map[string]string{}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				responses[labels["status"]+"/"+labels["rewritten"]] += metric.GetCounter().GetValue()
+			}
+			return responses["8/true"] >= 2 && responses["0/false"] >= 2
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("hook_timing", func(t *testing.T) {
+		// The request is rejected by header_auth, whose hooks are timed as every Go filter's.
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:1063/uuid")
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode == http.StatusUnauthorized
+		}, 30*time.Second, 200*time.Millisecond)
+		require.Eventually(t, func() bool {
+			for _, metric := range envoy.Stats()["go_filter_hook_duration_nanoseconds"].GetMetric() {
+				labels := map[string]string{}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				if labels["filter"] == "header_auth" && labels["hook"] == "request_headers" && metric.GetHistogram().GetSampleCount() > 0 {
+					return true
+				}
+			}
+			return false
+		}, 30*time.Second, 200*time.Millisecond)
+	})
+
+	t.Run("http_metrics", func(t *testing.T) {
+		// Send test request
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("GET", "http://localhost:1062/uuid", nil)
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Logf("Envoy not ready yet: %v", err)
+				return false
+			}
+			t.Logf("response: status=%d body=%s", resp.StatusCode, string(body))
+			return resp.StatusCode == 200
+		}, 30*time.Second, 200*time.Millisecond)
+
+		// Check the metrics endpoint
+		lastStatsOutput := ""
+		t.Cleanup(func() {
+			t.Logf("last stats output:\n%s", lastStatsOutput)
+		})
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest("GET", "http://localhost:9901/stats/prometheus", nil)
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, resp.Body.Close())
+			}()
+
+			// Check that the route_latency_ms metric is present
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			lastStatsOutput = string(body)
+
+			decoder := expfmt.NewDecoder(bytes.NewReader(body), expfmt.NewFormat(expfmt.TypeTextPlain))
+			for {
+				var metricFamily io_prometheus_client.MetricFamily
+				err := decoder.Decode(&metricFamily)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+
+				if metricFamily.GetName() != "route_latency_ms" {
+					continue
+				}
+				for _, metric := range metricFamily.GetMetric() {
+					hist := metric.GetHistogram()
+					require.NotNil(t, hist)
+					labels := make(map[string]string)
+					for _, label := range metric.GetLabel() {
+						labels[label.GetName()] = label.GetValue()
+					}
+					require.Equal(t, map[string]string{"version": "v1.0.0", "route_name": "catch_all"}, labels)
+					if hist.GetSampleCount() > 0 {
+						return true
+					}
+				}
+			}
+			t.Logf("route_latency_ms metric not found or no samples yet")
+			return false
+		}, 5*time.Second, 200*time.Millisecond)
+	})
+}
+
+// writeGeoIPDatabase atomically writes a MaxMind DB with the fixed test networks, where country is
+// the country of 198.51.100.0/24.
+func writeGeoIPDatabase(t *testing.T, path, country string) {
+	db, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoIP2-Country", IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	for cidr, record := range map[string]mmdbtype.Map{
+		"198.51.100.0/24": {
+			"country":                  mmdbtype.Map{"iso_code": mmdbtype.String(country)},
+			"autonomous_system_number": mmdbtype.Uint32(64496),
+		},
+		"203.0.113.0/24": {"country": mmdbtype.Map{"iso_code": mmdbtype.String("KP")}},
+		"192.0.2.0/25":   {"autonomous_system_number": mmdbtype.Uint32(64511)},
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.NoError(t, db.Insert(network, record))
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	require.NoError(t, err)
+	_, err = db.WriteTo(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+// writeReloadListener atomically writes the listener of the lds_reload test, whose JavaScript
+// filter returns the version in the x-lds-version response header.
+func writeReloadListener(t *testing.T, dir string, version int) {
+	script := `function OnConfigure() {}
+function OnRequestHeaders(ctx) {}
+function OnResponseHeaders(ctx) { ctx.setResponseHeader("x-lds-version", "` + strconv.Itoa(version) + `"); }`
+	filterConfig, err := json.Marshal(map[string]any{"script": script, "concurrency": 1})
+	require.NoError(t, err)
+	listener := map[string]any{
+		"@type": "type.googleapis.com/envoy.config.listener.v3.Listener",
+		"name":  "lds_reload",
+		"address": map[string]any{
+			"socket_address": map[string]any{"address": "0.0.0.0", "port_value": 1126},
+		},
+		"filter_chains": []any{map[string]any{
+			"filters": []any{map[string]any{
+				"name": "envoy.filters.network.http_connection_manager",
+				"typed_config": map[string]any{
+					"@type":       "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+					"stat_prefix": "lds_reload",
+					"route_config": map[string]any{
+						"virtual_hosts": []any{map[string]any{
+							"name":    "local_route",
+							"domains": []string{"*"},
+							"routes":  []any{map[string]any{"match": map[string]any{"prefix": "/"}, "route": map[string]any{"cluster": "httpbin"}}},
+						}},
+					},
+					"http_filters": []any{
+						map[string]any{
+							"name": "dynamic_modules/javascript",
+							"typed_config": map[string]any{
+								"@type":                 "type.googleapis.com/envoy.extensions.filters.http.dynamic_modules.v3.DynamicModuleFilter",
+								"dynamic_module_config": map[string]any{"name": "go_module", "do_not_close": true},
+								"filter_name":           "javascript",
+								"filter_config": map[string]any{
+									"@type": "type.googleapis.com/google.protobuf.StringValue",
+									"value": string(filterConfig),
+								},
+							},
+						},
+						map[string]any{
+							"name":         "envoy.filters.http.router",
+							"typed_config": map[string]any{"@type": "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router"},
+						},
+					},
+				},
+			}},
+		}},
+	}
+	data, err := json.Marshal(map[string]any{"version_info": strconv.Itoa(version), "resources": []any{listener}})
+	require.NoError(t, err)
+	// Envoy reloads the file when it is moved into the watched directory.
+	tmp := dir + "/listeners.json.tmp"
+	require.NoError(t, os.WriteFile(tmp, data, 0o644))
+	require.NoError(t, os.Rename(tmp, dir+"/listeners.json"))
+}
+
+// sdkBenchRun sends the GET requests of the sdk_bench test with the concurrency, and returns their
+// latencies. The responses of the filters of the header_mutation workload must have its headers.
+func sdkBenchRun(t *testing.T, client *http.Client, url string, requests, concurrency int, mutated bool) []time.Duration {
+	latencies := make([]time.Duration, requests)
+	var next atomic.Int64
+	var failureMu sync.Mutex
+	var failure error
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Go(func() {
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= requests {
+					return
+				}
+				start := time.Now()
+				err := func() error {
+					resp, err := client.Get(url)
+					if err != nil {
+						return err
+					}
+					defer func() { _ = resp.Body.Close() }()
+					if _, err = io.Copy(io.Discard, resp.Body); err != nil {
+						return err
+					}
+					if resp.StatusCode != http.StatusOK {
+						return fmt.Errorf("unexpected status %d", resp.StatusCode)
+					}
+					if mutated && (resp.Header.Get("Foo") != "bar" || resp.Header.Get("X-Response-Code") != "200") {
+						return fmt.Errorf("headers not mutated: %v", resp.Header)
+					}
+					return nil
+				}()
+				latencies[i] = time.Since(start)
+				if err != nil {
+					failureMu.Lock()
+					failure = cmp.Or(failure, err)
+					failureMu.Unlock()
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	require.NoError(t, failure, url)
+	return latencies
+}
+
+// reportCoverage merges the coverage counters written by the Envoys of the test, logs the coverage
+// by package, and writes it to coverage.out for "go tool cover -html".
+func reportCoverage(t *testing.T, dir string) {
+	out, err := exec.Command("go", "tool", "covdata", "percent", "-i", dir).CombinedOutput()
+	if err != nil {
+		t.Errorf("failed to read the coverage in %s, was the module built with -cover?: %v\n%s", dir, err, out)
+		return
+	}
+	t.Logf("coverage of the Go module:\n%s", out)
+	if out, err := exec.Command("go", "tool", "covdata", "textfmt", "-i", dir, "-o", "coverage.out").CombinedOutput(); err != nil {
+		t.Errorf("failed to write coverage.out: %v\n%s", err, out)
+	}
+}
+
+// greeterServiceDesc is the helloworld.Greeter gRPC service of the greeter upstream, with the
+// messages as wrappers instead of generated ones. SayHello replies "Hello <name>", and
+// SayHelloStream replies a message per letter of the name. Both fail with UNAVAILABLE for the name
+// "unavailable", before any message for SayHello and after all of them for SayHelloStream.
+var greeterServiceDesc = grpc.ServiceDesc{
+	ServiceName: "helloworld.Greeter",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "SayHello",
+		Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			var name wrapperspb.StringValue
+			if err := dec(&name); err != nil {
+				return nil, err
+			}
+			if name.GetValue() == "unavailable" {
+				// No message is sent before the error, so the status is in a trailers-only response.
+				return nil, status.Error(codes.Unavailable, "the greeter is unavailable")
+			}
+			if err := grpc.SetTrailer(ctx, metadata.Pairs("x-greeter", "hello")); err != nil {
+				return nil, err
+			}
+			return wrapperspb.String("Hello " + name.GetValue()), nil
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "SayHelloStream",
+		ServerStreams: true,
+		Handler: func(_ any, stream grpc.ServerStream) error {
+			var name wrapperspb.StringValue
+			if err := stream.RecvMsg(&name); err != nil {
+				return err
+			}
+			stream.SetTrailer(metadata.Pairs("x-greeter", "stream"))
+			for i, letter := range name.GetValue() {
+				if i > 0 {
+					time.Sleep(100 * time.Millisecond)
+				}
+				if err := stream.SendMsg(wrapperspb.String(string(letter))); err != nil {
+					return err
+				}
+			}
+			if name.GetValue() == "unavailable" {
+				return status.Error(codes.Unavailable, "the greeter is unavailable")
+			}
+			return nil
+		},
+	}},
+}
+
+// startGreeter starts the greeter gRPC upstream on addr until the end of the test.
+func startGreeter(t *testing.T, addr string) {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	server.RegisterService(&greeterServiceDesc, nil)
+	go func() {
+		if err := server.Serve(l); err != nil {
+			t.Logf("greeter server error: %v", err)
+		}
+	}()
+	t.Cleanup(server.Stop)
 }